@@ -0,0 +1,161 @@
+/*
+Package access implements role-based access control for bots built with package irc.
+
+A List maps message sources to roles, either by address mask or by services account name.
+Account names are read from the IRCv3 "account" message tag, which servers include
+when the account-tag capability is enabled.
+Accounts should be preferred over masks whenever the network supports them,
+since a nickname can be used by anybody while it's not in use.
+*/
+package access
+
+import (
+	"sync"
+
+	"github.com/Travis-Britz/irc"
+)
+
+// Role is the level of access granted to a message source.
+// Roles are ordered: a higher role includes the permissions of every lower role.
+//
+// The predefined roles cover the common cases,
+// but any int value may be used to define additional levels.
+type Role int
+
+const (
+	RoleNone    Role = 0   // no access; the role of everybody not on a List
+	RoleUser    Role = 10  // known users
+	RoleTrusted Role = 20  // trusted users, e.g. allowed to invite the bot
+	RoleAdmin   Role = 30  // bot administrators
+	RoleOwner   Role = 100 // the bot owner
+)
+
+// A Rule grants Role to messages whose source matches Mask or whose account tag matches Account.
+// If both are set, then both must match.
+type Rule struct {
+
+	// Mask is a wildcard address mask such as "*!*@staff.example.com",
+	// compared with irc.IsWM against the nick!user@host of the message source.
+	Mask string
+
+	// Account is the services account name, compared case-insensitively
+	// against the "account" message tag.
+	Account string
+
+	Role Role
+}
+
+func (r Rule) matches(m *irc.Message) bool {
+	if r.Mask == "" && r.Account == "" {
+		return false
+	}
+	if r.Mask != "" && !irc.IsWM(r.Mask, sourceAddress(m.Source)) {
+		return false
+	}
+	if r.Account != "" {
+		// the account tag is "*" for users who are not logged in on some servers
+		account := m.Tags.Get("account")
+		if account == "" || account == "*" || !irc.Nickname(account).Is(r.Account) {
+			return false
+		}
+	}
+	return true
+}
+
+// sourceAddress returns the full nick!user@host form of p, using '*' for any unknown parts,
+// so that masks can always be matched against the same form.
+func sourceAddress(p irc.Prefix) string {
+	return irc.Mask(p, irc.MaskFull)
+}
+
+// A List holds access rules.
+// It is safe for concurrent use.
+//
+// The zero value is an empty list.
+type List struct {
+	mu    sync.RWMutex
+	rules []Rule
+}
+
+// Add appends rules to the list.
+func (l *List) Add(rules ...Rule) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rules = append(l.rules, rules...)
+}
+
+// Remove deletes every rule equal to r.
+func (l *List) Remove(r Rule) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	kept := l.rules[:0]
+	for _, rule := range l.rules {
+		if rule != r {
+			kept = append(kept, rule)
+		}
+	}
+	l.rules = kept
+}
+
+// Rules returns a copy of the rules in the list.
+func (l *List) Rules() []Rule {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return append([]Rule(nil), l.rules...)
+}
+
+// Role returns the highest role granted by any rule matching the source of m,
+// or RoleNone when no rules match.
+//
+// Messages sent by servers never match any rule.
+func (l *List) Role(m *irc.Message) Role {
+	if l == nil || m.Source.IsServer() {
+		return RoleNone
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	role := RoleNone
+	for _, r := range l.rules {
+		if r.Role > role && r.matches(m) {
+			role = r.Role
+		}
+	}
+	return role
+}
+
+// Allowed reports whether the source of m has at least role.
+func (l *List) Allowed(m *irc.Message, role Role) bool {
+	return l.Role(m) >= role
+}
+
+// Require returns middleware which only calls the next handler
+// when the source of the message has at least role.
+//
+//	r.OnText("!quit", handleQuit).Use(acl.Require(access.RoleOwner))
+func (l *List) Require(role Role) func(irc.Handler) irc.Handler {
+	return func(next irc.Handler) irc.Handler {
+		return irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+			if !l.Allowed(m, role) {
+				return
+			}
+			next.SpeakIRC(w, m)
+		})
+	}
+}
+
+// HelpFilter returns a filter for irc.Router.HelpHandler which hides routes from users
+// who don't have the role required to use them.
+// required maps route names to roles; see the Name method of routes.
+// Routes which are unnamed or missing from required are always listed.
+//
+//	r.OnText("!quit", handleQuit).Name("quit").Help("!quit", "disconnects the bot").Use(acl.Require(access.RoleOwner))
+//	help := r.HelpHandler(acl.HelpFilter(map[string]access.Role{"quit": access.RoleOwner}))
+//	r.OnText("!help", help)
+//	r.OnText("!help &", help)
+func (l *List) HelpFilter(required map[string]Role) func(*irc.Message, irc.RouteInfo) bool {
+	return func(m *irc.Message, rt irc.RouteInfo) bool {
+		role, ok := required[rt.Name]
+		return !ok || l.Allowed(m, role)
+	}
+}
@@ -0,0 +1,106 @@
+package access_test
+
+import (
+	"testing"
+
+	"github.com/Travis-Britz/irc"
+	"github.com/Travis-Britz/irc/access"
+	"github.com/Travis-Britz/irc/irctest"
+)
+
+func message(source, account string) *irc.Message {
+	m := new(irc.Message)
+	if err := m.UnmarshalText([]byte(":" + source + " PRIVMSG #chan :!cmd")); err != nil {
+		panic(err)
+	}
+	if account != "" {
+		m.Tags.Set("account", account)
+	}
+	return m
+}
+
+func TestList_Role(t *testing.T) {
+	acl := &access.List{}
+	acl.Add(
+		access.Rule{Mask: "*!*@staff.example.com", Role: access.RoleTrusted},
+		access.Rule{Account: "Owner", Role: access.RoleOwner},
+		access.Rule{Mask: "admin!*@*", Account: "admin", Role: access.RoleAdmin},
+		access.Rule{Role: access.RoleOwner}, // matches nothing
+	)
+
+	tt := []struct {
+		name     string
+		given    *irc.Message
+		expected access.Role
+	}{
+		{"unknown", message("someone!user@host.example.com", ""), access.RoleNone},
+		{"mask", message("someone!user@staff.example.com", ""), access.RoleTrusted},
+		{"account", message("anybody!user@host.example.com", "owner"), access.RoleOwner},
+		{"highest role", message("anybody!user@staff.example.com", "OWNER"), access.RoleOwner},
+		{"logged out", message("anybody!user@host.example.com", "*"), access.RoleNone},
+		{"mask and account", message("admin!user@host.example.com", "admin"), access.RoleAdmin},
+		{"mask without the account", message("admin!user@host.example.com", ""), access.RoleNone},
+		{"account without the mask", message("impostor!user@host.example.com", "admin"), access.RoleNone},
+		{"server", message("staff.example.com", "owner"), access.RoleNone},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := acl.Role(tc.given); got != tc.expected {
+				t.Errorf("expected role %d; got %d", tc.expected, got)
+			}
+		})
+	}
+
+	acl.Remove(access.Rule{Mask: "*!*@staff.example.com", Role: access.RoleTrusted})
+	if got := acl.Role(message("someone!user@staff.example.com", "")); got != access.RoleNone {
+		t.Errorf("expected the removed rule not to match; got role %d", got)
+	}
+	if n := len(acl.Rules()); n != 3 {
+		t.Errorf("expected 3 rules left; got %d", n)
+	}
+
+	var nilList *access.List
+	if nilList.Allowed(message("someone!user@host", ""), access.RoleUser) {
+		t.Errorf("expected a nil list to allow nothing")
+	}
+}
+
+func TestList_Require(t *testing.T) {
+	acl := &access.List{}
+	acl.Add(access.Rule{Account: "owner", Role: access.RoleOwner})
+
+	r := &irc.Router{}
+	r.OnText("!quit", func(w irc.MessageWriter, m *irc.Message) {
+		w.WriteMessage(irc.Quit("bye"))
+	}).Name("quit").Use(acl.Require(access.RoleOwner))
+	r.OnText("!help", func(w irc.MessageWriter, m *irc.Message) {}).Name("help")
+
+	w := &irctest.RecordingWriter{}
+	m := message("someone!user@host.example.com", "")
+	m.Params = irc.Params{"#chan", "!quit"}
+	r.SpeakIRC(w, m)
+	if w.Len() != 0 {
+		t.Errorf("expected the handler not to be called for an unknown user; got %q", w.Lines())
+	}
+	m.Tags.Set("account", "owner")
+	r.SpeakIRC(w, m)
+	if w.Len() != 1 {
+		t.Errorf("expected the handler to be called for the owner; got %q", w.Lines())
+	}
+
+	filter := acl.HelpFilter(map[string]access.Role{"quit": access.RoleOwner})
+	listed := func(m *irc.Message) (names []string) {
+		for _, rt := range r.Routes() {
+			if filter(m, rt) {
+				names = append(names, rt.Name)
+			}
+		}
+		return names
+	}
+	if got := listed(message("someone!user@host.example.com", "")); len(got) != 1 || got[0] != "help" {
+		t.Errorf("expected only help to be listed for an unknown user; got %q", got)
+	}
+	if got := listed(message("someone!user@host.example.com", "owner")); len(got) != 2 {
+		t.Errorf("expected every route to be listed for the owner; got %q", got)
+	}
+}
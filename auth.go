@@ -0,0 +1,204 @@
+package irc
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// ErrAuthTimeout is reported for an Authenticator which didn't finish within the client's CapTimeout.
+var ErrAuthTimeout = errors.New("authentication timed out")
+
+// An Authenticator authenticates the client while it connects, e.g. with SASL, a NickServ IDENTIFY, or a token sent as PASS.
+//
+// The client runs its Authenticators side by side and takes care of the ordering between them and registration:
+// capability negotiation stays open while an Authenticator holds it (see Auth.HoldCapEnd),
+// and Perform and AutoJoin wait until every Authenticator is done, so channels are joined with the authenticated identity.
+// Authenticators which don't finish within the client's CapTimeout are given up on.
+type Authenticator interface {
+
+	// Authenticate starts authentication on a new connection.
+	// It's called before the client sends CAP LS, NICK, and USER, so anything written to w is sent first, e.g. PASS.
+	//
+	// The returned handler (which may be nil) sees each message read from the connection before the client's handler,
+	// until a.Done is called.
+	Authenticate(w MessageWriter, a *Auth) Handler
+}
+
+// The AuthFunc type is an adapter to allow the use of ordinary functions as Authenticators.
+type AuthFunc func(w MessageWriter, a *Auth) Handler
+
+// Authenticate calls f(w, a).
+func (f AuthFunc) Authenticate(w MessageWriter, a *Auth) Handler {
+	return f(w, a)
+}
+
+// An Auth is the authentication of one Authenticator on one connection.
+type Auth struct {
+	p *authPipeline
+	h Handler
+
+	mu      sync.Mutex
+	holding bool
+	done    bool
+}
+
+// HoldCapEnd keeps capability negotiation open until Done is called,
+// for authentication which must complete before CAP END, like SASL.
+// It must be called before the final line of the CAP LS reply is handled:
+// from Authenticate, or from the Authenticator's handler of a CAP LS line.
+func (a *Auth) HoldCapEnd() {
+	a.mu.Lock()
+	if a.done || a.holding {
+		a.mu.Unlock()
+		return
+	}
+	a.holding = true
+	a.mu.Unlock()
+	a.p.caps.hold()
+}
+
+// Done ends the authentication, successful or not. A non-nil err is reported to the client's ErrorLog.
+// Calls after the first have no effect.
+func (a *Auth) Done(err error) {
+	a.mu.Lock()
+	if a.done {
+		a.mu.Unlock()
+		return
+	}
+	a.done = true
+	holding := a.holding
+	a.holding = false
+	a.mu.Unlock()
+
+	if err != nil {
+		a.p.client.log(fmt.Errorf("auth: %w", err))
+	}
+	if holding {
+		a.p.caps.release(a.p.client)
+	}
+	a.p.finished()
+}
+
+func (a *Auth) isDone() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.done
+}
+
+// authPipeline runs the Authenticators of a connection, and starts Perform, followed by AutoJoin,
+// once the client is registered and every Authenticator is done.
+type authPipeline struct {
+	client  *Client
+	caps    *capState
+	perform *performer
+
+	// auths is set by start, before any message is handled, and never changes.
+	auths []*Auth
+
+	mu       sync.Mutex
+	pending  int  // the number of Auths which aren't done
+	welcomed bool // the client is registered
+	joined   bool // Perform was started
+}
+
+// start starts the authenticators.
+func (p *authPipeline) start(authenticators []Authenticator) {
+	p.auths = make([]*Auth, len(authenticators))
+	p.mu.Lock()
+	p.pending = len(authenticators)
+	p.mu.Unlock()
+	for i := range authenticators {
+		p.auths[i] = &Auth{p: p}
+	}
+	for i, au := range authenticators {
+		p.auths[i].h = au.Authenticate(p.client, p.auths[i])
+	}
+}
+
+// expire gives up on the Auths which aren't done, when the client's CapTimeout has passed.
+// The timer is shared with capability negotiation; see ConnectAndRun.
+func (p *authPipeline) expire() {
+	for _, a := range p.auths {
+		a.Done(ErrAuthTimeout)
+	}
+}
+
+// finished is called when an Auth is done.
+func (p *authPipeline) finished() {
+	p.mu.Lock()
+	p.pending--
+	join := p.pending == 0 && p.welcomed && !p.joined
+	if join {
+		p.joined = true
+	}
+	p.mu.Unlock()
+	if join {
+		p.perform.start(p.client)
+	}
+}
+
+// middleware passes each message to the handlers of the Auths which aren't done,
+// and starts Perform when the client registers, unless authentication is still in progress.
+func (p *authPipeline) middleware(next Handler) Handler {
+	return HandlerFunc(func(w MessageWriter, m *Message) {
+		for _, a := range p.auths {
+			if a.h != nil && !a.isDone() {
+				a.h.SpeakIRC(w, m)
+			}
+		}
+		next.SpeakIRC(w, m)
+
+		if m.Command.is(RplWelcome) {
+			p.mu.Lock()
+			p.welcomed = true
+			join := p.pending == 0 && !p.joined
+			if join {
+				p.joined = true
+			}
+			p.mu.Unlock()
+			if join {
+				p.perform.start(w)
+			}
+		}
+	})
+}
+
+// NickServ returns an Authenticator which identifies with NickServ once the client has registered,
+// for networks which don't support SASL. If account is empty, the client's nickname is identified.
+//
+// NickServ is done when the server reports that the client is logged in (RPL_LOGGEDIN),
+// which also skips the IDENTIFY when SASL already logged the client in,
+// or when NickServ replies that the client is identified (Atheme, Anope). A reply about a wrong password is reported as an error.
+func NickServ(account, password string) Authenticator {
+	return nickServAuth{account: account, password: password}
+}
+
+type nickServAuth struct {
+	account, password string
+}
+
+func (n nickServAuth) Authenticate(_ MessageWriter, a *Auth) Handler {
+	return HandlerFunc(func(w MessageWriter, m *Message) {
+		switch {
+		case m.Command.is(RplLoggedIn):
+			a.Done(nil)
+		case m.Command.is(RplWelcome):
+			identify := "IDENTIFY " + n.password
+			if n.account != "" {
+				identify = "IDENTIFY " + n.account + " " + n.password
+			}
+			w.WriteMessage(Msg("NickServ", identify))
+		case m.Command.is(CmdNotice) && m.Source.Nick.Is("NickServ"):
+			text := strings.ToLower(m.Params.Get(2))
+			switch {
+			case strings.Contains(text, "password") && (strings.Contains(text, "invalid") || strings.Contains(text, "incorrect")):
+				a.Done(fmt.Errorf("nickserv: %s", m.Params.Get(2)))
+			case strings.Contains(text, "you are now identified"), strings.Contains(text, "you are now logged in"),
+				strings.Contains(text, "you are now recognized"):
+				a.Done(nil)
+			}
+		}
+	})
+}
@@ -0,0 +1,565 @@
+/*
+Package bouncer lets IRC clients connect through the upstream connection of an irc.Client, like ZNC or soju,
+so that a bot's connection can be shared with a person, or a person can stay on IRC while their client is closed.
+
+Downstream clients connect to the Bouncer and register as they would with any server.
+They're sent the channels the upstream client is on, and then the messages which arrived while no client was attached.
+Everything the downstream clients send is relayed to the upstream connection, except QUIT, which only detaches them.
+While no client is attached, the upstream client is marked as away.
+
+	b := &bouncer.Bouncer{Client: client, Password: "secret"}
+	go b.ListenAndServe("127.0.0.1:6667")
+	defer b.Close()
+	r.Use(b.Middleware)
+	err := client.ConnectAndRun(ctx, r)
+
+The bouncer has no TLS, so it should only listen on a loopback address, or behind a TLS proxy.
+*/
+package bouncer
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Travis-Britz/irc"
+)
+
+// Defaults used by a Bouncer when its fields are left empty.
+const (
+	DefaultPlayback    = 500
+	DefaultAwayMessage = "Detached"
+)
+
+// ErrBouncerClosed is returned by Serve and ListenAndServe after Close is called.
+var ErrBouncerClosed = errors.New("bouncer: closed")
+
+// serverName is the source of the messages sent by the bouncer itself.
+const serverName = "bouncer"
+
+// isupportTokens are the RPL_ISUPPORT tokens of the upstream server which are passed on to downstream clients.
+var isupportTokens = []string{"CASEMAPPING", "CHANMODES", "CHANTYPES", "NETWORK", "NICKLEN", "PREFIX", "STATUSMSG", "TOPICLEN"}
+
+// A Bouncer relays downstream client connections to the upstream connection of Client.
+// Its Middleware must be given the messages of Client, e.g. with Router.Use.
+type Bouncer struct {
+
+	// Client is the upstream connection.
+	Client *irc.Client
+
+	// Password is the password which downstream clients must send with PASS (optional).
+	Password string
+
+	// Playback is the number of messages kept while no downstream client is attached.
+	// Older messages are dropped. If 0, DefaultPlayback is used.
+	Playback int
+
+	// AwayMessage is the away message of the upstream client while no downstream client is attached.
+	// If empty, DefaultAwayMessage is used.
+	AwayMessage string
+
+	mu        sync.Mutex
+	awayMu    sync.Mutex // serializes the AWAY writes of syncAway
+	attached  map[*downstream]struct{}
+	conns     map[*downstream]struct{}
+	buffer    []*irc.Message
+	topics    map[string]string // keyed by lowercase channel name
+	away      bool              // whether the upstream client is marked as away; changed by syncAway
+	listeners []net.Listener
+	closed    bool
+}
+
+// ListenAndServe listens on the TCP address addr and serves downstream connections until Close is called.
+func (b *Bouncer) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return b.Serve(ln)
+}
+
+// Serve accepts downstream connections on ln and serves each of them in a new goroutine.
+// Serve always returns a non-nil error; after Close it returns ErrBouncerClosed.
+func (b *Bouncer) Serve(ln net.Listener) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		_ = ln.Close()
+		return ErrBouncerClosed
+	}
+	b.listeners = append(b.listeners, ln)
+	b.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			b.mu.Lock()
+			closed := b.closed
+			b.mu.Unlock()
+			if closed {
+				return ErrBouncerClosed
+			}
+			return err
+		}
+		go b.ServeConn(conn)
+	}
+}
+
+// ServeConn serves a single downstream connection, such as one end of irc.Pipe, and returns when it's closed.
+func (b *Bouncer) ServeConn(rwc io.ReadWriteCloser) {
+	d := &downstream{b: b, conn: rwc, out: make(chan []byte, 256)}
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		_ = rwc.Close()
+		return
+	}
+	if b.conns == nil {
+		b.conns = make(map[*downstream]struct{})
+	}
+	b.conns[d] = struct{}{}
+	b.mu.Unlock()
+
+	go d.write()
+	defer func() {
+		b.detach(d)
+		b.mu.Lock()
+		delete(b.conns, d)
+		b.mu.Unlock()
+		// nothing sends to d anymore; the writer closes the connection once the last messages are written
+		close(d.out)
+	}()
+
+	scanner := bufio.NewScanner(rwc)
+	for scanner.Scan() {
+		line := bytes.TrimRight(scanner.Bytes(), "\r")
+		if len(line) == 0 {
+			continue
+		}
+		m := new(irc.Message)
+		if err := m.UnmarshalText(line); err != nil {
+			continue
+		}
+		// commands are case-insensitive, and are relayed upstream in uppercase
+		m.Command = irc.Command(strings.ToUpper(m.Command.String()))
+		if quit := d.handle(m); quit {
+			return
+		}
+	}
+}
+
+// Close stops every listener and closes every downstream connection.
+// The upstream connection is left alone.
+func (b *Bouncer) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	var err error
+	for _, ln := range b.listeners {
+		if e := ln.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	for d := range b.conns {
+		d.close()
+	}
+	return err
+}
+
+// Middleware passes the messages of the upstream connection to the attached downstream clients,
+// or keeps them for playback while none is attached.
+func (b *Bouncer) Middleware(next irc.Handler) irc.Handler {
+	return irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+		b.upstream(w, m)
+		next.SpeakIRC(w, m)
+	})
+}
+
+func (b *Bouncer) upstream(w irc.MessageWriter, m *irc.Message) {
+	if is(m.Command, irc.RplWelcome) {
+		// a new connection starts out present; the AWAY is written by another goroutine,
+		// since flood control may delay it, and the handlers of the upstream client shouldn't wait for it
+		b.mu.Lock()
+		b.away = false
+		b.mu.Unlock()
+		go b.syncAway()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trackTopic(m)
+	if !relayable(m) {
+		return
+	}
+	out := relayed(m)
+	if len(b.attached) > 0 {
+		for d := range b.attached {
+			d.send(out)
+		}
+		return
+	}
+	if !is(out.Command, irc.CmdPrivmsg, irc.CmdNotice) {
+		return
+	}
+	if !out.Tags.Has("time") {
+		out.Tags.Set("time", time.Now().UTC().Format("2006-01-02T15:04:05.000Z"))
+	}
+	limit := b.Playback
+	if limit <= 0 {
+		limit = DefaultPlayback
+	}
+	if len(b.buffer) >= limit {
+		b.buffer = append(b.buffer[:0], b.buffer[len(b.buffer)-limit+1:]...)
+	}
+	b.buffer = append(b.buffer, out)
+}
+
+// trackTopic records the topics of the upstream client's channels, which are sent to downstream clients when they attach.
+// b.mu must be held.
+func (b *Bouncer) trackTopic(m *irc.Message) {
+	var channel, topic string
+	switch {
+	case is(m.Command, irc.RplTopic):
+		channel, topic = m.Params.Get(2), m.Params.Get(3)
+	case is(m.Command, irc.CmdTopic):
+		channel, topic = m.Params.Get(1), m.Params.Get(2)
+	default:
+		return
+	}
+	if b.topics == nil {
+		b.topics = make(map[string]string)
+	}
+	b.topics[strings.ToLower(channel)] = topic
+}
+
+// relayable reports whether an upstream message is passed on to downstream clients.
+// The messages of the upstream client's own registration and capability negotiation are not.
+func relayable(m *irc.Message) bool {
+	return !is(m.Command, irc.CmdCap, irc.CmdAuthenticate, irc.RplWelcome, irc.RplYourHost, irc.RplCreated, irc.RplMyInfo, irc.RplISupport)
+}
+
+// is reports whether cmd is one of cmds, regardless of case.
+func is(cmd irc.Command, cmds ...irc.Command) bool {
+	for _, c := range cmds {
+		if strings.EqualFold(cmd.String(), c.String()) {
+			return true
+		}
+	}
+	return false
+}
+
+// relayed returns a copy of an upstream message as it's sent to downstream clients:
+// with its prefix, and with CTCP messages, which the upstream client decoded, encoded again.
+func relayed(m *irc.Message) *irc.Message {
+	params := append(irc.Params(nil), m.Params...)
+	out := &irc.Message{Command: m.Command, Params: params, Trailing: m.Trailing}
+	if query, ok := strings.CutPrefix(m.Command.String(), "_CTCP_QUERY_"); ok {
+		out = irc.CTCP(params.Get(1), query, params.Get(2))
+	} else if reply, ok := strings.CutPrefix(m.Command.String(), "_CTCP_REPLY_"); ok {
+		out = irc.CTCPReply(params.Get(1), reply, params.Get(2))
+	}
+	out = out.WithSource(m.Source)
+	out.Tags = make(irc.Tags, len(m.Tags))
+	for k, v := range m.Tags {
+		out.Tags[k] = v
+	}
+	return out
+}
+
+// attach sends the state of the upstream connection to d, followed by the messages kept for playback.
+// It holds b.mu while it does, so that the upstream messages which arrive meanwhile wait for d to be attached
+// instead of going only to the downstream clients attached before it.
+// The state and playback are queued as a single write, so that they never count against the queue of d.
+func (b *Bouncer) attach(d *downstream) {
+	b.mu.Lock()
+	var batch []byte
+	add := func(m *irc.Message) {
+		batch = append(batch, d.encode(m)...)
+	}
+	nick := b.Client.Nick().String()
+	if nick == "" {
+		nick = d.nick
+	}
+	add(d.reply(irc.RplWelcome, "Welcome to the bouncer, "+nick))
+	var tokens []string
+	for _, name := range isupportTokens {
+		if v, ok := b.Client.ISupport(name); ok {
+			tokens = append(tokens, name+"="+v)
+		}
+	}
+	if len(tokens) > 0 {
+		add(d.reply(irc.RplISupport, append(tokens, "are supported by this server")...))
+	}
+	add(d.reply(irc.RplErrNoMOTD, "MOTD File is missing"))
+	if nick != d.nick {
+		add(irc.NewMessage(irc.CmdNick, nick).WithSource(irc.Prefix{Nick: irc.Nickname(d.nick)}))
+		d.nick = nick
+	}
+
+	self := irc.Prefix{Nick: irc.Nickname(nick)}
+	for _, channel := range b.Client.Channels() {
+		add(irc.Join(channel).WithSource(self))
+		if topic := b.topics[strings.ToLower(channel)]; topic != "" {
+			add(d.reply(irc.RplTopic, channel, topic))
+		}
+		var names []string
+		for _, member := range b.Client.Members(channel) {
+			names = append(names, highestPrefix(member.Prefixes)+member.Nick.String())
+		}
+		add(d.reply(irc.RplNamReply, "=", channel, strings.Join(names, " ")))
+		add(d.reply(irc.RplEndOfNames, channel, "End of /NAMES list"))
+	}
+
+	for _, m := range b.buffer {
+		add(m)
+	}
+	d.queue(batch)
+	b.buffer = nil
+	if b.attached == nil {
+		b.attached = make(map[*downstream]struct{})
+	}
+	b.attached[d] = struct{}{}
+	b.mu.Unlock()
+	b.syncAway()
+}
+
+// detach stops relaying to d, and marks the upstream client as away if it was the last downstream client.
+func (b *Bouncer) detach(d *downstream) {
+	b.mu.Lock()
+	_, ok := b.attached[d]
+	delete(b.attached, d)
+	b.mu.Unlock()
+	if ok {
+		b.syncAway()
+	}
+}
+
+// syncAway marks the upstream client as away when no downstream client is attached, and as present otherwise,
+// if it isn't already. The AWAY is written without holding b.mu, since flood control may delay it.
+func (b *Bouncer) syncAway() {
+	b.awayMu.Lock()
+	defer b.awayMu.Unlock()
+	b.mu.Lock()
+	away := len(b.attached) == 0
+	changed := away != b.away
+	b.away = away
+	b.mu.Unlock()
+	switch {
+	case !changed:
+	case away:
+		b.Client.WriteMessage(irc.NewMessage(irc.CmdAway, b.awayMessage()))
+	default:
+		b.Client.WriteMessage(irc.NewMessage(irc.CmdAway))
+	}
+}
+
+func (b *Bouncer) awayMessage() string {
+	if b.AwayMessage == "" {
+		return DefaultAwayMessage
+	}
+	return b.AwayMessage
+}
+
+// echo sends m, a message from the downstream client from, to the other attached downstream clients,
+// since the upstream server doesn't echo the messages of the upstream client back to it.
+func (b *Bouncer) echo(from *downstream, m *irc.Message) {
+	if b.Client.CapEnabled("echo-message") {
+		return
+	}
+	out := relayed(m.WithSource(irc.Prefix{Nick: b.Client.Nick()}))
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for d := range b.attached {
+		if d != from {
+			d.send(out)
+		}
+	}
+}
+
+// highestPrefix returns the first of prefixes, the highest membership prefix of a member.
+func highestPrefix(prefixes string) string {
+	if prefixes == "" {
+		return ""
+	}
+	return prefixes[:1]
+}
+
+// downstream is the connection of a downstream client.
+type downstream struct {
+	b    *Bouncer
+	conn io.ReadWriteCloser
+	out  chan []byte
+
+	// the state of registration; only used by the goroutine reading the connection
+	nick, user, pass string
+	negotiating      bool
+	registered       bool
+	serverTime       bool
+
+	closeOnce sync.Once
+}
+
+// handle processes a message from the downstream client. It returns true when the connection should be closed.
+func (d *downstream) handle(m *irc.Message) bool {
+	switch m.Command {
+	case irc.CmdPing:
+		d.send(d.message(irc.CmdPong, serverName, m.Params.Get(1)))
+		return false
+	case irc.CmdPong:
+		return false
+	case irc.CmdQuit:
+		d.send(d.message(irc.CmdError, "Closing link (detached)"))
+		return true
+	case irc.CmdCap:
+		d.handleCap(m)
+		return d.register()
+	}
+	if !d.registered {
+		switch m.Command {
+		case irc.CmdPass:
+			d.pass = m.Params.Get(1)
+		case irc.CmdNick:
+			d.nick = m.Params.Get(1)
+		case irc.CmdUser:
+			d.user = m.Params.Get(1)
+		default:
+			d.numeric(irc.RplErrNotRegistered, "You have not registered")
+			return false
+		}
+		return d.register()
+	}
+
+	switch m.Command {
+	case irc.CmdPass, irc.CmdUser:
+		d.numeric(irc.RplErrAlreadyRegistered, "You may not reregister")
+		return false
+	}
+	m = m.WithSource(irc.Prefix{})
+	if err := d.b.Client.WriteMessageE(m); err != nil {
+		d.send(d.message(irc.CmdNotice, d.target(), "Not sent upstream: "+err.Error()))
+		return false
+	}
+	if m.Command == irc.CmdPrivmsg || m.Command == irc.CmdNotice {
+		d.b.echo(d, m)
+	}
+	return false
+}
+
+func (d *downstream) handleCap(m *irc.Message) {
+	switch strings.ToUpper(m.Params.Get(1)) {
+	case "LS":
+		d.negotiating = !d.registered
+		d.send(d.message(irc.CmdCap, d.target(), "LS", "server-time"))
+	case "REQ":
+		requested := strings.Fields(m.Params.Get(2))
+		if len(requested) == 1 && requested[0] == "server-time" {
+			d.serverTime = true
+			d.send(d.message(irc.CmdCap, d.target(), "ACK", m.Params.Get(2)))
+			return
+		}
+		d.send(d.message(irc.CmdCap, d.target(), "NAK", m.Params.Get(2)))
+	case "LIST":
+		list := ""
+		if d.serverTime {
+			list = "server-time"
+		}
+		d.send(d.message(irc.CmdCap, d.target(), "LIST", list))
+	case "END":
+		d.negotiating = false
+	}
+}
+
+// register completes registration once the client sent NICK and USER and finished capability negotiation,
+// and attaches the client. It returns true when the password was wrong.
+func (d *downstream) register() bool {
+	if d.registered || d.negotiating || d.nick == "" || d.user == "" {
+		return false
+	}
+	if d.b.Password != "" && d.pass != d.b.Password {
+		d.numeric(irc.RplErrPasswdMismatch, "Password incorrect")
+		d.send(d.message(irc.CmdError, "Closing link (password incorrect)"))
+		return true
+	}
+	d.registered = true
+	d.b.attach(d)
+	return false
+}
+
+// message returns a message from the bouncer.
+func (d *downstream) message(cmd irc.Command, params ...string) *irc.Message {
+	return irc.NewMessage(cmd, params...).WithSource(irc.Prefix{Host: serverName})
+}
+
+// target returns the nickname of the client for use as the first parameter of replies, or "*" before it has one.
+func (d *downstream) target() string {
+	if d.nick == "" {
+		return "*"
+	}
+	return d.nick
+}
+
+// numeric sends a numeric reply to the client.
+func (d *downstream) numeric(cmd irc.Command, params ...string) {
+	d.send(d.reply(cmd, params...))
+}
+
+// reply returns a numeric reply to the client.
+func (d *downstream) reply(cmd irc.Command, params ...string) *irc.Message {
+	return d.message(cmd, append([]string{d.target()}, params...)...)
+}
+
+// send queues m to be written to the client.
+func (d *downstream) send(m *irc.Message) {
+	d.queue(d.encode(m))
+}
+
+// encode returns m as it's written to the client, or nil if it can't be encoded.
+func (d *downstream) encode(m *irc.Message) []byte {
+	if len(m.Tags) > 0 {
+		// only the time tag of server-time is supported downstream
+		tags := m.Tags
+		m = m.WithSource(m.Source)
+		m.Tags = nil
+		if t, ok := tags["time"]; ok && d.serverTime {
+			m.Tags = irc.Tags{"time": t}
+		}
+	}
+	b, err := m.MarshalText()
+	if len(b) == 0 && err != nil {
+		return nil
+	}
+	return b
+}
+
+// queue queues the lines in b to be written to the client in a single write.
+// Clients which fall too far behind are disconnected, so that they don't hold up the upstream connection.
+func (d *downstream) queue(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	select {
+	case d.out <- b:
+	default:
+		d.close()
+	}
+}
+
+func (d *downstream) write() {
+	defer d.close()
+	for b := range d.out {
+		if _, err := d.conn.Write(b); err != nil {
+			d.close()
+		}
+	}
+}
+
+// close closes the connection. It's safe to call more than once.
+func (d *downstream) close() {
+	d.closeOnce.Do(func() {
+		_ = d.conn.Close()
+	})
+}
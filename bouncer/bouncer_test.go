@@ -0,0 +1,161 @@
+package bouncer_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Travis-Britz/irc"
+	"github.com/Travis-Britz/irc/bouncer"
+	"github.com/Travis-Britz/irc/ircserver"
+	"github.com/Travis-Britz/irc/irctest"
+)
+
+// dial returns a DialFn which connects to s with irc.Pipe.
+func dial(s *ircserver.Server) func() (io.ReadWriteCloser, error) {
+	return func() (io.ReadWriteCloser, error) {
+		client, server := irc.Pipe()
+		go s.ServeConn(server)
+		return client, nil
+	}
+}
+
+// attach connects a downstream client to b, and returns its connection and a reader of the lines it receives.
+func attach(b *bouncer.Bouncer, lines ...string) (io.ReadWriteCloser, *bufio.Scanner) {
+	client, server := irc.Pipe()
+	go b.ServeConn(server)
+	go func() {
+		for _, line := range lines {
+			io.WriteString(client, line+"\r\n")
+		}
+	}()
+	return client, bufio.NewScanner(client)
+}
+
+// expectLine reads lines from scanner until one contains want.
+func expectLine(t *testing.T, scanner *bufio.Scanner, want string) {
+	t.Helper()
+	for scanner.Scan() {
+		if strings.Contains(scanner.Text(), want) {
+			return
+		}
+	}
+	t.Fatalf("expected a line containing %q", want)
+}
+
+func TestBouncer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	s := &ircserver.Server{}
+	defer s.Close()
+
+	b := &bouncer.Bouncer{Password: "secret"}
+	defer b.Close()
+	bot := &irc.Client{Nickname: "bot", DialFn: dial(s)}
+	b.Client = bot
+	joined := make(chan struct{})
+	r := &irc.Router{}
+	r.Use(b.Middleware)
+	r.OnConnect(func(w irc.MessageWriter, m *irc.Message) {
+		w.WriteMessage(irc.Join("#test"))
+	})
+	r.HandleFunc(irc.RplEndOfNames, func(w irc.MessageWriter, m *irc.Message) {
+		close(joined)
+	})
+	go func() { _ = bot.ConnectAndRun(ctx, r) }()
+
+	select {
+	case <-joined:
+	case <-ctx.Done():
+		t.Fatal("bot never joined the channel")
+	}
+
+	// a message which arrives while no client is attached is played back
+	replied := make(chan string, 1)
+	speaker := &irc.Client{Nickname: "speaker", DialFn: dial(s)}
+	sr := &irc.Router{}
+	sr.OnConnect(func(w irc.MessageWriter, m *irc.Message) {
+		w.WriteMessage(irc.Msg("bot", "are you there?"))
+	})
+	sr.OnText("*", func(w irc.MessageWriter, m *irc.Message) {
+		replied <- m.Params.Get(2)
+		w.WriteMessage(irc.Quit("bye"))
+	})
+	go func() { _ = speaker.ConnectAndRun(ctx, sr) }()
+
+	conn, lines := attach(b, "PASS secret", "NICK me", "USER me 0 * :me")
+	defer conn.Close()
+	expectLine(t, lines, " 001 ")
+	expectLine(t, lines, ":me NICK :bot")
+	expectLine(t, lines, ":bot JOIN :#test")
+	expectLine(t, lines, " 353 bot = #test :")
+	expectLine(t, lines, ":speaker!~guest@localhost PRIVMSG bot :are you there?")
+
+	// what the downstream client sends is relayed upstream
+	io.WriteString(conn, "PRIVMSG speaker :I am\r\n")
+	select {
+	case text := <-replied:
+		if text != "I am" {
+			t.Errorf("expected the reply of the downstream client to be relayed; got %q", text)
+		}
+	case <-ctx.Done():
+		t.Fatal("speaker never received the reply")
+	}
+}
+
+func TestBouncer_password(t *testing.T) {
+	b := &bouncer.Bouncer{Client: &irc.Client{}, Password: "secret"}
+	defer b.Close()
+
+	conn, lines := attach(b, "PASS wrong", "NICK me", "USER me 0 * :me")
+	defer conn.Close()
+	expectLine(t, lines, " 464 me :Password incorrect")
+	expectLine(t, lines, "ERROR :")
+	if lines.Scan() {
+		t.Errorf("expected the connection to be closed; got %q", lines.Text())
+	}
+}
+
+func TestBouncer_lowercaseCommands(t *testing.T) {
+	b := &bouncer.Bouncer{Client: &irc.Client{Nickname: "bot", ErrorLog: log.New(io.Discard, "", 0)}}
+	defer b.Close()
+
+	h := b.Middleware(irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {}))
+	m := &irc.Message{Source: irc.Prefix{Nick: "speaker"}, Command: "privmsg", Params: irc.Params{"bot", "are you there?"}}
+	h.SpeakIRC(irctest.Discard, m)
+
+	conn, lines := attach(b, "nick me", "user me 0 * :me")
+	defer conn.Close()
+	expectLine(t, lines, " 001 ")
+	expectLine(t, lines, ":speaker privmsg bot :are you there?")
+}
+
+func TestBouncer_playback(t *testing.T) {
+	b := &bouncer.Bouncer{Client: &irc.Client{Nickname: "bot", ErrorLog: log.New(io.Discard, "", 0)}}
+	defer b.Close()
+
+	// more messages than a downstream client may have queued, which attaching must not count against it
+	const n = 300
+	h := b.Middleware(irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {}))
+	for i := 0; i < n; i++ {
+		h.SpeakIRC(irctest.Discard, irc.Msg("bot", fmt.Sprintf("message %d", i)).WithSource(irc.Prefix{Nick: "speaker"}))
+	}
+
+	// net.Pipe doesn't buffer, so nothing is written before it's read
+	client, server := net.Pipe()
+	defer client.Close()
+	go b.ServeConn(server)
+	go io.WriteString(client, "NICK me\r\nUSER me 0 * :me\r\n")
+	lines := bufio.NewScanner(client)
+	expectLine(t, lines, " 001 ")
+	for i := 0; i < n; i++ {
+		expectLine(t, lines, fmt.Sprintf("PRIVMSG bot :message %d", i))
+	}
+}
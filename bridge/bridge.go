@@ -0,0 +1,391 @@
+/*
+Package bridge converts between IRC messages and a neutral chat Event,
+so that bridges to other chat networks such as Matrix, Slack, or Discord
+can share the same handling of actions, notices, replies, edits, and multiline messages.
+
+A Converter turns incoming messages into Events, and Events into the messages to send:
+
+	conv := &bridge.Converter{}
+	r.HandleFunc("*", func(w irc.MessageWriter, m *irc.Message) {
+		if e, ok := conv.FromIRC(m); ok {
+			relay(e)
+		}
+	})
+	// later, for an event from the other network:
+	msgs, err := conv.ToIRC(e)
+	for _, m := range msgs {
+		client.WriteMessage(m)
+	}
+*/
+package bridge
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Travis-Britz/irc"
+)
+
+// ErrNoChannel is returned by Converter.ToIRC for events with neither a Channel nor a To to send to.
+var ErrNoChannel = errors.New("bridge: event has no channel")
+
+// Message tags used by the converter.
+const (
+	tagMsgID   = "msgid"
+	tagTime    = "time"
+	tagAccount = "account"
+	tagBatch   = "batch"
+	tagConcat  = "draft/multiline-concat"
+
+	// TagReply is the IRCv3 client tag which marks a message as a reply to the message with the given msgid.
+	TagReply = "+draft/reply"
+
+	// TagEdit is the client tag which marks a message as an edit of the message with the given msgid.
+	// Clients which don't understand it show the edit as a new message.
+	TagEdit = "+draft/edit"
+)
+
+// multilineBatch is the batch type of the IRCv3 draft/multiline extension.
+const multilineBatch = "draft/multiline"
+
+// Incoming multiline batches which are never closed, e.g. because the connection was lost,
+// are dropped after batchTimeout, or when maxBatches newer ones are open.
+const (
+	batchTimeout = time.Minute
+	maxBatches   = 16
+)
+
+// Kind is the kind of a chat event.
+type Kind int
+
+const (
+	KindMessage Kind = iota // a regular message (PRIVMSG)
+	KindNotice              // a notice, which bots and services use for automatic replies (NOTICE)
+	KindAction              // an action, sent with "/me" (CTCP ACTION)
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindMessage:
+		return "message"
+	case KindNotice:
+		return "notice"
+	case KindAction:
+		return "action"
+	}
+	return "Kind(" + strconv.Itoa(int(k)) + ")"
+}
+
+// An Event is a chat message in a form shared by the networks on both sides of a bridge.
+type Event struct {
+
+	// ID identifies the message for replies and edits. On IRC it's the msgid tag, which may be empty.
+	ID string
+
+	// Time is when the message was sent, from the server-time tag, or the zero time if unknown.
+	Time time.Time
+
+	// Sender is the name shown for the author, and Account is the author's services account if known.
+	Sender  string
+	Account string
+
+	// Channel is where the message was sent, or empty for a private message.
+	Channel string
+
+	// To is the recipient of a private message: the client's nickname for messages from FromIRC,
+	// and the nickname to send to for ToIRC. It's empty for channel messages.
+	To string
+
+	Kind Kind
+
+	// Text is the body of the message. It may have several lines, separated by "\n".
+	Text string
+
+	// Attachments are the URLs of files attached to the message.
+	// IRC can't carry files, so they're sent as links after the text.
+	Attachments []string
+
+	// ReplyTo and Edits are the IDs of the message this one replies to, or replaces.
+	ReplyTo string
+	Edits   string
+}
+
+// A Converter converts between Events and IRC messages.
+// The zero value is ready to use.
+// A Converter may be used from several goroutines at once.
+type Converter struct {
+
+	// ChanTypes are the characters which start a channel name.
+	// If empty, "#&" is used.
+	ChanTypes string
+
+	// Multiline sends events with several lines as a draft/multiline batch,
+	// which should only be set when the server accepts the draft/multiline capability.
+	// Otherwise each line is sent as a separate message.
+	Multiline bool
+
+	// ShowSender prefixes the messages sent by ToIRC with the name of the sender,
+	// as "<Sender> text", or "* Sender text" for actions,
+	// so that IRC users can see who wrote messages relayed from the other network.
+	ShowSender bool
+
+	// KeepFormatting keeps the IRC formatting codes in the text of incoming messages.
+	// By default they're removed.
+	KeepFormatting bool
+
+	mu      sync.Mutex
+	seq     int
+	batches map[string]*batch // open multiline batches, keyed by reference tag
+}
+
+// batch collects the lines of an incoming multiline message.
+type batch struct {
+	event  Event
+	lines  int
+	opened time.Time
+}
+
+// FromIRC converts an incoming message to an Event,
+// and reports whether the message was a chat message which completed an Event.
+//
+// PRIVMSG, NOTICE, and CTCP ACTION are converted whether or not the client decoded the CTCP message.
+// The lines of a draft/multiline batch are collected, and the Event is returned with the end of the batch.
+// Other messages, including other CTCP messages, report false.
+func (c *Converter) FromIRC(m *irc.Message) (Event, bool) {
+	if strings.EqualFold(m.Command.String(), "BATCH") {
+		return c.batch(m)
+	}
+
+	e, ok := c.event(m)
+	if !ok {
+		return Event{}, false
+	}
+	ref := m.Tags.Get(tagBatch)
+	if ref == "" {
+		return e, true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b := c.batches[ref]
+	if b == nil {
+		// the batch isn't a multiline message
+		return e, true
+	}
+	if b.lines == 0 {
+		b.event.Sender, b.event.Account, b.event.Kind = e.Sender, e.Account, e.Kind
+	} else if !m.Tags.Has(tagConcat) {
+		b.event.Text += "\n"
+	}
+	b.event.Text += e.Text
+	b.lines++
+	return Event{}, false
+}
+
+// batch opens or closes a multiline batch, returning the Event when it's closed.
+func (c *Converter) batch(m *irc.Message) (Event, bool) {
+	ref := m.Params.Get(1)
+	if len(ref) < 2 {
+		return Event{}, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch ref[0] {
+	case '+':
+		// "BATCH +<ref> draft/multiline <target>"
+		if m.Params.Get(2) != multilineBatch {
+			return Event{}, false
+		}
+		if c.batches == nil {
+			c.batches = make(map[string]*batch)
+		}
+		c.expire()
+		e := Event{
+			ID:      m.Tags.Get(tagMsgID),
+			Time:    serverTime(m),
+			ReplyTo: m.Tags.Get(TagReply),
+			Edits:   m.Tags.Get(TagEdit),
+		}
+		e.Channel, e.To = c.target(m.Params.Get(3))
+		c.batches[ref[1:]] = &batch{event: e, opened: time.Now()}
+	case '-':
+		b := c.batches[ref[1:]]
+		if b == nil {
+			return Event{}, false
+		}
+		delete(c.batches, ref[1:])
+		return b.event, b.lines > 0
+	}
+	return Event{}, false
+}
+
+// expire drops the batches opened more than batchTimeout ago,
+// and the oldest ones while there are maxBatches or more. c.mu must be held.
+func (c *Converter) expire() {
+	var oldest string
+	for ref, b := range c.batches {
+		if time.Since(b.opened) > batchTimeout {
+			delete(c.batches, ref)
+			continue
+		}
+		if oldest == "" || b.opened.Before(c.batches[oldest].opened) {
+			oldest = ref
+		}
+	}
+	if len(c.batches) >= maxBatches {
+		delete(c.batches, oldest)
+	}
+}
+
+// event converts a single chat message.
+func (c *Converter) event(m *irc.Message) (Event, bool) {
+	text := m.Params.Get(2)
+	var kind Kind
+	switch cmd := m.Command.String(); {
+	case strings.EqualFold(cmd, irc.CmdPrivmsg):
+		kind = KindMessage
+		if body, ok := strings.CutPrefix(text, "\x01ACTION "); ok {
+			kind, text = KindAction, strings.TrimSuffix(body, "\x01")
+		} else if strings.HasPrefix(text, "\x01") {
+			return Event{}, false
+		}
+	case strings.EqualFold(cmd, irc.CmdNotice):
+		kind = KindNotice
+		if strings.HasPrefix(text, "\x01") {
+			return Event{}, false
+		}
+	case strings.EqualFold(cmd, irc.CTCPAction):
+		kind = KindAction
+	default:
+		return Event{}, false
+	}
+	if !c.KeepFormatting {
+		text = irc.StripFormatting(text)
+	}
+
+	sender := m.Source.Nick.String()
+	if m.Source.IsServer() {
+		sender = m.Source.Host
+	}
+	e := Event{
+		ID:      m.Tags.Get(tagMsgID),
+		Time:    serverTime(m),
+		Sender:  sender,
+		Account: m.Tags.Get(tagAccount),
+		Kind:    kind,
+		Text:    text,
+		ReplyTo: m.Tags.Get(TagReply),
+		Edits:   m.Tags.Get(TagEdit),
+	}
+	e.Channel, e.To = c.target(m.Params.Get(1))
+	return e, true
+}
+
+// target returns the channel of target without its STATUSMSG prefixes if it's a channel,
+// or else the nickname of the recipient.
+func (c *Converter) target(target string) (channel, to string) {
+	chantypes := c.ChanTypes
+	if chantypes == "" {
+		chantypes = "#&"
+	}
+	if target != "" && strings.ContainsRune(chantypes, rune(target[0])) {
+		return target, ""
+	}
+	channel = strings.TrimLeft(target, "~&@%+")
+	if channel != "" && strings.ContainsRune(chantypes, rune(channel[0])) {
+		return channel, ""
+	}
+	return "", target
+}
+
+// ToIRC converts an Event to the messages which send it to e.Channel,
+// or to the nickname e.To for a private message.
+// The sender and ID of e are not sent, except as the text prefix of ShowSender.
+//
+// Each line of the text is a separate message unless Multiline is set,
+// and attachments follow as additional lines.
+// Replies and edits are marked with the TagReply and TagEdit client tags.
+func (c *Converter) ToIRC(e Event) ([]*irc.Message, error) {
+	target := e.Channel
+	if target == "" {
+		target = e.To
+	}
+	if target == "" {
+		return nil, ErrNoChannel
+	}
+
+	var lines []string
+	for _, line := range strings.Split(strings.ReplaceAll(e.Text, "\r\n", "\n"), "\n") {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	lines = append(lines, e.Attachments...)
+	if len(lines) == 0 {
+		return nil, nil
+	}
+
+	kind := e.Kind
+	if c.ShowSender && e.Sender != "" {
+		if kind == KindAction {
+			kind, lines[0] = KindMessage, "* "+e.Sender+" "+lines[0]
+		} else {
+			lines[0] = "<" + e.Sender + "> " + lines[0]
+		}
+	}
+
+	var tags irc.Tags
+	if e.ReplyTo != "" {
+		tags.Set(TagReply, e.ReplyTo)
+	}
+	if e.Edits != "" {
+		tags.Set(TagEdit, e.Edits)
+	}
+
+	msgs := make([]*irc.Message, 0, len(lines)+2)
+	for _, line := range lines {
+		var m *irc.Message
+		switch kind {
+		case KindNotice:
+			m = irc.Notice(target, line)
+		case KindAction:
+			m = irc.Describe(target, line)
+		default:
+			m = irc.Msg(target, line)
+		}
+		msgs = append(msgs, m)
+	}
+
+	// actions are CTCP messages, which can't be split across the lines of a batch
+	if !c.Multiline || len(msgs) == 1 || kind == KindAction {
+		msgs[0].Tags = tags
+		return msgs, nil
+	}
+
+	c.mu.Lock()
+	c.seq++
+	ref := "multiline" + strconv.Itoa(c.seq)
+	c.mu.Unlock()
+	start := irc.NewMessage("BATCH", "+"+ref, multilineBatch, target)
+	start.Tags = tags
+	end := irc.NewMessage("BATCH", "-"+ref)
+	start.Trailing, end.Trailing = irc.TrailingAuto, irc.TrailingAuto
+	for _, m := range msgs {
+		m.Tags.Set(tagBatch, ref)
+	}
+	msgs = append([]*irc.Message{start}, msgs...)
+	return append(msgs, end), nil
+}
+
+// serverTime returns the time of the server-time tag of m, or the zero time.
+func serverTime(m *irc.Message) time.Time {
+	t, err := time.Parse(time.RFC3339Nano, m.Tags.Get(tagTime))
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
@@ -0,0 +1,173 @@
+package bridge_test
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Travis-Britz/irc"
+	"github.com/Travis-Britz/irc/bridge"
+)
+
+func parse(t *testing.T, line string) *irc.Message {
+	t.Helper()
+	m, err := irc.ParseMessage([]byte(line))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestConverter_FromIRC(t *testing.T) {
+	tests := []struct {
+		line string
+		want bridge.Event
+		ok   bool
+	}{
+		{
+			"@msgid=abc;time=2023-04-05T06:07:08.000Z;account=alice :alice!a@host PRIVMSG #chan :\x02hello\x02",
+			bridge.Event{ID: "abc", Time: time.Date(2023, 4, 5, 6, 7, 8, 0, time.UTC), Sender: "alice", Account: "alice", Channel: "#chan", Text: "hello"},
+			true,
+		},
+		{":alice!a@host PRIVMSG #chan :\x01ACTION waves\x01", bridge.Event{Sender: "alice", Channel: "#chan", Kind: bridge.KindAction, Text: "waves"}, true},
+		{":alice!a@host NOTICE @#chan :ops only", bridge.Event{Sender: "alice", Channel: "#chan", Kind: bridge.KindNotice, Text: "ops only"}, true},
+		{"@+draft/reply=abc :bob!b@host PRIVMSG bot :thanks", bridge.Event{Sender: "bob", To: "bot", Kind: bridge.KindMessage, Text: "thanks", ReplyTo: "abc"}, true},
+		{":alice!a@host PRIVMSG bot :\x01VERSION\x01", bridge.Event{}, false},
+		{":alice!a@host JOIN #chan", bridge.Event{}, false},
+	}
+	for _, tt := range tests {
+		conv := &bridge.Converter{}
+		got, ok := conv.FromIRC(parse(t, tt.line))
+		if ok != tt.ok || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: expected %+v, %t; got %+v, %t", tt.line, tt.want, tt.ok, got, ok)
+		}
+	}
+
+	// decoded actions are converted the same way
+	m := &irc.Message{Source: irc.Prefix{Nick: "alice"}, Command: irc.CTCPAction, Params: irc.Params{"#chan", "waves"}}
+	if e, ok := (&bridge.Converter{}).FromIRC(m); !ok || e.Kind != bridge.KindAction || e.Text != "waves" {
+		t.Errorf("expected an action; got %+v, %t", e, ok)
+	}
+	m = &irc.Message{Source: irc.Prefix{Nick: "alice"}, Command: "privmsg", Params: irc.Params{"#chan", "hi"}}
+	if e, ok := (&bridge.Converter{}).FromIRC(m); !ok || e.Kind != bridge.KindMessage || e.Text != "hi" {
+		t.Errorf("expected a message regardless of the case of the command; got %+v, %t", e, ok)
+	}
+}
+
+func TestConverter_multiline(t *testing.T) {
+	conv := &bridge.Converter{}
+	lines := []string{
+		"@msgid=xyz BATCH +m1 draft/multiline #chan",
+		"@batch=m1 :alice!a@host PRIVMSG #chan :first line",
+		"@batch=m1 :alice!a@host PRIVMSG #chan :second ",
+		"@batch=m1;draft/multiline-concat :alice!a@host PRIVMSG #chan :line",
+		"BATCH -m1",
+	}
+	var events []bridge.Event
+	for _, line := range lines {
+		if e, ok := conv.FromIRC(parse(t, line)); ok {
+			events = append(events, e)
+		}
+	}
+	want := []bridge.Event{{ID: "xyz", Sender: "alice", Channel: "#chan", Text: "first line\nsecond line"}}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("expected %+v; got %+v", want, events)
+	}
+
+	// and sent back
+	conv.Multiline = true
+	msgs, err := conv.ToIRC(want[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, m := range msgs {
+		b, _ := m.MarshalText()
+		got = append(got, strings.TrimSpace(string(b)))
+	}
+	wantLines := []string{
+		"BATCH +multiline1 draft/multiline #chan",
+		"@batch=multiline1 PRIVMSG #chan :first line",
+		"@batch=multiline1 PRIVMSG #chan :second line",
+		"BATCH -multiline1",
+	}
+	if !reflect.DeepEqual(got, wantLines) {
+		t.Errorf("expected %q; got %q", wantLines, got)
+	}
+}
+
+func TestConverter_multilineUnfinished(t *testing.T) {
+	conv := &bridge.Converter{}
+	conv.FromIRC(parse(t, "BATCH +lost draft/multiline #chan"))
+	conv.FromIRC(parse(t, "@batch=lost :alice!a@host PRIVMSG #chan :never finished"))
+	// batches which are never closed don't pile up
+	for i := 0; i < 20; i++ {
+		conv.FromIRC(parse(t, fmt.Sprintf("BATCH +m%d draft/multiline #chan", i)))
+	}
+	if e, ok := conv.FromIRC(parse(t, "BATCH -lost")); ok {
+		t.Errorf("expected the oldest unfinished batch to be dropped; got %+v", e)
+	}
+	conv.FromIRC(parse(t, "@batch=m19 :alice!a@host PRIVMSG #chan :still open"))
+	if e, ok := conv.FromIRC(parse(t, "BATCH -m19")); !ok || e.Text != "still open" {
+		t.Errorf("expected the newest batch to be kept; got %+v, %t", e, ok)
+	}
+}
+
+func TestConverter_ToIRC(t *testing.T) {
+	tests := []struct {
+		conv  *bridge.Converter
+		event bridge.Event
+		want  []string
+	}{
+		{
+			&bridge.Converter{},
+			bridge.Event{Channel: "#chan", Text: "one\r\ntwo", Attachments: []string{"https://example.com/cat.png"}, ReplyTo: "abc"},
+			[]string{"@+draft/reply=abc PRIVMSG #chan :one", "PRIVMSG #chan :two", "PRIVMSG #chan :https://example.com/cat.png"},
+		},
+		{
+			&bridge.Converter{ShowSender: true},
+			bridge.Event{Sender: "carol", Channel: "#chan", Text: "hi"},
+			[]string{"PRIVMSG #chan :<carol> hi"},
+		},
+		{
+			&bridge.Converter{ShowSender: true},
+			bridge.Event{Sender: "carol", Channel: "#chan", Kind: bridge.KindAction, Text: "waves"},
+			[]string{"PRIVMSG #chan :* carol waves"},
+		},
+		{
+			&bridge.Converter{Multiline: true},
+			bridge.Event{Channel: "#chan", Kind: bridge.KindAction, Text: "waves", Edits: "abc"},
+			[]string{"@+draft/edit=abc PRIVMSG #chan :\x01ACTION waves\x01"},
+		},
+		{
+			&bridge.Converter{},
+			bridge.Event{Channel: "#chan", Kind: bridge.KindNotice, Text: "\n"},
+			nil,
+		},
+		{
+			&bridge.Converter{Multiline: true},
+			bridge.Event{To: "alice", Text: "one\ntwo"},
+			[]string{"BATCH +multiline1 draft/multiline alice", "@batch=multiline1 PRIVMSG alice :one", "@batch=multiline1 PRIVMSG alice :two", "BATCH -multiline1"},
+		},
+	}
+	for _, tt := range tests {
+		msgs, err := tt.conv.ToIRC(tt.event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, m := range msgs {
+			b, _ := m.MarshalText()
+			got = append(got, strings.TrimSpace(string(b)))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%+v: expected %q; got %q", tt.event, tt.want, got)
+		}
+	}
+
+	if _, err := (&bridge.Converter{}).ToIRC(bridge.Event{Text: "hi"}); err != bridge.ErrNoChannel {
+		t.Errorf("expected ErrNoChannel; got %v", err)
+	}
+}
@@ -0,0 +1,60 @@
+package irc
+
+import "strconv"
+
+// LineBudget returns the number of bytes available to the command and parameters of a message written by the client,
+// excluding CR-LF, once the server relays it to other clients with the client's prefix (":nick!user@host ").
+// Longer messages are likely to be truncated.
+//
+// The budget depends on the address the server shows for the client, which is learned while connecting
+// and updated from RPL_HOSTHIDDEN (396), CHGHOST, the client's own JOINs, and a WHOIS of the client.
+// Until the host is known, the longest likely prefix is assumed.
+// See OnLineBudget.
+func (c *Client) LineBudget() int {
+	limit := c.lineLimit()
+	if limit == 0 {
+		limit = defaultLineLength
+	}
+	prefix := unknownPrefixLength
+	if p := c.prefix(); p.Host != "" {
+		prefix = len(p.String()) + 2 // ':' and SPACE
+	}
+	return limit - prefix - 2 // CR-LF
+}
+
+// budgetWatch is middleware which calls OnLineBudget when a message changed the client's LineBudget.
+func (c *Client) budgetWatch(next Handler) Handler {
+	return HandlerFunc(func(w MessageWriter, m *Message) {
+		if c.OnLineBudget == nil {
+			next.SpeakIRC(w, m)
+			return
+		}
+		before := c.LineBudget()
+		next.SpeakIRC(w, m)
+		if budget := c.LineBudget(); budget != before {
+			c.OnLineBudget(budget)
+		}
+	})
+}
+
+// capMaxLine is the name of the capability with which Ergo servers accept lines longer than 512 bytes.
+// Its value is the new limit.
+const capMaxLine = "oragono.io/maxline-2"
+
+// lineLimit returns the length limit of a line without tags, including CR-LF, which the server advertised
+// in the LINELEN token of RPL_ISUPPORT or as the value of an enabled maxline capability.
+// It returns 0 when the server advertised neither.
+func (c *Client) lineLimit() int {
+	if v, ok := c.state.isupport.get("LINELEN"); ok {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return n
+		}
+	}
+	if c.CapEnabled(capMaxLine) {
+		v, _ := c.CapValue(capMaxLine)
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return n
+		}
+	}
+	return 0
+}
@@ -0,0 +1,234 @@
+package irc
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults used by a BurstCoalescer when its fields are left empty.
+const (
+	DefaultBurstThreshold = 10
+	DefaultBurstWindow    = 2 * time.Second
+)
+
+// CmdBurst is the command of the messages written by a BurstCoalescer in place of the JOIN, PART, and QUIT messages of a burst.
+// See BurstEvent.
+//
+// CmdBurst is *not* a valid IRC command; the messages are never sent to or received from a server.
+const CmdBurst Command = "_BURST"
+
+// A BurstCoalescer is middleware which coalesces storms of JOIN, PART, and QUIT messages,
+// such as the rejoins after a netsplit heals or a mass-join raid, into a single BurstEvent,
+// so that handlers like greeters and loggers aren't called thousands of times a second.
+//
+// Messages are counted separately for each command and channel; QUITs are counted for the whole network.
+// Once Threshold messages arrived within Window, the ones that follow are held back instead of passed on,
+// until Window passes without another one. The held messages are then passed on as one CmdBurst message.
+// The messages before the threshold was reached are passed on as usual.
+//
+// The client tracks channel members before its handler sees a message,
+// so Client.Members is up to date even for the messages held back.
+//
+// The CmdBurst messages are routed like any other message, so the middleware is attached to the Router:
+//
+//	b := &irc.BurstCoalescer{}
+//	r.Use(b.Middleware)
+//	r.OnBurstEvent(func(w irc.MessageWriter, e *irc.BurstEvent) {
+//		log.Printf("%d users joined %s", e.Count, e.Channel)
+//	})
+type BurstCoalescer struct {
+
+	// Threshold is the number of messages within Window which starts a burst.
+	// If 0, DefaultBurstThreshold is used.
+	Threshold int
+
+	// Window is how recent the messages counted towards Threshold must be,
+	// and how long a burst lasts after its last message. If 0, DefaultBurstWindow is used.
+	Window time.Duration
+}
+
+// Middleware coalesces the bursts of messages passed to next.
+// Next is called with the CmdBurst message of a burst from another goroutine once the burst ends,
+// but never while it's handling another message.
+func (b *BurstCoalescer) Middleware(next Handler) Handler {
+	g := &burstGate{b: b, next: next, keys: make(map[burstKey]*burstState)}
+	return HandlerFunc(g.speakIRC)
+}
+
+// burstKey identifies the messages which are counted together.
+type burstKey struct {
+	cmd     Command // uppercase
+	channel string  // folded with the server's CASEMAPPING; empty for QUIT
+}
+
+// burstState is the recent messages of a burstKey, and the burst in progress, if any.
+type burstState struct {
+	recent []time.Time // the times of the recent messages, oldest first
+
+	// held are the messages of the burst in progress, and timer ends it.
+	held  []*Message
+	timer *time.Timer
+	w     MessageWriter
+}
+
+// burstGate is the state of one BurstCoalescer middleware.
+type burstGate struct {
+	b    *BurstCoalescer
+	next Handler
+
+	// handling serializes the calls to next.
+	handling sync.Mutex
+
+	mu   sync.Mutex
+	keys map[burstKey]*burstState
+}
+
+func (g *burstGate) speakIRC(w MessageWriter, m *Message) {
+	if g.hold(w, m) {
+		return
+	}
+	g.handling.Lock()
+	defer g.handling.Unlock()
+	g.next.SpeakIRC(w, m)
+}
+
+// hold reports whether m is part of a burst, and holds it if so.
+func (g *burstGate) hold(w MessageWriter, m *Message) bool {
+	var key burstKey
+	cmd := m.Command
+	cmd.normalize()
+	switch cmd {
+	case CmdJoin, CmdPart:
+		info, _ := ConnInfoOf(w)
+		key = burstKey{cmd: cmd, channel: info.fold(m.Params.Get(1))}
+	case CmdQuit:
+		key = burstKey{cmd: cmd}
+	default:
+		return false
+	}
+	threshold, window := g.b.Threshold, g.b.Window
+	if threshold <= 0 {
+		threshold = DefaultBurstThreshold
+	}
+	if window <= 0 {
+		window = DefaultBurstWindow
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	st := g.keys[key]
+	if st == nil {
+		st = &burstState{}
+		g.keys[key] = st
+	}
+	if st.timer != nil {
+		st.held = append(st.held, m)
+		st.w = w
+		st.timer.Reset(window)
+		return true
+	}
+
+	now := time.Now()
+	recent := st.recent[:0]
+	for _, t := range st.recent {
+		if now.Sub(t) < window {
+			recent = append(recent, t)
+		}
+	}
+	st.recent = append(recent, now)
+	if len(st.recent) <= threshold {
+		return false
+	}
+	st.held = []*Message{m}
+	st.w = w
+	st.timer = time.AfterFunc(window, func() { g.flush(key) })
+	return true
+}
+
+// flush ends the burst of key, and passes its messages on as one CmdBurst message.
+func (g *burstGate) flush(key burstKey) {
+	g.mu.Lock()
+	st := g.keys[key]
+	if st == nil || st.timer == nil {
+		g.mu.Unlock()
+		return
+	}
+	held, w := st.held, st.w
+	delete(g.keys, key)
+	g.mu.Unlock()
+
+	info, _ := ConnInfoOf(w)
+	m := burstMessage(key.cmd, held, info.fold)
+	g.handling.Lock()
+	defer g.handling.Unlock()
+	g.next.SpeakIRC(w, m)
+}
+
+// burstMessage returns the CmdBurst message of held, the messages of a burst of cmd:
+//
+//	_BURST <command> <channel> <count> :<nick> <nick>...
+//
+// The channel is "*" for QUIT. Each nickname is listed once, in the order of their first message,
+// with nicknames compared by fold.
+func burstMessage(cmd Command, held []*Message, fold func(string) string) *Message {
+	channel := "*"
+	if !cmd.is(CmdQuit) {
+		channel = held[0].Params.Get(1)
+	}
+	seen := make(map[string]bool, len(held))
+	nicks := make([]string, 0, len(held))
+	for _, m := range held {
+		nick := m.Source.Nick.String()
+		if nick == "" || seen[fold(nick)] {
+			continue
+		}
+		seen[fold(nick)] = true
+		nicks = append(nicks, nick)
+	}
+	return &Message{
+		Command: CmdBurst,
+		Params:  Params{cmd.String(), channel, strconv.Itoa(len(held)), strings.Join(nicks, " ")},
+	}
+}
+
+// BurstEvent is a burst of JOIN, PART, or QUIT messages coalesced by a BurstCoalescer.
+type BurstEvent struct {
+	Message *Message
+
+	// Kind is the command of the coalesced messages: JOIN, PART, or QUIT.
+	Kind Command
+
+	// Channel is the channel joined or parted. It's empty for QUIT.
+	Channel string
+
+	// Count is the number of messages coalesced.
+	Count int
+
+	// Nicks are the users who sent the messages, each listed once.
+	Nicks []Nickname
+}
+
+// Command implements Event.
+func (e *BurstEvent) Command() Command { return CmdBurst }
+
+// Decode implements Event. m must be a CmdBurst message.
+func (e *BurstEvent) Decode(m *Message) error {
+	if err := expect(m, CmdBurst, 3); err != nil {
+		return err
+	}
+	count, err := strconv.Atoi(m.Params.Get(3))
+	if err != nil {
+		return fmt.Errorf("decode %s: invalid count %q", CmdBurst, m.Params.Get(3))
+	}
+	*e = BurstEvent{Message: m, Kind: Command(m.Params.Get(1)), Channel: m.Params.Get(2), Count: count}
+	if e.Channel == "*" {
+		e.Channel = ""
+	}
+	for _, nick := range strings.Fields(m.Params.Get(4)) {
+		e.Nicks = append(e.Nicks, Nickname(nick))
+	}
+	return nil
+}
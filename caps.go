@@ -0,0 +1,531 @@
+package irc
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultCapTimeout is how long capability negotiation and authentication may take when Client.CapTimeout is 0.
+const DefaultCapTimeout = 15 * time.Second
+
+// capReqLength is the longest list of capabilities sent in a single CAP REQ,
+// so that "CAP REQ :<list>" fits in a line, even counting the longest prefix the line length checks assume.
+const capReqLength = defaultLineLength - unknownPrefixLength - len("CAP REQ :\r\n")
+
+// capState tracks IRCv3 capabilities for a single connection:
+// which capabilities the server has advertised, which were requested, and which are currently enabled.
+// https://ircv3.net/specs/extensions/capability-negotiation.html
+type capState struct {
+	mu sync.RWMutex
+
+	// want is the list of capabilities to request whenever the server advertises them.
+	want []string
+
+	// available contains the capabilities advertised by the server in CAP LS and CAP NEW,
+	// mapped to their values (if any).
+	available map[string]string
+
+	// enabled contains the capabilities acknowledged by the server.
+	enabled map[string]bool
+
+	// rejected contains the capabilities the server refused with CAP NAK.
+	// A capability is no longer rejected once it's advertised again with CAP NEW.
+	rejected map[string]bool
+
+	// queued are the capabilities to request once the final line of a multiline CAP LS reply is received.
+	queued []string
+
+	// pending are the lists sent with CAP REQ which the server has not answered with ACK or NAK yet.
+	pending []string
+
+	// holds is the number of handlers which need capability negotiation to stay open,
+	// such as SASL authentication which must complete before CAP END.
+	holds int
+
+	// lsDone is set once the final line of the CAP LS reply was received.
+	lsDone bool
+
+	// ended is set once capability negotiation is over: we sent CAP END,
+	// the server doesn't support CAP, or registration completed without it.
+	ended bool
+
+	// listing is set while the lines of a multiline CAP LIST reply are received.
+	listing bool
+
+	// deleted is called with the names of the capabilities removed with CAP DEL, before the next handler sees the message,
+	// so that the client's subsystems which rely on them stop doing so (optional).
+	// It must be set before the connection's messages are handled.
+	deleted func(names []string)
+}
+
+func newCapState(want []string) *capState {
+	return &capState{
+		want:      want,
+		available: make(map[string]string),
+		enabled:   make(map[string]bool),
+		rejected:  make(map[string]bool),
+	}
+}
+
+// isEnabled reports whether the server has acknowledged capability name.
+func (cs *capState) isEnabled(name string) bool {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	return cs.enabled[strings.ToLower(name)]
+}
+
+// isRejected reports whether the server refused to enable capability name.
+func (cs *capState) isRejected(name string) bool {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	return cs.rejected[strings.ToLower(name)]
+}
+
+// value returns the value of capability name as advertised by the server,
+// and whether the server advertised it.
+func (cs *capState) value(name string) (string, bool) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	v, ok := cs.available[strings.ToLower(name)]
+	return v, ok
+}
+
+// list returns the names of the enabled capabilities.
+func (cs *capState) list() []string {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	caps := make([]string, 0, len(cs.enabled))
+	for c := range cs.enabled {
+		caps = append(caps, c)
+	}
+	return caps
+}
+
+// advertise records the capabilities in a CAP LS or CAP NEW list
+// and returns the names of the capabilities we want which are neither enabled nor already requested.
+func (cs *capState) advertise(list string) []string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	var req []string
+	for _, c := range strings.Fields(list) {
+		name, value, _ := strings.Cut(c, "=")
+		name = strings.ToLower(name)
+		cs.available[name] = value
+		delete(cs.rejected, name)
+		if cs.enabled[name] || cs.requested(name) {
+			continue
+		}
+		for _, w := range cs.want {
+			if strings.EqualFold(w, name) {
+				req = append(req, name)
+				break
+			}
+		}
+	}
+	return req
+}
+
+// requested reports whether capability name is queued or waiting for an answer to CAP REQ.
+// cs.mu must be held.
+func (cs *capState) requested(name string) bool {
+	if containsFold(cs.queued, name) {
+		return true
+	}
+	for _, list := range cs.pending {
+		if containsFold(strings.Fields(list), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// ls handles the capabilities we want from a line of the CAP LS reply.
+// They're queued until the final line, which marks the reply complete and returns everything queued,
+// so that they're requested in as few CAP REQ lines as possible.
+func (cs *capState) ls(req []string, final bool) []string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.queued = append(cs.queued, req...)
+	if !final {
+		return nil
+	}
+	cs.lsDone = true
+	req, cs.queued = cs.queued, nil
+	return req
+}
+
+// request sends a CAP REQ for each list and records them as pending until the server answers.
+func (cs *capState) request(mw MessageWriter, lists []string) {
+	if len(lists) == 0 {
+		return
+	}
+	cs.mu.Lock()
+	cs.pending = append(cs.pending, lists...)
+	cs.mu.Unlock()
+	for _, list := range lists {
+		mw.WriteMessage(CapReq(list))
+	}
+}
+
+// capBatches joins caps into as few lists as possible which fit in a CAP REQ line.
+func capBatches(caps []string) []string {
+	var lists []string
+	var b strings.Builder
+	for _, c := range caps {
+		if b.Len() > 0 && b.Len()+1+len(c) > capReqLength {
+			lists = append(lists, b.String())
+			b.Reset()
+		}
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(c)
+	}
+	if b.Len() > 0 {
+		lists = append(lists, b.String())
+	}
+	return lists
+}
+
+// ack records the capabilities in a CAP ACK or CAP LIST list as enabled.
+// Capabilities prefixed with '-' were disabled.
+// It returns the capabilities with the ack modifier ('~'), which the server needs us to acknowledge with our own CAP ACK
+// before it enables them (CAP 3.1 draft). The sticky modifier ('=') is ignored.
+func (cs *capState) ack(list string) (confirm []string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for _, c := range strings.Fields(list) {
+		if strings.HasPrefix(c, "-") {
+			delete(cs.enabled, strings.ToLower(c[1:]))
+			continue
+		}
+		name := strings.TrimLeft(c, "=~")
+		if strings.Contains(c[:len(c)-len(name)], "~") {
+			confirm = append(confirm, name)
+		}
+		cs.enabled[strings.ToLower(name)] = true
+	}
+	return confirm
+}
+
+// listed records the capabilities in a line of the CAP LIST reply as enabled.
+// The reply lists every enabled capability, so the ones missing from it are no longer enabled.
+// more is set when more lines of the reply follow.
+func (cs *capState) listed(list string, more bool) {
+	cs.mu.Lock()
+	if !cs.listing {
+		cs.enabled = make(map[string]bool)
+	}
+	cs.listing = more
+	cs.mu.Unlock()
+	cs.ack(list)
+}
+
+// resolve removes the CAP REQ which the server answered with list from the pending requests.
+//
+// When the server refuses a request (nak), none of its capabilities are enabled.
+// A refused request for a single capability marks it rejected;
+// a refused request for several is returned as retry, so that each can be requested alone
+// and one capability the server won't enable doesn't cost us the others.
+func (cs *capState) resolve(list string, nak bool) (retry []string) {
+	names := capNames(list)
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	found := false
+	for i, p := range cs.pending {
+		if sameCaps(capNames(p), names) {
+			cs.pending = append(cs.pending[:i], cs.pending[i+1:]...)
+			found = true
+			break
+		}
+	}
+	if !nak {
+		return nil
+	}
+	if found && len(names) > 1 {
+		return names
+	}
+	for _, name := range names {
+		cs.rejected[strings.ToLower(name)] = true
+	}
+	return nil
+}
+
+// capNames returns the names of the capabilities in list, without modifiers.
+func capNames(list string) []string {
+	fields := strings.Fields(list)
+	for i, c := range fields {
+		fields[i] = strings.TrimLeft(c, "-=~")
+	}
+	return fields
+}
+
+// sameCaps reports whether a and b are the same capabilities, in any order.
+func sameCaps(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, c := range a {
+		if !containsFold(b, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// del removes the capabilities in a CAP DEL list, and returns their names.
+// Deleted capabilities are no longer available and no longer enabled.
+func (cs *capState) del(list string) []string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	var names []string
+	for _, c := range strings.Fields(list) {
+		name := strings.ToLower(c)
+		delete(cs.available, name)
+		delete(cs.enabled, name)
+		names = append(names, name)
+	}
+	return names
+}
+
+// hold delays the end of capability negotiation until release is called.
+// hold must be called before the final line of the CAP LS reply is handled.
+func (cs *capState) hold() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.holds++
+}
+
+// release removes a hold placed by hold.
+// When the last hold is removed after negotiation could otherwise end, capability negotiation is ended.
+func (cs *capState) release(mw MessageWriter) {
+	cs.mu.Lock()
+	cs.holds--
+	cs.mu.Unlock()
+	cs.maybeEnd(mw)
+}
+
+// maybeEnd ends capability negotiation once it's complete: the CAP LS reply was received,
+// every CAP REQ was answered, and no handler holds negotiation open.
+func (cs *capState) maybeEnd(mw MessageWriter) {
+	cs.mu.Lock()
+	end := cs.lsDone && cs.holds == 0 && len(cs.pending) == 0 && !cs.ended
+	cs.mu.Unlock()
+	if end {
+		cs.end(mw)
+	}
+}
+
+// end requests a list of the caps enabled and ends capability negotiation.
+// Note that we send CAP END before handling the response of CAP LIST. This is intentional, since we have
+// no reason to wait for the response.
+func (cs *capState) end(mw MessageWriter) {
+	cs.mu.Lock()
+	cs.ended = true
+	cs.mu.Unlock()
+	mw.WriteMessage(CapList())
+	mw.WriteMessage(CapEnd())
+}
+
+// expire ends capability negotiation if it's still open, whether or not the server finished its CAP LS reply,
+// answered every CAP REQ, and handlers are holding negotiation open.
+// It keeps a server which never completes negotiation, or a handler which never releases its hold, from stalling registration.
+func (cs *capState) expire(mw MessageWriter) {
+	cs.mu.Lock()
+	open := !cs.ended
+	cs.mu.Unlock()
+	if open {
+		cs.end(mw)
+	}
+}
+
+// abandon marks capability negotiation as over without sending anything, because the server doesn't take part in it.
+func (cs *capState) abandon() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.ended = true
+}
+
+// middleware listens for CAP messages to track capability state and complete capability negotiation.
+//
+// "CAP * LS * :extended-join chghost cap-notify userhost-in-names multi-prefix"
+// "CAP * LS :extended-join chghost cap-notify userhost-in-names multi-prefix"
+// "CAP <nick> ACK :extended-join "
+// "CAP <nick> NAK :extended-join "
+// "CAP <nick> LIST * :extended-join chghost cap-notify userhost-in-names multi-prefix away-notify account-notify"
+// "CAP <nick> LIST :extended-join chghost cap-notify userhost-in-names multi-prefix away-notify account-notify"
+// "CAP <nick> NEW :away-notify"
+// "CAP <nick> DEL :away-notify"
+// https://ircv3.net/specs/core/capability-negotiation.html
+func (cs *capState) middleware(next Handler) Handler {
+	return HandlerFunc(func(mw MessageWriter, m *Message) {
+		switch {
+		// Servers which don't support IRCv3 either reply to CAP LS with ERR_UNKNOWNCOMMAND or ignore it
+		// and complete registration after NICK and USER. Either way, there is nothing to negotiate.
+		case m.Command.is(RplErrUnknownCommand) && strings.EqualFold(m.Params.Get(2), CmdCap),
+			m.Command.is(RplWelcome):
+			cs.abandon()
+			next.SpeakIRC(mw, m)
+			return
+		case !m.Command.is(CmdCap):
+			next.SpeakIRC(mw, m)
+			return
+		}
+
+		// if this is ever true then something is either wrong with the server or with our message parser
+		if len(m.Params) < 3 {
+			next.SpeakIRC(mw, m)
+			return
+		}
+
+		// the list of capabilities is always in the last (trailing) parameter, separated by SPACE
+		list := m.Params.Get(len(m.Params))
+		subcommand := strings.ToUpper(m.Params.Get(2))
+
+		// state is updated before calling the next handler, so that handlers reacting to ACK/NAK/DEL
+		// will see the new state.
+		var confirm, retry []string
+		switch subcommand {
+		case "ACK":
+			confirm = cs.ack(list)
+			cs.resolve(list, false)
+		case "NAK":
+			retry = cs.resolve(list, true)
+		case "LIST":
+			cs.listed(list, m.Params.Get(3) == "*")
+		case "DEL":
+			// The client's own subsystems are torn down here. Handlers relying on a deleted capability
+			// must check Client.CapEnabled or listen for CAP DEL themselves (Router.OnCapDel).
+			if names := cs.del(list); cs.deleted != nil {
+				cs.deleted(names)
+			}
+		}
+
+		// the next handler is always called before we write anything, so that other middleware which request capabilities
+		// will write their message before we complete negotiation.
+		next.SpeakIRC(mw, m)
+
+		switch subcommand {
+
+		// LS lists the capabilities supported by the server.
+		// An asterisk in the 3rd param (before the CAP list) indicates there will be more lines coming
+		// for the CAP LS response, so the capabilities we want are requested after the last line.
+		// If the server does not support CAP Version 302 then multiple lines will be sent without the asterisk,
+		// which makes each line a complete reply. This should be fine, since additional capabilities can be requested
+		// at any time (requests after the end of negotiation are simply sent after CAP END).
+		case "LS":
+			cs.request(mw, capBatches(cs.ls(cs.advertise(list), m.Params.Get(3) != "*")))
+			cs.maybeEnd(mw)
+
+		// NEW is sent when the server makes additional capabilities available after negotiation has ended (cap-notify).
+		// Negotiation is already over, so we only need to request what we want.
+		case "NEW":
+			cs.request(mw, capBatches(cs.advertise(list)))
+
+		case "ACK":
+			if len(confirm) > 0 {
+				mw.WriteMessage(Cap("ACK", strings.Join(confirm, " ")))
+			}
+			cs.maybeEnd(mw)
+
+		case "NAK":
+			cs.request(mw, retry)
+			cs.maybeEnd(mw)
+		}
+	})
+}
+
+func (c *Client) capTimeout() time.Duration {
+	if c.CapTimeout == 0 {
+		return DefaultCapTimeout
+	}
+	return c.CapTimeout
+}
+
+// currentCaps returns the capabilities of the current connection, or nil before the first connection.
+func (c *Client) currentCaps() *capState {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	return c.caps
+}
+
+// CapEnabled reports whether the IRCv3 capability name is enabled on the current connection.
+//
+// Handlers relying on a capability should check CapEnabled before trusting data that depends on it,
+// since capabilities can be removed at any time with CAP DEL.
+// For example, message timestamps from the "time" tag should not be trusted once server-time is removed.
+func (c *Client) CapEnabled(name string) bool {
+	caps := c.currentCaps()
+	if caps == nil {
+		return false
+	}
+	return caps.isEnabled(name)
+}
+
+// CapRejected reports whether the server refused to enable the IRCv3 capability name with CAP NAK on the current connection.
+// Subsystems which need a capability can check CapRejected to tell a refusal from a request which is still waiting for an answer.
+func (c *Client) CapRejected(name string) bool {
+	caps := c.currentCaps()
+	if caps == nil {
+		return false
+	}
+	return caps.isRejected(name)
+}
+
+// EnabledCaps returns the names of the IRCv3 capabilities enabled on the current connection, in no particular order.
+func (c *Client) EnabledCaps() []string {
+	caps := c.currentCaps()
+	if caps == nil {
+		return nil
+	}
+	return caps.list()
+}
+
+// CapValue returns the value the server advertised for the IRCv3 capability name in CAP LS or CAP NEW,
+// and whether the server advertised it on the current connection.
+// The value is empty for capabilities advertised without one.
+//
+// With CAP LS 302, values describe how the server implements a capability:
+//
+//	mechs, _ := client.CapValue("sasl") // "PLAIN,EXTERNAL"
+//
+// A capability may be advertised without being enabled; see CapEnabled.
+func (c *Client) CapValue(name string) (string, bool) {
+	caps := c.currentCaps()
+	if caps == nil {
+		return "", false
+	}
+	return caps.value(name)
+}
+
+// MultilineLimits returns the limits of a draft/multiline batch sent by the client,
+// from the value of the draft/multiline capability: the maximum number of bytes of the combined message text,
+// and the maximum number of lines (0 when the server sets no limit).
+// ok is false when draft/multiline is not enabled.
+// https://ircv3.net/specs/extensions/multiline
+func (c *Client) MultilineLimits() (maxBytes, maxLines int, ok bool) {
+	if !c.CapEnabled(capMultiline) {
+		return 0, 0, false
+	}
+	v, _ := c.CapValue(capMultiline)
+	maxBytes, _ = strconv.Atoi(capParam(v, "max-bytes"))
+	maxLines, _ = strconv.Atoi(capParam(v, "max-lines"))
+	return maxBytes, maxLines, true
+}
+
+// capMultiline is the name of the IRCv3 draft/multiline capability.
+const capMultiline = "draft/multiline"
+
+// capParam returns the value of key in a capability value made of comma-separated key=value pairs,
+// such as "max-bytes=4096,max-lines=24".
+func capParam(value, key string) string {
+	for _, kv := range strings.Split(value, ",") {
+		if k, v, _ := strings.Cut(kv, "="); k == key {
+			return v
+		}
+	}
+	return ""
+}
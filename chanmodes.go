@@ -0,0 +1,277 @@
+package irc
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Channel is a channel the client is on, as tracked by the client. See Client.Channel.
+//
+// Modes are tracked from MODE and RPL_CHANNELMODEIS (324). Servers don't send a channel's modes on join;
+// send ModeQuery for the channel to learn the modes set before the client joined.
+type Channel struct {
+	Name string
+
+	// Created is when the channel was created, from RPL_CREATIONTIME (329), which servers send after RPL_CHANNELMODEIS.
+	// It's zero until then.
+	Created time.Time
+
+	// modes maps the modes set on the channel to their parameter, which is empty for modes without one.
+	// List modes such as bans aren't tracked.
+	modes map[rune]string
+
+	// prefixes maps the nicknames of the members, folded by fold, to their membership prefixes,
+	// and symbols are the prefixes of the server, from highest to lowest.
+	// fold is Client.fold, which follows the server's CASEMAPPING.
+	prefixes map[string]string
+	symbols  string
+	fold     func(string) string
+}
+
+// Modes returns the modes set on the channel, sorted and without a leading '+', e.g. "iklnt".
+// List modes such as +b aren't included.
+func (ch Channel) Modes() string {
+	set := make(map[rune]bool, len(ch.modes))
+	for r := range ch.modes {
+		set[r] = true
+	}
+	return sortedModes(set)
+}
+
+// Mode returns the parameter of mode, e.g. the limit of 'l', and whether mode is set on the channel.
+func (ch Channel) Mode(mode rune) (param string, ok bool) {
+	param, ok = ch.modes[mode]
+	return param, ok
+}
+
+// Key returns the key of the channel (+k), or "" if it has none or the key isn't known.
+// The key is known when it was set while the client was on the channel, when the client joined with it,
+// or after a ModeQuery while the client is on the channel.
+func (ch Channel) Key() string {
+	return ch.modes['k']
+}
+
+// Limit returns the user limit of the channel (+l), or 0 if it has none.
+func (ch Channel) Limit() int {
+	n, _ := strconv.Atoi(ch.modes['l'])
+	return n
+}
+
+// IsOp reports whether nick is a channel operator (@) on the channel, or has a higher prefix, such as ~ for owners.
+func (ch Channel) IsOp(nick string) bool {
+	if ch.fold == nil {
+		return false
+	}
+	prefixes, ok := ch.prefixes[ch.fold(nick)]
+	if !ok {
+		return false
+	}
+	op := strings.IndexByte(ch.symbols, '@')
+	for i := 0; i < len(prefixes); i++ {
+		if j := strings.IndexByte(ch.symbols, prefixes[i]); j >= 0 && j <= op {
+			return true
+		}
+	}
+	return false
+}
+
+// Channel returns the state of channel, and whether the client is on it.
+func (c *Client) Channel(channel string) (Channel, bool) {
+	c.connMu.Lock()
+	t := c.members
+	c.connMu.Unlock()
+	if t == nil {
+		return Channel{}, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ch := t.channel(channel)
+	if ch == nil {
+		return Channel{}, false
+	}
+	modes := make(map[rune]string, len(ch.modes))
+	for r, p := range ch.modes {
+		modes[r] = p
+	}
+	prefixes := make(map[string]string, len(ch.members))
+	for key, member := range ch.members {
+		prefixes[key] = member.Prefixes
+	}
+	symbols := serverModesOf(c.state.isupport.get).prefixSymbols
+	return Channel{Name: ch.name, Created: ch.created, modes: modes, prefixes: prefixes, symbols: symbols, fold: c.fold}, true
+}
+
+// parseChanModes parses the CHANMODES token of RPL_ISUPPORT, e.g. "beI,k,l,imnpst".
+// https://modern.ircdocs.horse/#chanmodes-parameter
+func parseChanModes(v string) chanModes {
+	types := strings.SplitN(v, ",", 5)
+	for len(types) < 4 {
+		types = append(types, "")
+	}
+	return chanModes{A: types[0], B: types[1], C: types[2], D: types[3]}
+}
+
+// A ModeChange is a single change of a channel mode, split out of a MODE message.
+type ModeChange struct {
+
+	// Add is true for a mode which was set (+), and false for a mode which was unset (-).
+	Add bool
+
+	Mode rune
+
+	// Param is the parameter of the mode, e.g. the nickname of +o or the mask of +b. It's empty for modes without one.
+	Param string
+}
+
+// serverModes are the channel modes of a server, from the CHANMODES and PREFIX tokens of RPL_ISUPPORT,
+// which are needed to tell which modes of a MODE message take a parameter.
+type serverModes struct {
+	chanModes
+
+	// prefixModes are the modes of the membership prefixes, e.g. "ov",
+	// and prefixSymbols are their symbols in the same order, e.g. "@+".
+	prefixModes   string
+	prefixSymbols string
+}
+
+// serverModesOf returns the channel modes advertised by a server, or the defaults.
+// isupport looks up a token of RPL_ISUPPORT; it may be nil.
+func serverModesOf(isupport func(name string) (string, bool)) serverModes {
+	sm := serverModes{chanModes: defaultChanModes, prefixModes: "ov", prefixSymbols: "@+"}
+	if isupport == nil {
+		return sm
+	}
+	if v, ok := isupport("CHANMODES"); ok {
+		sm.chanModes = parseChanModes(v)
+	}
+	// PREFIX=(ov)@+
+	if v, ok := isupport("PREFIX"); ok {
+		if modes, symbols, ok := strings.Cut(strings.TrimPrefix(v, "("), ")"); ok && len(modes) == len(symbols) {
+			sm.prefixModes, sm.prefixSymbols = modes, symbols
+		}
+	}
+	return sm
+}
+
+// split splits the mode string change and its parameters, e.g. "+ol-m" "nick" "10", into single changes.
+func (sm serverModes) split(change string, params []string) []ModeChange {
+	var changes []ModeChange
+	add := true
+	for _, r := range change {
+		mc := ModeChange{Add: add, Mode: r}
+		switch {
+		case r == '+':
+			add = true
+			continue
+		case r == '-':
+			add = false
+			continue
+		// lists, membership prefixes, and type B always have a parameter; type C only when set
+		case strings.ContainsRune(sm.A, r), strings.ContainsRune(sm.prefixModes, r), strings.ContainsRune(sm.B, r),
+			add && strings.ContainsRune(sm.C, r):
+			if len(params) > 0 {
+				mc.Param, params = params[0], params[1:]
+			}
+		}
+		changes = append(changes, mc)
+	}
+	return changes
+}
+
+// symbol returns the membership prefix symbol of mode, e.g. '@' for 'o', or 0 if mode isn't a membership prefix.
+func (sm serverModes) symbol(mode rune) byte {
+	if i := strings.IndexRune(sm.prefixModes, mode); i >= 0 {
+		return sm.prefixSymbols[i]
+	}
+	return 0
+}
+
+// apply applies changes to modes, the modes set on a channel. Lists and membership prefixes aren't kept in modes.
+func (sm serverModes) apply(modes map[rune]string, changes []ModeChange) {
+	for _, mc := range changes {
+		switch {
+		case strings.ContainsRune(sm.A, mc.Mode), strings.ContainsRune(sm.prefixModes, mc.Mode):
+		case mc.Add:
+			modes[mc.Mode] = mc.Param
+		default:
+			delete(modes, mc.Mode)
+		}
+	}
+}
+
+// channelKeys remembers the keys of channels across connections, so that the client can join them again
+// after a reconnect or kick.
+//
+// Channel names are folded by Client.fold, which the callers of get, set, and joined do,
+// so that the keys follow the server's CASEMAPPING like the rest of the channel state.
+type channelKeys struct {
+	mu      sync.Mutex
+	keys    map[string]string // keyed by folded channel name
+	joining map[string]string // the keys sent with JOIN, until the server confirms the join
+}
+
+// get returns the last known key of the folded channel.
+func (k *channelKeys) get(channel string) string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.keys[channel]
+}
+
+// set records the key of the folded channel. An empty key forgets it.
+func (k *channelKeys) set(channel, key string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if key == "" {
+		delete(k.keys, channel)
+		return
+	}
+	if k.keys == nil {
+		k.keys = make(map[string]string)
+	}
+	k.keys[channel] = key
+}
+
+// sent records the keys of a JOIN written by the client, with the channel names folded by fold.
+func (k *channelKeys) sent(m *Message, fold func(string) string) {
+	if !m.Command.is(CmdJoin) || len(m.Params) < 2 {
+		return
+	}
+	keys := strings.Split(m.Params.Get(2), ",")
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.joining == nil {
+		k.joining = make(map[string]string)
+	}
+	for i, channel := range strings.Split(m.Params.Get(1), ",") {
+		if i < len(keys) && keys[i] != "" {
+			k.joining[fold(channel)] = keys[i]
+		}
+	}
+}
+
+// joined returns the key the client joined the folded channel with, if any, and records it as the channel's key.
+func (k *channelKeys) joined(channel string) string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	key, ok := k.joining[channel]
+	if !ok {
+		return ""
+	}
+	delete(k.joining, channel)
+	if k.keys == nil {
+		k.keys = make(map[string]string)
+	}
+	k.keys[channel] = key
+	return key
+}
+
+// parseCreationTime parses the time of RPL_CREATIONTIME, in seconds since the Unix epoch.
+func parseCreationTime(s string) time.Time {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(n, 0)
+}
@@ -0,0 +1,683 @@
+package irc
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// whoxToken marks the WHOX replies to the client's own refresh queries.
+const whoxToken = "135"
+
+// DefaultRejoinDelay is how long the client waits to rejoin a channel it was kicked from when Client.RejoinDelay is 0.
+const DefaultRejoinDelay = 5 * time.Second
+
+// With RejoinOnKick, the client stops rejoining a channel which kicked it maxRejoins times within rejoinWindow,
+// so that a channel which kicks the bot on sight isn't flooded with JOINs.
+const (
+	maxRejoins   = 3
+	rejoinWindow = 10 * time.Minute
+)
+
+// Member is a user on a channel, as tracked by the client.
+type Member struct {
+	Nick Nickname
+
+	// User and Host are empty until they're learned from a JOIN, WHO, or userhost-in-names (see Client.Caps).
+	// When they're unknown, Client.Members sends a WHO for the channel, so that they're known to later calls.
+	User string
+	Host string
+
+	// Account is the services account of the member, as reported by WHOX.
+	// It's empty when the member isn't logged in, or the server doesn't support WHOX.
+	Account string
+
+	// Prefixes are the membership prefixes of the member, such as "@" for channel operators.
+	// Only the highest is known unless the multi-prefix capability is enabled.
+	Prefixes string
+
+	// Away is set when the member is marked as away.
+	// It's updated right away with the away-notify capability, and otherwise only by WHO refreshes (see Client.WhoRefresh).
+	Away bool
+
+	// AwayMessage is the reason given by an away member, when it's known from away-notify or RPL_AWAY.
+	AwayMessage string
+}
+
+// Prefix returns the member's nick!user@host, e.g. for Mask to make a ban mask.
+// The user and host are empty until they're known; see Client.Members.
+func (mem Member) Prefix() Prefix {
+	return Prefix{Nick: mem.Nick, User: mem.User, Host: mem.Host}
+}
+
+// StateDrift describes the differences found when a refresh of a channel's members with WHO
+// didn't match the members tracked by the client, because the client missed events,
+// e.g. during a netsplit.
+type StateDrift struct {
+	Channel string
+
+	// Joined are the members the client didn't know about,
+	// Parted are the tracked members who are no longer on the channel,
+	// and Changed are the members whose prefixes, user, or host were out of date.
+	Joined  []Nickname
+	Parted  []Nickname
+	Changed []Nickname
+}
+
+// awayChange is a change of a member's away status, reported to Client.OnMemberAway.
+type awayChange struct {
+	nick    Nickname
+	away    bool
+	message string
+}
+
+// channelTracker keeps the members of the client's channels up to date,
+// and refreshes them with WHO every Client.WhoRefresh.
+type channelTracker struct {
+	ctx    context.Context
+	client *Client
+
+	mu       sync.Mutex
+	channels map[string]*trackedChannel // keyed by folded channel name (see Client.fold)
+
+	// refreshing is the channel with a WHO refresh in flight, if any.
+	refreshing *trackedChannel
+	timer      *time.Timer
+
+	// kicks counts the recent kicks of the client, keyed by folded channel name, for RejoinOnKick.
+	kicks map[string]*kickCount
+}
+
+// kickCount is the number of times the client was kicked from a channel since first.
+type kickCount struct {
+	n     int
+	first time.Time
+}
+
+type trackedChannel struct {
+	name    string
+	members map[string]*Member // keyed by folded nickname
+
+	// names collects the members from RPL_NAMREPLY until RPL_ENDOFNAMES.
+	names map[string]*Member
+
+	// who collects the members from a refresh until RPL_ENDOFWHO.
+	who map[string]*Member
+
+	// refreshed is when the last refresh was sent.
+	refreshed time.Time
+
+	// needsHosts is set when the hosts of members are unknown after NAMES, and Members should send a WHO to learn them.
+	needsHosts bool
+
+	// modes and created are the state returned by Client.Channel.
+	modes   map[rune]string
+	created time.Time
+}
+
+func newChannelTracker(ctx context.Context, c *Client) *channelTracker {
+	return &channelTracker{ctx: ctx, client: c, channels: make(map[string]*trackedChannel), kicks: make(map[string]*kickCount)}
+}
+
+func (t *channelTracker) middleware(next Handler) Handler {
+	return HandlerFunc(func(w MessageWriter, m *Message) {
+		rejoin := t.rejoin(m)
+		drift, away := t.update(m)
+		next.SpeakIRC(w, m)
+		if rejoin != nil {
+			time.AfterFunc(t.client.rejoinDelay(), func() {
+				if t.ctx.Err() == nil {
+					t.client.WriteMessage(rejoin)
+				}
+			})
+		}
+		if drift != nil && t.client.OnStateDrift != nil {
+			t.client.OnStateDrift(*drift)
+		}
+		if t.client.OnMemberAway != nil {
+			for _, a := range away {
+				t.client.OnMemberAway(a.nick, a.away, a.message)
+			}
+		}
+	})
+}
+
+// autoJoin joins the channels of AutoJoin.
+// A key learned since the client last joined a channel replaces the key of AutoJoin.
+func (c *Client) autoJoin(w MessageWriter) {
+	for _, channel := range c.AutoJoin {
+		name, key, _ := strings.Cut(channel, " ")
+		if known := c.keys.get(c.fold(name)); known != "" {
+			key = known
+		}
+		if key != "" {
+			w.WriteMessage(JoinWithKey(name, key))
+			continue
+		}
+		w.WriteMessage(Join(name))
+	}
+}
+
+// update applies the membership changes caused by m, and returns the drift found by a completed refresh
+// and the members whose away status changed.
+func (t *channelTracker) update(m *Message) (*StateDrift, []awayChange) {
+	me := t.client.Nick()
+	nick := m.Source.Nick
+	self := t.client.fold(nick.String()) == t.client.fold(me.String())
+
+	cmd := m.Command
+	cmd.normalize()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch cmd {
+	case RplWelcome:
+		t.channels = make(map[string]*trackedChannel)
+		t.refreshing = nil
+		t.schedule(t.client.WhoRefresh)
+	case CmdJoin:
+		name := m.Params.Get(1)
+		if self {
+			ch := &trackedChannel{name: name, members: make(map[string]*Member), modes: make(map[rune]string)}
+			if key := t.client.keys.joined(t.client.fold(name)); key != "" {
+				ch.modes['k'] = key
+			}
+			t.channels[t.client.fold(name)] = ch
+		}
+		if ch := t.channel(name); ch != nil {
+			ch.members[t.client.fold(nick.String())] = &Member{Nick: nick, User: m.Source.User, Host: m.Source.Host}
+		}
+	case CmdPart:
+		t.part(m.Params.Get(1), nick, self)
+	case CmdKick:
+		target := Nickname(m.Params.Get(2))
+		t.part(m.Params.Get(1), target, t.client.fold(target.String()) == t.client.fold(me.String()))
+	case CmdQuit:
+		for _, ch := range t.channels {
+			delete(ch.members, t.client.fold(nick.String()))
+		}
+	// away-notify: "AWAY :<message>" when a user goes away, and "AWAY" when they're back
+	case CmdAway:
+		if nick == "" || m.Source.IsServer() {
+			break
+		}
+		return nil, t.setAway(nick, len(m.Params) > 0, m.Params.Get(1))
+	// "<client> <nick> :<message>"
+	case RplAway:
+		return nil, t.setAway(Nickname(m.Params.Get(2)), true, m.Params.Get(3))
+	case RplUnAway:
+		return nil, t.setAway(me, false, "")
+	case RplNowAway:
+		return nil, t.setAway(me, true, "")
+	case CmdMode:
+		// "MODE <channel>" without a change is a query, which some servers echo
+		if ch := t.channel(m.Params.Get(1)); ch != nil && len(m.Params) >= 2 {
+			t.setModes(ch, m.Params.Get(2), m.Params[2:], false)
+		}
+	// "<client> <channel> <modestring> <mode arguments>..."
+	case RplChannelModeIs:
+		if ch := t.channel(m.Params.Get(2)); ch != nil && len(m.Params) >= 3 {
+			t.setModes(ch, m.Params.Get(3), m.Params[3:], true)
+		}
+	// "<client> <channel> <creationtime>"
+	case RplCreationTime:
+		if ch := t.channel(m.Params.Get(2)); ch != nil {
+			ch.created = parseCreationTime(m.Params.Get(3))
+		}
+	case CmdNick:
+		to := Nickname(m.Params.Get(1))
+		for _, ch := range t.channels {
+			if member := ch.members[t.client.fold(nick.String())]; member != nil {
+				delete(ch.members, t.client.fold(nick.String()))
+				member.Nick = to
+				ch.members[t.client.fold(to.String())] = member
+			}
+		}
+
+	// "<client> <symbol> <channel> :[prefix]<nick>{ [prefix]<nick>}"
+	case RplNamReply:
+		ch := t.channel(m.Params.Get(3))
+		if ch == nil {
+			break
+		}
+		if ch.names == nil {
+			ch.names = make(map[string]*Member)
+		}
+		for _, member := range parseNames(m.Params.Get(4), t.client.prefixSymbols()) {
+			member := member
+			ch.names[t.client.fold(member.Nick.String())] = &member
+		}
+	// "<client> <channel> :End of /NAMES list"
+	case RplEndOfNames:
+		ch := t.channel(m.Params.Get(2))
+		if ch == nil || ch.names == nil {
+			break
+		}
+		for key, member := range ch.names {
+			old := ch.members[key]
+			if old == nil {
+				continue
+			}
+			// NAMES only has the hosts of users with userhost-in-names
+			if member.Host == "" {
+				member.User, member.Host, member.Account = old.User, old.Host, old.Account
+			}
+			member.Away, member.AwayMessage = old.Away, old.AwayMessage
+		}
+		ch.members, ch.names = ch.names, nil
+		if !t.client.CapEnabled("userhost-in-names") {
+			for _, member := range ch.members {
+				if member.Host == "" {
+					ch.needsHosts = true
+					break
+				}
+			}
+		}
+
+	// "<client> <channel> <user> <host> <server> <nick> <flags> :<hopcount> <realname>"
+	case RplWhoReply:
+		t.whoReply(m.Params.Get(2), &Member{
+			Nick:     Nickname(m.Params.Get(6)),
+			User:     m.Params.Get(3),
+			Host:     m.Params.Get(4),
+			Prefixes: t.flagPrefixes(m.Params.Get(7)),
+			Away:     strings.HasPrefix(m.Params.Get(7), "G"),
+		})
+	// "<client> <token> <channel> <user> <host> <nick> <flags> <account>", in the order of the fields asked for
+	case RplWhoSpcRpl:
+		if m.Params.Get(2) != whoxToken {
+			break
+		}
+		account := m.Params.Get(8)
+		if account == "0" {
+			account = ""
+		}
+		t.whoReply(m.Params.Get(3), &Member{
+			Nick:     Nickname(m.Params.Get(6)),
+			User:     m.Params.Get(4),
+			Host:     m.Params.Get(5),
+			Account:  account,
+			Prefixes: t.flagPrefixes(m.Params.Get(7)),
+			Away:     strings.HasPrefix(m.Params.Get(7), "G"),
+		})
+	// "<client> <mask> :End of WHO list"
+	case RplEndOfWho:
+		ch := t.refreshing
+		if ch == nil || t.client.fold(ch.name) != t.client.fold(m.Params.Get(2)) {
+			break
+		}
+		t.refreshing = nil
+		if t.channel(ch.name) != ch {
+			// we left the channel while waiting
+			break
+		}
+		return ch.reconcile()
+	}
+	return nil, nil
+}
+
+// setModes applies a mode change to ch, and remembers the channel's key for joining it again.
+// With replace, the change lists every mode of the channel, as in RPL_CHANNELMODEIS.
+// t.mu must be held.
+func (t *channelTracker) setModes(ch *trackedChannel, change string, params []string, replace bool) {
+	if replace {
+		ch.modes = make(map[rune]string)
+	}
+	oldKey := ch.modes['k']
+	sm := serverModesOf(t.client.state.isupport.get)
+	changes := sm.split(change, params)
+	sm.apply(ch.modes, changes)
+	for _, mc := range changes {
+		if symbol := sm.symbol(mc.Mode); symbol != 0 {
+			if member := ch.members[t.client.fold(mc.Param)]; member != nil {
+				member.Prefixes = setPrefix(member.Prefixes, symbol, mc.Add, sm.prefixSymbols)
+			}
+		}
+	}
+	// some servers hide the key from users who aren't operators
+	if key := ch.modes['k']; key == "*" && oldKey != "" {
+		ch.modes['k'] = oldKey
+	}
+	if key := ch.modes['k']; key != oldKey || replace {
+		t.client.keys.set(t.client.fold(ch.name), key)
+	}
+}
+
+// setPrefix adds or removes symbol from the membership prefixes of a member,
+// keeping them in the order of symbols, from highest to lowest.
+func setPrefix(prefixes string, symbol byte, add bool, symbols string) string {
+	var b strings.Builder
+	for i := 0; i < len(symbols); i++ {
+		s := symbols[i]
+		has := strings.IndexByte(prefixes, s) >= 0
+		if s == symbol {
+			has = add
+		}
+		if has {
+			b.WriteByte(s)
+		}
+	}
+	return b.String()
+}
+
+// rejoin returns the JOIN which rejoins the channel the client was kicked from by m, with the channel's key,
+// when Client.RejoinOnKick is set. It returns nil for other messages,
+// and once the channel kicked the client maxRejoins times within rejoinWindow.
+func (t *channelTracker) rejoin(m *Message) *Message {
+	if !t.client.RejoinOnKick || !m.Command.is(CmdKick) || t.client.fold(t.client.Nick().String()) != t.client.fold(m.Params.Get(2)) {
+		return nil
+	}
+	channel := m.Params.Get(1)
+	key := t.client.fold(channel)
+	t.mu.Lock()
+	kc := t.kicks[key]
+	if kc == nil || time.Since(kc.first) > rejoinWindow {
+		kc = &kickCount{first: time.Now()}
+		t.kicks[key] = kc
+	}
+	kc.n++
+	n := kc.n
+	t.mu.Unlock()
+	if n > maxRejoins {
+		t.client.log(fmt.Errorf("not rejoining %s: kicked %d times within %s", channel, n, rejoinWindow))
+		return nil
+	}
+	if key := t.client.keys.get(t.client.fold(channel)); key != "" {
+		return JoinWithKey(channel, key)
+	}
+	return Join(channel)
+}
+
+// setAway records the away status of nick on every channel, and returns the change, if any.
+// t.mu must be held.
+func (t *channelTracker) setAway(nick Nickname, away bool, message string) []awayChange {
+	key := t.client.fold(nick.String())
+	changed := false
+	for _, ch := range t.channels {
+		member := ch.members[key]
+		if member == nil {
+			continue
+		}
+		if member.Away != away || member.AwayMessage != message && message != "" {
+			changed = true
+		}
+		member.Away = away
+		if !away || message != "" {
+			member.AwayMessage = message
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return []awayChange{{nick, away, message}}
+}
+
+func (c *Client) rejoinDelay() time.Duration {
+	if c.RejoinDelay == 0 {
+		return DefaultRejoinDelay
+	}
+	return c.RejoinDelay
+}
+
+// joined reports whether the client is on channel.
+func (t *channelTracker) joined(channel string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.channel(channel) != nil
+}
+
+// shares reports whether nick is a member of one of the client's channels.
+func (t *channelTracker) shares(nick string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := t.client.fold(nick)
+	for _, ch := range t.channels {
+		if ch.members[key] != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// channel returns the tracked channel name, or nil if the client isn't on it.
+func (t *channelTracker) channel(name string) *trackedChannel {
+	return t.channels[t.client.fold(name)]
+}
+
+func (t *channelTracker) part(channel string, nick Nickname, self bool) {
+	if self {
+		delete(t.channels, t.client.fold(channel))
+		return
+	}
+	if ch := t.channel(channel); ch != nil {
+		delete(ch.members, t.client.fold(nick.String()))
+	}
+}
+
+// whoReply records a member reported by the refresh of channel.
+func (t *channelTracker) whoReply(channel string, member *Member) {
+	ch := t.refreshing
+	if ch == nil || t.client.fold(ch.name) != t.client.fold(channel) {
+		return
+	}
+	ch.who[t.client.fold(member.Nick.String())] = member
+}
+
+// flagPrefixes returns the membership prefixes in the flags of a WHO reply, e.g. "@" from "H*@".
+func (t *channelTracker) flagPrefixes(flags string) string {
+	symbols := t.client.prefixSymbols()
+	var prefixes []byte
+	for i := 0; i < len(flags); i++ {
+		if strings.IndexByte(symbols, flags[i]) >= 0 {
+			prefixes = append(prefixes, flags[i])
+		}
+	}
+	return string(prefixes)
+}
+
+// reconcile replaces the tracked members with the ones reported by a refresh,
+// and returns the differences, or nil if there were none, and the members whose away status changed.
+func (ch *trackedChannel) reconcile() (*StateDrift, []awayChange) {
+	drift := StateDrift{Channel: ch.name}
+	var away []awayChange
+	for key, member := range ch.who {
+		old := ch.members[key]
+		if old != nil {
+			// WHO has the away status, but not the message
+			if member.Away && old.Away {
+				member.AwayMessage = old.AwayMessage
+			}
+			if member.Away != old.Away {
+				away = append(away, awayChange{member.Nick, member.Away, ""})
+			}
+		}
+		switch {
+		case old == nil:
+			drift.Joined = append(drift.Joined, member.Nick)
+		case old.Prefixes != member.Prefixes ||
+			old.Host != "" && (old.User != member.User || old.Host != member.Host):
+			drift.Changed = append(drift.Changed, member.Nick)
+		}
+	}
+	for key, member := range ch.members {
+		if ch.who[key] == nil {
+			drift.Parted = append(drift.Parted, member.Nick)
+		}
+	}
+	ch.members, ch.who = ch.who, nil
+	if len(drift.Joined)+len(drift.Parted)+len(drift.Changed) == 0 {
+		return nil, away
+	}
+	for _, nicks := range [][]Nickname{drift.Joined, drift.Parted, drift.Changed} {
+		sort.Slice(nicks, func(i, j int) bool { return nicks[i] < nicks[j] })
+	}
+	return &drift, away
+}
+
+// schedule runs the next refresh after d. t.mu must be held.
+func (t *channelTracker) schedule(d time.Duration) {
+	if t.client.WhoRefresh <= 0 {
+		return
+	}
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	t.timer = time.AfterFunc(d, t.refresh)
+}
+
+// refresh sends WHO for the channel refreshed longest ago, if it's due.
+//
+// Only one refresh is in flight at a time, and refreshes are spread out over Client.WhoRefresh,
+// so that a client on many channels doesn't flood the server with WHO queries.
+func (t *channelTracker) refresh() {
+	t.mu.Lock()
+	if t.ctx.Err() != nil {
+		t.mu.Unlock()
+		return
+	}
+	interval := t.client.WhoRefresh
+	pace := interval
+	if len(t.channels) > 0 {
+		pace = interval / time.Duration(len(t.channels))
+	}
+	var next *trackedChannel
+	for _, ch := range t.channels {
+		if next == nil || ch.refreshed.Before(next.refreshed) {
+			next = ch
+		}
+	}
+	switch {
+	case t.refreshing != nil && time.Since(t.refreshing.refreshed) < interval:
+		// the server hasn't answered the last refresh yet
+		t.schedule(pace)
+		t.mu.Unlock()
+		return
+	case next == nil:
+		t.schedule(interval)
+		t.mu.Unlock()
+		return
+	case time.Since(next.refreshed) < interval:
+		t.schedule(interval - time.Since(next.refreshed))
+		t.mu.Unlock()
+		return
+	}
+	m := t.startRefresh(next)
+	t.schedule(pace)
+	t.mu.Unlock()
+	t.client.WriteMessage(m)
+}
+
+// startRefresh marks ch as refreshing, and returns the WHO (or WHOX) query to send. t.mu must be held.
+func (t *channelTracker) startRefresh(ch *trackedChannel) *Message {
+	ch.refreshed = time.Now()
+	ch.who = make(map[string]*Member)
+	ch.needsHosts = false
+	t.refreshing = ch
+
+	m := Who(ch.name)
+	if t.client.state.isupport.has("WHOX") {
+		m.Params = append(m.Params, "%tcuhnfa,"+whoxToken)
+		m.Trailing = TrailingAuto
+	}
+	return m
+}
+
+// stop cancels the scheduled refresh.
+func (t *channelTracker) stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+}
+
+// prefixSymbols returns the membership prefixes advertised in RPL_ISUPPORT PREFIX, e.g. "@+" from "(ov)@+".
+func (c *Client) prefixSymbols() string {
+	v, ok := c.state.isupport.get("PREFIX")
+	if !ok {
+		return "@+"
+	}
+	if _, symbols, ok := strings.Cut(v, ")"); ok {
+		return symbols
+	}
+	return v
+}
+
+// splitPrefixes splits the membership prefixes from the start of a name in RPL_NAMREPLY.
+func splitPrefixes(name, symbols string) (prefixes, nick string) {
+	i := 0
+	for i < len(name) && strings.IndexByte(symbols, name[i]) >= 0 {
+		i++
+	}
+	return name[:i], name[i:]
+}
+
+// Channels returns the names of the channels the client is on, in sorted order.
+func (c *Client) Channels() []string {
+	c.connMu.Lock()
+	t := c.members
+	c.connMu.Unlock()
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	names := make([]string, 0, len(t.channels))
+	for _, ch := range t.channels {
+		names = append(names, ch.name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Members returns the members of channel sorted by nickname, or nil if the client isn't on channel.
+//
+// Members are tracked from JOIN, PART, KICK, QUIT, NICK, and NAMES.
+// Events missed during netsplits or while the client's queue overflowed can leave the members out of date;
+// set Client.WhoRefresh to correct them periodically.
+//
+// Without userhost-in-names, NAMES has no hosts; the first call after joining sends a WHO for channel
+// (unless another is in flight), and the hosts are filled in when it's answered. See Member.
+func (c *Client) Members(channel string) []Member {
+	c.connMu.Lock()
+	t := c.members
+	c.connMu.Unlock()
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	ch := t.channel(channel)
+	if ch == nil {
+		t.mu.Unlock()
+		return nil
+	}
+	members := make([]Member, 0, len(ch.members))
+	for _, member := range ch.members {
+		members = append(members, *member)
+	}
+	var who *Message
+	if ch.needsHosts && t.refreshing == nil {
+		who = t.startRefresh(ch)
+	}
+	t.mu.Unlock()
+	if who != nil {
+		c.WriteMessage(who)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Nick < members[j].Nick })
+	return members
+}
+
+// AwayMembers returns the members of channel who are marked as away, sorted by nickname.
+// See Member.Away for how up to date it is.
+func (c *Client) AwayMembers(channel string) []Member {
+	var away []Member
+	for _, member := range c.Members(channel) {
+		if member.Away {
+			away = append(away, member)
+		}
+	}
+	return away
+}
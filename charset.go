@@ -0,0 +1,68 @@
+package irc
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Charset is a legacy character encoding used to decode incoming text which is not valid UTF-8.
+//
+// Modern IRC networks use UTF-8, but plenty of older clients still send text in
+// whatever 8-bit encoding their operating system used. Without decoding, those bytes reach
+// handlers as invalid UTF-8 and typically end up displayed as mojibake.
+type Charset int
+
+const (
+	// CharsetNone passes invalid UTF-8 to handlers unchanged.
+	CharsetNone Charset = iota
+
+	// CharsetLatin1 decodes invalid UTF-8 as ISO-8859-1.
+	CharsetLatin1
+
+	// CharsetCP1252 decodes invalid UTF-8 as Windows-1252,
+	// which is a superset of ISO-8859-1 and was the default for Windows clients.
+	CharsetCP1252
+)
+
+// cp1252 maps the bytes 0x80-0x9F, where Windows-1252 differs from ISO-8859-1.
+// Bytes which are undefined in Windows-1252 map to the same code point as in ISO-8859-1.
+var cp1252 = [32]rune{
+	'€', '\u0081', '‚', 'ƒ', '„', '…', '†', '‡',
+	'ˆ', '‰', 'Š', '‹', 'Œ', '\u008D', 'Ž', '\u008F',
+	'\u0090', '‘', '’', '“', '”', '•', '–', '—',
+	'˜', '™', 'š', '›', 'œ', '\u009D', 'ž', 'Ÿ',
+}
+
+// Decode converts s to UTF-8 if s is not already valid UTF-8.
+// Valid UTF-8 is always returned unchanged, since a line which happens to be valid UTF-8
+// is far more likely to actually be UTF-8 than a legacy encoding.
+func (cs Charset) Decode(s string) string {
+	if cs == CharsetNone || utf8.ValidString(s) {
+		return s
+	}
+	var b strings.Builder
+	b.Grow(len(s) * 2)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c < 0x80:
+			b.WriteByte(c)
+		case c < 0xA0 && cs == CharsetCP1252:
+			b.WriteRune(cp1252[c-0x80])
+		default:
+			// ISO-8859-1 code points are identical to the first 256 Unicode code points
+			b.WriteRune(rune(c))
+		}
+	}
+	return b.String()
+}
+
+// decodeMessage converts every parameter of m which is not valid UTF-8 with cs.
+func (cs Charset) decodeMessage(m *Message) {
+	if cs == CharsetNone {
+		return
+	}
+	for i, p := range m.Params {
+		m.Params[i] = cs.Decode(p)
+	}
+}
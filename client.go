@@ -14,9 +14,15 @@ import (
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 )
 
-var errPingTimeout = errors.New("ping timeout")
+// ErrQueueFull is returned by ConnectAndRun when the client's queue of incoming messages is full
+// and Client.QueueOverflow is OverflowDisconnect.
+var ErrQueueFull = errors.New("incoming message queue is full")
+
+// DefaultQueueSize is the number of incoming messages queued for handlers when Client.QueueSize is 0.
+const DefaultQueueSize = 64
 
 // A Client manages a connection to an IRC server.
 // It reads/writes IRC lines on the connection,
@@ -31,6 +37,9 @@ type Client struct {
 	// Nicknames cannot contain spaces.
 	Nickname string
 
+	// AltNicks are tried in order when the server refuses Nickname while connecting, e.g. because it's in use (optional).
+	AltNicks []string
+
 	// The user name (required).
 	// User cannot contain spaces.
 	User string
@@ -43,14 +52,229 @@ type Client struct {
 	// The connection password (optional: depends on the network).
 	Pass string
 
+	// Caps lists the IRCv3 capabilities that the client requests whenever the server advertises them,
+	// either in reply to CAP LS while connecting or later with CAP NEW (cap-notify).
+	// Capabilities which the server does not support are skipped.
+	// With userhost-in-names, the hosts of channel members are known as soon as the client joins (see Member).
+	//
+	// Use CapEnabled to check whether a capability was acknowledged by the server.
+	Caps []string
+
 	// DialFn is a function that accepts no parameters and returns an io.ReadWriteCloser and error.
 	//
 	// The returned connection can be any io.ReadWriteCloser: irc, ircs, ws, wss, a server mock, etc.
 	// The only requirement is that the stream consists of CRLF-delimited IRC messages.
 	//
-	// When DialFn is nil, the default behavior dials Addr with tls.Dial.
+	// When DialFn is nil, the default behavior dials Addr with TLS, using Resolver and AddressFamily.
+	// Package ircdial builds a DialFn from parts such as retries, timeouts, TLS, and proxies.
 	DialFn func() (io.ReadWriteCloser, error)
 
+	// Resolver looks up the addresses of the host in Addr (optional).
+	// If nil, net.DefaultResolver is used.
+	// It is not used when DialFn is set.
+	Resolver Resolver
+
+	// AddressFamily controls whether IPv4 or IPv6 addresses of Addr are tried first, or exclusively.
+	// By default, addresses are tried in the order returned by the Resolver, with both families
+	// dialed in parallel after a short delay. It is not used when DialFn is set.
+	AddressFamily AddressFamily
+
+	// DialTimeout limits the time spent resolving, connecting to, and completing the TLS handshake with Addr.
+	// If 0, DefaultDialTimeout is used. It is not used when DialFn is set.
+	DialTimeout time.Duration
+
+	// TLSConfig is an optional TLS configuration used when dialing Addr.
+	// It is not used when DialFn is set.
+	TLSConfig *tls.Config
+
+	// Certificate is an optional TLS client certificate presented to the server when dialing Addr,
+	// for networks which support identifying users by certificate fingerprint (CertFP).
+	// See LoadCertificate and Fingerprint.
+	//
+	// When Certificate is set and SASL is nil, the client authenticates with SASL EXTERNAL.
+	Certificate *tls.Certificate
+
+	// KeepAlive is the period of TCP keepalive probes, which let the operating system notice
+	// a dead connection even when the client has nothing to send.
+	// It applies to TCP connections, including TLS over TCP, whether or not they were made by DialFn.
+	// If 0, DefaultKeepAlive is used. If negative, the connection's keepalive settings are left alone.
+	KeepAlive time.Duration
+
+	// StallTimeout enables the detection of half-open connections, much sooner than the ping timeout notices them.
+	// When nothing was read for StallTimeout, the client sends a PING;
+	// when nothing was read for another StallTimeout, or a write blocks for StallTimeout,
+	// ConnectAndRun returns an error wrapping ErrStalled.
+	// It applies to connections which implement net.Conn. If 0, stall detection is disabled.
+	StallTimeout time.Duration
+
+	// SASL is the mechanism used to authenticate during capability negotiation (optional).
+	// The sasl capability is requested automatically when SASL is set.
+	// Use SASLFirst to let the client choose among several mechanisms, by those the server advertises.
+	// SASL runs as the first of the client's Authenticators.
+	SASL SASLMechanism
+
+	// Auth are the Authenticators which authenticate the client while it connects (optional),
+	// such as NickServ, or twitch.OAuth.
+	Auth []Authenticator
+
+	// CapTimeout is how long the client waits for capability negotiation and its Authenticators, including SASL,
+	// to finish while connecting. Once it passes, the Authenticators which aren't done are given up on,
+	// negotiation is ended with CAP END so that registration continues with the capabilities the client has,
+	// and Perform and AutoJoin run without waiting any longer.
+	// This keeps a server which never finishes its CAP LS reply, or authentication which gets no answer, from stalling the connection.
+	// If 0, DefaultCapTimeout is used. If negative, the client waits as long as it takes.
+	CapTimeout time.Duration
+
+	// StrictLineEndings requires every line read from the connection to end with CR-LF,
+	// as defined by the IRC protocol.
+	// Lines containing a bare CR or LF are then reported to ErrorLog and dropped.
+	//
+	// By default, lines ending with a bare LF are also accepted,
+	// and stray CR characters are removed from each line.
+	// Some legacy servers and bridges send such lines, and the alternatives are
+	// to either merge multiple messages into one or to leak CR characters into message parameters.
+	StrictLineEndings bool
+
+	// Encoding is the legacy character encoding used to decode incoming message parameters
+	// which are not valid UTF-8 (optional).
+	// It has no effect when the server advertises the UTF8ONLY token in RPL_ISUPPORT,
+	// since those servers reject any text which is not valid UTF-8.
+	Encoding Charset
+
+	// QueueSize is the number of parsed messages which may wait for the handler,
+	// so that a handler which stalls briefly doesn't stop the client from reading the connection.
+	// If 0, DefaultQueueSize is used.
+	//
+	// Server PINGs are answered as soon as they're read, so a full queue never delays PONG replies.
+	QueueSize int
+
+	// QueueOverflow controls what happens when a message is read while the queue is full.
+	// The default is to stop reading until the handler catches up.
+	QueueOverflow OverflowPolicy
+
+	// ControlChars controls what WriteMessage does with messages containing CR, LF, or NUL characters,
+	// which would otherwise let text echoed from other users inject commands.
+	// The default is to drop them. See Sanitize.
+	ControlChars ControlCharPolicy
+
+	// OnForcedNickChange is called when the client's nickname was changed without the client asking for it,
+	// e.g. by services enforcing a registered nickname or by a server operator (optional).
+	OnForcedNickChange func(old, nick Nickname)
+
+	// ReclaimNick is how often the client tries to take its nickname back after a forced change.
+	// If 0, the client keeps whatever nickname it was given.
+	ReclaimNick time.Duration
+
+	// JoinTimeout is how long messages written to a channel wait for the server to confirm
+	// a JOIN sent by the client, so that a bot can write messages right after joining
+	// without them being rejected for not being on the channel yet.
+	// Held messages are sent once the JOIN is confirmed,
+	// or dropped and reported to ErrorLog when the JOIN fails or times out, or the connection shuts down first.
+	// If 0, DefaultJoinTimeout is used. If negative, messages are never held.
+	JoinTimeout time.Duration
+
+	// AutoJoin lists the channels which the client joins once it's connected, every Authenticator is done,
+	// and Perform is complete (optional).
+	// A channel which needs a key is written with the key after a space, e.g. "#secret hunter2".
+	AutoJoin []string
+
+	// Perform lists the messages which the client writes in order once it's connected and every Authenticator is done,
+	// before it joins the channels of AutoJoin (optional), such as setting user modes or becoming an IRC operator:
+	//
+	//	client.Perform = []irc.PerformItem{
+	//		irc.PerformLine("MODE bot +x"),
+	//		{Message: irc.Oper("bot", "hunter2"), WaitFor: irc.WaitForCommand(irc.RplYoureOper, irc.RplErrPasswdMismatch)},
+	//		irc.PerformLine("JOIN #first"),
+	//	}
+	Perform []PerformItem
+
+	// RejoinOnKick makes the client join a channel again after it was kicked from it, once RejoinDelay has passed,
+	// with the channel's key when it's known (see Channel.Key).
+	// The client gives up on a channel which kicked it 3 times within 10 minutes, and reports it to ErrorLog.
+	RejoinOnKick bool
+
+	// RejoinDelay is how long the client waits before rejoining a channel with RejoinOnKick.
+	// If 0, DefaultRejoinDelay is used.
+	RejoinDelay time.Duration
+
+	// FloodControl paces the messages written by the client to stay within the server's flood limits (optional).
+	// If nil, messages are written as soon as possible, except on Twitch, where a TwitchFlood is used.
+	FloodControl FloodControl
+
+	// Store keeps the state of FloodControl across restarts, so that restarting doesn't reset its timers (optional).
+	// The state is restored when the client connects, and saved when the connection ends.
+	// Other state, such as the cooldowns of a Router, may be saved to the same store with SaveState.
+	Store StateStore
+
+	// CTCP answers the common CTCP queries such as VERSION and PING (optional).
+	// If nil, every CTCP query is left to the handler.
+	CTCP *CTCPResponder
+
+	// CTCPParsing controls which messages are recognized as CTCP. The default is CTCPLenient.
+	CTCPParsing CTCPParsing
+
+	// SlowHandler is how long the handler may take for a message before it's reported as a SlowDispatch,
+	// to find the handlers which delay the others and cause ping timeouts.
+	// If 0, DefaultSlowHandler is used. If negative, slow handlers are never reported.
+	SlowHandler time.Duration
+
+	// OnSlowHandler is called with each SlowDispatch (optional).
+	// If nil, they're reported to ErrorLog.
+	OnSlowHandler func(SlowDispatch)
+
+	// Audit is called with an AuditRecord for every message written by the client, successfully or not (optional),
+	// to answer which route of a bot sent a message. It's called from the writing goroutine, so it should be quick.
+	Audit func(AuditRecord)
+
+	// QuitMessage is the reason sent with QUIT during a graceful shutdown, e.g. "upgrading to v2.3".
+	// If empty, DefaultQuitMessage is used.
+	QuitMessage string
+
+	// ShutdownTimeout is how long a graceful shutdown waits for the server to close the connection after QUIT,
+	// before the client closes it. If 0, DefaultShutdownTimeout is used. See Shutdown.
+	ShutdownTimeout time.Duration
+
+	// TagLimits overrides the size limits of message tags, for servers which accept more tag data than the message-tags
+	// specification allows, or less (optional). Like the length of lines, they're only checked to report messages
+	// which are likely to be truncated or rejected; see WarnTagsTooLong.
+	TagLimits TagLimits
+
+	// OnLineBudget is called with the new LineBudget when it changed,
+	// e.g. because the server assigned the client a new host, to help debug truncated messages (optional).
+	OnLineBudget func(budget int)
+
+	// OnShutdown is called during a graceful shutdown, before QUIT is sent,
+	// to write final messages such as goodbye notices to channels (optional).
+	OnShutdown func(w MessageWriter)
+
+	// Reconnect is the delay between connection attempts of Run (optional).
+	// If nil, Run doesn't reconnect.
+	Reconnect *Backoff
+
+	// WhoRefresh is how often the members of each channel are revalidated with WHO (or WHOX),
+	// correcting the members tracked by the client after missed events, e.g. during netsplits.
+	// Only one WHO is sent at a time, and the channels are spread out over the interval.
+	// If 0, the members are never refreshed.
+	WhoRefresh time.Duration
+
+	// OnStateDrift is called when a refresh finds that the tracked members of a channel were wrong (optional).
+	OnStateDrift func(StateDrift)
+
+	// OnMemberAway is called when a member of one of the client's channels is marked as away, or back (optional).
+	// The message is empty when it's unknown, e.g. when the change was found by a WHO refresh.
+	// Enable the away-notify capability in Caps to learn about changes as they happen.
+	OnMemberAway func(nick Nickname, away bool, message string)
+
+	// LoopGuard keeps the client's handlers from replying to NOTICEs, replying to other bots,
+	// and repeating the same message over and over.
+	// If nil, a LoopGuard with the default settings is used, which reports dropped messages to ErrorLog.
+	LoopGuard *LoopGuard
+
+	// Keepalive detects connections which died without being closed, by sending a PING when the server has been quiet.
+	// If nil, a Keepalive with the default settings is used.
+	// Set its LagInterval and OnLag to keep track of the lag of a busy connection; see Lag.
+	Keepalive *Keepalive
+
 	// ErrorLog specifies an optional logger for errors returned from parsing and encoding messages.
 	// If nil, logging is done via the log package's standard logger.
 	ErrorLog *log.Logger
@@ -75,17 +299,59 @@ type Client struct {
 	// todo: 512 default, then pass this somehow to the Message type in WriteMessage before calling marshaltext? maybe a conditional type assertion
 	// writeLineSize int
 
+	// connMu guards conn, so that WriteMessage is safe to call from any goroutine
+	// and writes of concurrent messages never interleave on the connection.
+	connMu  sync.Mutex
 	conn    io.ReadWriteCloser
 	handler Handler
 	state   clientState
+	caps    *capState       // guarded by connMu
+	nicks   *nickKeeper     // guarded by connMu
+	outbox  *joinOutbox     // guarded by connMu
+	replies *pendingReplies // guarded by connMu
+	flood   *floodGate      // guarded by connMu
+	account *accountCache   // guarded by connMu
+	members *channelTracker // guarded by connMu
+	closing *shutdown       // guarded by connMu
 	wg      sync.WaitGroup
 
+	// connecting is set by ConnectAndRun while it prepares and dials a connection, before conn is set. Guarded by connMu.
+	connecting bool
+
+	// dispatch collects the statistics of the handler for DispatchStats.
+	dispatch dispatchStats
+
+	// redispatch is the handler of the messages passed to Redispatch: the handler given to ConnectAndRun,
+	// without the middleware which tracks the state of the connection.
+	redispatch Handler
+
+	// keys remembers the keys of channels across connections.
+	keys channelKeys
+
+	// keepalive pings the server while the connection is quiet. Guarded by connMu.
+	keepalive *Keepalive
+
 	// errC is a buffered channel of errors.
 	// The channel may be nil, so senders must always have a default case if sending blocked.
 	// Only the first error sent to the channel will be used.
 	errC chan error
 }
 
+// OverflowPolicy is the action taken when a message is read while the client's queue of incoming messages is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock stops reading from the connection until there is room in the queue.
+	OverflowBlock OverflowPolicy = iota
+
+	// OverflowDrop discards the message and reports it to the ErrorLog.
+	// Dropped messages are never seen by handlers, which may leave state tracked by handlers out of date.
+	OverflowDrop
+
+	// OverflowDisconnect closes the connection, and ConnectAndRun returns ErrQueueFull.
+	OverflowDisconnect
+)
+
 type caseMapping int
 
 const (
@@ -108,6 +374,7 @@ var noop HandlerFunc = func(mw MessageWriter, m *Message) {}
 // ConnectAndRun always returns an error, with one exception: if the client sends an IRC "QUIT"
 // message followed by receiving an io.EOF from the connection, then the returned error
 // will be nil.
+// When the server explained why it closed the connection, the error is a *DisconnectError.
 func (c *Client) ConnectAndRun(ctx context.Context, h Handler) error {
 	var (
 		err     error
@@ -129,13 +396,18 @@ func (c *Client) ConnectAndRun(ctx context.Context, h Handler) error {
 		c.Realname = "..."
 	}
 
-	if c.DialFn == nil {
+	dial := c.DialFn
+	if dial == nil {
 		if c.Addr == "" {
 			panic("ConnectAndRun: Addr cannot be empty when DialFn is nil")
 		}
-		c.DialFn = func() (io.ReadWriteCloser, error) {
-			return tls.Dial("tcp", c.Addr, nil)
-		}
+		// the default dialer gives up when ctx is done
+		dial = func() (io.ReadWriteCloser, error) { return c.dialAddr(ctx) }
+	}
+
+	mech := c.SASL
+	if mech == nil && c.Certificate != nil {
+		mech = SASLExternal()
 	}
 
 	// this context intentionally doesn't use ctx as a parent because we listen for ctx.Done() to trigger
@@ -143,53 +415,130 @@ func (c *Client) ConnectAndRun(ctx context.Context, h Handler) error {
 	mainctx, cancel = context.WithCancel(context.Background())
 	defer cancel()
 
-	// initial state
-	c.state = clientState{
-		nick:   c.Nickname,
-		user:   c.User,
-		server: strings.Split(c.Addr, ":")[0],
+	want := c.Caps
+	if mech != nil && !containsFold(want, "sasl") {
+		want = append(want[:len(want):len(want)], "sasl")
 	}
 
-	if c.conn != nil {
+	// the connection is reserved before any state is reset, so that a second call can't clobber the state of a live connection
+	c.connMu.Lock()
+	if c.conn != nil || c.connecting {
+		c.connMu.Unlock()
 		return errors.New("the client already has a connection")
 	}
+	c.connecting = true
+	c.connMu.Unlock()
 
-	if c.conn, err = c.DialFn(); err != nil {
+	// initial state
+	c.state.reset(c.Nickname, c.User, strings.Split(c.Addr, ":")[0])
+	c.restoreFlood(c.FloodControl)
+	caps := newCapState(want)
+
+	c.connMu.Lock()
+	c.caps = caps
+	c.connMu.Unlock()
+
+	// dialing may take a while, so the lock is only held again to install the connection;
+	// connecting keeps the connection reserved in the meantime
+	conn, err := dial()
+	c.connMu.Lock()
+	c.connecting = false
+	if err != nil {
+		c.connMu.Unlock()
 		return err
 	}
+	c.conn = conn
+	c.configureTransport(conn)
+	nicks := newNickKeeper(mainctx, c)
+	c.nicks = nicks
+	outbox := newJoinOutbox(mainctx, c)
+	c.outbox = outbox
+	replies := newPendingReplies(mainctx)
+	c.replies = replies
+	flood := &floodGate{ctx: mainctx, client: c, control: c.FloodControl}
+	c.flood = flood
+	channels := newChannelTracker(mainctx, c)
+	c.members = channels
+	account := newAccountCache(c, caps, channels)
+	c.account = account
+	caps.deleted = account.capsDeleted
+	outbox.onChannel = channels.joined
+	closing := &shutdown{ctx: mainctx}
+	c.closing = closing
+	keepalive := c.Keepalive
+	if keepalive == nil {
+		keepalive = &Keepalive{}
+	}
+	c.keepalive = keepalive
+	c.connMu.Unlock()
+	c.dispatch.reset()
+	defer channels.stop()
+	defer c.saveFlood(flood)
 	defer func() {
-		_ = c.conn.Close()
+		c.connMu.Lock()
+		_ = conn.Close()
 		c.conn = nil
+		c.connMu.Unlock()
 	}()
 
+	// the channel is created before any goroutine that might call exit is started
+	c.errC = make(chan error, 1)
+
 	// trigger shutdown on the first read from the error channel
 	c.wg.Add(1)
 	go func() {
 		defer c.wg.Done()
-		defer c.conn.Close()
+		defer conn.Close()
 		defer cancel()
 
-		c.errC = make(chan error, 1)
 		err = <-c.errC // err is used in the method return value
-		c.errC = nil
 	}()
 
 	if h == nil {
 		h = noop
 	}
 
-	pinger := &pingHandler{
-		timeout: func() {
-			c.exit(errPingTimeout)
-		},
+	// routers need to know our nickname for matchers such as MatchQuery
+	if r, ok := h.(*Router); ok && r.client == nil {
+		r.BindClient(c)
 	}
 
-	c.handler = wrap(h, ctcpHandler, pingMiddleware, pinger.pongHandler, c.state.middleware, capLSHandler)
+	guard := c.LoopGuard
+	if guard == nil {
+		guard = &LoopGuard{Dropped: func(m *Message, reason string) {
+			c.log(fmt.Errorf("loop guard dropped message (%s): %#v", reason, m))
+		}}
+	}
+
+	middlewares := []middleware{guard.Middleware, ctcpDecoder(c.CTCPParsing)}
+	if c.CTCP != nil {
+		middlewares = append(middlewares, c.CTCP.middleware)
+	}
+	perform := &performer{client: c, items: c.Perform}
+	defer perform.stop()
+	auth := &authPipeline{client: c, caps: caps, perform: perform}
+	middlewares = append(middlewares, replies.middleware, account.middleware, channels.middleware, nicks.middleware, outbox.middleware, flood.middleware, c.budgetWatch, c.state.middleware, auth.middleware, perform.middleware, caps.middleware)
+	c.handler = wrap(h, middlewares...)
+	c.redispatch = wrap(h, guard.Middleware, ctcpDecoder(c.CTCPParsing))
+
+	authenticators := c.Auth
+	if mech != nil {
+		authenticators = append([]Authenticator{saslAuth{mech: mech}}, authenticators...)
+	}
+	auth.start(authenticators)
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		c.mainLoop(mainctx, c.reader(conn), keepalive)
+	}()
 
 	c.wg.Add(1)
 	go func() {
 		defer c.wg.Done()
-		c.mainLoop(mainctx, pinger)
+		if err := keepalive.Run(mainctx, c); errors.Is(err, ErrPingTimeout) {
+			c.exit(err)
+		}
 	}()
 
 	// when ctx is done we try to close the connection gracefully
@@ -202,18 +551,19 @@ func (c *Client) ConnectAndRun(ctx context.Context, h Handler) error {
 			// if mainctx is done that means an error was already read from c.errC and the client is already closing
 			return
 		case <-ctx.Done():
-			c.WriteMessage(Quit("closing link"))
-			select {
-			// after sending a quit message we wait for c.errC to receive an error from the connection being closed by the server
-			case <-mainctx.Done():
-				// if we're still waiting, just shut down
-			case <-time.After(3 * time.Second):
-				c.exit(nil)
-			}
+			c.quit(mainctx, closing)
 		}
 	}()
 
 	c.WriteMessage(CapLS("302"))
+	if timeout := c.capTimeout(); timeout > 0 {
+		// the Authenticators are given up on first, so that CAP END doesn't interrupt one which still holds negotiation open
+		t := time.AfterFunc(timeout, func() {
+			auth.expire()
+			caps.expire(c)
+		})
+		defer t.Stop()
+	}
 	if c.Pass != "" {
 		c.WriteMessage(Pass(c.Pass))
 	}
@@ -221,14 +571,21 @@ func (c *Client) ConnectAndRun(ctx context.Context, h Handler) error {
 	c.WriteMessage(User(c.User, c.Realname))
 
 	c.wg.Wait()
-	if err == io.EOF && c.state.status == statusDisconnecting {
+	if err == io.EOF && c.state.getStatus() == statusDisconnecting {
 		return nil
 	}
+	c.state.mu.RLock()
+	disconnect := c.state.disconnect
+	c.state.mu.RUnlock()
+	if err != nil && disconnect != nil {
+		disconnect.Err = err
+		return disconnect
+	}
 	return err
 }
 
-func (c *Client) mainLoop(ctx context.Context, pinger *pingHandler) {
-	messages := c.startReading(ctx)
+func (c *Client) mainLoop(ctx context.Context, conn io.Reader, keepalive *Keepalive) {
+	messages := c.startReading(ctx, conn, keepalive)
 	for {
 		select {
 		case <-ctx.Done():
@@ -238,34 +595,59 @@ func (c *Client) mainLoop(ctx context.Context, pinger *pingHandler) {
 				c.exit(errors.New("read channel closed"))
 				return
 			}
-			c.handler.SpeakIRC(c, m)
-		case <-time.After(2 * time.Minute):
-			// using time.After() for every line read from the connection probably isn't good,
-			// but it can be cleaned up later without breaking any interfaces or behavior
-			pinger.ping(ctx, c, "TIMEOUTCHECK")
+			// decoding must happen in the same goroutine as the handlers,
+			// otherwise it may run before the handlers saw a UTF8ONLY token from an earlier line.
+			if !c.state.isupport.has("UTF8ONLY") {
+				c.Encoding.decodeMessage(m)
+			}
+			c.dispatchMessage(m, func() int { return len(messages) })
 		}
 	}
-
 }
 
-func (c *Client) startReading(ctx context.Context) <-chan *Message {
+func (c *Client) startReading(ctx context.Context, conn io.Reader, keepalive *Keepalive) <-chan *Message {
 	// a channel of pointers might not be as desirable as a channel of Message,
 	// but since a message's Params and Tags fields are reference types anyway,
 	// at least this way it's clear that messages are never really safely passed as copies.
-	messages := make(chan *Message, 10)
+	size := c.QueueSize
+	if size <= 0 {
+		size = DefaultQueueSize
+	}
+	messages := make(chan *Message, size)
+
+	// PONGs are written by their own goroutine because writing can block until the server reads,
+	// and the server may be waiting for us to read.
+	pongs := make(chan string, 4)
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		for reply := range pongs {
+			c.WriteMessage(Pong(reply))
+		}
+	}()
+
 	c.wg.Add(1)
 	go func() {
 		defer c.wg.Done()
 		defer close(messages)
+		defer close(pongs)
 
-		s := bufio.NewScanner(c.conn)
+		s := bufio.NewScanner(conn)
+		if c.StrictLineEndings {
+			s.Split(scanCRLF)
+		} else {
+			s.Split(scanLenient)
+		}
 		for s.Scan() {
 			l := s.Bytes()
 			if len(l) == 0 {
 				continue
 			}
+			if c.StrictLineEndings && bytes.ContainsAny(l, "\r\n") {
+				c.log(fmt.Errorf("line contains bare CR or LF: %q", l))
+				continue
+			}
 			m := new(Message)
-			m.IncludePrefix()
 			if err := m.UnmarshalText(l); err != nil {
 				// A parse error might be caused by a malformed line from the remote server
 				// or a bug in our message parser. Both cases are interesting but not
@@ -277,7 +659,43 @@ func (c *Client) startReading(ctx context.Context) <-chan *Message {
 			// is assumed to have originated from the connection from which it was
 			// received.
 			if (m.Source == Prefix{}) {
-				m.Source.Host = c.state.server
+				m.Source.Host = c.state.serverHost()
+			}
+
+			// the answers to our own PINGs are taken here too, so that the lag doesn't include the time spent in the queue.
+			if keepalive.Received(m) {
+				continue
+			}
+
+			// PINGs are answered here instead of by a handler, so that the reply isn't delayed by messages waiting in the queue.
+			// Handlers never saw server PINGs anyway.
+			if m.Command.is(CmdPing) {
+				select {
+				case pongs <- m.Params.Get(1):
+				default:
+					// the server only needs one reply to know we're alive
+				}
+				continue
+			}
+
+			// the reason for a disconnect is recorded here, since the handler may never get to see it
+			if m.Command.is(CmdError) || (m.Command.is(CmdKill) && c.Nick().Is(m.Params.Get(1))) {
+				c.state.mu.Lock()
+				c.state.disconnect = classifyDisconnect(m)
+				c.state.mu.Unlock()
+			}
+
+			if c.QueueOverflow != OverflowBlock {
+				select {
+				case messages <- m:
+				default:
+					if c.QueueOverflow == OverflowDisconnect {
+						c.exit(ErrQueueFull)
+						return
+					}
+					c.log(fmt.Errorf("incoming message queue is full; dropped message: %s", m.Command))
+				}
+				continue
 			}
 
 			select {
@@ -304,9 +722,47 @@ func (c *Client) startReading(ctx context.Context) <-chan *Message {
 	return messages
 }
 
+// scanCRLF is a bufio.SplitFunc which splits lines strictly on CR-LF.
+func scanCRLF(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.Index(data, []byte("\r\n")); i >= 0 {
+		return i + 2, data[:i], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// scanLenient is a bufio.SplitFunc which splits lines on LF, and removes every CR from the line.
+// This accepts both CR-LF and bare LF line endings.
+func scanLenient(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	i := bytes.IndexByte(data, '\n')
+	switch {
+	case i >= 0:
+		advance = i + 1
+	case atEOF:
+		i, advance = len(data), len(data)
+	default:
+		return 0, nil, nil
+	}
+	line := data[:i]
+	if bytes.IndexByte(line, '\r') >= 0 {
+		// the scanner owns data, so a copy is made rather than removing CRs in place
+		line = bytes.ReplaceAll(line, []byte("\r"), nil)
+	}
+	return advance, line, nil
+}
+
 // exit requests the client to exit and return with err. Only the first such error
 // is returned; any successive calls to exit will drop the error, such as if
 // there were remaining writes that also failed with errors.
+// exit is safe to call from any goroutine.
 func (c *Client) exit(err error) {
 	select {
 	case c.errC <- err:
@@ -318,45 +774,153 @@ func (c *Client) exit(err error) {
 // It writes m to the client's connection.
 // Marshaling errors will be reported to the client's logger.
 // Write errors will cause the client's run method to return with the first error.
+//
+// WriteMessage is safe to call from multiple goroutines, e.g. from timers or HTTP handlers
+// in addition to the client's own handlers. Each message is written to the connection in a single write,
+// so concurrent messages are never interleaved.
+//
+// See WriteMessageE for a variant which returns the error instead of logging it.
 func (c *Client) WriteMessage(m encoding.TextMarshaler) {
-	// WriteMessage does not return any errors itself because IRC itself does not provide any guarantees about message delivery.
-	// Even if bytes are successfully written to a TCP stream, that does not guarantee message delivery to the intended recipient(s).
-	//
+	c.logWriteError(c.WriteMessageE(m))
+}
+
+// WriteMessageE is like WriteMessage, but returns the reason m wasn't written instead of logging it,
+// e.g. ErrNotConnected when the client isn't connected yet or anymore,
+// so that code which may run outside of a connection can retry the message later.
+//
+// A nil error means the message was written to the connection, or is held until a JOIN completes (see JoinTimeout).
+// As with WriteMessage, it doesn't mean the server accepted the message.
+// When the write to the connection fails, the error is returned as well as ending the connection.
+func (c *Client) WriteMessageE(m encoding.TextMarshaler) error {
+	return c.auditWrite(m, nil)
+}
+
+// sanitizeWrite writes m, or the messages which replace it according to ControlChars.
+func (c *Client) sanitizeWrite(m encoding.TextMarshaler) error {
+	if msg, ok := m.(*Message); ok && c.ControlChars != ControlCharsReject {
+		messages, err := Sanitize(msg, c.ControlChars)
+		if err != nil {
+			return fmt.Errorf("WriteMessage: %w; message: %#v", err, m)
+		}
+		var errs []error
+		for _, msg := range messages {
+			if err := c.writeMessage(msg); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		return errors.Join(errs...)
+	}
+	return c.writeMessage(m)
+}
+
+// connWriteError is an error from writing to the connection, which ends the connection rather than being logged.
+type connWriteError struct{ error }
+
+func (e connWriteError) Unwrap() error { return e.error }
+
+// logWriteError logs an error returned by writeMessage, unless it's one that ends the connection.
+func (c *Client) logWriteError(err error) {
+	var cw connWriteError
+	if err == nil || errors.As(err, &cw) {
+		return
+	}
+	c.log(err)
+}
+
+// writeMessage marshals m and writes it to the connection, unless it's held for a JOIN.
+func (c *Client) writeMessage(m encoding.TextMarshaler) error {
+	if msg, ok := m.(*Message); ok && c.holdForJoin(msg) {
+		return nil
+	}
+	return c.writeNow(m)
+}
+
+// writeNow marshals m and writes it to the connection.
+func (c *Client) writeNow(m encoding.TextMarshaler) error {
+	// IRC itself does not provide any guarantees about message delivery.
+	// Even if bytes are successfully written to a TCP stream, that does not guarantee message delivery to the intended recipient(s),
+	// so the errors returned are only about the client failing to write the message.
 	var (
 		err error
 		b   []byte
 	)
 
-	if c.conn == nil {
-		c.log(fmt.Errorf("WriteMessage: conn cannot be nil; m: %#v", m))
-		return
-	}
-
 	if msg, ok := m.(*Message); ok && !msg.includePrefix {
 		// set the message prefix to what the client thinks it is currently
 		// so that marshaltext can correctly return warnings when lines are likely to be truncated
 		msg.Source = c.prefix()
+		msg.limits.line = c.lineLimit()
+		msg.limits.clientTags, msg.limits.tags = c.TagLimits.ClientData, c.TagLimits.Total
 	}
 
 	b, err = m.MarshalText()
 	if err != nil {
-		c.log(fmt.Errorf("marshal text: %w; message: %#v", err, m))
-		return
+		err = fmt.Errorf("marshal text: %w; message: %#v", err, m)
+		// length warnings are only logged; the server decides what to do with long lines
+		if !errors.Is(err, warnTruncate) {
+			return err
+		}
+		c.log(err)
 	}
 	if !bytes.HasSuffix(b, []byte("\r\n")) {
 		b = append(b, []byte("\r\n")...)
 	}
 
+	// UTF8ONLY servers reject lines which aren't valid UTF-8,
+	// so there's no point sending them.
+	if c.state.isupport.has("UTF8ONLY") && !utf8.Valid(b) {
+		return fmt.Errorf("WriteMessage: server is UTF8ONLY and the message is not valid UTF-8; message: %q", b)
+	}
+
+	defer c.floodWait(m)()
+
 	// this might not be the cleanest way to intercept outgoing quit commands,
 	// but it works for now and lets us rewrite ConnectAndRun's error to nil
 	// when the exit was intentional
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+
+	if c.conn == nil {
+		return fmt.Errorf("WriteMessage: %w; message: %q", ErrNotConnected, bytes.TrimSuffix(b, []byte("\r\n")))
+	}
+
 	if bytes.HasPrefix(b, []byte("QUIT")) {
-		c.state.status = statusDisconnecting
+		c.state.setStatus(statusDisconnecting)
+	}
+	if msg, ok := m.(*Message); ok && msg.Command.is(CmdNick) && c.nicks != nil {
+		c.nicks.sent(msg.Params.Get(1))
+	}
+	if msg, ok := m.(*Message); ok && c.outbox != nil {
+		c.outbox.sent(msg)
+	}
+	if msg, ok := m.(*Message); ok {
+		c.keys.sent(msg, c.fold)
 	}
 
+	c.writeDeadline(c.conn)
 	if _, err = c.conn.Write(b); err != nil {
+		if isTimeout(err) {
+			err = fmt.Errorf("%w: write blocked for %s", ErrStalled, c.StallTimeout)
+		}
 		c.exit(err)
+		return connWriteError{err}
 	}
+	return nil
+}
+
+// tlsConfig returns the TLS configuration for the default dialer.
+func (c *Client) tlsConfig() *tls.Config {
+	if c.TLSConfig == nil && c.Certificate == nil {
+		return nil
+	}
+	cfg := &tls.Config{}
+	if c.TLSConfig != nil {
+		cfg = c.TLSConfig.Clone()
+	}
+	if c.Certificate != nil {
+		cfg.Certificates = append(cfg.Certificates, *c.Certificate)
+	}
+	return cfg
 }
 
 // log reports errors which are noteworthy but not a reason for the client to exit.
@@ -370,7 +934,11 @@ func (c *Client) log(e error) {
 
 // clientState groups and manages access to a minimal set of
 // state around each new connection to the IRC server.
+//
+// The state is updated by the client's handlers, but read from any goroutine that writes messages,
+// so every field except isupport (which has its own lock) is guarded by mu.
 type clientState struct {
+	mu sync.RWMutex
 
 	// the client's current nickname, used for calculating max outgoing message length and for
 	// matching events that originated from our client.
@@ -389,21 +957,72 @@ type clientState struct {
 	// the server the client is connected to, used as the message source when incoming messages didn't contain a prefix.
 	server string
 
+	// isupport contains the tokens advertised by the server in RPL_ISUPPORT.
+	isupport isupport
+
+	// disconnect is set when the server told us why it's closing the connection.
+	disconnect *DisconnectError
+
+	// umodes are the client's own user modes, sorted.
+	umodes string
+
+	// motd is the last complete message of the day, and motdLines collects the next one.
+	motd      string
+	motdLines []string
+
 	// status contains the client's connection state: disconnected, connected, etc.
 	// not all states are implemented.
 	// only the "disconnecting" state is used to rewrite io.EOF errors to nil when the disconnect was intentional
 	status clientStatus
 }
 
+// reset sets the initial state for a new connection.
+func (s *clientState) reset(nick, user, server string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nick = nick
+	s.user = user
+	s.host = ""
+	s.server = server
+	s.status = statusDisconnected
+	s.disconnect = nil
+	s.motd = ""
+	s.motdLines = nil
+	s.umodes = ""
+	s.isupport.reset()
+}
+
+func (s *clientState) serverHost() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.server
+}
+
+func (s *clientState) getStatus() clientStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.status
+}
+
+func (s *clientState) setStatus(status clientStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+}
+
 // Nick returns the client's current nickname according to the client's internal state tracking.
 // This is used by some route matchers to determine when a message originated from or targeted our client.
 func (c *Client) Nick() Nickname {
+	c.state.mu.RLock()
+	defer c.state.mu.RUnlock()
 	return Nickname(c.state.nick)
 }
 
 // prefix returns the estimated prefix based on internal state tracking,
 // used by Message to calculate the actual limit of outgoing messages.
 func (c *Client) prefix() Prefix {
+	c.state.mu.RLock()
+	defer c.state.mu.RUnlock()
 	return Prefix{
 		Nick: Nickname(c.state.nick),
 		Host: c.state.host,
@@ -416,58 +1035,112 @@ var fullAddress = regexp.MustCompile("^([^!@]+)!(.+?)@(.+)?$")
 // stateMiddleware intercepts various events to keep the client state up to date.
 func (s *clientState) middleware(next Handler) Handler {
 	return HandlerFunc(func(mw MessageWriter, m *Message) {
-		switch m.Command {
-
-		// By saving our host (as seen by the server) we can more accurately calculate the maximum length
-		// of any message we can send, because 512-byte line length limit defined by the IRC protocol
-		// will include our nickname and host in each message when they are received by others.
-		//
-		// Format: "Welcome to the Internet Relay Network <nick>!<user>@<host>"
-		case RplWelcome:
-			fields := strings.Fields(m.Params.Get(2))
-			if len(fields) == 0 {
-				fields = []string{""}
-			}
-			// The last field can be <nick> or <nick>!<user>@<host>, but the format of RPL_WELCOME varies so widely that
-			// accepting anything other than nick!user@host might break our nick state tracking.
-			// For example, twitch.tv servers ignore the spec completely and include neither
-			// the network name nor our nickname.
-			if parts := fullAddress.FindStringSubmatch(fields[len(fields)-1]); parts != nil {
-				s.nick = parts[1]
-				s.user = parts[2]
-				s.host = parts[3]
-			}
-		case RplMyInfo:
-			// Even though param 2 should contain the server host, checking for more than 2 params is a smoke test
-			// to determine if the line is likely to follow protocol. If not, we'll fall back and hope
-			// the message prefix contains the server host. Twitch.tv notably breaks protocol here
-			// by sending only 2 params, with the second being only a single hyphen (-).
-			// Even though the twitch case doesn't technically matter because their
-			// server and host names are static, it annoyed me that the wrong
-			// info would be contained in the client state.
-			if len(m.Params) > 2 {
-				s.server = m.Params.Get(2)
-			} else {
-				s.server = m.Source.Host
-			}
-		case RplHostHidden:
-			// "<target> <host> :is now your displayed host"
-			// Some servers implement numeric 396 to indicate when our displayed host is changed,
-			// e.g. hidden or unhidden with user mode +x/-x. We listen for this by default to
-			// improve our calculations for the maximum message length we can send.
-			if len(m.Params) > 1 {
-				s.host = m.Params.Get(2)
-			}
-		case CmdNick:
-			if m.Source.Nick.Is(s.nick) {
-				s.nick = m.Params.Get(1)
-			}
-		}
-
+		s.update(m)
 		next.SpeakIRC(mw, m)
 	})
 }
 
+// update applies the state changes caused by m.
+func (s *clientState) update(m *Message) {
+	if m.Command == RplISupport {
+		s.isupport.parse(m)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch m.Command {
+
+	// By saving our host (as seen by the server) we can more accurately calculate the maximum length
+	// of any message we can send, because 512-byte line length limit defined by the IRC protocol
+	// will include our nickname and host in each message when they are received by others.
+	//
+	// Format: "Welcome to the Internet Relay Network <nick>!<user>@<host>"
+	case RplWelcome:
+		// the target of the welcome is our nickname, even if it's not the one we asked for first
+		if nick := m.Params.Get(1); nick != "" && nick != "*" {
+			s.nick = nick
+		}
+		fields := strings.Fields(m.Params.Get(2))
+		if len(fields) == 0 {
+			fields = []string{""}
+		}
+		// The last field can be <nick> or <nick>!<user>@<host>, but the format of RPL_WELCOME varies so widely that
+		// accepting anything other than nick!user@host might break our nick state tracking.
+		// For example, twitch.tv servers ignore the spec completely and include neither
+		// the network name nor our nickname.
+		if parts := fullAddress.FindStringSubmatch(fields[len(fields)-1]); parts != nil {
+			s.nick = parts[1]
+			s.user = parts[2]
+			s.host = parts[3]
+		}
+	case RplMyInfo:
+		// Even though param 2 should contain the server host, checking for more than 2 params is a smoke test
+		// to determine if the line is likely to follow protocol. If not, we'll fall back and hope
+		// the message prefix contains the server host. Twitch.tv notably breaks protocol here
+		// by sending only 2 params, with the second being only a single hyphen (-).
+		// Even though the twitch case doesn't technically matter because their
+		// server and host names are static, it annoyed me that the wrong
+		// info would be contained in the client state.
+		if len(m.Params) > 2 {
+			s.server = m.Params.Get(2)
+		} else {
+			s.server = m.Source.Host
+		}
+	case RplHostHidden:
+		// "<target> <host> :is now your displayed host"
+		// Some servers implement numeric 396 to indicate when our displayed host is changed,
+		// e.g. hidden or unhidden with user mode +x/-x. We listen for this by default to
+		// improve our calculations for the maximum message length we can send.
+		if len(m.Params) > 1 {
+			s.host = m.Params.Get(2)
+		}
+	// "<nick> <modes>"
+	case CmdMode:
+		if len(m.Params) > 1 && strings.EqualFold(m.Params.Get(1), s.nick) {
+			s.umodes = applyModes(s.umodes, strings.Join(m.Params[1:], " "))
+		}
+	// "<client> <user modes>"
+	case RplUModeIs:
+		if len(m.Params) > 1 {
+			s.umodes = applyModes("", strings.Join(m.Params[1:], " "))
+		}
+	case RplMOTDStart:
+		s.motdLines = []string{}
+	case RplMOTD:
+		s.motdLines = append(s.motdLines, motdLine(m.Params.Get(2)))
+	case RplEndOfMOTD:
+		s.motd = strings.Join(s.motdLines, "\n")
+		s.motdLines = nil
+	case RplErrNoMOTD:
+		s.motd = ""
+		s.motdLines = nil
+	// chghost: ":<nick>!<old user>@<old host> CHGHOST <user> <host>"
+	case CmdChgHost:
+		if m.Source.Nick.Is(s.nick) && len(m.Params) > 1 {
+			s.user = m.Params.Get(1)
+			s.host = m.Params.Get(2)
+		}
+	// "<client> <nick> <user> <host> * :<real name>", e.g. from a WHOIS of ourselves
+	case RplWhoIsUser:
+		if strings.EqualFold(m.Params.Get(2), s.nick) && m.Params.Get(4) != "" {
+			s.user = m.Params.Get(3)
+			s.host = m.Params.Get(4)
+		}
+	case CmdJoin:
+		// our JOINs are echoed with the address other users see
+		if m.Source.Nick.Is(s.nick) && m.Source.Host != "" {
+			s.user = m.Source.User
+			s.host = m.Source.Host
+		}
+	case CmdNick:
+		// a NICK with the server as its source can only be a forced change of our own nickname
+		if m.Source.Nick.Is(s.nick) || m.Source.IsServer() {
+			s.nick = m.Params.Get(1)
+		}
+	}
+}
+
 type clientStatus int
 
 func (s clientStatus) String() string {
@@ -1,9 +1,23 @@
 package irc_test
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -38,6 +52,58 @@ func TestClient_ConnectAndRun(t *testing.T) {
 
 }
 
+// TestClient_slowDial checks that the client can be used while it dials, and can't be connected twice.
+func TestClient_slowDial(t *testing.T) {
+	dialing, release := make(chan struct{}), make(chan struct{})
+	client := &irc.Client{Nickname: "bot"}
+	client.DialFn = func() (io.ReadWriteCloser, error) {
+		close(dialing)
+		<-release
+		return nil, errors.New("no route to host")
+	}
+	errC := make(chan error, 1)
+	go func() { errC <- client.ConnectAndRun(context.Background(), nil) }()
+	<-dialing
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = client.CapEnabled("sasl")
+		if err := client.ConnectAndRun(context.Background(), nil); err == nil {
+			t.Errorf("expected a second connection to be refused while dialing")
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("expected the client not to be locked while dialing")
+	}
+	close(release)
+	if err := <-errC; err == nil || err.Error() != "no route to host" {
+		t.Errorf("expected the dial error; got %v", err)
+	}
+}
+
+func TestClient_tls(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	l, err := irctest.ListenTLS(mockNetwork)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	client := &irc.Client{Nickname: "HelloBot", Addr: l.Addr(), TLSConfig: l.TLSConfig()}
+	h := &irc.Router{}
+	h.OnConnect(func(w irc.MessageWriter, m *irc.Message) {
+		w.WriteMessage(irc.Quit("bye"))
+	})
+	if err = client.ConnectAndRun(ctx, h); err != nil {
+		t.Errorf("expected client to exit without errors, got: %v", err)
+	}
+}
+
 func TestClient_pongReply(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 	defer cancel()
@@ -89,6 +155,67 @@ func TestClient_ctcpRewrite(t *testing.T) {
 	}
 }
 
+func TestClient_lineEndings(t *testing.T) {
+	tt := []struct {
+		name     string
+		strict   bool
+		expected []string
+	}{
+		{"lenient", false, []string{"crlf", "lf", "stray cr", "crcrlf"}},
+		{"strict", true, []string{"crlf"}},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server, done := setup()
+			defer done()
+			client.StrictLineEndings = tc.strict
+			client.ErrorLog = log.New(io.Discard, "", 0)
+			go server.WriteString(":n NOTICE bot :crlf\r\n:n NOTICE bot :lf\n:n NOTICE bot :stray\r cr\r\n:n NOTICE bot :crcrlf\r\r\n:n NOTICE bot :end\r\n")
+			var got []string
+			_ = client.ConnectAndRun(context.Background(), irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+				if m.Command != irc.CmdNotice {
+					return
+				}
+				if text := m.Params.Get(2); text != "end" {
+					got = append(got, text)
+					return
+				}
+				done()
+			}))
+			if fmt.Sprint(got) != fmt.Sprint(tc.expected) {
+				t.Errorf("expected to receive %q; got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestClient_encoding(t *testing.T) {
+	client, server, done := setup()
+	defer done()
+	client.Encoding = irc.CharsetCP1252
+	// "caf\xe9 \x93quoted\x94" is cp1252; the second NOTICE arrives after the server declared UTF8ONLY
+	go server.WriteString(":n NOTICE bot :caf\xe9 \x93quoted\x94\r\n" +
+		":irc.example.com 005 bot UTF8ONLY NETWORK=Example\\x20Net :are supported by this server\r\n" +
+		":n NOTICE bot :caf\xe9\r\n")
+	var got []string
+	_ = client.ConnectAndRun(context.Background(), irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+		if m.Command != irc.CmdNotice {
+			return
+		}
+		got = append(got, m.Params.Get(2))
+		if len(got) == 2 {
+			done()
+		}
+	}))
+	expected := []string{"café “quoted”", "caf\xe9"}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("expected %q; got %q", expected, got)
+	}
+	if network, _ := client.ISupport("network"); network != "Example Net" {
+		t.Errorf("expected NETWORK token to be %q; got %q", "Example Net", network)
+	}
+}
+
 func TestClient_nickTracker(t *testing.T) {
 	client, server, done := setup()
 	client.Nickname = "nick1"
@@ -119,6 +246,263 @@ func TestClient_nickTracker(t *testing.T) {
 	}
 }
 
+func TestClient_capNotify(t *testing.T) {
+	client, server, done := setup()
+	defer done()
+	client.Caps = []string{"server-time", "away-notify"}
+	var requested []string
+	server.Handler = irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+		if m.Command == irc.CmdCap && m.Params.Get(1) == "REQ" {
+			requested = append(requested, m.Params.Get(2))
+			server.WriteString(":irc.example.com CAP bot ACK :" + m.Params.Get(2))
+		}
+	})
+	go server.WriteString(":irc.example.com CAP * LS :server-time multi-prefix")
+
+	var acked, added, deleted bool
+	r := &irc.Router{}
+	r.OnCapNew(func(w irc.MessageWriter, m *irc.Message) {
+		added = m.Params.Get(3) == "away-notify"
+	})
+	r.OnCapDel(func(w irc.MessageWriter, m *irc.Message) {
+		deleted = !client.CapEnabled("server-time") && client.CapEnabled("away-notify")
+		done()
+	})
+	r.HandleFunc(irc.CmdCap, func(w irc.MessageWriter, m *irc.Message) {
+		if m.Params.Get(2) != "ACK" {
+			return
+		}
+		switch m.Params.Get(3) {
+		case "server-time":
+			acked = client.CapEnabled("server-time")
+			go server.WriteString(":irc.example.com CAP bot NEW :away-notify")
+		case "away-notify":
+			go server.WriteString(":irc.example.com CAP bot DEL :server-time")
+		}
+	})
+	_ = client.ConnectAndRun(context.Background(), r)
+
+	if len(requested) != 2 || requested[0] != "server-time" || requested[1] != "away-notify" {
+		t.Errorf("expected client to request server-time then away-notify; got %q", requested)
+	}
+	if !acked {
+		t.Errorf("expected server-time to be enabled after ACK")
+	}
+	if !added {
+		t.Errorf("expected OnCapNew handler to be called")
+	}
+	if !deleted {
+		t.Errorf("expected server-time to be disabled after DEL")
+	}
+}
+
+func TestClient_capListAndDel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	var whois []string
+	clientConn, serverConn := irc.Pipe()
+	go func() {
+		defer serverConn.Close()
+		scanner := bufio.NewScanner(serverConn)
+		for scanner.Scan() {
+			m := new(irc.Message)
+			if err := m.UnmarshalText(scanner.Bytes()); err != nil {
+				continue
+			}
+			switch m.Command {
+			case irc.CmdCap:
+				switch m.Params.Get(1) {
+				case "LS":
+					fmt.Fprintf(serverConn, ":irc.example.com CAP * LS :server-time account-notify extended-join\r\n")
+				case "REQ":
+					fmt.Fprintf(serverConn, ":irc.example.com CAP bot ACK :%s\r\n", m.Params.Get(2))
+				case "LIST":
+					// server-time was enabled, but it's not anymore
+					fmt.Fprintf(serverConn, ":irc.example.com CAP bot LIST * :account-notify\r\n")
+					fmt.Fprintf(serverConn, ":irc.example.com CAP bot LIST :extended-join\r\n")
+				case "END":
+					fmt.Fprintf(serverConn, ":irc.example.com 001 bot :Welcome bot!bot@example.com\r\n")
+					fmt.Fprintf(serverConn, ":bot!bot@example.com JOIN #chan * :bot\r\n")
+					fmt.Fprintf(serverConn, ":bob!b@host JOIN #chan bobacct :Bob\r\n")
+					fmt.Fprintf(serverConn, ":irc.example.com CAP bot DEL :account-notify\r\n")
+				}
+			case irc.CmdWhoIs:
+				whois = append(whois, m.Params.Get(1))
+				fmt.Fprintf(serverConn, ":irc.example.com 330 bot bob newacct :is logged in as\r\n")
+				fmt.Fprintf(serverConn, ":irc.example.com 318 bot bob :End of /WHOIS list.\r\n")
+			case irc.CmdQuit:
+				return
+			}
+		}
+	}()
+
+	client := &irc.Client{Nickname: "bot", Caps: []string{"server-time", "account-notify", "extended-join"}}
+	client.DialFn = func() (io.ReadWriteCloser, error) { return clientConn, nil }
+	var (
+		enabled []string
+		account string
+	)
+	r := &irc.Router{}
+	r.OnCapDel(func(w irc.MessageWriter, m *irc.Message) {
+		enabled = client.EnabledCaps()
+		sort.Strings(enabled)
+		go func() {
+			defer cancel()
+			account, _ = client.Resolve(ctx, "bob")
+		}()
+	})
+	_ = client.ConnectAndRun(ctx, r)
+
+	if strings.Join(enabled, " ") != "extended-join" {
+		t.Errorf("expected only the caps of the CAP LIST reply, without the deleted one, to be enabled; got %q", enabled)
+	}
+	if account != "newacct" || len(whois) != 1 {
+		t.Errorf("expected the account learned before account-notify was deleted to be looked up again; got %q after WHOIS %q", account, whois)
+	}
+}
+
+func TestClient_saslExternal(t *testing.T) {
+	client, server, done := setup()
+	defer done()
+	cert, err := irc.GenerateCertificate("bot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Certificate = &cert
+
+	var sent []string
+	server.Handler = irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+		switch m.Command {
+		case irc.CmdCap:
+			sent = append(sent, "CAP "+m.Params.Get(1))
+			switch m.Params.Get(1) {
+			case "LS":
+				server.WriteString(":irc.example.com CAP * LS :multi-prefix sasl=PLAIN,EXTERNAL")
+			case "REQ":
+				server.WriteString(":irc.example.com CAP bot ACK :" + m.Params.Get(2))
+			case "END":
+				done()
+			}
+		case irc.CmdAuthenticate:
+			sent = append(sent, "AUTHENTICATE "+m.Params.Get(1))
+			switch m.Params.Get(1) {
+			case "EXTERNAL":
+				server.WriteString("AUTHENTICATE +")
+			case "+":
+				server.WriteString(":irc.example.com 903 bot :SASL authentication successful")
+			}
+		}
+	})
+	_ = client.ConnectAndRun(context.Background(), nil)
+
+	expected := []string{"CAP LS", "CAP REQ", "AUTHENTICATE EXTERNAL", "AUTHENTICATE +", "CAP LIST", "CAP END"}
+	if fmt.Sprint(sent) != fmt.Sprint(expected) {
+		t.Errorf("expected client to send %q; got %q; transcript:\n%s", expected, sent, server.Transcript())
+	}
+	transcript := server.Transcript()
+	if len(transcript) < 2 || !transcript[0].FromClient || transcript[0].Line != "CAP LS :302" ||
+		transcript[len(transcript)-1].Line != "CAP :END" {
+		t.Errorf("expected the transcript to start with CAP LS and end with CAP END; got:\n%s", transcript)
+	}
+	for i := 1; i < len(transcript); i++ {
+		if transcript[i].At < transcript[i-1].At {
+			t.Errorf("expected the transcript to be in order; got:\n%s", transcript)
+			break
+		}
+	}
+	if !strings.Contains(transcript.String(), "server: AUTHENTICATE +\n") {
+		t.Errorf("expected the transcript to include the lines of the server; got:\n%s", transcript)
+	}
+}
+
+func TestClient_saslPlain(t *testing.T) {
+	client, server, done := setup()
+	defer done()
+	client.SASL = irc.SASLPlain("bot", "hunter2")
+
+	var sent []string
+	server.Handler = irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+		switch m.Command {
+		case irc.CmdCap:
+			switch m.Params.Get(1) {
+			case "LS":
+				server.WriteString(":irc.example.com CAP * LS :sasl=PLAIN")
+			case "REQ":
+				server.WriteString(":irc.example.com CAP bot ACK :" + m.Params.Get(2))
+			case "END":
+				done()
+			}
+		case irc.CmdAuthenticate:
+			sent = append(sent, "AUTHENTICATE "+m.Params.Get(1))
+			if m.Params.Get(1) == "PLAIN" {
+				// a 421 for another command doesn't mean that SASL isn't supported
+				server.WriteString(":irc.example.com 421 bot FOO :Unknown command")
+				server.WriteString("AUTHENTICATE +")
+			} else {
+				server.WriteString(":irc.example.com 903 bot :SASL authentication successful")
+			}
+		}
+	})
+	_ = client.ConnectAndRun(context.Background(), nil)
+
+	// the response is base64("\x00bot\x00hunter2"): an empty authorization identity, the account, and the password
+	expected := []string{"AUTHENTICATE PLAIN", "AUTHENTICATE AGJvdABodW50ZXIy"}
+	if fmt.Sprint(sent) != fmt.Sprint(expected) {
+		t.Errorf("expected client to send %q; got %q", expected, sent)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	cert, err := irc.GenerateCertificate("bot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp, err := irc.Fingerprint(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fp) != 64 || strings.ToLower(fp) != fp {
+		t.Errorf("expected a lowercase hex-encoded SHA-256 fingerprint; got %q", fp)
+	}
+}
+
+func TestLoadCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "bot.crt"), filepath.Join(dir, "bot.key")
+
+	generated, err := irc.LoadCertificate(certFile, keyFile, "bot")
+	if err != nil {
+		t.Fatalf("expected a certificate to be generated; got %v", err)
+	}
+	if info, err := os.Stat(keyFile); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected the key file to be readable only by its owner; got %v %v", info.Mode(), err)
+	}
+	loaded, err := irc.LoadCertificate(certFile, keyFile, "bot")
+	if err != nil {
+		t.Fatalf("expected the saved certificate to be loaded; got %v", err)
+	}
+	fp1, _ := irc.Fingerprint(generated)
+	fp2, _ := irc.Fingerprint(loaded)
+	if fp1 != fp2 {
+		t.Errorf("expected the same certificate to be loaded again; got fingerprints %s and %s", fp1, fp2)
+	}
+
+	// a broken pair is never overwritten
+	if err := os.WriteFile(keyFile, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := irc.LoadCertificate(certFile, keyFile, "bot"); err == nil {
+		t.Errorf("expected an error for a broken key file")
+	}
+	if b, _ := os.ReadFile(keyFile); string(b) != "broken" {
+		t.Errorf("expected the broken key file to be left alone")
+	}
+	if _, err := irc.LoadCertificate(filepath.Join(dir, "other.crt"), keyFile, "bot"); err == nil {
+		t.Errorf("expected an error when only the key file exists")
+	}
+}
+
 func TestNewCTCPCmd(t *testing.T) {
 	fn := irc.NewCTCPCmd("ACTION")
 	if irc.CTCPAction != fn {
@@ -135,6 +519,12 @@ func TestNewCTCPReply(t *testing.T) {
 
 func newServer() *irctest.Server {
 	s := irctest.NewServer()
+	mockNetwork(s)
+	return s
+}
+
+// mockNetwork sets the handler of s to simulate the registration and join behavior of a real IRC server.
+func mockNetwork(s *irctest.Server) {
 	state := struct {
 		servername   string
 		clientPrefix irc.Prefix
@@ -183,12 +573,11 @@ func newServer() *irctest.Server {
 		}
 
 	})
-
-	return s
 }
 
 func setup() (client *irc.Client, server *irctest.Server, done context.CancelFunc) {
 	server = irctest.NewServer()
+	server.RecordTranscript = true
 	client = &irc.Client{Nickname: "bot"}
 	client.DialFn = func() (io.ReadWriteCloser, error) {
 		return server, nil
@@ -198,3 +587,3170 @@ func setup() (client *irc.Client, server *irctest.Server, done context.CancelFun
 	go func() { <-ctx.Done(); done(); server.Close() }()
 	return
 }
+
+func TestClient_concurrentWrites(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	const writers, messages = 20, 25
+	var (
+		mu       sync.Mutex
+		received int
+	)
+	server := irctest.NewServer()
+	mockNetwork(server)
+	network := server.Handler
+	server.Handler = irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+		if m.Command == irc.CmdPrivmsg {
+			mu.Lock()
+			if m.Params.Get(2) == "hello from a goroutine" {
+				received++
+			}
+			mu.Unlock()
+		}
+		network.SpeakIRC(w, m)
+	})
+	defer server.Close()
+
+	client := &irc.Client{Nickname: "bot"}
+	client.DialFn = func() (io.ReadWriteCloser, error) { return server, nil }
+	h := &irc.Router{}
+	h.OnConnect(func(w irc.MessageWriter, m *irc.Message) {
+		go func() {
+			var wg sync.WaitGroup
+			for i := 0; i < writers; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < messages; j++ {
+						client.WriteMessage(irc.Msg("#foo", "hello from a goroutine"))
+						_ = client.Nick()
+					}
+				}()
+			}
+			wg.Wait()
+			client.WriteMessage(irc.Quit("bye"))
+		}()
+	})
+	if err := client.ConnectAndRun(ctx, h); err != nil {
+		t.Errorf("expected client to exit without errors, got: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if received != writers*messages {
+		t.Errorf("expected %d intact messages; got %d", writers*messages, received)
+	}
+}
+
+func TestClient_queueOverflow(t *testing.T) {
+	client, server, done := setup()
+	defer done()
+	client.QueueSize = 1
+	client.QueueOverflow = irc.OverflowDisconnect
+
+	go func() {
+		for i := 0; i < 10; i++ {
+			server.WriteString(":nick PRIVMSG bot :hello")
+		}
+	}()
+	stall := irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+		if m.Command == irc.CmdPrivmsg {
+			time.Sleep(100 * time.Millisecond)
+		}
+	})
+	if err := client.ConnectAndRun(context.Background(), stall); err != irc.ErrQueueFull {
+		t.Errorf("expected client to exit with ErrQueueFull; got: %v", err)
+	}
+}
+
+func TestPipe(t *testing.T) {
+	a, b := irc.Pipe()
+	if _, err := a.Write([]byte("PING :1\r\nPI")); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = a.Write([]byte("NG :2\r\n"))
+	_ = a.Close()
+
+	buf := make([]byte, 512)
+	for _, want := range []string{"PING :1\r\n", "PING :2\r\n"} {
+		n, err := b.Read(buf)
+		if err != nil || string(buf[:n]) != want {
+			t.Errorf("expected to read %q; got %q, %v", want, buf[:n], err)
+		}
+	}
+	if _, err := b.Read(buf); err != io.EOF {
+		t.Errorf("expected EOF after the pipe was closed; got %v", err)
+	}
+	if _, err := b.Write([]byte("PONG :1\r\n")); err != io.ErrClosedPipe {
+		t.Errorf("expected writes to a closed pipe to fail; got %v", err)
+	}
+}
+
+func TestClient_pipe(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	clientConn, serverConn := irc.Pipe()
+	go func() {
+		// a minimal server which welcomes the client and closes the connection when it quits
+		defer serverConn.Close()
+		scanner := bufio.NewScanner(serverConn)
+		for scanner.Scan() {
+			m := new(irc.Message)
+			if err := m.UnmarshalText(scanner.Bytes()); err != nil {
+				continue
+			}
+			switch m.Command {
+			case irc.CmdUser:
+				fmt.Fprintf(serverConn, ":irc.example.com 001 bot :Welcome bot!bot@example.com\r\n")
+			case irc.CmdQuit:
+				return
+			}
+		}
+	}()
+
+	client := &irc.Client{Nickname: "bot"}
+	client.DialFn = func() (io.ReadWriteCloser, error) { return clientConn, nil }
+	h := &irc.Router{}
+	h.OnConnect(func(w irc.MessageWriter, m *irc.Message) {
+		w.WriteMessage(irc.Quit("bye"))
+	})
+	if err := client.ConnectAndRun(ctx, h); err != nil {
+		t.Errorf("expected client to exit without errors, got: %v", err)
+	}
+}
+
+func TestLoopGuard(t *testing.T) {
+	guard := &irc.LoopGuard{Bots: []string{"*bot!*@*"}, MaxRepeats: 2}
+	echo := guard.Middleware(irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+		w.WriteMessage(irc.Msg("#foo", "echo"))
+		w.WriteMessage(irc.Join("#bar"))
+	}))
+
+	tests := []struct {
+		name string
+		m    *irc.Message
+		want int
+	}{
+		{"notice", &irc.Message{Source: irc.Prefix{Nick: "alice"}, Command: irc.CmdNotice, Params: irc.Params{"#foo", "hi"}}, 1},
+		{"bot mask", &irc.Message{Source: irc.Prefix{Nick: "otherbot", User: "u", Host: "h"}, Command: irc.CmdPrivmsg, Params: irc.Params{"#foo", "hi"}}, 1},
+		{"bot tag", &irc.Message{Tags: irc.Tags{"bot": ""}, Source: irc.Prefix{Nick: "alice"}, Command: irc.CmdPrivmsg, Params: irc.Params{"#foo", "hi"}}, 1},
+		{"user", &irc.Message{Source: irc.Prefix{Nick: "alice"}, Command: irc.CmdPrivmsg, Params: irc.Params{"#foo", "hi"}}, 2},
+		{"repeat", &irc.Message{Source: irc.Prefix{Nick: "alice"}, Command: irc.CmdPrivmsg, Params: irc.Params{"#foo", "hi"}}, 2},
+		{"too many repeats", &irc.Message{Source: irc.Prefix{Nick: "alice"}, Command: irc.CmdPrivmsg, Params: irc.Params{"#foo", "hi"}}, 1},
+	}
+	for _, tt := range tests {
+		rec := &irctest.RecordingWriter{}
+		echo.SpeakIRC(rec, tt.m)
+		if len(rec.Messages()) != tt.want {
+			t.Errorf("%s: expected %d messages to be written; got %d", tt.name, tt.want, len(rec.Messages()))
+		}
+	}
+
+	// services and CTCP queries are answered even when the checks above would drop the reply
+	reply := guard.Middleware(irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+		switch m.Command {
+		case irc.CmdNotice:
+			w.WriteMessage(irc.Msg("NickServ", "IDENTIFY hunter2"))
+		case irc.CTCPVersionQuery:
+			w.WriteMessage(irc.CTCPReply("otherbot", "VERSION", "irc"))
+		}
+	}))
+	exempt := []*irc.Message{
+		{Source: irc.Prefix{Nick: "NickServ"}, Command: irc.CmdNotice, Params: irc.Params{"bot", "This nickname is registered."}},
+		{Source: irc.Prefix{Nick: "otherbot", User: "u", Host: "h"}, Command: irc.CTCPVersionQuery, Params: irc.Params{"bot", ""}},
+	}
+	for _, m := range exempt {
+		rec := &irctest.RecordingWriter{}
+		reply.SpeakIRC(rec, m)
+		if rec.Len() != 1 {
+			t.Errorf("%s: expected the reply to be written", m.Command)
+		}
+	}
+}
+
+func TestClient_forcedNickChange(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	clientConn, serverConn := irc.Pipe()
+	go func() {
+		defer serverConn.Close()
+		registered := false
+		scanner := bufio.NewScanner(serverConn)
+		for scanner.Scan() {
+			m := new(irc.Message)
+			if err := m.UnmarshalText(scanner.Bytes()); err != nil {
+				continue
+			}
+			switch m.Command {
+			case irc.CmdUser:
+				registered = true
+				fmt.Fprintf(serverConn, ":irc.example.com 001 bot :Welcome bot!bot@example.com\r\n")
+				// services rename us
+				fmt.Fprintf(serverConn, ":bot!bot@example.com NICK Guest42\r\n")
+			case irc.CmdNick:
+				if registered {
+					fmt.Fprintf(serverConn, ":Guest42!bot@example.com NICK %s\r\n", m.Params.Get(1))
+				}
+			case irc.CmdQuit:
+				return
+			}
+		}
+	}()
+
+	var forced []string
+	client := &irc.Client{Nickname: "bot", ReclaimNick: 10 * time.Millisecond}
+	client.OnForcedNickChange = func(old, nick irc.Nickname) {
+		forced = append(forced, old.String()+" -> "+nick.String())
+	}
+	client.DialFn = func() (io.ReadWriteCloser, error) { return clientConn, nil }
+	h := irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+		if m.Command == irc.CmdNick && m.Params.Get(1) == "bot" {
+			w.WriteMessage(irc.Quit("bye"))
+		}
+	})
+	if err := client.ConnectAndRun(ctx, h); err != nil {
+		t.Errorf("expected client to reclaim its nickname and quit, got: %v", err)
+	}
+	if len(forced) != 1 || forced[0] != "bot -> Guest42" {
+		t.Errorf("expected a single forced nickname change; got %q", forced)
+	}
+	if !client.Nick().Is("bot") {
+		t.Errorf("expected the client to have its nickname back; got %q", client.Nick())
+	}
+}
+
+func TestClient_disconnectCause(t *testing.T) {
+	tests := map[string]irc.DisconnectCause{
+		"ERROR :Closing Link: bot[1.2.3.4] (K-Lined: spamming)":                 irc.CauseBanned,
+		"ERROR :Trying to reconnect too fast.":                                  irc.CauseThrottled,
+		"ERROR :Closing Link: 1.2.3.4 (Too many host connections (global))":     irc.CauseTooManyConnections,
+		":oper!oper@example.com KILL bot :Killed (oper (behave))":               irc.CauseKilled,
+		"ERROR :Closing Link: bot[1.2.3.4] (Ping timeout: 240 seconds)":         irc.CausePingTimeout,
+		"ERROR :Closing Link: bot[1.2.3.4] (Server shutting down for upgrades)": irc.CauseUnknown,
+	}
+	for line, want := range tests {
+		clientConn, serverConn := irc.Pipe()
+		go func(line string) {
+			defer serverConn.Close()
+			scanner := bufio.NewScanner(serverConn)
+			for scanner.Scan() {
+				if strings.HasPrefix(scanner.Text(), "USER") {
+					fmt.Fprintf(serverConn, ":irc.example.com 001 bot :Welcome bot!bot@example.com\r\n%s\r\n", line)
+					return
+				}
+			}
+		}(line)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		client := &irc.Client{Nickname: "bot"}
+		client.DialFn = func() (io.ReadWriteCloser, error) { return clientConn, nil }
+		err := client.ConnectAndRun(ctx, nil)
+		cancel()
+
+		var disconnect *irc.DisconnectError
+		if !errors.As(err, &disconnect) {
+			t.Errorf("%q: expected a DisconnectError; got: %v", line, err)
+			continue
+		}
+		if disconnect.Cause != want {
+			t.Errorf("%q: expected cause %s; got %s", line, want, disconnect.Cause)
+		}
+		if !errors.Is(err, io.EOF) {
+			t.Errorf("%q: expected the error to wrap io.EOF; got: %v", line, err)
+		}
+	}
+}
+
+type staticResolver []net.IPAddr
+
+func (r staticResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return r, nil
+}
+
+func TestClient_resolver(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	l, err := irctest.ListenTLS(mockNetwork)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr())
+
+	// the IPv6 address is unreachable, so the client has to fall back to IPv4
+	client := &irc.Client{
+		Nickname:  "HelloBot",
+		Addr:      net.JoinHostPort("localhost", port),
+		TLSConfig: l.TLSConfig(),
+		Resolver:  staticResolver{{IP: net.ParseIP("100::1")}, {IP: net.ParseIP("127.0.0.1")}},
+	}
+	h := &irc.Router{}
+	h.OnConnect(func(w irc.MessageWriter, m *irc.Message) {
+		w.WriteMessage(irc.Quit("bye"))
+	})
+	if err = client.ConnectAndRun(ctx, h); err != nil {
+		t.Errorf("expected client to exit without errors, got: %v", err)
+	}
+}
+
+// blockingResolver never answers, until the lookup is canceled.
+type blockingResolver struct{}
+
+func (blockingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestClient_dialTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration // of the context given to ConnectAndRun
+		dial    time.Duration // DialTimeout
+	}{
+		{"canceled", 20 * time.Millisecond, 0},
+		{"dial timeout", time.Minute, 20 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+			client := &irc.Client{Nickname: "bot", Addr: "irc.example.com:6697", Resolver: blockingResolver{}, DialTimeout: tt.dial}
+
+			start := time.Now()
+			err := client.ConnectAndRun(ctx, nil)
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("expected the dial to time out; got %v", err)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("expected the dial to give up quickly; took %s", elapsed)
+			}
+		})
+	}
+}
+
+func TestClient_stallTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	go func() {
+		// a server which welcomes the client, then reads everything but never answers again
+		scanner := bufio.NewScanner(serverConn)
+		for scanner.Scan() {
+			if strings.HasPrefix(scanner.Text(), "USER") {
+				fmt.Fprintf(serverConn, ":irc.example.com 001 bot :Welcome bot!bot@example.com\r\n")
+			}
+		}
+	}()
+
+	client := &irc.Client{Nickname: "bot", StallTimeout: 50 * time.Millisecond}
+	client.DialFn = func() (io.ReadWriteCloser, error) { return clientConn, nil }
+	err := client.ConnectAndRun(ctx, nil)
+	if !errors.Is(err, irc.ErrStalled) {
+		t.Errorf("expected the client to detect the stalled connection; got: %v", err)
+	}
+}
+
+func TestClient_profiles(t *testing.T) {
+	for _, p := range []irctest.Profile{irctest.RFC1459, irctest.IRCv3, irctest.Twitch, irctest.InspIRCd, irctest.Ergo} {
+		t.Run(p.Name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			l, err := irctest.ListenTLS(p.Setup)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+
+			client := &irc.Client{Nickname: "HelloBot", Addr: l.Addr(), TLSConfig: l.TLSConfig(), Caps: []string{"message-tags"}}
+			h := &irc.Router{}
+			h.OnConnect(func(w irc.MessageWriter, m *irc.Message) {
+				w.WriteMessage(irc.Join("#test"))
+			})
+			h.HandleFunc(irc.RplEndOfNames, func(w irc.MessageWriter, m *irc.Message) {
+				w.WriteMessage(irc.Quit("bye"))
+			})
+			if err = client.ConnectAndRun(ctx, h); err != nil {
+				t.Errorf("expected client to join and quit without errors, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestClient_joinOutbox(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	clientConn, serverConn := irc.Pipe()
+	var (
+		mu        sync.Mutex
+		confirmed bool
+		got       []string
+	)
+	go func() {
+		defer serverConn.Close()
+		scanner := bufio.NewScanner(serverConn)
+		for scanner.Scan() {
+			m := new(irc.Message)
+			if err := m.UnmarshalText(scanner.Bytes()); err != nil {
+				continue
+			}
+			mu.Lock()
+			switch m.Command {
+			case irc.CmdUser:
+				fmt.Fprintf(serverConn, ":irc.example.com 001 bot :Welcome bot!bot@example.com\r\n")
+			case irc.CmdJoin:
+				if m.Params.Get(1) == "#banned" {
+					fmt.Fprintf(serverConn, ":irc.example.com 474 bot #banned :Cannot join channel (+b)\r\n")
+					break
+				}
+				// a slow server, so that an unheld message would arrive before the confirmation
+				time.AfterFunc(50*time.Millisecond, func() {
+					mu.Lock()
+					defer mu.Unlock()
+					confirmed = true
+					fmt.Fprintf(serverConn, ":bot!bot@example.com JOIN %s\r\n", m.Params.Get(1))
+				})
+			case irc.CmdPrivmsg:
+				got = append(got, fmt.Sprintf("%s %s (joined: %t)", m.Params.Get(1), m.Params.Get(2), confirmed))
+			case irc.CmdQuit:
+				mu.Unlock()
+				return
+			}
+			mu.Unlock()
+		}
+	}()
+
+	client := &irc.Client{Nickname: "bot", ErrorLog: log.New(io.Discard, "", 0)}
+	client.DialFn = func() (io.ReadWriteCloser, error) { return clientConn, nil }
+	h := irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+		switch m.Command {
+		case irc.RplWelcome:
+			w.WriteMessage(irc.Join("#banned"))
+			w.WriteMessage(irc.Msg("#banned", "never sent"))
+			w.WriteMessage(irc.Join("#foo"))
+			w.WriteMessage(irc.Msg("#foo", "hello"))
+			w.WriteMessage(irc.Msg("alice", "not held"))
+		case irc.CmdJoin:
+			w.WriteMessage(irc.Quit("bye"))
+		}
+	})
+	if err := client.ConnectAndRun(ctx, h); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := "alice not held (joined: false)|#foo hello (joined: true)"
+	if strings.Join(got, "|") != want {
+		t.Errorf("expected %q; got %q", want, strings.Join(got, "|"))
+	}
+}
+
+// TestClient_joinOutbox_order checks that a message written to a channel while its held messages are being sent
+// goes out after them, and that the JOIN confirmation is matched regardless of the command's case.
+func TestClient_joinOutbox_order(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	// net.Pipe is unbuffered, so the client is still writing the held messages while the server reads them
+	clientConn, serverConn := net.Pipe()
+	flushing := make(chan struct{})
+	var got []string
+	go func() {
+		defer serverConn.Close()
+		scanner := bufio.NewScanner(serverConn)
+		for scanner.Scan() {
+			m := new(irc.Message)
+			if err := m.UnmarshalText(scanner.Bytes()); err != nil {
+				continue
+			}
+			switch m.Command {
+			case irc.CmdUser:
+				go fmt.Fprintf(serverConn, ":irc.example.com 001 bot :Welcome bot!bot@example.com\r\n")
+			case irc.CmdJoin:
+				go fmt.Fprintf(serverConn, ":bot!bot@example.com join %s\r\n", m.Params.Get(1))
+			case irc.CmdPrivmsg:
+				got = append(got, m.Params.Get(2))
+				if len(got) == 1 {
+					close(flushing)
+					time.Sleep(50 * time.Millisecond)
+				}
+				if m.Params.Get(2) == "late" {
+					go fmt.Fprintf(serverConn, ":irc.example.com NOTICE bot :done\r\n")
+				}
+			case irc.CmdQuit:
+				return
+			}
+		}
+	}()
+
+	client := &irc.Client{Nickname: "bot"}
+	client.DialFn = func() (io.ReadWriteCloser, error) { return clientConn, nil }
+	h := irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+		switch m.Command {
+		case irc.RplWelcome:
+			w.WriteMessage(irc.Join("#foo"))
+			for i := 0; i < 5; i++ {
+				w.WriteMessage(irc.Msg("#foo", fmt.Sprintf("held %d", i)))
+			}
+			go func() {
+				<-flushing
+				w.WriteMessage(irc.Msg("#foo", "late"))
+			}()
+		case irc.CmdNotice:
+			w.WriteMessage(irc.Quit("bye"))
+		}
+	})
+	if err := client.ConnectAndRun(ctx, h); err != nil {
+		t.Fatal(err)
+	}
+	want := "held 0|held 1|held 2|held 3|held 4|late"
+	if strings.Join(got, "|") != want {
+		t.Errorf("expected %q; got %q", want, strings.Join(got, "|"))
+	}
+}
+
+// TestClient_joinOutbox_joined checks that messages aren't held for a JOIN which the server ignores,
+// because the client is already on the channel, and that channel names are compared with the server's CASEMAPPING.
+func TestClient_joinOutbox_joined(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	clientConn, serverConn := irc.Pipe()
+	var got []string
+	go func() {
+		defer serverConn.Close()
+		joined := false
+		scanner := bufio.NewScanner(serverConn)
+		for scanner.Scan() {
+			m := new(irc.Message)
+			if err := m.UnmarshalText(scanner.Bytes()); err != nil {
+				continue
+			}
+			switch m.Command {
+			case irc.CmdUser:
+				fmt.Fprintf(serverConn, ":irc.example.com 001 bot :Welcome bot!bot@example.com\r\n")
+				fmt.Fprintf(serverConn, ":irc.example.com 005 bot CASEMAPPING=rfc1459 :are supported by this server\r\n")
+			case irc.CmdJoin:
+				if !joined {
+					joined = true
+					fmt.Fprintf(serverConn, ":bot!bot@example.com JOIN #Foo{\r\n")
+				}
+			case irc.CmdPrivmsg:
+				got = append(got, m.Params.Get(2))
+				if m.Params.Get(2) == "again" {
+					fmt.Fprintf(serverConn, ":irc.example.com NOTICE bot :done\r\n")
+				}
+			case irc.CmdQuit:
+				return
+			}
+		}
+	}()
+
+	client := &irc.Client{Nickname: "bot"}
+	client.DialFn = func() (io.ReadWriteCloser, error) { return clientConn, nil }
+	h := irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+		switch m.Command {
+		case irc.RplISupport:
+			w.WriteMessage(irc.Join("#foo["))
+			w.WriteMessage(irc.Msg("#foo[", "hello"))
+		case irc.CmdJoin:
+			w.WriteMessage(irc.Join("#FOO{"))
+			w.WriteMessage(irc.Msg("#FOO{", "again"))
+		case irc.CmdNotice:
+			w.WriteMessage(irc.Quit("bye"))
+		}
+	})
+	if err := client.ConnectAndRun(ctx, h); err != nil {
+		t.Fatal(err)
+	}
+	if ctx.Err() != nil {
+		t.Errorf("expected the message to the channel the client was on not to be held")
+	}
+	if strings.Join(got, "|") != "hello|again" {
+		t.Errorf("expected both messages; got %q", got)
+	}
+}
+
+func TestIgnoreList(t *testing.T) {
+	var got []string
+	l := &irc.IgnoreList{}
+	h := l.Middleware(irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+		if m.Command == irc.CmdPrivmsg {
+			got = append(got, m.Source.Nick.String())
+		}
+	}))
+	speak := func(w irc.MessageWriter, line string) {
+		m := new(irc.Message)
+		if err := m.UnmarshalText([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+		h.SpeakIRC(w, m)
+	}
+
+	// without SILENCE, the list is only applied by the middleware
+	rec := &irctest.RecordingWriter{}
+	l.Add(rec, "spammer")
+	l.Add(rec, "*!*@flood.example.com")
+	speak(rec, ":irc.example.com 001 bot :Welcome bot!bot@example.com")
+	speak(rec, ":spammer!s@host PRIVMSG bot :buy now")
+	speak(rec, ":bob!b@flood.example.com PRIVMSG bot :hi")
+	speak(rec, ":alice!a@host PRIVMSG bot :hi")
+	if len(rec.Messages()) != 0 {
+		t.Errorf("expected no SILENCE commands; got %v", rec.Messages())
+	}
+	if strings.Join(got, ",") != "alice" {
+		t.Errorf("expected only alice's message; got %q", got)
+	}
+
+	// with SILENCE=1, the first mask is added to the server's list and the other stays client-side
+	speak(rec, ":irc.example.com 005 bot SILENCE=1 :are supported by this server")
+	if len(rec.Messages()) != 1 || rec.Messages()[0].Params.Get(1) != "+spammer!*@*" {
+		t.Fatalf("expected the first mask to be silenced; got %v", rec.Messages())
+	}
+
+	// removing it makes room for the other
+	l.Remove(rec, "spammer!*@*")
+	if len(rec.Messages()) != 3 || rec.Messages()[1].Params.Get(1) != "-spammer!*@*" || rec.Messages()[2].Params.Get(1) != "+*!*@flood.example.com" {
+		t.Errorf("expected the second mask to replace the first; got %v", rec.Messages())
+	}
+	if masks := l.Masks(); len(masks) != 1 {
+		t.Errorf("expected 1 mask; got %q", masks)
+	}
+}
+
+func TestClient_operCommands(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	clientConn, serverConn := irc.Pipe()
+	go func() {
+		defer serverConn.Close()
+		scanner := bufio.NewScanner(serverConn)
+		for scanner.Scan() {
+			m := new(irc.Message)
+			if err := m.UnmarshalText(scanner.Bytes()); err != nil {
+				continue
+			}
+			switch m.Command {
+			case irc.CmdUser:
+				fmt.Fprintf(serverConn, ":irc.example.com 001 bot :Welcome bot!bot@example.com\r\n")
+			case irc.CmdOper:
+				if m.Params.Get(2) != "secret" {
+					fmt.Fprintf(serverConn, ":irc.example.com 464 bot :Password incorrect\r\n")
+					break
+				}
+				fmt.Fprintf(serverConn, ":irc.example.com 381 bot :You are now an IRC operator\r\n")
+			case irc.CmdRehash:
+				fmt.Fprintf(serverConn, ":irc.example.com 382 bot ircd.conf :Rehashing\r\n")
+			case irc.CmdConnect:
+				fmt.Fprintf(serverConn, ":irc.example.com 402 bot %s :No such server\r\n", m.Params.Get(1))
+			case irc.CmdPing:
+				fmt.Fprintf(serverConn, ":irc.example.com PONG irc.example.com :%s\r\n", m.Params.Get(1))
+			case irc.CmdDie:
+				return
+			}
+		}
+	}()
+
+	var got []string
+	done := make(chan struct{})
+	client := &irc.Client{Nickname: "bot"}
+	client.DialFn = func() (io.ReadWriteCloser, error) { return clientConn, nil }
+	h := irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+		if m.Command != irc.RplWelcome {
+			return
+		}
+		// the commands wait for replies read by the client, so they can't block the handler
+		go func() {
+			defer close(done)
+			record := func(err error) {
+				if err == nil {
+					got = append(got, "ok")
+					return
+				}
+				got = append(got, err.Error())
+			}
+			record(client.Oper(ctx, "admin", "wrong"))
+			record(client.Oper(ctx, "admin", "secret"))
+			record(client.Rehash(ctx))
+			err := client.ConnectServer(ctx, "hub.example.com", 0, "")
+			if !errors.Is(err, irc.ErrNoSuchServer) {
+				t.Errorf("expected ErrNoSuchServer; got %v", err)
+			}
+			record(client.Die(ctx))
+		}()
+	})
+	_ = client.ConnectAndRun(ctx, h)
+	<-done
+
+	want := "OPER: password incorrect: Password incorrect|ok|ok|ok"
+	if strings.Join(got, "|") != want {
+		t.Errorf("expected %q; got %q", want, strings.Join(got, "|"))
+	}
+	if err := client.Rehash(ctx); !errors.Is(err, irc.ErrNotConnected) {
+		t.Errorf("expected ErrNotConnected after disconnecting; got %v", err)
+	}
+}
+
+// TestClient_requestErrors checks that an error numeric which doesn't name its command
+// only completes a pending request for a command which it can answer.
+func TestClient_requestErrors(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	clientConn, serverConn := irc.Pipe()
+	operSent := make(chan struct{})
+	go func() {
+		defer serverConn.Close()
+		scanner := bufio.NewScanner(serverConn)
+		for scanner.Scan() {
+			m := new(irc.Message)
+			if err := m.UnmarshalText(scanner.Bytes()); err != nil {
+				continue
+			}
+			switch m.Command {
+			case irc.CmdUser:
+				fmt.Fprintf(serverConn, ":irc.example.com 001 bot :Welcome bot!bot@example.com\r\n")
+			case irc.CmdOper:
+				// the password is checked slowly, and the reply arrives after the reply to STATS
+				close(operSent)
+			case irc.CmdStats:
+				fmt.Fprintf(serverConn, ":irc.example.com 481 bot :Permission Denied - You're not an IRC operator\r\n")
+				fmt.Fprintf(serverConn, ":irc.example.com 381 bot :You are now an IRC operator\r\n")
+			case irc.CmdQuit:
+				return
+			}
+		}
+	}()
+
+	var operErr, statsErr error
+	client := &irc.Client{Nickname: "bot"}
+	client.DialFn = func() (io.ReadWriteCloser, error) { return clientConn, nil }
+	h := irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+		if m.Command != irc.RplWelcome {
+			return
+		}
+		go func() {
+			oper := make(chan error, 1)
+			go func() { oper <- client.Oper(ctx, "admin", "secret") }()
+			<-operSent
+			_, statsErr = client.Stats(ctx, "o", "")
+			operErr = <-oper
+			client.WriteMessage(irc.Quit("bye"))
+		}()
+	})
+	_ = client.ConnectAndRun(ctx, h)
+
+	if !errors.Is(statsErr, irc.ErrNoPrivileges) {
+		t.Errorf("expected STATS to be refused; got %v", statsErr)
+	}
+	if operErr != nil {
+		t.Errorf("expected OPER to succeed despite the refusal of STATS; got %v", operErr)
+	}
+}
+
+func TestClient_statsAndLUsers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	clientConn, serverConn := irc.Pipe()
+	go func() {
+		defer serverConn.Close()
+		scanner := bufio.NewScanner(serverConn)
+		for scanner.Scan() {
+			m := new(irc.Message)
+			if err := m.UnmarshalText(scanner.Bytes()); err != nil {
+				continue
+			}
+			switch m.Command {
+			case irc.CmdUser:
+				fmt.Fprintf(serverConn, ":irc.example.com 001 bot :Welcome bot!bot@example.com\r\n")
+			case irc.CmdStats:
+				switch m.Params.Get(1) {
+				case "u":
+					fmt.Fprintf(serverConn, ":irc.example.com 242 bot :Server Up 3 days 4:05:06\r\n")
+				case "m":
+					fmt.Fprintf(serverConn, ":irc.example.com 212 bot PRIVMSG 120 5000 3\r\n")
+					fmt.Fprintf(serverConn, ":irc.example.com 212 bot JOIN 7\r\n")
+				case "o":
+					fmt.Fprintf(serverConn, ":irc.example.com 481 bot :Permission Denied - You're not an IRC operator\r\n")
+					continue
+				}
+				fmt.Fprintf(serverConn, ":irc.example.com 219 bot %s :End of /STATS report\r\n", m.Params.Get(1))
+			case irc.CmdLUsers:
+				fmt.Fprintf(serverConn, ":irc.example.com 251 bot :There are 5 users and 120 invisible on 3 servers\r\n")
+				fmt.Fprintf(serverConn, ":irc.example.com 252 bot 4 :operator(s) online\r\n")
+				fmt.Fprintf(serverConn, ":irc.example.com 254 bot 42 :channels formed\r\n")
+				fmt.Fprintf(serverConn, ":irc.example.com 255 bot :I have 50 clients and 1 servers\r\n")
+				fmt.Fprintf(serverConn, ":irc.example.com 265 bot 50 60 :Current local users 50, max 60\r\n")
+				fmt.Fprintf(serverConn, ":irc.example.com 266 bot :Current global users: 125  Max: 300\r\n")
+			case irc.CmdPing:
+				fmt.Fprintf(serverConn, ":irc.example.com PONG irc.example.com :%s\r\n", m.Params.Get(1))
+			case irc.CmdQuit:
+				return
+			}
+		}
+	}()
+
+	client := &irc.Client{Nickname: "bot"}
+	client.DialFn = func() (io.ReadWriteCloser, error) { return clientConn, nil }
+	h := irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+		if m.Command != irc.RplWelcome {
+			return
+		}
+		go func() {
+			defer w.WriteMessage(irc.Quit("bye"))
+
+			uptime, err := client.Stats(ctx, "u", "")
+			if err != nil || uptime.Uptime != 3*24*time.Hour+4*time.Hour+5*time.Minute+6*time.Second {
+				t.Errorf("unexpected uptime: %v, %v", uptime, err)
+			}
+			commands, err := client.Stats(ctx, "m", "")
+			if err != nil || len(commands.Commands) != 2 || commands.Commands[0] != (irc.StatsCommand{Command: "PRIVMSG", Count: 120, Bytes: 5000, RemoteCount: 3}) {
+				t.Errorf("unexpected commands: %v, %v", commands, err)
+			}
+			if _, err := client.Stats(ctx, "o", ""); !errors.Is(err, irc.ErrNoPrivileges) {
+				t.Errorf("expected ErrNoPrivileges; got %v", err)
+			}
+
+			lusers, err := client.LUsers(ctx)
+			want := irc.LUsersReply{
+				Users: 5, Invisible: 120, Servers: 3, Operators: 4, Channels: 42, LocalClients: 50, LocalServers: 1,
+				LocalUsers: 50, MaxLocalUsers: 60, GlobalUsers: 125, MaxGlobalUsers: 300,
+			}
+			if err != nil || *lusers != want {
+				t.Errorf("expected %+v; got %+v, %v", want, lusers, err)
+			}
+		}()
+	})
+	if err := client.ConnectAndRun(ctx, h); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClient_topology(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	clientConn, serverConn := irc.Pipe()
+	go func() {
+		defer serverConn.Close()
+		polls := 0
+		scanner := bufio.NewScanner(serverConn)
+		for scanner.Scan() {
+			m := new(irc.Message)
+			if err := m.UnmarshalText(scanner.Bytes()); err != nil {
+				continue
+			}
+			switch m.Command {
+			case irc.CmdUser:
+				fmt.Fprintf(serverConn, ":irc.example.com 001 bot :Welcome bot!bot@example.com\r\n")
+			case irc.CmdLinks:
+				polls++
+				fmt.Fprintf(serverConn, ":irc.example.com 364 bot leaf1.example.com hub.example.com :2 Leaf One\r\n")
+				if polls == 1 {
+					fmt.Fprintf(serverConn, ":irc.example.com 364 bot leaf2.example.com hub.example.com :2 Leaf Two\r\n")
+				}
+				fmt.Fprintf(serverConn, ":irc.example.com 364 bot hub.example.com irc.example.com :1 The Hub\r\n")
+				fmt.Fprintf(serverConn, ":irc.example.com 364 bot irc.example.com irc.example.com :0 Example IRC\r\n")
+				fmt.Fprintf(serverConn, ":irc.example.com 365 bot * :End of /LINKS list.\r\n")
+			case irc.CmdMap:
+				fmt.Fprintf(serverConn, ":irc.example.com 006 bot :irc.example.com (10) 50%%\r\n")
+				fmt.Fprintf(serverConn, ":irc.example.com 006 bot :`-hub.example.com (2) 10%%\r\n")
+				fmt.Fprintf(serverConn, ":irc.example.com 006 bot :  |-leaf1.example.com (4) 20%%\r\n")
+				fmt.Fprintf(serverConn, ":irc.example.com 006 bot :  `-leaf2.example.com (4) 20%%\r\n")
+				fmt.Fprintf(serverConn, ":irc.example.com 007 bot :End of /MAP\r\n")
+			case irc.CmdQuit:
+				return
+			}
+		}
+	}()
+
+	client := &irc.Client{Nickname: "bot"}
+	client.DialFn = func() (io.ReadWriteCloser, error) { return clientConn, nil }
+	h := irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+		if m.Command != irc.RplWelcome {
+			return
+		}
+		go func() {
+			defer w.WriteMessage(irc.Quit("bye"))
+
+			before, err := client.Links(ctx, "")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			want := "irc.example.com,hub.example.com,leaf1.example.com,leaf2.example.com"
+			if got := strings.Join(before.Servers(), ","); got != want {
+				t.Errorf("expected servers %q; got %q", want, got)
+			}
+			if leaf := before.Server("LEAF1.example.com"); leaf == nil || leaf.Parent.Name != "hub.example.com" || leaf.Info != "Leaf One" {
+				t.Errorf("unexpected leaf1: %+v", leaf)
+			}
+
+			after, err := client.Links(ctx, "")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			diff := before.Diff(after)
+			if !diff.Changed() || len(diff.Delinked) != 1 || diff.Delinked[0] != "leaf2.example.com" || len(diff.Linked)+len(diff.Moved) != 0 {
+				t.Errorf("expected leaf2 to be delinked; got %+v", diff)
+			}
+
+			tree, err := client.Map(ctx)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if diff := before.Diff(tree); diff.Changed() {
+				t.Errorf("expected MAP to match LINKS; got %+v", diff)
+			}
+			if leaf := tree.Server("leaf2.example.com"); leaf == nil || leaf.Hops != 2 || leaf.Info != "(4) 20%" {
+				t.Errorf("unexpected leaf2: %+v", leaf)
+			}
+		}()
+	})
+	if err := client.ConnectAndRun(ctx, h); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFloodControl(t *testing.T) {
+	parse := func(line string) *irc.Message {
+		m := new(irc.Message)
+		if err := m.UnmarshalText([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	// delays are measured from the time of each call, so they're compared with a margin
+	near := func(got, want time.Duration) bool {
+		return got >= want-time.Second && got <= want
+	}
+
+	p := &irc.PenaltyFlood{}
+	for i := 0; i < 6; i++ {
+		if d := p.Delay(irc.Msg("#a", "hi")); d != 0 {
+			t.Fatalf("PenaltyFlood: expected message %d of the burst to be sent immediately; got %s", i+1, d)
+		}
+	}
+	if d := p.Delay(irc.Msg("#a", "hi")); !near(d, 2*time.Second) {
+		t.Errorf("PenaltyFlood: expected the message after the burst to wait 2s; got %s", d)
+	}
+
+	f := &irc.TwitchFlood{}
+	for i := 0; i < 20; i++ {
+		if d := f.Delay(irc.Msg("#a", "hi")); d != 0 {
+			t.Fatalf("TwitchFlood: expected message %d to be sent immediately; got %s", i+1, d)
+		}
+	}
+	if d := f.Delay(irc.Msg("#a", "hi")); !near(d, 30*time.Second) {
+		t.Errorf("TwitchFlood: expected message 21 to wait for the window; got %s", d)
+	}
+	if d := f.Delay(irc.Join("#b")); d != 0 {
+		t.Errorf("TwitchFlood: expected JOIN not to count as a chat message; got %s", d)
+	}
+
+	// as a moderator, the limit is 100
+	f.Observe(parse("@badges=moderator/1;mod=1 :tmi.twitch.tv USERSTATE #b"))
+	if d := f.Delay(irc.Msg("#b", "hi")); d != 0 {
+		t.Errorf("TwitchFlood: expected a moderator's message to be sent immediately; got %s", d)
+	}
+
+	// slow mode applies per channel, but not to moderators
+	f = &irc.TwitchFlood{}
+	f.Observe(parse("@slow=10 :tmi.twitch.tv ROOMSTATE #c"))
+	f.Observe(parse("@emote-only=0 :tmi.twitch.tv ROOMSTATE #c"))
+	f.Observe(parse("@slow=10 :tmi.twitch.tv ROOMSTATE #d"))
+	f.Observe(parse("@badges=broadcaster/1;mod=0 :tmi.twitch.tv USERSTATE #d"))
+	f.Delay(irc.Msg("#c", "hi"))
+	if d := f.Delay(irc.Msg("#c", "hi")); !near(d, 10*time.Second) {
+		t.Errorf("TwitchFlood: expected slow mode to delay the second message by 10s; got %s", d)
+	}
+	f.Delay(irc.Msg("#d", "hi"))
+	if d := f.Delay(irc.Msg("#d", "hi")); d != 0 {
+		t.Errorf("TwitchFlood: expected slow mode not to apply to the broadcaster; got %s", d)
+	}
+}
+
+func TestSaveState(t *testing.T) {
+	store := irc.DirStore(t.TempDir())
+
+	// a restarted bot keeps the penalty timer of its flood control
+	p := &irc.PenaltyFlood{}
+	for i := 0; i < 6; i++ {
+		p.Delay(irc.Msg("#a", "hi"))
+	}
+	if err := irc.SaveState(store, "flood", p); err != nil {
+		t.Fatal(err)
+	}
+	restarted := &irc.PenaltyFlood{}
+	if err := irc.RestoreState(store, "flood", restarted); err != nil {
+		t.Fatal(err)
+	}
+	if d := restarted.Delay(irc.Msg("#a", "hi")); d < time.Second {
+		t.Errorf("expected the restored flood control to delay the message after the burst; got %s", d)
+	}
+
+	// and the cooldowns of its router
+	r := &irc.Router{}
+	r.OnCommand("!roll", func(irc.MessageWriter, *irc.Message) {})
+	r.SetOverlay("#dice", irc.ChannelOverlay{Cooldowns: map[string]time.Duration{"!roll": time.Hour}})
+	r.SpeakIRC(irctest.Discard, irc.Msg("#dice", "!roll"))
+	if err := irc.SaveState(store, "router", r); err != nil {
+		t.Fatal(err)
+	}
+	var ran bool
+	r = &irc.Router{}
+	r.OnCommand("!roll", func(irc.MessageWriter, *irc.Message) { ran = true })
+	r.SetOverlay("#dice", irc.ChannelOverlay{Cooldowns: map[string]time.Duration{"!roll": time.Hour}})
+	if err := irc.RestoreState(store, "router", r); err != nil {
+		t.Fatal(err)
+	}
+	r.SpeakIRC(irctest.Discard, irc.Msg("#dice", "!roll"))
+	if ran {
+		t.Error("expected the restored router to keep the cooldown of !roll")
+	}
+
+	// nothing saved is not an error
+	if err := irc.RestoreState(store, "missing", &irc.PenaltyFlood{}); err != nil {
+		t.Errorf("expected no error for a key which was never saved; got %v", err)
+	}
+	if _, err := store.Load("../flood"); err == nil {
+		t.Error("expected keys which aren't file names to be refused")
+	}
+}
+
+func TestClient_twitchFlood(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var sent []time.Time
+	clientConn, serverConn := irc.Pipe()
+	go func() {
+		defer serverConn.Close()
+		scanner := bufio.NewScanner(serverConn)
+		for scanner.Scan() {
+			m := new(irc.Message)
+			if err := m.UnmarshalText(scanner.Bytes()); err != nil {
+				continue
+			}
+			switch m.Command {
+			case irc.CmdUser:
+				fmt.Fprintf(serverConn, ":tmi.twitch.tv 001 bot :Welcome, GLHF!\r\n")
+				fmt.Fprintf(serverConn, "@slow=1 :tmi.twitch.tv ROOMSTATE #chan\r\n")
+			case irc.CmdPrivmsg:
+				sent = append(sent, time.Now())
+				if len(sent) == 2 {
+					fmt.Fprintf(serverConn, "ERROR :done\r\n")
+					return
+				}
+			}
+		}
+	}()
+
+	client := &irc.Client{Nickname: "bot", ErrorLog: log.New(io.Discard, "", 0)}
+	client.DialFn = func() (io.ReadWriteCloser, error) { return clientConn, nil }
+	h := irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+		if m.Command == "ROOMSTATE" {
+			w.WriteMessage(irc.Msg("#chan", "one"))
+			w.WriteMessage(irc.Msg("#chan", "two"))
+		}
+	})
+	_ = client.ConnectAndRun(ctx, h)
+	if len(sent) != 2 {
+		t.Fatalf("expected 2 messages; got %d", len(sent))
+	}
+	if d := sent[1].Sub(sent[0]); d < 900*time.Millisecond {
+		t.Errorf("expected the client to follow the channel's slow mode on Twitch; messages were %s apart", d)
+	}
+}
+
+func TestClient_slowHandler(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	clientConn, serverConn := irc.Pipe()
+	go func() {
+		defer serverConn.Close()
+		scanner := bufio.NewScanner(serverConn)
+		for scanner.Scan() {
+			m := new(irc.Message)
+			if err := m.UnmarshalText(scanner.Bytes()); err != nil {
+				continue
+			}
+			if m.Command == irc.CmdUser {
+				fmt.Fprintf(serverConn, ":irc.example.com 001 bot :Welcome bot!bot@example.com\r\n")
+				fmt.Fprintf(serverConn, ":alice!a@host PRIVMSG #chan :!report\r\n")
+				fmt.Fprintf(serverConn, ":alice!a@host PRIVMSG #chan :hi\r\n")
+			}
+			if m.Command == irc.CmdQuit {
+				return
+			}
+		}
+	}()
+
+	var slow []irc.SlowDispatch
+	client := &irc.Client{
+		Nickname:      "bot",
+		SlowHandler:   20 * time.Millisecond,
+		OnSlowHandler: func(sd irc.SlowDispatch) { slow = append(slow, sd) },
+	}
+	client.DialFn = func() (io.ReadWriteCloser, error) { return clientConn, nil }
+	r := &irc.Router{}
+	r.OnText("!report", func(w irc.MessageWriter, m *irc.Message) {
+		time.Sleep(50 * time.Millisecond)
+	}).Name("report")
+	r.OnText("*", func(w irc.MessageWriter, m *irc.Message) { cancel() })
+	_ = client.ConnectAndRun(ctx, r)
+
+	if len(slow) != 1 {
+		t.Fatalf("expected 1 slow handler; got %v", slow)
+	}
+	if sd := slow[0]; sd.Command != irc.CmdPrivmsg || sd.Route != "report" || sd.Duration < 50*time.Millisecond {
+		t.Errorf("expected the report route to be reported; got %+v", sd)
+	}
+	if !strings.Contains(slow[0].Error(), `in route "report"`) {
+		t.Errorf("expected the warning to name the route; got %q", slow[0].Error())
+	}
+	stats := client.DispatchStats()
+	if stats.Dispatched < 3 || stats.Slow != 1 || stats.MaxDuration < 50*time.Millisecond {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestClient_Audit(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	clientConn, serverConn := irc.Pipe()
+	go func() {
+		defer serverConn.Close()
+		scanner := bufio.NewScanner(serverConn)
+		for scanner.Scan() {
+			m := new(irc.Message)
+			if err := m.UnmarshalText(scanner.Bytes()); err != nil {
+				continue
+			}
+			if m.Command == irc.CmdUser {
+				fmt.Fprintf(serverConn, ":irc.example.com 001 bot :Welcome bot!bot@example.com\r\n")
+				fmt.Fprintf(serverConn, ":alice!a@host PRIVMSG #chan :!dice\r\n")
+			}
+			if m.Command == irc.CmdPrivmsg {
+				return
+			}
+		}
+	}()
+
+	var (
+		mu      sync.Mutex
+		records []irc.AuditRecord
+	)
+	client := &irc.Client{
+		Nickname: "bot",
+		Audit: func(rec irc.AuditRecord) {
+			mu.Lock()
+			defer mu.Unlock()
+			records = append(records, rec)
+		},
+	}
+	client.DialFn = func() (io.ReadWriteCloser, error) { return clientConn, nil }
+	r := &irc.Router{}
+	r.OnText("!dice", func(w irc.MessageWriter, m *irc.Message) {
+		w.WriteMessage(irc.Msg("#chan", "4"))
+	}).Name("dice")
+	_ = client.ConnectAndRun(ctx, r)
+
+	mu.Lock()
+	defer mu.Unlock()
+	var nick, reply *irc.AuditRecord
+	for i, rec := range records {
+		m, _ := rec.Message.(*irc.Message)
+		switch {
+		case m == nil:
+		case m.Command == irc.CmdNick:
+			nick = &records[i]
+		case m.Command == irc.CmdPrivmsg:
+			reply = &records[i]
+		}
+	}
+	if nick == nil || nick.Cause != nil || nick.Route != "" {
+		t.Errorf("expected NICK to be audited without a cause; got %+v", nick)
+	}
+	if reply == nil || reply.Route != "dice" || reply.Cause == nil || reply.Cause.Params.Get(2) != "!dice" || reply.Err != nil {
+		t.Errorf("expected the reply to be attributed to the dice route; got %+v", reply)
+	}
+}
+
+func TestClient_Resolve(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	var whois []string
+	clientConn, serverConn := irc.Pipe()
+	go func() {
+		defer serverConn.Close()
+		scanner := bufio.NewScanner(serverConn)
+		for scanner.Scan() {
+			m := new(irc.Message)
+			if err := m.UnmarshalText(scanner.Bytes()); err != nil {
+				continue
+			}
+			switch m.Command {
+			case irc.CmdUser:
+				fmt.Fprintf(serverConn, ":irc.example.com 001 bot :Welcome bot!bot@example.com\r\n")
+				// extended-join
+				fmt.Fprintf(serverConn, ":bob!b@host JOIN #chan bobacct :Bob\r\n")
+			case irc.CmdWhoIs:
+				nick := m.Params.Get(1)
+				whois = append(whois, nick)
+				switch nick {
+				case "alice":
+					fmt.Fprintf(serverConn, ":irc.example.com 311 bot alice a host * :Alice\r\n")
+					fmt.Fprintf(serverConn, ":irc.example.com 330 bot alice aliceacct :is logged in as\r\n")
+				case "nobody":
+					fmt.Fprintf(serverConn, ":bob!b@host NICK robert\r\n")
+					fmt.Fprintf(serverConn, ":irc.example.com 401 bot nobody :No such nick/channel\r\n")
+				}
+				fmt.Fprintf(serverConn, ":irc.example.com 318 bot %s :End of /WHOIS list.\r\n", nick)
+			case irc.CmdQuit:
+				return
+			}
+		}
+	}()
+
+	var got []string
+	client := &irc.Client{Nickname: "bot"}
+	client.DialFn = func() (io.ReadWriteCloser, error) { return clientConn, nil }
+	h := irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+		if m.Command != irc.RplWelcome {
+			return
+		}
+		go func() {
+			defer cancel()
+			resolve := func(nick string) {
+				account, err := client.Resolve(ctx, nick)
+				switch {
+				case errors.Is(err, irc.ErrNoSuchNick):
+					got = append(got, nick+"=offline")
+				case err != nil:
+					got = append(got, nick+"="+err.Error())
+				default:
+					got = append(got, nick+"="+account)
+				}
+			}
+			resolve("alice")
+			resolve("Alice")
+			resolve("bob")
+			resolve("nobody")
+			resolve("robert")
+		}()
+	})
+	_ = client.ConnectAndRun(ctx, h)
+
+	want := "alice=aliceacct|Alice=aliceacct|bob=bobacct|nobody=offline|robert=bobacct"
+	if strings.Join(got, "|") != want {
+		t.Errorf("expected %q; got %q", want, strings.Join(got, "|"))
+	}
+	if strings.Join(whois, ",") != "alice,nobody" {
+		t.Errorf("expected WHOIS only for unknown users; got %q", whois)
+	}
+}
+
+func TestClient_Resolve_left(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	var whois []string
+	clientConn, serverConn := irc.Pipe()
+	go func() {
+		defer serverConn.Close()
+		scanner := bufio.NewScanner(serverConn)
+		for scanner.Scan() {
+			m := new(irc.Message)
+			if err := m.UnmarshalText(scanner.Bytes()); err != nil {
+				continue
+			}
+			switch m.Command {
+			case irc.CmdCap:
+				switch m.Params.Get(1) {
+				case "LS":
+					fmt.Fprintf(serverConn, ":irc.example.com CAP * LS :account-notify extended-join\r\n")
+				case "REQ":
+					fmt.Fprintf(serverConn, ":irc.example.com CAP bot ACK :%s\r\n", m.Params.Get(2))
+				case "END":
+					fmt.Fprintf(serverConn, ":irc.example.com 001 bot :Welcome bot!bot@example.com\r\n")
+					fmt.Fprintf(serverConn, ":bot!bot@example.com JOIN #a * :bot\r\n")
+					fmt.Fprintf(serverConn, ":bot!bot@example.com JOIN #b * :bot\r\n")
+					fmt.Fprintf(serverConn, ":bob!b@host JOIN #a bobacct :Bob\r\n")
+					fmt.Fprintf(serverConn, ":carol!c@host JOIN #a carolacct :Carol\r\n")
+					fmt.Fprintf(serverConn, ":carol!c@host JOIN #b carolacct :Carol\r\n")
+					fmt.Fprintf(serverConn, ":dave[]!d@host JOIN #a daveacct :Dave\r\n")
+					// bob leaves the only channel shared with the client, and carol still shares #b
+					fmt.Fprintf(serverConn, ":bob!b@host PART #a\r\n")
+					fmt.Fprintf(serverConn, ":carol!c@host PART #a\r\n")
+					fmt.Fprintf(serverConn, ":irc.example.com NOTICE bot :parted\r\n")
+				}
+			case irc.CmdPart:
+				fmt.Fprintf(serverConn, ":bot!bot@example.com PART %s\r\n", m.Params.Get(1))
+				fmt.Fprintf(serverConn, ":irc.example.com NOTICE bot :left\r\n")
+			case irc.CmdWhoIs:
+				nick := m.Params.Get(1)
+				whois = append(whois, nick)
+				fmt.Fprintf(serverConn, ":irc.example.com 330 bot %s newacct :is logged in as\r\n", nick)
+				fmt.Fprintf(serverConn, ":irc.example.com 318 bot %s :End of /WHOIS list.\r\n", nick)
+			case irc.CmdQuit:
+				return
+			}
+		}
+	}()
+
+	client := &irc.Client{Nickname: "bot", Caps: []string{"account-notify", "extended-join"}}
+	client.DialFn = func() (io.ReadWriteCloser, error) { return clientConn, nil }
+	var got []string
+	resolve := func(nick string) {
+		account, err := client.Resolve(ctx, nick)
+		if err != nil {
+			account = err.Error()
+		}
+		got = append(got, nick+"="+account)
+	}
+	h := irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+		if m.Command != irc.CmdNotice {
+			return
+		}
+		switch m.Params.Get(2) {
+		case "parted":
+			go func() {
+				resolve("bob")
+				resolve("Carol")
+				resolve("DAVE{}")
+				client.WriteMessage(irc.Part("#b"))
+			}()
+		case "left":
+			go func() {
+				defer cancel()
+				resolve("carol")
+			}()
+		}
+	})
+	_ = client.ConnectAndRun(ctx, h)
+
+	want := "bob=newacct|Carol=carolacct|DAVE{}=daveacct|carol=newacct"
+	if strings.Join(got, "|") != want {
+		t.Errorf("expected %q; got %q", want, strings.Join(got, "|"))
+	}
+	if strings.Join(whois, ",") != "bob,carol" {
+		t.Errorf("expected WHOIS for the users who left every channel shared with the client; got %q", whois)
+	}
+}
+
+func TestClient_WriteMessageE(t *testing.T) {
+	client := &irc.Client{Nickname: "bot", ErrorLog: log.New(io.Discard, "", 0)}
+	if err := client.WriteMessageE(irc.Msg("#chan", "hi")); !errors.Is(err, irc.ErrNotConnected) {
+		t.Errorf("expected ErrNotConnected before connecting; got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	clientConn, serverConn := irc.Pipe()
+	go func() {
+		defer serverConn.Close()
+		scanner := bufio.NewScanner(serverConn)
+		for scanner.Scan() {
+			if strings.HasPrefix(scanner.Text(), "USER") {
+				fmt.Fprintf(serverConn, ":irc.example.com 001 bot :Welcome bot!bot@example.com\r\n")
+			}
+			if strings.HasPrefix(scanner.Text(), "QUIT") {
+				return
+			}
+		}
+	}()
+	client.DialFn = func() (io.ReadWriteCloser, error) { return clientConn, nil }
+	var errs []error
+	h := irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+		if m.Command != irc.RplWelcome {
+			return
+		}
+		errs = append(errs, client.WriteMessageE(irc.Msg("#chan", "hi")))
+		errs = append(errs, client.WriteMessageE(irc.Msg("#chan", "bad\x00")))
+		cancel()
+	})
+	_ = client.ConnectAndRun(ctx, h)
+	if len(errs) != 2 || errs[0] != nil || errs[1] == nil {
+		t.Errorf("expected the first message to be written and the second to fail; got %v", errs)
+	}
+	if err := client.WriteMessageE(irc.Msg("#chan", "hi")); !errors.Is(err, irc.ErrNotConnected) {
+		t.Errorf("expected ErrNotConnected after disconnecting; got %v", err)
+	}
+}
+
+func TestClient_SendMessage(t *testing.T) {
+	for _, capability := range []string{"", "echo-message", "labeled-response"} {
+		t.Run(capability, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			clientConn, serverConn := irc.Pipe()
+			go func() {
+				defer serverConn.Close()
+				scanner := bufio.NewScanner(serverConn)
+				for scanner.Scan() {
+					m := new(irc.Message)
+					if err := m.UnmarshalText(scanner.Bytes()); err != nil {
+						continue
+					}
+					label := ""
+					if m.Tags.Has("label") {
+						label = "@label=" + m.Tags.Get("label") + " "
+					}
+					switch m.Command {
+					case irc.CmdCap:
+						switch m.Params.Get(1) {
+						case "LS":
+							fmt.Fprintf(serverConn, ":irc.example.com CAP * LS :%s\r\n", capability)
+						case "REQ":
+							fmt.Fprintf(serverConn, ":irc.example.com CAP bot ACK :%s\r\n", m.Params.Get(2))
+						}
+					case irc.CmdUser:
+						fmt.Fprintf(serverConn, ":irc.example.com 001 bot :Welcome bot!bot@example.com\r\n")
+					case irc.CmdPing:
+						fmt.Fprintf(serverConn, ":irc.example.com PONG irc.example.com :%s\r\n", m.Params.Get(1))
+					case irc.CmdPrivmsg:
+						switch {
+						case m.Params.Get(1) == "#banned":
+							fmt.Fprintf(serverConn, "%s:irc.example.com 404 bot #banned :Cannot send to channel\r\n", label)
+						case capability == "echo-message":
+							fmt.Fprintf(serverConn, ":bot!bot@example.com PRIVMSG %s :%s\r\n", m.Params.Get(1), m.Params.Get(2))
+						case label != "":
+							fmt.Fprintf(serverConn, "%s:irc.example.com ACK\r\n", label)
+						}
+					case irc.CmdQuit:
+						return
+					}
+				}
+			}()
+
+			var got []error
+			client := &irc.Client{Nickname: "bot"}
+			if capability != "" {
+				client.Caps = []string{capability}
+			}
+			client.DialFn = func() (io.ReadWriteCloser, error) { return clientConn, nil }
+			h := irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+				if m.Command != irc.RplWelcome {
+					return
+				}
+				go func() {
+					defer cancel()
+					got = append(got, client.SendMessage(ctx, irc.Msg("#ok", "hello")))
+					got = append(got, client.SendMessage(ctx, irc.Msg("#banned", "hello")))
+				}()
+			})
+			_ = client.ConnectAndRun(ctx, h)
+
+			if len(got) != 2 {
+				t.Fatalf("expected 2 results; got %v", got)
+			}
+			if got[0] != nil {
+				t.Errorf("expected the message to #ok to be delivered; got %v", got[0])
+			}
+			if !errors.Is(got[1], irc.ErrNotDelivered) || !strings.Contains(got[1].Error(), "Cannot send to channel") {
+				t.Errorf("expected the message to #banned to be rejected; got %v", got[1])
+			}
+		})
+	}
+}
+
+func TestClient_CTCP(t *testing.T) {
+	lines := []string{
+		"\x01ACTION waves\x01",
+		"\x01ACTION waves",
+		"hey \x01ACTION waves\x01 there",
+	}
+	for _, tc := range []struct {
+		mode irc.CTCPParsing
+		want string // whether each line was recognized as an ACTION
+	}{
+		{irc.CTCPLenient, "yes yes no"},
+		{irc.CTCPStrict, "yes no no"},
+		{irc.CTCPEmbedded, "yes yes yes"},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		var replies []string
+		clientConn, serverConn := irc.Pipe()
+		serverDone := make(chan struct{})
+		go func() {
+			defer close(serverDone)
+			defer serverConn.Close()
+			scanner := bufio.NewScanner(serverConn)
+			for scanner.Scan() {
+				m := new(irc.Message)
+				if err := m.UnmarshalText(scanner.Bytes()); err != nil {
+					continue
+				}
+				switch m.Command {
+				case irc.CmdUser:
+					fmt.Fprintf(serverConn, ":irc.example.com 001 bot :Welcome bot!bot@example.com\r\n")
+					for _, query := range []string{"FINGER", "SOURCE", "CLIENTINFO", "PING 123", "USERINFO"} {
+						fmt.Fprintf(serverConn, ":alice!a@host PRIVMSG bot :\x01%s\x01\r\n", query)
+					}
+					for _, line := range lines {
+						fmt.Fprintf(serverConn, ":alice!a@host PRIVMSG #chan :%s\r\n", line)
+					}
+					fmt.Fprintf(serverConn, ":alice!a@host PRIVMSG #chan :done\r\n")
+				case irc.CmdNotice:
+					replies = append(replies, strings.Trim(m.Params.Get(2), "\x01"))
+				case irc.CmdQuit:
+					return
+				}
+			}
+		}()
+
+		var got []string
+		client := &irc.Client{
+			Nickname:    "bot",
+			CTCPParsing: tc.mode,
+			CTCP:        &irc.CTCPResponder{Finger: "Bot Owner", Source: "https://example.com/bot"},
+		}
+		client.DialFn = func() (io.ReadWriteCloser, error) { return clientConn, nil }
+		h := irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+			switch {
+			case m.Command == irc.CTCPAction:
+				got = append(got, "yes")
+			case m.Command == irc.CmdPrivmsg && m.Params.Get(2) == "done":
+				cancel()
+			case m.Command == irc.CmdPrivmsg && m.Params.Get(1) == "#chan":
+				got = append(got, "no")
+			}
+		})
+		_ = client.ConnectAndRun(ctx, h)
+		cancel()
+		<-serverDone
+
+		if strings.Join(got, " ") != tc.want {
+			t.Errorf("mode %d: expected ACTIONs %q; got %q", tc.mode, tc.want, strings.Join(got, " "))
+		}
+		want := "FINGER Bot Owner|SOURCE https://example.com/bot|CLIENTINFO ACTION CLIENTINFO FINGER PING SOURCE TIME|PING 123"
+		if strings.Join(replies, "|") != want {
+			t.Errorf("mode %d: expected replies %q; got %q", tc.mode, want, strings.Join(replies, "|"))
+		}
+	}
+}
+
+func TestClient_WhoRefresh(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	var who []string
+	clientConn, serverConn := irc.Pipe()
+	go func() {
+		defer serverConn.Close()
+		scanner := bufio.NewScanner(serverConn)
+		for scanner.Scan() {
+			m := new(irc.Message)
+			if err := m.UnmarshalText(scanner.Bytes()); err != nil {
+				continue
+			}
+			switch m.Command {
+			case irc.CmdUser:
+				fmt.Fprintf(serverConn, ":irc.example.com 001 bot :Welcome bot!bot@example.com\r\n")
+				fmt.Fprintf(serverConn, ":irc.example.com 005 bot PREFIX=(ov)@+ WHOX :are supported by this server\r\n")
+				fmt.Fprintf(serverConn, ":bot!bot@example.com JOIN #chan\r\n")
+				fmt.Fprintf(serverConn, ":irc.example.com 353 bot = #chan :@bot alice +bob\r\n")
+				fmt.Fprintf(serverConn, ":irc.example.com 366 bot #chan :End of /NAMES list.\r\n")
+				fmt.Fprintf(serverConn, ":dave!d@host JOIN #chan\r\n")
+			case irc.CmdWho:
+				who = append(who, strings.Join(m.Params, " "))
+				// bob and dave left during a netsplit, carol joined, and alice was opped
+				fmt.Fprintf(serverConn, ":irc.example.com 354 bot 135 #chan bot example.com bot H@ 0\r\n")
+				fmt.Fprintf(serverConn, ":irc.example.com 354 bot 135 #chan a host alice H@ aliceacct\r\n")
+				fmt.Fprintf(serverConn, ":irc.example.com 354 bot 135 #chan c host carol G 0\r\n")
+				fmt.Fprintf(serverConn, ":irc.example.com 315 bot #chan :End of /WHO list.\r\n")
+			case irc.CmdQuit:
+				return
+			}
+		}
+	}()
+
+	var drift irc.StateDrift
+	var members []irc.Member
+	client := &irc.Client{Nickname: "bot", WhoRefresh: 50 * time.Millisecond}
+	client.DialFn = func() (io.ReadWriteCloser, error) { return clientConn, nil }
+	client.OnStateDrift = func(d irc.StateDrift) {
+		drift = d
+		members = client.Members("#CHAN")
+		cancel()
+	}
+	_ = client.ConnectAndRun(ctx, nil)
+
+	if len(who) != 1 || who[0] != "#chan %tcuhnfa,135" {
+		t.Errorf("expected one WHOX query; got %q", who)
+	}
+	want := irc.StateDrift{
+		Channel: "#chan",
+		Joined:  []irc.Nickname{"carol"},
+		Parted:  []irc.Nickname{"bob", "dave"},
+		Changed: []irc.Nickname{"alice"},
+	}
+	if !reflect.DeepEqual(drift, want) {
+		t.Errorf("expected drift %+v; got %+v", want, drift)
+	}
+	wantMembers := []irc.Member{
+		{Nick: "alice", User: "a", Host: "host", Account: "aliceacct", Prefixes: "@"},
+		{Nick: "bot", User: "bot", Host: "example.com", Prefixes: "@"},
+		{Nick: "carol", User: "c", Host: "host", Away: true},
+	}
+	if !reflect.DeepEqual(members, wantMembers) {
+		t.Errorf("expected members %+v; got %+v", wantMembers, members)
+	}
+	if got := client.Channels(); !reflect.DeepEqual(got, []string{"#chan"}) {
+		t.Errorf("expected to be on #chan; got %q", got)
+	}
+}
+
+func TestClient_Members_casemapping(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	clientConn, serverConn := irc.Pipe()
+	go func() {
+		defer serverConn.Close()
+		scanner := bufio.NewScanner(serverConn)
+		for scanner.Scan() {
+			switch {
+			case strings.HasPrefix(scanner.Text(), "USER"):
+				fmt.Fprintf(serverConn, ":irc.example.com 001 bot :Welcome bot!bot@example.com\r\n")
+				fmt.Fprintf(serverConn, ":irc.example.com 005 bot CASEMAPPING=rfc1459 :are supported by this server\r\n")
+				fmt.Fprintf(serverConn, ":bot!bot@example.com JOIN #Chan[1]\r\n")
+				fmt.Fprintf(serverConn, ":irc.example.com 353 bot = #Chan[1] :bot dave[] alice\r\n")
+				fmt.Fprintf(serverConn, ":irc.example.com 366 bot #Chan[1] :End of /NAMES list.\r\n")
+				// the server spells the names differently, but they're the same with rfc1459
+				fmt.Fprintf(serverConn, ":DAVE{}!d@host PART #chan{1}\r\n")
+				fmt.Fprintf(serverConn, ":irc.example.com MODE #CHAN{1} +o ALICE\r\n")
+				fmt.Fprintf(serverConn, ":irc.example.com NOTICE bot :done\r\n")
+			case strings.HasPrefix(scanner.Text(), "QUIT"):
+				return
+			}
+		}
+	}()
+
+	var members []irc.Member
+	client := &irc.Client{Nickname: "bot"}
+	client.DialFn = func() (io.ReadWriteCloser, error) { return clientConn, nil }
+	_ = client.ConnectAndRun(ctx, irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+		if m.Command == irc.CmdNotice && m.Params.Get(2) == "done" {
+			members = client.Members("#chan{1}")
+			cancel()
+		}
+	}))
+
+	want := []irc.Member{
+		{Nick: "alice", Prefixes: "@"},
+		{Nick: "bot", User: "bot", Host: "example.com"},
+	}
+	if !reflect.DeepEqual(members, want) {
+		t.Errorf("expected members %+v; got %+v", want, members)
+	}
+}
+
+func TestClient_memberHosts(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	var who, caps []string
+	clientConn, serverConn := irc.Pipe()
+	go func() {
+		defer serverConn.Close()
+		scanner := bufio.NewScanner(serverConn)
+		for scanner.Scan() {
+			m := new(irc.Message)
+			if err := m.UnmarshalText(scanner.Bytes()); err != nil {
+				continue
+			}
+			switch m.Command {
+			case irc.CmdCap:
+				switch m.Params.Get(1) {
+				case "LS":
+					fmt.Fprintf(serverConn, ":irc.example.com CAP * LS :userhost-in-names\r\n")
+				case "REQ":
+					caps = append(caps, m.Params.Get(2))
+					fmt.Fprintf(serverConn, ":irc.example.com CAP * NAK :%s\r\n", m.Params.Get(2))
+				}
+			case irc.CmdUser:
+				// no userhost-in-names: the names have no hosts
+				fmt.Fprintf(serverConn, ":irc.example.com 001 bot :Welcome bot!bot@example.com\r\n")
+				fmt.Fprintf(serverConn, ":bot!bot@example.com JOIN #chan\r\n")
+				fmt.Fprintf(serverConn, ":irc.example.com 353 bot = #chan :@bot alice\r\n")
+				fmt.Fprintf(serverConn, ":irc.example.com 366 bot #chan :End of /NAMES list.\r\n")
+				fmt.Fprintf(serverConn, ":alice!a@host.example PRIVMSG #chan :hello\r\n")
+			case irc.CmdPrivmsg:
+				who = append(who, "PRIVMSG")
+			case irc.CmdWho:
+				who = append(who, strings.Join(m.Params, " "))
+				fmt.Fprintf(serverConn, ":irc.example.com 352 bot #chan bot example.com irc.example.com bot H@ :0 Bot\r\n")
+				fmt.Fprintf(serverConn, ":irc.example.com 352 bot #chan a host.example irc.example.com alice H :0 Alice\r\n")
+				fmt.Fprintf(serverConn, ":irc.example.com 315 bot #chan :End of /WHO list.\r\n")
+			case irc.CmdQuit:
+				return
+			}
+		}
+	}()
+
+	var members []irc.Member
+	client := &irc.Client{Nickname: "bot"}
+	client.DialFn = func() (io.ReadWriteCloser, error) { return clientConn, nil }
+	h := irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+		switch m.Command {
+		case irc.CmdPrivmsg:
+			// the WHO waits until the members are asked for, and is sent once
+			w.WriteMessage(irc.Msg("#chan", "hi"))
+			client.Members("#chan")
+			client.Members("#chan")
+		case irc.RplEndOfWho:
+			members = client.Members("#chan")
+			cancel()
+		}
+	})
+	_ = client.ConnectAndRun(ctx, h)
+
+	if len(caps) != 0 {
+		t.Errorf("expected userhost-in-names not to be requested unless it's in Caps; got %q", caps)
+	}
+	if want := []string{"PRIVMSG", "#chan"}; !reflect.DeepEqual(who, want) {
+		t.Errorf("expected one WHO for the hosts of the members, sent when they're asked for; got %q", who)
+	}
+	if len(members) != 2 || members[0].Prefix() != (irc.Prefix{Nick: "alice", User: "a", Host: "host.example"}) {
+		t.Fatalf("expected the hosts of the members to be learned from WHO; got %+v", members)
+	}
+	if mask := irc.Mask(members[0].Prefix(), irc.MaskHost); mask != "*!*@host.example" {
+		t.Errorf("expected a ban mask for alice's host; got %q", mask)
+	}
+}
+
+func TestClient_Channel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	var joins []string
+	clientConn, serverConn := irc.Pipe()
+	go func() {
+		defer serverConn.Close()
+		scanner := bufio.NewScanner(serverConn)
+		for scanner.Scan() {
+			m := new(irc.Message)
+			if err := m.UnmarshalText(scanner.Bytes()); err != nil {
+				continue
+			}
+			switch m.Command {
+			case irc.CmdUser:
+				fmt.Fprintf(serverConn, ":irc.example.com 001 bot :Welcome bot!bot@example.com\r\n")
+				fmt.Fprintf(serverConn, ":irc.example.com 005 bot PREFIX=(ov)@+ CHANMODES=beI,k,l,imnpst :are supported by this server\r\n")
+			case irc.CmdJoin:
+				joins = append(joins, strings.Join(m.Params, " "))
+				if len(joins) > 1 {
+					cancel()
+					return
+				}
+				// the server folds the channel name differently than it was joined with, as rfc1459 allows
+				fmt.Fprintf(serverConn, ":bot!bot@example.com JOIN #chan{1}\r\n")
+				fmt.Fprintf(serverConn, ":irc.example.com 324 bot #chan{1} +nt\r\n")
+				fmt.Fprintf(serverConn, ":irc.example.com 329 bot #chan{1} 1600000000\r\n")
+				fmt.Fprintf(serverConn, ":alice!a@host MODE #chan{1}\r\n")
+				fmt.Fprintf(serverConn, ":w[m]!w@host JOIN #chan{1}\r\n")
+				fmt.Fprintf(serverConn, ":alice!a@host MODE #chan{1} +ool-n+bi bot w[m] 10 *!*@spam\r\n")
+				fmt.Fprintf(serverConn, ":alice!a@host MODE #chan{1} -k+k oldkey newkey\r\n")
+				fmt.Fprintf(serverConn, ":alice!a@host KICK #CHAN[1] bot :bye\r\n")
+			}
+		}
+	}()
+
+	var ch irc.Channel
+	client := &irc.Client{Nickname: "bot", AutoJoin: []string{"#chan[1] oldkey"}, RejoinOnKick: true, RejoinDelay: time.Millisecond}
+	client.DialFn = func() (io.ReadWriteCloser, error) { return clientConn, nil }
+	h := irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+		if m.Command == irc.CmdMode && m.Params.Get(2) == "-k+k" {
+			ch, _ = client.Channel("#CHAN[1]")
+		}
+	})
+	_ = client.ConnectAndRun(ctx, h)
+
+	if ch.Name != "#chan{1}" || ch.Modes() != "iklt" || ch.Key() != "newkey" || ch.Limit() != 10 {
+		t.Errorf("expected #chan{1} with modes iklt, key newkey, and limit 10; got %q %q %q %d", ch.Name, ch.Modes(), ch.Key(), ch.Limit())
+	}
+	if !ch.IsOp("BOT") || !ch.IsOp("W[M]") || ch.IsOp("alice") {
+		t.Errorf("expected the client and w[m] to be channel operators after +o, and alice not to be")
+	}
+	if !ch.Created.Equal(time.Unix(1600000000, 0)) {
+		t.Errorf("expected the creation time from RPL_CREATIONTIME; got %s", ch.Created)
+	}
+	if want := []string{"#chan[1] oldkey", "#CHAN[1] newkey"}; !reflect.DeepEqual(joins, want) {
+		t.Errorf("expected to rejoin with the new key after the kick; got %q", joins)
+	}
+	if _, ok := client.Channel("#chan{1}"); ok {
+		t.Error("expected the client not to be on #chan after the kick")
+	}
+}
+
+func TestClient_RejoinOnKick_limit(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	joins := 0
+	serverDone := make(chan struct{})
+	clientConn, serverConn := irc.Pipe()
+	go func() {
+		defer close(serverDone)
+		defer serverConn.Close()
+		scanner := bufio.NewScanner(serverConn)
+		for scanner.Scan() {
+			m := new(irc.Message)
+			if err := m.UnmarshalText(scanner.Bytes()); err != nil {
+				continue
+			}
+			switch m.Command {
+			case irc.CmdUser:
+				fmt.Fprintf(serverConn, ":irc.example.com 001 bot :Welcome bot!bot@example.com\r\n")
+			case irc.CmdJoin:
+				// the channel kicks the client on sight
+				joins++
+				fmt.Fprintf(serverConn, ":bot!bot@example.com JOIN #chan\r\n")
+				fmt.Fprintf(serverConn, ":alice!a@host KICK #chan bot :go away\r\n")
+				fmt.Fprintf(serverConn, "PING :%d\r\n", joins)
+			case irc.CmdPong:
+				if m.Params.Get(1) == "4" {
+					// give a fifth JOIN the time to arrive
+					time.Sleep(50 * time.Millisecond)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	var errs bytes.Buffer
+	client := &irc.Client{
+		Nickname:     "bot",
+		AutoJoin:     []string{"#chan"},
+		RejoinOnKick: true,
+		RejoinDelay:  time.Millisecond,
+		ErrorLog:     log.New(&errs, "", 0),
+	}
+	client.DialFn = func() (io.ReadWriteCloser, error) { return clientConn, nil }
+	_ = client.ConnectAndRun(ctx, irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {}))
+	<-serverDone
+
+	if joins != 4 {
+		t.Errorf("expected the first JOIN and 3 rejoins; got %d JOINs", joins)
+	}
+	if !strings.Contains(errs.String(), "not rejoining #chan") {
+		t.Errorf("expected the client to report that it gave up on #chan; got %q", errs.String())
+	}
+}
+
+// delayNotices is a FloodControl which delays every NOTICE.
+type delayNotices time.Duration
+
+func (d delayNotices) Delay(m *irc.Message) time.Duration {
+	if m.Command == irc.CmdNotice {
+		return time.Duration(d)
+	}
+	return 0
+}
+
+func TestClient_Shutdown(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	var lines []string
+	serverDone := make(chan struct{})
+	clientConn, serverConn := irc.Pipe()
+	go func() {
+		defer close(serverDone)
+		defer serverConn.Close()
+		scanner := bufio.NewScanner(serverConn)
+		for scanner.Scan() {
+			m := new(irc.Message)
+			if err := m.UnmarshalText(scanner.Bytes()); err != nil {
+				continue
+			}
+			switch m.Command {
+			case irc.CmdUser:
+				fmt.Fprintf(serverConn, ":irc.example.com 001 bot :Welcome bot!bot@example.com\r\n")
+			case irc.CmdJoin, irc.CmdPrivmsg, irc.CmdNotice:
+				// the JOIN is never confirmed
+				lines = append(lines, scanner.Text())
+			case irc.CmdQuit:
+				lines = append(lines, scanner.Text())
+				return
+			}
+		}
+	}()
+
+	var errorLog bytes.Buffer
+	client := &irc.Client{Nickname: "bot", FloodControl: delayNotices(50 * time.Millisecond), QuitMessage: "upgrading to v2.3", ErrorLog: log.New(&errorLog, "", 0)}
+	client.DialFn = func() (io.ReadWriteCloser, error) { return clientConn, nil }
+	client.OnShutdown = func(w irc.MessageWriter) {
+		w.WriteMessage(irc.Notice("alice", "goodbye"))
+	}
+	shutdown := make(chan error, 1)
+	h := irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+		if m.Command != irc.RplWelcome {
+			return
+		}
+		w.WriteMessage(irc.Join("#chan"))
+		w.WriteMessage(irc.Msg("#chan", "held"))
+		go func() {
+			go client.WriteMessage(irc.Notice("alice", "delayed"))
+			time.Sleep(10 * time.Millisecond)
+			shutdown <- client.Shutdown(ctx)
+		}()
+	})
+	if err := client.ConnectAndRun(context.Background(), h); err != nil {
+		t.Errorf("expected ConnectAndRun to return nil after Shutdown; got %v", err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+	<-serverDone
+
+	if len(lines) != 4 || lines[0] != "JOIN :#chan" || lines[3] != "QUIT :upgrading to v2.3" {
+		t.Errorf("expected the delayed messages before QUIT, without the held one; got %q", lines)
+	}
+	if !strings.Contains(errorLog.String(), "dropped 1 messages to #chan") {
+		t.Errorf("expected the held message to be dropped; got %q", errorLog.String())
+	}
+	if err := client.Shutdown(ctx); !errors.Is(err, irc.ErrNotConnected) {
+		t.Errorf("expected ErrNotConnected after the connection closed; got %v", err)
+	}
+}
+
+func TestNewClient(t *testing.T) {
+	flood := &irc.PenaltyFlood{}
+	logger := log.New(io.Discard, "", 0)
+	client := irc.NewClient(
+		irc.WithAddr("irc.example.com:6697"),
+		irc.WithNick("bot"),
+		irc.WithTLSConfig(&tls.Config{ServerName: "example.com"}),
+		irc.WithSASL(irc.SASLExternal()),
+		irc.WithReconnect(irc.Backoff{Min: time.Second}),
+		irc.WithRateLimit(flood),
+		irc.WithLogger(logger),
+		irc.WithCaps("message-tags"),
+		irc.WithCaps("server-time"),
+	)
+	if client.Addr != "irc.example.com:6697" || client.Nickname != "bot" ||
+		client.TLSConfig.ServerName != "example.com" || client.SASL == nil ||
+		client.Reconnect == nil || client.Reconnect.Min != time.Second ||
+		client.FloodControl != flood || client.ErrorLog != logger ||
+		!reflect.DeepEqual(client.Caps, []string{"message-tags", "server-time"}) {
+		t.Errorf("expected the options to be applied; got %+v", client)
+	}
+}
+
+func TestClient_Run(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	dials := 0
+	client := &irc.Client{
+		Nickname:  "bot",
+		Reconnect: &irc.Backoff{Min: time.Millisecond, Max: 4 * time.Millisecond},
+		ErrorLog:  log.New(io.Discard, "", 0),
+	}
+	client.DialFn = func() (io.ReadWriteCloser, error) {
+		dials++
+		if dials < 3 {
+			return nil, errors.New("connection refused")
+		}
+		clientConn, serverConn := irc.Pipe()
+		go func() {
+			defer serverConn.Close()
+			scanner := bufio.NewScanner(serverConn)
+			for scanner.Scan() {
+				if strings.HasPrefix(scanner.Text(), "USER") {
+					fmt.Fprintf(serverConn, "ERROR :Closing Link: bot[1.2.3.4] (K-Lined: spamming)\r\n")
+					return
+				}
+			}
+		}()
+		return clientConn, nil
+	}
+	// the state of each connection may be read from other goroutines while Run reconnects
+	polling := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-polling:
+				return
+			default:
+				client.CapEnabled("sasl")
+			}
+		}
+	}()
+	err := client.Run(ctx, nil)
+	close(polling)
+
+	var disconnect *irc.DisconnectError
+	if !errors.As(err, &disconnect) || disconnect.Cause != irc.CauseBanned {
+		t.Errorf("expected Run to stop after a ban; got %v", err)
+	}
+	if dials != 3 {
+		t.Errorf("expected 3 connection attempts; got %d", dials)
+	}
+}
+
+func TestClient_Perform(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	var lines []string
+	clientConn, serverConn := irc.Pipe()
+	go func() {
+		defer serverConn.Close()
+		scanner := bufio.NewScanner(serverConn)
+		for scanner.Scan() {
+			m := new(irc.Message)
+			if err := m.UnmarshalText(scanner.Bytes()); err != nil {
+				continue
+			}
+			switch m.Command {
+			case irc.CmdUser:
+				fmt.Fprintf(serverConn, ":irc.example.com 001 bot :Welcome bot!bot@example.com\r\n")
+			case irc.CmdMode, irc.CmdWhoIs:
+				lines = append(lines, scanner.Text())
+			case irc.CmdOper:
+				lines = append(lines, scanner.Text())
+				// the reply is late, so a JOIN written before it would be recorded first
+				time.Sleep(20 * time.Millisecond)
+				lines = append(lines, "381")
+				fmt.Fprintf(serverConn, ":irc.example.com 381 bot :You are now an IRC operator\r\n")
+			case irc.CmdJoin:
+				lines = append(lines, scanner.Text())
+				cancel()
+			case irc.CmdQuit:
+				return
+			}
+		}
+	}()
+
+	var logged bytes.Buffer
+	client := &irc.Client{
+		Nickname: "bot",
+		AutoJoin: []string{"#chan"},
+		ErrorLog: log.New(&logged, "", 0),
+		Perform: []irc.PerformItem{
+			irc.PerformLine("MODE bot +x"),
+			{Message: irc.Oper("bot", "hunter2"), WaitFor: irc.WaitForCommand(irc.RplYoureOper, irc.RplErrPasswdMismatch)},
+			// never answered
+			{Message: irc.NewMessage(irc.CmdWhoIs, "bot"), WaitFor: irc.WaitForCommand(irc.RplEndOfWhoIs), Timeout: 10 * time.Millisecond},
+		},
+	}
+	client.DialFn = func() (io.ReadWriteCloser, error) { return clientConn, nil }
+	_ = client.ConnectAndRun(ctx, nil)
+
+	want := []string{"MODE bot +x", "OPER bot :hunter2", "381", "WHOIS :bot", "JOIN :#chan"}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("expected the perform list in order, followed by AutoJoin\nwant: %q\n got: %q", want, lines)
+	}
+	if !strings.Contains(logged.String(), irc.ErrPerformTimeout.Error()+" after item 2") {
+		t.Errorf("expected the timeout of the WHOIS to be logged; got %q", logged.String())
+	}
+}
+
+func TestClient_TagLimits(t *testing.T) {
+	client, server, done := setup()
+	defer done()
+	var logged bytes.Buffer
+	client.ErrorLog = log.New(&logged, "", 0)
+	client.TagLimits = irc.TagLimits{ClientData: 100}
+
+	var sent []string
+	server.Handler = irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+		switch m.Command {
+		case irc.CmdUser:
+			server.WriteString(":irc.example.com 001 bot :Welcome")
+		case irc.CmdTagMsg:
+			sent = append(sent, m.Tags["+data"])
+			if len(sent) == 2 {
+				done()
+			}
+		}
+	})
+	_ = client.ConnectAndRun(context.Background(), irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+		if m.Command == irc.RplWelcome {
+			w.WriteMessage(&irc.Message{Tags: irc.Tags{"+data": strings.Repeat("a", 50)}, Command: irc.CmdTagMsg, Params: irc.Params{"#chan"}})
+			w.WriteMessage(&irc.Message{Tags: irc.Tags{"+data": strings.Repeat("b", 200)}, Command: irc.CmdTagMsg, Params: irc.Params{"#chan"}})
+		}
+	}))
+
+	if len(sent) != 2 {
+		t.Errorf("expected both messages to be sent, since limits are only warnings; got %d", len(sent))
+	}
+	if n := strings.Count(logged.String(), "the limit is 100"); n != 1 {
+		t.Errorf("expected only the second message to be reported; got %q", logged.String())
+	}
+}
+
+func TestFromConfig(t *testing.T) {
+	var cfg irc.Config
+	err := json.Unmarshal([]byte(`{
+		"server": "irc.example.com:6697",
+		"nick": "bot",
+		"alt_nicks": ["bot_", "bot__"],
+		"sasl": {"password": "hunter2"},
+		"channels": ["#hello", "#secret hunter2"],
+		"rate_limit": {"penalty": "1s", "burst": "5s"}
+	}`), &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := irc.FromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Addr != "irc.example.com:6697" || client.SASL == nil ||
+		!reflect.DeepEqual(client.FloodControl, &irc.PenaltyFlood{Penalty: time.Second, Burst: 5 * time.Second}) {
+		t.Errorf("unexpected client: %+v", client)
+	}
+	if _, err := irc.FromConfig(irc.Config{Server: "irc.example.com:6697", Nick: "bot", SASL: &irc.SASLConfig{Mechanism: "SCRAM-SHA-256"}}); err == nil {
+		t.Errorf("expected an error for an unsupported SASL mechanism")
+	}
+
+	// the alternative nicknames and channels are used once connected
+	client.SASL = nil
+	client.FloodControl = nil
+	var joins []string
+	serverDone := make(chan struct{})
+	clientConn, serverConn := irc.Pipe()
+	go func() {
+		defer close(serverDone)
+		defer serverConn.Close()
+		scanner := bufio.NewScanner(serverConn)
+		for scanner.Scan() {
+			m := new(irc.Message)
+			if err := m.UnmarshalText(scanner.Bytes()); err != nil {
+				continue
+			}
+			switch m.Command {
+			case irc.CmdNick:
+				if nick := m.Params.Get(1); nick != "bot_" {
+					fmt.Fprintf(serverConn, ":irc.example.com 433 * %s :Nickname is already in use\r\n", nick)
+				} else {
+					fmt.Fprintf(serverConn, ":irc.example.com 001 bot_ :Welcome\r\n")
+				}
+			case irc.CmdJoin:
+				joins = append(joins, scanner.Text())
+				if len(joins) == 2 {
+					return
+				}
+			}
+		}
+	}()
+	client.DialFn = func() (io.ReadWriteCloser, error) { return clientConn, nil }
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	client.ConnectAndRun(ctx, nil)
+	<-serverDone
+
+	if !client.Nick().Is("bot_") {
+		t.Errorf("expected the client to use the first alternative nickname; got %q", client.Nick())
+	}
+	if !reflect.DeepEqual(joins, []string{"JOIN :#hello", "JOIN #secret :hunter2"}) {
+		t.Errorf("unexpected joins: %q", joins)
+	}
+}
+
+func TestClient_MOTD(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	clientConn, serverConn := irc.Pipe()
+	go func() {
+		defer serverConn.Close()
+		scanner := bufio.NewScanner(serverConn)
+		for scanner.Scan() {
+			switch {
+			case strings.HasPrefix(scanner.Text(), "USER"):
+				fmt.Fprintf(serverConn, ":irc.example.com 001 bot :Welcome\r\n"+
+					":irc.example.com 375 bot :- irc.example.com Message of the day - \r\n"+
+					":irc.example.com 372 bot :- Welcome to the network!\r\n"+
+					":irc.example.com 372 bot :-\r\n"+
+					":irc.example.com 372 bot :- Maintenance tonight.\r\n"+
+					":irc.example.com 376 bot :End of /MOTD command.\r\n")
+			case strings.HasPrefix(scanner.Text(), "QUIT"):
+				return
+			}
+		}
+	}()
+
+	client := &irc.Client{Nickname: "bot"}
+	client.DialFn = func() (io.ReadWriteCloser, error) { return clientConn, nil }
+	var motds []string
+	r := &irc.Router{}
+	r.OnMOTD(func(w irc.MessageWriter, motd string) {
+		motds = append(motds, motd)
+		w.WriteMessage(irc.Quit("bye"))
+	})
+	if err := client.ConnectAndRun(ctx, r); err != nil {
+		t.Fatal(err)
+	}
+	want := "Welcome to the network!\n\nMaintenance tonight."
+	if len(motds) != 1 || motds[0] != want {
+		t.Errorf("expected OnMOTD to be called once with %q; got %q", want, motds)
+	}
+	if client.MOTD() != want {
+		t.Errorf("expected Client.MOTD to return %q; got %q", want, client.MOTD())
+	}
+}
+
+func TestClient_AwayMembers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	clientConn, serverConn := irc.Pipe()
+	go func() {
+		defer serverConn.Close()
+		scanner := bufio.NewScanner(serverConn)
+		for scanner.Scan() {
+			switch {
+			case strings.HasPrefix(scanner.Text(), "USER"):
+				fmt.Fprintf(serverConn, ":irc.example.com 001 bot :Welcome bot!bot@example.com\r\n"+
+					":bot!bot@example.com JOIN #chan\r\n"+
+					":irc.example.com 353 bot = #chan :@bot alice bob carol\r\n"+
+					":irc.example.com 366 bot #chan :End of /NAMES list.\r\n"+
+					":alice!a@host AWAY :lunch\r\n"+
+					":bob!b@host AWAY :brb\r\n"+
+					":bob!b@host AWAY\r\n"+
+					":irc.example.com 301 bot carol :on vacation\r\n"+
+					":irc.example.com NOTICE bot :done\r\n")
+			case strings.HasPrefix(scanner.Text(), "QUIT"):
+				return
+			}
+		}
+	}()
+
+	var changes []string
+	var away []irc.Member
+	client := &irc.Client{Nickname: "bot"}
+	client.DialFn = func() (io.ReadWriteCloser, error) { return clientConn, nil }
+	client.OnMemberAway = func(nick irc.Nickname, away bool, message string) {
+		changes = append(changes, fmt.Sprintf("%s %t %s", nick, away, message))
+	}
+	h := irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+		if m.Command == irc.CmdNotice {
+			away = client.AwayMembers("#chan")
+			w.WriteMessage(irc.Quit("bye"))
+		}
+	})
+	if err := client.ConnectAndRun(ctx, h); err != nil {
+		t.Fatal(err)
+	}
+
+	wantChanges := []string{"alice true lunch", "bob true brb", "bob false ", "carol true on vacation"}
+	if !reflect.DeepEqual(changes, wantChanges) {
+		t.Errorf("expected away changes %q; got %q", wantChanges, changes)
+	}
+	wantAway := []irc.Member{
+		{Nick: "alice", Away: true, AwayMessage: "lunch"},
+		{Nick: "carol", Away: true, AwayMessage: "on vacation"},
+	}
+	if !reflect.DeepEqual(away, wantAway) {
+		t.Errorf("expected away members %+v; got %+v", wantAway, away)
+	}
+}
+
+func TestClient_UserModes(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	clientConn, serverConn := irc.Pipe()
+	go func() {
+		defer serverConn.Close()
+		scanner := bufio.NewScanner(serverConn)
+		for scanner.Scan() {
+			switch {
+			case strings.HasPrefix(scanner.Text(), "USER"):
+				fmt.Fprintf(serverConn, ":irc.example.com 001 bot :Welcome bot!bot@example.com\r\n"+
+					":bot MODE bot :+iw\r\n"+
+					":irc.example.com 221 bot +iws +cF\r\n"+
+					":alice!a@host MODE #chan +o bot\r\n"+
+					":NickServ!services@services. MODE bot :-w+x\r\n")
+			case strings.HasPrefix(scanner.Text(), "QUIT"):
+				return
+			}
+		}
+	}()
+
+	var changes, modes []string
+	client := &irc.Client{Nickname: "bot"}
+	client.DialFn = func() (io.ReadWriteCloser, error) { return clientConn, nil }
+	r := &irc.Router{}
+	r.OnUserMode(func(w irc.MessageWriter, change string) {
+		changes = append(changes, change)
+		modes = append(modes, client.UserModes())
+		if strings.Contains(change, "x") {
+			w.WriteMessage(irc.Quit("bye"))
+		}
+	})
+	if err := client.ConnectAndRun(ctx, r); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"+iw", "-w+x"}; !reflect.DeepEqual(changes, want) {
+		t.Errorf("expected user mode changes %q; got %q", want, changes)
+	}
+	if want := []string{"iw", "isx"}; !reflect.DeepEqual(modes, want) {
+		t.Errorf("expected user modes %q; got %q", want, modes)
+	}
+}
+
+func TestClient_LineBudget(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	clientConn, serverConn := irc.Pipe()
+	go func() {
+		defer serverConn.Close()
+		scanner := bufio.NewScanner(serverConn)
+		for scanner.Scan() {
+			switch {
+			case strings.HasPrefix(scanner.Text(), "USER"):
+				fmt.Fprintf(serverConn, ":irc.example.com 001 bot :Welcome bot!bot@example.com\r\n"+
+					":bot!bot@example.com CHGHOST bot very.long.vhost.example.com\r\n"+
+					":irc.example.com 311 bot bot ~bot short.host * :Real Name\r\n"+
+					":irc.example.com NOTICE bot :done\r\n")
+			case strings.HasPrefix(scanner.Text(), "QUIT"):
+				return
+			}
+		}
+	}()
+
+	var budgets []int
+	client := &irc.Client{Nickname: "bot"}
+	client.DialFn = func() (io.ReadWriteCloser, error) { return clientConn, nil }
+	client.OnLineBudget = func(budget int) {
+		budgets = append(budgets, budget)
+	}
+	h := irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+		if m.Command == irc.CmdNotice {
+			w.WriteMessage(irc.Quit("bye"))
+		}
+	})
+	if err := client.ConnectAndRun(ctx, h); err != nil {
+		t.Fatal(err)
+	}
+	// 512, minus the prefix with ':' and SPACE, minus CR-LF
+	want := []int{512 - 21 - 2, 512 - 37 - 2, 512 - 21 - 2}
+	if !reflect.DeepEqual(budgets, want) {
+		t.Errorf("expected line budgets %v; got %v", want, budgets)
+	}
+}
+
+func TestClient_CapValue(t *testing.T) {
+	client, server, done := setup()
+	defer done()
+	client.Caps = []string{"draft/multiline", "oragono.io/maxline-2"}
+	client.SASL = irc.SASLFirst(irc.SASLPlain("bot", "hunter2"), irc.SASLExternal())
+
+	var sent []string
+	var sasl string
+	var maxBytes, maxLines, budget int
+	server.Handler = irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+		switch m.Command {
+		case irc.CmdCap:
+			switch m.Params.Get(1) {
+			case "LS":
+				server.WriteString(":irc.example.com CAP * LS * :multi-prefix sasl=EXTERNAL draft/multiline=max-bytes=4096,max-lines=24")
+				server.WriteString(":irc.example.com CAP * LS :oragono.io/maxline-2=2048")
+			case "REQ":
+				server.WriteString(":irc.example.com CAP bot ACK :" + m.Params.Get(2))
+			case "END":
+				sasl, _ = client.CapValue("SASL")
+				maxBytes, maxLines, _ = client.MultilineLimits()
+				budget = client.LineBudget()
+				done()
+			}
+		case irc.CmdAuthenticate:
+			sent = append(sent, "AUTHENTICATE "+m.Params.Get(1))
+			switch m.Params.Get(1) {
+			case "EXTERNAL":
+				server.WriteString("AUTHENTICATE +")
+			case "+":
+				server.WriteString(":irc.example.com 903 bot :SASL authentication successful")
+			}
+		}
+	})
+	_ = client.ConnectAndRun(context.Background(), nil)
+
+	// the server only supports EXTERNAL, so the client must not try PLAIN first
+	expected := []string{"AUTHENTICATE EXTERNAL", "AUTHENTICATE +"}
+	if fmt.Sprint(sent) != fmt.Sprint(expected) {
+		t.Errorf("expected client to send %q; got %q", expected, sent)
+	}
+	if sasl != "EXTERNAL" {
+		t.Errorf("expected sasl value %q; got %q", "EXTERNAL", sasl)
+	}
+	if maxBytes != 4096 || maxLines != 24 {
+		t.Errorf("expected multiline limits 4096 bytes and 24 lines; got %d and %d", maxBytes, maxLines)
+	}
+	if budget <= 512 || budget > 2048 {
+		t.Errorf("expected a line budget based on maxline 2048; got %d", budget)
+	}
+	if _, ok := client.CapValue("echo-message"); ok {
+		t.Errorf("expected echo-message to not be advertised")
+	}
+}
+
+func TestClient_registration(t *testing.T) {
+	tests := map[string]struct {
+		cap     string // the server's reply to CAP LS
+		welcome string // the line after which the server completes registration
+		want    []string
+	}{
+		// the server requires the PONG before it completes registration, and doesn't know CAP
+		"unknown CAP": {
+			cap:     ":irc.example.com 421 * CAP :Unknown command",
+			welcome: "PONG :cookie",
+			want:    []string{"CAP LS :302", "NICK :bot", "USER guest 0 * :...", "PONG :cookie", "QUIT :bye"},
+		},
+		// the server never finishes its CAP LS reply, so the client must end negotiation on its own
+		"unfinished CAP LS": {
+			cap:     ":irc.example.com CAP * LS * :multi-prefix",
+			welcome: "CAP :END",
+			want:    []string{"CAP LS :302", "NICK :bot", "USER guest 0 * :...", "PONG :cookie", "CAP :LIST", "CAP :END", "QUIT :bye"},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			var sent []string
+			serverDone := make(chan struct{})
+			clientConn, serverConn := irc.Pipe()
+			go func() {
+				defer close(serverDone)
+				defer serverConn.Close()
+				scanner := bufio.NewScanner(serverConn)
+				for scanner.Scan() {
+					line := scanner.Text()
+					sent = append(sent, line)
+					switch {
+					case strings.HasPrefix(line, "CAP LS"):
+						fmt.Fprintf(serverConn, "%s\r\n", tt.cap)
+					case strings.HasPrefix(line, "USER"):
+						fmt.Fprintf(serverConn, "PING :cookie\r\n")
+					case line == tt.welcome:
+						fmt.Fprintf(serverConn, ":irc.example.com 001 bot :Welcome\r\n")
+					case strings.HasPrefix(line, "QUIT"):
+						return
+					}
+				}
+			}()
+
+			client := &irc.Client{Nickname: "bot", CapTimeout: 50 * time.Millisecond}
+			client.DialFn = func() (io.ReadWriteCloser, error) { return clientConn, nil }
+			h := irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+				if m.Command == irc.RplWelcome {
+					w.WriteMessage(irc.Quit("bye"))
+				}
+			})
+			if err := client.ConnectAndRun(ctx, h); err != nil {
+				t.Fatal(err)
+			}
+			<-serverDone
+			if !reflect.DeepEqual(sent, tt.want) {
+				t.Errorf("expected client to send %q; got %q", tt.want, sent)
+			}
+		})
+	}
+}
+
+func TestClient_capNegotiation(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	var many []string
+	for i := 0; i < 40; i++ {
+		many = append(many, fmt.Sprintf("example.com/capability-%02d", i))
+	}
+
+	var sent []string
+	serverDone := make(chan struct{})
+	clientConn, serverConn := irc.Pipe()
+	go func() {
+		defer close(serverDone)
+		defer serverConn.Close()
+		scanner := bufio.NewScanner(serverConn)
+		for scanner.Scan() {
+			line := scanner.Text()
+			sent = append(sent, line)
+			switch {
+			case strings.HasPrefix(line, "CAP LS"):
+				fmt.Fprintf(serverConn, ":irc.example.com CAP * LS * :%s\r\n", strings.Join(many[:20], " "))
+				fmt.Fprintf(serverConn, ":irc.example.com CAP * LS :%s multi-prefix away-notify\r\n", strings.Join(many[20:], " "))
+			case strings.HasPrefix(line, "CAP REQ"):
+				list := strings.TrimPrefix(line, "CAP REQ :")
+				// the server refuses away-notify, and requires multi-prefix to be acknowledged by the client
+				if strings.Contains(list, "away-notify") {
+					fmt.Fprintf(serverConn, ":irc.example.com CAP bot NAK :%s\r\n", list)
+					continue
+				}
+				fmt.Fprintf(serverConn, ":irc.example.com CAP bot ACK :%s\r\n", strings.Replace(list, "multi-prefix", "~multi-prefix", 1))
+			case line == "CAP :END":
+				fmt.Fprintf(serverConn, ":irc.example.com 001 bot :Welcome\r\n")
+			case strings.HasPrefix(line, "QUIT"):
+				return
+			}
+		}
+	}()
+
+	client := &irc.Client{Nickname: "bot", Caps: append([]string{"multi-prefix", "away-notify"}, many...)}
+	client.DialFn = func() (io.ReadWriteCloser, error) { return clientConn, nil }
+	var enabled, rejected bool
+	h := irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+		if m.Command == irc.RplWelcome {
+			enabled = client.CapEnabled("multi-prefix") && client.CapEnabled(many[0]) && client.CapEnabled(many[39])
+			rejected = client.CapRejected("away-notify") && !client.CapEnabled("away-notify")
+			w.WriteMessage(irc.Quit("bye"))
+		}
+	})
+	if err := client.ConnectAndRun(ctx, h); err != nil {
+		t.Fatal(err)
+	}
+	<-serverDone
+
+	var reqs, retries int
+	var acked, ended bool
+	for _, line := range sent {
+		switch {
+		case strings.HasPrefix(line, "CAP REQ"):
+			if len(line)+2 > 512 {
+				t.Errorf("CAP REQ line is too long: %d bytes", len(line)+2)
+			}
+			if ended {
+				t.Errorf("expected CAP REQ before CAP END; got %q", sent)
+			}
+			reqs++
+			if line == "CAP REQ :away-notify" {
+				retries++
+			}
+		case line == "CAP ACK :multi-prefix":
+			acked = true
+		case line == "CAP :END":
+			ended = true
+		}
+	}
+	if reqs < 3 || retries == 0 {
+		t.Errorf("expected the capabilities to be requested in batches, and refused batches one at a time; got %q", sent)
+	}
+	if !acked {
+		t.Errorf("expected client to acknowledge multi-prefix; got %q", sent)
+	}
+	if !ended {
+		t.Errorf("expected client to end negotiation; got %q", sent)
+	}
+	if !enabled {
+		t.Errorf("expected the acknowledged capabilities to be enabled")
+	}
+	if !rejected {
+		t.Errorf("expected away-notify to be rejected")
+	}
+}
+
+func TestClient_Auth(t *testing.T) {
+	// the replies of Atheme and Anope
+	for _, identified := range []string{"You are now identified for \x02bot\x02.", "Password accepted - you are now recognized."} {
+		testAuth(t, identified)
+	}
+}
+
+func testAuth(t *testing.T, identified string) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	var sent []string
+	serverDone := make(chan struct{})
+	clientConn, serverConn := irc.Pipe()
+	go func() {
+		defer close(serverDone)
+		defer serverConn.Close()
+		scanner := bufio.NewScanner(serverConn)
+		for scanner.Scan() {
+			line := scanner.Text()
+			sent = append(sent, line)
+			switch {
+			case strings.HasPrefix(line, "CAP LS"):
+				fmt.Fprintf(serverConn, ":irc.example.com CAP * LS :multi-prefix\r\n")
+			case strings.HasPrefix(line, "USER"):
+				fmt.Fprintf(serverConn, ":irc.example.com NOTICE * :token accepted\r\n")
+			case line == "CAP :END":
+				fmt.Fprintf(serverConn, ":irc.example.com 001 bot :Welcome\r\n")
+			case line == "PRIVMSG NickServ :IDENTIFY bot hunter2":
+				fmt.Fprintf(serverConn, ":NickServ!NickServ@services. NOTICE bot :%s\r\n", identified)
+			case strings.HasPrefix(line, "JOIN"):
+				fmt.Fprintf(serverConn, ":bot!bot@example.com JOIN #chan\r\n")
+			case strings.HasPrefix(line, "QUIT"):
+				return
+			}
+		}
+	}()
+
+	// token sends a token before registration and needs capability negotiation to wait for the server to accept it
+	token := irc.AuthFunc(func(w irc.MessageWriter, a *irc.Auth) irc.Handler {
+		w.WriteMessage(irc.NewMessage("TOKEN", "secret"))
+		a.HoldCapEnd()
+		return irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+			if m.Command == irc.CmdNotice && m.Params.Get(2) == "token accepted" {
+				a.Done(nil)
+			}
+		})
+	})
+	client := &irc.Client{
+		Nickname: "bot",
+		Auth:     []irc.Authenticator{token, irc.NickServ("bot", "hunter2")},
+		AutoJoin: []string{"#chan"},
+	}
+	client.DialFn = func() (io.ReadWriteCloser, error) { return clientConn, nil }
+	h := irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+		if m.Command == irc.CmdJoin {
+			w.WriteMessage(irc.Quit("bye"))
+		}
+	})
+	if err := client.ConnectAndRun(ctx, h); err != nil {
+		t.Fatal(err)
+	}
+	<-serverDone
+
+	want := []string{
+		"TOKEN :secret",
+		"CAP LS :302",
+		"NICK :bot",
+		"USER guest 0 * :...",
+		"CAP :LIST",
+		"CAP :END",
+		"PRIVMSG NickServ :IDENTIFY bot hunter2",
+		"JOIN :#chan",
+		"QUIT :bye",
+	}
+	if !reflect.DeepEqual(sent, want) {
+		t.Errorf("%s: expected client to send %q; got %q", identified, want, sent)
+	}
+}
+
+func TestClient_authTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	var sent []string
+	serverDone := make(chan struct{})
+	clientConn, serverConn := irc.Pipe()
+	go func() {
+		defer close(serverDone)
+		defer serverConn.Close()
+		scanner := bufio.NewScanner(serverConn)
+		for scanner.Scan() {
+			line := scanner.Text()
+			sent = append(sent, line)
+			switch {
+			case strings.HasPrefix(line, "CAP LS"):
+				fmt.Fprintf(serverConn, ":irc.example.com CAP * LS :multi-prefix\r\n")
+			case line == "CAP :END":
+				fmt.Fprintf(serverConn, ":irc.example.com 001 bot :Welcome\r\n")
+			case strings.HasPrefix(line, "JOIN"):
+				fmt.Fprintf(serverConn, ":bot!bot@example.com JOIN #chan\r\n")
+			case strings.HasPrefix(line, "QUIT"):
+				return
+			}
+		}
+	}()
+
+	// silent holds capability negotiation open, and never hears back
+	silent := irc.AuthFunc(func(w irc.MessageWriter, a *irc.Auth) irc.Handler {
+		a.HoldCapEnd()
+		return nil
+	})
+	var errorLog bytes.Buffer
+	client := &irc.Client{
+		Nickname:   "bot",
+		Auth:       []irc.Authenticator{silent},
+		AutoJoin:   []string{"#chan"},
+		CapTimeout: 50 * time.Millisecond,
+		ErrorLog:   log.New(&errorLog, "", 0),
+	}
+	client.DialFn = func() (io.ReadWriteCloser, error) { return clientConn, nil }
+	h := irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+		if m.Command == irc.CmdJoin {
+			w.WriteMessage(irc.Quit("bye"))
+		}
+	})
+	if err := client.ConnectAndRun(ctx, h); err != nil {
+		t.Fatal(err)
+	}
+	<-serverDone
+
+	want := []string{"CAP LS :302", "NICK :bot", "USER guest 0 * :...", "CAP :LIST", "CAP :END", "JOIN :#chan", "QUIT :bye"}
+	if !reflect.DeepEqual(sent, want) {
+		t.Errorf("expected the timeout to end negotiation and start AutoJoin; got %q", sent)
+	}
+	if !strings.Contains(errorLog.String(), irc.ErrAuthTimeout.Error()) {
+		t.Errorf("expected the authenticator to time out; got %q", errorLog.String())
+	}
+}
+
+func TestClient_Redispatch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	clientConn, serverConn := irc.Pipe()
+	go func() {
+		defer serverConn.Close()
+		scanner := bufio.NewScanner(serverConn)
+		for scanner.Scan() {
+			m := new(irc.Message)
+			if err := m.UnmarshalText(scanner.Bytes()); err != nil {
+				continue
+			}
+			if m.Command == irc.CmdUser {
+				fmt.Fprintf(serverConn, ":irc.example.com 001 bot :Welcome bot!bot@example.com\r\n")
+				fmt.Fprintf(serverConn, ":alice!a@host PRIVMSG #chan :!relay\r\n")
+				fmt.Fprintf(serverConn, ":alice!a@host PRIVMSG #chan :!loop\r\n")
+			}
+			if m.Command == irc.CmdPrivmsg && m.Params.Get(2) == "done" {
+				return
+			}
+		}
+	}()
+
+	client := &irc.Client{Nickname: "bot"}
+	client.DialFn = func() (io.ReadWriteCloser, error) { return clientConn, nil }
+	var (
+		cause              *irc.Message
+		relayErr, loopErr  error
+		actions, loopCalls int
+	)
+	r := &irc.Router{}
+	r.OnText("!relay", func(w irc.MessageWriter, m *irc.Message) {
+		cause = m
+		relayed := &irc.Message{Source: irc.Prefix{Nick: "bridge"}, Command: irc.CmdPrivmsg, Params: irc.Params{"#chan", "\x01ACTION waves\x01"}}
+		relayErr = client.Redispatch(m, relayed)
+	})
+	r.OnAction("waves", func(w irc.MessageWriter, m *irc.Message) {
+		if m.Source.Nick == "bridge" {
+			actions++
+		}
+	})
+	r.OnText("!loop", func(w irc.MessageWriter, m *irc.Message) {
+		loopCalls++
+		if err := client.Redispatch(m, irc.Msg("#chan", "!loop")); err != nil && loopErr == nil {
+			loopErr = err
+		}
+		if m.Source.Nick == "alice" {
+			w.WriteMessage(irc.Msg("#chan", "done"))
+		}
+	})
+	_ = client.ConnectAndRun(ctx, r)
+
+	if relayErr != nil || actions != 1 {
+		t.Errorf("expected the relayed action to be decoded and routed once; got %d (%v)", actions, relayErr)
+	}
+	if !errors.Is(loopErr, irc.ErrRedispatchLoop) || loopCalls != irc.MaxRedispatchDepth+1 {
+		t.Errorf("expected redispatching to stop after %d levels; got %d calls (%v)", irc.MaxRedispatchDepth, loopCalls, loopErr)
+	}
+	if err := client.Redispatch(cause, irc.Msg("#chan", "late")); !errors.Is(err, irc.ErrNotDispatching) {
+		t.Errorf("expected ErrNotDispatching after the handler returned; got %v", err)
+	}
+}
+
+// TestClient_OnTextRESubmatch checks that a handler receives the submatches of the message it handles,
+// even when the same route matched another message before the handler ran.
+func TestClient_OnTextRESubmatch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	clientConn, serverConn := irc.Pipe()
+	go func() {
+		defer serverConn.Close()
+		scanner := bufio.NewScanner(serverConn)
+		for scanner.Scan() {
+			m := new(irc.Message)
+			if err := m.UnmarshalText(scanner.Bytes()); err != nil {
+				continue
+			}
+			if m.Command == irc.CmdUser {
+				fmt.Fprintf(serverConn, ":irc.example.com 001 bot :Welcome bot!bot@example.com\r\n")
+				fmt.Fprintf(serverConn, ":alice!a@host PRIVMSG #chan :!say \x02hi\x02\r\n")
+			}
+			if m.Command == irc.CmdPrivmsg && m.Params.Get(2) == "done" {
+				return
+			}
+		}
+	}()
+
+	client := &irc.Client{Nickname: "bot"}
+	client.DialFn = func() (io.ReadWriteCloser, error) { return clientConn, nil }
+	var got []string
+	r := &irc.Router{StripFormatting: true}
+	r.OnTextRESubmatch(`^!say (.+)$`, func(w irc.MessageWriter, m *irc.Message, matches []string) {
+		got = append(got, matches[1])
+		if m.Source.Nick == "alice" {
+			w.WriteMessage(irc.Msg("#chan", "done"))
+		}
+	}).Use(func(next irc.Handler) irc.Handler {
+		return irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+			// the route matches the relayed message before alice's reaches the handler
+			if m.Source.Nick == "alice" {
+				client.Redispatch(m, &irc.Message{Source: irc.Prefix{Nick: "bridge"}, Command: irc.CmdPrivmsg, Params: irc.Params{"#chan", "!say relayed"}})
+			}
+			next.SpeakIRC(w, m)
+		})
+	})
+	_ = client.ConnectAndRun(ctx, r)
+
+	if strings.Join(got, "|") != "relayed|hi" {
+		t.Errorf("expected the submatches of each message, with formatting stripped; got %q", got)
+	}
+}
+
+// unwrappingWriter is a MessageWriter of a middleware, which wraps the writer given to the handler.
+type unwrappingWriter struct{ w irc.MessageWriter }
+
+func (uw unwrappingWriter) WriteMessage(m encoding.TextMarshaler) { uw.w.WriteMessage(m) }
+func (uw unwrappingWriter) Unwrap() irc.MessageWriter             { return uw.w }
+
+func TestConnInfoOf(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	clientConn, serverConn := irc.Pipe()
+	go func() {
+		defer serverConn.Close()
+		scanner := bufio.NewScanner(serverConn)
+		for scanner.Scan() {
+			m := new(irc.Message)
+			if err := m.UnmarshalText(scanner.Bytes()); err != nil {
+				continue
+			}
+			if m.Command == irc.CmdUser {
+				fmt.Fprintf(serverConn, ":irc.example.com 001 bot :Welcome bot!bot@example.com\r\n")
+				fmt.Fprintf(serverConn, ":irc.example.com 004 bot irc.example.com ircd-1.0 iow blkmnt\r\n")
+				fmt.Fprintf(serverConn, ":irc.example.com 005 bot NETWORK=Example TOPICLEN=300 CHANTYPES=# :are supported by this server\r\n")
+				fmt.Fprintf(serverConn, ":alice!a@host PRIVMSG #chan :!info\r\n")
+			}
+			if m.Command == irc.CmdPrivmsg {
+				return
+			}
+		}
+	}()
+
+	client := &irc.Client{Nickname: "bot"}
+	client.DialFn = func() (io.ReadWriteCloser, error) { return clientConn, nil }
+	var (
+		info irc.ConnInfo
+		ok   bool
+	)
+	r := &irc.Router{}
+	r.Use(func(next irc.Handler) irc.Handler {
+		return irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+			next.SpeakIRC(unwrappingWriter{w}, m)
+		})
+	})
+	r.OnText("!info", func(w irc.MessageWriter, m *irc.Message) {
+		info, ok = irc.ConnInfoOf(w)
+		w.WriteMessage(irc.Msg("#chan", "ok"))
+	})
+	_ = client.ConnectAndRun(ctx, r)
+
+	if !ok || info.Nick != "bot" || info.Server != "irc.example.com" {
+		t.Errorf("expected the connection info behind the wrapped writer; got %v %+v", ok, info)
+	}
+	if v, _ := info.ISupport("topiclen"); v != "300" {
+		t.Errorf("expected TOPICLEN=300; got %q", v)
+	}
+	if info.CapEnabled("sasl") || len(info.Caps()) != 0 {
+		t.Errorf("expected no caps; got %q", info.Caps())
+	}
+	if !info.IsChannel("#chan") || info.IsChannel("&local") || info.IsChannel("alice") {
+		t.Errorf("expected only # to be a channel type with CHANTYPES=#")
+	}
+	if !(irc.ConnInfo{}).IsChannel("&local") || (irc.ConnInfo{}).IsChannel("") {
+		t.Errorf("expected # and & to be channel types when CHANTYPES isn't advertised")
+	}
+	if _, ok := irc.ConnInfoOf(irctest.Discard); ok {
+		t.Errorf("expected no connection info for a writer without a connection")
+	}
+}
+
+func TestPager_chantypes(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	clientConn, serverConn := irc.Pipe()
+	var targets []string
+	go func() {
+		defer serverConn.Close()
+		scanner := bufio.NewScanner(serverConn)
+		for scanner.Scan() {
+			m := new(irc.Message)
+			if err := m.UnmarshalText(scanner.Bytes()); err != nil {
+				continue
+			}
+			switch m.Command {
+			case irc.CmdUser:
+				fmt.Fprintf(serverConn, ":irc.example.com 001 bot :Welcome bot!bot@example.com\r\n")
+				fmt.Fprintf(serverConn, ":irc.example.com 005 bot CHANTYPES=#! STATUSMSG=@+ :are supported by this server\r\n")
+				for _, target := range []string{"!chan", "@#chan", "bot"} {
+					fmt.Fprintf(serverConn, ":alice!a@host PRIVMSG %s :!list\r\n", target)
+				}
+			case irc.CmdPrivmsg:
+				if targets = append(targets, m.Params.Get(1)); len(targets) == 3 {
+					return
+				}
+			}
+		}
+	}()
+
+	pager := &irc.Pager{}
+	r := &irc.Router{}
+	r.OnCommand("!list", func(w irc.MessageWriter, m *irc.Message) {
+		pager.Reply(w, m, []string{"item"})
+	})
+	client := &irc.Client{Nickname: "bot"}
+	client.DialFn = func() (io.ReadWriteCloser, error) { return clientConn, nil }
+	_ = client.ConnectAndRun(ctx, r)
+
+	if want := []string{"!chan", "@#chan", "alice"}; !reflect.DeepEqual(targets, want) {
+		t.Errorf("expected replies to %q; got %q", want, targets)
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	type timer struct {
+		d time.Duration
+		c chan time.Time
+	}
+	var (
+		mu  sync.Mutex
+		now = time.Unix(0, 0)
+	)
+	advance := func(d time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		now = now.Add(d)
+	}
+	timers := make(chan timer)
+	k := &irc.Keepalive{
+		Interval: time.Minute,
+		Now: func() time.Time {
+			mu.Lock()
+			defer mu.Unlock()
+			return now
+		},
+		After: func(d time.Duration) <-chan time.Time {
+			c := make(chan time.Time, 1)
+			timers <- timer{d, c}
+			return c
+		},
+	}
+	w := &irctest.RecordingWriter{}
+	done := make(chan error, 1)
+	go func() { done <- k.Run(context.Background(), w) }()
+
+	// a quiet connection is pinged after Interval
+	tm := <-timers
+	if tm.d != time.Minute {
+		t.Fatalf("expected to wait %s; waited %s", time.Minute, tm.d)
+	}
+	advance(time.Minute)
+	tm.c <- now
+	tm = <-timers
+	if tm.d != irc.DefaultKeepaliveTimeout || w.Len() != 1 || w.Last().Command != irc.CmdPing {
+		t.Fatalf("expected a PING with a timeout of %s; got %q, %s", irc.DefaultKeepaliveTimeout, w.Lines(), tm.d)
+	}
+	advance(150 * time.Millisecond)
+	if k.Received(&irc.Message{Command: irc.CmdPong, Params: irc.Params{"irc.example.com", "other"}}) {
+		t.Errorf("expected a PONG to another PING to be passed on")
+	}
+	if !k.Received(&irc.Message{Command: irc.CmdPong, Params: irc.Params{"irc.example.com", "TIMEOUTCHECK"}}) {
+		t.Fatalf("expected the PONG to be taken")
+	}
+	if lag := k.Lag(); lag != 150*time.Millisecond {
+		t.Errorf("expected a lag of 150ms; got %s", lag)
+	}
+
+	// a connection which doesn't answer times out
+	tm = <-timers
+	advance(time.Minute)
+	tm.c <- now
+	tm = <-timers
+	tm.c <- now
+	if err := <-done; !errors.Is(err, irc.ErrPingTimeout) {
+		t.Errorf("expected ErrPingTimeout; got %v", err)
+	}
+	if w.Len() != 2 {
+		t.Errorf("expected a second PING; got %q", w.Lines())
+	}
+}
+
+func TestKeepalive_reuse(t *testing.T) {
+	type timer struct {
+		d time.Duration
+		c chan time.Time
+	}
+	var (
+		mu  sync.Mutex
+		now = time.Unix(0, 0)
+	)
+	advance := func(d time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		now = now.Add(d)
+	}
+	timers := make(chan timer)
+	k := &irc.Keepalive{
+		Interval: time.Minute,
+		Now: func() time.Time {
+			mu.Lock()
+			defer mu.Unlock()
+			return now
+		},
+		After: func(d time.Duration) <-chan time.Time {
+			c := make(chan time.Time, 1)
+			timers <- timer{d, c}
+			return c
+		},
+	}
+	w := &irctest.RecordingWriter{}
+
+	// the first connection ends while its PING waits for an answer
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- k.Run(ctx, w) }()
+	tm := <-timers
+	advance(time.Minute)
+	tm.c <- now
+	<-timers
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the first Run to end with its context; got %v", err)
+	}
+
+	// the next connection sends a PING of its own instead of waiting for the old one
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go func() { done <- k.Run(ctx, w) }()
+	tm = <-timers
+	advance(time.Minute)
+	tm.c <- now
+	tm = <-timers
+	if tm.d != irc.DefaultKeepaliveTimeout || w.Len() != 2 {
+		t.Fatalf("expected the second connection to be pinged; got %q", w.Lines())
+	}
+	if !k.Received(&irc.Message{Command: irc.CmdPong, Params: irc.Params{"irc.example.com", "TIMEOUTCHECK"}}) {
+		t.Errorf("expected the PONG to the new PING to be taken")
+	}
+	cancel()
+	<-timers // the wait for the next Interval, which ends with ctx
+	<-done
+}
+
+func TestClient_Lag(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	clientConn, serverConn := irc.Pipe()
+	go func() {
+		defer serverConn.Close()
+		scanner := bufio.NewScanner(serverConn)
+		for scanner.Scan() {
+			m := new(irc.Message)
+			if err := m.UnmarshalText(scanner.Bytes()); err != nil {
+				continue
+			}
+			switch m.Command {
+			case irc.CmdUser:
+				fmt.Fprintf(serverConn, ":irc.example.com 001 bot :Welcome bot!bot@example.com\r\n")
+			case irc.CmdPing:
+				time.Sleep(5 * time.Millisecond)
+				fmt.Fprintf(serverConn, ":irc.example.com PONG irc.example.com :%s\r\n", m.Params.Get(1))
+			case irc.CmdQuit:
+				return
+			}
+		}
+	}()
+
+	lags := make(chan time.Duration, 10)
+	client := &irc.Client{
+		Nickname: "bot",
+		// the connection is never quiet for an hour, but the lag is still measured every 20ms
+		Keepalive: &irc.Keepalive{Interval: time.Hour, LagInterval: 20 * time.Millisecond, OnLag: func(lag time.Duration) {
+			select {
+			case lags <- lag:
+			default:
+			}
+		}},
+	}
+	client.DialFn = func() (io.ReadWriteCloser, error) { return clientConn, nil }
+	var lag time.Duration
+	r := &irc.Router{}
+	r.OnConnect(func(w irc.MessageWriter, m *irc.Message) {
+		go func() {
+			<-lags
+			lag = <-lags
+			cancel()
+		}()
+	})
+	_ = client.ConnectAndRun(ctx, r)
+
+	if lag < 5*time.Millisecond {
+		t.Errorf("expected a lag of at least 5ms; got %s", lag)
+	}
+	if got := client.Lag(); got < 5*time.Millisecond {
+		t.Errorf("expected Client.Lag to report the last lag; got %s", got)
+	}
+}
+
+// panicWriter is a MessageWriter which panics on every write.
+type panicWriter struct{}
+
+func (panicWriter) WriteMessage(encoding.TextMarshaler) { panic("broken") }
+
+func TestMultiWriter(t *testing.T) {
+	first, last := &irctest.RecordingWriter{}, &irctest.RecordingWriter{}
+	disconnected := &irc.Client{}
+	var failed []irc.MessageWriter
+	mw := irc.NewMultiWriter(first, panicWriter{}, disconnected)
+	mw.Add(last)
+	mw.OnError = func(w irc.MessageWriter, err error) { failed = append(failed, w) }
+
+	err := mw.WriteMessageE(irc.Msg("#test", "hello"))
+	if !errors.Is(err, irc.ErrNotConnected) || !strings.Contains(err.Error(), "panic") {
+		t.Errorf("expected the errors of the disconnected client and the panic; got %v", err)
+	}
+	if len(failed) != 2 || failed[1] != disconnected {
+		t.Errorf("expected OnError to be called for the failed writers; got %v", failed)
+	}
+	if first.Len() != 1 || last.Len() != 1 {
+		t.Errorf("expected the message to reach the writers around the failed ones; got %d and %d", first.Len(), last.Len())
+	}
+
+	if !mw.Remove(disconnected) || mw.Remove(disconnected) {
+		t.Errorf("expected Remove to report the writer the first time only")
+	}
+	mw.Remove(panicWriter{})
+	if err := mw.WriteMessageE(irc.Msg("#test", "again")); err != nil {
+		t.Errorf("expected no errors once the failing writers were removed; got %v", err)
+	}
+	if last.Len() != 2 {
+		t.Errorf("expected the message to reach the remaining writers; got %d", last.Len())
+	}
+}
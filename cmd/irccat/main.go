@@ -0,0 +1,187 @@
+/*
+Command irccat connects to an IRC server, sends each line read from standard input as a message,
+and prints the messages it receives to standard output.
+
+	echo "deploy finished" | irccat -server irc.libera.chat:6697 -nick deploybot -target '#mychannel'
+
+When target is a channel, irccat joins it before sending anything.
+irccat quits once standard input is closed and every line was sent.
+Lines are sent no faster than one per -interval to stay clear of server flood limits.
+
+SASL PLAIN authentication is used when -sasl-user is set, with the password read from
+the IRCCAT_PASSWORD environment variable so that it doesn't show up in the process list.
+SASL EXTERNAL is used when a client certificate is given with -cert and -key, which requires -tls.
+*/
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/Travis-Britz/irc"
+)
+
+func main() {
+	var (
+		server   = flag.String("server", "", "address (host:port) of the IRC server (required)")
+		useTLS   = flag.Bool("tls", true, "connect with TLS")
+		insecure = flag.Bool("insecure", false, "skip verification of the server's TLS certificate")
+		nick     = flag.String("nick", "irccat", "nickname")
+		target   = flag.String("target", "", "channel or nickname to send stdin lines to; channels are joined first")
+		saslUser = flag.String("sasl-user", "", "account name for SASL PLAIN; the password is read from IRCCAT_PASSWORD")
+		certFile = flag.String("cert", "", "client certificate file for CertFP and SASL EXTERNAL")
+		keyFile  = flag.String("key", "", "client certificate key file")
+		interval = flag.Duration("interval", 500*time.Millisecond, "minimum delay between sent lines")
+		raw      = flag.Bool("raw", false, "print every received line instead of only messages")
+	)
+	flag.Parse()
+	if *server == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	client := &irc.Client{
+		Addr:     *server,
+		Nickname: *nick,
+		User:     "irccat",
+		Realname: "irccat",
+	}
+	if *useTLS {
+		client.TLSConfig = &tls.Config{InsecureSkipVerify: *insecure}
+	} else {
+		client.DialFn = func() (io.ReadWriteCloser, error) {
+			return net.Dial("tcp", *server)
+		}
+	}
+	if *certFile != "" {
+		if !*useTLS {
+			// the certificate is presented during the TLS handshake, so EXTERNAL can't work without it
+			log.Fatal("-cert requires -tls")
+		}
+		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		client.Certificate = &cert
+	}
+	if *saslUser != "" {
+		client.SASL = irc.SASLPlain(*saslUser, os.Getenv("IRCCAT_PASSWORD"))
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	cat := &cat{target: *target, interval: *interval, raw: *raw, in: os.Stdin, out: os.Stdout}
+	if err := client.ConnectAndRun(ctx, cat.handler()); err != nil {
+		log.Fatal(err)
+	}
+}
+
+type cat struct {
+	target   string
+	interval time.Duration
+	raw      bool
+
+	// in is read for the lines to send, and received messages are printed to out.
+	in  io.Reader
+	out io.Writer
+
+	started bool
+}
+
+func (c *cat) handler() irc.Handler {
+	r := &irc.Router{}
+	r.Use(c.print)
+	r.OnConnect(func(w irc.MessageWriter, m *irc.Message) {
+		// the server tells which prefixes are channel types
+		if info, _ := irc.ConnInfoOf(w); info.IsChannel(c.target) {
+			w.WriteMessage(irc.Join(c.target))
+			return
+		}
+		c.start(w)
+	})
+	// the end of the NAMES reply means the join is complete
+	r.HandleFunc(irc.RplEndOfNames, func(w irc.MessageWriter, m *irc.Message) {
+		if strings.EqualFold(m.Params.Get(2), c.target) {
+			c.start(w)
+		}
+	})
+	return r
+}
+
+// start begins copying the input lines to the target, once.
+func (c *cat) start(w irc.MessageWriter) {
+	if c.started {
+		return
+	}
+	c.started = true
+	go c.copyInput(w)
+}
+
+// copyInput sends each line of in to the target, then quits.
+func (c *cat) copyInput(w irc.MessageWriter) {
+	throttle := time.NewTicker(c.interval)
+	defer throttle.Stop()
+
+	scanner := bufio.NewScanner(c.in)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		if c.target == "" {
+			// without a target, lines are sent as raw IRC commands
+			m := new(irc.Message)
+			if err := m.UnmarshalText([]byte(line)); err != nil {
+				log.Println(err)
+				continue
+			}
+			w.WriteMessage(m)
+		} else {
+			w.WriteMessage(irc.Msg(c.target, line))
+		}
+		<-throttle.C
+	}
+	if err := scanner.Err(); err != nil {
+		log.Println(err)
+	}
+	w.WriteMessage(irc.Quit("irccat"))
+}
+
+// print is middleware which writes received messages to stdout.
+func (c *cat) print(next irc.Handler) irc.Handler {
+	return irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+		switch {
+		case c.raw:
+			b, _ := m.MarshalText()
+			fmt.Fprint(c.out, string(b))
+		case m.Command == irc.CmdPrivmsg:
+			fmt.Fprintf(c.out, "%s <%s> %s\n", m.Params.Get(1), m.Source.Nick, m.Params.Get(2))
+		case m.Command == irc.CmdNotice:
+			fmt.Fprintf(c.out, "%s -%s- %s\n", m.Params.Get(1), sourceName(m.Source), m.Params.Get(2))
+		case m.Command == irc.CTCPAction:
+			fmt.Fprintf(c.out, "%s * %s %s\n", m.Params.Get(1), m.Source.Nick, m.Params.Get(2))
+		case m.Command == irc.CmdError:
+			fmt.Fprintf(c.out, "ERROR %s\n", m.Params.Get(1))
+		}
+		next.SpeakIRC(w, m)
+	})
+}
+
+// sourceName returns the nickname of p, or the server name for server messages.
+func sourceName(p irc.Prefix) string {
+	if p.IsServer() {
+		return p.Host
+	}
+	return string(p.Nick)
+}
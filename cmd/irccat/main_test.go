@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Travis-Britz/irc"
+	"github.com/Travis-Britz/irc/ircserver"
+)
+
+// dial returns a DialFn which connects to s with irc.Pipe.
+func dial(s *ircserver.Server) func() (io.ReadWriteCloser, error) {
+	return func() (io.ReadWriteCloser, error) {
+		client, server := irc.Pipe()
+		go s.ServeConn(server)
+		return client, nil
+	}
+}
+
+func TestCat(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	s := &ircserver.Server{}
+	defer s.Close()
+
+	joined := make(chan struct{})
+	received := make(chan string, 2)
+	listener := &irc.Client{Nickname: "listener", DialFn: dial(s)}
+	r := &irc.Router{}
+	r.OnConnect(func(w irc.MessageWriter, m *irc.Message) {
+		w.WriteMessage(irc.Join("#test"))
+	})
+	r.HandleFunc(irc.RplEndOfNames, func(w irc.MessageWriter, m *irc.Message) {
+		close(joined)
+	})
+	r.OnText("*", func(w irc.MessageWriter, m *irc.Message) {
+		received <- m.Params.Get(2)
+	})
+	go func() { _ = listener.ConnectAndRun(ctx, r) }()
+	select {
+	case <-joined:
+	case <-ctx.Done():
+		t.Fatal("listener never joined the channel")
+	}
+
+	var out bytes.Buffer
+	c := &cat{target: "#test", interval: time.Millisecond, in: strings.NewReader("hello\n\nworld\n"), out: &out}
+	client := &irc.Client{Nickname: "irccat", DialFn: dial(s)}
+	if err := client.ConnectAndRun(ctx, c.handler()); err != nil {
+		t.Errorf("expected irccat to quit without errors once its input was sent; got %v", err)
+	}
+
+	for _, want := range []string{"hello", "world"} {
+		select {
+		case got := <-received:
+			if got != want {
+				t.Errorf("expected %q; got %q", want, got)
+			}
+		case <-ctx.Done():
+			t.Fatalf("expected %q to be received", want)
+		}
+	}
+	if !strings.Contains(out.String(), "ERROR ") {
+		t.Errorf("expected the ERROR of the server to be printed; got %q", out.String())
+	}
+}
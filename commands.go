@@ -1,5 +1,7 @@
 package irc
 
+import "strconv"
+
 // Msg constructs a new Message of type PRIVMSG,
 // with target being the intended target channel or nickname,
 // and message being the text body.
@@ -49,6 +51,8 @@ func Describe(target, action string) *Message {
 }
 
 // TagMsg constructs a TAGMSG command, defined in the IRCv3 message-tags capability.
+//
+// Deprecated: The message has no target, which servers reject. Use TagMsgTo.
 func TagMsg(tags map[string]string) *Message {
 	return &Message{
 		Tags:    tags,
@@ -56,6 +60,44 @@ func TagMsg(tags map[string]string) *Message {
 	}
 }
 
+// TagMsgTo constructs a TAGMSG command to target, a channel or nickname,
+// defined in the IRCv3 message-tags capability.
+// A TAGMSG carries only tags, so they should be client-only tags, like "+typing".
+// tags is copied, so it may be reused by the caller.
+func TagMsgTo(target string, tags Tags) *Message {
+	m := NewMessage(CmdTagMsg, target)
+	for k, v := range tags {
+		m.Tags.Set(k, v)
+	}
+	return m
+}
+
+// React constructs a TAGMSG to target which reacts to the message with the msgid tag msgid, e.g. with an emoji.
+// https://ircv3.net/specs/client-tags/react
+func React(target, msgid, reaction string) *Message {
+	return TagMsgTo(target, Tags{"+draft/react": reaction, "+draft/reply": msgid})
+}
+
+// TypingState is the value of the client-only typing tag.
+// https://ircv3.net/specs/client-tags/typing
+type TypingState string
+
+const (
+	// TypingActive means the user is typing. It should be resent at most every 3 seconds while typing continues.
+	TypingActive TypingState = "active"
+
+	// TypingPaused means the user stopped typing, but hasn't cleared their input.
+	TypingPaused TypingState = "paused"
+
+	// TypingDone means the user cleared their input without sending it.
+	TypingDone TypingState = "done"
+)
+
+// Typing constructs a TAGMSG which tells target whether the user is typing a message to it.
+func Typing(target string, state TypingState) *Message {
+	return TagMsgTo(target, Tags{"+typing": string(state)})
+}
+
 // CTCP constructs a CTCP (Client-to-Client Protocol) encoded
 // message to the target. command is the CTCP subcommand.
 func CTCP(target, command, message string) *Message {
@@ -135,6 +177,116 @@ func Invite(nick, channel string) *Message {
 	return NewMessage(CmdInvite, nick, channel)
 }
 
+// Knock constructs a command to ask the operators of an invite-only channel for an invite.
+// The reason is optional, and not relayed by every server.
+// See Router.OnKnockReply for the server's answer.
+func Knock(channel, reason string) *Message {
+	if reason == "" {
+		return NewMessage(CmdKnock, channel)
+	}
+	return NewMessage(CmdKnock, channel, reason)
+}
+
+// Silence constructs a command to add a mask to the server-side ignore list.
+// Messages from users matching the mask are no longer delivered to the client.
+// Servers which support SILENCE advertise the SILENCE token in RPL_ISUPPORT;
+// see IgnoreList for a list which works on every server.
+func Silence(mask string) *Message {
+	return NewMessage(CmdSilence, "+"+mask)
+}
+
+// Unsilence constructs a command to remove a mask from the server-side ignore list.
+func Unsilence(mask string) *Message {
+	return NewMessage(CmdSilence, "-"+mask)
+}
+
+// SilenceList constructs a command to list the server-side ignore list.
+// The server replies with an RPL_SILELIST (271) for each mask, then RPL_ENDOFSILELIST (272).
+func SilenceList() *Message {
+	return NewMessage(CmdSilence)
+}
+
+// Oper constructs a command to obtain IRC operator privileges.
+func Oper(name, password string) *Message {
+	return NewMessage(CmdOper, name, password)
+}
+
+// Rehash constructs an operator command which makes the server reload its configuration.
+func Rehash() *Message {
+	return NewMessage(CmdRehash)
+}
+
+// Restart constructs an operator command which restarts the server.
+func Restart() *Message {
+	return NewMessage(CmdRestart)
+}
+
+// Die constructs an operator command which shuts down the server.
+func Die() *Message {
+	return NewMessage(CmdDie)
+}
+
+// ConnectServer constructs an operator command which links the server target to the network.
+// If port is 0, the port in the server's configuration is used.
+// If remote is not empty, remote connects to target instead of the server the client is on.
+func ConnectServer(target string, port int, remote string) *Message {
+	switch {
+	case remote != "":
+		return NewMessage(CmdConnect, target, strconv.Itoa(port), remote)
+	case port != 0:
+		return NewMessage(CmdConnect, target, strconv.Itoa(port))
+	}
+	return NewMessage(CmdConnect, target)
+}
+
+// SQuit constructs an operator command which disconnects server from the network.
+func SQuit(server, comment string) *Message {
+	return NewMessage(CmdSQuit, server, comment)
+}
+
+// Stats constructs a command to query statistics of type query, e.g. "u" for the server's uptime.
+// If server is empty, the statistics of the server the client is on are returned.
+// See Client.Stats to collect the replies.
+func Stats(query, server string) *Message {
+	if server == "" {
+		return NewMessage(CmdStats, query)
+	}
+	return NewMessage(CmdStats, query, server)
+}
+
+// LUsers constructs a command to query the size of the network.
+// See Client.LUsers to collect the replies.
+func LUsers() *Message {
+	return NewMessage(CmdLUsers)
+}
+
+// Links constructs a command to list the servers of the network matching mask.
+// If mask is empty, every server is listed.
+// See Client.Links to collect the replies.
+func Links(mask string) *Message {
+	if mask == "" {
+		return NewMessage(CmdLinks)
+	}
+	return NewMessage(CmdLinks, mask)
+}
+
+// Map constructs a command to show the network's server tree, on servers which support it.
+// See Client.Map to collect the replies.
+func Map() *Message {
+	return NewMessage(CmdMap)
+}
+
+// WhoIs constructs a command to query information about the user nick.
+// See Client.Resolve to look up the user's account.
+func WhoIs(nick string) *Message {
+	return NewMessage(CmdWhoIs, nick)
+}
+
+// Who constructs a command to list the users matching mask, such as the members of a channel.
+func Who(mask string) *Message {
+	return NewMessage(CmdWho, mask)
+}
+
 // Ping constructs a command to PING the connection.
 // The server will typically respond with PONG <message>,
 // although it is possible on some networks to ping a specific server,
@@ -206,3 +358,13 @@ func User(user, realname string) *Message {
 func Pass(password string) *Message {
 	return NewMessage(CmdPass, password)
 }
+
+// Authenticate constructs an AUTHENTICATE command used during SASL authentication.
+// payload is either a mechanism name, a base64-encoded chunk of the response,
+// "+" for an empty response, or "*" to abort authentication.
+//
+// The client performs SASL authentication automatically when Client.SASL is set,
+// so there is usually no need to use this directly.
+func Authenticate(payload string) *Message {
+	return NewMessage(CmdAuthenticate, payload)
+}
@@ -0,0 +1,197 @@
+package irc
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Config holds the connection settings of a Client in a form which can be read from a config file,
+// with encoding/json or a TOML package. Use FromConfig to create the Client:
+//
+//	var cfg irc.Config
+//	if err := json.Unmarshal(data, &cfg); err != nil { ... }
+//	client, err := irc.FromConfig(cfg)
+//
+// A JSON config file looks like this:
+//
+//	{
+//		"server": "irc.example.com:6697",
+//		"nick": "HelloBot",
+//		"alt_nicks": ["HelloBot_", "HelloBot__"],
+//		"sasl": {"mechanism": "PLAIN", "account": "HelloBot", "password": "hunter2"},
+//		"perform": ["MODE HelloBot +x"],
+//		"channels": ["#hello", "#secret hunter2"],
+//		"rate_limit": {"penalty": "2s", "burst": "10s"}
+//	}
+type Config struct {
+
+	// Server is the address ("host:port") of the IRC server. See Client.Addr.
+	Server string `json:"server" toml:"server"`
+
+	TLS TLSConfig `json:"tls" toml:"tls"`
+
+	// Pass is the connection password. See Client.Pass.
+	Pass string `json:"pass,omitempty" toml:"pass"`
+
+	// Nick is the nickname of the client (required).
+	Nick string `json:"nick" toml:"nick"`
+
+	// AltNicks are the nicknames tried when Nick is taken. See Client.AltNicks.
+	AltNicks []string `json:"alt_nicks,omitempty" toml:"alt_nicks"`
+
+	User     string `json:"user,omitempty" toml:"user"`
+	Realname string `json:"realname,omitempty" toml:"realname"`
+
+	SASL *SASLConfig `json:"sasl,omitempty" toml:"sasl"`
+
+	// Caps are the IRCv3 capabilities to request. See Client.Caps.
+	Caps []string `json:"caps,omitempty" toml:"caps"`
+
+	// Channels are joined once the client is connected, written as "#channel" or "#channel key". See Client.AutoJoin.
+	Channels []string `json:"channels,omitempty" toml:"channels"`
+
+	// Perform are raw IRC lines written in order once the client is connected, before Channels are joined,
+	// e.g. "MODE HelloBot +x". See Client.Perform.
+	Perform []string `json:"perform,omitempty" toml:"perform"`
+
+	// QuitMessage is the reason sent with QUIT when the client shuts down. See Client.QuitMessage.
+	QuitMessage string `json:"quit_message,omitempty" toml:"quit_message"`
+
+	// RateLimit sets a PenaltyFlood for the client when it's not nil. See Client.FloodControl.
+	RateLimit *RateLimitConfig `json:"rate_limit,omitempty" toml:"rate_limit"`
+
+	// Reconnect makes Client.Run reconnect when it's not nil. See Client.Reconnect.
+	Reconnect *ReconnectConfig `json:"reconnect,omitempty" toml:"reconnect"`
+}
+
+// TLSConfig is the TLS part of a Config.
+type TLSConfig struct {
+
+	// ServerName overrides the name used to verify the server's certificate,
+	// which is otherwise the host of Config.Server.
+	ServerName string `json:"server_name,omitempty" toml:"server_name"`
+
+	// InsecureSkipVerify accepts any certificate presented by the server. It should only be used for testing.
+	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty" toml:"insecure_skip_verify"`
+
+	// CertFile and KeyFile are the client certificate presented to the server, for CertFP.
+	// They're loaded with LoadCertificate, so a new certificate is created if neither file exists.
+	CertFile string `json:"cert_file,omitempty" toml:"cert_file"`
+	KeyFile  string `json:"key_file,omitempty" toml:"key_file"`
+}
+
+// SASLConfig is the SASL part of a Config.
+type SASLConfig struct {
+
+	// Mechanism is "PLAIN" or "EXTERNAL".
+	// If empty, PLAIN is used when Password is set.
+	Mechanism string `json:"mechanism,omitempty" toml:"mechanism"`
+
+	Account  string `json:"account,omitempty" toml:"account"`
+	Password string `json:"password,omitempty" toml:"password"`
+}
+
+// RateLimitConfig is the rate limit part of a Config. See PenaltyFlood.
+type RateLimitConfig struct {
+	Penalty Duration `json:"penalty,omitempty" toml:"penalty"`
+	Burst   Duration `json:"burst,omitempty" toml:"burst"`
+}
+
+// ReconnectConfig is the reconnect part of a Config. See Backoff.
+type ReconnectConfig struct {
+	Min Duration `json:"min,omitempty" toml:"min"`
+	Max Duration `json:"max,omitempty" toml:"max"`
+}
+
+// Duration is a time.Duration which is written as text in config files, e.g. "1m30s".
+type Duration time.Duration
+
+// MarshalText implements encoding.TextMarshaler.
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// FromConfig returns a new Client with the settings of cfg.
+// It returns an error if cfg is missing the server or nickname, or has settings which can't be used.
+func FromConfig(cfg Config) (*Client, error) {
+	if cfg.Server == "" {
+		return nil, errors.New("config: server is required")
+	}
+	if cfg.Nick == "" {
+		return nil, errors.New("config: nick is required")
+	}
+	if strings.Contains(cfg.Nick, " ") {
+		return nil, fmt.Errorf("config: invalid nick %q", cfg.Nick)
+	}
+
+	c := &Client{
+		Addr:        cfg.Server,
+		Pass:        cfg.Pass,
+		Nickname:    cfg.Nick,
+		AltNicks:    cfg.AltNicks,
+		User:        cfg.User,
+		Realname:    cfg.Realname,
+		Caps:        cfg.Caps,
+		AutoJoin:    cfg.Channels,
+		QuitMessage: cfg.QuitMessage,
+	}
+
+	if cfg.TLS.ServerName != "" || cfg.TLS.InsecureSkipVerify {
+		c.TLSConfig = &tls.Config{ServerName: cfg.TLS.ServerName, InsecureSkipVerify: cfg.TLS.InsecureSkipVerify}
+	}
+	if cfg.TLS.CertFile != "" || cfg.TLS.KeyFile != "" {
+		if cfg.TLS.CertFile == "" || cfg.TLS.KeyFile == "" {
+			return nil, errors.New("config: tls needs both cert_file and key_file")
+		}
+		cert, err := LoadCertificate(cfg.TLS.CertFile, cfg.TLS.KeyFile, cfg.Nick)
+		if err != nil {
+			return nil, fmt.Errorf("config: %w", err)
+		}
+		c.Certificate = &cert
+	}
+
+	if s := cfg.SASL; s != nil {
+		mech := strings.ToUpper(s.Mechanism)
+		if mech == "" && s.Password != "" {
+			mech = "PLAIN"
+		}
+		switch mech {
+		case "PLAIN":
+			account := s.Account
+			if account == "" {
+				account = cfg.Nick
+			}
+			c.SASL = SASLPlain(account, s.Password)
+		case "EXTERNAL":
+			c.SASL = SASLExternal()
+		case "":
+		default:
+			return nil, fmt.Errorf("config: unsupported SASL mechanism %q", s.Mechanism)
+		}
+	}
+
+	for _, line := range cfg.Perform {
+		c.Perform = append(c.Perform, PerformLine(line))
+	}
+
+	if r := cfg.RateLimit; r != nil {
+		c.FloodControl = &PenaltyFlood{Penalty: time.Duration(r.Penalty), Burst: time.Duration(r.Burst)}
+	}
+	if r := cfg.Reconnect; r != nil {
+		c.Reconnect = &Backoff{Min: time.Duration(r.Min), Max: time.Duration(r.Max)}
+	}
+	return c, nil
+}
@@ -0,0 +1,96 @@
+package irc
+
+import (
+	"sort"
+	"strings"
+)
+
+// ConnInfo is a read-only snapshot of the facts negotiated on the client's current connection,
+// for handlers and middleware which don't hold a reference to the Client. See ConnInfoOf.
+type ConnInfo struct {
+
+	// Nick is the client's nickname.
+	Nick Nickname
+
+	// Server is the name of the server the client is connected to, from RPL_MYINFO (004).
+	Server string
+
+	isupport map[string]string
+	caps     []string // sorted
+}
+
+// ISupport returns the value of an RPL_ISUPPORT (005) token, and whether the server advertised it, as in Client.ISupport.
+func (ci ConnInfo) ISupport(name string) (value string, ok bool) {
+	value, ok = ci.isupport[strings.ToUpper(name)]
+	return value, ok
+}
+
+// IsChannel reports whether target is a channel name, by the channel types the server advertised with CHANTYPES.
+// Servers which don't advertise CHANTYPES are assumed to support '#' and '&' channels.
+func (ci ConnInfo) IsChannel(target string) bool {
+	chantypes, ok := ci.ISupport("CHANTYPES")
+	if !ok {
+		chantypes = "#&"
+	}
+	return target != "" && strings.ContainsRune(chantypes, rune(target[0]))
+}
+
+// fold returns the nickname or channel name s in lowercase, according to the CASEMAPPING of the server.
+// See Client.fold.
+func (ci ConnInfo) fold(s string) string {
+	casemapping, _ := ci.ISupport("CASEMAPPING")
+	return foldNick(s, casemapping)
+}
+
+// CapEnabled reports whether the IRCv3 capability name was enabled, as in Client.CapEnabled.
+func (ci ConnInfo) CapEnabled(name string) bool {
+	i := sort.SearchStrings(ci.caps, name)
+	return i < len(ci.caps) && ci.caps[i] == name
+}
+
+// Caps returns the names of the enabled IRCv3 capabilities, sorted.
+func (ci ConnInfo) Caps() []string {
+	return append([]string(nil), ci.caps...)
+}
+
+// ConnInfo returns a snapshot of the current connection.
+func (c *Client) ConnInfo() ConnInfo {
+	caps := c.EnabledCaps()
+	sort.Strings(caps)
+	c.state.mu.RLock()
+	defer c.state.mu.RUnlock()
+	return ConnInfo{
+		Nick:     Nickname(c.state.nick),
+		Server:   c.state.server,
+		isupport: c.state.isupport.snapshot(),
+		caps:     caps,
+	}
+}
+
+// ConnInfoOf returns a snapshot of the connection of w, the MessageWriter passed to a handler,
+// and whether w belongs to a connection:
+//
+//	func handleThanks(w irc.MessageWriter, m *irc.Message) {
+//		if info, ok := irc.ConnInfoOf(w); ok && info.CapEnabled("message-tags") {
+//			w.WriteMessage(irc.React(m.Params.Get(1), m.Tags["msgid"], "❤️"))
+//		}
+//	}
+//
+// MessageWriters which wrap another MessageWriter, like the ones of middleware, should implement
+//
+//	Unwrap() MessageWriter
+//
+// returning the wrapped writer, so that ConnInfoOf can find the connection behind them.
+func ConnInfoOf(w MessageWriter) (ConnInfo, bool) {
+	for w != nil {
+		if c, ok := w.(interface{ ConnInfo() ConnInfo }); ok {
+			return c.ConnInfo(), true
+		}
+		u, ok := w.(interface{ Unwrap() MessageWriter })
+		if !ok {
+			break
+		}
+		w = u.Unwrap()
+	}
+	return ConnInfo{}, false
+}
@@ -2,54 +2,60 @@ package irc
 
 // irc commands which may be sent or received by a client.
 const (
-	CmdAdmin    = "ADMIN"    // Get information about the administrator of a server.
-	CmdAway     = "AWAY"     // Set an automatic reply string for any PRIVMSG commands.
-	CmdCap      = "CAP"      // IRCv3 Capability negotiation.
-	CmdConnect  = "CONNECT"  // Request a new connection to another server immediately.
-	CmdDie      = "DIE"      // Shutdown the server.
-	CmdError    = "ERROR"    // Report a serious or fatal error to a peer.
-	CmdInfo     = "INFO"     // Get information describing a server.
-	CmdInvite   = "INVITE"   // Invite a user to a channel.
-	CmdIsOn     = "ISON"     // Determine if a nickname is currently on IRC.
-	CmdJoin     = "JOIN"     // Join a channel.
-	CmdKick     = "KICK"     // Request the forced removal of a user from a channel.
-	CmdKill     = "KILL"     // Close a client-server connection by the server which has the actual connection.
-	CmdLinks    = "LINKS"    // List all servernames which are known by the server answering the query.
-	CmdList     = "LIST"     // List channels and their topics.
-	CmdLUsers   = "LUSERS"   // Get statistics about the size of the IRC network.
-	CmdMode     = "MODE"     // User mode.
-	CmdMOTD     = "MOTD"     // Get the Message of the Day.
-	CmdNames    = "NAMES"    // List all visible nicknames.
-	CmdNick     = "NICK"     // ":<newnick>" Define a nickname.
-	CmdNJoin    = "NJOIN"    // Exchange the list of channel members for each channel between servers.
-	CmdNotice   = "NOTICE"   // Send a notice message to specific users or channels.
-	CmdOper     = "OPER"     // Obtain operator privileges.
-	CmdPart     = "PART"     // Leave a channel.
-	CmdPass     = "PASS"     // Set a connection password.
-	CmdPing     = "PING"     // Test for the presence of an active client or server.
-	CmdPong     = "PONG"     // Reply to a PING message.
-	CmdPrivmsg  = "PRIVMSG"  // Send private messages between users, as well as to send messages to channels.
-	CmdQuit     = "QUIT"     // Terminate the client session.
-	CmdRehash   = "REHASH"   // Force the server to re-read and process its configuration file.
-	CmdRestart  = "RESTART"  // Force the server to restart itself.
-	CmdServer   = "SERVER"   // Register a new server.
-	CmdService  = "SERVICE"  // Register a new service.
-	CmdServList = "SERVLIST" // List services currently connected to the network.
-	CmdSQuery   = "SQUERY"   //
-	CmdSQuit    = "SQUIT"    // Break a local or remote server link.
-	CmdStats    = "STATS"    // Get server statistics.
-	CmdTagMsg   = "TAGMSG"   // https://ircv3.net/specs/extensions/message-tags.html
-	CmdTime     = "TIME"     // Get the local time from the specified server.
-	CmdTopic    = "TOPIC"    // Change or view the topic of a channel.
-	CmdTrace    = "TRACE"    // Find the route to a server and information about it's peers.
-	CmdUser     = "USER"     // Specify the username, hostname and realname of a new user.
-	CmdUserHost = "USERHOST" // Get a list of information about upto 5 nicknames.
-	CmdUsers    = "USERS"    // Get a list of users logged into the server.
-	CmdVersion  = "VERSION"  // Get the version of the server program.
-	CmdWAllOps  = "WALLOPS"  // Send a message to all currently connected users who have set the 'w' user mode.
-	CmdWho      = "WHO"      // List a set of users.
-	CmdWhoIs    = "WHOIS"    // Get information about a specific user.
-	CmdWhoWas   = "WHOWAS"   // Get information about a nickname which no longer exists.
+	CmdAccount      = "ACCOUNT"      // IRCv3 account-notify: a user logged in to or out of an account.
+	CmdAdmin        = "ADMIN"        // Get information about the administrator of a server.
+	CmdAuthenticate = "AUTHENTICATE" // IRCv3 SASL authentication.
+	CmdAway         = "AWAY"         // Set an automatic reply string for any PRIVMSG commands.
+	CmdCap          = "CAP"          // IRCv3 Capability negotiation.
+	CmdChgHost      = "CHGHOST"      // IRCv3 chghost: a user's user name or host changed.
+	CmdConnect      = "CONNECT"      // Request a new connection to another server immediately.
+	CmdDie          = "DIE"          // Shutdown the server.
+	CmdError        = "ERROR"        // Report a serious or fatal error to a peer.
+	CmdInfo         = "INFO"         // Get information describing a server.
+	CmdInvite       = "INVITE"       // Invite a user to a channel.
+	CmdIsOn         = "ISON"         // Determine if a nickname is currently on IRC.
+	CmdJoin         = "JOIN"         // Join a channel.
+	CmdKick         = "KICK"         // Request the forced removal of a user from a channel.
+	CmdKill         = "KILL"         // Close a client-server connection by the server which has the actual connection.
+	CmdKnock        = "KNOCK"        // Request an invite to a channel.
+	CmdLinks        = "LINKS"        // List all servernames which are known by the server answering the query.
+	CmdList         = "LIST"         // List channels and their topics.
+	CmdMap          = "MAP"          // Show the network's server tree (not part of RFC 1459 or 2812).
+	CmdLUsers       = "LUSERS"       // Get statistics about the size of the IRC network.
+	CmdMode         = "MODE"         // User mode.
+	CmdMOTD         = "MOTD"         // Get the Message of the Day.
+	CmdNames        = "NAMES"        // List all visible nicknames.
+	CmdNick         = "NICK"         // ":<newnick>" Define a nickname.
+	CmdNJoin        = "NJOIN"        // Exchange the list of channel members for each channel between servers.
+	CmdNotice       = "NOTICE"       // Send a notice message to specific users or channels.
+	CmdOper         = "OPER"         // Obtain operator privileges.
+	CmdPart         = "PART"         // Leave a channel.
+	CmdPass         = "PASS"         // Set a connection password.
+	CmdPing         = "PING"         // Test for the presence of an active client or server.
+	CmdPong         = "PONG"         // Reply to a PING message.
+	CmdPrivmsg      = "PRIVMSG"      // Send private messages between users, as well as to send messages to channels.
+	CmdQuit         = "QUIT"         // Terminate the client session.
+	CmdRehash       = "REHASH"       // Force the server to re-read and process its configuration file.
+	CmdRestart      = "RESTART"      // Force the server to restart itself.
+	CmdServer       = "SERVER"       // Register a new server.
+	CmdService      = "SERVICE"      // Register a new service.
+	CmdServList     = "SERVLIST"     // List services currently connected to the network.
+	CmdSilence      = "SILENCE"      // Manage the server-side list of users whose messages are not delivered to the client.
+	CmdSQuery       = "SQUERY"       //
+	CmdSQuit        = "SQUIT"        // Break a local or remote server link.
+	CmdStats        = "STATS"        // Get server statistics.
+	CmdTagMsg       = "TAGMSG"       // https://ircv3.net/specs/extensions/message-tags.html
+	CmdTime         = "TIME"         // Get the local time from the specified server.
+	CmdTopic        = "TOPIC"        // Change or view the topic of a channel.
+	CmdTrace        = "TRACE"        // Find the route to a server and information about it's peers.
+	CmdUser         = "USER"         // Specify the username, hostname and realname of a new user.
+	CmdUserHost     = "USERHOST"     // Get a list of information about upto 5 nicknames.
+	CmdUsers        = "USERS"        // Get a list of users logged into the server.
+	CmdVersion      = "VERSION"      // Get the version of the server program.
+	CmdWAllOps      = "WALLOPS"      // Send a message to all currently connected users who have set the 'w' user mode.
+	CmdWho          = "WHO"          // List a set of users.
+	CmdWhoIs        = "WHOIS"        // Get information about a specific user.
+	CmdWhoWas       = "WHOWAS"       // Get information about a nickname which no longer exists.
 )
 
 // irc connection reply codes.
@@ -59,6 +65,8 @@ const (
 	RplCreated  = "003" // "This server was created <date>"
 	RplMyInfo   = "004" // "<servername> <version> <available user modes> <available channel modes>"
 	RplISupport = "005" // http://www.irc.org/tech_docs/005.html http://www.irc.org/tech_docs/draft-brocklesby-irc-isupport-03.txt https://www.mirc.com/isupport.html
+	RplMap      = "006" // "<nick> :<server tree line>" A line of the MAP command's drawing of the network.
+	RplMapEnd   = "007" // "<nick> :End of /MAP"
 	RplBounce   = "010" // "Try server <server name>, port <port number>" - https://modern.ircdocs.horse/#rplbounce-010
 )
 
@@ -95,6 +103,10 @@ const (
 	RplTraceLog        = "261" // "File <logfile> <debug level>"
 	RplTraceEnd        = "262" // "<server name> <version & debug level> :End of TRACE"
 	RplTryAgain        = "263" // "<command> :Please wait a while and try again."
+	RplLocalUsers      = "265" // "<nick> [<u> <m>] :Current local users <u>, max <m>"
+	RplGlobalUsers     = "266" // "<nick> [<u> <m>] :Current global users <u>, max <m>"
+	RplSilEList        = "271" // "<nick> <mask>" An entry of the SILENCE list.
+	RplEndOfSilEList   = "272" // "<nick> :End of Silence List"
 	RplAway            = "301" // "<nick> :<away message>"
 	RplUserHost        = "302" // ":*1<reply> *( " " <reply> )"
 	RplIsOn            = "303" // ":*1<nick> *( " " <nick> )"
@@ -113,6 +125,8 @@ const (
 	RplListEnd         = "323" // ":End of LIST"
 	RplChannelModeIs   = "324" // "<channel> <mode> <mode params>"
 	RplUniqOpIs        = "325" // "<channel> <nickname>"
+	RplCreationTime    = "329" // "<channel> <creationtime>"
+	RplWhoIsAccount    = "330" // "<nick> <account> :is logged in as"
 	RplNoTopic         = "331" // "<channel> :No topic is set"
 	RplTopic           = "332" // "<channel> :<topic>"
 	RplWhoisBot        = "335" // "<nick> <target> :<message>"
@@ -125,6 +139,7 @@ const (
 	RplVersion         = "351" // "<version>.<debuglevel> <server>:<comments>"
 	RplWhoReply        = "352" // "<channel> <user> <host> <server><nick> ( "H" / "G" > ["*"] [ ("@" / "+" ) ] :<hopcount> <real name>"
 	RplNamReply        = "353" // "( "=" / "*" / "@" ) <channel>:[ "@" / "+" ] <nick> *( " " ["@" / "+" ] <nick> )"
+	RplWhoSpcRpl       = "354" // "<token> <fields...>" The reply to a WHOX query, with the fields it asked for.
 	RplLinks           = "364" // "<mask> <server> :<hopcount> <serverinfo>"
 	RplEndOfLinks      = "365" // "<mask> :End of LINKS list"
 	RplEndOfNames      = "366" // "<channel> :End of NAMES list"
@@ -203,6 +218,32 @@ const (
 	RplErrNoOperHost        = "491" // ":No O-lines for your host"
 	RplErrUModeUnknownFlag  = "501" // ":Unknown MODE flag"
 	RplErrUsersDontMatch    = "502" // ":Cannot change mode for other users"
+	RplErrSilEListFull      = "511" // "<nick> <mask> :Your silence list is full"
+	RplErrNoPrivs           = "723" // "<nick> <priv> :Insufficient oper privileges."
+)
+
+// KNOCK reply codes.
+// https://modern.ircdocs.horse/#knock-message
+const (
+	RplKnock           = "710" // "<channel> <channel> <nick>!<user>@<host> :has asked for an invite." Sent to the channel's operators.
+	RplKnockDlvr       = "711" // "<nick> <channel> :Your KNOCK has been delivered."
+	RplErrTooManyKnock = "712" // "<nick> <channel> :Too many KNOCKs (channel)."
+	RplErrChanOpen     = "713" // "<nick> <channel> :Channel is open."
+	RplErrKnockOnChan  = "714" // "<nick> <channel> :You are already on that channel."
+)
+
+// IRCv3 SASL authentication reply codes.
+// https://ircv3.net/specs/extensions/sasl-3.1
+const (
+	RplLoggedIn       = "900" // "<nick> <nick>!<ident>@<host> <account> :You are now logged in as <user>"
+	RplLoggedOut      = "901" // "<nick> <nick>!<ident>@<host> :You are now logged out"
+	RplErrNickLocked  = "902" // "<nick> :You must use a nick assigned to you"
+	RplSASLSuccess    = "903" // "<nick> :SASL authentication successful"
+	RplErrSASLFail    = "904" // "<nick> :SASL authentication failed"
+	RplErrSASLTooLong = "905" // "<nick> :SASL message too long"
+	RplErrSASLAborted = "906" // "<nick> :SASL authentication aborted"
+	RplErrSASLAlready = "907" // "<nick> :You have already authenticated using SASL"
+	RplSASLMechs      = "908" // "<nick> <mechanisms> :are available SASL mechanisms"
 )
 
 // Client-to-Client Protocol command constants. These commands are NOT sent by the server; they are instead generated
@@ -222,4 +263,11 @@ const (
 	CTCPPingReply = "_CTCP_REPLY_PING"
 	CTCPTimeQuery = "_CTCP_QUERY_TIME"
 	CTCPTimeReply = "_CTCP_REPLY_TIME"
+
+	CTCPSourceQuery   = "_CTCP_QUERY_SOURCE"
+	CTCPSourceReply   = "_CTCP_REPLY_SOURCE"
+	CTCPUserInfoQuery = "_CTCP_QUERY_USERINFO"
+	CTCPUserInfoReply = "_CTCP_REPLY_USERINFO"
+	CTCPFingerQuery   = "_CTCP_QUERY_FINGER"
+	CTCPFingerReply   = "_CTCP_REPLY_FINGER"
 )
@@ -0,0 +1,75 @@
+package irc
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// CTCPResponder answers the common CTCP queries on behalf of the client:
+// PING, TIME, and CLIENTINFO always, and VERSION, SOURCE, USERINFO, and FINGER when their text is set.
+// The queries are still passed on to the client's handler afterwards.
+//
+// See Client.CTCP.
+type CTCPResponder struct {
+
+	// Version is the reply to VERSION, e.g. "mybot 1.2 (github.com/Travis-Britz/irc)".
+	Version string
+
+	// Source is the reply to SOURCE, typically where the bot's source code can be found.
+	Source string
+
+	// UserInfo is the reply to USERINFO, a description chosen by the bot's owner.
+	UserInfo string
+
+	// Finger is the reply to FINGER, traditionally the real name and idle time of the user.
+	Finger string
+}
+
+// replies returns the replies of r to each CTCP subcommand it answers.
+// PING is answered separately, since its reply echoes the query.
+func (r *CTCPResponder) replies() map[string]func() string {
+	replies := map[string]func() string{
+		"TIME": func() string { return time.Now().Format(time.RFC1123Z) },
+	}
+	for subcommand, text := range map[string]string{
+		"VERSION":  r.Version,
+		"SOURCE":   r.Source,
+		"USERINFO": r.UserInfo,
+		"FINGER":   r.Finger,
+	} {
+		if text != "" {
+			text := text
+			replies[subcommand] = func() string { return text }
+		}
+	}
+	return replies
+}
+
+func (r *CTCPResponder) middleware(next Handler) Handler {
+	return HandlerFunc(func(w MessageWriter, m *Message) {
+		subcommand, ok := strings.CutPrefix(m.Command.String(), "_CTCP_QUERY_")
+		if !ok || m.Source.Nick == "" {
+			next.SpeakIRC(w, m)
+			return
+		}
+		nick := m.Source.Nick.String()
+		replies := r.replies()
+		switch subcommand {
+		case "PING":
+			w.WriteMessage(CTCPReply(nick, subcommand, m.Params.Get(2)))
+		case "CLIENTINFO":
+			supported := []string{"ACTION", "CLIENTINFO", "PING"}
+			for s := range replies {
+				supported = append(supported, s)
+			}
+			sort.Strings(supported)
+			w.WriteMessage(CTCPReply(nick, subcommand, strings.Join(supported, " ")))
+		default:
+			if reply := replies[subcommand]; reply != nil {
+				w.WriteMessage(CTCPReply(nick, subcommand, reply()))
+			}
+		}
+		next.SpeakIRC(w, m)
+	})
+}
@@ -0,0 +1,218 @@
+package irc
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// A Resolver looks up the IP addresses of a host name for the default dialer.
+// *net.Resolver implements Resolver.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// AddressFamily controls which IP addresses of a server the default dialer connects to.
+type AddressFamily int
+
+const (
+	// FamilyAuto tries addresses in the order returned by the Resolver.
+	// The first address's family is tried first, and the other family is tried in parallel
+	// if it hasn't connected after a short delay ("happy eyeballs", RFC 8305).
+	FamilyAuto AddressFamily = iota
+
+	// PreferIPv4 tries IPv4 addresses first, falling back to IPv6 like FamilyAuto.
+	PreferIPv4
+
+	// PreferIPv6 tries IPv6 addresses first, falling back to IPv4 like FamilyAuto.
+	PreferIPv6
+
+	// IPv4Only never connects to IPv6 addresses.
+	// It's useful for networks with broken AAAA records.
+	IPv4Only
+
+	// IPv6Only never connects to IPv4 addresses.
+	IPv6Only
+)
+
+// DefaultDialTimeout is how long the default dialer may spend resolving, connecting, and completing the TLS handshake
+// when Client.DialTimeout is 0.
+const DefaultDialTimeout = 30 * time.Second
+
+const (
+	// fallbackDelay is how long the first address family gets before the other is tried in parallel.
+	fallbackDelay = 300 * time.Millisecond
+)
+
+// split divides addrs into those which are tried first and the fallbacks, according to f.
+func (f AddressFamily) split(addrs []net.IPAddr) (primaries, fallbacks []net.IPAddr) {
+	if len(addrs) == 0 {
+		return nil, nil
+	}
+	var primary func(net.IPAddr) bool
+	switch f {
+	case PreferIPv4, IPv4Only:
+		primary = isIPv4
+	case PreferIPv6, IPv6Only:
+		primary = func(a net.IPAddr) bool { return !isIPv4(a) }
+	default:
+		first := isIPv4(addrs[0])
+		primary = func(a net.IPAddr) bool { return isIPv4(a) == first }
+	}
+	for _, a := range addrs {
+		if primary(a) {
+			primaries = append(primaries, a)
+		} else {
+			fallbacks = append(fallbacks, a)
+		}
+	}
+	if f == IPv4Only || f == IPv6Only {
+		return primaries, nil
+	}
+	if len(primaries) == 0 {
+		return fallbacks, nil
+	}
+	return primaries, fallbacks
+}
+
+func isIPv4(a net.IPAddr) bool {
+	return a.IP.To4() != nil
+}
+
+// dialAddr is the default dialer: it connects to Addr over TLS.
+// It gives up when ctx is done, or after DialTimeout.
+func (c *Client) dialAddr(ctx context.Context) (io.ReadWriteCloser, error) {
+	timeout := c.DialTimeout
+	if timeout == 0 {
+		timeout = DefaultDialTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	host, port, err := net.SplitHostPort(c.Addr)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := c.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	primaries, fallbacks := c.AddressFamily.split(addrs)
+	if len(primaries) == 0 {
+		return nil, &net.AddrError{Err: "no suitable address found", Addr: host}
+	}
+	conn, err := dialParallel(ctx, primaries, fallbacks, port)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := c.tlsConfig()
+	if cfg == nil {
+		cfg = &tls.Config{}
+	}
+	if cfg.ServerName == "" {
+		cfg = cfg.Clone()
+		cfg.ServerName = host
+	}
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// resolve returns the addresses of host, which may already be an IP address.
+func (c *Client) resolve(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+	var r Resolver = net.DefaultResolver
+	if c.Resolver != nil {
+		r = c.Resolver
+	}
+	return r.LookupIPAddr(ctx, host)
+}
+
+// dialParallel connects to the first of primaries that accepts a connection.
+// If fallbacks is not empty, they are tried in parallel once fallbackDelay has passed
+// or the primaries have failed, whichever is first.
+func dialParallel(ctx context.Context, primaries, fallbacks []net.IPAddr, port string) (net.Conn, error) {
+	if len(fallbacks) == 0 {
+		return dialSerial(ctx, primaries, port)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn    net.Conn
+		err     error
+		primary bool
+	}
+	results := make(chan result)
+	dial := func(addrs []net.IPAddr, primary bool) {
+		conn, err := dialSerial(ctx, addrs, port)
+		select {
+		case results <- result{conn: conn, err: err, primary: primary}:
+		case <-ctx.Done():
+			if conn != nil {
+				_ = conn.Close()
+			}
+		}
+	}
+
+	go dial(primaries, true)
+	fallbackTimer := time.NewTimer(fallbackDelay)
+	defer fallbackTimer.Stop()
+
+	var firstErr error
+	fallbackStarted := false
+	pending := 1
+	startFallback := func() {
+		if !fallbackStarted {
+			fallbackStarted = true
+			pending++
+			go dial(fallbacks, false)
+		}
+	}
+	for {
+		select {
+		case <-fallbackTimer.C:
+			startFallback()
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				return res.conn, nil
+			}
+			if firstErr == nil || res.primary {
+				firstErr = res.err
+			}
+			// the fallbacks don't need to wait for the delay once the primaries failed
+			startFallback()
+			if pending == 0 {
+				return nil, firstErr
+			}
+		}
+	}
+}
+
+// dialSerial tries each of addrs in order, returning the first connection made.
+func dialSerial(ctx context.Context, addrs []net.IPAddr, port string) (net.Conn, error) {
+	var d net.Dialer
+	var errs []error
+	for _, a := range addrs {
+		conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(a.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Join(errs...)
+}
@@ -0,0 +1,135 @@
+package irc
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DisconnectCause classifies why a server closed our connection,
+// as far as can be told from its ERROR or KILL message.
+type DisconnectCause int
+
+const (
+	// CauseUnknown is any disconnect which didn't match a known reason.
+	CauseUnknown DisconnectCause = iota
+
+	// CauseBanned means the client is banned from the server, e.g. K-lined, G-lined, or Z-lined.
+	// Reconnecting won't work until the ban expires or is removed.
+	CauseBanned
+
+	// CauseThrottled means the client reconnected too quickly.
+	CauseThrottled
+
+	// CauseTooManyConnections means there are too many connections from the client's host or network.
+	CauseTooManyConnections
+
+	// CausePingTimeout means the server stopped hearing from the client.
+	CausePingTimeout
+
+	// CauseKilled means the connection was closed by a KILL from a server operator or services.
+	CauseKilled
+)
+
+func (c DisconnectCause) String() string {
+	switch c {
+	case CauseBanned:
+		return "banned"
+	case CauseThrottled:
+		return "throttled"
+	case CauseTooManyConnections:
+		return "too many connections"
+	case CausePingTimeout:
+		return "ping timeout"
+	case CauseKilled:
+		return "killed"
+	default:
+		return "unknown"
+	}
+}
+
+// Retry reports whether reconnecting may succeed, and how long to wait at least before trying.
+// Reconnect loops should never retry after CauseBanned; reconnecting to a server which banned the client
+// tends to make the ban longer or wider.
+func (c DisconnectCause) Retry() (ok bool, delay time.Duration) {
+	switch c {
+	case CauseBanned:
+		return false, 0
+	case CauseThrottled:
+		return true, time.Minute
+	case CauseTooManyConnections:
+		return true, 5 * time.Minute
+	case CauseKilled:
+		return true, 30 * time.Second
+	default:
+		return true, 0
+	}
+}
+
+// DisconnectError is returned by Client.ConnectAndRun when the server explained why it closed the connection,
+// with an ERROR message or a KILL for the client. Use errors.As to inspect it:
+//
+//	var disconnect *irc.DisconnectError
+//	if errors.As(err, &disconnect) {
+//		if ok, delay := disconnect.Cause.Retry(); !ok { ... }
+//	}
+type DisconnectError struct {
+	Cause DisconnectCause
+
+	// Reason is the text of the ERROR or KILL message.
+	Reason string
+
+	// By is the source of a KILL.
+	By Prefix
+
+	// Err is the error which ended the connection, usually io.EOF.
+	Err error
+}
+
+func (e *DisconnectError) Error() string {
+	if e.By != (Prefix{}) {
+		return fmt.Sprintf("disconnected (%s): killed by %s: %s", e.Cause, e.By, e.Reason)
+	}
+	return fmt.Sprintf("disconnected (%s): %s", e.Cause, e.Reason)
+}
+
+func (e *DisconnectError) Unwrap() error {
+	return e.Err
+}
+
+// disconnectReasons maps lowercase fragments of ERROR and KILL reasons to their cause.
+// They're tested in order, so bans come first: "K-lined: too many connections" is still a ban.
+var disconnectReasons = []struct {
+	fragment string
+	cause    DisconnectCause
+}{
+	{"k-line", CauseBanned},
+	{"g-line", CauseBanned},
+	{"z-line", CauseBanned},
+	{"d-line", CauseBanned},
+	{"akill", CauseBanned},
+	{"banned", CauseBanned},
+	{"throttl", CauseThrottled},
+	{"too fast", CauseThrottled},
+	{"too many", CauseTooManyConnections},
+	{"clones", CauseTooManyConnections},
+	{"ping timeout", CausePingTimeout},
+}
+
+// classifyDisconnect returns the cause described by an ERROR or KILL message.
+func classifyDisconnect(m *Message) *DisconnectError {
+	e := &DisconnectError{Reason: m.Params.Get(1)}
+	if m.Command.is(CmdKill) {
+		e.Cause = CauseKilled
+		e.By = m.Source
+		e.Reason = m.Params.Get(2)
+	}
+	reason := strings.ToLower(e.Reason)
+	for _, r := range disconnectReasons {
+		if strings.Contains(reason, r.fragment) {
+			e.Cause = r.cause
+			break
+		}
+	}
+	return e
+}
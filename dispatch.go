@@ -0,0 +1,246 @@
+package irc
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultSlowHandler is how long handling a message may take before the client reports it,
+// when Client.SlowHandler is 0.
+const DefaultSlowHandler = 5 * time.Second
+
+// SlowDispatch describes a message which took the client's handler longer than Client.SlowHandler.
+// While a handler runs, no other message is handled, including the PINGs which keep the connection alive,
+// so slow handlers eventually cause ping timeouts.
+//
+// SlowDispatch is an error so that it can be written to Client.ErrorLog.
+type SlowDispatch struct {
+	Command Command
+
+	// Route and Handler identify the Router route which handled the message, as in RouteInfo.
+	// They're empty when the client's handler is not a Router, or no route matched.
+	Route   string
+	Handler string
+
+	Duration time.Duration
+
+	// Queued is the number of messages which were waiting to be handled when the handler returned.
+	Queued int
+}
+
+func (sd SlowDispatch) Error() string {
+	s := fmt.Sprintf("slow handler: %s took %s", sd.Command, sd.Duration.Round(time.Millisecond))
+	switch {
+	case sd.Route != "":
+		s += fmt.Sprintf(" in route %q (%s)", sd.Route, sd.Handler)
+	case sd.Handler != "":
+		s += " in " + sd.Handler
+	}
+	return s + fmt.Sprintf("; %d messages queued", sd.Queued)
+}
+
+// DispatchStats summarizes how long the client's handler took for the messages of the current connection.
+type DispatchStats struct {
+
+	// Dispatched is the number of messages passed to the handler.
+	Dispatched uint64
+
+	// TotalDuration and MaxDuration summarize how long the handler took.
+	TotalDuration time.Duration
+	MaxDuration   time.Duration
+
+	// Slow is the number of messages which took longer than Client.SlowHandler.
+	Slow uint64
+
+	// MaxQueued is the highest number of messages which were waiting while the handler ran,
+	// out of Client.QueueSize.
+	MaxQueued int
+}
+
+// dispatchRecord is attached to a message while the client's handler runs,
+// so that a Router can report which route handled it.
+type dispatchRecord struct {
+	route   string
+	handler string
+
+	// depth is the number of Redispatch calls which led to the message; 0 for messages from the server.
+	depth int
+
+	// submatch is the OnTextRESubmatch matcher which last matched the message, and groups are the submatches it found,
+	// so that the route's handler doesn't run the expression a second time.
+	submatch *submatchMatch
+	groups   []string
+}
+
+// MaxRedispatchDepth is how deeply Redispatch calls may nest,
+// e.g. a handler of a message passed to Redispatch passing another message to Redispatch.
+const MaxRedispatchDepth = 8
+
+// Errors returned by Redispatch.
+var (
+	ErrNotDispatching = errors.New("redispatch: cause is not being handled")
+	ErrRedispatchLoop = errors.New("redispatch: too many nested messages")
+)
+
+// Redispatch passes m, a synthetic message such as a single mode change split out of a MODE message,
+// or a message relayed from another network, to the client's handler as if it was read from the connection.
+// Routes and middleware see m like any other message, instead of each feature calling its next Handler with a rewritten message.
+//
+// Redispatch must be called by the handler of cause, which is the message being handled, before the handler returns.
+// m is handled before Redispatch returns. CTCP messages in m are decoded, and the messages written in response
+// are checked by the LoopGuard, but m doesn't change the state tracked by the client, such as channel members,
+// which was already updated by cause.
+//
+// A handler of m may pass further messages to Redispatch, up to MaxRedispatchDepth levels deep;
+// beyond that, ErrRedispatchLoop is returned and the message is dropped, so that a handler which
+// redispatches the messages it handles can't loop forever.
+func (c *Client) Redispatch(cause, m *Message) error {
+	if cause == nil || cause.dispatch == nil || c.redispatch == nil {
+		return ErrNotDispatching
+	}
+	depth := cause.dispatch.depth + 1
+	if depth > MaxRedispatchDepth {
+		return ErrRedispatchLoop
+	}
+	m.dispatch = &dispatchRecord{depth: depth}
+	defer func() { m.dispatch = nil }()
+	c.redispatch.SpeakIRC(c.handlerWriter(m), m)
+	return nil
+}
+
+// handlerWriter returns the MessageWriter passed to the client's handler for m.
+func (c *Client) handlerWriter(m *Message) MessageWriter {
+	if c.Audit != nil {
+		return &auditWriter{client: c, cause: m}
+	}
+	return c
+}
+
+// AuditRecord describes a message written by the client, and what wrote it. See Client.Audit.
+type AuditRecord struct {
+	Time    time.Time
+	Message encoding.TextMarshaler
+
+	// Cause is the message which the client's handler was handling when it wrote Message.
+	// It's nil for messages written outside of the handler, e.g. from timers or other goroutines
+	// which write to the Client itself rather than to the MessageWriter passed to the handler.
+	Cause *Message
+
+	// Route and Handler identify the Router route whose handler wrote the message, as in SlowDispatch.
+	// They're empty when the message wasn't written by a route, e.g. by the client's own middleware.
+	Route   string
+	Handler string
+
+	// Err is the reason the message wasn't written, as returned by WriteMessageE.
+	Err error
+}
+
+// auditWriter is passed to the client's handler in place of the client while Client.Audit is set,
+// so that the messages written by the handler are attributed to the message and route which caused them.
+type auditWriter struct {
+	client  *Client
+	cause   *Message
+	route   string
+	handler string
+}
+
+// WriteMessage implements MessageWriter.
+func (w *auditWriter) WriteMessage(m encoding.TextMarshaler) {
+	w.client.logWriteError(w.client.auditWrite(m, w))
+}
+
+// Unwrap returns the client. See ConnInfoOf.
+func (w *auditWriter) Unwrap() MessageWriter { return w.client }
+
+// routeWriter is implemented by the MessageWriters which can attribute the messages written through them to a route.
+// Router passes the writer returned by forRoute to the route it dispatches a message to.
+// Writers which wrap another MessageWriter should implement it by wrapping the result of the inner writer's forRoute.
+type routeWriter interface {
+	forRoute(rt *route) MessageWriter
+}
+
+func (w *auditWriter) forRoute(rt *route) MessageWriter {
+	rw := *w
+	rw.route, rw.handler = rt.name, rt.handler
+	return &rw
+}
+
+// auditWrite writes m and reports it to Client.Audit.
+// src describes what wrote m; it's nil for messages written outside of the handler.
+func (c *Client) auditWrite(m encoding.TextMarshaler, src *auditWriter) error {
+	err := c.sanitizeWrite(m)
+	if c.Audit == nil {
+		return err
+	}
+	rec := AuditRecord{Time: time.Now(), Message: m, Err: err}
+	if src != nil {
+		rec.Cause, rec.Route, rec.Handler = src.cause, src.route, src.handler
+	}
+	c.Audit(rec)
+	return err
+}
+
+// dispatchStats collects the DispatchStats of a connection.
+type dispatchStats struct {
+	mu sync.Mutex
+	DispatchStats
+}
+
+func (ds *dispatchStats) reset() {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.DispatchStats = DispatchStats{}
+}
+
+// DispatchStats returns the statistics of the client's handler since the connection started.
+func (c *Client) DispatchStats() DispatchStats {
+	c.dispatch.mu.Lock()
+	defer c.dispatch.mu.Unlock()
+	return c.dispatch.DispatchStats
+}
+
+// dispatchMessage passes m to the client's handler, and reports it if the handler was slow.
+// queued returns the number of messages waiting.
+func (c *Client) dispatchMessage(m *Message, queued func() int) {
+	rec := &dispatchRecord{}
+	m.dispatch = rec
+	start := time.Now()
+	c.handler.SpeakIRC(c.handlerWriter(m), m)
+	d := time.Since(start)
+	m.dispatch = nil
+
+	threshold := c.SlowHandler
+	if threshold == 0 {
+		threshold = DefaultSlowHandler
+	}
+	slow := threshold > 0 && d > threshold
+	n := queued()
+
+	c.dispatch.mu.Lock()
+	s := &c.dispatch.DispatchStats
+	s.Dispatched++
+	s.TotalDuration += d
+	if d > s.MaxDuration {
+		s.MaxDuration = d
+	}
+	if n > s.MaxQueued {
+		s.MaxQueued = n
+	}
+	if slow {
+		s.Slow++
+	}
+	c.dispatch.mu.Unlock()
+
+	if !slow {
+		return
+	}
+	sd := SlowDispatch{Command: m.Command, Route: rec.route, Handler: rec.handler, Duration: d, Queued: n}
+	if c.OnSlowHandler != nil {
+		c.OnSlowHandler(sd)
+		return
+	}
+	c.log(sd)
+}
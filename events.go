@@ -0,0 +1,287 @@
+package irc
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Typed events are an optional layer over Message for the most common commands.
+// Each event type decodes the positional parameters of its command into named fields,
+// so that handlers don't need to remember which parameter holds what.
+// The original message is kept in each event for everything else, such as tags.
+// Handlers for any event type, including those defined outside of this package, are attached with On.
+
+// PrivmsgEvent is a PRIVMSG, sent to a channel or directly to the client.
+// CTCP messages are not PrivmsgEvents; see OnCTCP.
+// The client decodes them before they reach a handler, and Decode rejects the ones which weren't decoded,
+// such as a PRIVMSG read from a log.
+type PrivmsgEvent struct {
+	Message *Message
+	Sender  Prefix
+
+	// Target is the channel or nickname the message was sent to,
+	// including any STATUSMSG prefix, e.g. "@#channel".
+	Target string
+
+	// Channel is the channel the message was sent to without any STATUSMSG prefix,
+	// or empty when the message was sent directly to the client.
+	Channel string
+
+	Text string
+}
+
+// Command implements Event.
+func (e *PrivmsgEvent) Command() Command { return CmdPrivmsg }
+
+// Decode implements Event. m must be a PRIVMSG, and its text must not be CTCP-framed.
+func (e *PrivmsgEvent) Decode(m *Message) error {
+	if err := expect(m, CmdPrivmsg, 2); err != nil {
+		return err
+	}
+	if strings.HasPrefix(m.Params.Get(2), "\x01") {
+		return fmt.Errorf("decode %s: message is a CTCP query", CmdPrivmsg)
+	}
+	*e = PrivmsgEvent{
+		Message: m,
+		Sender:  m.Source,
+		Target:  m.Params.Get(1),
+		Channel: channelOf(m.Params.Get(1)),
+		Text:    m.Params.Get(2),
+	}
+	return nil
+}
+
+// NoticeEvent is a NOTICE, sent to a channel or directly to the client.
+// Server notices have an empty Sender.Nick.
+type NoticeEvent struct {
+	Message *Message
+	Sender  Prefix
+
+	// Target and Channel are the same as in PrivmsgEvent.
+	Target  string
+	Channel string
+
+	Text string
+}
+
+// Command implements Event.
+func (e *NoticeEvent) Command() Command { return CmdNotice }
+
+// Decode implements Event. m must be a NOTICE.
+func (e *NoticeEvent) Decode(m *Message) error {
+	if err := expect(m, CmdNotice, 2); err != nil {
+		return err
+	}
+	*e = NoticeEvent{
+		Message: m,
+		Sender:  m.Source,
+		Target:  m.Params.Get(1),
+		Channel: channelOf(m.Params.Get(1)),
+		Text:    m.Params.Get(2),
+	}
+	return nil
+}
+
+// JoinEvent is a user, possibly the client, joining a channel.
+type JoinEvent struct {
+	Message *Message
+	Sender  Prefix
+	Channel string
+
+	// Account and Realname are only known when the extended-join capability is enabled.
+	// Account is empty when the user isn't logged in.
+	Account  string
+	Realname string
+}
+
+// Command implements Event.
+func (e *JoinEvent) Command() Command { return CmdJoin }
+
+// Decode implements Event. m must be a JOIN.
+func (e *JoinEvent) Decode(m *Message) error {
+	if err := expect(m, CmdJoin, 1); err != nil {
+		return err
+	}
+	*e = JoinEvent{
+		Message:  m,
+		Sender:   m.Source,
+		Channel:  m.Params.Get(1),
+		Account:  m.Params.Get(2),
+		Realname: m.Params.Get(3),
+	}
+	if e.Account == "*" {
+		e.Account = ""
+	}
+	return nil
+}
+
+// PartEvent is a user, possibly the client, leaving a channel.
+type PartEvent struct {
+	Message *Message
+	Sender  Prefix
+	Channel string
+	Reason  string
+}
+
+// Command implements Event.
+func (e *PartEvent) Command() Command { return CmdPart }
+
+// Decode implements Event. m must be a PART.
+func (e *PartEvent) Decode(m *Message) error {
+	if err := expect(m, CmdPart, 1); err != nil {
+		return err
+	}
+	*e = PartEvent{Message: m, Sender: m.Source, Channel: m.Params.Get(1), Reason: m.Params.Get(2)}
+	return nil
+}
+
+// KickEvent is a user, possibly the client, being kicked from a channel.
+type KickEvent struct {
+	Message *Message
+
+	// Sender is whoever did the kicking.
+	Sender  Prefix
+	Channel string
+	Kicked  Nickname
+	Reason  string
+}
+
+// Command implements Event.
+func (e *KickEvent) Command() Command { return CmdKick }
+
+// Decode implements Event. m must be a KICK.
+func (e *KickEvent) Decode(m *Message) error {
+	if err := expect(m, CmdKick, 2); err != nil {
+		return err
+	}
+	*e = KickEvent{
+		Message: m,
+		Sender:  m.Source,
+		Channel: m.Params.Get(1),
+		Kicked:  Nickname(m.Params.Get(2)),
+		Reason:  m.Params.Get(3),
+	}
+	return nil
+}
+
+// QuitEvent is a user disconnecting from the server.
+type QuitEvent struct {
+	Message *Message
+	Sender  Prefix
+	Reason  string
+}
+
+// Command implements Event.
+func (e *QuitEvent) Command() Command { return CmdQuit }
+
+// Decode implements Event. m must be a QUIT.
+func (e *QuitEvent) Decode(m *Message) error {
+	if err := expect(m, CmdQuit, 0); err != nil {
+		return err
+	}
+	*e = QuitEvent{Message: m, Sender: m.Source, Reason: m.Params.Get(1)}
+	return nil
+}
+
+// NickEvent is a user, possibly the client, changing their nickname.
+type NickEvent struct {
+	Message *Message
+
+	// Sender is the user's address under their old nickname.
+	Sender Prefix
+	Old    Nickname
+	New    Nickname
+}
+
+// Command implements Event.
+func (e *NickEvent) Command() Command { return CmdNick }
+
+// Decode implements Event. m must be a NICK.
+func (e *NickEvent) Decode(m *Message) error {
+	if err := expect(m, CmdNick, 1); err != nil {
+		return err
+	}
+	*e = NickEvent{Message: m, Sender: m.Source, Old: m.Source.Nick, New: Nickname(m.Params.Get(1))}
+	return nil
+}
+
+// TopicEvent is a change of a channel's topic.
+type TopicEvent struct {
+	Message *Message
+	Sender  Prefix
+	Channel string
+
+	// Topic is empty when the topic was cleared.
+	Topic string
+}
+
+// Command implements Event.
+func (e *TopicEvent) Command() Command { return CmdTopic }
+
+// Decode implements Event. m must be a TOPIC.
+func (e *TopicEvent) Decode(m *Message) error {
+	if err := expect(m, CmdTopic, 1); err != nil {
+		return err
+	}
+	*e = TopicEvent{Message: m, Sender: m.Source, Channel: m.Params.Get(1), Topic: m.Params.Get(2)}
+	return nil
+}
+
+// ModeEvent is a change of the modes of a channel or of the client.
+// The modes are not split into individual changes, since that needs the server's CHANMODES and PREFIX tokens.
+type ModeEvent struct {
+	Message *Message
+	Sender  Prefix
+
+	// Target is the channel or nickname whose modes changed.
+	Target string
+
+	// Modes is the mode string, e.g. "+ov-b".
+	Modes string
+
+	// Args are the parameters of the modes which take one, in order.
+	Args []string
+}
+
+// Command implements Event.
+func (e *ModeEvent) Command() Command { return CmdMode }
+
+// Decode implements Event. m must be a MODE.
+func (e *ModeEvent) Decode(m *Message) error {
+	if err := expect(m, CmdMode, 2); err != nil {
+		return err
+	}
+	*e = ModeEvent{
+		Message: m,
+		Sender:  m.Source,
+		Target:  m.Params.Get(1),
+		Modes:   m.Params.Get(2),
+		Args:    append([]string(nil), m.Params[2:]...),
+	}
+	return nil
+}
+
+// expect returns an error unless m is a cmd message with at least n parameters.
+func expect(m *Message, cmd Command, n int) error {
+	if !m.Command.is(cmd) {
+		return fmt.Errorf("decode %s: message is a %s", cmd, m.Command)
+	}
+	if len(m.Params) < n {
+		return fmt.Errorf("decode %s: expected at least %d parameters; got %d", cmd, n, len(m.Params))
+	}
+	return nil
+}
+
+// channelOf returns the channel name in target, without STATUSMSG prefixes,
+// or an empty string if target is not a channel.
+func channelOf(target string) string {
+	channel := target
+	// '&' is both a prefix and a channel type, so a prefix is only removed when it's followed by another
+	for len(channel) > 1 && strings.ContainsRune("~&@%+", rune(channel[0])) && strings.ContainsRune("~&@%+#!", rune(channel[1])) {
+		channel = channel[1:]
+	}
+	if channel == "" || !strings.ContainsRune("#&!", rune(channel[0])) {
+		return ""
+	}
+	return channel
+}
@@ -53,7 +53,7 @@ func Example_router() {
 
 	// Listen for interrupt signals (Ctrl+C) and initiate
 	// a graceful shutdown sequence when one is received.
-	shutdown := make(chan os.Signal)
+	shutdown := make(chan os.Signal, 1)
 	go func() {
 		<-shutdown
 		cancel()
@@ -2,6 +2,7 @@ package irc_test
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -130,6 +131,18 @@ func ExampleClient_ConnectAndRun_reconnect() {
 					if err != nil {
 						delay = delay*2 + time.Second
 					}
+					// the server may have told us to stay away for a while, or for good
+					var disconnect *irc.DisconnectError
+					if errors.As(err, &disconnect) {
+						retry, min := disconnect.Cause.Retry()
+						if !retry {
+							log.Println("not reconnecting:", disconnect)
+							return
+						}
+						if delay < min {
+							delay = min
+						}
+					}
 					log.Println("reconnect delay:", delay)
 				}
 
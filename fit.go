@@ -0,0 +1,98 @@
+package irc
+
+import (
+	"strings"
+	"text/template"
+	"unicode/utf8"
+
+	"github.com/Travis-Britz/irc/internal/formatting"
+)
+
+// Ellipsis is appended by Ellipsize to text which was shortened.
+const Ellipsis = "…"
+
+// Ellipsize shortens text to at most n bytes, ending it with Ellipsis when anything was cut.
+//
+// The cut is made at a word boundary when there's one near the end,
+// and never splits a UTF-8 character or a color code.
+// If the kept text uses formatting, a reset code is added before the ellipsis, so the formatting doesn't run on.
+func Ellipsize(text string, n int) string {
+	if len(text) <= n {
+		return text
+	}
+	if n <= 0 {
+		return ""
+	}
+	tail := Ellipsis
+	if strings.ContainsAny(text, formatting.Chars) {
+		tail = string(formatting.Reset) + Ellipsis
+	}
+	if n < len(tail) {
+		return text[:runeStart(text, n)]
+	}
+	cut := runeStart(text, n-len(tail))
+	cut = colorStart(text, cut)
+
+	// prefer the end of a word, unless that loses too much of the text
+	if i := strings.LastIndexByte(text[:cut], ' '); i > 0 && cut-i <= 16 {
+		cut = i
+	}
+	kept := strings.TrimRight(text[:cut], " ")
+	if !strings.ContainsAny(kept, formatting.Chars) {
+		tail = Ellipsis
+	}
+	return kept + tail
+}
+
+// runeStart returns the largest i <= n which is the start of a character in s.
+func runeStart(s string, n int) int {
+	for n > 0 && n < len(s) && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return n
+}
+
+// colorStart moves n back to the start of the color code which it's inside of, if any.
+func colorStart(s string, n int) int {
+	for i := 0; i < n; i++ {
+		var l int
+		switch s[i] {
+		case formatting.Color:
+			_, _, l = formatting.ParseColor(s[i+1:])
+		case formatting.HexColor:
+			_, _, l = formatting.ParseHexColor(s[i+1:])
+		default:
+			continue
+		}
+		if i+1+l > n {
+			return i
+		}
+		i += l
+	}
+	return n
+}
+
+// TextBudget returns the number of bytes available to the text of a PRIVMSG sent by the client to target,
+// before the server is likely to truncate it. See LineBudget.
+func (c *Client) TextBudget(target string) int {
+	// "PRIVMSG <target> :<text>"
+	return c.LineBudget() - len(CmdPrivmsg) - 1 - len(target) - 2
+}
+
+// FitMsg returns a PRIVMSG to target with text shortened by Ellipsize to fit the client's TextBudget,
+// for announcements which must not be truncated by the server in the middle of a word or character.
+func (c *Client) FitMsg(target, text string) *Message {
+	return Msg(target, Ellipsize(text, c.TextBudget(target)))
+}
+
+// TemplateMsg executes tmpl with data and returns the result as a PRIVMSG to target, shortened like FitMsg:
+//
+//	announce := template.Must(template.New("release").Parse("{{.Name}} {{.Version}} released: {{.Notes}}"))
+//	m, err := client.TemplateMsg("#releases", announce, release)
+func (c *Client) TemplateMsg(target string, tmpl *template.Template, data any) (*Message, error) {
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return nil, err
+	}
+	return c.FitMsg(target, b.String()), nil
+}
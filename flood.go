@@ -0,0 +1,370 @@
+package irc
+
+import (
+	"context"
+	"encoding"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A FloodControl paces the messages written by a Client, so that the server doesn't
+// drop them or disconnect the client for flooding.
+//
+// Delay is called for each message before it's written, in the order the messages are written,
+// and returns how long the client must wait before writing m. The FloodControl should count m
+// as sent at the end of the delay.
+//
+// PONG and QUIT messages are never delayed, and Delay is not called for them.
+//
+// If the FloodControl also has a method Observe(*Message), it's called with every message the client receives,
+// e.g. to learn the limits of a channel.
+type FloodControl interface {
+	Delay(m *Message) time.Duration
+}
+
+type floodObserver interface {
+	Observe(m *Message)
+}
+
+// PenaltyFlood is the flood control described in RFC 1459 section 8.10, which most servers implement in some form:
+// every message adds a penalty to a timer, and messages may only be sent while the timer is less than Burst ahead of now.
+// This allows short bursts of messages, followed by one message per Penalty.
+//
+// The zero value uses a Penalty of 2 seconds and a Burst of 10 seconds.
+type PenaltyFlood struct {
+	Penalty time.Duration
+	Burst   time.Duration
+
+	mu    sync.Mutex
+	timer time.Time
+}
+
+// Delay implements FloodControl.
+func (f *PenaltyFlood) Delay(m *Message) time.Duration {
+	penalty, burst := f.Penalty, f.Burst
+	if penalty <= 0 {
+		penalty = 2 * time.Second
+	}
+	if burst <= 0 {
+		burst = 10 * time.Second
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	if f.timer.Before(now) {
+		f.timer = now
+	}
+	var delay time.Duration
+	if ahead := f.timer.Sub(now); ahead > burst {
+		delay = ahead - burst
+	}
+	f.timer = f.timer.Add(penalty)
+	return delay
+}
+
+// Snapshot implements Snapshotter, so that the penalty timer survives a restart.
+func (f *PenaltyFlood) Snapshot() ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return json.Marshal(penaltySnapshot{Timer: f.timer})
+}
+
+// Restore implements Snapshotter.
+func (f *PenaltyFlood) Restore(data []byte) error {
+	var snap penaltySnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.timer = snap.Timer
+	return nil
+}
+
+type penaltySnapshot struct {
+	Timer time.Time `json:"timer"`
+}
+
+// Twitch's documented limits for chat messages.
+const (
+	twitchWindow       = 30 * time.Second
+	twitchLimit        = 20  // messages per window
+	twitchModLimit     = 100 // messages per window, in channels where the bot is a moderator or the broadcaster
+	twitchJoinWindow   = 10 * time.Second
+	twitchJoinLimit    = 20
+	twitchVerifiedJoin = 2000
+)
+
+// TwitchFlood is the flood control for Twitch chat, which limits the number of messages per 30 seconds
+// rather than their rate:
+//
+//   - 20 messages in channels where the bot is a regular user,
+//   - 100 messages in channels where the bot is a moderator or the broadcaster, or for verified bots,
+//   - one message per slow mode interval in channels with slow mode, unless the bot is a moderator,
+//   - 20 JOINs per 10 seconds (2000 for verified bots).
+//
+// The bot's roles and each channel's slow mode are learned from the USERSTATE and ROOMSTATE messages,
+// which Twitch sends when the twitch.tv/commands and twitch.tv/tags capabilities are enabled.
+//
+// A Client uses a TwitchFlood automatically when it's connected to Twitch and Client.FloodControl is nil.
+type TwitchFlood struct {
+
+	// Verified raises the limits for bots which Twitch has verified.
+	Verified bool
+
+	mu       sync.Mutex
+	sent     []time.Time // when messages were sent, in order
+	joins    []time.Time
+	channels map[string]*twitchChannel
+}
+
+// twitchChannel is what TwitchFlood knows about a channel.
+type twitchChannel struct {
+	mod      bool
+	slow     time.Duration
+	lastSent time.Time
+}
+
+// Delay implements FloodControl.
+func (f *TwitchFlood) Delay(m *Message) time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+
+	switch {
+	case m.Command.is(CmdJoin):
+		limit := twitchJoinLimit
+		if f.Verified {
+			limit = twitchVerifiedJoin
+		}
+		// a JOIN may list several channels, and each counts towards the limit
+		var slot time.Time
+		for range strings.Split(m.Params.Get(1), ",") {
+			slot = reserve(&f.joins, now, twitchJoinWindow, limit)
+		}
+		return slot.Sub(now)
+	case m.Command.is(CmdPrivmsg):
+	default:
+		return 0
+	}
+
+	ch := f.channel(m.Params.Get(1))
+	limit := twitchLimit
+	if ch.mod || f.Verified {
+		limit = twitchModLimit
+	}
+	earliest := now
+	if !ch.mod && ch.slow > 0 && ch.lastSent.Add(ch.slow).After(earliest) {
+		earliest = ch.lastSent.Add(ch.slow)
+	}
+	slot := reserve(&f.sent, earliest, twitchWindow, limit)
+	ch.lastSent = slot
+	return slot.Sub(now)
+}
+
+// reserve records a message sent at the earliest time at or after earliest that keeps
+// the number of messages in any window at most limit, and returns that time.
+// sent holds the times of the previous messages, in order.
+func reserve(sent *[]time.Time, earliest time.Time, window time.Duration, limit int) time.Time {
+	times := *sent
+	// times which are outside of every window that could still matter are forgotten
+	for len(times) > 0 && times[0].Add(window).Before(earliest.Add(-window)) {
+		times = times[1:]
+	}
+	slot := earliest
+	for {
+		// count the messages in the window ending at slot
+		start := sort.Search(len(times), func(i int) bool { return times[i].After(slot.Add(-window)) })
+		end := sort.Search(len(times), func(i int) bool { return times[i].After(slot) })
+		if end-start < limit {
+			break
+		}
+		slot = times[end-limit].Add(window)
+	}
+	i := sort.Search(len(times), func(i int) bool { return times[i].After(slot) })
+	times = append(times, time.Time{})
+	copy(times[i+1:], times[i:])
+	times[i] = slot
+	*sent = times
+	return slot
+}
+
+func (f *TwitchFlood) channel(name string) *twitchChannel {
+	name = strings.ToLower(name)
+	if f.channels == nil {
+		f.channels = make(map[string]*twitchChannel)
+	}
+	ch := f.channels[name]
+	if ch == nil {
+		ch = &twitchChannel{}
+		f.channels[name] = ch
+	}
+	return ch
+}
+
+// Observe learns the bot's roles and the channels' slow mode from m.
+func (f *TwitchFlood) Observe(m *Message) {
+	switch m.Command {
+	// USERSTATE describes the bot in a channel, after joining and after each message it sends.
+	case "USERSTATE":
+		mod := m.Tags.Get("mod") == "1" || strings.Contains(","+m.Tags.Get("badges"), ",broadcaster/")
+		f.mu.Lock()
+		f.channel(m.Params.Get(1)).mod = mod
+		f.mu.Unlock()
+	// ROOMSTATE describes the settings of a channel; updates only include the settings that changed.
+	case "ROOMSTATE":
+		if !m.Tags.Has("slow") {
+			return
+		}
+		seconds, _ := strconv.Atoi(m.Tags.Get("slow"))
+		f.mu.Lock()
+		f.channel(m.Params.Get(1)).slow = time.Duration(seconds) * time.Second
+		f.mu.Unlock()
+	}
+}
+
+// Snapshot implements Snapshotter, so that the messages counted towards the limits survive a restart.
+func (f *TwitchFlood) Snapshot() ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	snap := twitchSnapshot{Sent: f.sent, Joins: f.joins, Channels: make(map[string]twitchChannelSnapshot, len(f.channels))}
+	for name, ch := range f.channels {
+		snap.Channels[name] = twitchChannelSnapshot{Mod: ch.mod, Slow: ch.slow, LastSent: ch.lastSent}
+	}
+	return json.Marshal(snap)
+}
+
+// Restore implements Snapshotter.
+func (f *TwitchFlood) Restore(data []byte) error {
+	var snap twitchSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sent, f.joins = snap.Sent, snap.Joins
+	f.channels = make(map[string]*twitchChannel, len(snap.Channels))
+	for name, ch := range snap.Channels {
+		f.channels[name] = &twitchChannel{mod: ch.Mod, slow: ch.Slow, lastSent: ch.LastSent}
+	}
+	return nil
+}
+
+type twitchSnapshot struct {
+	Sent     []time.Time                      `json:"sent"`
+	Joins    []time.Time                      `json:"joins"`
+	Channels map[string]twitchChannelSnapshot `json:"channels"`
+}
+
+type twitchChannelSnapshot struct {
+	Mod      bool          `json:"mod,omitempty"`
+	Slow     time.Duration `json:"slow,omitempty"`
+	LastSent time.Time     `json:"last_sent"`
+}
+
+// isTwitch reports whether the server is Twitch chat.
+func isTwitch(server string) bool {
+	return server == "tmi.twitch.tv" || strings.HasSuffix(server, ".tmi.twitch.tv")
+}
+
+// floodGate applies the FloodControl of a connection.
+type floodGate struct {
+	ctx     context.Context
+	client  *Client
+	control FloodControl // guarded by client.connMu; nil if writes aren't paced
+
+	// waiting counts the writes delayed by the FloodControl,
+	// and idle is closed when the count drops to zero, for a shutdown waiting for the delayed writes.
+	mu      sync.Mutex
+	waiting int
+	idle    chan struct{}
+}
+
+// floodWait blocks until m may be written, or the connection is closed.
+// done must be called after m was written.
+func (c *Client) floodWait(m encoding.TextMarshaler) (done func()) {
+	msg, ok := m.(*Message)
+	if !ok || msg.Command.is(CmdPong) || msg.Command.is(CmdQuit) {
+		return func() {}
+	}
+	c.connMu.Lock()
+	gate := c.flood
+	var control FloodControl
+	if gate != nil {
+		control = gate.control
+	}
+	c.connMu.Unlock()
+	if control == nil {
+		return func() {}
+	}
+	delay := control.Delay(msg)
+	if delay <= 0 {
+		return func() {}
+	}
+	gate.mu.Lock()
+	gate.waiting++
+	gate.mu.Unlock()
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-gate.ctx.Done():
+	}
+	return gate.written
+}
+
+// written records that a delayed write is done.
+func (g *floodGate) written() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.waiting--
+	if g.waiting == 0 && g.idle != nil {
+		close(g.idle)
+		g.idle = nil
+	}
+}
+
+// drain waits until the writes delayed by the FloodControl are done, or ctx is done.
+func (g *floodGate) drain(ctx context.Context) {
+	g.mu.Lock()
+	if g.waiting == 0 {
+		g.mu.Unlock()
+		return
+	}
+	if g.idle == nil {
+		g.idle = make(chan struct{})
+	}
+	idle := g.idle
+	g.mu.Unlock()
+	select {
+	case <-idle:
+	case <-ctx.Done():
+	case <-g.ctx.Done():
+	}
+}
+
+// middleware selects TwitchFlood on Twitch, and shows incoming messages to the FloodControl.
+func (g *floodGate) middleware(next Handler) Handler {
+	return HandlerFunc(func(w MessageWriter, m *Message) {
+		g.client.connMu.Lock()
+		var created bool
+		if m.Command == RplWelcome && g.client.FloodControl == nil && isTwitch(m.Source.Host) {
+			g.control = &TwitchFlood{}
+			created = true
+		}
+		control := g.control
+		g.client.connMu.Unlock()
+		if created {
+			g.client.restoreFlood(control)
+		}
+		if o, ok := control.(floodObserver); ok {
+			o.Observe(m)
+		}
+		next.SpeakIRC(w, m)
+	})
+}
@@ -1,11 +1,8 @@
 package irc
 
 import (
-	"context"
 	"regexp"
 	"strings"
-	"sync"
-	"time"
 )
 
 // A Handler responds to an IRC message.
@@ -46,6 +43,23 @@ func wrap(h Handler, mw ...middleware) Handler {
 
 var ctcpRegex = regexp.MustCompile("^\\x01([^ \\x01]+) ?(.*?)\\x01?$")
 
+// CTCPParsing controls how strictly the client recognizes CTCP messages.
+type CTCPParsing int
+
+const (
+	// CTCPLenient recognizes messages which start with the CTCP delimiter \x01,
+	// whether or not they end with one, since some clients leave out the closing delimiter.
+	CTCPLenient CTCPParsing = iota
+
+	// CTCPStrict only recognizes messages which are enclosed in \x01 delimiters.
+	CTCPStrict
+
+	// CTCPEmbedded also recognizes a CTCP message embedded in the middle of a line,
+	// as sent by some broken clients and allowed by the original CTCP specification.
+	// The text around the CTCP message is discarded.
+	CTCPEmbedded
+)
+
 // ctcpHandler looks for incoming PRIVMSG or NOTICE messages that match the CTCP protocol,
 // and if found, modifies the Message's Command field and strips CTCP formatting from
 // the message parameters before passing the message to the next Handler.
@@ -53,167 +67,69 @@ var ctcpRegex = regexp.MustCompile("^\\x01([^ \\x01]+) ?(.*?)\\x01?$")
 // ctcpHandler MUST be called before any handlers or middleware which need to
 // differentiate between regular PRIVMSG/NOTICE and CTCP messages.
 func ctcpHandler(next Handler) Handler {
-	return HandlerFunc(func(mw MessageWriter, m *Message) {
-		if !m.Command.is(CmdPrivmsg) && !m.Command.is(CmdNotice) {
-			next.SpeakIRC(mw, m)
-			return
-		}
-		body := m.Params.Get(2)
-		if len(body) == 0 {
-			next.SpeakIRC(mw, m)
-			return
-		}
-		if body[0] != 0x01 { // "\x01" is the ctcp delim
-			next.SpeakIRC(mw, m)
-			return
-		}
-		parts := ctcpRegex.FindStringSubmatch(body)
-		// parts should never be nil if we made it this far, but if it is we pass it on
-		// because we don't know how to deal with it
-		if parts == nil {
-			next.SpeakIRC(mw, m)
-			return
-		}
-		// now we know the message is either a CTCP or CTCP Reply
-		subcommand := parts[1]
-		body = parts[2]
-
-		switch m.Command {
-		case CmdPrivmsg:
-			m.Command = CTCPAction
-			m.Command = NewCTCPCmd(subcommand)
-		case CmdNotice:
-			m.Command = NewCTCPReplyCmd(subcommand)
-		}
-		m.Params[1] = body
-		next.SpeakIRC(mw, m)
-	})
+	return ctcpDecoder(CTCPLenient)(next)
 }
 
-// pingMiddleware intercepts server PING messages and replies with the appropriate PONG.
-func pingMiddleware(next Handler) Handler {
-	return HandlerFunc(func(mw MessageWriter, m *Message) {
-		if !m.Command.is(CmdPing) {
+// ctcpDecoder returns the middleware of ctcpHandler, recognizing CTCP messages according to mode.
+func ctcpDecoder(mode CTCPParsing) middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(mw MessageWriter, m *Message) {
+			if !m.Command.is(CmdPrivmsg) && !m.Command.is(CmdNotice) {
+				next.SpeakIRC(mw, m)
+				return
+			}
+			body := ctcpBody(m.Params.Get(2), mode)
+			if len(body) == 0 {
+				next.SpeakIRC(mw, m)
+				return
+			}
+			parts := ctcpRegex.FindStringSubmatch(body)
+			// parts should never be nil if we made it this far, but if it is we pass it on
+			// because we don't know how to deal with it
+			if parts == nil {
+				next.SpeakIRC(mw, m)
+				return
+			}
+			// now we know the message is either a CTCP or CTCP Reply
+			subcommand := parts[1]
+			body = parts[2]
+
+			switch m.Command {
+			case CmdPrivmsg:
+				m.Command = NewCTCPCmd(subcommand)
+			case CmdNotice:
+				m.Command = NewCTCPReplyCmd(subcommand)
+			}
+			m.Params[1] = body
 			next.SpeakIRC(mw, m)
-			return
-		}
-		mw.WriteMessage(Pong(m.Params.Get(1)))
-	})
-}
-
-type pingHandler struct {
-	sync.Mutex
-	expecting map[string]chan bool
-	timeout   func()
-}
-
-func (ph *pingHandler) ping(ctx context.Context, mw MessageWriter, m string) {
-	ph.Lock()
-	defer ph.Unlock()
-
-	if ph.expecting == nil {
-		ph.expecting = make(map[string]chan bool)
-	}
-
-	// if we're already expecting a reply for the given ping then we skip sending another
-	// in order to simplify the logic. having duplicate in-flight pings would not
-	// be of any benefit.
-	if _, exists := ph.expecting[m]; exists {
-		return
+		})
 	}
-
-	ret := make(chan bool, 1)
-	ph.expecting[m] = ret
-	go func() {
-		// we know this is the only goroutine waiting for a reply to m, so when it exits
-		// for any reason we must remove the reference.
-		defer func() {
-			ph.Lock()
-			defer ph.Unlock()
-			delete(ph.expecting, m)
-		}()
-
-		select {
-		case <-ret:
-		case <-ctx.Done():
-		case <-time.After(10 * time.Second):
-			ph.timeout()
-		}
-	}()
-	mw.WriteMessage(Ping(m))
 }
 
-func (ph *pingHandler) pongHandler(next Handler) Handler {
-	return HandlerFunc(func(mw MessageWriter, m *Message) {
-		if !m.Command.is(CmdPong) {
-			next.SpeakIRC(mw, m)
-			return
-		}
-
-		ph.Lock()
-		defer ph.Unlock()
-
-		reply := m.Params.Get(2)
-
-		// if we were not expecting the reply, pass it on
-		if _, expected := ph.expecting[reply]; !expected {
-			next.SpeakIRC(mw, m)
-			return
+// ctcpBody returns the CTCP part of text, starting with the \x01 delimiter,
+// or an empty string if text is not a CTCP message according to mode.
+func ctcpBody(text string, mode CTCPParsing) string {
+	if len(text) < 2 {
+		return ""
+	}
+	switch mode {
+	case CTCPStrict:
+		if text[0] != 0x01 || text[len(text)-1] != 0x01 {
+			return ""
 		}
-
-		// if we were expecting the reply, intercept it and don't pass it on
-		select {
-		case ph.expecting[reply] <- true:
-		default:
+	case CTCPEmbedded:
+		start := strings.IndexByte(text, 0x01)
+		if start < 0 {
+			return ""
 		}
-	})
-}
-
-// capLSHandler listens for replies to CAP LS and completes capability negotiation.
-//
-// "CAP * LS * :extended-join chghost cap-notify userhost-in-names multi-prefix"
-// "CAP * LS :extended-join chghost cap-notify userhost-in-names multi-prefix"
-// "CAP <nick> ACK :extended-join "
-// "CAP <nick> LIST * :extended-join chghost cap-notify userhost-in-names multi-prefix away-notify account-notify"
-// "CAP <nick> LIST :extended-join chghost cap-notify userhost-in-names multi-prefix away-notify account-notify"
-// https://ircv3.net/specs/core/capability-negotiation.html
-func capLSHandler(next Handler) Handler {
-	return HandlerFunc(func(mw MessageWriter, m *Message) {
-		// the next handler is always called first so that other middleware which request capabilities
-		// will write their message before we complete negotiation.
-		next.SpeakIRC(mw, m)
-
-		if !m.Command.is(CmdCap) {
-			return
+		text = text[start:]
+		if end := strings.IndexByte(text[1:], 0x01); end >= 0 {
+			text = text[:end+2]
 		}
-
-		// if this is ever true then something is either wrong with the server or with our message parser
-		if len(m.Params) < 3 {
-			return
+	default:
+		if text[0] != 0x01 { // "\x01" is the ctcp delim
+			return ""
 		}
-
-		// the 2nd param is the CAP subcommand (LS, ACK, etc.)
-		switch strings.ToUpper(m.Params.Get(2)) {
-
-		// LS lists the capabilities supported by the server
-		case "LS", "NEW":
-			// the list of capabilities are in the last (trailing) parameter, separated by SPACE
-			// caps := strings.Fields(m.Params.Get(len(m.Params)))
-			// for _, cap := range caps {
-			// 	// request cap
-			// }
-
-			// An asterisk in the 3rd param (before the CAP list) indicates there will be more lines coming
-			// for the CAP LS response. If this is the last line we request a list of the caps enabled and send CAP END.
-			// However, if the server does not support CAP Version 302 then multiple lines will be sent without the asterisk,
-			// which will cause *each* line to trigger us to send CAP LIST and CAP END. This should be fine, since additional
-			// capabilities can be requested at any time (the additional requests would be sent after cap negotiation has ended).
-			// Note that we send CAP END before handling the response of CAP LIST. This is intentional, since we have
-			// no reason to wait for the response.
-			if m.Params.Get(3) != "*" {
-				mw.WriteMessage(CapList())
-				mw.WriteMessage(CapEnd())
-			}
-		}
-	})
+	}
+	return text
 }
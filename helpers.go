@@ -1,5 +1,136 @@
 package irc
 
+import (
+	"net"
+	"strings"
+
+	"github.com/Travis-Britz/irc/internal/formatting"
+)
+
+// MaskType selects the format of an address mask generated by Mask.
+//
+// The numbering follows the mask types of mIRC's $mask identifier,
+// so anybody who has written a ban script before should feel at home.
+type MaskType int
+
+// Mask types, shown for the address "nick!~user@host.example.com".
+const (
+	MaskUserHost           MaskType = iota // *!~user@host.example.com
+	MaskWildUserHost                       // *!*user@host.example.com
+	MaskHost                               // *!*@host.example.com
+	MaskWildUserDomain                     // *!*user@*.example.com
+	MaskDomain                             // *!*@*.example.com
+	MaskFull                               // nick!~user@host.example.com
+	MaskNickWildUserHost                   // nick!*user@host.example.com
+	MaskNickHost                           // nick!*@host.example.com
+	MaskNickWildUserDomain                 // nick!*user@*.example.com
+	MaskNickDomain                         // nick!*@*.example.com
+)
+
+// Mask converts the address p into an address mask of type t,
+// typically for use as the parameter of a channel ban (MODE +b).
+//
+// Missing parts of the address are replaced with '*'.
+// If p is missing both the user and host (such as when only a nickname is known),
+// the returned mask is always in the form "nick!*@*", regardless of t.
+//
+// For domain masks, the first label of a hostname is replaced with '*',
+// while the last octet of an IPv4 address is replaced instead ("1.2.3.*").
+// IPv6 addresses and hosts with a single label are never shortened.
+func Mask(p Prefix, t MaskType) string {
+	nick := wildEmpty(p.Nick.String())
+	user := wildEmpty(p.User)
+	host := wildEmpty(p.Host)
+
+	if p.User == "" && p.Host == "" {
+		return nick + "!*@*"
+	}
+
+	// a leading '~' means the user name was not verified by ident,
+	// so the "wild user" masks swap it (or the first character) for '*'.
+	wildUser := "*" + strings.TrimPrefix(user, "~")
+	if user == "*" {
+		wildUser = "*"
+	}
+
+	switch t {
+	case MaskUserHost:
+		return "*!" + user + "@" + host
+	case MaskWildUserHost:
+		return "*!" + wildUser + "@" + host
+	case MaskHost:
+		return "*!*@" + host
+	case MaskWildUserDomain:
+		return "*!" + wildUser + "@" + wildDomain(host)
+	case MaskDomain:
+		return "*!*@" + wildDomain(host)
+	case MaskNickWildUserHost:
+		return nick + "!" + wildUser + "@" + host
+	case MaskNickHost:
+		return nick + "!*@" + host
+	case MaskNickWildUserDomain:
+		return nick + "!" + wildUser + "@" + wildDomain(host)
+	case MaskNickDomain:
+		return nick + "!*@" + wildDomain(host)
+	default:
+		return nick + "!" + user + "@" + host
+	}
+}
+
+func wildEmpty(s string) string {
+	if s == "" {
+		return "*"
+	}
+	return s
+}
+
+// wildDomain replaces the most specific part of host with a wildcard.
+func wildDomain(host string) string {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.To4() == nil {
+			return host
+		}
+		return host[:strings.LastIndexByte(host, '.')] + ".*"
+	}
+	i := strings.IndexByte(host, '.')
+	if i < 0 {
+		return host
+	}
+	return "*" + host[i:]
+}
+
+// IsWM compares a wildcard string with an input string and determines whether text matches wildText.
+// '*' matches any number of characters (including none), and '?' matches exactly one character.
+// The comparison is case-insensitive, which makes IsWM suitable for comparing address masks.
+func IsWM(wildText string, text string) bool {
+	w := []rune(strings.ToLower(wildText))
+	t := []rune(strings.ToLower(text))
+
+	// iterative matching with backtracking to the most recent '*',
+	// which avoids the exponential worst case of the naive recursive approach.
+	var wi, ti int
+	star, mark := -1, 0
+	for ti < len(t) {
+		switch {
+		case wi < len(w) && w[wi] == '*':
+			star, mark = wi, ti
+			wi++
+		case wi < len(w) && (w[wi] == '?' || w[wi] == t[ti]):
+			wi++
+			ti++
+		case star >= 0:
+			mark++
+			wi, ti = star+1, mark
+		default:
+			return false
+		}
+	}
+	for wi < len(w) && w[wi] == '*' {
+		wi++
+	}
+	return wi == len(w)
+}
+
 // EqualFold tests whether two strings are equal according to mapping.
 // func EqualFold(s1, s2 string, mapping caseMapping) bool {
 //
@@ -13,39 +144,49 @@ package irc
 
 // }
 
-// Mask converts a full address into an address mask of type maskType.
-// func Mask(fulladdress string, maskType int) string {
-//
-// }
-//
-// IsWM compares a wildcard string with an input string and determines whether text matches wildText.
-// func IsWM(wildText string, text string) bool {
-//
-// }
-//
-// StripColors removes IRC color codes from text.
-// func StripColors(text string) string {
-//
-// }
-//
+// StripColors removes IRC color codes from text, including their foreground and background color numbers.
+// Other formatting such as bold and underline is kept.
+func StripColors(text string) string {
+	return stripFormatting(text, false)
+}
+
 // StripFormatting removes IRC formatting control characters from text.
-// func StripFormatting(text string) string {
-//
-// }
-//
-// func Colorize(text string, fg int, bg int) string {
-//
-// }
+// Codes include colors, bold, underline, reverse, italics, etc.
+func StripFormatting(text string) string {
+	return stripFormatting(text, true)
+}
 
-// Decode decodes a line of IRC text into a Message struct. line must not end with line endings \r\n.
-// func Decode(line []byte) (*Message, error) {
-// 	m := new(Message)
-// 	err := m.UnmarshalText(line)
-// 	return m, err
-// }
+func stripFormatting(text string, all bool) string {
+	if !strings.ContainsAny(text, formatting.Chars) {
+		return text
+	}
+	var b strings.Builder
+	b.Grow(len(text))
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; c {
+		case formatting.Color:
+			// ^C[N[N]][,M[M]]
+			_, _, n := formatting.ParseColor(text[i+1:])
+			i += n
+		case formatting.HexColor:
+			// ^D[RRGGBB][,RRGGBB]
+			_, _, n := formatting.ParseHexColor(text[i+1:])
+			i += n
+		case formatting.Bold, formatting.Reset, formatting.Monospace, formatting.Reverse, formatting.Italic, formatting.Strikethrough, formatting.Underline:
+			if !all {
+				b.WriteByte(c)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
 
-// Encode encodes a message to be sent on an IRC connection.
-// func Encode(command string, params ...string) ([]byte,error) {
-// 	m := NewMessage(Command(command), params...)
-// 	return m.MarshalText()
+// func Colorize(text string, fg int, bg int) string {
+//
 // }
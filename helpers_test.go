@@ -0,0 +1,161 @@
+package irc_test
+
+import (
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/Travis-Britz/irc"
+)
+
+func TestMask(t *testing.T) {
+	full := irc.Prefix{Nick: "nick", User: "~user", Host: "host.example.com"}
+	ip := irc.Prefix{Nick: "nick", User: "user", Host: "192.0.2.7"}
+	tt := []struct {
+		prefix   irc.Prefix
+		maskType irc.MaskType
+		expected string
+	}{
+		{full, irc.MaskUserHost, "*!~user@host.example.com"},
+		{full, irc.MaskWildUserHost, "*!*user@host.example.com"},
+		{full, irc.MaskHost, "*!*@host.example.com"},
+		{full, irc.MaskWildUserDomain, "*!*user@*.example.com"},
+		{full, irc.MaskDomain, "*!*@*.example.com"},
+		{full, irc.MaskFull, "nick!~user@host.example.com"},
+		{full, irc.MaskNickWildUserHost, "nick!*user@host.example.com"},
+		{full, irc.MaskNickHost, "nick!*@host.example.com"},
+		{full, irc.MaskNickWildUserDomain, "nick!*user@*.example.com"},
+		{full, irc.MaskNickDomain, "nick!*@*.example.com"},
+		{ip, irc.MaskDomain, "*!*@192.0.2.*"},
+		{ip, irc.MaskWildUserHost, "*!*user@192.0.2.7"},
+		{irc.Prefix{Nick: "nick", User: "user", Host: "2001:db8::1"}, irc.MaskDomain, "*!*@2001:db8::1"},
+		{irc.Prefix{Nick: "nick", User: "user", Host: "localhost"}, irc.MaskDomain, "*!*@localhost"},
+		{irc.Prefix{Nick: "nick"}, irc.MaskHost, "nick!*@*"},
+	}
+	for _, tc := range tt {
+		if got := irc.Mask(tc.prefix, tc.maskType); got != tc.expected {
+			t.Errorf("Mask(%q, %d): expected %q; got %q", tc.prefix, tc.maskType, tc.expected, got)
+		}
+	}
+}
+
+func TestIsWM(t *testing.T) {
+	tt := []struct {
+		wild  string
+		text  string
+		match bool
+	}{
+		{"*", "", true},
+		{"*", "anything", true},
+		{"?", "", false},
+		{"?", "a", true},
+		{"a*c", "abbbc", true},
+		{"a*c", "abbbd", false},
+		{"*!*@*.example.com", "Nick!~user@host.EXAMPLE.com", true},
+		{"*!*@*.example.com", "nick!user@example.com", false},
+		{"nick!*@*", "NICK!user@host", true},
+		{"*a*a*a*a*b", "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaac", false},
+	}
+	for _, tc := range tt {
+		if got := irc.IsWM(tc.wild, tc.text); got != tc.match {
+			t.Errorf("IsWM(%q, %q): expected %v; got %v", tc.wild, tc.text, tc.match, got)
+		}
+	}
+}
+
+func TestStripFormatting(t *testing.T) {
+	tt := []struct {
+		given      string
+		formatting string
+		colors     string
+	}{
+		{"plain text", "plain text", "plain text"},
+		{"\x02bold\x02 text", "bold text", "\x02bold\x02 text"},
+		{"\x0304red\x03 text", "red text", "red text"},
+		{"\x034,12red on blue\x0f", "red on blue", "red on blue\x0f"},
+		{"\x03,12not a background", ",12not a background", ",12not a background"},
+		{"\x0312,done", ",done", ",done"},
+		{"\x031234", "34", "34"},
+		{"\x04FF0000red\x04", "red", "red"},
+		{"\x1d\x1f\x1e\x11\x16text", "text", "\x1d\x1f\x1e\x11\x16text"},
+	}
+	for _, tc := range tt {
+		if got := irc.StripFormatting(tc.given); got != tc.formatting {
+			t.Errorf("StripFormatting(%q): expected %q; got %q", tc.given, tc.formatting, got)
+		}
+		if got := irc.StripColors(tc.given); got != tc.colors {
+			t.Errorf("StripColors(%q): expected %q; got %q", tc.given, tc.colors, got)
+		}
+	}
+}
+
+func TestEllipsize(t *testing.T) {
+	tests := []struct {
+		text string
+		n    int
+		want string
+	}{
+		{"short", 10, "short"},
+		{"the quick brown fox", 14, "the quick…"},
+		{"supercalifragilisticexpialidocious", 10, "superca…"},
+		{"naïve café", 9, "naïve…"},
+		{"ééé", 5, "é…"},
+		{"ééé", 4, "…"},
+		{"ééé", 2, "é"},
+		{"\x0304,12colorful text here", 8, "…"},
+		{"\x0304red\x03 text more", 12, "\x0304red\x03\x0f…"},
+		{"\x02bold\x02 and more words", 15, "\x02bold\x02 and\x0f…"},
+		{"anything", 0, ""},
+	}
+	for _, tt := range tests {
+		got := irc.Ellipsize(tt.text, tt.n)
+		if got != tt.want {
+			t.Errorf("Ellipsize(%q, %d): expected %q; got %q", tt.text, tt.n, tt.want, got)
+		}
+		if len(got) > tt.n && tt.n > 0 {
+			t.Errorf("Ellipsize(%q, %d): result is %d bytes", tt.text, tt.n, len(got))
+		}
+	}
+}
+
+func TestClient_TemplateMsg(t *testing.T) {
+	client := &irc.Client{Nickname: "bot"}
+	tmpl := template.Must(template.New("announce").Parse("{{.}} released"))
+	m, err := client.TemplateMsg("#c", tmpl, strings.Repeat("v1.0 ", 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := m.Params.Get(2)
+	if len(text) > client.TextBudget("#c") || !strings.HasSuffix(text, "v1.0…") {
+		t.Errorf("expected the text to be shortened to %d bytes; got %d bytes: %q", client.TextBudget("#c"), len(text), text)
+	}
+}
+
+func TestMentions(t *testing.T) {
+	tt := []struct {
+		text        string
+		nick        irc.Nickname
+		casemapping string
+		want        bool
+	}{
+		{"bot: hi", "bot", "", true},
+		{"ask the BOT", "bot", "ascii", true},
+		{"bot's answer", "bot", "", true},
+		{"@bot", "bot", "", true},
+		{"robot", "bot", "", false},
+		{"bots", "bot", "", false},
+		{"bot__ and bot`", "bot", "", true},
+		{"hi bot", "bot_", "", true},
+		{"hi bot|afk", "bot", "", true},
+		{"hi [bot]", "{bot}", "rfc1459", true},
+		{"hi [bot]", "{bot}", "ascii", false},
+		{"hi a~b", "a^b", "rfc1459", true},
+		{"hi a~b", "a^b", "rfc1459-strict", false},
+		{"hi", "_", "", false},
+	}
+	for _, tc := range tt {
+		if got := irc.Mentions(tc.text, tc.nick, tc.casemapping); got != tc.want {
+			t.Errorf("Mentions(%q, %q, %q): expected %t; got %t", tc.text, tc.nick, tc.casemapping, tc.want, got)
+		}
+	}
+}
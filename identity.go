@@ -0,0 +1,210 @@
+package irc
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// accountTTL is how long a resolved account is trusted when the server doesn't announce its changes:
+// when account-notify isn't enabled, or the client shares no channel with the user.
+const accountTTL = time.Minute
+
+// accountCache remembers the services accounts of users for Client.Resolve.
+//
+// Accounts are learned from the account tag, extended-join, account-notify, and WHOIS replies.
+// The client is only told about the account changes of users it shares a channel with,
+// so an entry is dropped when its user quits or leaves the last channel shared with the client,
+// and every other entry expires after accountTTL.
+type accountCache struct {
+	client   *Client
+	caps     *capState
+	channels *channelTracker
+
+	mu       sync.Mutex
+	accounts map[string]accountEntry // keyed by folded nickname
+}
+
+type accountEntry struct {
+	account string // empty if the user isn't logged in
+
+	// expires is when the entry is stale, unless account-notify keeps it up to date.
+	expires time.Time
+}
+
+func newAccountCache(c *Client, caps *capState, channels *channelTracker) *accountCache {
+	return &accountCache{client: c, caps: caps, channels: channels, accounts: make(map[string]accountEntry)}
+}
+
+// set records the account of nick. account may be "*" for users who aren't logged in.
+func (ac *accountCache) set(nick Nickname, account string) {
+	if account == "*" {
+		account = ""
+	}
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	ac.accounts[ac.client.fold(nick.String())] = accountEntry{account: account, expires: time.Now().Add(accountTTL)}
+}
+
+func (ac *accountCache) get(nick string) (account string, ok bool) {
+	notified := ac.notified(nick)
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	key := ac.client.fold(nick)
+	e, ok := ac.accounts[key]
+	if ok && !notified && time.Now().After(e.expires) {
+		delete(ac.accounts, key)
+		return "", false
+	}
+	return e.account, ok
+}
+
+// notified reports whether the server announces the account changes of nick with account-notify.
+func (ac *accountCache) notified(nick string) bool {
+	return ac.caps.isEnabled("account-notify") && ac.channels.shares(nick)
+}
+
+func (ac *accountCache) forget(nick Nickname) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	delete(ac.accounts, ac.client.fold(nick.String()))
+}
+
+// left drops the account of nick after it left a channel, if it shares no other channel with the client.
+// When the client itself left, it drops the accounts of every user it no longer shares a channel with.
+func (ac *accountCache) left(nick Nickname, self bool) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if !self {
+		if !ac.channels.shares(nick.String()) {
+			delete(ac.accounts, ac.client.fold(nick.String()))
+		}
+		return
+	}
+	for key := range ac.accounts {
+		if !ac.channels.shares(key) {
+			delete(ac.accounts, key)
+		}
+	}
+}
+
+// capsDeleted drops every account when account-notify is removed with CAP DEL,
+// since the accounts which were kept up to date by it may change without the client knowing.
+func (ac *accountCache) capsDeleted(names []string) {
+	if !containsFold(names, "account-notify") {
+		return
+	}
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	ac.accounts = make(map[string]accountEntry)
+}
+
+func (ac *accountCache) rename(from, to Nickname) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if e, ok := ac.accounts[ac.client.fold(from.String())]; ok {
+		delete(ac.accounts, ac.client.fold(from.String()))
+		ac.accounts[ac.client.fold(to.String())] = e
+	}
+}
+
+func (ac *accountCache) middleware(next Handler) Handler {
+	return HandlerFunc(func(w MessageWriter, m *Message) {
+		nick := m.Source.Nick
+		fromUser := nick != "" && !m.Source.IsServer()
+
+		if fromUser {
+			switch {
+			case m.Tags.Has("account"):
+				ac.set(nick, m.Tags.Get("account"))
+			case ac.caps.isEnabled("account-tag") && !m.Command.is(CmdQuit):
+				// messages from users who are logged in carry the tag
+				ac.set(nick, "")
+			}
+		}
+
+		switch m.Command {
+		case RplWelcome:
+			ac.mu.Lock()
+			ac.accounts = make(map[string]accountEntry)
+			ac.mu.Unlock()
+		case CmdJoin:
+			// extended-join: "JOIN <channel> <account> :<realname>"
+			if fromUser && len(m.Params) >= 3 {
+				ac.set(nick, m.Params.Get(2))
+			}
+		case CmdAccount:
+			if fromUser {
+				ac.set(nick, m.Params.Get(1))
+			}
+		case CmdNick:
+			ac.rename(nick, Nickname(m.Params.Get(1)))
+		case CmdQuit:
+			ac.forget(nick)
+		// "<nick> <nick>!<ident>@<host> <account> :You are now logged in as <user>"
+		case RplLoggedIn:
+			ac.set(Nickname(m.Params.Get(1)), m.Params.Get(3))
+		case RplLoggedOut:
+			ac.set(Nickname(m.Params.Get(1)), "")
+		}
+		next.SpeakIRC(w, m)
+
+		// the channel tracker has applied the change by now
+		switch m.Command {
+		case CmdPart:
+			ac.left(nick, nick.Is(ac.client.Nick().String()))
+		case CmdKick:
+			target := Nickname(m.Params.Get(2))
+			ac.left(target, target.Is(ac.client.Nick().String()))
+		}
+	})
+}
+
+// Resolve returns the services account nick is logged in to, or an empty string if nick isn't logged in.
+// Permission checks should be based on accounts rather than nicknames,
+// since anybody can use a nickname while it's not in use.
+//
+// Accounts are remembered from the account tag, extended-join, and account-notify when those capabilities are enabled,
+// so most users are resolved without asking the server.
+// Otherwise the account is looked up with WHOIS (RPL_WHOISACCOUNT), and the error wraps ErrNoSuchNick
+// if nick isn't online.
+//
+// Like the other Client methods which wait for a reply, Resolve must not be called from a handler
+// when the account isn't known yet.
+func (c *Client) Resolve(ctx context.Context, nick string) (account string, err error) {
+	c.connMu.Lock()
+	cache := c.account
+	c.connMu.Unlock()
+	if cache == nil {
+		return "", ErrNotConnected
+	}
+	if account, ok := cache.get(nick); ok {
+		return account, nil
+	}
+
+	refused := commandReply(CmdWhoIs, "")
+	err = c.request(ctx, WhoIs(nick), false, func(m *Message) (bool, error) {
+		if done, err := refused(m); done {
+			return true, err
+		}
+		if !Nickname(m.Params.Get(2)).Is(nick) {
+			return false, nil
+		}
+		switch m.Command {
+		// "<client> <nick> <account> :is logged in as"
+		case RplWhoIsAccount:
+			account = m.Params.Get(3)
+		case RplErrNoSuchNick:
+			return true, fmt.Errorf("%s %s: %w", CmdWhoIs, nick, ErrNoSuchNick)
+		case RplEndOfWhoIs:
+			return true, nil
+		}
+		return false, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	cache.set(Nickname(nick), account)
+	return account, nil
+}
@@ -0,0 +1,187 @@
+package irc
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// An IgnoreList is middleware which hides the messages of unwanted users from the handlers it wraps.
+//
+// On servers which advertise the SILENCE token in RPL_ISUPPORT, ignored masks are also added to
+// the server-side SILENCE list, so the server doesn't even deliver the messages.
+// Masks which don't fit on the server's list, and every mask on servers without SILENCE,
+// are only filtered by the middleware. The list is added to the server again for every connection.
+//
+// Only messages addressed to the client are hidden: PRIVMSG, NOTICE, TAGMSG, INVITE, and CTCP.
+// Ignored users still JOIN, PART, QUIT, etc. like any other user, so that handlers tracking channel members stay accurate.
+//
+// Masks are wildcard masks (nick!user@host). A mask with only a nickname, e.g. "spammer", is expanded to "spammer!*@*".
+//
+// The zero value is an empty list, ready to use.
+type IgnoreList struct {
+	mu    sync.Mutex
+	masks []string
+
+	// silence is set when the server supports SILENCE, with room for limit masks (0 for no limit).
+	silence bool
+	limit   int
+
+	// silenced holds the lowercase masks which are on the server's SILENCE list.
+	silenced map[string]bool
+}
+
+// Add ignores users matching mask, writing a SILENCE command to w when the server supports it.
+func (l *IgnoreList) Add(w MessageWriter, mask string) {
+	mask = normalizeMask(mask)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, m := range l.masks {
+		if strings.EqualFold(m, mask) {
+			return
+		}
+	}
+	l.masks = append(l.masks, mask)
+	l.silenceMasks(w)
+}
+
+// Remove stops ignoring mask, removing it from the server's SILENCE list if it was added there.
+func (l *IgnoreList) Remove(w MessageWriter, mask string) {
+	mask = normalizeMask(mask)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, m := range l.masks {
+		if strings.EqualFold(m, mask) {
+			l.masks = append(l.masks[:i], l.masks[i+1:]...)
+			break
+		}
+	}
+	key := strings.ToLower(mask)
+	if l.silenced[key] {
+		delete(l.silenced, key)
+		w.WriteMessage(Unsilence(mask))
+	}
+	// a mask which didn't fit before may fit now
+	l.silenceMasks(w)
+}
+
+// Masks returns the ignored masks.
+func (l *IgnoreList) Masks() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.masks...)
+}
+
+// Ignored reports whether m is a message from an ignored user which is hidden by the middleware.
+func (l *IgnoreList) Ignored(m *Message) bool {
+	if m.Source.Nick == "" {
+		return false
+	}
+	switch {
+	case m.Command.is(CmdPrivmsg), m.Command.is(CmdNotice), m.Command.is(CmdTagMsg), m.Command.is(CmdInvite):
+	case strings.HasPrefix(m.Command.String(), "_CTCP_"):
+	default:
+		return false
+	}
+	source := m.Source.String()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, mask := range l.masks {
+		if IsWM(mask, source) {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware hides the messages of ignored users from next,
+// and keeps the server's SILENCE list in sync with the IgnoreList.
+func (l *IgnoreList) Middleware(next Handler) Handler {
+	return HandlerFunc(func(w MessageWriter, m *Message) {
+		switch m.Command {
+		case RplWelcome:
+			// a new connection starts with an empty SILENCE list
+			l.mu.Lock()
+			l.silence, l.limit, l.silenced = false, 0, nil
+			l.mu.Unlock()
+		case RplISupport:
+			l.parseISupport(w, m)
+		case RplSilEList:
+			// masks added by another client of the same user, e.g. through a bouncer, are adopted
+			mask := m.Params.Get(2)
+			l.mu.Lock()
+			if !containsFold(l.masks, mask) {
+				l.masks = append(l.masks, mask)
+			}
+			if l.silenced == nil {
+				l.silenced = make(map[string]bool)
+			}
+			l.silenced[strings.ToLower(mask)] = true
+			l.mu.Unlock()
+		case RplErrSilEListFull:
+			l.mu.Lock()
+			delete(l.silenced, strings.ToLower(m.Params.Get(2)))
+			l.limit = len(l.silenced)
+			l.mu.Unlock()
+		}
+		if l.Ignored(m) {
+			return
+		}
+		next.SpeakIRC(w, m)
+	})
+}
+
+// parseISupport looks for the SILENCE token in an RPL_ISUPPORT message.
+//
+// "<client> SILENCE[=<limit>] ... :are supported by this server"
+func (l *IgnoreList) parseISupport(w MessageWriter, m *Message) {
+	if len(m.Params) < 3 {
+		return
+	}
+	for _, token := range m.Params[1 : len(m.Params)-1] {
+		name, value, _ := strings.Cut(token, "=")
+		if !strings.EqualFold(name, "SILENCE") {
+			continue
+		}
+		l.mu.Lock()
+		l.silence = true
+		l.limit, _ = strconv.Atoi(value)
+		l.silenceMasks(w)
+		l.mu.Unlock()
+	}
+}
+
+// silenceMasks adds the masks which aren't on the server's SILENCE list yet, as long as there's room.
+// l.mu must be held.
+func (l *IgnoreList) silenceMasks(w MessageWriter) {
+	if !l.silence {
+		return
+	}
+	if l.silenced == nil {
+		l.silenced = make(map[string]bool)
+	}
+	for _, mask := range l.masks {
+		if l.limit > 0 && len(l.silenced) >= l.limit {
+			return
+		}
+		key := strings.ToLower(mask)
+		if !l.silenced[key] {
+			l.silenced[key] = true
+			w.WriteMessage(Silence(mask))
+		}
+	}
+}
+
+// normalizeMask expands a partial mask such as "nick" or "user@host" to a full nick!user@host mask.
+func normalizeMask(mask string) string {
+	hasUser, hasHost := strings.Contains(mask, "!"), strings.Contains(mask, "@")
+	switch {
+	case !hasUser && !hasHost:
+		return mask + "!*@*"
+	case !hasUser:
+		return "*!" + mask
+	case !hasHost:
+		return mask + "@*"
+	}
+	return mask
+}
@@ -0,0 +1,62 @@
+// Package formatting holds the control codes of IRC formatting and the parser of color codes,
+// shared by package irc and package ircfmt.
+// https://modern.ircdocs.horse/formatting.html
+package formatting
+
+// Control codes of IRC formatting.
+const (
+	Bold          = '\x02'
+	Color         = '\x03'
+	HexColor      = '\x04'
+	Reset         = '\x0F'
+	Monospace     = '\x11'
+	Reverse       = '\x16'
+	Italic        = '\x1D'
+	Strikethrough = '\x1E'
+	Underline     = '\x1F'
+)
+
+// Chars contains every control code.
+const Chars = "\x02\x03\x04\x0F\x11\x16\x1D\x1E\x1F"
+
+// ParseColor returns the foreground and optional background color numbers at the start of s,
+// which follows a Color code ("N[N][,M[M]]"), and the length of the code after the Color byte.
+func ParseColor(s string) (fg, bg string, n int) {
+	return colors(s, isDigit, 2)
+}
+
+// ParseHexColor returns the foreground and optional background colors at the start of s,
+// which follows a HexColor code ("RRGGBB[,RRGGBB]"), and the length of the code after the HexColor byte.
+// The colors may be shorter than 6 digits, which clients treat as the end of the code.
+func ParseHexColor(s string) (fg, bg string, n int) {
+	return colors(s, isHexDigit, 6)
+}
+
+// colors returns the foreground and optional background color at the start of s, where each color is made of
+// up to width characters accepted by valid, and the length of the code.
+// The comma is only part of the code when it is followed by a background color.
+func colors(s string, valid func(byte) bool, width int) (fg, bg string, n int) {
+	for n < len(s) && n < width && valid(s[n]) {
+		n++
+	}
+	fg = s[:n]
+	if n == 0 || n >= len(s) || s[n] != ',' {
+		return fg, "", n
+	}
+	m := 0
+	for n+1+m < len(s) && m < width && valid(s[n+1+m]) {
+		m++
+	}
+	if m == 0 {
+		return fg, "", n
+	}
+	return fg, s[n+1 : n+1+m], n + 1 + m
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
@@ -0,0 +1,149 @@
+/*
+Package invite provides a policy handler for channel invitations.
+
+Bots that join every channel they're invited to are easy to abuse:
+anybody can drag them into spam channels, or flood them with invites until
+the server disconnects them for joining too fast.
+A Policy only accepts invites from sources with a sufficient access role,
+and limits how often invites are accepted.
+
+	acl := &access.List{}
+	acl.Add(access.Rule{Account: "MyAccount", Role: access.RoleOwner})
+	policy := &invite.Policy{Access: acl}
+	r.OnInvite(policy.SpeakIRC).MatchClient(client)
+*/
+package invite
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Travis-Britz/irc"
+	"github.com/Travis-Britz/irc/access"
+)
+
+var (
+	// ErrNotAllowed is reported for invites from sources without the required role.
+	ErrNotAllowed = errors.New("invite: source is not allowed to invite")
+
+	// ErrRateLimited is reported for invites that arrived after the rate limit was reached.
+	ErrRateLimited = errors.New("invite: too many invites")
+)
+
+// Default rate limit values used when Policy.Limit or Policy.Interval are zero.
+const (
+	defaultLimit    = 3
+	defaultInterval = time.Minute
+)
+
+// A Policy is a Handler for INVITE messages.
+// Accepted invites are answered by joining the channel.
+//
+// The zero value accepts no invites.
+type Policy struct {
+
+	// Access determines the role of the inviting user.
+	Access *access.List
+
+	// Role is the minimum role required for an invite to be accepted.
+	// If zero, access.RoleTrusted is required.
+	Role access.Role
+
+	// Limit is the maximum number of invites accepted per Interval.
+	// Invites past the limit are rejected with ErrRateLimited, even from allowed sources.
+	// If zero, 3 invites per minute are accepted.
+	Limit    int
+	Interval time.Duration
+
+	// Report is called for every rejected invite with the reason it was rejected.
+	// If nil, rejected invites are ignored silently.
+	// Report could be used to log rejections, or to send a notice to the bot owner.
+	Report func(w irc.MessageWriter, m *irc.Message, reason error)
+
+	mu       sync.Mutex
+	accepted []time.Time
+
+	// now is used by tests to control the clock.
+	now func() time.Time
+}
+
+// SpeakIRC implements irc.Handler.
+func (p *Policy) SpeakIRC(w irc.MessageWriter, m *irc.Message) {
+	if !strings.EqualFold(m.Command.String(), irc.CmdInvite) {
+		return
+	}
+	channel, _ := m.Chan()
+	if channel == "" {
+		return
+	}
+	if err := p.accept(m); err != nil {
+		if p.Report != nil {
+			p.Report(w, m, err)
+		}
+		return
+	}
+	w.WriteMessage(irc.Join(channel))
+}
+
+// accept returns nil if the invite m should be accepted,
+// and records the acceptance for rate limiting.
+func (p *Policy) accept(m *irc.Message) error {
+	role := p.Role
+	if role == access.RoleNone {
+		role = access.RoleTrusted
+	}
+	if !p.Access.Allowed(m, role) {
+		return ErrNotAllowed
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	limit, interval := p.Limit, p.Interval
+	if limit <= 0 {
+		limit = defaultLimit
+	}
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+
+	now := time.Now()
+	if p.now != nil {
+		now = p.now()
+	}
+	// drop acceptances which have aged out of the window
+	recent := p.accepted[:0]
+	for _, t := range p.accepted {
+		if now.Sub(t) < interval {
+			recent = append(recent, t)
+		}
+	}
+	p.accepted = recent
+	if len(p.accepted) >= limit {
+		return ErrRateLimited
+	}
+	p.accepted = append(p.accepted, now)
+	return nil
+}
+
+// Snapshot implements irc.Snapshotter, so that the rate limit survives a restart.
+func (p *Policy) Snapshot() ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return json.Marshal(p.accepted)
+}
+
+// Restore implements irc.Snapshotter.
+func (p *Policy) Restore(data []byte) error {
+	var accepted []time.Time
+	if err := json.Unmarshal(data, &accepted); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.accepted = accepted
+	return nil
+}
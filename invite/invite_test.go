@@ -0,0 +1,62 @@
+package invite
+
+import (
+	"encoding"
+	"testing"
+	"time"
+
+	"github.com/Travis-Britz/irc"
+	"github.com/Travis-Britz/irc/access"
+)
+
+type recorder struct {
+	joined []string
+}
+
+func (r *recorder) WriteMessage(m encoding.TextMarshaler) {
+	if msg, ok := m.(*irc.Message); ok && msg.Command == irc.CmdJoin {
+		r.joined = append(r.joined, msg.Params.Get(1))
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	acl := &access.List{}
+	acl.Add(access.Rule{Mask: "*!*@trusted.example.com", Role: access.RoleTrusted})
+
+	now := time.Now()
+	var rejected []error
+	p := &Policy{
+		Access: acl,
+		Limit:  2,
+		Report: func(w irc.MessageWriter, m *irc.Message, reason error) {
+			rejected = append(rejected, reason)
+		},
+		now: func() time.Time { return now },
+	}
+	invite := func(host, channel string) *irc.Message {
+		m := irc.NewMessage(irc.CmdInvite, "bot", channel)
+		m.Source = irc.Prefix{Nick: "someone", User: "user", Host: host}
+		return m
+	}
+
+	w := &recorder{}
+	p.SpeakIRC(w, invite("untrusted.example.com", "#spam"))
+	p.SpeakIRC(w, invite("trusted.example.com", "#one"))
+	p.SpeakIRC(w, invite("trusted.example.com", "#two"))
+	p.SpeakIRC(w, invite("trusted.example.com", "#three"))
+	now = now.Add(time.Minute)
+	p.SpeakIRC(w, invite("trusted.example.com", "#four"))
+
+	expected := []string{"#one", "#two", "#four"}
+	if len(w.joined) != len(expected) {
+		t.Fatalf("expected joins %q; got %q", expected, w.joined)
+	}
+	for i := range expected {
+		if w.joined[i] != expected[i] {
+			t.Errorf("expected joins %q; got %q", expected, w.joined)
+		}
+	}
+	if len(rejected) != 2 || rejected[0] != ErrNotAllowed || rejected[1] != ErrRateLimited {
+		t.Errorf("expected rejections [%v %v]; got %v", ErrNotAllowed, ErrRateLimited, rejected)
+	}
+}
@@ -4,19 +4,72 @@ Package ircdebug contains helper functions that are useful while writing an IRC
 package ircdebug
 
 import (
+	"bytes"
 	"io"
+	"strings"
+	"sync"
+
+	"github.com/Travis-Britz/irc"
 )
 
 // WriteTo returns a new io.ReadWriteCloser that copies all reads/writes for rwc to w.
 // Reads and Writes are prefixed with inPrefix and outPrefix respectively.
 // This is mainly useful while developing an IRC client like a bot,
 // e.g. for writing to os.Stdout or a file.
-// todo: it's not safe for concurrent usage, so replies are sometimes mixed in with connection reads
-func WriteTo(w io.Writer, rwc io.ReadWriteCloser, outPrefix string, inPrefix string) io.ReadWriteCloser {
+//
+// Lines are copied to w whole, one at a time, so reads and writes from different goroutines aren't mixed together.
+// Options may leave lines out of the copy or hide secrets in them:
+//
+//	ircdebug.WriteTo(os.Stdout, conn, "-> ", "<- ", ircdebug.Skip(irc.CmdPing, irc.CmdPong), ircdebug.Redact())
+//
+// Options only change what is written to w; rwc always receives the lines unchanged.
+func WriteTo(w io.Writer, rwc io.ReadWriteCloser, outPrefix string, inPrefix string, opts ...Option) io.ReadWriteCloser {
+	l := &lineLogger{w: w}
+	for _, opt := range opts {
+		opt(l)
+	}
 	return &debugConn{
 		ReadWriteCloser: rwc,
-		r:               io.TeeReader(rwc, &writePrefixer{w: w, prefix: inPrefix}),
-		w:               io.MultiWriter(rwc, &writePrefixer{w: w, prefix: outPrefix}),
+		r:               io.TeeReader(rwc, &writePrefixer{l: l, prefix: inPrefix}),
+		w:               io.MultiWriter(rwc, &writePrefixer{l: l, prefix: outPrefix}),
+	}
+}
+
+// An Option changes the debug output of WriteTo.
+type Option func(*lineLogger)
+
+// Skip leaves lines with any of the given commands out of the debug output,
+// e.g. Skip(irc.CmdPing, irc.CmdPong) to hide keepalive noise.
+func Skip(commands ...irc.Command) Option {
+	return Filter(func(line string) bool {
+		cmd := command(line)
+		for _, c := range commands {
+			if strings.EqualFold(cmd, string(c)) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// Filter leaves lines out of the debug output when keep returns false.
+// The line passed to keep has no prefix or line ending.
+func Filter(keep func(line string) bool) Option {
+	return func(l *lineLogger) {
+		l.keep = append(l.keep, keep)
+	}
+}
+
+// Redact hides secrets in the debug output, so that it's safe to share:
+// the password of PASS and OPER,
+// the payload of AUTHENTICATE,
+// and the arguments of NickServ commands which take a password, like IDENTIFY, REGISTER, GHOST, and SET PASSWORD,
+// whether they are sent with PRIVMSG NickServ or the NICKSERV and NS aliases.
+//
+// Redacted text is replaced with "***".
+func Redact() Option {
+	return func(l *lineLogger) {
+		l.redact = true
 	}
 }
 
@@ -33,15 +86,142 @@ func (dc *debugConn) Write(p []byte) (int, error) {
 	return dc.w.Write(p)
 }
 
-type writePrefixer struct {
+// lineLogger writes the lines of both directions of a connection to w.
+type lineLogger struct {
+	mu     sync.Mutex
 	w      io.Writer
+	keep   []func(line string) bool
+	redact bool
+}
+
+// log writes line to w with prefix, unless a filter drops it.
+// line includes its line ending.
+func (l *lineLogger) log(prefix string, line []byte) {
+	text := strings.TrimRight(string(line), "\r\n")
+	for _, keep := range l.keep {
+		if !keep(text) {
+			return
+		}
+	}
+	if l.redact {
+		if r := redact(text); r != text {
+			line = []byte(r + string(line[len(text):]))
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(append([]byte(prefix), line...))
+}
+
+// writePrefixer collects the bytes of one direction of a connection into lines for a lineLogger.
+type writePrefixer struct {
+	l      *lineLogger
 	prefix string
+	buf    []byte // the start of a line which hasn't ended yet
 }
 
 func (wp *writePrefixer) Write(p []byte) (n int, err error) {
-	n, err = wp.w.Write(append([]byte(wp.prefix), p...))
+	wp.buf = append(wp.buf, p...)
+	for {
+		i := bytes.IndexByte(wp.buf, '\n')
+		if i < 0 {
+			break
+		}
+		wp.l.log(wp.prefix, wp.buf[:i+1])
+		wp.buf = wp.buf[i+1:]
+	}
+	if len(wp.buf) == 0 {
+		wp.buf = nil
+	}
+
+	// since this writePrefixer is only ever used for a MultiWriter or TeeReader, we report
+	// every byte as written, so that a debug output error never interrupts the connection.
+	return len(p), nil
+}
+
+// nickServCommands are the NickServ commands whose arguments contain a password.
+var nickServCommands = []string{"IDENTIFY", "ID", "REGISTER", "GHOST", "RECOVER", "RELEASE", "REGAIN"}
+
+// redact returns line with its secrets replaced.
+func redact(line string) string {
+	tk := irc.NewTokenizer(line)
+	var cmd string
+	var params []irc.Token
+	for {
+		tok := tk.Next()
+		if tok.Type == irc.TokenEOF || tok.Type == irc.TokenError {
+			break
+		}
+		switch tok.Type {
+		case irc.TokenCommand:
+			cmd = strings.ToUpper(tok.Value)
+		case irc.TokenParam, irc.TokenTrailing:
+			params = append(params, tok)
+		}
+	}
+	// hide returns line with everything from the start of params[i] replaced
+	hide := func(i int) string {
+		if i >= len(params) {
+			return line
+		}
+		return line[:params[i].Offset] + "***"
+	}
 
-	// since this writePrefixer is only ever used for a MultiWriter, we need to lie about how many bytes
-	// were written so that the MultiWriter doesn't have an error for different byte counts on each of its writers.
-	return n - len(wp.prefix), err
+	switch cmd {
+	case irc.CmdPass:
+		return hide(0)
+	case irc.CmdOper:
+		return hide(1)
+	case irc.CmdAuthenticate:
+		if len(params) > 0 && params[0].Value != "+" && params[0].Value != "*" {
+			return hide(0)
+		}
+	case irc.CmdPrivmsg:
+		if len(params) > 1 {
+			target, _, _ := strings.Cut(params[0].Value, "@")
+			if strings.EqualFold(target, "NickServ") {
+				return redactNickServ(line, params[1].Offset)
+			}
+		}
+	case "NICKSERV", "NS":
+		if len(params) > 0 {
+			return redactNickServ(line, params[0].Offset)
+		}
+	}
+	return line
+}
+
+// redactNickServ hides the arguments of the NickServ command which starts at line[offset:], if it takes a password.
+func redactNickServ(line string, offset int) string {
+	text := line[offset:]
+	word, args, _ := strings.Cut(text, " ")
+	if args == "" {
+		return line
+	}
+	if strings.EqualFold(word, "SET") {
+		// SET PASSWORD <password>
+		if setting, _, ok := strings.Cut(args, " "); ok && strings.EqualFold(setting, "PASSWORD") {
+			return line[:offset+len(word)+1+len(setting)+1] + "***"
+		}
+		return line
+	}
+	for _, c := range nickServCommands {
+		if strings.EqualFold(word, c) {
+			return line[:offset+len(word)+1] + "***"
+		}
+	}
+	return line
+}
+
+// command returns the command of line, or "" if it can't be found.
+func command(line string) string {
+	tk := irc.NewTokenizer(line)
+	for {
+		switch tok := tk.Next(); tok.Type {
+		case irc.TokenCommand:
+			return tok.Value
+		case irc.TokenEOF, irc.TokenError:
+			return ""
+		}
+	}
 }
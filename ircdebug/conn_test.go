@@ -0,0 +1,68 @@
+package ircdebug_test
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/Travis-Britz/irc"
+	"github.com/Travis-Britz/irc/ircdebug"
+)
+
+type nopCloser struct{ io.ReadWriter }
+
+func (nopCloser) Close() error { return nil }
+
+func TestWriteTo(t *testing.T) {
+	in := strings.NewReader("PING :abc\r\n:irc.example.com 001 bot :Welcome\r\nAUTHENTICATE +\r\n")
+	out := new(bytes.Buffer)
+	conn := nopCloser{struct {
+		io.Reader
+		io.Writer
+	}{in, out}}
+	debug := new(bytes.Buffer)
+	rwc := ircdebug.WriteTo(debug, conn, "-> ", "<- ", ircdebug.Skip(irc.CmdPing, irc.CmdPong), ircdebug.Redact())
+
+	sent := []string{
+		"PONG :abc\r\n",
+		"PASS hunter2\r\n",
+		"OPER admin :secret pass\r\n",
+		"AUTHENTICATE PLAIN\r\n",
+		"AUTHENTICATE Ym90AGJvdABodW50ZXIy\r\n",
+		"PRIVMSG NickServ :IDENTIFY bot hunter2\r\n",
+		"PRIVMSG NickServ@services.example.com :SET PASSWORD hunter3\r\n",
+		"NS GHOST bot hunter2\r\n",
+		"PRIVMSG #chan :IDENTIFY is not a secret here\r\n",
+		"PRIVMSG NickServ :INFO",
+		" bot\r\n",
+	}
+	for _, line := range sent {
+		if _, err := rwc.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := io.ReadAll(rwc); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := out.String(), strings.Join(sent, ""); got != want {
+		t.Errorf("the connection should receive lines unchanged:\n got %q\nwant %q", got, want)
+	}
+	want := strings.Join([]string{
+		"-> PASS ***",
+		"-> OPER admin :***",
+		"-> AUTHENTICATE ***",
+		"-> AUTHENTICATE ***",
+		"-> PRIVMSG NickServ :IDENTIFY ***",
+		"-> PRIVMSG NickServ@services.example.com :SET PASSWORD ***",
+		"-> NS GHOST ***",
+		"-> PRIVMSG #chan :IDENTIFY is not a secret here",
+		"-> PRIVMSG NickServ :INFO bot",
+		"<- :irc.example.com 001 bot :Welcome",
+		"<- AUTHENTICATE +",
+	}, "\r\n") + "\r\n"
+	if got := debug.String(); got != want {
+		t.Errorf("unexpected debug output:\n got %q\nwant %q", got, want)
+	}
+}
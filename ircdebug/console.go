@@ -0,0 +1,196 @@
+package ircdebug
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Travis-Britz/irc"
+)
+
+// DefaultPageSize is the number of reply lines sent at once by a Console when PageSize is 0.
+const DefaultPageSize = 8
+
+// A Console lets authorized users inspect and drive a running client from IRC.
+// Once registered on a Router, it handles the following commands:
+//
+//	!raw <line>        send line to the server as-is
+//	!join <channel>    join a channel
+//	!part <channel>    leave a channel
+//	!state [channel]   show the client's state, or the tracked state of channel
+//	!caps              list the enabled IRCv3 capabilities
+//	!more              show the next page of the previous reply
+//
+// Replies are sent as NOTICEs to the requesting user, PageSize lines at a time.
+//
+// Every command is checked with Allow, and messages from anybody else are ignored.
+// Since !raw can do anything the client can, Allow should only accept the bot's operators:
+//
+//	console := &ircdebug.Console{Client: client, Allow: func(m *irc.Message) bool {
+//		return acl.Allowed(m, access.RoleOwner)
+//	}}
+//	console.Register(router)
+type Console struct {
+
+	// Client is the client being inspected (required).
+	Client *irc.Client
+
+	// Allow reports whether the source of m may use the console.
+	// When Allow is nil, nobody may use the console.
+	Allow func(m *irc.Message) bool
+
+	// State optionally describes the tracked state of a channel for "!state <channel>",
+	// e.g. its topic, modes, and members.
+	// It's typically provided by a state tracking handler.
+	State func(channel string) []string
+
+	// Prefix is the prefix of every command. If empty, "!" is used.
+	Prefix string
+
+	// PageSize is the number of lines sent per reply. If 0, DefaultPageSize is used.
+	PageSize int
+
+	mu    sync.Mutex
+	pages map[irc.Nickname][]string // remaining lines of each user's last reply
+}
+
+// Register adds the console commands to r.
+// The routes are named "console.<command>", e.g. "console.raw".
+func (c *Console) Register(r *irc.Router) {
+	prefix := c.prefix()
+	commands := []struct {
+		name, usage, description string
+		h                        irc.HandlerFunc
+	}{
+		{"raw", "<line>", "send a raw line to the server", c.raw},
+		{"join", "<channel>", "join a channel", c.join},
+		{"part", "<channel>", "leave a channel", c.part},
+		{"state", "[channel]", "show the client state, or the state of a channel", c.state},
+		{"caps", "", "list the enabled capabilities", c.caps},
+		{"more", "", "show the next page of the previous reply", c.more},
+	}
+	for _, cmd := range commands {
+		usage := strings.TrimSpace(prefix + cmd.name + " " + cmd.usage)
+		r.OnCommand(prefix+cmd.name, cmd.h).
+			Name("console."+cmd.name).
+			Help(usage, cmd.description).
+			Use(c.authorize)
+	}
+}
+
+func (c *Console) prefix() string {
+	if c.Prefix == "" {
+		return "!"
+	}
+	return c.Prefix
+}
+
+// authorize is middleware which drops messages from sources that are not allowed to use the console.
+func (c *Console) authorize(next irc.Handler) irc.Handler {
+	return irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+		if c.Allow == nil || !c.Allow(m) {
+			return
+		}
+		next.SpeakIRC(w, m)
+	})
+}
+
+// args returns the text of m after the command word.
+func args(m *irc.Message) string {
+	text, _ := m.Text()
+	_, rest, _ := strings.Cut(text, " ")
+	return strings.TrimSpace(rest)
+}
+
+func (c *Console) raw(w irc.MessageWriter, m *irc.Message) {
+	line := args(m)
+	if line == "" {
+		c.reply(w, m, "usage: "+c.prefix()+"raw <line>")
+		return
+	}
+	msg := new(irc.Message)
+	if err := msg.UnmarshalText([]byte(line)); err != nil {
+		c.reply(w, m, "invalid line: "+err.Error())
+		return
+	}
+	w.WriteMessage(msg)
+}
+
+func (c *Console) join(w irc.MessageWriter, m *irc.Message) {
+	if channel := args(m); channel != "" {
+		w.WriteMessage(irc.Join(channel))
+	}
+}
+
+func (c *Console) part(w irc.MessageWriter, m *irc.Message) {
+	if channel := args(m); channel != "" {
+		w.WriteMessage(irc.Part(channel))
+	}
+}
+
+func (c *Console) state(w irc.MessageWriter, m *irc.Message) {
+	if channel := args(m); channel != "" {
+		if c.State == nil {
+			c.reply(w, m, "channel state is not tracked")
+			return
+		}
+		c.reply(w, m, c.State(channel)...)
+		return
+	}
+	lines := []string{"nick: " + c.Client.Nick().String()}
+	if network, ok := c.Client.ISupport("NETWORK"); ok {
+		lines = append(lines, "network: "+network)
+	}
+	lines = append(lines, "caps: "+strings.Join(c.enabledCaps(), " "))
+	c.reply(w, m, lines...)
+}
+
+func (c *Console) caps(w irc.MessageWriter, m *irc.Message) {
+	caps := c.enabledCaps()
+	if len(caps) == 0 {
+		c.reply(w, m, "no capabilities are enabled")
+		return
+	}
+	c.reply(w, m, caps...)
+}
+
+func (c *Console) enabledCaps() []string {
+	caps := c.Client.EnabledCaps()
+	sort.Strings(caps)
+	return caps
+}
+
+func (c *Console) more(w irc.MessageWriter, m *irc.Message) {
+	c.mu.Lock()
+	lines := c.pages[m.Source.Nick]
+	delete(c.pages, m.Source.Nick)
+	c.mu.Unlock()
+	if len(lines) == 0 {
+		c.reply(w, m, "nothing more to show")
+		return
+	}
+	c.reply(w, m, lines...)
+}
+
+// reply sends the first page of lines to the source of m, and keeps the rest for !more.
+func (c *Console) reply(w irc.MessageWriter, m *irc.Message, lines ...string) {
+	size := c.PageSize
+	if size <= 0 {
+		size = DefaultPageSize
+	}
+	if len(lines) > size {
+		rest := lines[size:]
+		lines = append(lines[:size:size], fmt.Sprintf("... %d more lines; use %smore to continue", len(rest), c.prefix()))
+
+		c.mu.Lock()
+		if c.pages == nil {
+			c.pages = make(map[irc.Nickname][]string)
+		}
+		c.pages[m.Source.Nick] = rest
+		c.mu.Unlock()
+	}
+	for _, line := range lines {
+		w.WriteMessage(irc.Notice(m.Source.Nick.String(), line))
+	}
+}
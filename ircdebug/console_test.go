@@ -0,0 +1,57 @@
+package ircdebug_test
+
+import (
+	"encoding"
+	"fmt"
+	"testing"
+
+	"github.com/Travis-Britz/irc"
+	"github.com/Travis-Britz/irc/ircdebug"
+)
+
+type recorder struct {
+	messages []*irc.Message
+}
+
+func (rec *recorder) WriteMessage(m encoding.TextMarshaler) {
+	rec.messages = append(rec.messages, m.(*irc.Message))
+}
+
+func TestConsole(t *testing.T) {
+	var channel []string
+	for i := 0; i < 5; i++ {
+		channel = append(channel, fmt.Sprintf("member %d", i))
+	}
+	console := &ircdebug.Console{
+		Client:   &irc.Client{Nickname: "bot"},
+		Allow:    func(m *irc.Message) bool { return m.Source.Nick == "owner" },
+		State:    func(string) []string { return channel },
+		PageSize: 3,
+	}
+	r := &irc.Router{}
+	console.Register(r)
+
+	send := func(nick irc.Nickname, text string) *recorder {
+		rec := &recorder{}
+		m := irc.Msg("bot", text)
+		m.Source = irc.Prefix{Nick: nick, User: "user", Host: "example.com"}
+		r.SpeakIRC(rec, m)
+		return rec
+	}
+
+	if rec := send("stranger", "!raw QUIT"); len(rec.messages) != 0 {
+		t.Errorf("expected messages from unauthorized users to be ignored; got %d replies", len(rec.messages))
+	}
+	rec := send("owner", "!raw PRIVMSG #foo :hi")
+	if len(rec.messages) != 1 || rec.messages[0].Command != irc.CmdPrivmsg || rec.messages[0].Params.Get(2) != "hi" {
+		t.Errorf("expected the raw line to be sent; got %v", rec.messages)
+	}
+
+	// 3 lines and a continuation notice, then the remaining 2 lines
+	if rec := send("owner", "!state #foo"); len(rec.messages) != 4 || rec.messages[2].Params.Get(2) != "member 2" {
+		t.Errorf("expected the first page of the channel state; got %v", rec.messages)
+	}
+	if rec := send("owner", "!more"); len(rec.messages) != 2 || rec.messages[1].Params.Get(2) != "member 4" {
+		t.Errorf("expected the second page of the channel state; got %v", rec.messages)
+	}
+}
@@ -0,0 +1,323 @@
+/*
+Package ircfmt builds and reads text with IRC formatting: colors, bold, italics, and the rest of the control codes
+of https://modern.ircdocs.horse/formatting.html.
+
+	text := ircfmt.New().Bold("alert: ").Color(ircfmt.Red, "down").String()
+	w.WriteMessage(irc.Msg("#ops", text))
+
+Lex splits formatted text into spans of the same style, Len counts the characters which are displayed,
+and ANSI translates the formatting into terminal escape codes, e.g. to print logs.
+*/
+package ircfmt
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/Travis-Britz/irc"
+	"github.com/Travis-Britz/irc/internal/formatting"
+)
+
+// A Color is a color of mIRC's palette. Colors 0 to 15 are named; 16 to 98 are an extended palette
+// which not every client supports.
+type Color int
+
+// The colors of mIRC's palette.
+const (
+	White Color = iota
+	Black
+	Blue
+	Green
+	Red
+	Brown
+	Magenta
+	Orange
+	Yellow
+	LightGreen
+	Cyan
+	LightCyan
+	LightBlue
+	Pink
+	Grey
+	LightGrey
+)
+
+// None is the absence of a color: the client's default color.
+const None Color = -1
+
+// A Builder builds formatted text. Each method appends a piece of text, and returns the Builder so that calls can be chained.
+// Formatting doesn't carry over from one piece to the next.
+//
+// The zero value is ready to use.
+type Builder struct {
+	b strings.Builder
+}
+
+// New returns an empty Builder.
+func New() *Builder {
+	return &Builder{}
+}
+
+// Text appends text without formatting.
+func (b *Builder) Text(text string) *Builder {
+	b.b.WriteString(text)
+	return b
+}
+
+// Bold appends text in bold.
+func (b *Builder) Bold(text string) *Builder {
+	return b.wrap(formatting.Bold, text)
+}
+
+// Italic appends text in italics.
+func (b *Builder) Italic(text string) *Builder {
+	return b.wrap(formatting.Italic, text)
+}
+
+// Underline appends underlined text.
+func (b *Builder) Underline(text string) *Builder {
+	return b.wrap(formatting.Underline, text)
+}
+
+// Strikethrough appends text which is struck through.
+func (b *Builder) Strikethrough(text string) *Builder {
+	return b.wrap(formatting.Strikethrough, text)
+}
+
+// Monospace appends text in a monospace font.
+func (b *Builder) Monospace(text string) *Builder {
+	return b.wrap(formatting.Monospace, text)
+}
+
+// Reverse appends text with the foreground and background colors swapped.
+func (b *Builder) Reverse(text string) *Builder {
+	return b.wrap(formatting.Reverse, text)
+}
+
+// Color appends text in the color fg.
+func (b *Builder) Color(fg Color, text string) *Builder {
+	return b.ColorBG(fg, None, text)
+}
+
+// ColorBG appends text in the color fg on the background color bg. Either may be None.
+func (b *Builder) ColorBG(fg, bg Color, text string) *Builder {
+	if fg == None && bg == None {
+		return b.Text(text)
+	}
+	// the colors are always written with two digits, so that text starting with a digit isn't read as part of them
+	fmt.Fprintf(&b.b, "%c%02d", formatting.Color, code(fg))
+	if bg != None {
+		fmt.Fprintf(&b.b, ",%02d", code(bg))
+	} else if rest, ok := strings.CutPrefix(text, ","); ok {
+		if digits, _, _ := formatting.ParseColor(rest); digits != "" {
+			// text like ",5" would be read as a background color
+			fmt.Fprintf(&b.b, ",%02d", code(None))
+		}
+	}
+	b.b.WriteString(text)
+	b.b.WriteByte(formatting.Color)
+	return b
+}
+
+// String returns the formatted text.
+func (b *Builder) String() string {
+	return b.b.String()
+}
+
+// Len returns the number of characters of the text which are displayed, without the control codes. See Len.
+func (b *Builder) Len() int {
+	return Len(b.b.String())
+}
+
+func (b *Builder) wrap(c byte, text string) *Builder {
+	b.b.WriteByte(c)
+	b.b.WriteString(text)
+	b.b.WriteByte(c)
+	return b
+}
+
+// code returns the number of c in a color code. None is 99, the code of the default color.
+func code(c Color) int {
+	if c < 0 || c > 98 {
+		return 99
+	}
+	return int(c)
+}
+
+// Strip removes the formatting from text. It's the same as irc.StripFormatting.
+func Strip(text string) string {
+	return irc.StripFormatting(text)
+}
+
+// Len returns the number of characters of text which are displayed, i.e. the runes of text without its formatting.
+// It's the length to measure against display limits, such as the width of a column;
+// the length of an IRC message is limited in bytes, including the formatting.
+func Len(text string) int {
+	return utf8.RuneCountInString(Strip(text))
+}
+
+// Style is the formatting of a Span.
+type Style struct {
+	Bold, Italic, Underline, Strikethrough, Monospace, Reverse bool
+
+	// FG and BG are the foreground and background colors, or None.
+	FG, BG Color
+
+	// HexFG and HexBG are the colors set with the hex color code, e.g. "FF0000", or "".
+	// They take the place of FG and BG.
+	HexFG, HexBG string
+}
+
+// A Span is a piece of text with the same Style.
+type Span struct {
+	Text string
+	Style
+}
+
+// Lex splits formatted text into the spans of text between its control codes.
+// Neighbouring spans have different styles; the control codes themselves aren't part of any span.
+func Lex(text string) []Span {
+	var spans []Span
+	st := Style{FG: None, BG: None}
+	start := 0
+	flush := func(end int) {
+		if end <= start {
+			return
+		}
+		if n := len(spans); n > 0 && spans[n-1].Style == st {
+			spans[n-1].Text += text[start:end]
+			return
+		}
+		spans = append(spans, Span{Text: text[start:end], Style: st})
+	}
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		if strings.IndexByte(formatting.Chars, c) < 0 {
+			continue
+		}
+		flush(i)
+		switch c {
+		case formatting.Bold:
+			st.Bold = !st.Bold
+		case formatting.Italic:
+			st.Italic = !st.Italic
+		case formatting.Underline:
+			st.Underline = !st.Underline
+		case formatting.Strikethrough:
+			st.Strikethrough = !st.Strikethrough
+		case formatting.Monospace:
+			st.Monospace = !st.Monospace
+		case formatting.Reverse:
+			st.Reverse = !st.Reverse
+		case formatting.Reset:
+			st = Style{FG: None, BG: None}
+		case formatting.Color:
+			// ^C[N[N]][,M[M]]
+			fg, bg, n := formatting.ParseColor(text[i+1:])
+			if fg == "" {
+				st.FG, st.BG, st.HexFG, st.HexBG = None, None, "", ""
+			} else {
+				st.FG, st.HexFG = color(fg), ""
+				if bg != "" {
+					st.BG, st.HexBG = color(bg), ""
+				}
+			}
+			i += n
+		case formatting.HexColor:
+			// ^D[RRGGBB][,RRGGBB]
+			fg, bg, n := formatting.ParseHexColor(text[i+1:])
+			if len(fg) != 6 {
+				st.FG, st.BG, st.HexFG, st.HexBG = None, None, "", ""
+			} else {
+				st.FG, st.HexFG = None, strings.ToUpper(fg)
+				if len(bg) == 6 {
+					st.BG, st.HexBG = None, strings.ToUpper(bg)
+				}
+			}
+			i += n
+		}
+		start = i + 1
+	}
+	flush(len(text))
+	return spans
+}
+
+// color returns the Color of a color code. 99 and numbers out of the palette are None.
+func color(s string) Color {
+	n, _ := strconv.Atoi(s)
+	if n > 98 {
+		return None
+	}
+	return Color(n)
+}
+
+// ansi256 are the colors of the xterm 256-color palette closest to the colors of mIRC's palette.
+// https://modern.ircdocs.horse/formatting.html#colors-16-98
+var ansi256 = [99]int{
+	15, 0, 4, 2, 9, 1, 5, 208, 11, 10, 6, 14, 12, 13, 8, 7,
+	52, 94, 100, 58, 22, 29, 23, 24, 17, 54, 53, 89,
+	88, 130, 142, 64, 28, 35, 30, 25, 18, 91, 90, 125,
+	124, 166, 184, 106, 34, 49, 37, 33, 19, 129, 127, 161,
+	196, 208, 226, 154, 46, 86, 51, 75, 21, 171, 201, 198,
+	203, 215, 227, 191, 83, 122, 87, 111, 63, 177, 207, 205,
+	217, 223, 229, 193, 157, 158, 159, 153, 147, 183, 219, 212,
+	16, 233, 235, 237, 239, 241, 244, 247, 250, 254, 231,
+}
+
+// ANSI returns the xterm 256-color palette index closest to c, or -1 for None.
+func (c Color) ANSI() int {
+	if c < 0 || int(c) >= len(ansi256) {
+		return -1
+	}
+	return ansi256[c]
+}
+
+// ANSI translates the formatting of text into ANSI escape codes, for display on a terminal.
+// Colors use the 256-color palette, and hex colors use 24-bit color. Monospace has no equivalent and is dropped.
+// The text ends with a reset when it has any formatting.
+func ANSI(text string) string {
+	spans := Lex(text)
+	if len(spans) == 1 && spans[0].Style == (Style{FG: None, BG: None}) {
+		return text
+	}
+	var b strings.Builder
+	for _, span := range spans {
+		b.WriteString("\x1b[0")
+		for _, attr := range []struct {
+			set  bool
+			code string
+		}{
+			{span.Bold, "1"},
+			{span.Italic, "3"},
+			{span.Underline, "4"},
+			{span.Reverse, "7"},
+			{span.Strikethrough, "9"},
+		} {
+			if attr.set {
+				b.WriteString(";" + attr.code)
+			}
+		}
+		writeANSIColor(&b, "38", span.FG, span.HexFG)
+		writeANSIColor(&b, "48", span.BG, span.HexBG)
+		b.WriteByte('m')
+		b.WriteString(span.Text)
+	}
+	if len(spans) > 0 {
+		b.WriteString("\x1b[0m")
+	}
+	return b.String()
+}
+
+// writeANSIColor writes the parameters of the SGR sequence which sets a color; layer is 38 for foreground or 48 for background.
+func writeANSIColor(b *strings.Builder, layer string, c Color, hex string) {
+	if len(hex) == 6 {
+		rgb, _ := strconv.ParseUint(hex, 16, 32)
+		fmt.Fprintf(b, ";%s;2;%d;%d;%d", layer, rgb>>16, rgb>>8&0xFF, rgb&0xFF)
+		return
+	}
+	if n := c.ANSI(); n >= 0 {
+		fmt.Fprintf(b, ";%s;5;%d", layer, n)
+	}
+}
@@ -0,0 +1,81 @@
+package ircfmt_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Travis-Britz/irc/ircfmt"
+)
+
+func TestBuilder(t *testing.T) {
+	tt := []struct {
+		name  string
+		built *ircfmt.Builder
+		want  string
+		len   int
+	}{
+		{"plain", ircfmt.New().Text("hello"), "hello", 5},
+		{"chained", ircfmt.New().Bold("alert: ").Color(ircfmt.Red, "down"), "\x02alert: \x02\x0304down\x03", 11},
+		{"digits after a color", ircfmt.New().Color(ircfmt.Blue, "5 nodes"), "\x03025 nodes\x03", 7},
+		{"background", ircfmt.New().ColorBG(ircfmt.White, ircfmt.Black, "x"), "\x0300,01x\x03", 1},
+		{"comma after a color", ircfmt.New().Color(ircfmt.Green, ",5"), "\x0303,99,5\x03", 2},
+		{"no color", ircfmt.New().ColorBG(ircfmt.None, ircfmt.None, "x"), "x", 1},
+		{"styles", ircfmt.New().Italic("a").Underline("b").Strikethrough("c").Monospace("d").Reverse("é"), "\x1da\x1d\x1fb\x1f\x1ec\x1e\x11d\x11\x16é\x16", 5},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.built.String(); got != tc.want {
+				t.Errorf("expected %q; got %q", tc.want, got)
+			}
+			if got := tc.built.Len(); got != tc.len {
+				t.Errorf("expected a length of %d; got %d", tc.len, got)
+			}
+		})
+	}
+}
+
+func TestLex(t *testing.T) {
+	plain := ircfmt.Style{FG: ircfmt.None, BG: ircfmt.None}
+	bold := plain
+	bold.Bold = true
+	red := plain
+	red.FG = ircfmt.Red
+	boldRedOnBlack := bold
+	boldRedOnBlack.FG, boldRedOnBlack.BG = ircfmt.Red, ircfmt.Black
+	hex := plain
+	hex.HexFG = "FF8800"
+
+	tt := []struct {
+		given string
+		want  []ircfmt.Span
+	}{
+		{"", nil},
+		{"hello", []ircfmt.Span{{Text: "hello", Style: plain}}},
+		{"\x02alert: \x02\x0304down\x03", []ircfmt.Span{{"alert: ", bold}, {"down", red}}},
+		{"\x02a\x034,1b\x0fc", []ircfmt.Span{{"a", bold}, {"b", boldRedOnBlack}, {"c", plain}}},
+		{"\x02\x02a\x0399b", []ircfmt.Span{{"ab", plain}}},
+		{"\x04ff8800x\x04,y", []ircfmt.Span{{"x", hex}, {",y", plain}}},
+	}
+	for _, tc := range tt {
+		if got := ircfmt.Lex(tc.given); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Lex(%q): expected %+v; got %+v", tc.given, tc.want, got)
+		}
+	}
+}
+
+func TestANSI(t *testing.T) {
+	tt := []struct {
+		given string
+		want  string
+	}{
+		{"hello", "hello"},
+		{"\x02alert: \x02\x0304down\x03", "\x1b[0;1malert: \x1b[0;38;5;9mdown\x1b[0m"},
+		{"\x1d\x0302,15x\x04FF0000y", "\x1b[0;3;38;5;4;48;5;7mx\x1b[0;3;38;2;255;0;0;48;5;7my\x1b[0m"},
+		{"\x11mono", "\x1b[0mmono\x1b[0m"},
+	}
+	for _, tc := range tt {
+		if got := ircfmt.ANSI(tc.given); got != tc.want {
+			t.Errorf("ANSI(%q): expected %q; got %q", tc.given, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,608 @@
+/*
+Package ircserver implements a tiny, single-process IRC server for the local development and testing of bots.
+
+It supports client registration, channels, topics, NAMES, PRIVMSG and NOTICE relay, nickname changes, AWAY, and PING.
+Everything else is answered with ERR_UNKNOWNCOMMAND.
+There are no server links, no services, no flood protection, and no security features of any kind,
+so it should never be exposed to a public network.
+
+	s := &ircserver.Server{}
+	go s.ListenAndServe("127.0.0.1:6667")
+	defer s.Close()
+*/
+package ircserver
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Travis-Britz/irc"
+)
+
+// ErrServerClosed is returned by Serve and ListenAndServe after Close is called.
+var ErrServerClosed = errors.New("ircserver: server closed")
+
+// Server is an IRC server. The zero value is ready to use.
+type Server struct {
+
+	// Name is the name of the server, used as the source of server messages.
+	// If empty, "irc.localhost" is used.
+	Name string
+
+	// Network is the network name advertised in RPL_ISUPPORT.
+	// If empty, "LocalNet" is used.
+	Network string
+
+	mu        sync.Mutex
+	clients   map[string]*client  // registered clients by folded nickname
+	channels  map[string]*channel // channels by folded name
+	conns     map[*client]struct{}
+	listeners []net.Listener
+	closed    bool
+	created   time.Time
+}
+
+// ListenAndServe listens on the TCP address addr and serves connections until Close is called.
+func (s *Server) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve accepts connections on ln and serves each of them in a new goroutine.
+// Serve always returns a non-nil error; after Close it returns ErrServerClosed.
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		_ = ln.Close()
+		return ErrServerClosed
+	}
+	s.listeners = append(s.listeners, ln)
+	s.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+		host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		go s.serve(conn, host)
+	}
+}
+
+// ServeConn serves a single connection, such as one end of irc.Pipe, and returns when the connection is closed.
+func (s *Server) ServeConn(rwc io.ReadWriteCloser) {
+	s.serve(rwc, "localhost")
+}
+
+// Close stops every listener and closes every connection.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	var err error
+	for _, ln := range s.listeners {
+		if e := ln.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	for c := range s.conns {
+		_ = c.conn.Close()
+	}
+	return err
+}
+
+func (s *Server) name() string {
+	if s.Name == "" {
+		return "irc.localhost"
+	}
+	return s.Name
+}
+
+func (s *Server) network() string {
+	if s.Network == "" {
+		return "LocalNet"
+	}
+	return s.Network
+}
+
+func (s *Server) serve(rwc io.ReadWriteCloser, host string) {
+	c := &client{server: s, conn: rwc, host: host, sendq: make(chan []byte, sendQueue), written: make(chan struct{})}
+	if host == "" {
+		c.host = "localhost"
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		_ = rwc.Close()
+		return
+	}
+	if s.conns == nil {
+		s.conns = make(map[*client]struct{})
+		s.clients = make(map[string]*client)
+		s.channels = make(map[string]*channel)
+		s.created = time.Now()
+	}
+	s.conns[c] = struct{}{}
+	s.mu.Unlock()
+
+	go c.writeLoop()
+	defer func() {
+		s.mu.Lock()
+		s.quit(c, "Connection closed")
+		delete(s.conns, c)
+		s.mu.Unlock()
+		// c can't be reached by other clients anymore, so nothing else is queued;
+		// the queue is flushed before the connection is closed so that the client receives ERROR
+		close(c.sendq)
+		<-c.written
+		_ = rwc.Close()
+	}()
+
+	scanner := bufio.NewScanner(rwc)
+	for scanner.Scan() {
+		line := bytes.TrimRight(scanner.Bytes(), "\r")
+		if len(line) == 0 {
+			continue
+		}
+		m := new(irc.Message)
+		if err := m.UnmarshalText(line); err != nil {
+			continue
+		}
+		// commands are case-insensitive
+		m.Command = irc.Command(strings.ToUpper(string(m.Command)))
+		s.mu.Lock()
+		quit := s.handle(c, m)
+		s.mu.Unlock()
+		if quit {
+			return
+		}
+	}
+}
+
+// handle processes a message from c. s.mu must be held.
+// It returns true when the connection should be closed.
+func (s *Server) handle(c *client, m *irc.Message) bool {
+	switch m.Command {
+	case irc.CmdPing:
+		c.send(s.message(irc.CmdPong, s.name(), m.Params.Get(1)))
+		return false
+	case irc.CmdPong, irc.CmdPass:
+		return false
+	case irc.CmdQuit:
+		reason := "Quit: " + m.Params.Get(1)
+		c.send(s.message(irc.CmdError, "Closing link: "+c.host+" ("+reason+")"))
+		s.quit(c, reason)
+		return true
+	case irc.CmdCap:
+		s.handleCap(c, m)
+		return false
+	case irc.CmdNick:
+		s.handleNick(c, m)
+		return false
+	case irc.CmdUser:
+		if c.registered {
+			c.numeric("462", "You may not reregister")
+			return false
+		}
+		if len(m.Params) < 4 {
+			c.numeric(irc.RplErrNeedMoreParams, irc.CmdUser, "Not enough parameters")
+			return false
+		}
+		c.user = "~" + m.Params.Get(1)
+		c.realname = m.Params.Get(4)
+		s.register(c)
+		return false
+	}
+
+	if !c.registered {
+		c.numeric(irc.RplErrNotRegistered, "You have not registered")
+		return false
+	}
+
+	switch m.Command {
+	case irc.CmdJoin:
+		for _, name := range strings.Split(m.Params.Get(1), ",") {
+			s.join(c, name)
+		}
+	case irc.CmdPart:
+		for _, name := range strings.Split(m.Params.Get(1), ",") {
+			s.part(c, name, m.Params.Get(2))
+		}
+	case irc.CmdPrivmsg, irc.CmdNotice:
+		s.relay(c, m)
+	case irc.CmdNames:
+		for _, name := range strings.Split(m.Params.Get(1), ",") {
+			s.names(c, name)
+		}
+	case irc.CmdTopic:
+		s.topic(c, m)
+	case irc.CmdAway:
+		// away users aren't reported to anyone; the replies only confirm the command
+		if c.away = m.Params.Get(1); c.away == "" {
+			c.numeric(irc.RplUnAway, "You are no longer marked as being away")
+		} else {
+			c.numeric(irc.RplNowAway, "You have been marked as being away")
+		}
+	default:
+		c.numeric(irc.RplErrUnknownCommand, string(m.Command), "Unknown command")
+	}
+	return false
+}
+
+func (s *Server) handleCap(c *client, m *irc.Message) {
+	switch strings.ToUpper(m.Params.Get(1)) {
+	case "LS":
+		// no capabilities are supported, but registration waits for CAP END like on a real server
+		c.negotiating = !c.registered
+		c.send(s.message(irc.CmdCap, c.target(), "LS", ""))
+	case "REQ":
+		c.send(s.message(irc.CmdCap, c.target(), "NAK", m.Params.Get(2)))
+	case "LIST":
+		c.send(s.message(irc.CmdCap, c.target(), "LIST", ""))
+	case "END":
+		c.negotiating = false
+		s.register(c)
+	}
+}
+
+func (s *Server) handleNick(c *client, m *irc.Message) {
+	nick := m.Params.Get(1)
+	if nick == "" {
+		c.numeric("431", "No nickname given")
+		return
+	}
+	if strings.ContainsAny(nick, " ,*?!@#:") || strings.HasPrefix(nick, "$") {
+		c.numeric("432", nick, "Erroneous nickname")
+		return
+	}
+	if s.nickInUse(c, nick) {
+		c.numeric(irc.RplErrNicknameInUse, nick, "Nickname is already in use")
+		return
+	}
+	if !c.registered {
+		c.nick = nick
+		s.register(c)
+		return
+	}
+
+	msg := s.messageFrom(c, irc.CmdNick, nick)
+	delete(s.clients, fold(c.nick))
+	c.nick = nick
+	s.clients[fold(nick)] = c
+	c.send(msg)
+	for other := range s.neighbors(c) {
+		other.send(msg)
+	}
+}
+
+// nickInUse reports whether a client other than c, registered or not, already has nick.
+func (s *Server) nickInUse(c *client, nick string) bool {
+	for other := range s.conns {
+		if other != c && !other.quit && other.nick != "" && fold(other.nick) == fold(nick) {
+			return true
+		}
+	}
+	return false
+}
+
+// register completes registration once the client sent both NICK and USER and finished capability negotiation.
+func (s *Server) register(c *client) {
+	if c.registered || c.negotiating || c.nick == "" || c.user == "" {
+		return
+	}
+	c.registered = true
+	s.clients[fold(c.nick)] = c
+
+	c.numeric(irc.RplWelcome, fmt.Sprintf("Welcome to the %s Network %s", s.network(), c.prefix()))
+	c.numeric(irc.RplYourHost, fmt.Sprintf("Your host is %s, running version ircserver", s.name()))
+	c.numeric(irc.RplCreated, "This server was created "+s.created.Format(time.RFC1123))
+	c.numeric(irc.RplMyInfo, s.name(), "ircserver", "i", "o")
+	c.numeric(irc.RplISupport, "CASEMAPPING=ascii", "CHANTYPES=#", "NETWORK="+s.network(), "PREFIX=(o)@", "are supported by this server")
+	c.numeric(irc.RplErrNoMOTD, "MOTD File is missing")
+}
+
+func (s *Server) join(c *client, name string) {
+	if !strings.HasPrefix(name, "#") || len(name) < 2 || strings.ContainsAny(name, " \x07,") {
+		c.numeric(irc.RplErrNoSuchChannel, name, "No such channel")
+		return
+	}
+	ch, ok := s.channels[fold(name)]
+	if !ok {
+		ch = &channel{name: name, members: make(map[*client]bool)}
+		s.channels[fold(name)] = ch
+	}
+	if _, joined := ch.members[c]; joined {
+		return
+	}
+	// the first member of a new channel is its operator
+	ch.members[c] = len(ch.members) == 0
+
+	msg := s.messageFrom(c, irc.CmdJoin, ch.name)
+	for member := range ch.members {
+		member.send(msg)
+	}
+	if ch.topic != "" {
+		c.numeric(irc.RplTopic, ch.name, ch.topic)
+	}
+	s.names(c, ch.name)
+}
+
+func (s *Server) part(c *client, name, reason string) {
+	ch, ok := s.channels[fold(name)]
+	if !ok {
+		c.numeric(irc.RplErrNoSuchChannel, name, "No such channel")
+		return
+	}
+	if _, joined := ch.members[c]; !joined {
+		c.numeric(irc.RplErrNotOnChannel, ch.name, "You're not on that channel")
+		return
+	}
+	params := []string{ch.name}
+	if reason != "" {
+		params = append(params, reason)
+	}
+	msg := s.messageFrom(c, irc.CmdPart, params...)
+	for member := range ch.members {
+		member.send(msg)
+	}
+	s.leave(c, ch)
+}
+
+// leave removes c from ch, and deletes ch when it's empty.
+func (s *Server) leave(c *client, ch *channel) {
+	delete(ch.members, c)
+	if len(ch.members) == 0 {
+		delete(s.channels, fold(ch.name))
+	}
+}
+
+func (s *Server) relay(c *client, m *irc.Message) {
+	target, text := m.Params.Get(1), m.Params.Get(2)
+	if target == "" {
+		c.numeric(irc.RplErrNoRecipient, "No recipient given ("+string(m.Command)+")")
+		return
+	}
+	if text == "" {
+		c.numeric(irc.RplErrNoTextToSend, "No text to send")
+		return
+	}
+	msg := s.messageFrom(c, m.Command, target, text)
+	msg.Tags = clientTags(m.Tags)
+
+	if strings.HasPrefix(target, "#") {
+		ch, ok := s.channels[fold(target)]
+		if !ok {
+			c.numeric(irc.RplErrNoSuchChannel, target, "No such channel")
+			return
+		}
+		if _, joined := ch.members[c]; !joined {
+			c.numeric(irc.RplErrCannotSendToChan, ch.name, "Cannot send to channel")
+			return
+		}
+		for member := range ch.members {
+			if member != c {
+				member.send(msg)
+			}
+		}
+		return
+	}
+
+	other, ok := s.clients[fold(target)]
+	if !ok {
+		c.numeric(irc.RplErrNoSuchNick, target, "No such nick/channel")
+		return
+	}
+	other.send(msg)
+}
+
+// clientTags returns the client-only tags (prefixed with '+') of tags, which are relayed with messages.
+func clientTags(tags irc.Tags) irc.Tags {
+	var relayed irc.Tags
+	for k, v := range tags {
+		if strings.HasPrefix(k, "+") {
+			if relayed == nil {
+				relayed = make(irc.Tags)
+			}
+			relayed[k] = v
+		}
+	}
+	return relayed
+}
+
+func (s *Server) names(c *client, name string) {
+	if ch, ok := s.channels[fold(name)]; ok {
+		var nicks []string
+		for member, op := range ch.members {
+			if op {
+				nicks = append(nicks, "@"+member.nick)
+			} else {
+				nicks = append(nicks, member.nick)
+			}
+		}
+		sort.Strings(nicks)
+		c.numeric(irc.RplNamReply, "=", ch.name, strings.Join(nicks, " "))
+		name = ch.name
+	}
+	c.numeric(irc.RplEndOfNames, name, "End of /NAMES list")
+}
+
+func (s *Server) topic(c *client, m *irc.Message) {
+	name := m.Params.Get(1)
+	ch, ok := s.channels[fold(name)]
+	if !ok {
+		c.numeric(irc.RplErrNoSuchChannel, name, "No such channel")
+		return
+	}
+	if len(m.Params) < 2 {
+		if ch.topic == "" {
+			c.numeric(irc.RplNoTopic, ch.name, "No topic is set")
+		} else {
+			c.numeric(irc.RplTopic, ch.name, ch.topic)
+		}
+		return
+	}
+	if _, joined := ch.members[c]; !joined {
+		c.numeric(irc.RplErrNotOnChannel, ch.name, "You're not on that channel")
+		return
+	}
+	ch.topic = m.Params.Get(2)
+	msg := s.messageFrom(c, irc.CmdTopic, ch.name, ch.topic)
+	for member := range ch.members {
+		member.send(msg)
+	}
+}
+
+// quit removes c from the server and tells the users who shared a channel with it. s.mu must be held.
+func (s *Server) quit(c *client, reason string) {
+	if c.quit {
+		return
+	}
+	c.quit = true
+	if !c.registered {
+		return
+	}
+	msg := s.messageFrom(c, irc.CmdQuit, reason)
+	for other := range s.neighbors(c) {
+		other.send(msg)
+	}
+	for _, ch := range s.channels {
+		if _, joined := ch.members[c]; joined {
+			s.leave(c, ch)
+		}
+	}
+	delete(s.clients, fold(c.nick))
+}
+
+// neighbors returns the clients other than c who share a channel with c.
+func (s *Server) neighbors(c *client) map[*client]struct{} {
+	found := make(map[*client]struct{})
+	for _, ch := range s.channels {
+		if _, joined := ch.members[c]; !joined {
+			continue
+		}
+		for member := range ch.members {
+			if member != c {
+				found[member] = struct{}{}
+			}
+		}
+	}
+	return found
+}
+
+// message returns a message from the server.
+func (s *Server) message(cmd irc.Command, params ...string) *irc.Message {
+	return irc.NewMessage(cmd, params...).WithSource(irc.Prefix{Host: s.name()})
+}
+
+// messageFrom returns a message from the client c.
+func (s *Server) messageFrom(c *client, cmd irc.Command, params ...string) *irc.Message {
+	return irc.NewMessage(cmd, params...).WithSource(c.prefix())
+}
+
+// sendQueue is the number of messages queued for a client before it's disconnected for not reading them.
+const sendQueue = 512
+
+type client struct {
+	server *Server
+	conn   io.ReadWriteCloser
+
+	// sendq holds the messages waiting to be written by writeLoop, so that a client which doesn't read
+	// never blocks the server while s.mu is held. It's closed when the connection is done.
+	sendq chan []byte
+
+	// written is closed when writeLoop returns.
+	written chan struct{}
+
+	nick, user, host, realname string
+	away                       string
+
+	negotiating bool
+	registered  bool
+	quit        bool
+}
+
+func (c *client) prefix() irc.Prefix {
+	return irc.Prefix{Nick: irc.Nickname(c.nick), User: c.user, Host: c.host}
+}
+
+// target returns the nickname of c for use as the first parameter of replies, or "*" before it has one.
+func (c *client) target() string {
+	if c.nick == "" {
+		return "*"
+	}
+	return c.nick
+}
+
+// numeric sends a numeric reply to c.
+func (c *client) numeric(cmd irc.Command, params ...string) {
+	c.send(c.server.message(cmd, append([]string{c.target()}, params...)...))
+}
+
+// send queues m to be written to c. s.mu must be held.
+// A client whose queue is full is disconnected, like a server would for an exceeded SendQ.
+func (c *client) send(m *irc.Message) {
+	b, err := m.MarshalText()
+	if len(b) == 0 && err != nil {
+		return
+	}
+	if c.quit {
+		return
+	}
+	select {
+	case c.sendq <- b:
+	default:
+		c.server.quit(c, "Max SendQ exceeded")
+		_ = c.conn.Close()
+	}
+}
+
+// writeLoop writes the queued messages of c until the queue is closed.
+func (c *client) writeLoop() {
+	defer close(c.written)
+	var failed bool
+	for b := range c.sendq {
+		if failed {
+			continue
+		}
+		if _, err := c.conn.Write(b); err != nil {
+			failed = true
+		}
+	}
+}
+
+type channel struct {
+	name  string
+	topic string
+
+	// members maps each member to whether it's a channel operator.
+	members map[*client]bool
+}
+
+// fold returns the ascii case mapping of s, for comparing nicknames and channel names.
+func fold(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'A' && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return r
+	}, s)
+}
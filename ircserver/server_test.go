@@ -0,0 +1,184 @@
+package ircserver_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Travis-Britz/irc"
+	"github.com/Travis-Britz/irc/ircserver"
+)
+
+// dial returns a DialFn which connects to s with irc.Pipe.
+func dial(s *ircserver.Server) func() (io.ReadWriteCloser, error) {
+	return func() (io.ReadWriteCloser, error) {
+		client, server := irc.Pipe()
+		go s.ServeConn(server)
+		return client, nil
+	}
+}
+
+func TestServer_relay(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	s := &ircserver.Server{}
+	defer s.Close()
+
+	joined := make(chan struct{})
+	received := make(chan string, 1)
+
+	listener := &irc.Client{Nickname: "listener", DialFn: dial(s)}
+	lr := &irc.Router{}
+	lr.OnConnect(func(w irc.MessageWriter, m *irc.Message) {
+		w.WriteMessage(irc.Join("#test"))
+	})
+	lr.OnJoin(func(w irc.MessageWriter, m *irc.Message) {
+		close(joined)
+	}).MatchClient(listener)
+	lr.OnText("*", func(w irc.MessageWriter, m *irc.Message) {
+		received <- m.Source.Nick.String() + ": " + m.Params.Get(2)
+		w.WriteMessage(irc.Quit("bye"))
+	})
+	go func() { _ = listener.ConnectAndRun(ctx, lr) }()
+
+	select {
+	case <-joined:
+	case <-ctx.Done():
+		t.Fatal("listener never joined the channel")
+	}
+
+	speaker := &irc.Client{Nickname: "speaker", DialFn: dial(s)}
+	sr := &irc.Router{}
+	sr.OnConnect(func(w irc.MessageWriter, m *irc.Message) {
+		w.WriteMessage(irc.Join("#test"))
+	})
+	sr.HandleFunc(irc.RplEndOfNames, func(w irc.MessageWriter, m *irc.Message) {
+		w.WriteMessage(irc.Msg("#test", "hello"))
+		w.WriteMessage(irc.Quit("bye"))
+	})
+	if err := speaker.ConnectAndRun(ctx, sr); err != nil {
+		t.Errorf("expected speaker to exit without errors; got: %v", err)
+	}
+
+	select {
+	case got := <-received:
+		if got != "speaker: hello" {
+			t.Errorf("expected listener to receive the message from speaker; got %q", got)
+		}
+	case <-ctx.Done():
+		t.Error("listener never received the message")
+	}
+}
+
+func TestServer_nicknameInUse(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	s := &ircserver.Server{}
+	defer s.Close()
+
+	first := &irc.Client{Nickname: "bot", DialFn: dial(s)}
+	connected := make(chan struct{})
+	go func() {
+		_ = first.ConnectAndRun(ctx, irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+			if m.Command == irc.RplWelcome {
+				close(connected)
+			}
+		}))
+	}()
+	<-connected
+
+	second := &irc.Client{Nickname: "BOT", DialFn: dial(s)}
+	err := second.ConnectAndRun(ctx, irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+		if m.Command == irc.RplErrNicknameInUse {
+			w.WriteMessage(irc.Quit("bye"))
+		}
+	}))
+	if err != nil {
+		t.Errorf("expected the second client to be told its nickname is in use and quit; got: %v", err)
+	}
+}
+
+// raw connects to s with net.Pipe, whose writes block until they're read, and returns a scanner of the lines it receives.
+func raw(s *ircserver.Server) (net.Conn, *bufio.Scanner) {
+	client, server := net.Pipe()
+	go s.ServeConn(server)
+	return client, bufio.NewScanner(client)
+}
+
+// expect reads lines from scanner until one contains want.
+func expect(t *testing.T, scanner *bufio.Scanner, want string) {
+	t.Helper()
+	for scanner.Scan() {
+		if strings.Contains(scanner.Text(), want) {
+			return
+		}
+	}
+	t.Fatalf("expected a line containing %q", want)
+}
+
+func TestServer_lowercaseCommands(t *testing.T) {
+	s := &ircserver.Server{}
+	defer s.Close()
+
+	conn, scanner := raw(s)
+	defer conn.Close()
+	go fmt.Fprint(conn, "nick bot\r\nuser bot 0 * :Bot\r\nping :token\r\n")
+	expect(t, scanner, " 001 bot ")
+	expect(t, scanner, "PONG")
+}
+
+func TestServer_nicknameInUseUnregistered(t *testing.T) {
+	s := &ircserver.Server{}
+	defer s.Close()
+
+	first, _ := raw(s)
+	defer first.Close()
+	if _, err := fmt.Fprint(first, "NICK bot\r\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	second, scanner := raw(s)
+	defer second.Close()
+	go fmt.Fprint(second, "NICK Bot\r\n")
+	expect(t, scanner, " 433 ")
+}
+
+func TestServer_stalledClient(t *testing.T) {
+	s := &ircserver.Server{}
+	defer s.Close()
+
+	// stalled joins the channel, and then never reads again
+	stalled, stalledScanner := raw(s)
+	defer stalled.Close()
+	go fmt.Fprint(stalled, "NICK stalled\r\nUSER stalled 0 * :Stalled\r\nJOIN #test\r\n")
+	expect(t, stalledScanner, " 366 ")
+
+	speaker, scanner := raw(s)
+	defer speaker.Close()
+	go func() {
+		fmt.Fprint(speaker, "NICK speaker\r\nUSER speaker 0 * :Speaker\r\nJOIN #test\r\n")
+		for i := 0; i < 1000; i++ {
+			fmt.Fprintf(speaker, "PRIVMSG #test :message %d\r\n", i)
+		}
+		fmt.Fprint(speaker, "PING :done\r\n")
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for scanner.Scan() && !strings.Contains(scanner.Text(), "PONG") {
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected a client which doesn't read not to block the server")
+	}
+}
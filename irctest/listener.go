@@ -0,0 +1,174 @@
+package irctest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+// A Listener serves mock IRC servers on a real TCP socket,
+// so that a client can be tested through its default dialer (Client.Addr)
+// instead of bypassing the network with Client.DialFn.
+type Listener struct {
+	ln    net.Listener
+	setup func(*Server)
+	roots *x509.CertPool
+
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	servers []*Server
+	stall   bool
+	stalled []net.Conn
+}
+
+// ListenTCP starts a Listener for plain-text connections on a random port on the loopback interface.
+//
+// Each accepted connection is served by a new Server,
+// which is passed to setup (if not nil) before the connection is read from.
+// setup would typically set the Handler of the server.
+func ListenTCP(setup func(*Server)) (*Listener, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	l := &Listener{ln: ln, setup: setup}
+	l.wg.Add(1)
+	go l.serve()
+	return l, nil
+}
+
+// ListenTLS is like ListenTCP, but connections are served with TLS using a newly generated self-signed certificate.
+// Clients must use the configuration returned by TLSConfig to trust the certificate.
+func ListenTLS(setup func(*Server)) (*Listener, error) {
+	cert, err := selfSigned()
+	if err != nil {
+		return nil, err
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		// client certificates are requested but not verified,
+		// so that handlers can inspect them (e.g. to test CertFP).
+		ClientAuth: tls.RequestClientCert,
+	})
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+	l := &Listener{ln: ln, setup: setup, roots: roots}
+	l.wg.Add(1)
+	go l.serve()
+	return l, nil
+}
+
+// Addr returns the "host:port" address of the listener, suitable for Client.Addr.
+func (l *Listener) Addr() string {
+	return l.ln.Addr().String()
+}
+
+// TLSConfig returns a client configuration which trusts the certificate of a Listener created by ListenTLS.
+// It returns nil for plain-text listeners.
+func (l *Listener) TLSConfig() *tls.Config {
+	if l.roots == nil {
+		return nil
+	}
+	return &tls.Config{RootCAs: l.roots}
+}
+
+// Stall makes the listener accept new connections without ever reading from or writing to them, while stall is true,
+// so that a client's timeouts can be tested: a TLS handshake never completes, and a plain-text server never speaks.
+// Stalled connections are closed by Close.
+func (l *Listener) Stall(stall bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stall = stall
+}
+
+// Close stops accepting connections and closes every Server created by the listener.
+func (l *Listener) Close() error {
+	err := l.ln.Close()
+	l.mu.Lock()
+	for _, s := range l.servers {
+		_ = s.Close()
+	}
+	for _, conn := range l.stalled {
+		_ = conn.Close()
+	}
+	l.mu.Unlock()
+	l.wg.Wait()
+	return err
+}
+
+func (l *Listener) serve() {
+	defer l.wg.Done()
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			return
+		}
+		l.mu.Lock()
+		stall := l.stall
+		if stall {
+			l.stalled = append(l.stalled, conn)
+		}
+		l.mu.Unlock()
+		if stall {
+			continue
+		}
+		s := NewServer()
+		if l.setup != nil {
+			l.setup(s)
+		}
+		l.mu.Lock()
+		l.servers = append(l.servers, s)
+		l.mu.Unlock()
+
+		go func() {
+			// server to client
+			_, _ = io.Copy(conn, s)
+			_ = conn.Close()
+		}()
+		go func() {
+			// client to server
+			_, _ = io.Copy(s, conn)
+			_ = s.Close()
+		}()
+	}
+}
+
+// selfSigned generates a certificate valid for the loopback interface.
+func selfSigned() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "irctest"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		DNSNames:              []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
@@ -0,0 +1,111 @@
+package irctest_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/Travis-Britz/irc"
+	"github.com/Travis-Britz/irc/ircdial"
+	"github.com/Travis-Britz/irc/irctest"
+)
+
+// welcome registers every client which connects to s, and closes the connection when it quits.
+func welcome(s *irctest.Server) {
+	s.Handler = irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+		switch m.Command {
+		case irc.CmdUser:
+			s.WriteString(":irc.example.com 001 bot :Welcome")
+		case irc.CmdQuit:
+			_ = s.Close()
+		}
+	})
+}
+
+// registers reports whether a client which connects with dial is welcomed by the server.
+func registers(dial func() (io.ReadWriteCloser, error)) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	welcomed := false
+	client := &irc.Client{Nickname: "bot", DialFn: dial}
+	_ = client.ConnectAndRun(ctx, irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+		if m.Command == irc.RplWelcome {
+			welcomed = true
+			cancel()
+		}
+	}))
+	return welcomed
+}
+
+func TestListenTCP(t *testing.T) {
+	l, err := irctest.ListenTCP(welcome)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if l.TLSConfig() != nil {
+		t.Errorf("expected no TLS configuration for a plain-text listener")
+	}
+	if !registers(ircdial.New(l.Addr())) {
+		t.Errorf("expected the client to register over TCP")
+	}
+}
+
+func TestListenTLS(t *testing.T) {
+	l, err := irctest.ListenTLS(welcome)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if !registers(ircdial.New(l.Addr(), ircdial.TLS(l.TLSConfig()))) {
+		t.Errorf("expected the client to register over TLS")
+	}
+}
+
+func TestListener_Stall(t *testing.T) {
+	l, err := irctest.ListenTLS(welcome)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.Stall(true)
+
+	start := time.Now()
+	_, err = ircdial.New(l.Addr(), ircdial.Timeout(100*time.Millisecond), ircdial.TLS(l.TLSConfig()))()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the TLS handshake to time out; got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the dial to give up after its timeout; took %s", elapsed)
+	}
+
+	l.Stall(false)
+	if !registers(ircdial.New(l.Addr(), ircdial.TLS(l.TLSConfig()))) {
+		t.Errorf("expected the client to register once the listener stops stalling")
+	}
+}
+
+func TestListenProxy(t *testing.T) {
+	l, err := irctest.ListenTCP(welcome)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	p, err := irctest.ListenProxy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	for _, proxyURL := range []string{"socks5://" + p.Addr(), "socks5://bot:secret@" + p.Addr(), "http://" + p.Addr()} {
+		if !registers(ircdial.New(l.Addr(), ircdial.Proxy(proxyURL))) {
+			t.Errorf("expected the client to register through %s", proxyURL)
+		}
+	}
+	targets := p.Targets()
+	if len(targets) != 3 || targets[0] != l.Addr() || targets[2] != l.Addr() {
+		t.Errorf("expected the proxy to connect to %s three times; got %q", l.Addr(), targets)
+	}
+}
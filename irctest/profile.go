@@ -0,0 +1,316 @@
+package irctest
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Travis-Britz/irc"
+)
+
+// A Profile describes the personality of a real-world IRC server: what it sends during registration,
+// which capabilities it offers, and the quirks that clients have to cope with.
+// Profiles let handler packages be tested against the variety of servers they'll meet.
+//
+// Use Setup with NewServer, ListenTCP, or ListenTLS:
+//
+//	l, err := irctest.ListenTLS(irctest.Ergo.Setup)
+type Profile struct {
+
+	// Name identifies the profile, e.g. "ergo".
+	Name string
+
+	// ServerName is the source of messages from the server.
+	ServerName string
+
+	// Caps are the capabilities listed in reply to CAP LS, as "name" or "name=value".
+	// If nil, the server predates capability negotiation and answers CAP with ERR_UNKNOWNCOMMAND.
+	Caps []string
+
+	// ISupport are the tokens sent in RPL_ISUPPORT (005) after registration.
+	// If nil, no RPL_ISUPPORT is sent.
+	ISupport []string
+
+	// Welcome is the text of RPL_WELCOME (001). "%s" is replaced by the client's nick!user@host.
+	Welcome string
+
+	// MyInfo are the parameters of RPL_MYINFO (004) after the client's nickname.
+	MyInfo []string
+
+	// MOTD is the message of the day. If nil, ERR_NOMOTD is sent instead.
+	MOTD []string
+
+	// ClientHost is the client's host as seen by the server. "%s" is replaced by the client's nickname.
+	ClientHost string
+
+	// LowercaseNicks makes the server lowercase the nickname requested by the client, like Twitch.
+	LowercaseNicks bool
+}
+
+// Presets for the servers that the irc package special-cases.
+var (
+	// RFC1459 is a server from before IRCv3 and RPL_ISUPPORT: no capabilities, no tags, and no 005.
+	RFC1459 = Profile{
+		Name:       "rfc1459",
+		ServerName: "irc.example.com",
+		Welcome:    "Welcome to the Internet Relay Network %s",
+		MyInfo:     []string{"irc.example.com", "2.8/hybrid-5.3", "iowsw", "biklmnopstv"},
+		MOTD:       []string{"- irc.example.com Message of the Day -", "- Be excellent to each other."},
+		ClientHost: "127.0.0.1",
+	}
+
+	// IRCv3 is a modern server which supports every commonly implemented capability.
+	IRCv3 = Profile{
+		Name:       "ircv3",
+		ServerName: "irc.example.com",
+		Caps: []string{
+			"account-notify", "account-tag", "away-notify", "batch", "cap-notify", "chghost", "echo-message",
+			"extended-join", "invite-notify", "labeled-response", "message-tags", "multi-prefix",
+			"sasl=PLAIN,EXTERNAL", "server-time", "setname", "userhost-in-names",
+		},
+		ISupport: []string{
+			"AWAYLEN=390", "CASEMAPPING=ascii", "CHANLIMIT=#:100", "CHANMODES=beI,k,l,imnpst", "CHANNELLEN=64",
+			"CHANTYPES=#", "ELIST=U", "EXCEPTS", "INVEX", "KICKLEN=390", "MAXTARGETS=4", "MODES=4", "NETWORK=Example",
+			"NICKLEN=32", "PREFIX=(ov)@+", "STATUSMSG=@+", "TARGMAX=NAMES:1,LIST:1,KICK:,WHOIS:1,PRIVMSG:4,NOTICE:4", "TOPICLEN=390",
+		},
+		Welcome:    "Welcome to the Example IRC Network %s",
+		MyInfo:     []string{"irc.example.com", "example-1.0", "iorw", "beiklmnopstv", "bklov"},
+		MOTD:       []string{"- irc.example.com Message of the Day -", "- Welcome!"},
+		ClientHost: "127.0.0.1",
+	}
+
+	// Twitch is Twitch's IRC interface, which ignores much of the protocol:
+	// RPL_WELCOME doesn't include the client's address, RPL_MYINFO has no real parameters,
+	// there is no RPL_ISUPPORT, and nicknames are always lowercase.
+	Twitch = Profile{
+		Name:           "twitch",
+		ServerName:     "tmi.twitch.tv",
+		Caps:           []string{"twitch.tv/commands", "twitch.tv/membership", "twitch.tv/tags"},
+		Welcome:        "Welcome, GLHF!",
+		MyInfo:         []string{"-"},
+		MOTD:           []string{"-", "You are in a maze of twisty passages, all alike.", ">"},
+		ClientHost:     "%s.tmi.twitch.tv",
+		LowercaseNicks: true,
+	}
+
+	// InspIRCd is an InspIRCd 3 server with its default modules, which has extra prefix modes and the rfc1459 case mapping.
+	InspIRCd = Profile{
+		Name:       "inspircd",
+		ServerName: "irc.inspircd.example",
+		Caps: []string{
+			"account-notify", "away-notify", "cap-notify", "chghost", "extended-join", "invite-notify",
+			"message-tags", "multi-prefix", "sasl=PLAIN,EXTERNAL", "server-time", "userhost-in-names",
+		},
+		ISupport: []string{
+			"AWAYLEN=200", "CASEMAPPING=rfc1459", "CHANLIMIT=#:20", "CHANMODES=IXbeg,k,FJLfjl,ACKMNOPQRSTcimnprstz",
+			"CHANNELLEN=64", "CHANTYPES=#", "ELIST=CMNTU", "EXCEPTS=e", "EXTBAN=,ACNOQRSTUacjmnprswz", "INVEX=I",
+			"KEYLEN=32", "KICKLEN=255", "LINELEN=512", "MAXLIST=I:100,X:100,b:100,e:100,g:100", "MAXTARGETS=20",
+			"MODES=20", "NAMESX", "NETWORK=InspIRCd", "NICKLEN=30", "PREFIX=(qaohv)~&@%+", "SAFELIST", "STATUSMSG=~&@%+",
+			"TOPICLEN=307", "UHNAMES", "USERLEN=10", "WHOX",
+		},
+		Welcome:    "Welcome to the InspIRCd IRC Network %s",
+		MyInfo:     []string{"irc.inspircd.example", "InspIRCd-3", "BILRSWcdghikorswxz", "ACIKLMNOPQRSTXabcefghijklmnopqrstvz", "IXabefghjkloqv"},
+		MOTD:       []string{"- irc.inspircd.example message of the day", "- Be nice."},
+		ClientHost: "127.0.0.1",
+	}
+
+	// Ergo is an Ergo server, which only accepts UTF-8 and supports many draft capabilities.
+	Ergo = Profile{
+		Name:       "ergo",
+		ServerName: "ergo.test",
+		Caps: []string{
+			"account-notify", "account-tag", "away-notify", "batch", "cap-notify", "chghost", "draft/chathistory",
+			"draft/event-playback", "draft/languages=1,en,~bs", "draft/relaymsg=/", "echo-message", "extended-join",
+			"extended-monitor", "invite-notify", "labeled-response", "message-tags", "multi-prefix", "sasl=PLAIN,EXTERNAL,SCRAM-SHA-256",
+			"server-time", "setname", "standard-replies", "userhost-in-names",
+		},
+		ISupport: []string{
+			"AWAYLEN=390", "BOT=B", "CASEMAPPING=ascii", "CHANLIMIT=#:100", "CHANMODES=Ibe,k,fl,CEMRUimnstu", "CHANNELLEN=64",
+			"CHANTYPES=#", "CHATHISTORY=1000", "ELIST=U", "EXCEPTS", "EXTBAN=,m", "FORWARD=f", "INVEX", "KICKLEN=390",
+			"MAXLIST=beI:100", "MAXTARGETS=4", "MODES", "MONITOR=100", "NETWORK=ErgoTest", "NICKLEN=32", "PREFIX=(qaohv)~&@%+",
+			"STATUSMSG=~&@%+", "TARGMAX=NAMES:1,LIST:1,KICK:,WHOIS:1,USERHOST:10,PRIVMSG:4,TAGMSG:4,NOTICE:4,MONITOR:100",
+			"TOPICLEN=390", "UTF8ONLY", "WHOX",
+		},
+		Welcome:    "Welcome to the ErgoTest IRC Network %s",
+		MyInfo:     []string{"ergo.test", "ergo-2.12.0", "BERTZios", "CEIMRUabefhiklmnoqstuv", "Ikbeflqahov"},
+		ClientHost: "127.0.0.1",
+	}
+)
+
+// Setup sets the handler of s to act like the server described by p.
+// The handler negotiates capabilities, registers the client with the profile's welcome burst,
+// answers PING, echoes JOIN and PART with the channel's names list, and closes the connection after QUIT.
+func (p Profile) Setup(s *Server) {
+	st := &profileState{profile: p, server: s}
+	s.Handler = irc.HandlerFunc(st.handle)
+}
+
+// profileState is the state of one client connection to a profile server.
+type profileState struct {
+	profile Profile
+	server  *Server
+
+	nick, user  string
+	negotiating bool // capability negotiation started and hasn't ended yet
+	registered  bool
+	caps302     bool
+}
+
+func (st *profileState) send(format string, args ...any) {
+	st.server.WriteString(fmt.Sprintf(format, args...))
+}
+
+// numeric sends a numeric reply from the server to the client.
+func (st *profileState) numeric(code string, params ...string) {
+	nick := st.nick
+	if nick == "" {
+		nick = "*"
+	}
+	m := irc.NewMessage(irc.Command(code), append([]string{nick}, params...)...).WithSource(irc.Prefix{Host: st.profile.ServerName})
+	b, _ := m.MarshalText()
+	st.server.WriteString(string(b))
+}
+
+// address returns the client's nick!user@host.
+func (st *profileState) address() string {
+	host := strings.ReplaceAll(st.profile.ClientHost, "%s", st.nick)
+	return irc.Prefix{Nick: irc.Nickname(st.nick), User: st.user, Host: host}.String()
+}
+
+func (st *profileState) handle(w irc.MessageWriter, m *irc.Message) {
+	p := st.profile
+	switch m.Command {
+	case irc.CmdCap:
+		if p.Caps == nil {
+			st.numeric(irc.RplErrUnknownCommand, "CAP", "Unknown command")
+			return
+		}
+		st.handleCap(m)
+	case irc.CmdAuthenticate:
+		// any credentials are accepted
+		if m.Params.Get(1) == "PLAIN" || m.Params.Get(1) == "EXTERNAL" {
+			st.send("AUTHENTICATE +")
+			return
+		}
+		st.numeric(irc.RplLoggedIn, st.address(), st.nick, "You are now logged in as "+st.nick)
+		st.numeric(irc.RplSASLSuccess, "SASL authentication successful")
+	case irc.CmdNick:
+		nick := m.Params.Get(1)
+		if p.LowercaseNicks {
+			nick = strings.ToLower(nick)
+		}
+		if st.registered {
+			st.send(":%s NICK :%s", st.address(), nick)
+		}
+		st.nick = nick
+		st.register()
+	case irc.CmdUser:
+		st.user = m.Params.Get(1)
+		if p.LowercaseNicks {
+			st.user = st.nick
+		}
+		st.register()
+	case irc.CmdPing:
+		st.send(":%s PONG %s :%s", p.ServerName, p.ServerName, m.Params.Get(1))
+	case irc.CmdJoin:
+		for _, channel := range strings.Split(m.Params.Get(1), ",") {
+			st.send(":%s JOIN :%s", st.address(), channel)
+			st.numeric(irc.RplNamReply, "=", channel, st.nick)
+			st.numeric(irc.RplEndOfNames, channel, "End of /NAMES list.")
+		}
+	case irc.CmdPart:
+		for _, channel := range strings.Split(m.Params.Get(1), ",") {
+			st.send(":%s PART :%s", st.address(), channel)
+		}
+	case irc.CmdQuit:
+		st.send("ERROR :Closing Link: %s (Quit: %s)", st.address(), m.Params.Get(1))
+		_ = st.server.Close()
+	}
+}
+
+func (st *profileState) handleCap(m *irc.Message) {
+	switch strings.ToUpper(m.Params.Get(1)) {
+	case "LS":
+		if !st.registered {
+			st.negotiating = true
+		}
+		st.caps302 = m.Params.Get(2) >= "302"
+		caps := make([]string, len(st.profile.Caps))
+		for i, c := range st.profile.Caps {
+			caps[i] = c
+			if !st.caps302 {
+				caps[i], _, _ = strings.Cut(c, "=")
+			}
+		}
+		st.send(":%s CAP %s LS :%s", st.profile.ServerName, st.target(), strings.Join(caps, " "))
+	case "REQ":
+		if !st.registered {
+			st.negotiating = true
+		}
+		requested := m.Params.Get(2)
+		for _, name := range strings.Fields(requested) {
+			if !st.offers(strings.TrimPrefix(name, "-")) {
+				st.send(":%s CAP %s NAK :%s", st.profile.ServerName, st.target(), requested)
+				return
+			}
+		}
+		st.send(":%s CAP %s ACK :%s", st.profile.ServerName, st.target(), requested)
+	case "END":
+		st.negotiating = false
+		st.register()
+	}
+}
+
+// target is the client's nickname, or "*" before it has one.
+func (st *profileState) target() string {
+	if st.nick == "" {
+		return "*"
+	}
+	return st.nick
+}
+
+// offers reports whether the profile lists the capability name.
+func (st *profileState) offers(name string) bool {
+	for _, c := range st.profile.Caps {
+		if n, _, _ := strings.Cut(c, "="); n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// register sends the welcome burst once the client sent NICK and USER and ended capability negotiation.
+func (st *profileState) register() {
+	if st.registered || st.negotiating || st.nick == "" || st.user == "" {
+		return
+	}
+	st.registered = true
+	p := st.profile
+
+	welcome := p.Welcome
+	if strings.Contains(welcome, "%s") {
+		welcome = fmt.Sprintf(welcome, st.address())
+	}
+	st.numeric(irc.RplWelcome, welcome)
+	st.numeric(irc.RplYourHost, "Your host is "+p.ServerName)
+	st.numeric(irc.RplCreated, "This server was created a while ago")
+	st.numeric(irc.RplMyInfo, p.MyInfo...)
+
+	// servers send at most 13 tokens per line
+	for i := 0; i < len(p.ISupport); i += 13 {
+		end := i + 13
+		if end > len(p.ISupport) {
+			end = len(p.ISupport)
+		}
+		st.numeric(irc.RplISupport, append(p.ISupport[i:end:end], "are supported by this server")...)
+	}
+
+	if p.MOTD == nil {
+		st.numeric(irc.RplErrNoMOTD, "MOTD File is missing")
+		return
+	}
+	st.numeric(irc.RplMOTDStart, p.MOTD[0])
+	for _, line := range p.MOTD[1:] {
+		st.numeric(irc.RplMOTD, line)
+	}
+	st.numeric(irc.RplEndOfMOTD, "End of /MOTD command.")
+}
@@ -0,0 +1,228 @@
+package irctest
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// A Proxy is a SOCKS5 and HTTP CONNECT proxy on the loopback interface, for testing clients which connect through a proxy,
+// such as with ircdial.Proxy. It connects to any address it's asked for, and accepts any credentials.
+type Proxy struct {
+	ln net.Listener
+	wg sync.WaitGroup
+
+	mu      sync.Mutex
+	targets []string
+	conns   []net.Conn
+	closed  bool
+}
+
+// ListenProxy starts a Proxy on a random port on the loopback interface.
+// The protocol of each connection is detected from its first byte.
+func ListenProxy() (*Proxy, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	p := &Proxy{ln: ln}
+	p.wg.Add(1)
+	go p.serve()
+	return p, nil
+}
+
+// Addr returns the "host:port" address of the proxy.
+func (p *Proxy) Addr() string {
+	return p.ln.Addr().String()
+}
+
+// Targets returns the addresses the proxy was asked to connect to, in order.
+func (p *Proxy) Targets() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.targets...)
+}
+
+// Close stops accepting connections and closes every connection made through the proxy.
+func (p *Proxy) Close() error {
+	err := p.ln.Close()
+	p.mu.Lock()
+	p.closed = true
+	for _, conn := range p.conns {
+		_ = conn.Close()
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+	return err
+}
+
+func (p *Proxy) serve() {
+	defer p.wg.Done()
+	for {
+		conn, err := p.ln.Accept()
+		if err != nil {
+			return
+		}
+		if !p.track(conn) {
+			_ = conn.Close()
+			continue
+		}
+		go p.handle(conn)
+	}
+}
+
+// track records conn to be closed by Close. It reports false when the proxy is already closed.
+func (p *Proxy) track(conn net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return false
+	}
+	p.conns = append(p.conns, conn)
+	return true
+}
+
+func (p *Proxy) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	first, err := r.Peek(1)
+	if err != nil {
+		return
+	}
+	var addr string
+	if first[0] == 5 {
+		addr, err = socks5Accept(r, conn)
+	} else {
+		addr, err = httpAccept(r)
+	}
+	if err != nil {
+		return
+	}
+	p.mu.Lock()
+	p.targets = append(p.targets, addr)
+	p.mu.Unlock()
+
+	target, err := net.Dial("tcp", addr)
+	if err != nil {
+		if first[0] == 5 {
+			_, _ = conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		} else {
+			_, _ = io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+		}
+		return
+	}
+	if !p.track(target) {
+		_ = target.Close()
+		return
+	}
+	defer target.Close()
+	if first[0] == 5 {
+		_, err = conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	} else {
+		_, err = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	}
+	if err != nil {
+		return
+	}
+	go func() {
+		_, _ = io.Copy(target, r)
+		_ = target.Close()
+	}()
+	_, _ = io.Copy(conn, target)
+}
+
+// socks5Accept reads the greeting and CONNECT request of a SOCKS5 client (RFC 1928), and returns the address to connect to.
+// User name and password authentication (RFC 1929) is accepted with any credentials.
+func socks5Accept(r *bufio.Reader, w io.Writer) (string, error) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return "", err
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return "", err
+	}
+	const noAuth, userPass = 0x00, 0x02
+	method := byte(0xFF)
+	for _, m := range methods {
+		if m == noAuth && method == 0xFF || m == userPass {
+			method = m
+		}
+	}
+	if _, err := w.Write([]byte{5, method}); err != nil || method == 0xFF {
+		return "", errors.New("socks5: no acceptable authentication method")
+	}
+	if method == userPass {
+		// VER ULEN UNAME PLEN PASSWD
+		if _, err := r.ReadByte(); err != nil {
+			return "", err
+		}
+		for i := 0; i < 2; i++ {
+			n, err := r.ReadByte()
+			if err != nil {
+				return "", err
+			}
+			if _, err := io.ReadFull(r, make([]byte, n)); err != nil {
+				return "", err
+			}
+		}
+		if _, err := w.Write([]byte{1, 0}); err != nil {
+			return "", err
+		}
+	}
+
+	// VER CMD RSV ATYP DST.ADDR DST.PORT
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(r, req); err != nil {
+		return "", err
+	}
+	if req[1] != 1 {
+		return "", errors.New("socks5: only CONNECT is supported")
+	}
+	var host string
+	switch req[3] {
+	case 1, 4:
+		ip := make(net.IP, net.IPv4len)
+		if req[3] == 4 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case 3:
+		n, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		name := make([]byte, n)
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", errors.New("socks5: unknown address type")
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// httpAccept reads an HTTP CONNECT request and returns the address to connect to.
+func httpAccept(r *bufio.Reader) (string, error) {
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return "", err
+	}
+	if req.Method != http.MethodConnect {
+		return "", errors.New("http: only CONNECT is supported")
+	}
+	return req.Host, nil
+}
@@ -0,0 +1,136 @@
+package irctest
+
+import (
+	"bufio"
+	"encoding"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/Travis-Britz/irc"
+)
+
+// VolatileTags lists the message tags whose values are replaced with "*" by Normalize,
+// because they differ between otherwise identical runs.
+var VolatileTags = []string{"time", "label", "msgid"}
+
+// Replay passes each line of transcript to h as a message received from the server,
+// and returns the lines h wrote in reply, in order, normalized with Normalize.
+//
+// A transcript contains one raw IRC line per line, exactly as the server would send it.
+// Empty lines and lines starting with "# " are ignored, so transcripts may contain comments.
+//
+// Messages are passed to h as parsed, without the processing that a Client does before calling its handler,
+// such as decoding CTCP messages or answering PINGs.
+func Replay(h irc.Handler, transcript io.Reader) ([]string, error) {
+	rec := &recorder{}
+	scanner := bufio.NewScanner(transcript)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" || strings.HasPrefix(line, "# ") {
+			continue
+		}
+		m := new(irc.Message)
+		if err := m.UnmarshalText([]byte(line)); err != nil {
+			return rec.lines, fmt.Errorf("transcript line %d: %w", n, err)
+		}
+		h.SpeakIRC(rec, m)
+		if rec.err != nil {
+			return rec.lines, rec.err
+		}
+	}
+	return rec.lines, scanner.Err()
+}
+
+// recorder is a MessageWriter which keeps the normalized lines of the messages written to it.
+type recorder struct {
+	lines []string
+	err   error
+}
+
+func (rec *recorder) WriteMessage(m encoding.TextMarshaler) {
+	b, err := m.MarshalText()
+	if len(b) == 0 && err != nil {
+		// messages which are too long are still returned with a warning, so only a missing line is an error
+		if rec.err == nil {
+			rec.err = fmt.Errorf("marshal text: %w", err)
+		}
+		return
+	}
+	rec.lines = append(rec.lines, Normalize(string(b)))
+}
+
+// Normalize removes the line ending of line, sorts its message tags,
+// and replaces the values of VolatileTags with "*",
+// so that lines can be compared with golden files.
+func Normalize(line string) string {
+	line = strings.TrimRight(line, "\r\n")
+	if !strings.HasPrefix(line, "@") {
+		return line
+	}
+	tags, rest, _ := strings.Cut(line[1:], " ")
+	var sorted []string
+	for _, tag := range strings.Split(tags, ";") {
+		if tag == "" {
+			continue
+		}
+		key, _, _ := strings.Cut(tag, "=")
+		for _, v := range VolatileTags {
+			if key == v {
+				tag = key + "=*"
+			}
+		}
+		sorted = append(sorted, tag)
+	}
+	sort.Strings(sorted)
+	return "@" + strings.Join(sorted, ";") + " " + rest
+}
+
+// Golden replays the transcript file at transcriptPath with h,
+// and compares the lines written by h with the golden file at goldenPath,
+// which lists the expected lines one per line.
+//
+// When update is true, the golden file is written with the current output instead,
+// which is typically controlled by a test flag:
+//
+//	var update = flag.Bool("update", false, "update golden files")
+//
+//	func TestBot(t *testing.T) {
+//		irctest.Golden(t, newBot(), "testdata/greet.txt", "testdata/greet.golden", *update)
+//	}
+func Golden(t testing.TB, h irc.Handler, transcriptPath, goldenPath string, update bool) {
+	t.Helper()
+	f, err := os.Open(transcriptPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	lines, err := Replay(h, f)
+	if err != nil {
+		t.Fatalf("replaying %s: %v", transcriptPath, err)
+	}
+	got := strings.Join(lines, "\n")
+	if len(lines) > 0 {
+		got += "\n"
+	}
+
+	if update {
+		if err := os.WriteFile(goldenPath, []byte(got), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	b, err := os.ReadFile(goldenPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.ReplaceAll(string(b), "\r\n", "\n")
+	if got != want {
+		t.Errorf("output of %s does not match %s\ngot:\n%s\nwant:\n%s", transcriptPath, goldenPath, got, want)
+	}
+}
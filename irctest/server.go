@@ -2,35 +2,66 @@ package irctest
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding"
+	"fmt"
 	"io"
-	"log"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/Travis-Britz/irc"
 )
 
 // NewServer creates a new mock irc server that implements io.ReadWriteCloser.
 // Don't forget to close.
+//
+// The server starts handling the lines written by the client when the client first reads or writes,
+// so Handler may be set any time before the server is used as the client's connection.
 func NewServer() *Server {
-	s := &Server{}
+	s := &Server{created: time.Now()}
 	s.sendReader, s.sendWriter = io.Pipe()
 	s.recvReader, s.recvWriter = io.Pipe()
 
 	s.recv = make(chan []byte, 1)
-
-	// should exit when Close() is called
-	go s.read()
-	go s.write()
+	s.out = make(chan outgoing)
+	s.done = make(chan struct{})
+	go s.send()
 	return s
 }
 
 type Server struct {
 	Handler irc.Handler
 
-	rs   sync.Once
-	recv chan []byte
+	// RecordTranscript makes the server keep a Transcript of every line sent in either direction.
+	// It must be set before the server is used.
+	RecordTranscript bool
+
+	// created is the time the timestamps of the transcript are relative to.
+	created time.Time
+
+	// trMu guards transcript and partial, the start of a line from the client which hasn't ended yet.
+	trMu       sync.Mutex
+	transcript Transcript
+	partial    []byte
+
+	start sync.Once
+	rs    sync.Once
+	recv  chan []byte
+
+	// mu guards closed, so that Write never sends on recv after it was closed.
+	mu     sync.RWMutex
+	closed bool
+
+	// out passes the lines written by the server to the goroutine which sends them to the client,
+	// until done is closed by Close.
+	out  chan outgoing
+	done chan struct{}
+
+	// errMu guards err, the first error which wasn't returned to a caller.
+	errMu sync.Mutex
+	err   error
 
 	recvReader *io.PipeReader
 	recvWriter *io.PipeWriter
@@ -39,68 +70,253 @@ type Server struct {
 	sendWriter *io.PipeWriter
 }
 
+// run starts the goroutines which pass the lines written by the client to Handler.
+// They exit when Close is called.
+func (s *Server) run() {
+	s.start.Do(func() {
+		h := s.Handler
+		if h == nil {
+			h = irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {})
+		}
+		go s.read(h)
+		go s.write()
+	})
+}
+
 // Read is how the client reads lines from the server
 func (s *Server) Read(p []byte) (int, error) {
+	s.run()
 	return s.sendReader.Read(p)
 }
 
 // Write is how a client sends messages to the server
 func (s *Server) Write(p []byte) (int, error) {
-	s.recv <- p
+	s.run()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if s.RecordTranscript {
+		s.recordClient(p)
+	}
+	// io.Writer implementations must not retain p
+	s.recv <- append([]byte(nil), p...)
 	return len(p), nil
 }
 
+// Close closes both directions of the connection. Writes blocked on either direction return an error.
+// Close may be called more than once, and from any goroutine.
 func (s *Server) Close() error {
-	_ = s.recvWriter.Close()
-	_ = s.sendWriter.Close()
 	s.rs.Do(func() {
+		// the pipes are closed first, which unblocks the writes in progress,
+		// so that the lock below isn't held up by a Write waiting on recv.
+		_ = s.recvWriter.Close()
+		_ = s.sendWriter.Close()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.closed = true
 		close(s.recv)
+		close(s.done)
 	})
 	return nil
 }
 
+// Err returns the first error of a write by WriteString or WriteMessage, or of a line from the client which couldn't be parsed.
+func (s *Server) Err() error {
+	s.errMu.Lock()
+	defer s.errMu.Unlock()
+	return s.err
+}
+
+func (s *Server) fail(err error) {
+	s.errMu.Lock()
+	defer s.errMu.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+}
+
 // WriteString sends messages to the client.
+// It blocks until the client reads the line. Like WriteMessage, errors are kept for Err.
 func (s *Server) WriteString(str string) {
+	if err := s.WriteStringContext(context.Background(), str); err != nil {
+		s.fail(err)
+	}
+}
+
+// WriteStringContext is like WriteString, but returns its error,
+// and returns ctx.Err() if ctx is done before the client reads the line, e.g. when a test's deadline passes.
+// A line which the server started sending is still sent if the client reads it later.
+func (s *Server) WriteStringContext(ctx context.Context, str string) error {
 	if !strings.HasSuffix(str, "\r\n") {
 		str = str + "\r\n"
 	}
-	if _, err := s.sendWriter.Write([]byte(str)); err != nil {
-		log.Println("mock server write error:", err)
-	}
+	return s.writeLine(ctx, []byte(str))
 }
 
-// WriteMessage sends messages from the server to the client
+// WriteMessage sends messages from the server to the client.
+// It implements irc.MessageWriter, so errors are kept for Err instead of returned.
 func (s *Server) WriteMessage(m encoding.TextMarshaler) {
-	if b, err := m.MarshalText(); err != nil {
-		if _, err := s.sendWriter.Write(b); err != nil {
-			log.Println("mock server write error:", err)
+	if err := s.WriteMessageContext(context.Background(), m); err != nil {
+		s.fail(err)
+	}
+}
+
+// WriteMessageContext is like WriteMessage, but returns its error,
+// and returns ctx.Err() if ctx is done before the client reads the message.
+func (s *Server) WriteMessageContext(ctx context.Context, m encoding.TextMarshaler) error {
+	b, err := m.MarshalText()
+	if err != nil {
+		return fmt.Errorf("irctest: marshal: %w", err)
+	}
+	if !strings.HasSuffix(string(b), "\r\n") {
+		b = append(b, "\r\n"...)
+	}
+	return s.writeLine(ctx, b)
+}
+
+// outgoing is a line for the client, and where the result of writing it is reported.
+type outgoing struct {
+	b   []byte
+	err chan error
+}
+
+// writeLine passes b to the send goroutine, and waits until the client read it or ctx is done.
+func (s *Server) writeLine(ctx context.Context, b []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	o := outgoing{b: b, err: make(chan error, 1)}
+	select {
+	case s.out <- o:
+	case <-s.done:
+		return fmt.Errorf("irctest: write: %w", io.ErrClosedPipe)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if s.RecordTranscript {
+		s.record(b)
+	}
+	select {
+	case err := <-o.err:
+		if err != nil {
+			return fmt.Errorf("irctest: write: %w", err)
 		}
-	} else {
-		log.Println("marshaler:", err)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
-func (s *Server) read() {
-	if s.Handler == nil {
-		s.Handler = irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {})
+// send writes the lines of the server to the client, one at a time, until Close.
+// Writes block until the client reads them, so a single goroutine does them for every caller,
+// and a caller whose context is done doesn't leave a goroutine behind.
+func (s *Server) send() {
+	for {
+		select {
+		case o := <-s.out:
+			_, err := s.sendWriter.Write(o.b)
+			o.err <- err
+		case <-s.done:
+			return
+		}
 	}
+}
+
+func (s *Server) read(h irc.Handler) {
 	scanner := bufio.NewScanner(s.recvReader)
 	for scanner.Scan() {
 		line := scanner.Bytes()
 		m := new(irc.Message)
-		m.IncludePrefix()
 		if err := m.UnmarshalText(line); err != nil {
-			log.Println("unmarshaling error:", err)
+			s.fail(fmt.Errorf("irctest: parse %q: %w", line, err))
 			continue
 		}
-		s.Handler.SpeakIRC(s, m)
+		h.SpeakIRC(s, m)
 	}
 }
 
 func (s *Server) write() {
 	for b := range s.recv {
-		if _, err := s.recvWriter.Write(b); err != nil {
-			log.Println("server mock write error:", err)
+		// after Close, the remaining lines are drained and dropped
+		_, _ = s.recvWriter.Write(b)
+	}
+}
+
+// A TranscriptLine is a line sent between the client and a Server.
+type TranscriptLine struct {
+
+	// At is when the line was sent, relative to the creation of the server.
+	At time.Duration
+
+	// FromClient is true for lines sent by the client, and false for lines sent by the server.
+	FromClient bool
+
+	// Line is the line without CR-LF.
+	Line string
+}
+
+// A Transcript is every line sent between the client and a Server, in the order they were sent.
+type Transcript []TranscriptLine
+
+// String formats the transcript with one line per line sent, e.g.:
+//
+//	+0.000s client: CAP LS :302
+//	+0.001s server: :irc.example.com CAP * LS :sasl
+func (t Transcript) String() string {
+	var b strings.Builder
+	for _, l := range t {
+		from := "server"
+		if l.FromClient {
+			from = "client"
+		}
+		fmt.Fprintf(&b, "+%.3fs %s: %s\n", l.At.Seconds(), from, l.Line)
+	}
+	return b.String()
+}
+
+// Transcript returns the lines sent so far in either direction, when RecordTranscript is set.
+// Failing tests can log it to show exactly what the client and server said:
+//
+//	t.Errorf("expected the client to join #chan; transcript:\n%s", server.Transcript())
+func (s *Server) Transcript() Transcript {
+	s.trMu.Lock()
+	defer s.trMu.Unlock()
+	return append(Transcript(nil), s.transcript...)
+}
+
+// recordClient records the lines completed by p, a write from the client.
+func (s *Server) recordClient(p []byte) {
+	s.trMu.Lock()
+	defer s.trMu.Unlock()
+	s.partial = append(s.partial, p...)
+	for {
+		i := bytes.IndexByte(s.partial, '\n')
+		if i < 0 {
+			break
 		}
+		s.appendLine(true, string(s.partial[:i+1]))
+		s.partial = s.partial[i+1:]
 	}
 }
+
+// record records the lines of b, a write from the server.
+func (s *Server) record(b []byte) {
+	s.trMu.Lock()
+	defer s.trMu.Unlock()
+	for _, line := range strings.SplitAfter(string(b), "\n") {
+		if line != "" {
+			s.appendLine(false, line)
+		}
+	}
+}
+
+// appendLine adds line to the transcript. s.trMu must be held.
+func (s *Server) appendLine(fromClient bool, line string) {
+	s.transcript = append(s.transcript, TranscriptLine{
+		At:         time.Since(s.created),
+		FromClient: fromClient,
+		Line:       strings.TrimRight(line, "\r\n"),
+	})
+}
@@ -0,0 +1,73 @@
+package irctest_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/Travis-Britz/irc"
+	"github.com/Travis-Britz/irc/irctest"
+)
+
+func TestServer_WriteMessage(t *testing.T) {
+	s := irctest.NewServer()
+	defer s.Close()
+
+	go s.WriteMessage(irc.Msg("bot", "hello"))
+	line, err := bufio.NewReader(s).ReadString('\n')
+	if err != nil || line != "PRIVMSG bot :hello\r\n" {
+		t.Errorf("expected the client to read the message; got %q, %v", line, err)
+	}
+	if err := s.Err(); err != nil {
+		t.Errorf("expected no error after a successful write; got %v", err)
+	}
+
+	_ = s.Close()
+	s.WriteMessage(irc.Msg("bot", "too late"))
+	if err := s.Err(); !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("expected the write after Close to be kept for Err; got %v", err)
+	}
+}
+
+func TestServer_Close(t *testing.T) {
+	s := irctest.NewServer()
+	for i := 0; i < 2; i++ {
+		if err := s.Close(); err != nil {
+			t.Errorf("expected Close to succeed every time; got %v", err)
+		}
+	}
+	if _, err := s.Write([]byte("NICK bot\r\n")); err == nil {
+		t.Errorf("expected the client's writes to fail after Close")
+	}
+	if _, err := s.Read(make([]byte, 512)); err != io.EOF {
+		t.Errorf("expected the client to read EOF after Close; got %v", err)
+	}
+}
+
+func TestServer_WriteStringContext(t *testing.T) {
+	s := irctest.NewServer()
+	defer s.Close()
+
+	// nothing reads, so the first line waits for the client, and the others can't be sent at all
+	before := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+		err := s.WriteStringContext(ctx, "PING :unread")
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected the write to stop at the deadline; got %v", err)
+		}
+	}
+	if after := runtime.NumGoroutine(); after > before+2 {
+		t.Errorf("expected writes which timed out not to leave goroutines behind; %d before, %d after", before, after)
+	}
+
+	line, err := bufio.NewReader(s).ReadString('\n')
+	if err != nil || line != "PING :unread\r\n" {
+		t.Errorf("expected the line the server started sending to reach the client; got %q, %v", line, err)
+	}
+}
@@ -0,0 +1,135 @@
+package irctest
+
+import (
+	"bytes"
+	"encoding"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/Travis-Britz/irc"
+)
+
+// Discard is an irc.MessageWriter on which all writes succeed without doing anything.
+var Discard irc.MessageWriter = discard{}
+
+type discard struct{}
+
+func (discard) WriteMessage(encoding.TextMarshaler) {}
+
+// A RecordingWriter is an irc.MessageWriter which keeps the messages written to it,
+// for testing handlers without a connection:
+//
+//	w := &irctest.RecordingWriter{}
+//	router.SpeakIRC(w, irc.Msg("#chan", "!ping"))
+//	if m := w.Last(); m == nil || m.Params.Get(2) != "pong" {
+//		t.Errorf("expected a pong; got %v", w.Lines())
+//	}
+//
+// Each message is marshaled and parsed again, so it's recorded the way a server would read it.
+// The zero value is ready to use. A RecordingWriter is safe for concurrent use.
+type RecordingWriter struct {
+	mu       sync.Mutex
+	messages []*irc.Message
+	lines    []string
+	err      error
+}
+
+// WriteMessage records m. Messages which can't be marshaled or parsed again are not recorded; see Err.
+func (w *RecordingWriter) WriteMessage(m encoding.TextMarshaler) {
+	b, err := m.MarshalText()
+	// length warnings still produce the whole line
+	if len(b) == 0 && err != nil {
+		w.fail(fmt.Errorf("marshal %#v: %w", m, err))
+		return
+	}
+	b = bytes.TrimRight(b, "\r\n")
+	msg := new(irc.Message)
+	if err := msg.UnmarshalText(b); err != nil {
+		w.fail(fmt.Errorf("parse %q: %w", b, err))
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.messages = append(w.messages, msg)
+	w.lines = append(w.lines, string(b))
+}
+
+func (w *RecordingWriter) fail(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+// Err returns the first error of a message which couldn't be recorded, if any.
+func (w *RecordingWriter) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// Messages returns the messages written so far, in order.
+func (w *RecordingWriter) Messages() []*irc.Message {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]*irc.Message(nil), w.messages...)
+}
+
+// Lines returns the messages written so far as the lines sent to a server, without CR-LF, in order.
+func (w *RecordingWriter) Lines() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]string(nil), w.lines...)
+}
+
+// Len returns the number of messages written so far.
+func (w *RecordingWriter) Len() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.messages)
+}
+
+// Last returns the last message written, or nil if nothing was written.
+func (w *RecordingWriter) Last() *irc.Message {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.messages) == 0 {
+		return nil
+	}
+	return w.messages[len(w.messages)-1]
+}
+
+// All returns the messages written with command cmd, in order.
+func (w *RecordingWriter) All(cmd irc.Command) []*irc.Message {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var found []*irc.Message
+	for _, m := range w.messages {
+		if strings.EqualFold(string(m.Command), string(cmd)) {
+			found = append(found, m)
+		}
+	}
+	return found
+}
+
+// MatchingText returns the messages whose text (see irc.Message.Text) contains substr, in order.
+func (w *RecordingWriter) MatchingText(substr string) []*irc.Message {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var found []*irc.Message
+	for _, m := range w.messages {
+		if text, err := m.Text(); err == nil && strings.Contains(text, substr) {
+			found = append(found, m)
+		}
+	}
+	return found
+}
+
+// Reset forgets the messages written so far, and any error.
+func (w *RecordingWriter) Reset() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.messages, w.lines, w.err = nil, nil, nil
+}
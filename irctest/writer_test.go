@@ -0,0 +1,47 @@
+package irctest_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Travis-Britz/irc"
+	"github.com/Travis-Britz/irc/irctest"
+)
+
+// badMessage is a message which can't be marshaled.
+type badMessage struct{}
+
+func (badMessage) MarshalText() ([]byte, error) {
+	return nil, errors.New("bad message")
+}
+
+func TestRecordingWriter(t *testing.T) {
+	w := &irctest.RecordingWriter{}
+	w.WriteMessage(irc.Msg("#chan", "hello there"))
+	w.WriteMessage(irc.Notice("alice", "hello"))
+	w.WriteMessage(&irc.Message{Command: "privmsg", Params: irc.Params{"bob", "bye"}})
+
+	if got := w.All(irc.CmdPrivmsg); len(got) != 2 || got[0].Params.Get(1) != "#chan" || got[1].Params.Get(1) != "bob" {
+		t.Errorf("expected both PRIVMSGs, regardless of case; got %v", got)
+	}
+	if got := w.MatchingText("hello"); len(got) != 2 || got[0].Command != irc.CmdPrivmsg || got[1].Command != irc.CmdNotice {
+		t.Errorf("expected the PRIVMSG and NOTICE with hello in their text; got %v", got)
+	}
+	if err := w.Err(); err != nil {
+		t.Errorf("expected no error; got %v", err)
+	}
+
+	w.WriteMessage(badMessage{})
+	w.WriteMessage(irc.Msg("#chan", "still recorded"))
+	if err := w.Err(); err == nil {
+		t.Errorf("expected the message which couldn't be marshaled to be reported by Err")
+	}
+	if w.Len() != 4 {
+		t.Errorf("expected the messages around the bad one to be recorded; got %q", w.Lines())
+	}
+
+	w.Reset()
+	if w.Len() != 0 || w.Last() != nil || len(w.Lines()) != 0 || w.Err() != nil {
+		t.Errorf("expected Reset to forget the messages and the error; got %q, %v", w.Lines(), w.Err())
+	}
+}
@@ -0,0 +1,105 @@
+package irc
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// isupport holds the tokens advertised by the server in RPL_ISUPPORT (005).
+// https://modern.ircdocs.horse/#rplisupport-005
+type isupport struct {
+	mu     sync.RWMutex
+	tokens map[string]string
+}
+
+// reset forgets every token, for a new connection.
+func (is *isupport) reset() {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	is.tokens = nil
+}
+
+// parse reads the tokens from an RPL_ISUPPORT message.
+//
+// "<client> <1-13 tokens> :are supported by this server"
+func (is *isupport) parse(m *Message) {
+	if len(m.Params) < 3 {
+		return
+	}
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	if is.tokens == nil {
+		is.tokens = make(map[string]string)
+	}
+	for _, token := range m.Params[1 : len(m.Params)-1] {
+		// a leading '-' means a previously advertised token is no longer supported
+		if strings.HasPrefix(token, "-") {
+			delete(is.tokens, strings.ToUpper(token[1:]))
+			continue
+		}
+		name, value, _ := strings.Cut(token, "=")
+		is.tokens[strings.ToUpper(name)] = unescapeISupport(value)
+	}
+}
+
+// get returns the value of token name and whether the server advertised it.
+func (is *isupport) get(name string) (string, bool) {
+	is.mu.RLock()
+	defer is.mu.RUnlock()
+	v, ok := is.tokens[strings.ToUpper(name)]
+	return v, ok
+}
+
+// snapshot returns a copy of the tokens.
+func (is *isupport) snapshot() map[string]string {
+	is.mu.RLock()
+	defer is.mu.RUnlock()
+	tokens := make(map[string]string, len(is.tokens))
+	for name, value := range is.tokens {
+		tokens[name] = value
+	}
+	return tokens
+}
+
+// has reports whether the server advertised token name.
+func (is *isupport) has(name string) bool {
+	_, ok := is.get(name)
+	return ok
+}
+
+// unescapeISupport replaces the "\xHH" escape sequences allowed in token values.
+func unescapeISupport(v string) string {
+	if !strings.Contains(v, `\x`) {
+		return v
+	}
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		if v[i] == '\\' && i+3 < len(v) && v[i+1] == 'x' {
+			if n, err := strconv.ParseUint(v[i+2:i+4], 16, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(v[i])
+	}
+	return b.String()
+}
+
+// ISupport returns the value of an RPL_ISUPPORT (005) token advertised by the server,
+// and whether the token was advertised at all.
+// Many tokens have no value, in which case ok is the only interesting result.
+//
+//	network, _ := client.ISupport("NETWORK")
+//	_, utf8only := client.ISupport("UTF8ONLY")
+func (c *Client) ISupport(name string) (value string, ok bool) {
+	return c.state.isupport.get(name)
+}
+
+// fold returns the nickname or channel name s in lowercase, according to the CASEMAPPING of the server,
+// for use as a key which matches every spelling of s.
+func (c *Client) fold(s string) string {
+	casemapping, _ := c.ISupport("CASEMAPPING")
+	return foldNick(s, casemapping)
+}
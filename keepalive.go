@@ -0,0 +1,207 @@
+package irc
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Defaults used by a Keepalive when its fields are left empty.
+const (
+	DefaultKeepaliveInterval = 2 * time.Minute
+	DefaultKeepaliveTimeout  = 10 * time.Second
+)
+
+// ErrPingTimeout is returned by Keepalive when the server didn't answer a PING in time.
+var ErrPingTimeout = errors.New("ping timeout")
+
+// A Keepalive detects dead connections, which can otherwise go unnoticed for a long time.
+// It sends a PING whenever nothing was received from the server for Interval,
+// and gives up on the connection when the server doesn't answer with a PONG within Timeout.
+//
+// Clients use a Keepalive with the default settings unless Client.Keepalive is set.
+// It can also keep any other connection alive: pass every message read from the connection to Received,
+// and run Run for as long as the connection is open:
+//
+//	k := &irc.Keepalive{}
+//	go func() {
+//		if err := k.Run(ctx, w); errors.Is(err, irc.ErrPingTimeout) {
+//			conn.Close()
+//		}
+//	}()
+//	for scanner.Scan() {
+//		...
+//		if k.Received(m) {
+//			continue // the answer to our own PING
+//		}
+//	}
+//
+// A Keepalive must not be used by more than one connection at a time.
+type Keepalive struct {
+
+	// Interval is how long the connection may be quiet before a PING is sent.
+	// If 0, DefaultKeepaliveInterval is used.
+	Interval time.Duration
+
+	// Timeout is how long the server has to answer a PING.
+	// If 0, DefaultKeepaliveTimeout is used.
+	Timeout time.Duration
+
+	// LagInterval makes the Keepalive send a PING at least once every LagInterval, even when the connection is busy,
+	// so that Lag stays up to date (optional). If 0, the connection is only pinged when it's quiet.
+	LagInterval time.Duration
+
+	// OnLag is called with the lag measured by each PING which was answered (optional).
+	// It's called from the goroutine which passed the PONG to Received, so it should be quick.
+	OnLag func(lag time.Duration)
+
+	// Token returns the parameter of each PING, which the server echoes in its PONG (optional).
+	// If nil, the parameter is "TIMEOUTCHECK".
+	Token func() string
+
+	// Now and After are the clock of the Keepalive, e.g. a fake clock for tests (optional).
+	// If nil, time.Now and time.After are used.
+	Now   func() time.Time
+	After func(d time.Duration) <-chan time.Time
+
+	mu       sync.Mutex
+	last     time.Time     // when the last message was received
+	token    string        // the parameter of the PING waiting for an answer
+	sent     time.Time     // when it was sent
+	answered chan struct{} // closed by its PONG; nil if no PING is waiting
+	lag      time.Duration
+}
+
+func (k *Keepalive) now() time.Time {
+	if k.Now != nil {
+		return k.Now()
+	}
+	return time.Now()
+}
+
+func (k *Keepalive) after(d time.Duration) <-chan time.Time {
+	if k.After != nil {
+		return k.After(d)
+	}
+	return time.After(d)
+}
+
+// Run sends a PING whenever the connection was quiet for Interval, and every LagInterval, until ctx is done.
+// It returns ErrPingTimeout if the server didn't answer one, or ctx.Err().
+func (k *Keepalive) Run(ctx context.Context, w MessageWriter) error {
+	interval := k.Interval
+	if interval <= 0 {
+		interval = DefaultKeepaliveInterval
+	}
+	k.mu.Lock()
+	k.last, k.sent, k.lag = k.now(), k.now(), 0
+	// a PING left waiting by the last connection will never be answered on this one
+	k.answered, k.token = nil, ""
+	k.mu.Unlock()
+	for {
+		k.mu.Lock()
+		now := k.now()
+		wait := interval - now.Sub(k.last)
+		if k.LagInterval > 0 {
+			if lagWait := k.LagInterval - now.Sub(k.sent); lagWait < wait {
+				wait = lagWait
+			}
+		}
+		k.mu.Unlock()
+		if wait > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-k.after(wait):
+			}
+			continue
+		}
+		if err := k.Ping(ctx, w); err != nil {
+			return err
+		}
+	}
+}
+
+// Ping sends a PING to w, and waits for the server's PONG.
+// It returns ErrPingTimeout if the PONG didn't arrive within Timeout, or ctx.Err() if ctx is done first.
+// If a PING is already waiting for its PONG, Ping waits for that one instead of sending another.
+func (k *Keepalive) Ping(ctx context.Context, w MessageWriter) error {
+	timeout := k.Timeout
+	if timeout <= 0 {
+		timeout = DefaultKeepaliveTimeout
+	}
+	k.mu.Lock()
+	answered := k.answered
+	if answered == nil {
+		answered = make(chan struct{})
+		k.answered, k.sent, k.token = answered, k.now(), "TIMEOUTCHECK"
+		if k.Token != nil {
+			k.token = k.Token()
+		}
+		token := k.token
+		k.mu.Unlock()
+		w.WriteMessage(Ping(token))
+	} else {
+		k.mu.Unlock()
+	}
+
+	select {
+	case <-answered:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-k.after(timeout):
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		if k.answered == answered {
+			k.answered = nil
+		}
+		return ErrPingTimeout
+	}
+}
+
+// Received records that m was received from the server, and reports whether m is the PONG of a PING sent by k.
+// Such PONGs are of no interest to anyone else.
+func (k *Keepalive) Received(m *Message) bool {
+	k.mu.Lock()
+	now := k.now()
+	k.last = now
+	// "PONG <server> :<token>", though some servers leave out the server
+	if k.answered == nil || !m.Command.is(CmdPong) || m.Params.Get(len(m.Params)) != k.token {
+		k.mu.Unlock()
+		return false
+	}
+	lag := now.Sub(k.sent)
+	k.lag = lag
+	close(k.answered)
+	k.answered = nil
+	k.mu.Unlock()
+
+	if k.OnLag != nil {
+		k.OnLag(lag)
+	}
+	return true
+}
+
+// Lag returns how long the server took to answer the last PING which was answered, or 0 if none was since Run started.
+func (k *Keepalive) Lag() time.Duration {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.lag
+}
+
+// Lag returns how long the server took to answer the client's last PING which was answered,
+// or 0 if none was answered on the current or last connection.
+//
+// The client only pings the server when the connection is quiet, unless Client.Keepalive has a LagInterval,
+// so without one the lag may be old on a busy connection.
+func (c *Client) Lag() time.Duration {
+	c.connMu.Lock()
+	k := c.keepalive
+	c.connMu.Unlock()
+	if k == nil {
+		return 0
+	}
+	return k.Lag()
+}
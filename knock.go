@@ -0,0 +1,83 @@
+package irc
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors passed to OnKnockReply handlers when the server refused to deliver a KNOCK.
+var (
+	ErrTooManyKnocks = errors.New("too many knocks")
+	ErrChanOpen      = errors.New("channel is open")
+	ErrKnockOnChan   = errors.New("already on channel")
+)
+
+// KnockEvent is a user asking the operators of a channel for an invite.
+// Servers only send it to channel operators, as RPL_KNOCK.
+type KnockEvent struct {
+	Message *Message
+
+	// Sender is the user who knocked.
+	Sender  Prefix
+	Channel string
+
+	// Text is the text sent by the server, e.g. "has asked for an invite.",
+	// which includes the reason given by the user on servers which relay it.
+	Text string
+}
+
+// Command implements Event.
+func (e *KnockEvent) Command() Command { return RplKnock }
+
+// Decode implements Event. m must be an RPL_KNOCK.
+func (e *KnockEvent) Decode(m *Message) error {
+	if err := expect(m, RplKnock, 3); err != nil {
+		return err
+	}
+	*e = KnockEvent{Message: m, Channel: m.Params.Get(2), Text: m.Params.Get(4)}
+	// some servers only send the nickname
+	if parts := fullAddress.FindStringSubmatch(m.Params.Get(3)); parts != nil {
+		e.Sender = Prefix{Nick: Nickname(parts[1]), User: parts[2], Host: parts[3]}
+	} else {
+		e.Sender.Nick = Nickname(m.Params.Get(3))
+	}
+	return nil
+}
+
+// OnKnock attaches a handler for users knocking on a channel where the client is an operator.
+//
+//	r.OnKnock(func(w irc.MessageWriter, e *irc.KnockEvent) {
+//		if trusted(e.Sender) {
+//			w.WriteMessage(irc.Invite(e.Sender.Nick.String(), e.Channel))
+//		}
+//	})
+func (r *Router) OnKnock(h func(MessageWriter, *KnockEvent)) *route {
+	return On(r, h)
+}
+
+// knockReplies maps the numerics sent in reply to KNOCK to the error they represent.
+var knockReplies = map[Command]error{
+	RplKnockDlvr:       nil,
+	RplErrTooManyKnock: ErrTooManyKnocks,
+	RplErrChanOpen:     ErrChanOpen,
+	RplErrKnockOnChan:  ErrKnockOnChan,
+}
+
+// OnKnockReply attaches a handler for the server's answer to a KNOCK sent by the client.
+// err is nil when the knock was delivered to the channel's operators,
+// and otherwise wraps ErrTooManyKnocks, ErrChanOpen, or ErrKnockOnChan.
+//
+// A delivered knock isn't an invite; the operators may still ignore it.
+// Use OnInvite to handle the invite.
+func (r *Router) OnKnockReply(h func(w MessageWriter, channel string, err error)) *route {
+	adapter := func(w MessageWriter, m *Message) {
+		err := knockReplies[m.Command]
+		if err != nil {
+			err = fmt.Errorf("knock %s: %w: %s", m.Params.Get(2), err, m.Params.Get(3))
+		}
+		h(w, m.Params.Get(2), err)
+	}
+	rt := r.handleCommands(HandlerFunc(adapter), RplKnockDlvr, RplErrTooManyKnock, RplErrChanOpen, RplErrKnockOnChan)
+	rt.handler = funcName(h)
+	return rt
+}
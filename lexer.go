@@ -23,6 +23,7 @@ const (
 type item struct {
 	typ itemType // Type, such as itemTarget
 	val string   // the value of the lexed token
+	pos int      // the byte offset of the token in the input
 }
 
 func (it itemType) String() string {
@@ -43,6 +44,8 @@ func (it itemType) String() string {
 		return "TagValue"
 	case itemParam:
 		return "Param"
+	case itemTrailing:
+		return "Trailing"
 	case itemError:
 		return "Error"
 	default:
@@ -71,10 +74,11 @@ const (
 	itemNickname
 	itemUser
 	itemHost
-	itemPrefix  // the prefix portion of a message, e.g. ":tmi.switch.tv"
-	itemCommand // the command or numeric, e.g. "PRIVMSG" or "001"
-	itemParam   // a command parameter, e.g. the target and text of a PRIVMSG
-	itemEOF     // end of message
+	itemPrefix   // the prefix portion of a message, e.g. ":tmi.switch.tv"
+	itemCommand  // the command or numeric, e.g. "PRIVMSG" or "001"
+	itemParam    // a command parameter, e.g. the target and text of a PRIVMSG
+	itemTrailing // the last parameter, when it was written with the trailing delimiter
+	itemEOF      // end of message
 )
 
 const eof = -1
@@ -84,25 +88,18 @@ type stateFn func(*lexer) stateFn
 
 // lexer holds the state of the scanner.
 type lexer struct {
-	name  string    // used only for error reports.
-	input string    // the string being scanned.
-	start int       // start position of this item.
-	pos   int       // current position in the input.
-	width int       // width of the last rune read
-	items chan item // channel of scanned item
-}
-
-// run lexes the input by executing state functions until
-// the state is nil.
-func (l *lexer) run() {
-	for state := lexStart; state != nil; {
-		state = state(l)
-	}
-	close(l.items)
+	name  string      // used only for error reports.
+	input string      // the string being scanned.
+	start int         // start position of this item.
+	pos   int         // current position in the input.
+	width int         // width of the last rune read
+	state stateFn     // the next state, or nil after the last item
+	items []item      // scanned items which haven't been returned by nextItem yet
+	err   *ParseError // set before itemError is emitted
 }
 
 func (l *lexer) emit(t itemType) {
-	l.items <- item{t, l.input[l.start:l.pos]}
+	l.items = append(l.items, item{t, l.input[l.start:l.pos], l.start})
 	l.start = l.pos
 }
 
@@ -141,8 +138,16 @@ func (l *lexer) backup() {
 
 // errorf returns an error token and terminates the scan by passing
 // back a nil pointer that will be the next state, terminating l.nextItem.
-func (l *lexer) errorf(format string, args ...interface{}) stateFn {
-	l.items <- item{itemError, fmt.Sprintf(format, args...)}
+// state names the part of the message being read, for the ParseError.
+func (l *lexer) errorf(state string, format string, args ...interface{}) stateFn {
+	l.err = &ParseError{
+		Line:    l.input,
+		Offset:  l.pos,
+		Segment: l.input[l.start:l.pos],
+		State:   state,
+		Reason:  fmt.Sprintf(format, args...),
+	}
+	l.items = append(l.items, item{itemError, l.err.Error(), l.pos})
 	return nil
 }
 
@@ -153,20 +158,26 @@ func (l *lexer) acceptRun(valid string) {
 	l.backup()
 }
 func lex(input string) *lexer {
-	l := &lexer{
+	return &lexer{
 		input: input,
-		items: make(chan item),
+		state: lexStart,
+		items: make([]item, 0, 2),
 	}
-
-	// todo: figure out what this todo was. it was empty last time I was here, which is ominous. what did I need to remember???
-	go l.run() // Concurrently run state machine
-	return l
 }
 
-// nextItem returns the next item from the input.
-// Called by the parser, not in the lexing goroutine.
+// nextItem returns the next item from the input,
+// running state functions until one of them emits an item.
+// Once the input is exhausted or an error was found, nextItem returns itemEOF.
 func (l *lexer) nextItem() item {
-	return <-l.items
+	for len(l.items) == 0 {
+		if l.state == nil {
+			return item{itemEOF, "", l.pos}
+		}
+		l.state = l.state(l)
+	}
+	i := l.items[0]
+	l.items = l.items[1:]
+	return i
 }
 
 func lexStart(l *lexer) stateFn {
@@ -201,9 +212,9 @@ func lexTagKey(l *lexer) stateFn {
 			l.emit(itemTagKey)
 			return lexTagValue
 		case r == eof:
-			return l.errorf("unexpected end of input while reading tag name")
+			return l.errorf("tag name", "unexpected end of input")
 		case invalidTagNameChar(r):
-			return l.errorf("invalid character %q found while reading tag name", r)
+			return l.errorf("tag name", "invalid character %q", r)
 		}
 	}
 }
@@ -242,11 +253,11 @@ func lexTagValue(l *lexer) stateFn {
 				return lexPrefixStart
 			}
 			if l.peek() == eof {
-				return l.errorf("unexpected end of input after message tags")
+				return l.errorf("command", "unexpected end of input after message tags")
 			}
 			return lexCommand
 		case r == eof:
-			return l.errorf("unexpected end of input while reading tag value")
+			return l.errorf("tag value", "unexpected end of input")
 		}
 	}
 }
@@ -264,7 +275,7 @@ func lexTagEnd(l *lexer) stateFn {
 			return lexPrefixStart
 		}
 		if l.peek() == eof {
-			return l.errorf("unexpected end of input after message tags")
+			return l.errorf("command", "unexpected end of input after message tags")
 		}
 		return lexCommand
 	}
@@ -287,7 +298,7 @@ func lexNickname(l *lexer) stateFn {
 			l.emit(itemNickname)
 			l.ignoreRun(" ")
 			if l.peek() == eof {
-				return l.errorf("unexpected end of input; expected command")
+				return l.errorf("command", "unexpected end of input after prefix")
 			}
 			return lexCommand
 		case r == '.':
@@ -298,7 +309,7 @@ func lexNickname(l *lexer) stateFn {
 			l.emit(itemNickname)
 			return lexUserStart
 		case r == eof:
-			return l.errorf("unexpected end of input")
+			return l.errorf("prefix", "unexpected end of input")
 		}
 	}
 }
@@ -319,9 +330,9 @@ func lexUser(l *lexer) stateFn {
 			l.emit(itemUser)
 			return lexHostStart
 		case r == delimParam:
-			return l.errorf("expected host, found end of prefix")
+			return l.errorf("prefix user", "expected host, found end of prefix")
 		case r == eof:
-			return l.errorf("unexpected end of input")
+			return l.errorf("prefix user", "unexpected end of input")
 		}
 	}
 }
@@ -343,7 +354,7 @@ func lexHost(l *lexer) stateFn {
 			l.ignoreRun(" ")
 			return lexCommand
 		case r == eof:
-			return l.errorf("expected command, found end of input")
+			return l.errorf("prefix host", "expected command, found end of input")
 		}
 	}
 }
@@ -354,14 +365,14 @@ func lexCommand(l *lexer) stateFn {
 		case r == delimParam:
 			l.backup()
 			if len(l.input[l.start:l.pos]) == 0 {
-				return l.errorf("unexpected end of command; command is empty")
+				return l.errorf("command", "command is empty")
 			}
 			l.emit(itemCommand)
 			l.ignoreRun(" ")
 			return lexParam
 		case r == eof:
 			if len(l.input[l.start:l.pos]) == 0 {
-				return l.errorf("unexpected eof; command is empty")
+				return l.errorf("command", "command is empty")
 			}
 			l.emit(itemCommand)
 			l.emit(itemEOF)
@@ -410,7 +421,7 @@ func lexTrailingPrefix(l *lexer) stateFn {
 
 func lexTrailingParam(l *lexer) stateFn {
 	l.pos += len(l.input[l.pos:])
-	l.emit(itemParam)
+	l.emit(itemTrailing)
 	l.emit(itemEOF)
 	return nil
 }
@@ -0,0 +1,274 @@
+package irc
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// LogFormat is the format of a log read by LogReader.
+type LogFormat int
+
+const (
+	// LogRaw is a transcript of raw IRC lines, as written by ircdebug.WriteTo or a bouncer's raw log.
+	// Each line may start with a timestamp, either in brackets ("[2006-01-02 15:04:05]", "[15:04:05]")
+	// or in RFC 3339 format ("2006-01-02T15:04:05Z").
+	// Lines without one are timestamped with their server-time tag, if any.
+	LogRaw LogFormat = iota
+
+	// LogZNC is the format of the ZNC log module, which writes one file per channel and day,
+	// with lines such as "[15:04:05] <nick> message" and "[15:04:05] *** Joins: nick (user@host)".
+	// The lines don't include the channel or the date, so they're taken from LogReader.Channel and LogReader.Date.
+	LogZNC
+)
+
+// serverTimeFormat is the format of the IRCv3 server-time tag.
+const serverTimeFormat = "2006-01-02T15:04:05.000Z"
+
+// LogEntry is a message read from a log.
+type LogEntry struct {
+
+	// Time is when the message was logged, or the zero time if the log doesn't say.
+	Time time.Time
+
+	Message *Message
+}
+
+// LogReader reads the messages of an IRC log, so that they can be processed again,
+// e.g. with Replay.
+type LogReader struct {
+	Format LogFormat
+
+	// Channel is the channel of a LogZNC log.
+	Channel string
+
+	// Date is the day of timestamps which only include the time of day.
+	// Its location is the time zone of the log.
+	Date time.Time
+
+	// Prefixes are removed from the start of each line after the timestamp, if present,
+	// such as the prefixes given to ircdebug.WriteTo to mark the direction of each line.
+	Prefixes []string
+
+	s    *bufio.Scanner
+	line int
+}
+
+// NewLogReader returns a LogReader which reads a LogRaw log from r.
+// The other fields may be set before the first call to Read.
+func NewLogReader(r io.Reader) *LogReader {
+	s := bufio.NewScanner(r)
+	s.Split(scanLenient)
+	return &LogReader{s: s}
+}
+
+// Read returns the next entry of the log, skipping empty lines.
+// At the end of the log, the error is io.EOF.
+// A line which can't be parsed returns an error which includes its line number,
+// and the next call to Read continues with the following line.
+func (r *LogReader) Read() (LogEntry, error) {
+	for r.s.Scan() {
+		r.line++
+		line := r.s.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var (
+			e   LogEntry
+			err error
+		)
+		switch r.Format {
+		case LogZNC:
+			e, err = r.parseZNC(line)
+		default:
+			e, err = r.parseRaw(line)
+		}
+		if err != nil {
+			return LogEntry{}, fmt.Errorf("log line %d: %w", r.line, err)
+		}
+		if !e.Time.IsZero() && !e.Message.Tags.Has("time") {
+			e.Message.Tags.Set("time", e.Time.UTC().Format(serverTimeFormat))
+		}
+		return e, nil
+	}
+	if err := r.s.Err(); err != nil {
+		return LogEntry{}, err
+	}
+	return LogEntry{}, io.EOF
+}
+
+// timestamp removes the timestamp at the start of line, returning the time and the rest of the line.
+// ok is false if line doesn't start with a timestamp.
+func (r *LogReader) timestamp(line string) (t time.Time, rest string, ok bool) {
+	var stamp string
+	if strings.HasPrefix(line, "[") {
+		end := strings.IndexByte(line, ']')
+		if end < 0 {
+			return time.Time{}, line, false
+		}
+		stamp, rest = line[1:end], line[end+1:]
+	} else {
+		stamp, rest, _ = strings.Cut(line, " ")
+	}
+	rest = strings.TrimPrefix(rest, " ")
+
+	loc := r.Date.Location()
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05", "2006-01-02T15:04:05"} {
+		if t, err := time.ParseInLocation(layout, stamp, loc); err == nil {
+			return t, rest, true
+		}
+	}
+	if tod, err := time.Parse("15:04:05", stamp); err == nil {
+		y, m, d := r.Date.Date()
+		return time.Date(y, m, d, tod.Hour(), tod.Minute(), tod.Second(), 0, loc), rest, true
+	}
+	return time.Time{}, line, false
+}
+
+func (r *LogReader) trimPrefixes(line string) string {
+	for _, p := range r.Prefixes {
+		if strings.HasPrefix(line, p) {
+			return line[len(p):]
+		}
+	}
+	return line
+}
+
+func (r *LogReader) parseRaw(line string) (LogEntry, error) {
+	t, rest, _ := r.timestamp(line)
+	m := new(Message)
+	if err := m.UnmarshalText([]byte(r.trimPrefixes(rest))); err != nil {
+		return LogEntry{}, err
+	}
+	if t.IsZero() {
+		t, _ = time.Parse(time.RFC3339Nano, m.Tags.Get("time"))
+	}
+	return LogEntry{Time: t, Message: m}, nil
+}
+
+// parseZNC converts a line of the ZNC log module back into the message it was written for.
+func (r *LogReader) parseZNC(line string) (LogEntry, error) {
+	t, rest, ok := r.timestamp(line)
+	if !ok {
+		return LogEntry{}, errors.New("missing timestamp")
+	}
+	rest = r.trimPrefixes(rest)
+	m, err := zncMessage(r.Channel, rest)
+	if err != nil {
+		return LogEntry{}, err
+	}
+	return LogEntry{Time: t, Message: m}, nil
+}
+
+func zncMessage(channel, line string) (*Message, error) {
+	from := func(nick string) *Message {
+		m := &Message{Source: Prefix{Nick: Nickname(nick)}}
+		m.SetIncludePrefix(true)
+		return m
+	}
+	with := func(m *Message, cmd Command, params ...string) *Message {
+		m.Command = cmd
+		m.Params = params
+		return m
+	}
+
+	switch {
+	// "<nick> message"
+	case strings.HasPrefix(line, "<"):
+		nick, text, ok := strings.Cut(line[1:], "> ")
+		if !ok {
+			break
+		}
+		return with(from(nick), CmdPrivmsg, channel, text), nil
+
+	// "-nick- message"
+	case strings.HasPrefix(line, "-"):
+		nick, text, ok := strings.Cut(line[1:], "- ")
+		if !ok {
+			break
+		}
+		return with(from(nick), CmdNotice, channel, text), nil
+
+	// "*** event"
+	case strings.HasPrefix(line, "*** "):
+		return zncEvent(channel, line[len("*** "):], from, with)
+
+	// "* nick action"
+	case strings.HasPrefix(line, "* "):
+		nick, action, _ := strings.Cut(line[2:], " ")
+		return with(from(nick), CmdPrivmsg, channel, "\x01ACTION "+action+"\x01"), nil
+	}
+	return nil, fmt.Errorf("unrecognized line %q", line)
+}
+
+func zncEvent(channel, event string, from func(string) *Message, with func(*Message, Command, ...string) *Message) (*Message, error) {
+	// "nick (user@host)" followed by an optional "(reason)"
+	user := func(s string) (*Message, string) {
+		nick, rest, _ := strings.Cut(s, " (")
+		m := from(nick)
+		address, rest, _ := strings.Cut(rest, ")")
+		m.Source.User, m.Source.Host, _ = strings.Cut(address, "@")
+		rest = strings.TrimPrefix(rest, " ")
+		if strings.HasPrefix(rest, "(") && strings.HasSuffix(rest, ")") {
+			rest = rest[1 : len(rest)-1]
+		}
+		return m, rest
+	}
+
+	if s, ok := strings.CutPrefix(event, "Joins: "); ok {
+		m, _ := user(s)
+		return with(m, CmdJoin, channel), nil
+	}
+	if s, ok := strings.CutPrefix(event, "Parts: "); ok {
+		m, reason := user(s)
+		if reason == "" {
+			return with(m, CmdPart, channel), nil
+		}
+		return with(m, CmdPart, channel, reason), nil
+	}
+	if s, ok := strings.CutPrefix(event, "Quits: "); ok {
+		m, reason := user(s)
+		return with(m, CmdQuit, reason), nil
+	}
+	if nick, s, ok := strings.Cut(event, " is now known as "); ok {
+		return with(from(nick), CmdNick, s), nil
+	}
+	if nick, s, ok := strings.Cut(event, " was kicked by "); ok {
+		op, reason, _ := strings.Cut(s, " (")
+		return with(from(op), CmdKick, channel, nick, strings.TrimSuffix(reason, ")")), nil
+	}
+	if nick, s, ok := strings.Cut(event, " sets mode: "); ok {
+		return with(from(nick), CmdMode, append([]string{channel}, strings.Fields(s)...)...), nil
+	}
+	if nick, s, ok := strings.Cut(event, " changes topic to '"); ok {
+		return with(from(nick), CmdTopic, channel, strings.TrimSuffix(s, "'")), nil
+	}
+	return nil, fmt.Errorf("unrecognized event %q", event)
+}
+
+// Replay passes each message of the log read by r to h, as a Client would when the messages were received,
+// so that the handlers of a bot can process its history. Replies written by h are written to w,
+// which is usually a recorder or a no-op writer rather than a live connection.
+//
+// Lines which can't be parsed are skipped; their errors are joined and returned at the end of the log.
+func Replay(r *LogReader, h Handler, w MessageWriter) error {
+	h = ctcpHandler(h)
+	var errs []error
+	for {
+		e, err := r.Read()
+		if err == io.EOF {
+			return errors.Join(errs...)
+		}
+		if err != nil {
+			if r.s.Err() != nil {
+				return errors.Join(append(errs, err)...)
+			}
+			errs = append(errs, err)
+			continue
+		}
+		h.SpeakIRC(w, e.Message)
+	}
+}
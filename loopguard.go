@@ -0,0 +1,187 @@
+package irc
+
+import (
+	"encoding"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults used by a LoopGuard when its fields are left empty.
+const (
+	DefaultMaxRepeats   = 3
+	DefaultRepeatWindow = 30 * time.Second
+)
+
+// DefaultServices are the nicknames of common network services, used by a LoopGuard when its Services are nil.
+var DefaultServices = []string{"NickServ", "ChanServ", "MemoServ", "HostServ", "OperServ", "BotServ", "SaslServ"}
+
+// A LoopGuard is middleware which prevents the classic ways for a bot to get stuck in a loop
+// with services or another bot, each answering the other forever.
+//
+// While a message is being handled, the LoopGuard drops PRIVMSG and NOTICE messages written in response when:
+//
+//   - the message being handled is a NOTICE.
+//     RFC 1459 forbids automatic replies to NOTICE for exactly this reason.
+//   - the message being handled came from another bot: a source matching one of the Bots masks,
+//     or a message with the IRCv3 "bot" tag.
+//
+// Replies to CTCP queries and messages to network services (see Services) are exempt from both checks,
+// so that CTCP VERSION is still answered for bots, and NickServ IDENTIFY is still sent when NickServ asks for it with a NOTICE.
+//
+// Regardless of what's being handled, it also drops identical messages sent to the same target
+// more than MaxRepeats times in a row within RepeatWindow.
+//
+// Other commands, such as JOIN in response to a NOTICE from services, are never dropped.
+//
+// Clients use a LoopGuard with the default settings unless Client.LoopGuard is set.
+// Each check has its own opt-out.
+type LoopGuard struct {
+
+	// AllowNoticeReplies disables the check for replies to NOTICE.
+	AllowNoticeReplies bool
+
+	// AllowBotReplies disables the check for replies to other bots.
+	AllowBotReplies bool
+
+	// Bots is a list of wildcard masks (nick!user@host) identifying other bots, e.g. "*bot!*@*".
+	Bots []string
+
+	// Services are the nicknames of the network services which may always be answered.
+	// If nil, DefaultServices is used.
+	Services []string
+
+	// MaxRepeats is the number of identical consecutive messages which may be sent to the same target.
+	// If 0, DefaultMaxRepeats is used. If negative, repeats are never dropped.
+	MaxRepeats int
+
+	// RepeatWindow is how long an identical message counts as a repeat of the previous one.
+	// If 0, DefaultRepeatWindow is used.
+	RepeatWindow time.Duration
+
+	// Dropped is called for every message which was dropped, with the reason (optional).
+	Dropped func(m *Message, reason string)
+
+	mu      sync.Mutex
+	last    string // the target and text of the last message sent
+	lastAt  time.Time
+	repeats int
+}
+
+// Middleware guards the messages written by next, and by any handlers it calls.
+func (g *LoopGuard) Middleware(next Handler) Handler {
+	return HandlerFunc(func(w MessageWriter, m *Message) {
+		next.SpeakIRC(&guardedWriter{w: w, g: g, m: m}, m)
+	})
+}
+
+// isBot reports whether m came from another bot.
+func (g *LoopGuard) isBot(m *Message) bool {
+	if _, ok := m.Tags["bot"]; ok {
+		return true
+	}
+	if m.Source.Nick == "" {
+		return false
+	}
+	source := m.Source.String()
+	for _, mask := range g.Bots {
+		if IsWM(mask, source) {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns the reason out should be dropped while handling m, or an empty string.
+func (g *LoopGuard) check(m *Message, out *Message) string {
+	if !out.Command.is(CmdPrivmsg) && !out.Command.is(CmdNotice) {
+		return ""
+	}
+	if !g.exempt(m, out) && !g.AllowNoticeReplies && (m.Command.is(CmdNotice) || strings.HasPrefix(m.Command.String(), "_CTCP_REPLY_")) {
+		return "automatic reply to a NOTICE"
+	}
+	if !g.exempt(m, out) && !g.AllowBotReplies && g.isBot(m) {
+		return "reply to a bot"
+	}
+	if g.repeated(out) {
+		return "repeated message"
+	}
+	return ""
+}
+
+// exempt reports whether out is a reply which is sent whatever m is: the reply to a CTCP query, or a message to services.
+func (g *LoopGuard) exempt(m *Message, out *Message) bool {
+	if out.Command.is(CmdNotice) && strings.HasPrefix(m.Command.String(), "_CTCP_QUERY_") && !m.Command.is(CTCPAction) &&
+		strings.HasPrefix(out.Params.Get(2), "\x01") {
+		return true
+	}
+	services := g.Services
+	if services == nil {
+		services = DefaultServices
+	}
+	target := out.Params.Get(1)
+	for _, name := range services {
+		if Nickname(name).Is(target) {
+			return true
+		}
+	}
+	return false
+}
+
+// repeated records out and reports whether it exceeds the limit of identical consecutive messages.
+func (g *LoopGuard) repeated(out *Message) bool {
+	max := g.MaxRepeats
+	if max == 0 {
+		max = DefaultMaxRepeats
+	}
+	if max < 0 {
+		return false
+	}
+	window := g.RepeatWindow
+	if window == 0 {
+		window = DefaultRepeatWindow
+	}
+
+	key := out.Command.String() + " " + strings.Join(out.Params, " ")
+	now := time.Now()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if key != g.last || now.Sub(g.lastAt) > window {
+		g.last = key
+		g.repeats = 0
+	}
+	g.lastAt = now
+	g.repeats++
+	return g.repeats > max
+}
+
+// guardedWriter is the MessageWriter given to the handlers of a message m.
+type guardedWriter struct {
+	w MessageWriter
+	g *LoopGuard
+	m *Message
+}
+
+func (gw *guardedWriter) WriteMessage(m encoding.TextMarshaler) {
+	if out, ok := m.(*Message); ok {
+		if reason := gw.g.check(gw.m, out); reason != "" {
+			if gw.g.Dropped != nil {
+				gw.g.Dropped(out, reason)
+			}
+			return
+		}
+	}
+	gw.w.WriteMessage(m)
+}
+
+// Unwrap returns the writer guarded by gw. See ConnInfoOf.
+func (gw *guardedWriter) Unwrap() MessageWriter { return gw.w }
+
+func (gw *guardedWriter) forRoute(rt *route) MessageWriter {
+	rw, ok := gw.w.(routeWriter)
+	if !ok {
+		return gw
+	}
+	return &guardedWriter{w: rw.forRoute(rt), g: gw.g, m: gw.m}
+}
@@ -0,0 +1,107 @@
+package irc
+
+import "strings"
+
+// mentionSuffixes are the characters which clients append to a nickname when it's taken, as in "bot_" or "bot`".
+// They're ignored at the end of both nicknames when looking for mentions.
+const mentionSuffixes = "_`^-"
+
+// OnMention attaches the handler h for channel messages and actions which mention the client's current nickname
+// anywhere in their text, such as "is the bot down?" or "thanks, bot".
+// See Mentions for what counts as a mention.
+// The router must know the client's nickname; see BindClient.
+func (r *Router) OnMention(h HandlerFunc) *route {
+	return r.handleCommands(h, CmdPrivmsg, CTCPAction).MatchMention()
+}
+
+// MatchMention limits the route to channel messages which mention the client's current nickname. See Mentions.
+// The router must know the client's nickname; see BindClient.
+func (r *route) MatchMention() *route {
+	return r.Matcher(mentionMatch{r.router})
+}
+
+type mentionMatch struct {
+	router *Router
+}
+
+func (mm mentionMatch) matches(m *Message) bool {
+	if (queryMatch{mm.router}).matches(m) {
+		return false
+	}
+	text, err := m.Text()
+	if err != nil {
+		return false
+	}
+	nick, ok := mm.router.nick()
+	return ok && Mentions(text, nick, mm.router.caseMapping())
+}
+
+func (mm mentionMatch) String() string {
+	return "mentioning the client"
+}
+
+// Mentions reports whether text mentions nick.
+//
+// A mention is a word of text which is nick, compared with casemapping, the CASEMAPPING token of RPL_ISUPPORT
+// ("ascii", "rfc1459", or "rfc1459-strict"; rfc1459 if empty or unknown). Words are the runs of characters
+// allowed in nicknames, so "bot's" and "@bot" mention bot, but "robot" doesn't.
+// The variants which clients use when a nickname is taken or to show a status match too:
+// "bot", "bot_", "bot`", and "bot|away" all mention each other.
+// Formatting is ignored.
+func Mentions(text string, nick Nickname, casemapping string) bool {
+	want := mentionBase(foldNick(nick.String(), casemapping))
+	if want == "" {
+		return false
+	}
+	text = foldNick(StripFormatting(text), casemapping)
+	for start := 0; start < len(text); {
+		if !isNickChar(text[start]) {
+			start++
+			continue
+		}
+		end := start
+		for end < len(text) && isNickChar(text[end]) {
+			end++
+		}
+		if mentionBase(text[start:end]) == want {
+			return true
+		}
+		start = end
+	}
+	return false
+}
+
+// mentionBase returns the folded nickname without its status (e.g. "|away") and taken-nickname suffixes.
+func mentionBase(nick string) string {
+	if i := strings.IndexByte(nick, '|'); i > 0 {
+		nick = nick[:i]
+	}
+	return strings.TrimRight(nick, mentionSuffixes)
+}
+
+// isNickChar reports whether c may be part of a nickname: letters, digits, and the special characters []\`_^{|}-.
+func isNickChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || isDigit(c) || strings.IndexByte("[]\\`_^{|}-", c) >= 0
+}
+
+// foldNick returns s in lowercase according to casemapping.
+// With rfc1459, "[]\~" are the uppercase forms of "{}|^", and with rfc1459-strict, "[]\" of "{}|".
+func foldNick(s, casemapping string) string {
+	var upper, lower string
+	switch strings.ToLower(casemapping) {
+	case "ascii":
+	case "rfc1459-strict":
+		upper, lower = "[]\\", "{}|"
+	default:
+		upper, lower = "[]\\~", "{}|^"
+	}
+	b := []byte(s)
+	for i, c := range b {
+		if c >= 'A' && c <= 'Z' {
+			b[i] = c + 'a' - 'A'
+		} else if j := strings.IndexByte(upper, c); j >= 0 {
+			b[i] = lower[j]
+		}
+	}
+	return string(b)
+}
@@ -5,6 +5,7 @@ import (
 	"encoding"
 	"errors"
 	"fmt"
+	"sort"
 	"strings"
 )
 
@@ -31,9 +32,21 @@ import (
 // limit defined in the IRC protocol (512 bytes including \r\n), then it is safe
 // to discard this error.
 // E.g.:
-//     if errors.Is(err, warnTruncate) { err = nil }
+//     if errors.Is(err, WarnMessageTooLong) { err = nil }
+//
+// MarshalText reports the tags and the rest of the line separately with WarnTagsTooLong and WarnMessageTooLong,
+// both of which wrap warnTruncate.
 var warnTruncate = errors.New("message length exceeds IRC limit and may be truncated")
 
+// WarnTagsTooLong is returned by MarshalText when the tags of a message exceed the limits of the message-tags specification.
+// Servers may reject the message or drop its tags.
+var WarnTagsTooLong = fmt.Errorf("%w: tags too long", warnTruncate)
+
+// WarnMessageTooLong is returned by MarshalText when the rest of a message,
+// including the prefix added by the server, exceeds the line length limit.
+// Servers are likely to truncate the end of the message.
+var WarnMessageTooLong = fmt.Errorf("%w: line too long", warnTruncate)
+
 // WarnTooManyParams is an error which is returned when encoding a message with more than
 // 15 parameters. RFC 2812 in particular specified 15 as the limit, and defined the
 // leading ':' of the trailing parameter as optional when the trailing parameter
@@ -109,8 +122,22 @@ type Message struct {
 	// Including a space in any other parameter will result in undefined behavior.
 	Params Params
 
+	// Trailing controls whether MarshalText writes the last parameter with the ':' sentinel.
+	// The default is to always write it, which every server understands.
+	// UnmarshalText sets Trailing to match the parsed line, so that a parsed message is marshaled the same way.
+	Trailing TrailingMode
+
 	// includePrefix controls whether MarshalText will write the prefix.
 	includePrefix bool
+
+	// serverTags allows server-only tags in a message written by a client. See SetServerTags.
+	serverTags bool
+
+	// limits overrides the protocol's length limits when the server advertised different ones.
+	limits lineLimits
+
+	// dispatch is set while the client's handler runs, to record the route which handled the message.
+	dispatch *dispatchRecord
 }
 
 // MarshalText implements encoding.TextMarshaler, mainly for use with irc.MessageWriter.
@@ -131,24 +158,46 @@ func (m *Message) MarshalText() ([]byte, error) {
 	- - (How many people are even going to bother with multi-target messages?)
 	*/
 
-	buf := bytes.NewBuffer(make([]byte, 0, 1024)) // 512 for tags, 512 for
-	maxLen := 300                                 // todo: use client nick/address to calculate max message size
-	var tbc int                                   // tags byte count
-	var err error
+	if err := checkControlChars(m); err != nil {
+		return nil, err
+	}
+	if !m.includePrefix && !m.serverTags {
+		if err := checkClientTags(m.Tags); err != nil {
+			return nil, err
+		}
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, 1024)) // 512 for tags, 512 for the rest
+	limits := m.limits.orDefaults()
+	var tbc int // tags byte count, including the leading '@' and trailing space
+	var errs []error
+
+	if len(m.Tags) > 0 {
+		keys := make([]string, 0, len(m.Tags))
+		for k := range m.Tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
 
-	if m.Tags != nil {
 		buf.WriteRune(startTags)
-		for k, v := range m.Tags {
+		for i, k := range keys {
+			if i > 0 {
+				buf.WriteRune(delimTag)
+			}
 			buf.WriteString(k)
 			buf.WriteRune(delimTagValue)
-			buf.WriteString(escaper.Replace(v))
-			buf.WriteRune(delimTag)
+			buf.WriteString(escaper.Replace(m.Tags[k]))
 		}
 		buf.WriteRune(delimParam)
-
 		tbc = buf.Len()
-		if tbc > 8000 { // todo: this number isn't correct
-			err = fmt.Errorf("%w: message tags were %d bytes", warnTruncate, tbc)
+
+		// clients are held to a smaller limit than the servers relaying their messages,
+		// which need room to add tags of their own
+		switch data := tbc - 2; {
+		case !m.includePrefix && data > limits.clientTags:
+			errs = append(errs, fmt.Errorf("%w: tag data is %d bytes; the limit is %d", WarnTagsTooLong, data, limits.clientTags))
+		case tbc > limits.tags:
+			errs = append(errs, fmt.Errorf("%w: tags are %d bytes; the limit is %d", WarnTagsTooLong, tbc, limits.tags))
 		}
 	}
 
@@ -163,23 +212,97 @@ func (m *Message) MarshalText() ([]byte, error) {
 	for i := 0; i < len(m.Params); i++ {
 		buf.WriteRune(delimParam)
 
-		// for simplicity, always write the last param in the trailing component.
+		// for simplicity, the last param is written in the trailing component by default.
 		// proper parsers should handle this normally.
-		if i == len(m.Params)-1 {
+		if i == len(m.Params)-1 && (m.Trailing == TrailingAlways || needsTrailing(m.Params[i])) {
 			buf.WriteRune(startTrailing)
 		}
 		buf.WriteString(m.Params[i])
 	}
 	buf.WriteString("\r\n")
 
-	if l := buf.Len() - tbc; l > maxLen {
-		if err != nil {
-			err = fmt.Errorf("%w, and message length is %d bytes", err, l)
+	// the line is measured as other clients will receive it, with our prefix added by the server
+	l := buf.Len() - tbc
+	if !m.includePrefix {
+		if m.Source != (Prefix{}) {
+			l += len(m.Source.String()) + 2 // ':' and SPACE
+		} else {
+			l += unknownPrefixLength
 		}
-		err = fmt.Errorf("%w: message length is %d bytes", warnTruncate, l)
 	}
+	if l > limits.line {
+		errs = append(errs, fmt.Errorf("%w: line is %d bytes; the limit is %d", WarnMessageTooLong, l, limits.line))
+	}
+
+	return buf.Bytes(), errors.Join(errs...)
+}
 
-	return buf.Bytes(), err
+// TrailingMode controls how MarshalText writes the last parameter of a message.
+type TrailingMode int
+
+const (
+	// TrailingAlways writes the last parameter with the ':' sentinel, e.g. "NICK :name".
+	TrailingAlways TrailingMode = iota
+
+	// TrailingAuto writes the ':' sentinel only when the last parameter requires it, e.g. "NICK name".
+	// A parameter requires it when it's empty, contains a SPACE, or begins with ':'.
+	TrailingAuto
+)
+
+// needsTrailing reports whether param can only be written as the trailing parameter.
+func needsTrailing(param string) bool {
+	return param == "" || param[0] == startTrailing || strings.ContainsRune(param, delimParam)
+}
+
+// Protocol limits on the length of a message.
+// https://ircv3.net/specs/extensions/message-tags.html#size-limit
+const (
+	// defaultLineLength is the limit of the non-tag portion of a line, including CR-LF.
+	defaultLineLength = 512
+
+	// maxClientTagData is the limit of the tag data sent by a client, excluding the leading '@' and trailing SPACE.
+	maxClientTagData = 4094
+
+	// maxTagsLength is the limit of the tags portion of a line, including the leading '@' and trailing SPACE.
+	maxTagsLength = 8191
+
+	// unknownPrefixLength is assumed for the prefix the server adds to our messages when we don't know it,
+	// enough for a 30 byte nickname, 10 byte username, and 63 byte hostname with delimiters.
+	unknownPrefixLength = 1 + 30 + 1 + 10 + 1 + 63 + 1
+)
+
+// TagLimits are the size limits of the tags of a message, for servers which don't follow the message-tags specification.
+// A zero field means the limit of the specification. See Client.TagLimits.
+type TagLimits struct {
+
+	// ClientData is the limit of the tag data sent by a client, excluding the leading '@' and trailing SPACE.
+	// The specification limits it to 4094 bytes.
+	ClientData int
+
+	// Total is the limit of the tags portion of a line, including the leading '@' and trailing SPACE.
+	// The specification limits it to 8191 bytes.
+	Total int
+}
+
+// lineLimits holds the length limits checked by MarshalText.
+// A zero field means the protocol default.
+type lineLimits struct {
+	line       int // LINELEN
+	clientTags int
+	tags       int
+}
+
+func (l lineLimits) orDefaults() lineLimits {
+	if l.line <= 0 {
+		l.line = defaultLineLength
+	}
+	if l.clientTags <= 0 {
+		l.clientTags = maxClientTagData
+	}
+	if l.tags <= 0 {
+		l.tags = maxTagsLength
+	}
+	return l
 }
 
 // UnmarshalText implements encoding.TextUnmarshaler,
@@ -198,17 +321,23 @@ func (m *Message) UnmarshalText(text []byte) error {
 	m.Command = ""
 	m.Params = nil
 	m.Tags = nil
+	m.Trailing = TrailingAlways
 
 	for {
 		i := l.nextItem()
 		switch i.typ {
 		case itemEOF:
+			// a parsed prefix is written back out, so that the message marshals the way it was read
+			m.includePrefix = m.Source != (Prefix{})
 			return nil
 		case itemError:
-			return errors.New(i.val)
+			return l.err
 		case itemTagKey:
-			v := l.nextItem() // type itemTagValue is *always* emitted after itemTagKey
-			if i.val == "" {  // if the key was empty, skip
+			v := l.nextItem() // type itemTagValue is *always* emitted after itemTagKey, unless the tag was invalid
+			if v.typ == itemError {
+				return l.err
+			}
+			if i.val == "" { // if the key was empty, skip
 				continue
 			}
 			m.Tags.Set(i.val, unescaper.Replace(v.val))
@@ -222,24 +351,68 @@ func (m *Message) UnmarshalText(text []byte) error {
 			m.Command = Command(i.val)
 		case itemParam:
 			m.Params = append(m.Params, i.val)
+			m.Trailing = TrailingAuto
+		case itemTrailing:
+			m.Params = append(m.Params, i.val)
+			m.Trailing = TrailingAlways
 		}
 	}
 }
 
-// IncludePrefix controls whether the Source field will be marshaled by MarshalText.
-// todo: wording
-// The Source field will be included in the encoded text for the sake of compatibility with encoding.TextUnmarshaler.
-// However, the Source field should be left empty for messages which are written to an IRC connection.
-// This is because [RFC 1459] states that for messages originating from a client,
-// it is invalid to include any prefix other than the client's nickname.
-// The RFC also instructs servers to silently discard messages which do not follow this rule.
+// SetIncludePrefix controls whether MarshalText writes the Source field as the message prefix.
+//
+// The prefix is included by default for messages parsed by UnmarshalText which had one, so that a parsed message
+// is marshaled the same way (see encoding.TextUnmarshaler), and excluded for new messages.
+// Messages written to an IRC connection by a client should not include it:
+// [RFC 1459] states that the only valid prefix for a message from a client is the client's own nickname,
+// and instructs servers to silently discard messages which don't follow this rule.
+// Fake servers and test fixtures, on the other hand, need the prefix to be written; see WithSource.
+//
+// Client.WriteMessage sets Source to the client's own address for messages without the prefix,
+// only to estimate how long the line will be once the server relays it.
+// Messages with the prefix are written unchanged.
+//
+// The setting is kept when a Message is copied by value, so middleware which passes a modified copy
+// of a message to the next handler preserves how it's marshaled.
 //
 // [RFC 1459]: https://datatracker.ietf.org/doc/html/rfc1459#section-2.3
-// todo: rename method
-// The default is to enable this setting for received messages and disable it for new messages.
-// Generally this should not be needed except in the case of middleware cloning a message and passing the copy to the next handler.
+func (m *Message) SetIncludePrefix(include bool) {
+	m.includePrefix = include
+}
+
+// IncludesPrefix reports whether MarshalText writes the Source field as the message prefix.
+// See SetIncludePrefix.
+func (m *Message) IncludesPrefix() bool {
+	return m.includePrefix
+}
+
+// IncludePrefix makes MarshalText write the Source field as the message prefix.
+//
+// Deprecated: Use SetIncludePrefix(true).
 func (m *Message) IncludePrefix() {
-	m.includePrefix = true
+	m.SetIncludePrefix(true)
+}
+
+// WithSource returns a copy of m from source, which MarshalText writes as the message prefix.
+// It's how servers, bouncers, and relays build the messages they send to clients:
+//
+//	w.WriteMessage(irc.Msg("#chan", "hello").WithSource(irc.Prefix{Nick: "alice", User: "a", Host: "host"}))
+//
+// An empty source removes the prefix. The copy shares Params and Tags with m, like any copy of a Message.
+// See SetIncludePrefix for why clients must not send a prefix to servers.
+func (m *Message) WithSource(source Prefix) *Message {
+	c := *m
+	c.Source = source
+	c.includePrefix = source != (Prefix{})
+	return &c
+}
+
+// SetServerTags controls whether MarshalText accepts tags which only servers may set, such as time and msgid,
+// in a message written by a client (one without the prefix; see SetIncludePrefix).
+// They're rejected with ErrInvalidTag by default, since servers drop them or refuse the whole message.
+// Relays and bouncers which forward them to servers known to accept them may allow them.
+func (m *Message) SetServerTags(allow bool) {
+	m.serverTags = allow
 }
 
 // unescaper is a string replacer that unescapes message tag values.
@@ -284,6 +457,72 @@ func (t Tags) Has(key string) bool {
 	return ok
 }
 
+// GetAny returns the value of the first of keys which the message has, or an empty string if it has none.
+// Tags are often renamed while their IRCv3 specification moves from draft to ratified,
+// so handlers can accept every name a tag is sent with:
+//
+//	reply := m.Tags.GetAny("+reply", "+draft/reply")
+func (t Tags) GetAny(keys ...string) string {
+	for _, key := range keys {
+		if v, ok := t[key]; ok {
+			return v
+		}
+	}
+	return ""
+}
+
+// Find looks up the tag called name in any namespace: with or without the client-only '+' prefix,
+// under the "draft/" or any vendor namespace, and regardless of case.
+// It returns the key the tag was sent with, e.g. "+draft/reply" when looking for "reply".
+//
+// When the message has several matching tags, an exact match of name is preferred,
+// then the client-only tag, then the draft, then other vendors, and then keys which only differ in case.
+func (t Tags) Find(name string) (key, value string, ok bool) {
+	if v, ok := t[name]; ok {
+		return name, v, true
+	}
+	name = tagName(name)
+	best := -1
+	for k, v := range t {
+		rank := tagRank(k, name)
+		if rank < 0 || best >= 0 && (rank > best || rank == best && k > key) {
+			continue
+		}
+		key, value, best = k, v, rank
+	}
+	return key, value, best >= 0
+}
+
+// tagName returns key without its client-only prefix and vendor namespace, e.g. "reply" for "+draft/reply".
+func tagName(key string) string {
+	key = strings.TrimPrefix(key, "+")
+	if i := strings.LastIndexByte(key, '/'); i >= 0 {
+		key = key[i+1:]
+	}
+	return key
+}
+
+// tagRank returns how well key matches the tag name for Tags.Find, lower being better, or -1 if it doesn't match.
+func tagRank(key, name string) int {
+	rank := 0
+	if n := tagName(key); n != name {
+		if !strings.EqualFold(n, name) {
+			return -1
+		}
+		rank = 4
+	}
+	vendor, _, namespaced := strings.Cut(strings.TrimPrefix(key, "+"), "/")
+	switch {
+	case !namespaced && strings.HasPrefix(key, "+"):
+		rank++
+	case namespaced && vendor == "draft":
+		rank += 2
+	case namespaced:
+		rank += 3
+	}
+	return rank
+}
+
 // Command is an IRC command such as PRIVMSG, NOTICE, 001, etc.
 //
 // A command may also be known as the "verb", "event type", or "numeric".
@@ -89,3 +89,41 @@ func (m *Message) Chan() (string, error) {
 		return "", fmt.Errorf("%s: chan method not supported", m.Command)
 	}
 }
+
+// DisplayText renders the message for human display, the way a client window or log would show it:
+// "* nick does thing" for CTCP ACTION, and "nick: text" for PRIVMSG, NOTICE, and other messages.
+// Actions are recognized whether or not the message was decoded by the client's CTCP handling,
+// so DisplayText gives the same result for messages read from logs or other sources.
+//
+// Formatting codes are kept; call Unformat first to remove them.
+// Messages from servers are shown with the server name, and messages without a source with the text alone.
+func (m *Message) DisplayText() string {
+	text, _ := m.Text()
+	action := m.Command == CTCPAction
+	if m.Command.is(CmdPrivmsg) {
+		if parts := ctcpRegex.FindStringSubmatch(ctcpBody(text, CTCPLenient)); parts != nil && parts[1] == "ACTION" {
+			action, text = true, parts[2]
+		}
+	}
+
+	name := m.Source.Nick.String()
+	if m.Source.IsServer() {
+		name = m.Source.Host
+	}
+	switch {
+	case action && name != "":
+		return "* " + name + " " + text
+	case action:
+		return "* " + text
+	case name != "":
+		return name + ": " + text
+	}
+	return text
+}
+
+// Unformat returns a copy of the message with the formatting codes removed from every parameter,
+// or the message itself when it had no formatting codes.
+// The text of a single parameter can be unformatted with StripFormatting.
+func (m *Message) Unformat() *Message {
+	return stripMessage(m)
+}
@@ -1,11 +1,15 @@
 package irc_test
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/Travis-Britz/irc"
+	"github.com/Travis-Britz/irc/irctest"
 )
 
 func newMessage(tags map[string]string, prefix struct{ nick, user, host string }, command irc.Command, params []string) *irc.Message {
@@ -192,6 +196,98 @@ func TestParseMessage(t *testing.T) {
 	}
 }
 
+func TestParseError(t *testing.T) {
+	tests := []struct {
+		raw     string
+		offset  int
+		segment string
+		state   string
+	}{
+		{"@a=b;c", 6, "c", "tag name"},
+		{"@a=b;c!d= PING", 7, "c!", "tag name"},
+		{"@a=b", 4, "b", "tag value"},
+		{":nick!user", 10, "user", "prefix user"},
+		{":nick ", 6, "", "command"},
+		{" ", 0, "", "command"},
+	}
+	for _, tt := range tests {
+		m := &irc.Message{}
+		err := m.UnmarshalText([]byte(tt.raw))
+		var perr *irc.ParseError
+		if !errors.As(err, &perr) {
+			t.Errorf("%q: expected *irc.ParseError; got %v", tt.raw, err)
+			continue
+		}
+		if perr.Line != tt.raw || perr.Offset != tt.offset || perr.Segment != tt.segment || perr.State != tt.state {
+			t.Errorf("%q: unexpected error details: %+v", tt.raw, perr)
+		}
+	}
+}
+
+func TestTokenizer(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want []irc.Token
+	}{
+		{"@a=b\\s;c :n!u@h PRIVMSG #chan :hi there", []irc.Token{
+			{Type: irc.TokenTagKey, Value: "a", Offset: 1},
+			{Type: irc.TokenTagValue, Value: "b\\s", Offset: 3},
+			{Type: irc.TokenTagKey, Value: "c", Offset: 7},
+			{Type: irc.TokenTagValue, Value: "", Offset: 8},
+			{Type: irc.TokenNickname, Value: "n", Offset: 10},
+			{Type: irc.TokenUser, Value: "u", Offset: 12},
+			{Type: irc.TokenHost, Value: "h", Offset: 14},
+			{Type: irc.TokenCommand, Value: "PRIVMSG", Offset: 16},
+			{Type: irc.TokenParam, Value: "#chan", Offset: 24},
+			{Type: irc.TokenTrailing, Value: "hi there", Offset: 31},
+			{Type: irc.TokenEOF, Offset: 39},
+		}},
+		{"PING x", []irc.Token{
+			{Type: irc.TokenCommand, Value: "PING", Offset: 0},
+			{Type: irc.TokenParam, Value: "x", Offset: 5},
+			{Type: irc.TokenEOF, Offset: 6},
+		}},
+	}
+	for _, tt := range tests {
+		tk := irc.NewTokenizer(tt.raw)
+		var got []irc.Token
+		for {
+			tok := tk.Next()
+			got = append(got, tok)
+			if tok.Type == irc.TokenEOF || tok.Type == irc.TokenError {
+				break
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) || len(got) != len(tt.want) {
+			t.Errorf("%q:\n got %v\nwant %v", tt.raw, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%q: token %d: got %+v; want %+v", tt.raw, i, got[i], tt.want[i])
+			}
+		}
+		if err := tk.Err(); err != nil {
+			t.Errorf("%q: unexpected error: %v", tt.raw, err)
+		}
+	}
+
+	tk := irc.NewTokenizer("@a=b")
+	if tok := tk.Next(); tok.Type != irc.TokenTagKey {
+		t.Fatalf("expected tag key; got %v", tok)
+	}
+	if tok := tk.Next(); tok.Type != irc.TokenError || tok.Offset != 4 {
+		t.Errorf("expected error at byte 4; got %+v", tok)
+	}
+	var perr *irc.ParseError
+	if !errors.As(tk.Err(), &perr) || perr.State != "tag value" {
+		t.Errorf("expected ParseError while reading tag value; got %v", tk.Err())
+	}
+	if tok := tk.Next(); tok.Type != irc.TokenEOF {
+		t.Errorf("expected EOF after error; got %v", tok)
+	}
+}
+
 func TestParseErrors(t *testing.T) {
 	var parseErrors = []string{
 		"@badge-info=;badges=;color=#FF0000;display-name=bot;emote-sets=0,19650,300374282,472873131;user-type=",
@@ -222,3 +318,409 @@ func TestParseErrors(t *testing.T) {
 		}
 	}
 }
+
+func TestMessage_MarshalText_limits(t *testing.T) {
+	tests := map[string]struct {
+		m           *irc.Message
+		tagsWarning bool
+		lineWarning bool
+	}{
+		"short": {
+			m: &irc.Message{Tags: irc.Tags{"+draft/reply": "123"}, Command: irc.CmdPrivmsg, Params: irc.Params{"#channel", "hi"}},
+		},
+		"client tags over 4094 bytes": {
+			m:           &irc.Message{Tags: irc.Tags{"+data": strings.Repeat("a", 4094)}, Command: irc.CmdPrivmsg, Params: irc.Params{"#channel", "hi"}},
+			tagsWarning: true,
+		},
+		"long line": {
+			m:           irc.Msg("#channel", strings.Repeat("a", 450)),
+			lineWarning: true,
+		},
+		"both": {
+			m:           &irc.Message{Tags: irc.Tags{"+data": strings.Repeat("a", 5000)}, Command: irc.CmdPrivmsg, Params: irc.Params{"#channel", strings.Repeat("a", 500)}},
+			tagsWarning: true,
+			lineWarning: true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := tt.m.MarshalText()
+			if got := errors.Is(err, irc.WarnTagsTooLong); got != tt.tagsWarning {
+				t.Errorf("expected tags warning to be %t; got error: %v", tt.tagsWarning, err)
+			}
+			if got := errors.Is(err, irc.WarnMessageTooLong); got != tt.lineWarning {
+				t.Errorf("expected line warning to be %t; got error: %v", tt.lineWarning, err)
+			}
+		})
+	}
+}
+
+func TestMessage_MarshalText_tags(t *testing.T) {
+	m := &irc.Message{Tags: irc.Tags{"b": "2", "a": "1"}, Command: irc.CmdTagMsg, Params: irc.Params{"#channel"}}
+	b, err := m.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "@a=1;b=2 TAGMSG :#channel\r\n"; string(b) != want {
+		t.Errorf("expected %q; got %q", want, b)
+	}
+}
+
+func TestTagMsgTo(t *testing.T) {
+	tests := []struct {
+		m    *irc.Message
+		want string
+	}{
+		{irc.TagMsgTo("#channel", irc.Tags{"+example.com/x": "1"}), "@+example.com/x=1 TAGMSG :#channel\r\n"},
+		{irc.React("#channel", "abc", "👍"), "@+draft/react=👍;+draft/reply=abc TAGMSG :#channel\r\n"},
+		{irc.Typing("nick", irc.TypingActive), "@+typing=active TAGMSG :nick\r\n"},
+	}
+	for _, tt := range tests {
+		b, err := tt.m.MarshalText()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != tt.want {
+			t.Errorf("expected %q; got %q", tt.want, b)
+		}
+	}
+}
+
+func TestMessage_MarshalText_clientTags(t *testing.T) {
+	valid := []string{"+typing", "+draft/reply", "+example.com/foo-bar", "label", "batch"}
+	for _, k := range valid {
+		m := &irc.Message{Tags: irc.Tags{k: "x"}, Command: irc.CmdTagMsg, Params: irc.Params{"#channel"}}
+		if _, err := m.MarshalText(); err != nil {
+			t.Errorf("tag %q: unexpected error: %v", k, err)
+		}
+	}
+
+	invalid := []string{"+", "++typing", "+bad tag", "+draft/", "+/reply", "+bad_vendor/reply", "time", "msgid", "account"}
+	for _, k := range invalid {
+		m := &irc.Message{Tags: irc.Tags{k: "x"}, Command: irc.CmdTagMsg, Params: irc.Params{"#channel"}}
+		if _, err := m.MarshalText(); !errors.Is(err, irc.ErrInvalidTag) {
+			t.Errorf("tag %q: expected ErrInvalidTag; got: %v", k, err)
+		}
+	}
+
+	// server-only tags may be written when allowed, and by servers
+	m := &irc.Message{Tags: irc.Tags{"time": "2023-01-01T00:00:00.000Z"}, Command: irc.CmdPrivmsg, Params: irc.Params{"#channel", "hi"}}
+	m.SetServerTags(true)
+	if _, err := m.MarshalText(); err != nil {
+		t.Errorf("expected SetServerTags to allow the time tag; got: %v", err)
+	}
+	m = new(irc.Message)
+	if err := m.UnmarshalText([]byte("@time=2023-01-01T00:00:00.000Z;msgid=abc :nick!user@host PRIVMSG #channel :hi")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.MarshalText(); err != nil {
+		t.Errorf("expected a message with a prefix to keep its server tags; got: %v", err)
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	injection := irc.Msg("#channel", "hello\r\nQUIT :bye\x00")
+	if _, err := injection.MarshalText(); !errors.Is(err, irc.ErrControlChars) {
+		t.Errorf("expected MarshalText to refuse the message; got: %v", err)
+	}
+
+	tests := map[irc.ControlCharPolicy][]string{
+		irc.ControlCharsStrip: {"PRIVMSG #channel :helloQUIT :bye\r\n"},
+		irc.ControlCharsSplit: {"PRIVMSG #channel :hello\r\n", "PRIVMSG #channel :QUIT :bye\r\n"},
+	}
+	for policy, want := range tests {
+		messages, err := irc.Sanitize(injection, policy)
+		if err != nil {
+			t.Fatalf("policy %d: unexpected error: %v", policy, err)
+		}
+		var got []string
+		for _, m := range messages {
+			b, err := m.MarshalText()
+			if err != nil {
+				t.Fatalf("policy %d: sanitized message can't be marshaled: %v", policy, err)
+			}
+			got = append(got, string(b))
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("policy %d: expected %q; got %q", policy, want, got)
+		}
+	}
+
+	if _, err := irc.Sanitize(injection, irc.ControlCharsReject); !errors.Is(err, irc.ErrControlChars) {
+		t.Errorf("expected reject policy to return ErrControlChars; got: %v", err)
+	}
+	if injection.Params.Get(2) != "hello\r\nQUIT :bye\x00" {
+		t.Errorf("expected Sanitize not to modify the message; got %q", injection.Params.Get(2))
+	}
+}
+
+func TestMessage_Trailing(t *testing.T) {
+	tests := []struct {
+		m    *irc.Message
+		want string
+	}{
+		{&irc.Message{Command: irc.CmdNick, Params: irc.Params{"name"}}, "NICK :name\r\n"},
+		{&irc.Message{Command: irc.CmdNick, Params: irc.Params{"name"}, Trailing: irc.TrailingAuto}, "NICK name\r\n"},
+		{&irc.Message{Command: irc.CmdPrivmsg, Params: irc.Params{"#channel", "two words"}, Trailing: irc.TrailingAuto}, "PRIVMSG #channel :two words\r\n"},
+		{&irc.Message{Command: irc.CmdPrivmsg, Params: irc.Params{"#channel", ":)"}, Trailing: irc.TrailingAuto}, "PRIVMSG #channel ::)\r\n"},
+		{&irc.Message{Command: irc.CmdTopic, Params: irc.Params{"#channel", ""}, Trailing: irc.TrailingAuto}, "TOPIC #channel :\r\n"},
+	}
+	for _, tt := range tests {
+		b, err := tt.m.MarshalText()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != tt.want {
+			t.Errorf("expected %q; got %q", tt.want, b)
+		}
+	}
+
+	// parsed lines are marshaled the way they were received
+	for _, line := range []string{"NICK name", "NICK :name", "MODE #channel +o nick"} {
+		m := new(irc.Message)
+		if err := m.UnmarshalText([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+		if b, _ := m.MarshalText(); string(b) != line+"\r\n" {
+			t.Errorf("expected %q to round trip; got %q", line, b)
+		}
+	}
+}
+
+func TestMessage_SetIncludePrefix(t *testing.T) {
+	m := new(irc.Message)
+	if err := m.UnmarshalText([]byte(":nick!user@host PRIVMSG #channel :hi")); err != nil {
+		t.Fatal(err)
+	}
+	if !m.IncludesPrefix() {
+		t.Error("expected parsed messages to include the prefix")
+	}
+	c := *m
+	if b, _ := c.MarshalText(); string(b) != ":nick!user@host PRIVMSG #channel :hi\r\n" {
+		t.Errorf("expected a copy to keep the prefix; got %q", b)
+	}
+	c.SetIncludePrefix(false)
+	if b, _ := c.MarshalText(); string(b) != "PRIVMSG #channel :hi\r\n" {
+		t.Errorf("expected the prefix to be left out; got %q", b)
+	}
+}
+
+func TestParseLines(t *testing.T) {
+	log := ":irc.example.com 001 bot :Welcome\r\n" +
+		"\n" +
+		":alice!a@host PRIVMSG #chan :hi\n" +
+		":\r\n" +
+		"PING :irc.example.com"
+	p := irc.ParseLines(strings.NewReader(log))
+	var got []string
+	for p.Scan() {
+		if p.Err() != nil {
+			got = append(got, fmt.Sprintf("error on line %d", p.Line()))
+			continue
+		}
+		b, _ := p.Message().MarshalText()
+		got = append(got, strings.TrimSuffix(string(b), "\r\n"))
+	}
+	if err := p.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		":irc.example.com 001 bot :Welcome",
+		":alice!a@host PRIVMSG #chan :hi",
+		"error on line 4",
+		"PING :irc.example.com",
+	}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("expected %q; got %q", want, got)
+	}
+
+	m, err := irc.ParseMessage([]byte(":alice!a@host PRIVMSG #chan :hi\r\n"))
+	if err != nil || m.Source.Nick != "alice" || m.Params.Get(2) != "hi" {
+		t.Errorf("ParseMessage: got %#v, %v", m, err)
+	}
+	if _, err := irc.ParseMessage([]byte(":")); err == nil {
+		t.Error("ParseMessage: expected an error for a malformed line")
+	}
+}
+
+func TestLogReader(t *testing.T) {
+	raw := "[2024-03-01 12:00:00] <- :alice!a@host PRIVMSG #chan :hi\n" +
+		"-> PRIVMSG #chan :hello\n" +
+		"@time=2024-03-01T12:00:02.000Z :bob!b@host JOIN #chan\n" +
+		":\n"
+	r := irc.NewLogReader(strings.NewReader(raw))
+	r.Prefixes = []string{"<- ", "-> "}
+	var got []string
+	for {
+		e, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			got = append(got, "error")
+			continue
+		}
+		got = append(got, fmt.Sprintf("%s %s %s", e.Time.Format("15:04:05"), e.Message.Source.Nick, e.Message.Command))
+	}
+	want := "12:00:00 alice PRIVMSG|00:00:00  PRIVMSG|12:00:02 bob JOIN|error"
+	if strings.Join(got, "|") != want {
+		t.Errorf("LogRaw: expected %q; got %q", want, strings.Join(got, "|"))
+	}
+
+	znc := "[12:00:00] *** Joins: alice (a@host)\n" +
+		"[12:00:01] <alice> hi all\n" +
+		"[12:00:02] * alice waves\n" +
+		"[12:00:03] -bob- a notice\n" +
+		"[12:00:04] *** bob sets mode: +o alice\n" +
+		"[12:00:05] *** bob changes topic to 'new topic'\n" +
+		"[12:00:06] *** alice is now known as alice_\n" +
+		"[12:00:07] *** carol was kicked by bob (spam)\n" +
+		"[12:00:08] *** Parts: alice_ (a@host) (bye)\n" +
+		"[12:00:09] *** Quits: bob (b@host) (Quit: leaving)\n" +
+		"[12:00:10] ??? something else\n"
+	r = irc.NewLogReader(strings.NewReader(znc))
+	r.Format = irc.LogZNC
+	r.Channel = "#chan"
+	r.Date = time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	got = nil
+	err := irc.Replay(r, irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+		b, _ := m.MarshalText()
+		got = append(got, strings.TrimSuffix(string(b), "\r\n"))
+	}), irctest.Discard)
+	if err == nil || !strings.Contains(err.Error(), "log line 11") {
+		t.Errorf("expected an error for line 11; got %v", err)
+	}
+	want = strings.Join([]string{
+		"@time=2024-03-01T12:00:00.000Z :alice!a@host JOIN :#chan",
+		"@time=2024-03-01T12:00:01.000Z :alice PRIVMSG #chan :hi all",
+		"@time=2024-03-01T12:00:02.000Z :alice _CTCP_QUERY_ACTION #chan :waves",
+		"@time=2024-03-01T12:00:03.000Z :bob NOTICE #chan :a notice",
+		"@time=2024-03-01T12:00:04.000Z :bob MODE #chan +o :alice",
+		"@time=2024-03-01T12:00:05.000Z :bob TOPIC #chan :new topic",
+		"@time=2024-03-01T12:00:06.000Z :alice NICK :alice_",
+		"@time=2024-03-01T12:00:07.000Z :bob KICK #chan carol :spam",
+		"@time=2024-03-01T12:00:08.000Z :alice_!a@host PART #chan :bye",
+		"@time=2024-03-01T12:00:09.000Z :bob!b@host QUIT :Quit: leaving",
+	}, "\n")
+	if strings.Join(got, "\n") != want {
+		t.Errorf("LogZNC: expected\n%s\ngot\n%s", want, strings.Join(got, "\n"))
+	}
+}
+
+func TestMessage_DisplayText(t *testing.T) {
+	alice := irc.Prefix{Nick: "alice", User: "a", Host: "host"}
+	tests := []struct {
+		m    *irc.Message
+		want string
+	}{
+		{&irc.Message{Source: alice, Command: irc.CmdPrivmsg, Params: irc.Params{"#chan", "hello"}}, "alice: hello"},
+		{&irc.Message{Source: alice, Command: irc.CmdNotice, Params: irc.Params{"#chan", "hello"}}, "alice: hello"},
+		{&irc.Message{Source: alice, Command: irc.CTCPAction, Params: irc.Params{"#chan", "waves"}}, "* alice waves"},
+		{&irc.Message{Source: alice, Command: irc.CmdPrivmsg, Params: irc.Params{"#chan", "\x01ACTION waves\x01"}}, "* alice waves"},
+		{&irc.Message{Source: irc.Prefix{Host: "irc.example.com"}, Command: irc.CmdNotice, Params: irc.Params{"*", "Looking up your hostname"}}, "irc.example.com: Looking up your hostname"},
+		{&irc.Message{Command: irc.CmdPrivmsg, Params: irc.Params{"#chan", "hello"}}, "hello"},
+		{(&irc.Message{Source: alice, Command: irc.CmdPrivmsg, Params: irc.Params{"#chan", "\x02bold\x02 text"}}).Unformat(), "alice: bold text"},
+	}
+	for _, tt := range tests {
+		if got := tt.m.DisplayText(); got != tt.want {
+			t.Errorf("%s %q: expected %q; got %q", tt.m.Command, tt.m.Params, tt.want, got)
+		}
+	}
+
+	m := &irc.Message{Command: irc.CmdPrivmsg, Params: irc.Params{"#chan", "\x0304red\x03"}}
+	if u := m.Unformat(); u.Params.Get(2) != "red" || m.Params.Get(2) != "\x0304red\x03" {
+		t.Errorf("Unformat: expected a stripped copy; got %q from %q", u.Params, m.Params)
+	}
+}
+
+func TestTags_Find(t *testing.T) {
+	tags := irc.Tags{"+draft/reply": "1", "example.com/reply": "2", "msgid": "abc", "+Typing": "active"}
+	if got := tags.GetAny("+reply", "+draft/reply"); got != "1" {
+		t.Errorf("GetAny: expected the draft tag; got %q", got)
+	}
+	if got := tags.GetAny("+reply"); got != "" {
+		t.Errorf("GetAny: expected no value; got %q", got)
+	}
+
+	tests := []struct {
+		tags      irc.Tags
+		name      string
+		key, want string
+		ok        bool
+	}{
+		{tags, "reply", "+draft/reply", "1", true},
+		{tags, "+draft/reply", "+draft/reply", "1", true},
+		{irc.Tags{"+draft/reply": "1", "+reply": "2"}, "reply", "+reply", "2", true},
+		{irc.Tags{"+draft/reply": "1", "+reply": "2", "reply": "3"}, "+draft/reply", "+draft/reply", "1", true},
+		{irc.Tags{"example.com/reply": "2"}, "reply", "example.com/reply", "2", true},
+		{tags, "typing", "+Typing", "active", true},
+		{tags, "msgid", "msgid", "abc", true},
+		{tags, "label", "", "", false},
+	}
+	for _, tt := range tests {
+		key, value, ok := tt.tags.Find(tt.name)
+		if key != tt.key || value != tt.want || ok != tt.ok {
+			t.Errorf("Find(%q) in %v: expected %q, %q, %t; got %q, %q, %t", tt.name, tt.tags, tt.key, tt.want, tt.ok, key, value, ok)
+		}
+	}
+}
+
+func TestParseMessageMode(t *testing.T) {
+	tests := []struct {
+		line  string
+		rules []irc.ParseRule
+	}{
+		{":nick!user@host PRIVMSG #chan :hello  there ", nil},
+		{"@k=v;l PING :x", nil},
+		{":BobNoH@bl@!B.Loblaw!@bob.loblaw.law.blog PRIVMSG #chan :hi", []irc.ParseRule{irc.RulePrefixChars}},
+		{"@k=\\v PING x", []irc.ParseRule{irc.RuleTagEscape}},
+		{"@k=1;k=2 PING x", []irc.ParseRule{irc.RuleTagKey}},
+		{"@;k PING x", []irc.ParseRule{irc.RuleTagKey}},
+		{":irc.example.com  PRIVMSG  #chan :hi", []irc.ParseRule{irc.RuleSpaces}},
+		{"PING x ", []irc.ParseRule{irc.RuleSpaces}},
+		{"PR1VMSG #chan :hi", []irc.ParseRule{irc.RuleCommand}},
+		{"FOO 1 2 3 4 5 6 7 8 9 10 11 12 13 14 15 16", []irc.ParseRule{irc.RuleParamCount}},
+		{"PRIVMSG #chan :a\x00b", []irc.ParseRule{irc.RuleControlChars}},
+	}
+	for _, tt := range tests {
+		m, diag, err := irc.ParseMessageMode([]byte(tt.line), irc.ParseLenient)
+		if err != nil || m == nil {
+			t.Errorf("%q: expected lenient parsing to accept the line; got %v", tt.line, err)
+			continue
+		}
+		if fmt.Sprint(diag.Relaxed) != fmt.Sprint(tt.rules) {
+			t.Errorf("%q: expected broken rules %v; got %v", tt.line, tt.rules, diag.Relaxed)
+		}
+		_, _, err = irc.ParseMessageMode([]byte(tt.line), irc.ParseStrict)
+		if (err != nil) != (len(tt.rules) > 0) {
+			t.Errorf("%q: expected strict parsing to fail only for broken rules; got %v", tt.line, err)
+		}
+	}
+
+	p := irc.ParseLines(strings.NewReader("PING ok\r\nPING x \r\n"))
+	p.Mode = irc.ParseStrict
+	var results []string
+	for p.Scan() {
+		results = append(results, fmt.Sprint(p.Err() == nil, p.Diagnostics().Broke(irc.RuleSpaces)))
+	}
+	if strings.Join(results, ",") != "true false,false true" {
+		t.Errorf("LineParser: unexpected results %q", results)
+	}
+}
+
+func TestMessage_WithSource(t *testing.T) {
+	m := irc.Msg("#chan", "hello")
+	relayed := m.WithSource(irc.Prefix{Nick: "alice", User: "a", Host: "host"})
+	b, err := relayed.MarshalText()
+	if err != nil || string(b) != ":alice!a@host PRIVMSG #chan :hello\r\n" {
+		t.Errorf("expected the message with a prefix; got %q (%v)", b, err)
+	}
+	if m.IncludesPrefix() || m.Source != (irc.Prefix{}) {
+		t.Errorf("expected the original message to be unchanged; got %+v", m)
+	}
+
+	b, err = relayed.WithSource(irc.Prefix{}).MarshalText()
+	if err != nil || string(b) != "PRIVMSG #chan :hello\r\n" {
+		t.Errorf("expected an empty source to remove the prefix; got %q (%v)", b, err)
+	}
+}
@@ -0,0 +1,124 @@
+/*
+Package moderation contains channel moderation actions for bots built with package irc.
+
+The actions take care of the protocol details that are easy to get wrong by hand,
+such as setting a ban before kicking (so the user can't rejoin in between),
+and splitting mode changes into lines the server will accept.
+*/
+package moderation
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Travis-Britz/irc"
+)
+
+// defaultModes is the number of mode changes with a parameter that may be sent in a single MODE command
+// when the server did not advertise the MODES token in RPL_ISUPPORT.
+const defaultModes = 3
+
+// A Moderator performs moderation actions.
+//
+// The zero value is ready to use.
+type Moderator struct {
+
+	// Modes is the maximum number of mode changes with a parameter allowed in one MODE command.
+	// If Modes is less than 1, then the MODES token of RPL_ISUPPORT (005) is read from the connection of
+	// the MessageWriter (see irc.ConnInfoOf), and the RFC 1459 default of 3 is used when the server
+	// didn't advertise it.
+	Modes int
+
+	// AfterFunc schedules f to be called after duration d.
+	// It is used for actions which undo themselves, such as timed bans.
+	// If nil, time.AfterFunc is used.
+	AfterFunc func(d time.Duration, f func())
+}
+
+var defaultModerator = &Moderator{}
+
+// KickBan bans target from channel with a mask of type style, then kicks them with reason.
+// The ban is always written first so that the user cannot rejoin before the ban is set.
+//
+// KickBan uses the default Moderator.
+func KickBan(w irc.MessageWriter, channel string, target irc.Prefix, reason string, style irc.MaskType) {
+	defaultModerator.KickBan(w, channel, target, reason, style)
+}
+
+// KickBan bans target from channel with a mask of type style, then kicks them with reason.
+func (mod *Moderator) KickBan(w irc.MessageWriter, channel string, target irc.Prefix, reason string, style irc.MaskType) {
+	mod.Ban(w, channel, irc.Mask(target, style))
+	w.WriteMessage(irc.KickWithReason(channel, target.Nick.String(), reason))
+}
+
+// TimedKickBan is like KickBan, but the ban is removed again after d.
+//
+// w must still be usable when the ban expires. If the client has disconnected by then,
+// the unban is lost along with the rest of the connection.
+func (mod *Moderator) TimedKickBan(w irc.MessageWriter, channel string, target irc.Prefix, reason string, style irc.MaskType, d time.Duration) {
+	mask := irc.Mask(target, style)
+	mod.KickBan(w, channel, target, reason, style)
+	mod.afterFunc(d, func() {
+		mod.Unban(w, channel, mask)
+	})
+}
+
+// Ban sets a ban on channel for each of masks.
+// Masks are grouped into as few MODE commands as the server allows.
+func (mod *Moderator) Ban(w irc.MessageWriter, channel string, masks ...string) {
+	mod.writeModes(w, channel, "+b", masks)
+}
+
+// Unban removes the ban on channel for each of masks.
+// Masks are grouped into as few MODE commands as the server allows.
+func (mod *Moderator) Unban(w irc.MessageWriter, channel string, masks ...string) {
+	mod.writeModes(w, channel, "-b", masks)
+}
+
+// writeModes writes one MODE command per group of params, setting mode (e.g. "+b") once for each param.
+func (mod *Moderator) writeModes(w irc.MessageWriter, channel string, mode string, params []string) {
+	limit := mod.modes(w, len(params))
+	sign, char := mode[:1], mode[1:]
+	for len(params) > 0 {
+		n := limit
+		if n > len(params) {
+			n = len(params)
+		}
+		args := append([]string{channel, sign + strings.Repeat(char, n)}, params[:n]...)
+		w.WriteMessage(irc.NewMessage(irc.CmdMode, args...))
+		params = params[n:]
+	}
+}
+
+// modes returns the number of mode changes with a parameter which may be sent in one MODE command on the connection of w,
+// or n when the server has no limit.
+func (mod *Moderator) modes(w irc.MessageWriter, n int) int {
+	if mod.Modes > 0 {
+		return mod.Modes
+	}
+	info, ok := irc.ConnInfoOf(w)
+	if !ok {
+		return defaultModes
+	}
+	v, ok := info.ISupport("MODES")
+	if !ok {
+		return defaultModes
+	}
+	// "MODES" without a value means there's no limit
+	if v == "" {
+		return n
+	}
+	if limit, err := strconv.Atoi(v); err == nil && limit > 0 {
+		return limit
+	}
+	return defaultModes
+}
+
+func (mod *Moderator) afterFunc(d time.Duration, f func()) {
+	if mod.AfterFunc != nil {
+		mod.AfterFunc(d, f)
+		return
+	}
+	time.AfterFunc(d, f)
+}
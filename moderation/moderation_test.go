@@ -0,0 +1,119 @@
+package moderation_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Travis-Britz/irc"
+	"github.com/Travis-Britz/irc/irctest"
+	"github.com/Travis-Britz/irc/moderation"
+)
+
+func TestKickBan(t *testing.T) {
+	w := &irctest.RecordingWriter{}
+	target := irc.Prefix{Nick: "spammer", User: "~spam", Host: "host.example.com"}
+	moderation.KickBan(w, "#chan", target, "spam", irc.MaskHost)
+
+	expected := []string{
+		"MODE #chan +b :*!*@host.example.com",
+		"KICK #chan spammer :spam",
+	}
+	if got := w.Lines(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected the ban before the kick %q; got %q", expected, got)
+	}
+}
+
+func TestModerator_TimedKickBan(t *testing.T) {
+	var (
+		after time.Duration
+		unban func()
+	)
+	mod := &moderation.Moderator{AfterFunc: func(d time.Duration, f func()) { after, unban = d, f }}
+	w := &irctest.RecordingWriter{}
+	target := irc.Prefix{Nick: "flooder", User: "~flood", Host: "1.2.3.4"}
+	mod.TimedKickBan(w, "#chan", target, "flood", irc.MaskDomain, 10*time.Minute)
+
+	if after != 10*time.Minute || unban == nil {
+		t.Fatalf("expected the unban to be scheduled after 10m; got %v", after)
+	}
+	w.Reset()
+	unban()
+	if got := w.Lines(); len(got) != 1 || got[0] != "MODE #chan -b :*!*@1.2.3.*" {
+		t.Errorf("expected the ban to be removed; got %q", got)
+	}
+}
+
+func TestModerator_Ban(t *testing.T) {
+	masks := []string{"a!*@*", "b!*@*", "c!*@*", "d!*@*", "e!*@*"}
+	tt := []struct {
+		name     string
+		modes    int
+		expected []string
+	}{
+		{"default", 0, []string{"MODE #chan +bbb a!*@* b!*@* :c!*@*", "MODE #chan +bb d!*@* :e!*@*"}},
+		{"configured", 4, []string{"MODE #chan +bbbb a!*@* b!*@* c!*@* :d!*@*", "MODE #chan +b :e!*@*"}},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			w := &irctest.RecordingWriter{}
+			(&moderation.Moderator{Modes: tc.modes}).Ban(w, "#chan", masks...)
+			if got := w.Lines(); !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("expected %q; got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+// TestModerator_isupport checks that the MODES token of the server is used when Modes isn't set.
+func TestModerator_isupport(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	clientConn, serverConn := irc.Pipe()
+	modes := make(chan string, 4)
+	go func() {
+		defer serverConn.Close()
+		scanner := bufio.NewScanner(serverConn)
+		for scanner.Scan() {
+			m := new(irc.Message)
+			if err := m.UnmarshalText(scanner.Bytes()); err != nil {
+				continue
+			}
+			switch m.Command {
+			case irc.CmdUser:
+				fmt.Fprintf(serverConn, ":irc.example.com 001 bot :Welcome bot!bot@example.com\r\n")
+				fmt.Fprintf(serverConn, ":irc.example.com 005 bot MODES=2 :are supported by this server\r\n")
+				fmt.Fprintf(serverConn, ":op!o@host PRIVMSG #chan :!ban\r\n")
+			case irc.CmdMode:
+				modes <- scanner.Text()
+			case irc.CmdQuit:
+				return
+			}
+		}
+	}()
+
+	client := &irc.Client{Nickname: "bot"}
+	client.DialFn = func() (io.ReadWriteCloser, error) { return clientConn, nil }
+	r := &irc.Router{}
+	r.OnText("!ban", func(w irc.MessageWriter, m *irc.Message) {
+		(&moderation.Moderator{}).Ban(w, "#chan", "a!*@*", "b!*@*", "c!*@*")
+	})
+	go func() { _ = client.ConnectAndRun(ctx, r) }()
+
+	expected := []string{"MODE #chan +bb a!*@* :b!*@*", "MODE #chan +b :c!*@*"}
+	for _, want := range expected {
+		select {
+		case got := <-modes:
+			if got != want {
+				t.Errorf("expected %q; got %q", want, got)
+			}
+		case <-ctx.Done():
+			t.Fatalf("expected %q; got nothing", want)
+		}
+	}
+}
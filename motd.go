@@ -0,0 +1,37 @@
+package irc
+
+import "strings"
+
+// MOTD returns the message of the day sent by the server while connecting, or in reply to the MOTD command,
+// with its lines separated by "\n". It's empty until the whole MOTD was received, and when the server has none.
+func (c *Client) MOTD() string {
+	c.state.mu.RLock()
+	defer c.state.mu.RUnlock()
+	return c.state.motd
+}
+
+// OnMOTD attaches a handler which is called with the complete message of the day,
+// once the server sent all of it (RPL_ENDOFMOTD), or said there is none (ERR_NOMOTD).
+// The lines are separated by "\n", without the "- " which servers put in front of each line.
+// The MOTD is read from the client bound to the router (see BindClient).
+func (r *Router) OnMOTD(h func(w MessageWriter, motd string)) *route {
+	adapter := func(w MessageWriter, m *Message) {
+		var motd string
+		if c, ok := r.client.(interface{ MOTD() string }); ok {
+			motd = c.MOTD()
+		}
+		h(w, motd)
+	}
+	rt := r.handleCommands(HandlerFunc(adapter), RplEndOfMOTD, RplErrNoMOTD)
+	rt.handler = funcName(h)
+	return rt
+}
+
+// motdLine returns the text of an RPL_MOTD line, without the "- " in front of it.
+func motdLine(text string) string {
+	if text == "-" {
+		return ""
+	}
+	text, _ = strings.CutPrefix(text, "- ")
+	return text
+}
@@ -0,0 +1,91 @@
+package irc
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// A MultiWriter is a MessageWriter which writes each message to all of its writers,
+// e.g. to the clients of several networks of a bridge, or to a client and a log.
+//
+// Writers are isolated from each other: a writer which fails or panics doesn't keep the message from the ones after it.
+// The errors of writers with a WriteMessageE method, such as Client, are returned by MultiWriter.WriteMessageE.
+//
+// Writers may be added and removed while the MultiWriter is in use.
+type MultiWriter struct {
+
+	// OnError is called with each writer which failed to write a message and its error (optional).
+	// It's called by WriteMessage, which has no other way to report the errors.
+	OnError func(w MessageWriter, err error)
+
+	mu      sync.RWMutex
+	writers []MessageWriter
+}
+
+// NewMultiWriter returns a MultiWriter which writes to writers.
+func NewMultiWriter(writers ...MessageWriter) *MultiWriter {
+	return &MultiWriter{writers: append([]MessageWriter(nil), writers...)}
+}
+
+// Add adds w to the writers of mw.
+func (mw *MultiWriter) Add(w MessageWriter) {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	mw.writers = append(mw.writers, w)
+}
+
+// Remove removes w, which is compared with ==, from the writers of mw. It reports whether w was one of them.
+func (mw *MultiWriter) Remove(w MessageWriter) bool {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	for i, ww := range mw.writers {
+		if ww == w {
+			// a new slice, since WriteMessageE may still be ranging over the old one
+			mw.writers = append(append([]MessageWriter(nil), mw.writers[:i]...), mw.writers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// WriteMessage implements MessageWriter. The errors of the writers are passed to OnError.
+func (mw *MultiWriter) WriteMessage(m encoding.TextMarshaler) {
+	_ = mw.WriteMessageE(m)
+}
+
+// WriteMessageE writes m to every writer, in the order they were added,
+// and returns the errors of the ones which failed joined together, or nil.
+func (mw *MultiWriter) WriteMessageE(m encoding.TextMarshaler) error {
+	mw.mu.RLock()
+	writers := mw.writers
+	mw.mu.RUnlock()
+
+	var errs []error
+	for _, w := range writers {
+		if err := writeIsolated(w, m); err != nil {
+			if mw.OnError != nil {
+				mw.OnError(w, err)
+			}
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// writeIsolated writes m to w, and returns the error of w's WriteMessageE method, if it has one, or of a panic.
+func writeIsolated(w MessageWriter, m encoding.TextMarshaler) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("MultiWriter: panic in %T: %v", w, p)
+		}
+	}()
+	if ew, ok := w.(interface {
+		WriteMessageE(encoding.TextMarshaler) error
+	}); ok {
+		return ew.WriteMessageE(m)
+	}
+	w.WriteMessage(m)
+	return nil
+}
@@ -0,0 +1,128 @@
+package irc
+
+import (
+	"strings"
+	"sync"
+)
+
+// Names is the reply to a NAMES query, or the names sent when the client joins a channel:
+// the members of a channel listed by RPL_NAMREPLY (353), which may be split over many messages,
+// until RPL_ENDOFNAMES (366).
+type Names struct {
+	Channel string
+
+	// Status is the symbol of the channel's visibility: "=" for public, "*" for private, and "@" for secret channels.
+	Status string
+
+	// Members are in the order the server listed them. Only Nick and Prefixes are set, and User and Host
+	// with the userhost-in-names capability.
+	Members []Member
+}
+
+// ParseNames returns the channel and the members listed in a single RPL_NAMREPLY message.
+//
+// The membership prefixes in front of each nickname are split off into Member.Prefixes; with the multi-prefix
+// capability there may be several, e.g. "@+". symbols are the prefix symbols of the server from the PREFIX token of
+// RPL_ISUPPORT, e.g. "~&@%+"; if empty, "@+" is used. With userhost-in-names, the names are full addresses,
+// e.g. "nick!user@host", and the user and host are split off too.
+func ParseNames(m *Message, symbols string) (channel string, members []Member, err error) {
+	// "<client> <symbol> <channel> :[prefix]<nick>{ [prefix]<nick>}"
+	if err := expect(m, RplNamReply, 4); err != nil {
+		return "", nil, err
+	}
+	if symbols == "" {
+		symbols = "@+"
+	}
+	return m.Params.Get(3), parseNames(m.Params.Get(4), symbols), nil
+}
+
+// parseNames parses the names of an RPL_NAMREPLY message.
+func parseNames(names, symbols string) []Member {
+	var members []Member
+	for _, name := range strings.Fields(names) {
+		var member Member
+		member.Prefixes, name = splitPrefixes(name, symbols)
+		member.Nick = Nickname(name)
+		// userhost-in-names: "nick!user@host"
+		if parts := fullAddress.FindStringSubmatch(name); parts != nil {
+			member.Nick, member.User, member.Host = Nickname(parts[1]), parts[2], parts[3]
+		}
+		members = append(members, member)
+	}
+	return members
+}
+
+// A NamesCollector collects the RPL_NAMREPLY messages of NAMES replies into Names.
+// Replies for several channels may be collected at once.
+//
+// The zero value is ready to use. A NamesCollector is safe for concurrent use.
+type NamesCollector struct {
+
+	// Symbols are the membership prefix symbols of the server; see ParseNames.
+	Symbols string
+
+	// CaseMapping is the CASEMAPPING token of the server, which the channel names of replies are compared with
+	// ("ascii", "rfc1459", or "rfc1459-strict"; rfc1459 if empty or unknown).
+	CaseMapping string
+
+	mu      sync.Mutex
+	pending map[string]*Names // keyed by channel name, folded with CaseMapping
+}
+
+// Add adds m to the reply of its channel. When m is the RPL_ENDOFNAMES which ends the reply,
+// Add returns the complete Names and true. Messages other than RPL_NAMREPLY and RPL_ENDOFNAMES are ignored.
+//
+// A reply without any RPL_NAMREPLY, as for a channel the client can't see, has no members.
+func (nc *NamesCollector) Add(m *Message) (*Names, bool) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	switch m.Command {
+	case RplNamReply:
+		channel, members, err := ParseNames(m, nc.Symbols)
+		if err != nil {
+			return nil, false
+		}
+		key := foldNick(channel, nc.CaseMapping)
+		names := nc.pending[key]
+		if names == nil {
+			if nc.pending == nil {
+				nc.pending = make(map[string]*Names)
+			}
+			names = &Names{Channel: channel, Status: m.Params.Get(2)}
+			nc.pending[key] = names
+		}
+		names.Members = append(names.Members, members...)
+	// "<client> <channel> :End of /NAMES list"
+	case RplEndOfNames:
+		channel := m.Params.Get(2)
+		key := foldNick(channel, nc.CaseMapping)
+		names := nc.pending[key]
+		delete(nc.pending, key)
+		if names == nil {
+			names = &Names{Channel: channel}
+		}
+		return names, true
+	}
+	return nil, false
+}
+
+// OnNames attaches a handler for complete NAMES replies, which is called with the members of the channel
+// once RPL_ENDOFNAMES arrives. This includes the names the server sends when the client joins a channel.
+//
+// The membership prefixes are split off with the PREFIX token of the bound client's server (see BindClient),
+// or "@+" when the router has no client bound.
+func (r *Router) OnNames(h func(MessageWriter, *Names)) *route {
+	nc := &NamesCollector{}
+	adapter := func(w MessageWriter, m *Message) {
+		nc.mu.Lock()
+		nc.Symbols = r.serverModes().prefixSymbols
+		nc.CaseMapping = r.caseMapping()
+		nc.mu.Unlock()
+		if names, ok := nc.Add(m); ok {
+			h(w, names)
+		}
+	}
+	rt := r.handleCommands(HandlerFunc(adapter), RplEndOfNames, RplNamReply)
+	rt.handler = funcName(h)
+	return rt
+}
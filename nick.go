@@ -0,0 +1,121 @@
+package irc
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// nickKeeper notices when our nickname is changed without us asking for it,
+// e.g. by services enforcing a registered nickname or by a server's SVSNICK,
+// and optionally keeps trying to take the old nickname back.
+type nickKeeper struct {
+	ctx    context.Context
+	client *Client
+
+	mu sync.Mutex
+
+	// registered is set once the server welcomed us; nickname changes before that are part of registration.
+	registered bool
+
+	// requested is the nickname we last asked for with NICK, until the server answers.
+	requested string
+
+	// alts counts the alternative nicknames tried during registration.
+	alts int
+
+	// reclaim is the nickname being taken back, if any.
+	reclaim string
+	timer   *time.Timer
+}
+
+func newNickKeeper(ctx context.Context, c *Client) *nickKeeper {
+	return &nickKeeper{ctx: ctx, client: c}
+}
+
+// sent records a NICK command written by the client.
+func (k *nickKeeper) sent(nick string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.requested = nick
+}
+
+func (k *nickKeeper) middleware(next Handler) Handler {
+	return HandlerFunc(func(w MessageWriter, m *Message) {
+		switch m.Command {
+		case RplWelcome:
+			k.mu.Lock()
+			k.registered = true
+			k.mu.Unlock()
+		case RplErrNicknameInUse, RplErrNickCollision, RplErrUnavailResource:
+			// our NICK was refused; a reclaim keeps trying on its own schedule
+			k.mu.Lock()
+			k.requested = ""
+			var alt string
+			if !k.registered && k.alts < len(k.client.AltNicks) {
+				// registration can't finish without a nickname
+				alt = k.client.AltNicks[k.alts]
+				k.alts++
+			}
+			k.mu.Unlock()
+			next.SpeakIRC(w, m)
+			if alt != "" {
+				w.WriteMessage(Nick(alt))
+			}
+			return
+		case CmdNick:
+			old := k.client.Nick()
+			// some servers announce a forced change with themselves as the source
+			if !m.Source.Nick.Is(old.String()) && !m.Source.IsServer() {
+				break
+			}
+			next.SpeakIRC(w, m)
+			k.changed(old, Nickname(m.Params.Get(1)))
+			return
+		}
+		next.SpeakIRC(w, m)
+	})
+}
+
+// changed is called after our nickname changed from old to nick.
+func (k *nickKeeper) changed(old, nick Nickname) {
+	k.mu.Lock()
+	forced := k.registered && !nick.Is(k.requested)
+	k.requested = ""
+	if k.reclaim != "" && nick.Is(k.reclaim) {
+		k.stop()
+	}
+	startReclaim := forced && k.reclaim == "" && k.client.ReclaimNick > 0
+	if startReclaim {
+		k.reclaim = old.String()
+		k.timer = time.AfterFunc(k.client.ReclaimNick, k.attempt)
+	}
+	k.mu.Unlock()
+
+	if forced && k.client.OnForcedNickChange != nil {
+		k.client.OnForcedNickChange(old, nick)
+	}
+}
+
+// attempt asks for the reclaimed nickname, and schedules the next attempt.
+func (k *nickKeeper) attempt() {
+	k.mu.Lock()
+	nick := k.reclaim
+	if nick == "" || k.ctx.Err() != nil {
+		k.mu.Unlock()
+		return
+	}
+	k.timer = time.AfterFunc(k.client.ReclaimNick, k.attempt)
+	k.mu.Unlock()
+
+	k.client.WriteMessage(Nick(nick))
+}
+
+// stop cancels a reclaim in progress. k.mu must be held.
+func (k *nickKeeper) stop() {
+	k.reclaim = ""
+	if k.timer != nil {
+		k.timer.Stop()
+		k.timer = nil
+	}
+}
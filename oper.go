@@ -0,0 +1,59 @@
+package irc
+
+import (
+	"context"
+	"fmt"
+)
+
+// Oper obtains IRC operator privileges, waiting for the server's RPL_YOUREOPER.
+//
+// Oper and the other operator commands of Client wait for replies which are read by the client's handlers,
+// so they must be called from another goroutine, not from a handler.
+func (c *Client) Oper(ctx context.Context, name, password string) error {
+	return c.request(ctx, Oper(name, password), false, commandReply(CmdOper, RplYoureOper))
+}
+
+// Rehash makes the server reload its configuration, waiting for the server's RPL_REHASHING.
+func (c *Client) Rehash(ctx context.Context) error {
+	return c.request(ctx, Rehash(), false, commandReply(CmdRehash, RplRehashing))
+}
+
+// Restart restarts the server.
+// It returns nil once the server closed the connection, or an error if the server refused.
+func (c *Client) Restart(ctx context.Context) error {
+	return c.shutdownServer(ctx, Restart())
+}
+
+// Die shuts down the server.
+// It returns nil once the server closed the connection, or an error if the server refused.
+func (c *Client) Die(ctx context.Context) error {
+	return c.shutdownServer(ctx, Die())
+}
+
+func (c *Client) shutdownServer(ctx context.Context, m *Message) error {
+	err := c.request(ctx, m, true, commandReply(m.Command, ""))
+	if err == errClosed {
+		return nil
+	}
+	if err == nil {
+		// the server answered the barrier PING, so the command was ignored
+		return fmt.Errorf("%s: the server did not shut down", m.Command)
+	}
+	return err
+}
+
+// ConnectServer links the server target to the network.
+// See the ConnectServer constructor for the parameters.
+//
+// There is no reply when the server accepts the command, so ConnectServer returns nil
+// once the server has processed it without an error.
+// The progress of the link is reported in server notices.
+func (c *Client) ConnectServer(ctx context.Context, target string, port int, remote string) error {
+	return c.request(ctx, ConnectServer(target, port, remote), true, commandReply(CmdConnect, ""))
+}
+
+// SQuit disconnects server from the network.
+// Like ConnectServer, it returns nil once the server has processed the command without an error.
+func (c *Client) SQuit(ctx context.Context, server, comment string) error {
+	return c.request(ctx, SQuit(server, comment), true, commandReply(CmdSQuit, ""))
+}
@@ -0,0 +1,86 @@
+package irc
+
+import (
+	"crypto/tls"
+	"log"
+)
+
+// An Option configures a Client created by NewClient.
+type Option func(*Client)
+
+// NewClient returns a new Client with opts applied in order.
+// It's equivalent to setting the fields of a Client directly,
+// so the fields without an Option, or options which need to be changed later, can still be set on the returned Client.
+//
+//	client := irc.NewClient(
+//		irc.WithAddr("irc.example.com:6697"),
+//		irc.WithNick("HelloBot"),
+//		irc.WithSASL(irc.SASLPlain("HelloBot", password)),
+//		irc.WithCaps("message-tags", "server-time"),
+//		irc.WithReconnect(irc.Backoff{}),
+//	)
+//	err := client.Run(ctx, router)
+func NewClient(opts ...Option) *Client {
+	c := &Client{}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// WithAddr sets the address ("host:port") of the IRC server. See Client.Addr.
+func WithAddr(addr string) Option {
+	return func(c *Client) {
+		c.Addr = addr
+	}
+}
+
+// WithNick sets the nickname of the client. See Client.Nickname.
+func WithNick(nick string) Option {
+	return func(c *Client) {
+		c.Nickname = nick
+	}
+}
+
+// WithTLSConfig sets the TLS configuration used when dialing Addr. See Client.TLSConfig.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(c *Client) {
+		c.TLSConfig = config
+	}
+}
+
+// WithSASL sets the mechanism used to authenticate while connecting. See Client.SASL.
+func WithSASL(mech SASLMechanism) Option {
+	return func(c *Client) {
+		c.SASL = mech
+	}
+}
+
+// WithReconnect makes Client.Run reconnect with the delays of b. See Client.Reconnect.
+func WithReconnect(b Backoff) Option {
+	return func(c *Client) {
+		c.Reconnect = &b
+	}
+}
+
+// WithRateLimit sets the flood control which paces the messages written by the client,
+// e.g. a PenaltyFlood. See Client.FloodControl.
+func WithRateLimit(f FloodControl) Option {
+	return func(c *Client) {
+		c.FloodControl = f
+	}
+}
+
+// WithLogger sets the logger for errors. See Client.ErrorLog.
+func WithLogger(l *log.Logger) Option {
+	return func(c *Client) {
+		c.ErrorLog = l
+	}
+}
+
+// WithCaps adds IRCv3 capabilities to request. See Client.Caps.
+func WithCaps(caps ...string) Option {
+	return func(c *Client) {
+		c.Caps = append(c.Caps, caps...)
+	}
+}
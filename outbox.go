@@ -0,0 +1,197 @@
+package irc
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultJoinTimeout is how long messages to a channel wait for a JOIN to be confirmed when Client.JoinTimeout is 0.
+const DefaultJoinTimeout = 30 * time.Second
+
+// joinOutbox holds the messages written to channels which the client asked to join,
+// until the server confirms the JOIN.
+// Without it, a bot which sends Join("#foo") followed by Msg("#foo", ...) races the join,
+// and the server may reject the message with ERR_NOTONCHANNEL or ERR_CANNOTSENDTOCHAN.
+type joinOutbox struct {
+	ctx    context.Context
+	client *Client
+
+	// onChannel reports whether the client is already on a channel, which makes a JOIN a no-op.
+	onChannel func(channel string) bool
+
+	mu sync.Mutex
+
+	// pending is keyed by the channel name, folded by Client.fold.
+	pending map[string]*pendingJoin
+}
+
+// pendingJoin is a channel which the client is joining, and the messages waiting for it.
+type pendingJoin struct {
+	channel string
+	held    []*Message
+	timer   *time.Timer
+
+	// flushing is set once the JOIN is confirmed, while the held messages are being written.
+	flushing bool
+}
+
+func newJoinOutbox(ctx context.Context, c *Client) *joinOutbox {
+	return &joinOutbox{ctx: ctx, client: c, pending: make(map[string]*pendingJoin)}
+}
+
+func (o *joinOutbox) timeout() time.Duration {
+	if o.client.JoinTimeout == 0 {
+		return DefaultJoinTimeout
+	}
+	return o.client.JoinTimeout
+}
+
+// sent records the channels of a JOIN command written by the client.
+func (o *joinOutbox) sent(m *Message) {
+	if !m.Command.is(CmdJoin) || o.timeout() < 0 {
+		return
+	}
+	channels := m.Params.Get(1)
+	// "JOIN 0" parts every channel
+	if channels == "0" {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, channel := range strings.Split(channels, ",") {
+		key := o.client.fold(channel)
+		if channel == "" || o.pending[key] != nil {
+			continue
+		}
+		// the server doesn't answer a JOIN for a channel we're on, so nothing would release the messages
+		if o.onChannel != nil && o.onChannel(channel) {
+			continue
+		}
+		p := &pendingJoin{channel: channel}
+		p.timer = time.AfterFunc(o.timeout(), func() {
+			o.drop(key, p, fmt.Sprintf("JOIN was not confirmed within %s", o.timeout()))
+		})
+		o.pending[key] = p
+	}
+}
+
+// hold reports whether m was held until the client has joined its target channel.
+func (o *joinOutbox) hold(m *Message) bool {
+	if !m.Command.is(CmdPrivmsg) && !m.Command.is(CmdNotice) && !m.Command.is(CmdTagMsg) {
+		return false
+	}
+	channel := channelOf(m.Params.Get(1))
+	if channel == "" {
+		return false
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	p := o.pending[o.client.fold(channel)]
+	if p == nil {
+		return false
+	}
+	p.held = append(p.held, m)
+	return true
+}
+
+func (o *joinOutbox) middleware(next Handler) Handler {
+	return HandlerFunc(func(w MessageWriter, m *Message) {
+		cmd := m.Command
+		cmd.normalize()
+		switch cmd {
+		case CmdJoin:
+			if m.Source.Nick.Is(o.client.Nick().String()) {
+				o.joined(m.Params.Get(1))
+			}
+		case RplErrNoSuchChannel, RplErrTooManyChannels, RplErrUnavailResource, RplErrChannelIsFull,
+			RplErrInviteOnlyChan, RplErrBannedFromChan, RplErrBadChannelKey, RplErrBadChanMask, RplErrNoChanModes:
+			key := o.client.fold(m.Params.Get(2))
+			o.mu.Lock()
+			p := o.pending[key]
+			o.mu.Unlock()
+			if p != nil {
+				o.drop(key, p, fmt.Sprintf("JOIN failed: %s", m.Params.Get(3)))
+			}
+		}
+		next.SpeakIRC(w, m)
+	})
+}
+
+// joined sends the messages held for channel.
+// They're written before the handlers see the JOIN, so that they're sent in the order they were written.
+// The channel stays pending until nothing is left to send,
+// so a message written to it meanwhile is held behind the older ones instead of jumping ahead of them.
+func (o *joinOutbox) joined(channel string) {
+	key := o.client.fold(channel)
+	o.mu.Lock()
+	p := o.pending[key]
+	if p == nil || p.flushing {
+		o.mu.Unlock()
+		return
+	}
+	p.flushing = true
+	o.mu.Unlock()
+	p.timer.Stop()
+	for {
+		o.mu.Lock()
+		held := p.held
+		p.held = nil
+		if len(held) == 0 || o.pending[key] != p {
+			if o.pending[key] == p {
+				delete(o.pending, key)
+			}
+			o.mu.Unlock()
+			return
+		}
+		o.mu.Unlock()
+		for _, m := range held {
+			o.client.logWriteError(o.client.writeNow(m))
+		}
+	}
+}
+
+// discard drops the messages held for every channel when the connection shuts down,
+// since the server would reject them while the client isn't on the channel, and reports them to ErrorLog.
+func (o *joinOutbox) discard() {
+	o.mu.Lock()
+	pending := o.pending
+	o.pending = make(map[string]*pendingJoin)
+	dropped := make(map[*pendingJoin]int, len(pending))
+	for _, p := range pending {
+		dropped[p] = len(p.held)
+	}
+	o.mu.Unlock()
+	for p, n := range dropped {
+		p.timer.Stop()
+		if n > 0 {
+			o.client.log(fmt.Errorf("dropped %d messages to %s: the connection shut down before the JOIN was confirmed", n, p.channel))
+		}
+	}
+}
+
+// drop discards the messages held for p, unless p is no longer pending or its JOIN was confirmed.
+func (o *joinOutbox) drop(key string, p *pendingJoin, reason string) {
+	o.mu.Lock()
+	if o.pending[key] != p || p.flushing {
+		o.mu.Unlock()
+		return
+	}
+	delete(o.pending, key)
+	n := len(p.held)
+	o.mu.Unlock()
+	p.timer.Stop()
+	if n > 0 && o.ctx.Err() == nil {
+		o.client.log(fmt.Errorf("dropped %d messages to %s: %s", n, p.channel, reason))
+	}
+}
+
+// holdForJoin reports whether m was held by the connection's outbox.
+func (c *Client) holdForJoin(m *Message) bool {
+	c.connMu.Lock()
+	outbox := c.outbox
+	c.connMu.Unlock()
+	return outbox != nil && outbox.hold(m)
+}
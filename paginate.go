@@ -0,0 +1,147 @@
+package irc
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultPageSize is the number of lines per page when PageOptions.Size is 0.
+const DefaultPageSize = 5
+
+// DefaultPageExpiry is how long a Pager keeps the rest of a reply when Pager.Expiry is 0.
+const DefaultPageExpiry = 10 * time.Minute
+
+// PageOptions controls how Paginate writes a page.
+type PageOptions struct {
+
+	// Size is the number of lines per page. If 0, DefaultPageSize is used.
+	Size int
+
+	// Notice sends the lines as NOTICEs instead of PRIVMSGs.
+	Notice bool
+
+	// More is the command which users send for the next page, e.g. "!more".
+	// When it's set, each page but the last ends with a line such as "… (12 more, reply !more)".
+	More string
+}
+
+func (o PageOptions) size() int {
+	if o.Size <= 0 {
+		return DefaultPageSize
+	}
+	return o.Size
+}
+
+// Paginate writes the first page of lines to target, and returns the lines left for the next pages.
+// Lines are written one message at a time, so the client's FloodControl paces them
+// and a long result never floods the client off the server; a page only needs to be small enough that users aren't kept waiting.
+//
+// Paginate keeps no state; use a Pager to let users ask for the next page.
+func Paginate(w MessageWriter, target string, lines []string, opts PageOptions) (rest []string) {
+	size := opts.size()
+	if len(lines) > size {
+		lines, rest = lines[:size], lines[size:]
+	}
+	send := Msg
+	if opts.Notice {
+		send = Notice
+	}
+	for _, line := range lines {
+		w.WriteMessage(send(target, line))
+	}
+	if len(rest) > 0 && opts.More != "" {
+		w.WriteMessage(send(target, fmt.Sprintf("%s (%d more, reply %s)", Ellipsis, len(rest), opts.More)))
+	}
+	return rest
+}
+
+// A Pager sends long replies a page at a time, and keeps the rest of each user's last reply
+// until they ask for the next page with the More command.
+//
+//	pager := &irc.Pager{PageOptions: irc.PageOptions{More: "!more"}}
+//	pager.Register(r)
+//	r.OnCommand("!list", func(w irc.MessageWriter, m *irc.Message) {
+//		pager.Reply(w, m, items)
+//	})
+type Pager struct {
+	PageOptions
+
+	// Expiry is how long the rest of a reply is kept. If 0, DefaultPageExpiry is used.
+	Expiry time.Duration
+
+	mu      sync.Mutex
+	pending map[string]pendingPages // keyed by nickname, folded with the server's CASEMAPPING
+}
+
+// pendingPages are the lines left of a reply.
+type pendingPages struct {
+	target  string
+	lines   []string
+	expires time.Time
+}
+
+// Reply sends the first page of lines in reply to m: to the channel m was sent to, or to the sender of a query.
+// The rest is kept for the sender of m, replacing the rest of their previous reply.
+func (p *Pager) Reply(w MessageWriter, m *Message, lines []string) {
+	target := m.Params.Get(1)
+	info, _ := ConnInfoOf(w)
+	// a message to the members of a channel with a status, such as "@#chan", is answered there too
+	statusmsg, _ := info.ISupport("STATUSMSG")
+	if !info.IsChannel(strings.TrimLeft(target, statusmsg)) {
+		target = m.Source.Nick.String()
+	}
+	p.send(w, m.Source.Nick, target, lines)
+}
+
+// Next sends the next page of the last reply to the sender of m, if there is one.
+// It's the handler of the More command; see Register.
+func (p *Pager) Next(w MessageWriter, m *Message) {
+	info, _ := ConnInfoOf(w)
+	key := info.fold(m.Source.Nick.String())
+	p.mu.Lock()
+	pages, ok := p.pending[key]
+	delete(p.pending, key)
+	p.mu.Unlock()
+	if !ok || time.Now().After(pages.expires) {
+		return
+	}
+	p.send(w, m.Source.Nick, pages.target, pages.lines)
+}
+
+// Register adds a route to r for the More command, which is "!more" if More is empty.
+func (p *Pager) Register(r *Router) *route {
+	if p.More == "" {
+		p.More = "!more"
+	}
+	return r.OnCommand(p.More, p.Next)
+}
+
+// send writes a page to target and keeps the rest for nick.
+func (p *Pager) send(w MessageWriter, nick Nickname, target string, lines []string) {
+	rest := Paginate(w, target, lines, p.PageOptions)
+	info, _ := ConnInfoOf(w)
+	key := info.fold(nick.String())
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for k, pages := range p.pending {
+		if now.After(pages.expires) {
+			delete(p.pending, k)
+		}
+	}
+	if len(rest) == 0 {
+		delete(p.pending, key)
+		return
+	}
+	if p.pending == nil {
+		p.pending = make(map[string]pendingPages)
+	}
+	expiry := p.Expiry
+	if expiry <= 0 {
+		expiry = DefaultPageExpiry
+	}
+	p.pending[key] = pendingPages{target: target, lines: rest, expires: now.Add(expiry)}
+}
@@ -0,0 +1,298 @@
+package irc
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ParseMessage parses a line of IRC text into a Message.
+// The line may end with CR-LF, which is ignored.
+//
+// The Message writes its prefix back out when marshaled,
+// so that it marshals the way it was read.
+//
+// ParseMessage is lenient: it accepts lines which break some rules of the message format,
+// as real servers send them. See ParseMessageMode to find out which rules were broken.
+func ParseMessage(line []byte) (*Message, error) {
+	m, _, err := ParseMessageMode(line, ParseLenient)
+	return m, err
+}
+
+// ParseMode controls how strictly lines are parsed.
+type ParseMode int
+
+const (
+	// ParseLenient accepts lines which break the rules listed by ParseRule, as long as they can be parsed.
+	// This is the default, and the mode used by Client.
+	ParseLenient ParseMode = iota
+
+	// ParseStrict rejects lines which break any of the rules listed by ParseRule.
+	ParseStrict
+)
+
+// A ParseRule is a rule of the IRC message format which lenient parsing doesn't enforce.
+type ParseRule int
+
+const (
+	// RulePrefixChars is broken by a nickname containing '@', or a user containing '!' or '@'.
+	RulePrefixChars ParseRule = iota + 1
+
+	// RuleTagEscape is broken by a backslash in a tag value which doesn't start one of the escapes
+	// \:, \s, \\, \r, or \n. Lenient parsing drops the backslash.
+	RuleTagEscape
+
+	// RuleTagKey is broken by an empty tag, e.g. "@;k=v", or a tag sent twice.
+	RuleTagKey
+
+	// RuleSpaces is broken by parts of a message separated by more than one space,
+	// or a line ending with a space.
+	RuleSpaces
+
+	// RuleCommand is broken by a command which is neither letters nor a 3-digit numeric.
+	RuleCommand
+
+	// RuleParamCount is broken by more than 15 parameters.
+	RuleParamCount
+
+	// RuleControlChars is broken by a NUL, CR, or LF inside the line.
+	RuleControlChars
+)
+
+func (r ParseRule) String() string {
+	switch r {
+	case RulePrefixChars:
+		return "invalid character in prefix"
+	case RuleTagEscape:
+		return "invalid escape in tag value"
+	case RuleTagKey:
+		return "empty or repeated tag"
+	case RuleSpaces:
+		return "extra spaces"
+	case RuleCommand:
+		return "invalid command"
+	case RuleParamCount:
+		return "too many parameters"
+	case RuleControlChars:
+		return "control character in line"
+	}
+	return "ParseRule(" + strconv.Itoa(int(r)) + ")"
+}
+
+// ParseDiagnostics lists the rules of the message format which a line broke.
+// Lenient parsing accepts the line anyway, so protocol tools can report what a server got wrong.
+type ParseDiagnostics struct {
+	Relaxed []ParseRule
+}
+
+// Broke reports whether the line broke rule.
+func (d ParseDiagnostics) Broke(rule ParseRule) bool {
+	for _, r := range d.Relaxed {
+		if r == rule {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *ParseDiagnostics) add(rule ParseRule) {
+	if !d.Broke(rule) {
+		d.Relaxed = append(d.Relaxed, rule)
+	}
+}
+
+// ParseMessageMode is like ParseMessage, parsing line according to mode,
+// and also returns the rules which line broke.
+// In strict mode, a line which broke any rule is an error.
+func ParseMessageMode(line []byte, mode ParseMode) (*Message, ParseDiagnostics, error) {
+	line = bytes.TrimRight(line, "\r\n")
+	m := new(Message)
+	if err := m.UnmarshalText(line); err != nil {
+		return nil, ParseDiagnostics{}, err
+	}
+	d := diagnose(string(line), m)
+	if mode == ParseStrict && len(d.Relaxed) > 0 {
+		return nil, d, fmt.Errorf("strict parsing: %s", d.Relaxed[0])
+	}
+	return m, d, nil
+}
+
+// diagnose checks the line which m was parsed from against the rules of ParseRule.
+func diagnose(line string, m *Message) ParseDiagnostics {
+	var d ParseDiagnostics
+	if strings.ContainsAny(line, "\x00\r\n") {
+		d.add(RuleControlChars)
+	}
+
+	rest := line
+	if strings.HasPrefix(rest, "@") {
+		var tags string
+		tags, rest, _ = strings.Cut(rest[1:], " ")
+		seen := make(map[string]bool)
+		for _, tag := range strings.Split(tags, ";") {
+			key, value, _ := strings.Cut(tag, "=")
+			if key == "" || seen[key] {
+				d.add(RuleTagKey)
+			}
+			seen[key] = true
+			for i := 0; i < len(value); i++ {
+				if value[i] != '\\' {
+					continue
+				}
+				if i+1 == len(value) || !strings.ContainsRune(":s\\rn", rune(value[i+1])) {
+					d.add(RuleTagEscape)
+				}
+				i++
+			}
+		}
+		if strings.HasPrefix(rest, " ") {
+			d.add(RuleSpaces)
+		}
+	}
+	if strings.HasPrefix(rest, ":") {
+		_, rest, _ = strings.Cut(rest, " ")
+		if strings.HasPrefix(rest, " ") {
+			d.add(RuleSpaces)
+		}
+		if strings.ContainsRune(m.Source.Nick.String(), '@') || strings.ContainsAny(m.Source.User, "!@") {
+			d.add(RulePrefixChars)
+		}
+	}
+
+	// the trailing parameter may contain any spaces
+	if i := strings.Index(rest, " :"); i >= 0 {
+		rest = rest[:i+1]
+	} else if strings.HasSuffix(rest, " ") {
+		d.add(RuleSpaces)
+	}
+	if strings.Contains(rest, "  ") {
+		d.add(RuleSpaces)
+	}
+
+	if !validCommand(m.Command.String()) {
+		d.add(RuleCommand)
+	}
+	if len(m.Params) > 15 {
+		d.add(RuleParamCount)
+	}
+	return d
+}
+
+// validCommand reports whether cmd is letters or a 3-digit numeric.
+func validCommand(cmd string) bool {
+	if len(cmd) == 3 && isDigit(cmd[0]) && isDigit(cmd[1]) && isDigit(cmd[2]) {
+		return true
+	}
+	for i := 0; i < len(cmd); i++ {
+		if !(cmd[i] >= 'a' && cmd[i] <= 'z' || cmd[i] >= 'A' && cmd[i] <= 'Z') {
+			return false
+		}
+	}
+	return cmd != ""
+}
+
+// ParseLines returns a LineParser which parses the messages read from r, one per line,
+// such as a raw log of an IRC connection.
+// Lines may end with CR-LF or a bare LF, and empty lines are skipped.
+func ParseLines(r io.Reader) *LineParser {
+	s := bufio.NewScanner(r)
+	s.Split(scanLenient)
+	return &LineParser{s: s}
+}
+
+// LineParser parses a stream of IRC lines. It's used like bufio.Scanner:
+//
+//	p := irc.ParseLines(f)
+//	for p.Scan() {
+//		if p.Err() != nil {
+//			continue // a malformed line
+//		}
+//		handle(p.Message())
+//	}
+//	if err := p.Err(); err != nil {
+//		// reading failed
+//	}
+//
+// Lines are parsed leniently unless Mode is set to ParseStrict before the first call to Scan.
+type LineParser struct {
+	Mode ParseMode
+
+	s    *bufio.Scanner
+	line int
+	m    *Message
+	diag ParseDiagnostics
+	err  error
+}
+
+// Scan advances to the next line, and reports whether there was one.
+// It returns false at the end of the input or when reading fails.
+// A line which can't be parsed doesn't stop the scan; see Err.
+func (p *LineParser) Scan() bool {
+	p.m, p.diag, p.err = nil, ParseDiagnostics{}, nil
+	for p.s.Scan() {
+		p.line++
+		if len(p.s.Bytes()) == 0 {
+			continue
+		}
+		m, diag, err := ParseMessageMode(p.s.Bytes(), p.Mode)
+		if err != nil {
+			p.err = fmt.Errorf("line %d: %w", p.line, err)
+		}
+		p.m, p.diag = m, diag
+		return true
+	}
+	p.err = p.s.Err()
+	return false
+}
+
+// Message returns the message parsed from the current line,
+// or nil if the line couldn't be parsed.
+func (p *LineParser) Message() *Message {
+	return p.m
+}
+
+// Diagnostics returns the rules of the message format which the current line broke.
+func (p *LineParser) Diagnostics() ParseDiagnostics {
+	return p.diag
+}
+
+// Line returns the number of the current line, counting from 1.
+func (p *LineParser) Line() int {
+	return p.line
+}
+
+// Err returns the error for the current line if it couldn't be parsed,
+// or, after Scan returned false, the error which stopped reading, which is nil at the end of the input.
+func (p *LineParser) Err() error {
+	return p.err
+}
+
+// ParseError describes a line which couldn't be parsed, and where parsing stopped.
+type ParseError struct {
+
+	// Line is the text which was being parsed.
+	Line string
+
+	// Offset is the byte offset in Line where the error was found.
+	Offset int
+
+	// Segment is the part of Line which was being read when the error was found, e.g. a partial tag name.
+	Segment string
+
+	// State is the part of the message the parser expected, such as "tag name", "prefix", or "command".
+	State string
+
+	// Reason describes the error.
+	Reason string
+}
+
+func (e *ParseError) Error() string {
+	s := fmt.Sprintf("parse error at byte %d while reading %s: %s", e.Offset, e.State, e.Reason)
+	if e.Segment != "" {
+		s += fmt.Sprintf(" (after %q)", e.Segment)
+	}
+	return s
+}
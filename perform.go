@@ -0,0 +1,154 @@
+package irc
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultPerformTimeout is how long a PerformItem waits for its WaitFor condition when its Timeout is 0.
+const DefaultPerformTimeout = 10 * time.Second
+
+// ErrPerformTimeout is reported for a PerformItem whose WaitFor condition wasn't met within its Timeout.
+var ErrPerformTimeout = errors.New("perform: wait timed out")
+
+// A PerformItem is one step of Client.Perform: a message to write, and optionally a condition to wait for
+// before the next step, such as the reply to an OPER or the MODE which sets a cloaked host.
+type PerformItem struct {
+
+	// Message is the message to write. Use PerformLine for a raw IRC line.
+	Message encoding.TextMarshaler
+
+	// Delay is how long to wait after writing Message before the next step (optional).
+	// It's not used when WaitFor is set.
+	Delay time.Duration
+
+	// WaitFor makes the next step wait until a message for which it returns true is read (optional),
+	// or Timeout passes, whichever comes first. It's called with each message read after Message was written,
+	// before the client's handler sees it.
+	WaitFor func(m *Message) bool
+
+	// Timeout limits how long WaitFor is waited for. If 0, DefaultPerformTimeout is used.
+	// Timing out is reported to ErrorLog, and the steps after it are performed anyway.
+	Timeout time.Duration
+}
+
+// PerformLine returns a PerformItem which writes line, a raw IRC line such as "MODE bot +x" or "OPER bot hunter2".
+// A line which can't be parsed is reported to ErrorLog when its turn comes, and skipped.
+func PerformLine(line string) PerformItem {
+	return PerformItem{Message: rawLine(line)}
+}
+
+// WaitForCommand returns a WaitFor condition which waits for any of cmds, e.g. RplYoureOper.
+func WaitForCommand(cmds ...Command) func(m *Message) bool {
+	return func(m *Message) bool {
+		return commandsMatch(cmds).matches(m)
+	}
+}
+
+// rawLine is a raw IRC line written by Perform. It's parsed when it's written, so that an invalid line
+// is reported like any other message which can't be written.
+type rawLine string
+
+func (l rawLine) MarshalText() ([]byte, error) {
+	m := new(Message)
+	if err := m.UnmarshalText([]byte(l)); err != nil {
+		return nil, fmt.Errorf("perform: %w", err)
+	}
+	return m.MarshalText()
+}
+
+// performer writes the items of Client.Perform on one connection, and then joins the channels of AutoJoin.
+type performer struct {
+	client *Client
+	items  []PerformItem
+
+	mu      sync.Mutex
+	next    int                   // the index of the next item to write
+	waitFor func(m *Message) bool // the condition the current step waits for, if any
+	timer   *time.Timer           // ends the wait of the current step
+	stopped bool
+}
+
+// start writes the items, once the client is registered and its Authenticators are done.
+func (p *performer) start(w MessageWriter) {
+	p.advance(w, p.next)
+}
+
+// advance performs the steps from the item at index step, unless the wait before step already ended.
+func (p *performer) advance(w MessageWriter, step int) {
+	for {
+		p.mu.Lock()
+		if p.stopped || p.next != step {
+			p.mu.Unlock()
+			return
+		}
+		if p.timer != nil {
+			p.timer.Stop()
+		}
+		p.waitFor, p.timer = nil, nil
+		p.next++
+		if step == len(p.items) {
+			p.mu.Unlock()
+			p.client.autoJoin(w)
+			return
+		}
+		item := p.items[step]
+		step++
+		// the condition is set before the message is written, so that the reply can't be missed
+		p.waitFor = item.WaitFor
+		p.mu.Unlock()
+
+		if item.Message != nil {
+			w.WriteMessage(item.Message)
+		}
+		wait := item.Delay
+		if item.WaitFor != nil {
+			if wait = item.Timeout; wait <= 0 {
+				wait = DefaultPerformTimeout
+			}
+		}
+		if wait <= 0 {
+			continue
+		}
+		p.mu.Lock()
+		if !p.stopped && p.next == step {
+			n := step
+			p.timer = time.AfterFunc(wait, func() {
+				p.mu.Lock()
+				current := !p.stopped && p.next == n
+				p.mu.Unlock()
+				if current && item.WaitFor != nil {
+					p.client.log(fmt.Errorf("%w after item %d", ErrPerformTimeout, n-1))
+				}
+				p.advance(p.client, n)
+			})
+		}
+		p.mu.Unlock()
+		return
+	}
+}
+
+// middleware ends the wait of the current step when its condition is met.
+func (p *performer) middleware(next Handler) Handler {
+	return HandlerFunc(func(w MessageWriter, m *Message) {
+		p.mu.Lock()
+		waitFor, step := p.waitFor, p.next
+		p.mu.Unlock()
+		next.SpeakIRC(w, m)
+		if waitFor != nil && waitFor(m) {
+			p.advance(w, step)
+		}
+	})
+}
+
+func (p *performer) stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stopped = true
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+}
@@ -0,0 +1,118 @@
+package irc
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// Pipe creates an in-memory connection with two ends, such that lines written to one end can be read from the other.
+// Either end can be returned from Client.DialFn, and the other used by a fake server,
+// or the ends can be used to connect two Clients.
+//
+// Unlike io.Pipe and net.Pipe, the connection is framed by lines:
+// each Read returns at most one line (ending with LF), and lines are only readable once they are complete.
+// Writes never block; lines are buffered until the other end reads them,
+// so two ends which write to each other at the same time can't deadlock.
+//
+// Closing either end closes both. Lines which were already written can still be read,
+// after which Read returns io.EOF.
+func Pipe() (io.ReadWriteCloser, io.ReadWriteCloser) {
+	a, b := newLineQueue(), newLineQueue()
+	return &pipeEnd{r: a, w: b}, &pipeEnd{r: b, w: a}
+}
+
+type pipeEnd struct {
+	r *lineQueue
+	w *lineQueue
+}
+
+func (p *pipeEnd) Read(b []byte) (int, error) {
+	return p.r.read(b)
+}
+
+func (p *pipeEnd) Write(b []byte) (int, error) {
+	return p.w.write(b)
+}
+
+func (p *pipeEnd) Close() error {
+	p.r.close()
+	p.w.close()
+	return nil
+}
+
+// lineQueue is one direction of a Pipe.
+type lineQueue struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	// partial holds written bytes which don't end with a line ending yet.
+	partial []byte
+
+	// lines holds complete lines waiting to be read.
+	lines [][]byte
+
+	// reading is the unread remainder of the line being read.
+	reading []byte
+
+	closed bool
+}
+
+func newLineQueue() *lineQueue {
+	q := &lineQueue{}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *lineQueue) write(b []byte) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return 0, io.ErrClosedPipe
+	}
+	q.partial = append(q.partial, b...)
+	for {
+		i := bytes.IndexByte(q.partial, '\n')
+		if i < 0 {
+			break
+		}
+		q.lines = append(q.lines, q.partial[:i+1:i+1])
+		q.partial = q.partial[i+1:]
+	}
+	q.cond.Broadcast()
+	return len(b), nil
+}
+
+func (q *lineQueue) read(b []byte) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.reading) == 0 && len(q.lines) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if len(q.reading) == 0 {
+		if len(q.lines) == 0 {
+			return 0, io.EOF
+		}
+		q.reading = q.lines[0]
+		q.lines[0] = nil
+		q.lines = q.lines[1:]
+	}
+	n := copy(b, q.reading)
+	q.reading = q.reading[n:]
+	return n, nil
+}
+
+func (q *lineQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	q.closed = true
+	// an unterminated line is still delivered, so that nothing written is lost
+	if len(q.partial) > 0 {
+		q.lines = append(q.lines, q.partial)
+		q.partial = nil
+	}
+	q.cond.Broadcast()
+}
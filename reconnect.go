@@ -0,0 +1,88 @@
+package irc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Backoff is the delay between the connection attempts of Client.Run.
+// The delay doubles after each connection which ends with an error, from Min up to Max,
+// and starts over after a connection which lasted longer than Max.
+//
+// The zero value uses a Min of 1 second and a Max of 5 minutes.
+type Backoff struct {
+	Min time.Duration
+	Max time.Duration
+}
+
+// limits returns Min and Max, or their defaults.
+func (b Backoff) limits() (min, max time.Duration) {
+	min, max = b.Min, b.Max
+	if min <= 0 {
+		min = time.Second
+	}
+	if max <= 0 {
+		max = 5 * time.Minute
+	}
+	return min, max
+}
+
+// delay returns the delay after n failed connections in a row.
+func (b Backoff) delay(n int) time.Duration {
+	min, max := b.limits()
+	d := min
+	for i := 1; i < n && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// Run calls ConnectAndRun, and reconnects whenever the connection ends with an error, waiting between attempts as set by Reconnect.
+// The server is given the wait it asked for with the cause of a DisconnectError, and Run never reconnects after CauseBanned.
+// The errors which end each connection are reported to ErrorLog.
+//
+// Run returns nil when the connection ends after ctx is done or the client sent QUIT.
+// It returns the error of the last connection when it stops reconnecting.
+// When Reconnect is nil, Run is the same as ConnectAndRun.
+func (c *Client) Run(ctx context.Context, h Handler) error {
+	if c.Reconnect == nil {
+		return c.ConnectAndRun(ctx, h)
+	}
+	failed := 0
+	for {
+		start := time.Now()
+		err := c.ConnectAndRun(ctx, h)
+		if err == nil || ctx.Err() != nil {
+			return nil
+		}
+		if _, max := c.Reconnect.limits(); time.Since(start) > max {
+			failed = 0
+		}
+		failed++
+		delay := c.Reconnect.delay(failed)
+		var disconnect *DisconnectError
+		if errors.As(err, &disconnect) {
+			retry, min := disconnect.Cause.Retry()
+			if !retry {
+				return err
+			}
+			if delay < min {
+				delay = min
+			}
+		}
+		c.log(fmt.Errorf("connection ended: %w; reconnecting in %s", err, delay))
+
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package irc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrNotConnected is returned by the Client methods which wait for a reply from the server
+// when the client isn't connected, or when the connection closed before the reply arrived,
+// and by Client.WriteMessageE when there is no connection to write to.
+var ErrNotConnected = errors.New("not connected")
+
+// Errors returned by the Client methods which wait for a reply, wrapping the server's explanation.
+var (
+	ErrNoPrivileges   = errors.New("insufficient privileges")
+	ErrPasswdMismatch = errors.New("password incorrect")
+	ErrNoOperHost     = errors.New("no operator block for host")
+	ErrNoSuchServer   = errors.New("no such server")
+	ErrTryAgain       = errors.New("server is busy; try again later")
+	ErrUnknownCommand = errors.New("unknown command")
+	ErrNoSuchNick     = errors.New("no such nick")
+	ErrNotDelivered   = errors.New("message not delivered")
+)
+
+// replyErrors maps error numerics to the errors returned by the Client methods which wait for a reply.
+var replyErrors = map[Command]error{
+	RplErrNoPrivileges:   ErrNoPrivileges,
+	RplErrNoPrivs:        ErrNoPrivileges,
+	RplErrPasswdMismatch: ErrPasswdMismatch,
+	RplErrNoOperHost:     ErrNoOperHost,
+	RplErrNoSuchServer:   ErrNoSuchServer,
+}
+
+// replyErrorCommands lists the commands which are answered with each error numeric of replyErrors,
+// since the numerics don't say which command they're about.
+// A numeric which isn't listed may answer any command.
+var replyErrorCommands = map[Command][]Command{
+	RplErrNoPrivileges:   operCommands,
+	RplErrNoPrivs:        operCommands,
+	RplErrPasswdMismatch: {CmdOper},
+	RplErrNoOperHost:     {CmdOper},
+}
+
+// operCommands are the commands which may be refused to users who aren't IRC operators.
+var operCommands = []Command{CmdKill, CmdRehash, CmdRestart, CmdDie, CmdConnect, CmdSQuit, CmdStats, CmdLinks, CmdMap}
+
+// answers reports whether the error numeric may be the reply to cmd.
+func answers(numeric, cmd Command) bool {
+	cmds, ok := replyErrorCommands[numeric]
+	if !ok {
+		return true
+	}
+	for _, c := range cmds {
+		if c.is(cmd) {
+			return true
+		}
+	}
+	return false
+}
+
+// commandReply returns an accept function for request, which completes with success for the numeric ok,
+// or with an error for the numerics in replyErrors which answer cmd,
+// and for ERR_UNKNOWNCOMMAND, ERR_NEEDMOREPARAMS, or RPL_TRYAGAIN about cmd.
+func commandReply(cmd, ok Command) func(*Message) (bool, error) {
+	return func(m *Message) (bool, error) {
+		text := m.Params.Get(len(m.Params))
+		switch {
+		case ok != "" && m.Command.is(ok):
+			return true, nil
+		case replyErrors[m.Command] != nil && answers(m.Command, cmd):
+			return true, fmt.Errorf("%s: %w: %s", cmd, replyErrors[m.Command], text)
+		case m.Command.is(RplTryAgain) && strings.EqualFold(m.Params.Get(2), cmd.String()):
+			return true, fmt.Errorf("%s: %w: %s", cmd, ErrTryAgain, text)
+		case m.Command.is(RplErrUnknownCommand) && strings.EqualFold(m.Params.Get(2), cmd.String()):
+			return true, fmt.Errorf("%s: %w", cmd, ErrUnknownCommand)
+		case m.Command.is(RplErrNeedMoreParams) && strings.EqualFold(m.Params.Get(2), cmd.String()):
+			return true, fmt.Errorf("%s: %s", cmd, text)
+		}
+		return false, nil
+	}
+}
+
+// errClosed is returned by request when the connection closed while waiting.
+// Commands such as DIE succeed by closing the connection.
+var errClosed = fmt.Errorf("%w: connection closed before the reply arrived", ErrNotConnected)
+
+// pendingReplies correlates incoming messages with the commands sent by Client methods
+// which wait for the server's reply, such as Rehash.
+type pendingReplies struct {
+
+	// ctx is done when the connection closes.
+	ctx context.Context
+
+	mu      sync.Mutex
+	seq     int
+	waiting []*pendingReply
+}
+
+// pendingReply is a request waiting for its reply.
+type pendingReply struct {
+
+	// accept is called with every incoming message until it reports that the reply is complete.
+	accept func(m *Message) (done bool, err error)
+
+	// barrier is the PING token which completes the request when its PONG arrives, if any.
+	barrier string
+
+	done chan error
+}
+
+func newPendingReplies(ctx context.Context) *pendingReplies {
+	return &pendingReplies{ctx: ctx}
+}
+
+func (p *pendingReplies) middleware(next Handler) Handler {
+	return HandlerFunc(func(w MessageWriter, m *Message) {
+		if p.deliver(m) {
+			return
+		}
+		next.SpeakIRC(w, m)
+	})
+}
+
+// deliver passes m to the pending requests, and reports whether m was a PONG sent only for a request.
+// Servers answer commands in order, so a message which completes a request completes only the oldest
+// request which accepts it, and isn't passed to the others.
+func (p *pendingReplies) deliver(m *Message) (barrier bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	waiting := p.waiting[:0]
+	completed := false
+	for _, r := range p.waiting {
+		if completed {
+			waiting = append(waiting, r)
+			continue
+		}
+		if r.barrier != "" && m.Command.is(CmdPong) && m.Params.Get(2) == r.barrier {
+			barrier, completed = true, true
+			r.done <- nil
+			continue
+		}
+		if done, err := r.accept(m); done {
+			completed = true
+			r.done <- err
+			continue
+		}
+		waiting = append(waiting, r)
+	}
+	p.waiting = waiting
+	return barrier
+}
+
+// add starts waiting for the reply to a request.
+func (p *pendingReplies) add(accept func(*Message) (bool, error), barrier bool) *pendingReply {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	r := &pendingReply{accept: accept, done: make(chan error, 1)}
+	if barrier {
+		r.barrier = p.token("REPLY")
+	}
+	p.waiting = append(p.waiting, r)
+	return r
+}
+
+// token returns a new unique token for correlating replies, e.g. "REPLY1".
+// p.mu must be held.
+func (p *pendingReplies) token(prefix string) string {
+	p.seq++
+	return prefix + strconv.Itoa(p.seq)
+}
+
+// remove stops waiting for the reply to r.
+func (p *pendingReplies) remove(r *pendingReply) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, w := range p.waiting {
+		if w == r {
+			p.waiting = append(p.waiting[:i], p.waiting[i+1:]...)
+			return
+		}
+	}
+}
+
+// request writes m and waits until accept reports that the server's reply is complete,
+// returning the error from accept.
+//
+// Commands which have no reply on success use a barrier: a PING written after m,
+// whose PONG completes the request, since servers answer commands in order.
+//
+// Requests wait for replies which only the client's handlers can deliver,
+// so they must not be made from a handler.
+func (c *Client) request(ctx context.Context, m *Message, barrier bool, accept func(*Message) (bool, error)) error {
+	c.connMu.Lock()
+	p := c.replies
+	c.connMu.Unlock()
+	if p == nil || p.ctx.Err() != nil {
+		return ErrNotConnected
+	}
+
+	r := p.add(accept, barrier)
+	if err := c.WriteMessageE(m); err != nil {
+		p.remove(r)
+		return err
+	}
+	if barrier {
+		c.WriteMessage(Ping(r.barrier))
+	}
+
+	select {
+	case err := <-r.done:
+		return err
+	case <-ctx.Done():
+		p.remove(r)
+		return ctx.Err()
+	case <-p.ctx.Done():
+		return errClosed
+	}
+}
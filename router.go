@@ -4,6 +4,10 @@ import (
 	"fmt"
 	"regexp"
 	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/Travis-Britz/irc/internal/formatting"
 )
 
 // Router provides a Handler which can match incoming messages against a slice of route handlers.
@@ -21,6 +25,47 @@ type Router struct {
 	// Slice of middleware to be called, regardless of whether a match was found.
 	middlewares []middleware
 
+	// handler is r.route wrapped with the global middleware, built by Use.
+	handler Handler
+
+	// end is the innermost link of handler, which the next call to Use points at its middleware.
+	end *link
+
+	// Trace is an optional callback which receives a description of how each message was routed:
+	// which routes were tested, the first matcher that failed for each, and which handler ran.
+	// It is meant for debugging routes that don't fire when expected.
+	// Leave Trace nil in production, since building each RouteTrace has a cost.
+	Trace func(RouteTrace)
+
+	// StripFormatting removes color and formatting codes from message text before it's matched against
+	// OnText patterns and regular expressions, so that e.g. a bold "!command" still triggers its route.
+	// Only matching is affected: handlers receive the original message, formatting included.
+	StripFormatting bool
+
+	// AbbreviatedCommands allows the routes added with OnCommand to be triggered by any unambiguous
+	// abbreviation of their names, e.g. "!wea" for "!weather" if no other command starts with "!wea".
+	AbbreviatedCommands bool
+
+	// CollectStats enables the collection of per-route statistics, which are returned by Stats.
+	// Collecting statistics adds a small cost to every message.
+	CollectStats bool
+
+	// commands holds the routes added with OnCommand.
+	commands *commandMux
+
+	// client tracks our current nickname for the matchers which need it. See BindClient.
+	client nickTracker
+
+	// unbound logs the use of those matchers without a client only once.
+	unbound sync.Once
+
+	// overlays holds the ChannelOverlay of each channel, keyed by channel name folded by fold. See SetOverlay.
+	overlayMu sync.RWMutex
+	overlays  map[string]*channelOverlay
+
+	// stats holds the statistics which aren't specific to a route.
+	stats routerStats
+
 	// chanmodes and nickprefixes are used to split MODE messages into multiple events
 	// CHANMODES=A,B,C,D[,X,Y...]
 	// CHANMODES=beIqa,kLf,lH,psmntirzMQNRTOVKDdGPZSCc
@@ -58,20 +103,29 @@ func handleMode(next Handler) Handler {
 	return next
 }
 
-func (r *Router) OnOp(h HandlerFunc) *route {
-	// todo: match channel
-	// OnOp depends on mode commands being split into multiple events before hitting the router
-	return r.HandleFunc(CmdMode, h).MatchFunc(func(m *Message) bool {
-		return strings.HasPrefix(m.Params.Get(2), "+o ")
-	})
-}
-
 // Handle appends h to the list of handlers for cmd.
 func (r *Router) Handle(cmd Command, h Handler) *route {
-	rt := &route{
+	rt := newRoute(cmd, h)
+	rt.router = r
+	r.routes = append(r.routes, rt)
+	return rt
+}
+
+func newRoute(cmd Command, h Handler) *route {
+	return &route{
 		h:        h,
+		cmd:      cmd,
+		handler:  handlerName(h),
 		matchers: []matcher{&commandMatch{cmd}},
 	}
+}
+
+// handleCommands appends h to the list of handlers for any of cmds.
+// The route is registered for the first of cmds, which is the command shown for it in Routes.
+func (r *Router) handleCommands(h Handler, cmds ...Command) *route {
+	rt := newRoute(cmds[0], h)
+	rt.matchers = []matcher{commandsMatch(cmds)}
+	rt.router = r
 	r.routes = append(r.routes, rt)
 	return rt
 }
@@ -81,38 +135,121 @@ func (r *Router) HandleFunc(cmd Command, f HandlerFunc) *route {
 	return r.Handle(cmd, f)
 }
 
-// SpeakIRC implements Handler
+// SpeakIRC implements Handler.
+// The message is passed through the global middleware before it's matched against the routes.
 func (r *Router) SpeakIRC(mw MessageWriter, m *Message) {
+	if r.handler == nil {
+		r.route(mw, m)
+		return
+	}
+	r.handler.SpeakIRC(mw, m)
+}
+
+// route calls the handler of the first route matching m.
+func (r *Router) route(mw MessageWriter, m *Message) {
+	match := m
+	if r.StripFormatting {
+		match = stripMessage(m)
+	}
+
+	if r.Trace != nil {
+		r.trace(m, match)
+	}
 
 	for _, rt := range r.routes {
-		if rt.matches(m) {
-			wrap(rt.h, r.middlewares...).SpeakIRC(mw, m)
+		if rt.mux != nil {
+			// every command route is looked up at once, in place of testing them one by one
+			if found := rt.mux.find(match); found != nil && r.available(found, m, true) {
+				r.dispatch(found, mw, m)
+				return
+			}
+			continue
+		}
+		if rt.matches(match) && r.available(rt, m, true) {
+			r.dispatch(rt, mw, m)
 			return
 		}
 	}
-	// global middlewares need to run even if there was no matching route
-	// since there's no route handler, we wrap the no-op handler
-	wrap(noop, r.middlewares...).SpeakIRC(mw, m)
+	if r.CollectStats {
+		r.stats.unmatched()
+	}
+}
+
+// dispatch calls the handler of the matching route rt.
+func (r *Router) dispatch(rt *route, mw MessageWriter, m *Message) {
+	if m.dispatch != nil {
+		m.dispatch.route, m.dispatch.handler = rt.name, rt.handler
+	}
+	if rw, ok := mw.(routeWriter); ok {
+		mw = rw.forRoute(rt)
+	}
+	if !r.CollectStats {
+		rt.h.SpeakIRC(mw, m)
+		return
+	}
+	rt.stats.match()
+	rt.stats.instrument(rt.h).SpeakIRC(mw, m)
+}
+
+// stripMessage returns a copy of m with formatting codes removed from every parameter,
+// or m itself when there were no formatting codes to remove.
+func stripMessage(m *Message) *Message {
+	var params Params
+	for i, p := range m.Params {
+		if !strings.ContainsAny(p, formatting.Chars) {
+			continue
+		}
+		if params == nil {
+			params = append(Params(nil), m.Params...)
+		}
+		params[i] = StripFormatting(p)
+	}
+	if params == nil {
+		return m
+	}
+	stripped := *m
+	stripped.Params = params
+	return &stripped
 }
 
 // Use appends global middleware to the router.
 // Middleware are functions which accept a handler and return a handler.
 //
-// Global middleware are run against every incoming line,
-// even if there were no matching routes for the message.
+// Global middleware are run against every incoming line, once, before it's matched against the routes,
+// even if there are no matching routes for the message.
+// The message a middleware passes to the next Handler is the one the routes are matched against.
 //
 // Middleware can do many things:
 //
-//  - Mutate incoming messages before passing them to the next Handler
+//  - Mutate incoming messages before passing them to the next Handler, changing which route matches
 //  - Decorate the MessageWriter with additional functionality before passing it to the next Handler
 //  - Write messages to the MessageWriter
-//  - Prevent additional processing by not calling the next Handler
+//  - Prevent additional processing by not calling the next Handler, so that no route is matched
 //
 // These are very powerful abilities, but it is very easy to use them improperly.
 //
 // Middleware will execute in the order they were attached.
+// Each middleware is called once when it's attached, not once per message, so it may keep state between messages.
+// Use must not be called while the router is handling messages.
 func (r *Router) Use(middlewares ...middleware) {
 	r.middlewares = append(r.middlewares, middlewares...)
+	end := &link{next: HandlerFunc(r.route)}
+	h := wrap(end, middlewares...)
+	if r.end == nil {
+		r.handler = h
+	} else {
+		r.end.next = h
+	}
+	r.end = end
+}
+
+// link is a Handler which passes messages on to next, which can be replaced after it's wrapped.
+type link struct {
+	next Handler
+}
+
+func (l *link) SpeakIRC(w MessageWriter, m *Message) {
+	l.next.SpeakIRC(w, m)
 }
 
 // Use wraps the route handler with middlewares.
@@ -133,6 +270,7 @@ func (r *route) Use(middlewares ...middleware) *route {
 		panic("nil handler: the route handler must be defined before wrapping the handler with middleware")
 	}
 	r.h = wrap(r.h, middlewares...)
+	r.middlewares += len(middlewares)
 	return r
 }
 
@@ -152,6 +290,9 @@ func (r *Router) OnConnect(h HandlerFunc) *route {
 //  text* matches if text starts with word
 //  *text matches if text ends with word
 //  *text* matches if text is anywhere
+//
+// Matching is case-insensitive by default; see the CaseSensitive and Anchor methods of the returned route
+// to change how text is matched.
 func (r *Router) OnText(wildtext string, h HandlerFunc) *route {
 	return r.HandleFunc(CmdPrivmsg, h).wildtext(wildtext)
 }
@@ -161,6 +302,25 @@ func (r *Router) OnTextRE(expr string, h HandlerFunc) *route {
 	return r.HandleFunc(CmdPrivmsg, h).textRE(expr)
 }
 
+// OnTextRESubmatch is like OnTextRE, but h also receives the submatches of expr:
+// matches[0] is the text matched by the whole expression, and matches[i] is the text of the ith capture group,
+// as returned by regexp.Regexp.FindStringSubmatch.
+//
+//	r.OnTextRESubmatch(`^!roll (\d+)d(\d+)$`, func(w irc.MessageWriter, m *irc.Message, matches []string) {
+//		dice, sides := matches[1], matches[2]
+//		// ...
+//	})
+func (r *Router) OnTextRESubmatch(expr string, h func(w MessageWriter, m *Message, matches []string)) *route {
+	sm := &submatchMatch{re: compileRegexp(expr)}
+	adapter := func(w MessageWriter, m *Message) {
+		h(w, m, sm.submatches(m))
+	}
+	rt := r.HandleFunc(CmdPrivmsg, adapter)
+	rt.handler = funcName(h)
+	rt.matchers = append(rt.matchers, sm)
+	return rt
+}
+
 // OnNotice is triggered when a NOTICE is received from a client on the server, following the
 // same format as OnText. For server notices, use MatchServer.
 func (r *Router) OnNotice(wildtext string, h HandlerFunc) *route {
@@ -197,6 +357,40 @@ func (r *Router) OnError(h HandlerFunc) *route {
 	return r.Handle(CmdError, h)
 }
 
+// OnInvite attaches a handler for INVITE events.
+// Servers only send INVITE to the invited user,
+// unless the invite-notify capability is enabled;
+// use MatchClient to ignore invites for other users.
+func (r *Router) OnInvite(h HandlerFunc) *route {
+	return r.Handle(CmdInvite, h)
+}
+
+// OnCapNew attaches a handler for CAP NEW events, which servers send when additional capabilities
+// become available after connecting (cap-notify).
+// The new capabilities are listed in the last parameter.
+//
+// The client has already requested any of the new capabilities listed in Client.Caps
+// by the time h is called.
+func (r *Router) OnCapNew(h HandlerFunc) *route {
+	return r.HandleFunc(CmdCap, h).MatchFunc(matchCapSubcommand("NEW"))
+}
+
+// OnCapDel attaches a handler for CAP DEL events, which servers send when capabilities
+// are no longer available (cap-notify).
+// The removed capabilities are listed in the last parameter.
+//
+// Handlers which depend on a capability should stop relying on it when it's removed,
+// e.g. stop trusting the "time" tag when server-time is removed.
+func (r *Router) OnCapDel(h HandlerFunc) *route {
+	return r.HandleFunc(CmdCap, h).MatchFunc(matchCapSubcommand("DEL"))
+}
+
+func matchCapSubcommand(subcommand string) matcherFunc {
+	return func(m *Message) bool {
+		return strings.EqualFold(m.Params.Get(2), subcommand)
+	}
+}
+
 // OnNick attaches a handler when a user's nickname changes.
 func (r *Router) OnNick(h func(nick Nickname, newnick Nickname)) *route {
 	adapter := func(mw MessageWriter, m *Message) {
@@ -232,18 +426,72 @@ func NewCTCPReplyCmd(subcommand string) Command {
 	return Command(fmt.Sprintf("_CTCP_REPLY_%s", strings.ToUpper(subcommand)))
 }
 
+// Route is a route attached to a Router, such as those returned by HandleFunc and On.
+// Packages which add routes for their users, such as twitch.OnSub, return it so that callers can add matchers.
+type Route = route
+
 type route struct {
 	h        Handler
 	matchers []matcher
+
+	// cmd is the command the route was registered for.
+	cmd Command
+
+	// name is the optional name given to the route with Name.
+	name string
+
+	// handler identifies the original handler of the route, for debugging.
+	handler string
+
+	// usage and description are the help text of the route, shown by Router.HelpHandler.
+	usage       string
+	description string
+
+	// middlewares is the number of middleware wrapping h, for debugging.
+	middlewares int
+
+	// stats is only updated when the router's CollectStats is true.
+	stats routeStats
+
+	// mux is set when the route is a placeholder for the command routes of the router.
+	// See OnCommand.
+	mux *commandMux
+
+	// router is the router the route was added to.
+	router *Router
+}
+
+// Name sets the name of the route.
+// Names are not used for matching; they identify routes in Router.Routes, traces, and help listings.
+// Names should be unique within a Router.
+func (r *route) Name(name string) *route {
+	r.name = name
+	return r
+}
+
+// Help sets the help text of the route, which is listed by Router.HelpHandler.
+// usage shows how to trigger the route, e.g. "!greet <nick>",
+// and description briefly explains what it does.
+//
+// Routes without help text are never listed.
+func (r *route) Help(usage, description string) *route {
+	r.usage = usage
+	r.description = description
+	return r
 }
 
 func (r *route) matches(m *Message) bool {
+	return r.mismatch(m) == nil
+}
+
+// mismatch returns the first matcher which does not match m, or nil if all matchers match.
+func (r *route) mismatch(m *Message) matcher {
 	for _, rm := range r.matchers {
 		if !rm.matches(m) {
-			return false
+			return rm
 		}
 	}
-	return true
+	return nil
 }
 
 // A matcher is attached to a route and determines whether a given Message satisfies some condition.
@@ -263,14 +511,24 @@ type matcher interface {
 // *text matches if text ends with word
 // *text* matches if text is anywhere
 func (r *route) wildtext(s string) *route {
+	rm := &regexMatch{wildtext: s, wild: true}
+	rm.compile()
+	r.matchers = append(r.matchers, rm)
+	return r
+}
 
-	re := regexp.MustCompile("\\*|\\?|[^*?]+")
-	expr := re.ReplaceAllStringFunc(s, func(s string) string {
+var wildTokens = regexp.MustCompile("\\*|\\?|[^*?]+")
+
+// wildRegexp converts the wildcard text s to a regular expression.
+// Wildcards and case folding operate on Unicode characters, not bytes,
+// so '?' matches "é" and "ÉCOLE" matches "école" when caseSensitive is false.
+func wildRegexp(s string, caseSensitive bool, anchor Anchor) *regexp.Regexp {
+	expr := wildTokens.ReplaceAllStringFunc(s, func(s string) string {
 		switch s {
 		case "*":
-			return ".*"
+			return "(?s:.*)"
 		case "?":
-			return "."
+			return "(?s:.)"
 		}
 		return regexp.QuoteMeta(s)
 	})
@@ -278,47 +536,194 @@ func (r *route) wildtext(s string) *route {
 	fields := strings.Split(expr, " ")
 	for i, f := range fields {
 		if f == "&" {
-			fields[i] = "\\S+"
+			fields[i] = "[^ ]+"
 		}
 	}
-
 	expr = strings.Join(fields, " ")
 
-	return r.textRE("^" + expr + "$")
+	switch anchor {
+	case AnchorPrefix:
+		expr = "^" + expr + "(?: |$)"
+	case AnchorNone:
+	default:
+		expr = "^" + expr + "$"
+	}
+	if !caseSensitive {
+		expr = "(?i)" + expr
+	}
+	return compileRegexp(expr)
 }
 
-func (r *route) matchtext(s string) *route {
-	return r.wildtext(s)
+// regexpCache holds the compiled regular expressions of routes, keyed by expression,
+// so that routes with identical patterns share one Regexp, which is safe for concurrent use.
+var regexpCache sync.Map
+
+// compileRegexp is like regexp.MustCompile, but returns the cached Regexp when expr was compiled before.
+func compileRegexp(expr string) *regexp.Regexp {
+	if re, ok := regexpCache.Load(expr); ok {
+		return re.(*regexp.Regexp)
+	}
+	re, _ := regexpCache.LoadOrStore(expr, regexp.MustCompile(expr))
+	return re.(*regexp.Regexp)
 }
 
-// textRE appends the regular expression expr to the route's matchers.
-func (r *route) textRE(expr string) *route {
-	r.matchers = append(r.matchers, &regexMatch{regexp.MustCompile(expr)})
-	return r
+// wildMatchFunc returns a function which matches the wildcard text s with string comparisons,
+// or nil if s needs a regular expression.
+// Most routes are literal text such as "!help", optionally with '*' at either end such as "!greet*",
+// and matching those doesn't need the regexp engine.
+func wildMatchFunc(s string, caseSensitive bool, anchor Anchor) func(text string) bool {
+	if strings.ContainsRune(s, '?') {
+		return nil
+	}
+	for _, f := range strings.Split(s, " ") {
+		if f == "&" {
+			return nil
+		}
+	}
+	lit := strings.Trim(s, "*")
+	if strings.Contains(lit, "*") {
+		return nil
+	}
+	leading := strings.HasPrefix(s, "*")
+	trailing := strings.HasSuffix(s, "*")
+
+	switch {
+	case lit == "" && (leading || anchor == AnchorNone):
+		return func(string) bool { return true }
+	case anchor == AnchorNone || leading && trailing:
+		if !caseSensitive {
+			// there's no case-insensitive strings.Contains
+			return nil
+		}
+		return func(text string) bool { return strings.Contains(text, lit) }
+	case leading:
+		if anchor == AnchorPrefix {
+			return nil
+		}
+		return func(text string) bool {
+			_, ok := cutSuffixFold(text, lit, caseSensitive)
+			return ok
+		}
+	case trailing:
+		return func(text string) bool {
+			_, ok := cutPrefixFold(text, lit, caseSensitive)
+			return ok
+		}
+	case anchor == AnchorPrefix:
+		// the text must be followed by a space or the end of the text
+		return func(text string) bool {
+			rest, ok := cutPrefixFold(text, lit, caseSensitive)
+			return ok && (rest == "" || rest[0] == ' ')
+		}
+	}
+	return func(text string) bool {
+		rest, ok := cutPrefixFold(text, lit, caseSensitive)
+		return ok && rest == ""
+	}
 }
 
-type nickTracker interface {
-	Nick() Nickname
+// cutPrefixFold is like strings.CutPrefix, but compares with Unicode case folding unless caseSensitive.
+// Simple case folding maps each character to one character, like the (?i) flag of regular expressions,
+// so the prefix of s has as many characters as prefix.
+func cutPrefixFold(s, prefix string, caseSensitive bool) (string, bool) {
+	if caseSensitive {
+		return strings.CutPrefix(s, prefix)
+	}
+	i := 0
+	for n := utf8.RuneCountInString(prefix); n > 0; n-- {
+		if i >= len(s) {
+			return s, false
+		}
+		_, size := utf8.DecodeRuneInString(s[i:])
+		i += size
+	}
+	if !strings.EqualFold(s[:i], prefix) {
+		return s, false
+	}
+	return s[i:], true
+}
+
+// cutSuffixFold is like strings.CutSuffix, but compares with Unicode case folding unless caseSensitive.
+func cutSuffixFold(s, suffix string, caseSensitive bool) (string, bool) {
+	if caseSensitive {
+		return strings.CutSuffix(s, suffix)
+	}
+	i := len(s)
+	for n := utf8.RuneCountInString(suffix); n > 0; n-- {
+		if i <= 0 {
+			return s, false
+		}
+		_, size := utf8.DecodeLastRuneInString(s[:i])
+		i -= size
+	}
+	if !strings.EqualFold(s[i:], suffix) {
+		return s, false
+	}
+	return s[:i], true
 }
 
-// isQuery limits the route to match only against query messages
-func (r *route) isQuery() *route {
+// Anchor controls which part of the message text a wildcard pattern must match.
+type Anchor int
+
+const (
+	// AnchorFull requires the pattern to match the entire text. This is the default.
+	AnchorFull Anchor = iota
+
+	// AnchorPrefix requires the pattern to match the start of the text,
+	// followed by either a space or the end of the text.
+	// The pattern "!greet" then matches "!greet" and "!greet bob", but not "!greeting".
+	AnchorPrefix
 
-	var nt nickTracker = nil // todo: figure out how to cleanly pass in a reference to the client
+	// AnchorNone allows the pattern to match anywhere in the text.
+	AnchorNone
+)
+
+// CaseSensitive makes the wildcard text of the route (e.g. from OnText) match case-sensitively.
+// By default, wildcard text matches regardless of case.
+// Regular expressions are not affected; use the (?i) flag to control their case sensitivity.
+func (r *route) CaseSensitive() *route {
+	for _, rm := range r.wildMatchers() {
+		rm.caseSensitive = true
+		rm.compile()
+	}
+	return r
+}
 
-	if nt == nil {
-		panic("isQuery: the router's nick tracker cannot be nil when using matchers that need the client's current nickname")
+// Anchor sets which part of the message text the wildcard text of the route (e.g. from OnText) must match.
+// Regular expressions are not affected; use ^ and $ to anchor them.
+func (r *route) Anchor(a Anchor) *route {
+	for _, rm := range r.wildMatchers() {
+		rm.anchor = a
+		rm.compile()
 	}
-	r.MatchFunc(func(m *Message) bool {
-		targ, err := m.Target()
-		if err != nil {
-			return false
+	return r
+}
+
+// wildMatchers returns the matchers of r which were converted from wildcard text.
+func (r *route) wildMatchers() []*regexMatch {
+	var matchers []*regexMatch
+	for _, m := range r.matchers {
+		if rm, ok := m.(*regexMatch); ok && rm.wild {
+			matchers = append(matchers, rm)
 		}
-		return nt.Nick().Is(targ)
-	})
+	}
+	return matchers
+}
+
+func (r *route) matchtext(s string) *route {
+	return r.wildtext(s)
+}
+
+// textRE appends the regular expression expr to the route's matchers.
+func (r *route) textRE(expr string) *route {
+	r.matchers = append(r.matchers, &regexMatch{re: compileRegexp(expr)})
 	return r
 }
 
+type nickTracker interface {
+	Nick() Nickname
+}
+
 func (r *route) channel(ch string) *route {
 	// not exported yet because I'm not sure how to deal with events other than privmsg/notice
 	r.matchers = append(r.matchers, &channelMatch{ch})
@@ -343,6 +748,27 @@ func (r *route) MatchChan(ch string) *route {
 	return r.channel(ch)
 }
 
+// MatchTag matches messages which have the IRCv3 message tag key,
+// with a value that matches the wildcard text value (see IsWM).
+// If value is empty or "*", any value matches, as long as the tag is present.
+//
+// Networks such as Twitch use tags for user roles; see package twitch for matchers built on MatchTag.
+func (r *route) MatchTag(key, value string) *route {
+	return r.Matcher(tagMatch{key: key, value: value})
+}
+
+type tagMatch struct {
+	key, value string
+}
+
+func (tm tagMatch) matches(m *Message) bool {
+	v, ok := m.Tags[tm.key]
+	if !ok {
+		return false
+	}
+	return tm.value == "" || IsWM(tm.value, v)
+}
+
 type matchAny struct {
 	matchers []matcher
 }
@@ -363,6 +789,8 @@ func (r *route) MatchClient(client nickTracker) *route {
 		switch m.Command {
 		case CmdKick:
 			return client.Nick().Is(m.Params.Get(2))
+		case CmdInvite:
+			return client.Nick().Is(m.Params.Get(1))
 		default:
 			return m.Source.Nick.Is(client.Nick().String())
 		}
@@ -383,8 +811,40 @@ func (cm commandMatch) matches(m *Message) bool {
 	return m.Command.is(cm.cmd)
 }
 
+// commandsMatch matches any of several commands.
+type commandsMatch []Command
+
+func (cm commandsMatch) matches(m *Message) bool {
+	for _, cmd := range cm {
+		if m.Command.is(cmd) {
+			return true
+		}
+	}
+	return false
+}
+
 type regexMatch struct {
 	re *regexp.Regexp
+
+	// match replaces re for wildcard text which doesn't need a regular expression; see wildMatchFunc.
+	match func(text string) bool
+
+	// wildtext is the original wildcard text, if re was converted from one.
+	wildtext string
+	wild     bool
+
+	// options for compiling wildtext.
+	caseSensitive bool
+	anchor        Anchor
+}
+
+// compile converts the wildcard text of rm to its regular expression.
+func (rm *regexMatch) compile() {
+	rm.re = nil
+	rm.match = wildMatchFunc(rm.wildtext, rm.caseSensitive, rm.anchor)
+	if rm.match == nil {
+		rm.re = wildRegexp(rm.wildtext, rm.caseSensitive, rm.anchor)
+	}
 }
 
 func (rm regexMatch) matches(m *Message) bool {
@@ -392,9 +852,48 @@ func (rm regexMatch) matches(m *Message) bool {
 	if err != nil {
 		return false
 	}
+	if rm.match != nil {
+		return rm.match(text)
+	}
 	return rm.re.MatchString(text)
 }
 
+// submatchMatch is the matcher of OnTextRESubmatch.
+// The submatches found while matching are kept on the message's dispatch record, so that the handler doesn't run the expression a second time.
+type submatchMatch struct {
+	re *regexp.Regexp
+}
+
+func (sm *submatchMatch) matches(m *Message) bool {
+	text, err := m.Text()
+	if err != nil {
+		return false
+	}
+	matches := sm.re.FindStringSubmatch(text)
+	if matches == nil {
+		return false
+	}
+	if m.dispatch != nil {
+		m.dispatch.submatch, m.dispatch.groups = sm, matches
+	}
+	return true
+}
+
+// submatches returns the submatches of m's text.
+// The expression only runs again when the message isn't being dispatched by a client,
+// such as a Router called directly, in which case the route may have matched the text after formatting was stripped (see Router.StripFormatting).
+func (sm *submatchMatch) submatches(m *Message) []string {
+	if d := m.dispatch; d != nil && d.submatch == sm {
+		return d.groups
+	}
+	text, _ := m.Text()
+	matches := sm.re.FindStringSubmatch(text)
+	if matches == nil {
+		matches = sm.re.FindStringSubmatch(StripFormatting(text))
+	}
+	return matches
+}
+
 type channelMatch struct {
 	channel string
 }
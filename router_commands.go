@@ -0,0 +1,151 @@
+package irc
+
+import (
+	"strings"
+)
+
+// OnCommand attaches a handler for PRIVMSG events whose first word is name or one of its aliases,
+// such as "!greet" in "!greet bob". Names are matched regardless of case.
+//
+// Unlike OnText, which tests a regular expression for every route in turn,
+// command routes are looked up by their first word in a single step,
+// which makes OnCommand the better choice for bots with many commands.
+// The returned route supports the same matchers and middleware as any other route.
+//
+// All command routes are tested together, at the position of the first route added with OnCommand.
+// When multiple command routes share a name, the first one that matches is used.
+//
+//	r.OnCommand("!weather", handleWeather, "!w")
+func (r *Router) OnCommand(name string, h HandlerFunc, aliases ...string) *route {
+	if r.commands == nil {
+		r.commands = &commandMux{router: r}
+		r.routes = append(r.routes, &route{mux: r.commands})
+	}
+	rt := newRoute(CmdPrivmsg, h)
+	rt.router = r
+	names := append([]string{name}, aliases...)
+	rt.matchers = append(rt.matchers, &commandWordMatch{mux: r.commands, rt: rt, names: names})
+	r.commands.add(rt, names)
+	return rt
+}
+
+// flatRoutes returns the routes of r in the order they are tested,
+// with each command mux placeholder replaced by its command routes.
+func (r *Router) flatRoutes() []*route {
+	if r.commands == nil {
+		return r.routes
+	}
+	routes := make([]*route, 0, len(r.routes)+len(r.commands.routes))
+	for _, rt := range r.routes {
+		if rt.mux != nil {
+			routes = append(routes, rt.mux.routes...)
+			continue
+		}
+		routes = append(routes, rt)
+	}
+	return routes
+}
+
+// commandMux looks up command routes by the first word of a message with a trie,
+// so that the cost of finding a command doesn't grow with the number of commands.
+type commandMux struct {
+	router *Router
+	routes []*route
+	root   commandNode
+}
+
+type commandNode struct {
+	children map[rune]*commandNode
+
+	// routes whose name ends at this node, in the order they were added.
+	routes []*route
+}
+
+func (mux *commandMux) add(rt *route, names []string) {
+	mux.routes = append(mux.routes, rt)
+	for _, name := range names {
+		n := &mux.root
+		for _, c := range strings.ToLower(name) {
+			if n.children == nil {
+				n.children = make(map[rune]*commandNode)
+			}
+			child, ok := n.children[c]
+			if !ok {
+				child = &commandNode{}
+				n.children[c] = child
+			}
+			n = child
+		}
+		n.routes = append(n.routes, rt)
+	}
+}
+
+// lookup returns the routes for the command word.
+// When the router allows abbreviated commands and word is not a full command name,
+// lookup returns the routes of the only command name starting with word, if there is exactly one.
+func (mux *commandMux) lookup(word string) []*route {
+	if word == "" {
+		return nil
+	}
+	n := &mux.root
+	for _, c := range strings.ToLower(word) {
+		if n = n.children[c]; n == nil {
+			return nil
+		}
+	}
+	if len(n.routes) > 0 || !mux.router.AbbreviatedCommands {
+		return n.routes
+	}
+	// a unique abbreviation has exactly one path below it, which leads to exactly one name
+	for len(n.routes) == 0 {
+		if len(n.children) != 1 {
+			return nil
+		}
+		for _, child := range n.children {
+			n = child
+		}
+	}
+	if len(n.children) > 0 {
+		// the abbreviation also starts a longer name, e.g. "!gr" for both "!greet" and "!greeting"
+		return nil
+	}
+	return n.routes
+}
+
+// find returns the first command route matching m, or nil if none match.
+func (mux *commandMux) find(m *Message) *route {
+	if !m.Command.is(CmdPrivmsg) {
+		return nil
+	}
+	for _, rt := range mux.lookup(commandWord(m)) {
+		if rt.matches(m) {
+			return rt
+		}
+	}
+	return nil
+}
+
+// commandWord returns the first word of the text of m.
+func commandWord(m *Message) string {
+	text, _ := m.Text()
+	word, _, _ := strings.Cut(text, " ")
+	return word
+}
+
+// commandWordMatch matches messages whose first word looks up to rt.
+// The command mux doesn't need it, but it keeps the route correct when it's tested on its own,
+// such as in traces.
+type commandWordMatch struct {
+	mux   *commandMux
+	rt    *route
+	names []string
+}
+
+func (cm commandWordMatch) matches(m *Message) bool {
+	for _, rt := range cm.mux.lookup(commandWord(m)) {
+		if rt == cm.rt {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,241 @@
+package irc
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"strings"
+)
+
+// RouteTrace describes how a Router handled a single message.
+// See Router.Trace.
+type RouteTrace struct {
+
+	// Message is the message which was routed.
+	Message *Message
+
+	// Tested lists the routes tested against the message, in order.
+	// Routes after the matching route are not tested.
+	Tested []RouteResult
+
+	// Handler identifies the handler of the matching route,
+	// or is empty if no route matched.
+	Handler string
+}
+
+// RouteResult is the result of testing a single route against a message.
+type RouteResult struct {
+
+	// Route is the position of the route in the router, starting at 0 for the first route added.
+	Route int
+
+	// Name is the name of the route, if it was given one with Name.
+	Name string
+
+	// Matched is true when every matcher of the route matched.
+	Matched bool
+
+	// FailedMatcher describes the first matcher which did not match the message.
+	// It is empty when the route matched.
+	FailedMatcher string
+}
+
+// String formats the trace for logging, e.g.:
+//
+//	PRIVMSG: route 0 failed (command is NOTICE); route 1 matched; handler main.handleGreet
+func (t RouteTrace) String() string {
+	var b strings.Builder
+	b.WriteString(t.Message.Command.String())
+	b.WriteString(":")
+	for i, r := range t.Tested {
+		if i > 0 {
+			b.WriteString(";")
+		}
+		if r.Matched {
+			fmt.Fprintf(&b, " route %d matched", r.Route)
+		} else {
+			fmt.Fprintf(&b, " route %d failed (%s)", r.Route, r.FailedMatcher)
+		}
+	}
+	if t.Handler == "" {
+		b.WriteString(" no route matched")
+	} else {
+		fmt.Fprintf(&b, "; handler %s", t.Handler)
+	}
+	return b.String()
+}
+
+// trace tests match against every route the same way SpeakIRC does and reports the results for m to r.Trace.
+// match differs from m when formatting is stripped before matching.
+func (r *Router) trace(m, match *Message) {
+	t := RouteTrace{Message: m}
+	for i, rt := range r.flatRoutes() {
+		result := RouteResult{Route: i, Name: rt.name}
+		if failed := rt.mismatch(match); failed != nil {
+			result.FailedMatcher = describeMatcher(failed)
+			t.Tested = append(t.Tested, result)
+			continue
+		}
+		if !r.available(rt, m, false) {
+			result.FailedMatcher = "channel overlay"
+			t.Tested = append(t.Tested, result)
+			continue
+		}
+		result.Matched = true
+		t.Tested = append(t.Tested, result)
+		t.Handler = rt.handler
+		break
+	}
+	r.Trace(t)
+}
+
+// RouteInfo describes a route of a Router.
+type RouteInfo struct {
+
+	// Name is the name given to the route with Name, if any.
+	Name string
+
+	// Command is the command the route handles.
+	Command Command
+
+	// Handler identifies the handler of the route, typically by function name.
+	Handler string
+
+	// Matchers describes each condition of the route, including the command.
+	Matchers []string
+
+	// Middlewares is the number of route-specific middleware.
+	Middlewares int
+
+	// Usage and Description are the help text given to the route with Help, if any.
+	Usage       string
+	Description string
+}
+
+// Routes returns a description of each route in r, in the order they are tested.
+// This is useful for administrative commands, and for generating help listings of bot commands.
+func (r *Router) Routes() []RouteInfo {
+	flat := r.flatRoutes()
+	routes := make([]RouteInfo, 0, len(flat))
+	for _, rt := range flat {
+		info := RouteInfo{
+			Name:        rt.name,
+			Command:     rt.cmd,
+			Handler:     rt.handler,
+			Middlewares: rt.middlewares,
+			Usage:       rt.usage,
+			Description: rt.description,
+		}
+		for _, m := range rt.matchers {
+			info.Matchers = append(info.Matchers, describeMatcher(m))
+		}
+		routes = append(routes, info)
+	}
+	return routes
+}
+
+// DumpRoutes returns a listing of the routes in r, one per line, in the order they are tested.
+// Each line lists the route's handler, matchers, and the number of route middleware, e.g.:
+//
+//	0: main.handleGreet [command is PRIVMSG, text matches "!greet &"] (1 middleware)
+//	1: "quit" main.handleQuit [command is PRIVMSG, text matches "!quit"] (0 middleware)
+func (r *Router) DumpRoutes() string {
+	var b strings.Builder
+	for i, rt := range r.Routes() {
+		fmt.Fprintf(&b, "%d: ", i)
+		if rt.Name != "" {
+			fmt.Fprintf(&b, "%q ", rt.Name)
+		}
+		fmt.Fprintf(&b, "%s [%s] (%d middleware)\n", rt.Handler, strings.Join(rt.Matchers, ", "), rt.Middlewares)
+	}
+	if len(r.middlewares) > 0 {
+		fmt.Fprintf(&b, "global middleware: %d\n", len(r.middlewares))
+	}
+	return b.String()
+}
+
+// describeMatcher returns a human-readable description of m.
+// Matchers which implement fmt.Stringer describe themselves.
+func describeMatcher(m matcher) string {
+	if s, ok := m.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("%T", m)
+}
+
+// handlerName returns the name of the function behind h,
+// or the type name of h if it is not a function.
+func handlerName(h Handler) string {
+	if f, ok := h.(HandlerFunc); ok && f != nil {
+		return funcName(f)
+	}
+	return fmt.Sprintf("%T", h)
+}
+
+// funcName returns the name of the function f, or its type name if the name isn't known.
+func funcName(f any) string {
+	if fn := runtime.FuncForPC(reflect.ValueOf(f).Pointer()); fn != nil {
+		return fn.Name()
+	}
+	return fmt.Sprintf("%T", f)
+}
+
+func (cm commandMatch) String() string {
+	return "command is " + cm.cmd.String()
+}
+
+func (cm commandsMatch) String() string {
+	cmds := make([]string, len(cm))
+	for i, cmd := range cm {
+		cmds[i] = cmd.String()
+	}
+	return "command is one of " + strings.Join(cmds, ", ")
+}
+
+func (rm regexMatch) String() string {
+	if rm.wild {
+		var flags string
+		if rm.caseSensitive {
+			flags += " (case-sensitive)"
+		}
+		switch rm.anchor {
+		case AnchorPrefix:
+			flags += " (prefix)"
+		case AnchorNone:
+			flags += " (anywhere)"
+		}
+		return fmt.Sprintf("text matches %q%s", rm.wildtext, flags)
+	}
+	return fmt.Sprintf("text matches regexp %q", rm.re.String())
+}
+
+func (sm *submatchMatch) String() string {
+	return fmt.Sprintf("text matches regexp %q", sm.re.String())
+}
+
+func (cm commandWordMatch) String() string {
+	return "first word is " + strings.Join(cm.names, " or ")
+}
+
+func (cm channelMatch) String() string {
+	return "channel is " + cm.channel
+}
+
+func (tm tagMatch) String() string {
+	if tm.value == "" {
+		return "has tag " + tm.key
+	}
+	return fmt.Sprintf("tag %s matches %q", tm.key, tm.value)
+}
+
+func (f matcherFunc) String() string {
+	return "custom matcher " + runtime.FuncForPC(reflect.ValueOf(f).Pointer()).Name()
+}
+
+func (ma *matchAny) String() string {
+	descriptions := make([]string, 0, len(ma.matchers))
+	for _, m := range ma.matchers {
+		descriptions = append(descriptions, describeMatcher(m))
+	}
+	return "any of (" + strings.Join(descriptions, ", ") + ")"
+}
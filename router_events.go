@@ -0,0 +1,217 @@
+package irc
+
+import "fmt"
+
+// Event is implemented by pointers to the typed events, such as *PrivmsgEvent.
+// Packages may define their own events by implementing Event, and use them with On and Decode.
+type Event interface {
+
+	// Command is the command of the messages that the event is decoded from.
+	Command() Command
+
+	// Decode sets the fields of the event from m,
+	// or returns an error if m is not a well formed message of the event's command.
+	Decode(m *Message) error
+}
+
+// eventPointer is satisfied by *E when *E implements Event.
+type eventPointer[E any] interface {
+	*E
+	Event
+}
+
+// On attaches the handler h to r for the messages which decode into events of type E.
+// Messages which don't decode, e.g. because they're missing parameters, are left for later routes.
+//
+//	irc.On(r, func(w irc.MessageWriter, e *irc.JoinEvent) {
+//		w.WriteMessage(irc.Msg(e.Channel, "welcome, "+e.Sender.Nick.String()))
+//	})
+func On[E any, P eventPointer[E]](r *Router, h func(MessageWriter, P)) *route {
+	adapter := func(w MessageWriter, m *Message) {
+		if e, err := Decode[E, P](m); err == nil {
+			h(w, e)
+		}
+	}
+	rt := r.HandleFunc(P(new(E)).Command(), adapter).Matcher(eventMatch[E, P]{})
+	rt.handler = funcName(h)
+	return rt
+}
+
+// Decode decodes m into a new event of type E.
+//
+//	join, err := irc.Decode[irc.JoinEvent](m)
+func Decode[E any, P eventPointer[E]](m *Message) (P, error) {
+	e := P(new(E))
+	if err := e.Decode(m); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// eventMatch matches messages which can be decoded into an event of type E.
+type eventMatch[E any, P eventPointer[E]] struct{}
+
+func (eventMatch[E, P]) matches(m *Message) bool {
+	return P(new(E)).Decode(m) == nil
+}
+
+func (eventMatch[E, P]) String() string {
+	return fmt.Sprintf("decodes as %T", P(new(E)))
+}
+
+// OnPrivmsgEvent attaches a handler for PRIVMSG events, decoded as a PrivmsgEvent.
+//
+//	r.OnPrivmsgEvent(func(w irc.MessageWriter, e *irc.PrivmsgEvent) {
+//		if e.Channel == "" {
+//			w.WriteMessage(irc.Msg(e.Sender.Nick.String(), "I only talk in channels"))
+//		}
+//	})
+func (r *Router) OnPrivmsgEvent(h func(MessageWriter, *PrivmsgEvent)) *route {
+	return On(r, h)
+}
+
+// OnNoticeEvent attaches a handler for NOTICE events, decoded as a NoticeEvent.
+// Unlike OnNotice, server notices are included.
+func (r *Router) OnNoticeEvent(h func(MessageWriter, *NoticeEvent)) *route {
+	return On(r, h)
+}
+
+// OnJoinEvent attaches a handler for JOIN events, decoded as a JoinEvent.
+func (r *Router) OnJoinEvent(h func(MessageWriter, *JoinEvent)) *route {
+	return On(r, h)
+}
+
+// OnPartEvent attaches a handler for PART events, decoded as a PartEvent.
+func (r *Router) OnPartEvent(h func(MessageWriter, *PartEvent)) *route {
+	return On(r, h)
+}
+
+// OnKickEvent attaches a handler for KICK events, decoded as a KickEvent.
+func (r *Router) OnKickEvent(h func(MessageWriter, *KickEvent)) *route {
+	return On(r, h)
+}
+
+// OnQuitEvent attaches a handler for QUIT events, decoded as a QuitEvent.
+func (r *Router) OnQuitEvent(h func(MessageWriter, *QuitEvent)) *route {
+	return On(r, h)
+}
+
+// OnNickEvent attaches a handler for NICK events, decoded as a NickEvent.
+func (r *Router) OnNickEvent(h func(MessageWriter, *NickEvent)) *route {
+	return On(r, h)
+}
+
+// OnTopicEvent attaches a handler for TOPIC events, decoded as a TopicEvent.
+func (r *Router) OnTopicEvent(h func(MessageWriter, *TopicEvent)) *route {
+	return On(r, h)
+}
+
+// OnModeEvent attaches a handler for MODE events, decoded as a ModeEvent.
+func (r *Router) OnModeEvent(h func(MessageWriter, *ModeEvent)) *route {
+	return On(r, h)
+}
+
+// OnBurstEvent attaches a handler for the bursts of JOIN, PART, and QUIT messages coalesced by a BurstCoalescer,
+// decoded as a BurstEvent.
+func (r *Router) OnBurstEvent(h func(MessageWriter, *BurstEvent)) *route {
+	return On(r, h)
+}
+
+// PrefixEvent is a change of a member's membership prefix, such as a user being opped, split out of a MODE message.
+// A MODE which changes several prefixes, like "+oo alice bob", is handled as one PrefixEvent for each.
+type PrefixEvent struct {
+	Message *Message
+
+	// Sender is whoever changed the mode.
+	Sender  Prefix
+	Channel string
+	Nick    Nickname
+
+	// Mode is the mode of the prefix, e.g. 'o' for channel operators or 'v' for voice.
+	Mode rune
+
+	// Added is true when the prefix was given, and false when it was taken away.
+	Added bool
+}
+
+// OnPrefix attaches a handler for changes of the membership prefix of mode, e.g. 'h' for half-operators.
+// With added, h is called when the prefix is given to a member, and otherwise when it's taken away.
+//
+// MODE messages are split into single changes with the CHANMODES and PREFIX tokens of the bound client's server
+// (see BindClient), or the RFC 1459 modes when the router has no client bound.
+func (r *Router) OnPrefix(mode rune, added bool, h func(MessageWriter, *PrefixEvent)) *route {
+	adapter := func(w MessageWriter, m *Message) {
+		for _, e := range r.prefixEvents(m, mode, added) {
+			h(w, e)
+		}
+	}
+	rt := r.HandleFunc(CmdMode, adapter).MatchFunc(func(m *Message) bool {
+		return len(r.prefixEvents(m, mode, added)) > 0
+	})
+	rt.handler = funcName(h)
+	return rt
+}
+
+// OnOp attaches a handler which is called when a member of a channel is given channel operator status (+o).
+func (r *Router) OnOp(h func(MessageWriter, *PrefixEvent)) *route {
+	return r.OnPrefix('o', true, h)
+}
+
+// OnDeop attaches a handler which is called when a member of a channel loses channel operator status (-o).
+func (r *Router) OnDeop(h func(MessageWriter, *PrefixEvent)) *route {
+	return r.OnPrefix('o', false, h)
+}
+
+// OnVoice attaches a handler which is called when a member of a channel is voiced (+v).
+func (r *Router) OnVoice(h func(MessageWriter, *PrefixEvent)) *route {
+	return r.OnPrefix('v', true, h)
+}
+
+// OnDevoice attaches a handler which is called when a member of a channel is devoiced (-v).
+func (r *Router) OnDevoice(h func(MessageWriter, *PrefixEvent)) *route {
+	return r.OnPrefix('v', false, h)
+}
+
+// prefixEvents returns the changes of the membership prefix of mode in the channel MODE m, in order.
+func (r *Router) prefixEvents(m *Message, mode rune, added bool) []*PrefixEvent {
+	if !m.Command.is(CmdMode) || channelOf(m.Params.Get(1)) == "" || len(m.Params) < 2 {
+		return nil
+	}
+	var events []*PrefixEvent
+	for _, mc := range r.serverModes().split(m.Params.Get(2), m.Params[2:]) {
+		if mc.Mode != mode || mc.Add != added || mc.Param == "" {
+			continue
+		}
+		events = append(events, &PrefixEvent{
+			Message: m,
+			Sender:  m.Source,
+			Channel: m.Params.Get(1),
+			Nick:    Nickname(mc.Param),
+			Mode:    mode,
+			Added:   added,
+		})
+	}
+	return events
+}
+
+// serverModes returns the channel modes of the bound client's server, or the defaults.
+func (r *Router) serverModes() serverModes {
+	if is, ok := r.client.(interface{ ISupport(string) (string, bool) }); ok {
+		return serverModesOf(is.ISupport)
+	}
+	return serverModesOf(nil)
+}
+
+// caseMapping returns the CASEMAPPING token of the bound client's server, or "" (rfc1459) without one.
+func (r *Router) caseMapping() string {
+	if is, ok := r.client.(interface{ ISupport(string) (string, bool) }); ok {
+		casemapping, _ := is.ISupport("CASEMAPPING")
+		return casemapping
+	}
+	return ""
+}
+
+// fold returns the nickname or channel name s in lowercase, according to caseMapping.
+func (r *Router) fold(s string) string {
+	return foldNick(s, r.caseMapping())
+}
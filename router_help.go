@@ -0,0 +1,116 @@
+package irc
+
+import (
+	"strings"
+)
+
+// helpLineLength is the maximum length of the text of each help reply.
+// It is well below the IRC line limit to leave room for the prefix and target that servers add when relaying.
+const helpLineLength = 300
+
+// HelpHandler returns a handler which replies to the sender of a message with the help text
+// of the routes in r (see the Help method of routes).
+// Routes without help text are not listed.
+//
+// Without arguments, the handler lists the usage of every route, split across as many NOTICE messages as needed.
+// With an argument, e.g. "!help greet", it replies with the usage and description of the routes
+// whose name or usage matches the argument.
+//
+// When allowed is not nil, routes are only listed when allowed returns true for the requesting message,
+// so that users are not shown commands they aren't permitted to use.
+//
+//	r.OnText("!help", r.HelpHandler(nil))
+//	r.OnText("!help &", r.HelpHandler(nil))
+func (r *Router) HelpHandler(allowed func(m *Message, rt RouteInfo) bool) HandlerFunc {
+	return func(w MessageWriter, m *Message) {
+		text, _ := m.Text()
+		fields := strings.Fields(text)
+
+		var routes []RouteInfo
+		for _, rt := range r.Routes() {
+			if rt.Usage == "" {
+				continue
+			}
+			if allowed != nil && !allowed(m, rt) {
+				continue
+			}
+			routes = append(routes, rt)
+		}
+
+		reply := func(text string) {
+			w.WriteMessage(Notice(string(m.Source.Nick), text))
+		}
+
+		if len(fields) < 2 {
+			if len(routes) == 0 {
+				reply("No commands available.")
+				return
+			}
+			usages := make([]string, 0, len(routes))
+			for _, rt := range routes {
+				usages = append(usages, rt.Usage)
+			}
+			for _, line := range joinLines(usages, ", ", helpLineLength) {
+				reply(line)
+			}
+			return
+		}
+
+		topic := fields[1]
+		found := false
+		for _, rt := range routes {
+			if !helpTopicMatches(rt, topic) {
+				continue
+			}
+			found = true
+			if rt.Description == "" {
+				reply(rt.Usage)
+			} else {
+				reply(rt.Usage + " - " + rt.Description)
+			}
+		}
+		if !found {
+			reply("No help available for " + topic + ".")
+		}
+	}
+}
+
+// helpTopicMatches reports whether topic refers to rt, either by route name or by the first word of its usage.
+// A leading command character such as '!' is optional, so "!help greet" and "!help !greet" are equivalent.
+func helpTopicMatches(rt RouteInfo, topic string) bool {
+	if rt.Name != "" && strings.EqualFold(rt.Name, topic) {
+		return true
+	}
+	word, _, _ := strings.Cut(rt.Usage, " ")
+	if strings.EqualFold(word, topic) {
+		return true
+	}
+	return len(word) > 1 && !isAlnum(word[0]) && strings.EqualFold(word[1:], topic)
+}
+
+func isAlnum(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// joinLines joins items with sep into lines which are at most max bytes long.
+// Items longer than max are placed on their own line.
+func joinLines(items []string, sep string, max int) []string {
+	var (
+		lines []string
+		b     strings.Builder
+	)
+	for _, item := range items {
+		if b.Len() > 0 && b.Len()+len(sep)+len(item) > max {
+			lines = append(lines, b.String())
+			b.Reset()
+		}
+		if b.Len() > 0 {
+			b.WriteString(sep)
+		}
+		b.WriteString(item)
+	}
+	if b.Len() > 0 {
+		lines = append(lines, b.String())
+	}
+	return lines
+}
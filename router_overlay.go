@@ -0,0 +1,204 @@
+package irc
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// A ChannelOverlay changes how a Router behaves in one channel, so that the same bot can behave differently
+// in #general and #dev without a second Router: which routes are available, and how often they may run.
+//
+// Routes are listed by their name (see the Name method of routes), or for command routes, by any of their command names:
+//
+//	r.OnCommand("!roll", roll)
+//	r.OnText("*lunch*", lunch).Name("lunch")
+//	r.SetOverlay("#general", irc.ChannelOverlay{
+//		Disable:   []string{"lunch"},
+//		Cooldowns: map[string]time.Duration{"!roll": 30 * time.Second},
+//	})
+//
+// A route which isn't available for a message is skipped as if it didn't match,
+// so a later route may handle the message instead.
+type ChannelOverlay struct {
+
+	// Only lists the routes available in the channel. If empty, every route is available unless it's disabled.
+	// Routes with neither a name nor command names can't be listed, so Only doesn't apply to them.
+	Only []string
+
+	// Disable lists the routes which are not available in the channel.
+	Disable []string
+
+	// Cooldowns maps routes to how long they're unavailable in the channel after they run.
+	Cooldowns map[string]time.Duration
+}
+
+// channelOverlay is a ChannelOverlay in use, with the times its routes last ran.
+type channelOverlay struct {
+	ChannelOverlay
+	lastRun map[*route]time.Time
+}
+
+// SetOverlay sets the overlay of channel, replacing any previous overlay of channel.
+// Overlays may be changed at any time, including from handlers.
+//
+// Channel names are compared with the CASEMAPPING of the bound client's server (see BindClient), as the client does,
+// or rfc1459 when the router has no client bound.
+func (r *Router) SetOverlay(channel string, o ChannelOverlay) {
+	r.overlayMu.Lock()
+	defer r.overlayMu.Unlock()
+	if r.overlays == nil {
+		r.overlays = make(map[string]*channelOverlay)
+	}
+	key := r.fold(channel)
+	lastRun := make(map[*route]time.Time)
+	if old, ok := r.overlays[key]; ok {
+		lastRun = old.lastRun
+	}
+	r.overlays[key] = &channelOverlay{ChannelOverlay: o, lastRun: lastRun}
+}
+
+// RemoveOverlay removes the overlay of channel, making every route available there again.
+func (r *Router) RemoveOverlay(channel string) {
+	r.overlayMu.Lock()
+	defer r.overlayMu.Unlock()
+	delete(r.overlays, r.fold(channel))
+}
+
+// Overlay returns the overlay of channel, and whether it has one.
+func (r *Router) Overlay(channel string) (ChannelOverlay, bool) {
+	r.overlayMu.RLock()
+	defer r.overlayMu.RUnlock()
+	o, ok := r.overlays[r.fold(channel)]
+	if !ok {
+		return ChannelOverlay{}, false
+	}
+	return o.ChannelOverlay, true
+}
+
+// available reports whether the overlay of the channel m was sent to allows rt to handle m.
+// When run is true and rt is available, rt is recorded as running now, which starts its cooldown.
+func (r *Router) available(rt *route, m *Message, run bool) bool {
+	r.overlayMu.RLock()
+	if len(r.overlays) == 0 {
+		r.overlayMu.RUnlock()
+		return true
+	}
+	channel := channelOf(m.Params.Get(1))
+	o, ok := r.overlays[r.fold(channel)]
+	r.overlayMu.RUnlock()
+	if channel == "" || !ok {
+		return true
+	}
+
+	ids := rt.ids()
+	if len(o.Only) > 0 && len(ids) > 0 && !listsRoute(o.Only, ids) {
+		return false
+	}
+	if listsRoute(o.Disable, ids) {
+		return false
+	}
+	var cooldown time.Duration
+	for _, id := range ids {
+		for name, d := range o.Cooldowns {
+			if strings.EqualFold(name, id) && d > cooldown {
+				cooldown = d
+			}
+		}
+	}
+	if cooldown <= 0 {
+		return true
+	}
+
+	r.overlayMu.Lock()
+	defer r.overlayMu.Unlock()
+	now := time.Now()
+	if last, ok := o.lastRun[rt]; ok && now.Sub(last) < cooldown {
+		return false
+	}
+	if run {
+		o.lastRun[rt] = now
+	}
+	return true
+}
+
+// Snapshot implements Snapshotter, so that the cooldowns of channel overlays survive a restart.
+// Overlays themselves aren't included; they're usually set from configuration at startup.
+func (r *Router) Snapshot() ([]byte, error) {
+	keys := r.routeKeys()
+	r.overlayMu.RLock()
+	defer r.overlayMu.RUnlock()
+	snap := make(map[string]map[string]time.Time)
+	for channel, o := range r.overlays {
+		for rt, t := range o.lastRun {
+			key, ok := keys[rt]
+			if !ok {
+				continue
+			}
+			if snap[channel] == nil {
+				snap[channel] = make(map[string]time.Time)
+			}
+			snap[channel][key] = t
+		}
+	}
+	return json.Marshal(snap)
+}
+
+// Restore implements Snapshotter.
+// Routes and overlays must be added before Restore is called: cooldowns are only restored
+// for channels which have an overlay, and for routes which still exist.
+func (r *Router) Restore(data []byte) error {
+	var snap map[string]map[string]time.Time
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return err
+	}
+	keys := r.routeKeys()
+	r.overlayMu.Lock()
+	defer r.overlayMu.Unlock()
+	for channel, o := range r.overlays {
+		runs := snap[channel]
+		for rt, key := range keys {
+			if t, ok := runs[key]; ok {
+				o.lastRun[rt] = t
+			}
+		}
+	}
+	return nil
+}
+
+// routeKeys returns the key of each route in a snapshot: the first name it can be listed by in a ChannelOverlay.
+// Routes without a name are left out, since they can't have a cooldown,
+// and keying them by their position would restore cooldowns to other routes after routes are added or removed.
+func (r *Router) routeKeys() map[*route]string {
+	keys := make(map[*route]string)
+	for _, rt := range r.flatRoutes() {
+		if ids := rt.ids(); len(ids) > 0 {
+			keys[rt] = ids[0]
+		}
+	}
+	return keys
+}
+
+// ids returns the names by which rt can be listed in a ChannelOverlay: its name and its command names.
+func (rt *route) ids() []string {
+	var ids []string
+	if rt.name != "" {
+		ids = append(ids, rt.name)
+	}
+	for _, rm := range rt.matchers {
+		if cm, ok := rm.(*commandWordMatch); ok {
+			ids = append(ids, cm.names...)
+		}
+	}
+	return ids
+}
+
+// listsRoute reports whether list contains any of ids.
+func listsRoute(list, ids []string) bool {
+	for _, id := range ids {
+		if containsFold(list, id) {
+			return true
+		}
+	}
+	return false
+}
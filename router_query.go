@@ -0,0 +1,90 @@
+package irc
+
+import "log"
+
+// BindClient gives the router a way to know the client's current nickname,
+// which is needed by matchers such as MatchQuery and MatchToMe.
+// Client.ConnectAndRun binds itself to a Router passed as its handler if no client was bound yet,
+// so BindClient is only needed when the router is wrapped in another handler.
+func (r *Router) BindClient(client nickTracker) {
+	r.client = client
+}
+
+// nick returns the current nickname of the bound client.
+// Without a bound client it returns false, so that the matchers which need the nickname never match,
+// and the mistake is logged once.
+func (r *Router) nick() (Nickname, bool) {
+	if r.client == nil {
+		r.unbound.Do(func() {
+			log.Print("irc: the router has no client bound; call Router.BindClient to use matchers that need the client's current nickname")
+		})
+		return "", false
+	}
+	return r.client.Nick(), true
+}
+
+// OnQuery attaches the handler h for private messages sent directly to the client (queries) that match wildtext.
+// See OnText for the wildcard syntax.
+func (r *Router) OnQuery(wildtext string, h HandlerFunc) *route {
+	return r.OnText(wildtext, h).MatchQuery()
+}
+
+// MatchQuery limits the route to messages sent directly to the client rather than to a channel.
+// The router must know the client's nickname; see BindClient.
+func (r *route) MatchQuery() *route {
+	return r.Matcher(queryMatch{r.router})
+}
+
+// MatchToMe limits the route to messages meant for the client:
+// queries, and channel messages which begin by addressing the client's nickname,
+// as in "bot: hello" or "bot, hello".
+// The router must know the client's nickname; see BindClient.
+func (r *route) MatchToMe() *route {
+	return r.Matcher(toMeMatch{r.router})
+}
+
+type queryMatch struct {
+	router *Router
+}
+
+func (qm queryMatch) matches(m *Message) bool {
+	target, err := m.Target()
+	if err != nil {
+		return false
+	}
+	nick, ok := qm.router.nick()
+	return ok && nick.Is(target)
+}
+
+func (qm queryMatch) String() string {
+	return "sent to the client"
+}
+
+type toMeMatch struct {
+	router *Router
+}
+
+func (tm toMeMatch) matches(m *Message) bool {
+	if (queryMatch{tm.router}).matches(m) {
+		return true
+	}
+	text, err := m.Text()
+	if err != nil {
+		return false
+	}
+	nick, ok := tm.router.nick()
+	return ok && addressedTo(text, nick)
+}
+
+func (tm toMeMatch) String() string {
+	return "sent to or addressing the client"
+}
+
+// addressedTo reports whether text begins with nick followed by ':' or ',', the usual way of addressing someone in a channel.
+func addressedTo(text string, nick Nickname) bool {
+	n := len(nick.String())
+	if n == 0 || len(text) <= n || !nick.Is(text[:n]) {
+		return false
+	}
+	return text[n] == ':' || text[n] == ','
+}
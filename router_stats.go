@@ -0,0 +1,126 @@
+package irc
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// StatsProvider is implemented by types which report routing statistics, such as Router.
+// Metrics adapters (e.g. a Prometheus collector) can poll Stats whenever they're scraped.
+type StatsProvider interface {
+	Stats() RouterStats
+}
+
+// RouterStats is a snapshot of the statistics collected by a Router.
+// See Router.CollectStats.
+type RouterStats struct {
+
+	// Routes contains the statistics of each route, in the same order as Router.Routes.
+	Routes []RouteStats
+
+	// Unmatched is the number of messages which did not match any route.
+	Unmatched uint64
+}
+
+// RouteStats is a snapshot of the statistics of a single route.
+type RouteStats struct {
+
+	// Route is the position of the route, as in RouteResult.
+	Route int
+
+	// Name and Handler identify the route, as in RouteInfo.
+	Name    string
+	Handler string
+
+	// Matched is the number of messages which matched the route.
+	Matched uint64
+
+	// Calls is the number of times the route handler ran.
+	// It's lower than Matched while the handler is running, since a call is counted when it returns.
+	Calls uint64
+
+	// TotalDuration and MaxDuration summarize how long the route handler took, including route middleware.
+	// The average duration is TotalDuration divided by Calls.
+	TotalDuration time.Duration
+	MaxDuration   time.Duration
+
+	// Panics is the number of times the route handler panicked.
+	Panics uint64
+
+	// LastPanic is the value of the most recent panic formatted as a string, and LastPanicTime is when it happened.
+	LastPanic     string
+	LastPanicTime time.Time
+}
+
+// Stats returns a snapshot of the statistics collected for r while CollectStats was enabled.
+func (r *Router) Stats() RouterStats {
+	stats := RouterStats{}
+	r.stats.mu.Lock()
+	stats.Unmatched = r.stats.unmatchedCount
+	r.stats.mu.Unlock()
+
+	for i, rt := range r.flatRoutes() {
+		rt.stats.mu.Lock()
+		s := rt.stats.RouteStats
+		rt.stats.mu.Unlock()
+
+		s.Route = i
+		s.Name = rt.name
+		s.Handler = rt.handler
+		stats.Routes = append(stats.Routes, s)
+	}
+	return stats
+}
+
+type routerStats struct {
+	mu             sync.Mutex
+	unmatchedCount uint64
+}
+
+func (rs *routerStats) unmatched() {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.unmatchedCount++
+}
+
+type routeStats struct {
+	mu sync.Mutex
+	RouteStats
+}
+
+func (rs *routeStats) match() {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.Matched++
+}
+
+// instrument returns h wrapped to record its duration and panics.
+// Panics are recorded, and then continue as if h was not wrapped.
+func (rs *routeStats) instrument(h Handler) Handler {
+	return HandlerFunc(func(mw MessageWriter, m *Message) {
+		start := time.Now()
+		defer func() {
+			p := recover()
+			d := time.Since(start)
+
+			rs.mu.Lock()
+			rs.Calls++
+			rs.TotalDuration += d
+			if d > rs.MaxDuration {
+				rs.MaxDuration = d
+			}
+			if p != nil {
+				rs.Panics++
+				rs.LastPanic = fmt.Sprint(p)
+				rs.LastPanicTime = time.Now()
+			}
+			rs.mu.Unlock()
+
+			if p != nil {
+				panic(p)
+			}
+		}()
+		h.SpeakIRC(mw, m)
+	})
+}
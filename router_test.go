@@ -1,18 +1,21 @@
 package irc_test
 
 import (
-	"encoding"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/Travis-Britz/irc"
+	"github.com/Travis-Britz/irc/irctest"
 )
 
-var discard = discarder{}
-
-type discarder struct{}
-
-func (d discarder) WriteMessage(marshaler encoding.TextMarshaler) {}
-
 func TestRouter_Handle(t *testing.T) {
 	var callCount int
 	h := func(w irc.MessageWriter, m *irc.Message) {
@@ -23,7 +26,7 @@ func TestRouter_Handle(t *testing.T) {
 	r.HandleFunc(irc.CmdNotice, h)
 
 	m := irc.Msg("#foo", "!test does this work")
-	r.SpeakIRC(discard, m)
+	r.SpeakIRC(irctest.Discard, m)
 	if callCount != 1 {
 		t.Errorf("expected handler to be callCount once; callCount %v times", callCount)
 	}
@@ -83,7 +86,7 @@ func TestRouter_OnText(t *testing.T) {
 				}
 				router := &irc.Router{}
 				router.OnText(tc.wildcard, handler)
-				router.SpeakIRC(discard, irc.Msg("#foo", given))
+				router.SpeakIRC(irctest.Discard, irc.Msg("#foo", given))
 				if !called {
 					t.Errorf("expected handler to be called: %q, text: %q", tc.wildcard, given)
 				}
@@ -95,7 +98,7 @@ func TestRouter_OnText(t *testing.T) {
 				}
 				router := &irc.Router{}
 				router.OnText(tc.wildcard, handler)
-				router.SpeakIRC(discard, irc.Notice("#foo", given))
+				router.SpeakIRC(irctest.Discard, irc.Notice("#foo", given))
 				if called {
 					t.Errorf("router matched text for NOTICE when it was supposed to only match PRIVMSG")
 				}
@@ -107,7 +110,7 @@ func TestRouter_OnText(t *testing.T) {
 				}
 				router := &irc.Router{}
 				router.OnText(tc.wildcard, handler)
-				router.SpeakIRC(discard, irc.Msg("#foo", given))
+				router.SpeakIRC(irctest.Discard, irc.Msg("#foo", given))
 				if called {
 					t.Errorf("text matched wildcard when it was not supposed to; wildcard: %q, text: %q", tc.wildcard, given)
 				}
@@ -115,3 +118,858 @@ func TestRouter_OnText(t *testing.T) {
 		})
 	}
 }
+
+func handleGreet(w irc.MessageWriter, m *irc.Message) {}
+
+func TestRouter_Trace(t *testing.T) {
+	var traces []irc.RouteTrace
+	r := &irc.Router{Trace: func(rt irc.RouteTrace) {
+		traces = append(traces, rt)
+	}}
+	r.HandleFunc(irc.CmdNotice, func(w irc.MessageWriter, m *irc.Message) {})
+	r.OnText("!greet &", handleGreet).MatchChan("#foo")
+
+	r.SpeakIRC(irctest.Discard, irc.Msg("#bar", "!greet bob"))
+	r.SpeakIRC(irctest.Discard, irc.Msg("#foo", "!greet bob"))
+
+	if len(traces) != 2 {
+		t.Fatalf("expected 2 traces; got %d", len(traces))
+	}
+	missed := traces[0]
+	if missed.Handler != "" || len(missed.Tested) != 2 {
+		t.Errorf("expected no handler after testing 2 routes; got %+v", missed)
+	} else if missed.Tested[0].FailedMatcher != "command is NOTICE" || missed.Tested[1].FailedMatcher != "channel is #foo" {
+		t.Errorf("unexpected failed matchers: %+v", missed.Tested)
+	}
+	matched := traces[1]
+	if !strings.HasSuffix(matched.Handler, ".handleGreet") || !matched.Tested[1].Matched {
+		t.Errorf("expected handleGreet to be matched; got %+v", matched)
+	}
+}
+
+func TestRouter_DumpRoutes(t *testing.T) {
+	r := &irc.Router{}
+	r.OnText("!greet &", handleGreet).Use(func(next irc.Handler) irc.Handler { return next })
+	expected := `0: github.com/Travis-Britz/irc_test.handleGreet [command is PRIVMSG, text matches "!greet &"] (1 middleware)` + "\n"
+	if got := r.DumpRoutes(); got != expected {
+		t.Errorf("expected %q; got %q", expected, got)
+	}
+}
+
+func TestRouter_Routes(t *testing.T) {
+	r := &irc.Router{}
+	r.OnText("!greet &", handleGreet).Name("greet")
+	r.OnJoin(handleGreet)
+
+	routes := r.Routes()
+	if len(routes) != 2 {
+		t.Fatalf("expected 2 routes; got %d", len(routes))
+	}
+	if routes[0].Name != "greet" || routes[0].Command != irc.CmdPrivmsg || len(routes[0].Matchers) != 2 {
+		t.Errorf("unexpected info for first route: %+v", routes[0])
+	}
+	if routes[1].Name != "" || routes[1].Command != irc.CmdJoin {
+		t.Errorf("unexpected info for second route: %+v", routes[1])
+	}
+}
+
+func TestRouter_HelpHandler(t *testing.T) {
+	r := &irc.Router{}
+	r.OnText("!greet &", handleGreet).Name("greet").Help("!greet <nick>", "says hello to nick")
+	r.OnText("!quit", handleGreet).Name("quit").Help("!quit", "disconnects the bot")
+	r.OnText("!secret", handleGreet)
+	help := r.HelpHandler(func(m *irc.Message, rt irc.RouteInfo) bool {
+		return rt.Name != "quit"
+	})
+
+	tt := []struct {
+		text string
+		want []string
+	}{
+		{"!help", []string{"!greet <nick>"}},
+		{"!help greet", []string{"!greet <nick> - says hello to nick"}},
+		{"!help !greet", []string{"!greet <nick> - says hello to nick"}},
+		{"!help quit", []string{"No help available for quit."}},
+	}
+	for _, tc := range tt {
+		rec := &irctest.RecordingWriter{}
+		m := irc.Msg("#foo", tc.text)
+		m.Source = irc.Prefix{Nick: "bob", User: "bob", Host: "example.com"}
+		help(rec, m)
+
+		var got []string
+		for _, reply := range rec.Messages() {
+			if reply.Command != irc.CmdNotice || reply.Params.Get(1) != "bob" {
+				t.Errorf("%q: expected a notice to bob; got %v", tc.text, reply)
+			}
+			got = append(got, reply.Params.Get(2))
+		}
+		if strings.Join(got, "\n") != strings.Join(tc.want, "\n") {
+			t.Errorf("%q: expected replies %q; got %q", tc.text, tc.want, got)
+		}
+	}
+}
+
+func TestRouter_HelpHandler_paginates(t *testing.T) {
+	r := &irc.Router{}
+	for i := 0; i < 100; i++ {
+		r.OnText("!command", handleGreet).Help("!command"+strings.Repeat("x", i%10), "")
+	}
+	rec := &irctest.RecordingWriter{}
+	r.HelpHandler(nil)(rec, irc.Msg("#foo", "!help"))
+	if len(rec.Messages()) < 2 {
+		t.Fatalf("expected the listing to be split into multiple replies; got %d", len(rec.Messages()))
+	}
+	for _, reply := range rec.Messages() {
+		if l := len(reply.Params.Get(2)); l > 300 {
+			t.Errorf("reply is %d bytes long", l)
+		}
+	}
+}
+
+func TestRouter_StripFormatting(t *testing.T) {
+	var got string
+	r := &irc.Router{StripFormatting: true}
+	r.OnText("!greet &", func(w irc.MessageWriter, m *irc.Message) {
+		got, _ = m.Text()
+	})
+
+	given := "\x02!greet\x02 \x0304bob"
+	r.SpeakIRC(irctest.Discard, irc.Msg("#foo", given))
+	if got != given {
+		t.Errorf("expected the handler to receive %q; got %q", given, got)
+	}
+}
+
+func TestRouter_OnText_options(t *testing.T) {
+	tt := []struct {
+		name  string
+		route func(r *irc.Router, h irc.HandlerFunc)
+		pass  []string
+		fail  []string
+	}{{
+		"case-insensitive by default",
+		func(r *irc.Router, h irc.HandlerFunc) { r.OnText("!greet &", h) },
+		[]string{"!greet bob", "!GREET bob", "!Greet Bob"},
+		[]string{"!greeting bob"},
+	}, {
+		"case-sensitive",
+		func(r *irc.Router, h irc.HandlerFunc) { r.OnText("!greet &", h).CaseSensitive() },
+		[]string{"!greet bob", "!greet BOB"},
+		[]string{"!GREET bob", "!Greet bob"},
+	}, {
+		"unicode case folding",
+		func(r *irc.Router, h irc.HandlerFunc) { r.OnText("!école", h) },
+		[]string{"!école", "!ÉCOLE"},
+		[]string{"!ecole"},
+	}, {
+		"question mark matches one unicode character",
+		func(r *irc.Router, h irc.HandlerFunc) { r.OnText("caf?", h) },
+		[]string{"café", "cafe", "caf😀"},
+		[]string{"caf", "cafée"},
+	}, {
+		"prefix anchor",
+		func(r *irc.Router, h irc.HandlerFunc) { r.OnText("!greet", h).Anchor(irc.AnchorPrefix) },
+		[]string{"!greet", "!greet bob", "!greet bob and alice"},
+		[]string{"!greeting", "say !greet", ""},
+	}, {
+		"no anchor",
+		func(r *irc.Router, h irc.HandlerFunc) { r.OnText("hello", h).Anchor(irc.AnchorNone) },
+		[]string{"hello", "oh hello there", "Othello"},
+		[]string{"help", ""},
+	}, {
+		"suffix with unicode case folding",
+		func(r *irc.Router, h irc.HandlerFunc) { r.OnText("*ok", h) },
+		[]string{"ok", "that's OK", "o\u212a"}, // KELVIN SIGN folds to k
+		[]string{"okay", "", "k"},
+	}, {
+		"case-sensitive substring",
+		func(r *irc.Router, h irc.HandlerFunc) { r.OnText("*bot*", h).CaseSensitive() },
+		[]string{"bot", "a bot here", "robots"},
+		[]string{"BOT", "b o t"},
+	}, {
+		"prefix anchor with trailing wildcard",
+		func(r *irc.Router, h irc.HandlerFunc) { r.OnText("!g*", h).Anchor(irc.AnchorPrefix) },
+		[]string{"!g", "!greet", "!G bob"},
+		[]string{"g", " !g"},
+	}, {
+		"identical patterns on several routes",
+		func(r *irc.Router, h irc.HandlerFunc) {
+			r.OnTextRE(`^!roll \d+$`, func(w irc.MessageWriter, m *irc.Message) {}).MatchFunc(func(*irc.Message) bool { return false })
+			r.OnTextRE(`^!roll \d+$`, h)
+		},
+		[]string{"!roll 20"},
+		[]string{"!roll", "!roll d20"},
+	}}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, given := range tc.pass {
+				called := false
+				r := &irc.Router{}
+				tc.route(r, func(w irc.MessageWriter, m *irc.Message) { called = true })
+				r.SpeakIRC(irctest.Discard, irc.Msg("#foo", given))
+				if !called {
+					t.Errorf("expected text to match: %q", given)
+				}
+			}
+			for _, given := range tc.fail {
+				called := false
+				r := &irc.Router{}
+				tc.route(r, func(w irc.MessageWriter, m *irc.Message) { called = true })
+				r.SpeakIRC(irctest.Discard, irc.Msg("#foo", given))
+				if called {
+					t.Errorf("text matched when it was not supposed to: %q", given)
+				}
+			}
+		})
+	}
+}
+
+func TestRouter_OnTextRESubmatch(t *testing.T) {
+	var got []string
+	r := &irc.Router{StripFormatting: true}
+	r.OnTextRESubmatch(`^!roll (\d+)d(\d+)$`, func(w irc.MessageWriter, m *irc.Message, matches []string) {
+		got = matches
+	})
+
+	r.SpeakIRC(irctest.Discard, irc.Msg("#foo", "!roll 2d6"))
+	if strings.Join(got, " ") != "!roll 2d6 2 6" {
+		t.Errorf("unexpected submatches: %q", got)
+	}
+
+	got = nil
+	r.SpeakIRC(irctest.Discard, irc.Msg("#foo", "\x02!roll\x02 3d20"))
+	if strings.Join(got, " ") != "!roll 3d20 3 20" {
+		t.Errorf("unexpected submatches for formatted text: %q", got)
+	}
+
+	got = nil
+	r.SpeakIRC(irctest.Discard, irc.Msg("#foo", "!roll dice"))
+	if got != nil {
+		t.Errorf("expected text which doesn't match not to be routed; got %q", got)
+	}
+}
+
+func TestRouter_OnCommand(t *testing.T) {
+	var got string
+	handler := func(name string) irc.HandlerFunc {
+		return func(w irc.MessageWriter, m *irc.Message) { got = name }
+	}
+	r := &irc.Router{}
+	r.OnText("!weather*", handler("text"))
+	r.OnCommand("!weather", handler("weather"), "!w")
+	r.OnCommand("!welcome", handler("welcome"))
+	r.OnCommand("!greet", handler("greet-foo")).MatchChan("#foo")
+	r.OnCommand("!greet", handler("greet"))
+	r.OnCommand("!quote", handler("quote"))
+	r.OnCommand("!quotes", handler("quotes"))
+
+	tt := []struct {
+		text        string
+		abbreviated bool
+		want        string
+	}{
+		{"!weather", false, "text"},
+		{"!w london", false, "weather"},
+		{"!W", false, "weather"},
+		{"!welcome bob", false, "welcome"},
+		{"!welcomes", false, ""},
+		{"!greet bob", false, "greet-foo"},
+		{"!wel", false, ""},
+		{"!wel", true, "welcome"},
+		{"!we", true, ""},
+		{"!gr", true, "greet-foo"},
+		{"greet", true, ""},
+		{"!quo", true, ""},
+		{"!quote", true, "quote"},
+		{"!quotes", true, "quotes"},
+	}
+	for _, tc := range tt {
+		got = ""
+		r.AbbreviatedCommands = tc.abbreviated
+		r.SpeakIRC(irctest.Discard, irc.Msg("#foo", tc.text))
+		if got != tc.want {
+			t.Errorf("%q (abbreviated: %v): expected handler %q; got %q", tc.text, tc.abbreviated, tc.want, got)
+		}
+	}
+
+	got = ""
+	r.SpeakIRC(irctest.Discard, irc.Msg("#bar", "!greet bob"))
+	if got != "greet" {
+		t.Errorf("expected the second !greet route to match outside of #foo; got %q", got)
+	}
+	if routes := r.Routes(); len(routes) != 7 {
+		t.Errorf("expected Routes to list every command route; got %d routes", len(routes))
+	}
+}
+
+func TestRouter_Stats(t *testing.T) {
+	r := &irc.Router{CollectStats: true}
+	r.OnText("!greet &", handleGreet).Name("greet")
+	r.OnText("!panic", func(w irc.MessageWriter, m *irc.Message) {
+		panic("oops")
+	})
+
+	r.SpeakIRC(irctest.Discard, irc.Msg("#foo", "!greet bob"))
+	r.SpeakIRC(irctest.Discard, irc.Msg("#foo", "!greet alice"))
+	r.SpeakIRC(irctest.Discard, irc.Msg("#foo", "hello"))
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("expected the handler panic to continue after it was recorded")
+			}
+		}()
+		r.SpeakIRC(irctest.Discard, irc.Msg("#foo", "!panic"))
+	}()
+
+	var provider irc.StatsProvider = r
+	stats := provider.Stats()
+	if stats.Unmatched != 1 {
+		t.Errorf("expected 1 unmatched message; got %d", stats.Unmatched)
+	}
+	if len(stats.Routes) != 2 {
+		t.Fatalf("expected stats for 2 routes; got %d", len(stats.Routes))
+	}
+	greet, panicked := stats.Routes[0], stats.Routes[1]
+	if greet.Name != "greet" || greet.Matched != 2 || greet.Calls != 2 || greet.Panics != 0 {
+		t.Errorf("unexpected stats for greet route: %+v", greet)
+	}
+	if panicked.Matched != 1 || panicked.Panics != 1 || panicked.LastPanic != "oops" || panicked.LastPanicTime.IsZero() {
+		t.Errorf("unexpected stats for panicking route: %+v", panicked)
+	}
+}
+
+func TestRouter_golden(t *testing.T) {
+	r := &irc.Router{}
+	r.OnText("!greet &", func(w irc.MessageWriter, m *irc.Message) {
+		text, _ := m.Text()
+		reply := irc.Msg(m.Params.Get(1), "Hello, "+strings.Fields(text)[1]+"!")
+		if m.Tags.Get("time") != "" {
+			reply.Tags = irc.Tags{"+draft/reply": "abc", "label": "random"}
+		}
+		w.WriteMessage(reply)
+	})
+	irctest.Golden(t, r, "testdata/greet.txt", "testdata/greet.golden", false)
+}
+
+type fixedNick irc.Nickname
+
+func (n fixedNick) Nick() irc.Nickname { return irc.Nickname(n) }
+
+func TestRouter_MatchQuery(t *testing.T) {
+	var queries, toMe []string
+	r := &irc.Router{}
+	r.BindClient(fixedNick("bot"))
+	r.OnQuery("*", func(w irc.MessageWriter, m *irc.Message) {
+		text, _ := m.Text()
+		queries = append(queries, text)
+	})
+	r.OnText("*", func(w irc.MessageWriter, m *irc.Message) {
+		text, _ := m.Text()
+		toMe = append(toMe, text)
+	}).MatchToMe()
+
+	r.SpeakIRC(irctest.Discard, irc.Msg("Bot", "private"))
+	r.SpeakIRC(irctest.Discard, irc.Msg("#foo", "bot: hello"))
+	r.SpeakIRC(irctest.Discard, irc.Msg("#foo", "BOT, hi"))
+	r.SpeakIRC(irctest.Discard, irc.Msg("#foo", "bots are great"))
+	r.SpeakIRC(irctest.Discard, irc.Msg("#foo", "hello"))
+
+	if strings.Join(queries, "|") != "private" {
+		t.Errorf("expected only the query to match OnQuery; got %q", queries)
+	}
+	if strings.Join(toMe, "|") != "bot: hello|BOT, hi" {
+		t.Errorf("expected only the messages addressing the bot to match MatchToMe; got %q", toMe)
+	}
+}
+
+func TestRouter_MatchQuery_unbound(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	var got string
+	r := &irc.Router{}
+	r.OnQuery("*", func(w irc.MessageWriter, m *irc.Message) { got = "query" })
+	r.OnText("*", func(w irc.MessageWriter, m *irc.Message) { got = "text" })
+
+	r.SpeakIRC(irctest.Discard, irc.Msg("bot", "private"))
+	r.SpeakIRC(irctest.Discard, irc.Msg("bot", "private"))
+	if got != "text" {
+		t.Errorf("expected the query route not to match without a bound client; got %q", got)
+	}
+	if n := strings.Count(logged.String(), "no client bound"); n != 1 {
+		t.Errorf("expected the missing client to be logged once; got %q", logged.String())
+	}
+}
+
+func TestRouter_OnMention(t *testing.T) {
+	var got []string
+	r := &irc.Router{}
+	r.BindClient(fixedNick("bot_"))
+	r.OnMention(func(w irc.MessageWriter, m *irc.Message) {
+		text, _ := m.Text()
+		got = append(got, text)
+	})
+
+	r.SpeakIRC(irctest.Discard, irc.Msg("#foo", "is the bot down?"))
+	r.SpeakIRC(irctest.Discard, irc.Msg("#foo", "thanks, \x02Bot\x02!"))
+	r.SpeakIRC(irctest.Discard, &irc.Message{Command: irc.CTCPAction, Params: irc.Params{"#foo", "pokes bot|away"}})
+	r.SpeakIRC(irctest.Discard, irc.Msg("#foo", "robots are great"))
+	r.SpeakIRC(irctest.Discard, irc.Msg("bot_", "bot, a query"))
+
+	if strings.Join(got, "|") != "is the bot down?|thanks, \x02Bot\x02!|pokes bot|away" {
+		t.Errorf("expected only the channel messages mentioning the bot to match; got %q", got)
+	}
+}
+
+func TestRouter_events(t *testing.T) {
+	var got []string
+	r := &irc.Router{}
+	r.OnPrivmsgEvent(func(w irc.MessageWriter, e *irc.PrivmsgEvent) {
+		got = append(got, e.Sender.Nick.String()+" to "+e.Channel+": "+e.Text)
+	})
+	r.OnKickEvent(func(w irc.MessageWriter, e *irc.KickEvent) {
+		got = append(got, e.Kicked.String()+" kicked from "+e.Channel+": "+e.Reason)
+	})
+	r.HandleFunc(irc.CmdKick, func(w irc.MessageWriter, m *irc.Message) {
+		got = append(got, "malformed kick")
+	})
+	r.HandleFunc(irc.CmdPrivmsg, func(w irc.MessageWriter, m *irc.Message) {
+		got = append(got, "undecoded ctcp")
+	})
+
+	for _, line := range []string{
+		":alice!a@host PRIVMSG @#foo :hello ops",
+		":alice!a@host PRIVMSG bot :hello bot",
+		":alice!a@host PRIVMSG bot :\x01VERSION\x01",
+		":alice!a@host KICK #foo bob :bye",
+		":alice!a@host KICK #foo",
+	} {
+		m := new(irc.Message)
+		if err := m.UnmarshalText([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+		r.SpeakIRC(irctest.Discard, m)
+	}
+
+	want := "alice to #foo: hello ops|alice to : hello bot|undecoded ctcp|bob kicked from #foo: bye|malformed kick"
+	if strings.Join(got, "|") != want {
+		t.Errorf("expected %q; got %q", want, strings.Join(got, "|"))
+	}
+}
+
+// inviteEvent is an event type defined outside of the irc package.
+type inviteEvent struct {
+	From    string
+	Channel string
+}
+
+func (e *inviteEvent) Command() irc.Command { return irc.CmdInvite }
+
+func (e *inviteEvent) Decode(m *irc.Message) error {
+	if len(m.Params) < 2 {
+		return errors.New("not enough parameters")
+	}
+	e.From, e.Channel = m.Source.Nick.String(), m.Params.Get(2)
+	return nil
+}
+
+func TestOn(t *testing.T) {
+	var got []string
+	r := &irc.Router{}
+	irc.On(r, func(w irc.MessageWriter, e *irc.JoinEvent) {
+		got = append(got, e.Sender.Nick.String()+" joined "+e.Channel)
+	})
+	irc.On[inviteEvent](r, func(w irc.MessageWriter, e *inviteEvent) {
+		got = append(got, e.From+" invited us to "+e.Channel)
+	})
+
+	for _, line := range []string{
+		":alice!a@host JOIN #foo",
+		":alice!a@host INVITE bot #bar",
+		":alice!a@host INVITE bot",
+		":alice!a@host PART #foo",
+	} {
+		m := new(irc.Message)
+		if err := m.UnmarshalText([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+		r.SpeakIRC(irctest.Discard, m)
+	}
+
+	want := "alice joined #foo|alice invited us to #bar"
+	if strings.Join(got, "|") != want {
+		t.Errorf("expected %q; got %q", want, strings.Join(got, "|"))
+	}
+
+	m := new(irc.Message)
+	_ = m.UnmarshalText([]byte(":alice!a@host KICK #foo bob"))
+	if e, err := irc.Decode[irc.KickEvent](m); err != nil || e.Kicked != "bob" {
+		t.Errorf("expected bob to be kicked; got %v, %v", e, err)
+	}
+	if _, err := irc.Decode[irc.JoinEvent](m); err == nil {
+		t.Errorf("expected an error decoding a KICK as a JoinEvent")
+	}
+}
+
+func TestRouter_OnKnock(t *testing.T) {
+	var got []string
+	r := &irc.Router{}
+	r.OnKnock(func(w irc.MessageWriter, e *irc.KnockEvent) {
+		w.WriteMessage(irc.Invite(e.Sender.Nick.String(), e.Channel))
+	})
+	r.OnKnockReply(func(w irc.MessageWriter, channel string, err error) {
+		switch {
+		case err == nil:
+			got = append(got, channel+" delivered")
+		case errors.Is(err, irc.ErrChanOpen):
+			got = append(got, channel+" open")
+		default:
+			got = append(got, channel+" "+err.Error())
+		}
+	})
+
+	rec := &irctest.RecordingWriter{}
+	for _, line := range []string{
+		":irc.example.com 710 #foo #foo alice!a@host :has asked for an invite.",
+		":irc.example.com 711 bot #bar :Your KNOCK has been delivered.",
+		":irc.example.com 713 bot #baz :Channel is open.",
+		":irc.example.com 712 bot #qux :Too many KNOCKs (channel).",
+	} {
+		m := new(irc.Message)
+		if err := m.UnmarshalText([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+		r.SpeakIRC(rec, m)
+	}
+
+	want := "#bar delivered|#baz open|#qux knock #qux: too many knocks: Too many KNOCKs (channel)."
+	if strings.Join(got, "|") != want {
+		t.Errorf("expected %q; got %q", want, strings.Join(got, "|"))
+	}
+	if len(rec.Messages()) != 1 || rec.Messages()[0].Command != irc.CmdInvite || rec.Messages()[0].Params.Get(1) != "alice" {
+		t.Errorf("expected an invite for alice; got %v", rec.Messages())
+	}
+}
+
+func TestRoute_MatchTag(t *testing.T) {
+	var got []string
+	r := &irc.Router{}
+	r.OnText("*", func(w irc.MessageWriter, m *irc.Message) {
+		got = append(got, "bot: "+m.Params.Get(2))
+	}).MatchTag("bot", "")
+	r.OnText("*", func(w irc.MessageWriter, m *irc.Message) {
+		got = append(got, "relayed: "+m.Params.Get(2))
+	}).MatchTag("+example.com/relay", "discord*")
+
+	for _, line := range []string{
+		"@bot :helper!h@host PRIVMSG #foo :beep",
+		"@+example.com/relay=discord-1 :relay!r@host PRIVMSG #foo :hi from discord",
+		"@+example.com/relay=matrix :relay!r@host PRIVMSG #foo :hi from matrix",
+	} {
+		m := new(irc.Message)
+		if err := m.UnmarshalText([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+		r.SpeakIRC(irctest.Discard, m)
+	}
+
+	want := "bot: beep|relayed: hi from discord"
+	if strings.Join(got, "|") != want {
+		t.Errorf("expected %q; got %q", want, strings.Join(got, "|"))
+	}
+}
+
+func TestPager(t *testing.T) {
+	var items []string
+	for i := 1; i <= 7; i++ {
+		items = append(items, fmt.Sprintf("item %d", i))
+	}
+	pager := &irc.Pager{PageOptions: irc.PageOptions{Size: 3}}
+	r := &irc.Router{}
+	pager.Register(r)
+	r.OnCommand("!list", func(w irc.MessageWriter, m *irc.Message) {
+		pager.Reply(w, m, items)
+	})
+
+	send := func(from, target, text string) []string {
+		rec := &irctest.RecordingWriter{}
+		m := irc.Msg(target, text)
+		m.Source = irc.Prefix{Nick: irc.Nickname(from), User: "u", Host: "example.com"}
+		r.SpeakIRC(rec, m)
+		var lines []string
+		for _, reply := range rec.Messages() {
+			lines = append(lines, reply.Params.Get(1)+" "+reply.Params.Get(2))
+		}
+		return lines
+	}
+
+	tt := []struct {
+		from, target, text string
+		want               []string
+	}{
+		{"bob", "#chan", "!list", []string{"#chan item 1", "#chan item 2", "#chan item 3", "#chan … (4 more, reply !more)"}},
+		{"alice", "bot", "!more", nil},
+		{"bob", "#chan", "!more", []string{"#chan item 4", "#chan item 5", "#chan item 6", "#chan … (1 more, reply !more)"}},
+		{"alice", "bot", "!list", []string{"alice item 1", "alice item 2", "alice item 3", "alice … (4 more, reply !more)"}},
+		{"BOB", "bot", "!more", []string{"#chan item 7"}},
+		{"bob", "#chan", "!more", nil},
+		{"w[m]", "bot", "!list", []string{"w[m] item 1", "w[m] item 2", "w[m] item 3", "w[m] … (4 more, reply !more)"}},
+		{"W{M}", "bot", "!more", []string{"w[m] item 4", "w[m] item 5", "w[m] item 6", "w[m] … (1 more, reply !more)"}},
+	}
+	for i, tc := range tt {
+		if got := send(tc.from, tc.target, tc.text); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%d: %s %q: expected %q; got %q", i, tc.from, tc.text, tc.want, got)
+		}
+	}
+}
+
+func TestRouter_SetOverlay(t *testing.T) {
+	var got []string
+	handler := func(name string) irc.HandlerFunc {
+		return func(w irc.MessageWriter, m *irc.Message) { got = append(got, name) }
+	}
+	r := &irc.Router{}
+	r.OnCommand("!roll", handler("roll"), "!dice")
+	r.OnCommand("!deploy", handler("deploy"))
+	r.OnText("*lunch*", handler("lunch")).Name("lunch")
+	r.OnText("*", handler("fallback"))
+
+	r.SetOverlay("#general", irc.ChannelOverlay{
+		Disable:   []string{"!deploy", "lunch"},
+		Cooldowns: map[string]time.Duration{"!dice": time.Hour},
+	})
+	r.SetOverlay("#DEV[1]", irc.ChannelOverlay{Only: []string{"!deploy"}})
+
+	for _, m := range []*irc.Message{
+		irc.Msg("#general", "!roll"),
+		irc.Msg("#General", "!roll"), // cooldown, so the next route handles it
+		irc.Msg("#general", "!deploy"),
+		irc.Msg("#general", "lunch time"),
+		irc.Msg("#dev{1}", "!roll"),
+		irc.Msg("#dev{1}", "!deploy"),
+		irc.Msg("#dev[1]", "lunch?"),
+		irc.Msg("#other", "!roll"),
+		irc.Msg("bot", "!deploy"),
+	} {
+		r.SpeakIRC(irctest.Discard, m)
+	}
+	want := []string{"roll", "fallback", "fallback", "fallback", "fallback", "deploy", "fallback", "roll", "deploy"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected handlers %q; got %q", want, got)
+	}
+
+	if o, ok := r.Overlay("#Dev{1}"); !ok || len(o.Only) != 1 {
+		t.Errorf("expected the overlay of #dev[1]; got %+v, %v", o, ok)
+	}
+	r.RemoveOverlay("#general")
+	got = nil
+	r.SpeakIRC(irctest.Discard, irc.Msg("#general", "!deploy"))
+	if !reflect.DeepEqual(got, []string{"deploy"}) {
+		t.Errorf("expected !deploy to be available once the overlay was removed; got %q", got)
+	}
+}
+
+// halfopServer is a client bound to a router, on a server with half-operators.
+type halfopServer struct{}
+
+func (halfopServer) Nick() irc.Nickname { return "bot" }
+
+func (halfopServer) ISupport(name string) (string, bool) {
+	switch name {
+	case "PREFIX":
+		return "(ohv)@%+", true
+	case "CHANMODES":
+		return "beI,k,l,imnpst", true
+	}
+	return "", false
+}
+
+func TestRouter_OnOp(t *testing.T) {
+	var got []string
+	record := func(w irc.MessageWriter, e *irc.PrefixEvent) {
+		got = append(got, fmt.Sprintf("%s %c%c %s", e.Channel, map[bool]rune{true: '+', false: '-'}[e.Added], e.Mode, e.Nick))
+	}
+	r := &irc.Router{}
+	r.OnOp(record)
+	r.OnDeop(record)
+	r.OnVoice(record)
+	r.OnDevoice(record)
+
+	m := new(irc.Message)
+	if err := m.UnmarshalText([]byte(":alice!a@host MODE #chan +olv-o+b bob 10 carol dave *!*@spam")); err != nil {
+		t.Fatal(err)
+	}
+	// the first matching route handles the message, once for each change
+	r.SpeakIRC(irctest.Discard, m)
+	if want := []string{"#chan +o bob"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q; got %q", want, got)
+	}
+
+	got = nil
+	r = &irc.Router{}
+	r.BindClient(halfopServer{})
+	r.OnPrefix('h', true, record)
+	r.OnDevoice(record)
+	if err := m.UnmarshalText([]byte(":alice!a@host MODE #chan +hh-v bob carol dave")); err != nil {
+		t.Fatal(err)
+	}
+	r.SpeakIRC(irctest.Discard, m)
+	if want := []string{"#chan +h bob", "#chan +h carol"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q; got %q", want, got)
+	}
+	if err := m.UnmarshalText([]byte(":alice!a@host MODE bot +v bob")); err != nil {
+		t.Fatal(err)
+	}
+	r.SpeakIRC(irctest.Discard, m)
+	if len(got) != 2 {
+		t.Errorf("expected user modes not to be prefix changes; got %q", got)
+	}
+}
+
+func TestBurstCoalescer(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		joins []string
+	)
+	bursts := make(chan *irc.BurstEvent, 1)
+	r := &irc.Router{}
+	r.HandleFunc(irc.CmdJoin, func(w irc.MessageWriter, m *irc.Message) {
+		mu.Lock()
+		defer mu.Unlock()
+		joins = append(joins, m.Source.Nick.String())
+	})
+	r.OnBurstEvent(func(w irc.MessageWriter, e *irc.BurstEvent) { bursts <- e })
+
+	b := &irc.BurstCoalescer{Threshold: 3, Window: 50 * time.Millisecond}
+	h := b.Middleware(r)
+	for _, line := range []string{
+		":a!u@h JOIN #chan[1]",
+		":b!u@h JOIN #chan[1]",
+		":c!u@h JOIN #CHAN{1}",
+		":d[!u@h JOIN #chan[1]",
+		":e!u@h JOIN #chan{1}",
+		":D{!u@h JOIN #chan[1]",
+		":x!u@h JOIN #other",
+	} {
+		m := new(irc.Message)
+		if err := m.UnmarshalText([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+		h.SpeakIRC(irctest.Discard, m)
+	}
+
+	select {
+	case e := <-bursts:
+		if e.Kind != irc.CmdJoin || e.Channel != "#chan[1]" || e.Count != 3 || !reflect.DeepEqual(e.Nicks, []irc.Nickname{"d[", "e"}) {
+			t.Errorf("unexpected burst: %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the burst to end")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"a", "b", "c", "x"}; !reflect.DeepEqual(joins, want) {
+		t.Errorf("expected the JOINs before the burst to be handled; got %q", joins)
+	}
+}
+
+func TestRouter_Use(t *testing.T) {
+	var (
+		calls []string
+		built int
+	)
+	record := func(name string) func(irc.Handler) irc.Handler {
+		return func(next irc.Handler) irc.Handler {
+			built++
+			return irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+				calls = append(calls, name)
+				next.SpeakIRC(w, m)
+			})
+		}
+	}
+	rewrite := func(next irc.Handler) irc.Handler {
+		return irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+			switch m.Params.Get(2) {
+			case "!veto":
+				calls = append(calls, "vetoed")
+				return
+			case "!old":
+				m = irc.Msg(m.Params.Get(1), "!new")
+			}
+			next.SpeakIRC(w, m)
+		})
+	}
+
+	r := &irc.Router{}
+	r.Use(record("first"), rewrite)
+	r.Use(record("second"))
+	r.OnText("!old", func(w irc.MessageWriter, m *irc.Message) { calls = append(calls, "old route") })
+	r.OnText("!new", func(w irc.MessageWriter, m *irc.Message) { calls = append(calls, "new route") })
+	r.OnText("*", func(w irc.MessageWriter, m *irc.Message) { calls = append(calls, "any route") })
+
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"!old", []string{"first", "second", "new route"}},
+		{"!veto", []string{"first", "vetoed"}},
+		{"hello", []string{"first", "second", "any route"}},
+	}
+	for _, tt := range tests {
+		calls = nil
+		r.SpeakIRC(irctest.Discard, irc.Msg("#chan", tt.text))
+		if !reflect.DeepEqual(calls, tt.want) {
+			t.Errorf("%q: expected calls %q; got %q", tt.text, tt.want, calls)
+		}
+	}
+
+	calls = nil
+	r.SpeakIRC(irctest.Discard, &irc.Message{Command: irc.CmdPing, Params: irc.Params{"x"}})
+	if want := []string{"first", "second"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("expected global middleware to run without a matching route; got %q", calls)
+	}
+	if built != 2 {
+		t.Errorf("expected each middleware to be built once, when it's attached; built %d times", built)
+	}
+}
+
+func TestRouter_OnNames(t *testing.T) {
+	var got []*irc.Names
+	r := &irc.Router{}
+	r.BindClient(halfopServer{})
+	r.OnNames(func(w irc.MessageWriter, names *irc.Names) {
+		got = append(got, names)
+	})
+
+	for _, line := range []string{
+		":irc 353 bot = #foo[1] :@%alice!a@host.example +bob",
+		":irc 353 bot @ #bar :%carol",
+		":irc 353 bot = #foo[1] :dave",
+		":irc 366 bot #FOO{1} :End of /NAMES list",
+		":irc 366 bot #empty :End of /NAMES list",
+	} {
+		m := new(irc.Message)
+		if err := m.UnmarshalText([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+		r.SpeakIRC(irctest.Discard, m)
+	}
+
+	if len(got) != 2 {
+		t.Fatalf("expected a result for each RPL_ENDOFNAMES; got %d", len(got))
+	}
+	want := &irc.Names{Channel: "#foo[1]", Status: "=", Members: []irc.Member{
+		{Nick: "alice", User: "a", Host: "host.example", Prefixes: "@%"},
+		{Nick: "bob", Prefixes: "+"},
+		{Nick: "dave"},
+	}}
+	if !reflect.DeepEqual(got[0], want) {
+		t.Errorf("expected the names of #foo[1] to be collected\nwant: %+v\n got: %+v", want, got[0])
+	}
+	if got[1].Channel != "#empty" || len(got[1].Members) != 0 {
+		t.Errorf("expected an empty reply for #empty; got %+v", got[1])
+	}
+}
@@ -0,0 +1,158 @@
+package irc
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ErrControlChars is returned by MarshalText when a parameter contains CR, LF, or NUL, or a tag contains NUL.
+//
+// CR and LF end an IRC line, so a bot which echoes user-provided text containing them
+// could be made to send any command the text continues with. NUL is forbidden anywhere in a line.
+var ErrControlChars = errors.New("message contains CR, LF, or NUL characters")
+
+// ErrInvalidTag is returned by MarshalText for a message written by a client with a tag the server would reject:
+// a key which isn't a valid tag name, such as "+" or "+bad tag",
+// or a tag which only servers may set, such as time or msgid (see Message.SetServerTags).
+//
+// Servers silently drop invalid tags, or refuse the whole message,
+// so a TAGMSG or PRIVMSG which relies on them would otherwise be lost without an error.
+var ErrInvalidTag = errors.New("invalid tag")
+
+// serverOnlyTags are the tags set by servers on the messages they relay, which clients must not send.
+var serverOnlyTags = []string{"time", "msgid", "account"}
+
+// controlChars are the characters which are never allowed in a message parameter.
+const controlChars = "\r\n\x00"
+
+// ControlCharPolicy is the action taken by Client.WriteMessage when an outgoing message contains
+// CR, LF, or NUL characters. See Sanitize.
+type ControlCharPolicy int
+
+const (
+	// ControlCharsReject drops the message and reports ErrControlChars to the ErrorLog.
+	ControlCharsReject ControlCharPolicy = iota
+
+	// ControlCharsStrip removes the characters from the message before sending it.
+	ControlCharsStrip
+
+	// ControlCharsSplit sends each line of the last parameter as a separate message
+	// with the same command, tags, and other parameters, skipping blank lines.
+	// Any characters left in the other parameters are removed.
+	ControlCharsSplit
+)
+
+// Sanitize applies policy to a message which may contain CR, LF, or NUL characters,
+// and returns the messages to send in its place.
+// m is never modified; if m contains none of the characters, it's returned as the only message.
+//
+// With ControlCharsReject, Sanitize returns ErrControlChars for any message containing the characters.
+//
+// Sanitize is used by Client.WriteMessage according to Client.ControlChars,
+// and may be used by other MessageWriters which accept user-provided text.
+func Sanitize(m *Message, policy ControlCharPolicy) ([]*Message, error) {
+	if !hasControlChars(m) {
+		return []*Message{m}, nil
+	}
+	switch policy {
+	case ControlCharsStrip:
+		return []*Message{stripControlChars(m)}, nil
+	case ControlCharsSplit:
+		if len(m.Params) == 0 {
+			return []*Message{stripControlChars(m)}, nil
+		}
+		last := len(m.Params) - 1
+		lines := strings.FieldsFunc(m.Params[last], func(r rune) bool { return r == '\r' || r == '\n' })
+		if len(lines) == 0 {
+			lines = []string{""}
+		}
+		messages := make([]*Message, 0, len(lines))
+		for _, line := range lines {
+			c := stripControlChars(m)
+			c.Params[last] = strings.ReplaceAll(line, "\x00", "")
+			messages = append(messages, c)
+		}
+		return messages, nil
+	default:
+		return nil, ErrControlChars
+	}
+}
+
+// hasControlChars reports whether any parameter of m contains CR, LF, or NUL, or any tag contains NUL.
+// Tag values may otherwise contain CR and LF, since they're escaped by MarshalText.
+func hasControlChars(m *Message) bool {
+	return checkControlChars(m) != nil
+}
+
+// checkControlChars returns an error describing the first part of m containing forbidden characters.
+func checkControlChars(m *Message) error {
+	for i, p := range m.Params {
+		if strings.ContainsAny(p, controlChars) {
+			return fmt.Errorf("%w: parameter %d", ErrControlChars, i+1)
+		}
+	}
+	for k, v := range m.Tags {
+		if strings.ContainsAny(k, controlChars) || strings.Contains(v, "\x00") {
+			return fmt.Errorf("%w: tag %q", ErrControlChars, k)
+		}
+	}
+	return nil
+}
+
+// checkClientTags returns an error describing the first tag of tags which a client must not send.
+// Keys are checked in sorted order, so the error doesn't depend on map iteration.
+func checkClientTags(tags Tags) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !validTagKey(k) {
+			return fmt.Errorf("%w: %q is not a valid tag name", ErrInvalidTag, k)
+		}
+		if containsFold(serverOnlyTags, k) {
+			return fmt.Errorf("%w: %q may only be set by servers", ErrInvalidTag, k)
+		}
+	}
+	return nil
+}
+
+// validTagKey reports whether key is a valid tag name: an optional '+' for client-only tags,
+// an optional vendor (a hostname followed by '/'), and a name of letters, digits, and hyphens.
+// https://ircv3.net/specs/extensions/message-tags.html#format
+func validTagKey(key string) bool {
+	key = strings.TrimPrefix(key, "+")
+	if vendor, name, ok := strings.Cut(key, "/"); ok {
+		if vendor == "" || strings.Trim(vendor, tagNameChars+".") != "" {
+			return false
+		}
+		key = name
+	}
+	return key != "" && strings.Trim(key, tagNameChars) == ""
+}
+
+const tagNameChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-"
+
+// stripControlChars returns a copy of m without CR, LF, or NUL in its parameters or NUL in its tags.
+func stripControlChars(m *Message) *Message {
+	c := *m
+	c.Params = make(Params, len(m.Params))
+	for i, p := range m.Params {
+		c.Params[i] = controlStripper.Replace(p)
+	}
+	if m.Tags != nil {
+		c.Tags = make(Tags, len(m.Tags))
+		for k, v := range m.Tags {
+			c.Tags[controlStripper.Replace(k)] = strings.ReplaceAll(v, "\x00", "")
+		}
+	}
+	return &c
+}
+
+var controlStripper = strings.NewReplacer("\r", "", "\n", "", "\x00", "")
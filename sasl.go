@@ -0,0 +1,248 @@
+package irc
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// A SASLMechanism implements a SASL authentication mechanism for the IRCv3 sasl capability.
+// https://ircv3.net/specs/extensions/sasl-3.1
+type SASLMechanism interface {
+
+	// Name returns the name of the mechanism as sent to the server, e.g. "PLAIN" or "EXTERNAL".
+	Name() string
+
+	// Next returns the response to a challenge from the server.
+	// The first challenge is always empty.
+	// The client takes care of base64 encoding and splitting the response into chunks.
+	Next(challenge []byte) (response []byte, err error)
+}
+
+// SASLExternal returns the SASL EXTERNAL mechanism,
+// which authenticates with credentials established outside of the IRC protocol,
+// typically the TLS client certificate (CertFP).
+func SASLExternal() SASLMechanism {
+	return saslExternal{}
+}
+
+type saslExternal struct{}
+
+func (saslExternal) Name() string { return "EXTERNAL" }
+
+// Next returns an empty response, which means the server should use the
+// authorization identity derived from the certificate.
+func (saslExternal) Next([]byte) ([]byte, error) { return nil, nil }
+
+// SASLPlain returns the SASL PLAIN mechanism, which authenticates with an account name and password.
+// The password is sent in clear text, so PLAIN should only be used over TLS.
+func SASLPlain(account, password string) SASLMechanism {
+	return saslPlain{account: account, password: password}
+}
+
+type saslPlain struct {
+	account, password string
+}
+
+func (saslPlain) Name() string { return "PLAIN" }
+
+// Next returns "authzid NUL authcid NUL password", leaving the authorization identity empty
+// so that it's derived from the account name.
+func (p saslPlain) Next([]byte) ([]byte, error) {
+	return []byte("\x00" + p.account + "\x00" + p.password), nil
+}
+
+// SASLFirst returns a mechanism which authenticates with the first of mechs that the server supports.
+// The mechanisms a server supports are the value of its sasl capability (see Client.CapValue), e.g. "sasl=PLAIN,EXTERNAL";
+// when the server doesn't list them, the first of mechs is used.
+//
+//	client.SASL = irc.SASLFirst(irc.SASLExternal(), irc.SASLPlain("account", "password"))
+func SASLFirst(mechs ...SASLMechanism) SASLMechanism {
+	return saslFirst(mechs)
+}
+
+// saslFirst is a list of mechanisms in order of preference.
+// The saslHandler chooses one of them; used on its own, it is the first mechanism.
+type saslFirst []SASLMechanism
+
+func (f saslFirst) Name() string {
+	if len(f) == 0 {
+		return ""
+	}
+	return f[0].Name()
+}
+
+func (f saslFirst) Next(challenge []byte) ([]byte, error) {
+	if len(f) == 0 {
+		return nil, errors.New("sasl: no mechanism")
+	}
+	return f[0].Next(challenge)
+}
+
+// saslChunkSize is the maximum length of a single AUTHENTICATE payload.
+const saslChunkSize = 400
+
+// saslAuth is the Authenticator for Client.SASL.
+type saslAuth struct {
+	mech SASLMechanism
+}
+
+func (sa saslAuth) Authenticate(w MessageWriter, a *Auth) Handler {
+	h := &saslHandler{mech: sa.mech, auth: a}
+	return HandlerFunc(h.handle)
+}
+
+// saslHandler authenticates with mech during capability negotiation.
+// It holds capability negotiation open (delaying CAP END) until authentication has either succeeded or failed.
+type saslHandler struct {
+	mech SASLMechanism
+	auth *Auth
+
+	// active is the mechanism chosen from mech for the mechanisms advertised by the server.
+	active SASLMechanism
+
+	// holding is true while we're delaying the end of capability negotiation.
+	holding bool
+
+	// challenge buffers a server challenge which was split over multiple AUTHENTICATE messages.
+	challenge strings.Builder
+}
+
+func (s *saslHandler) handle(mw MessageWriter, m *Message) {
+	switch {
+	case m.Command.is(CmdCap):
+		s.handleCap(mw, m)
+	case m.Command.is(CmdAuthenticate):
+		s.handleAuthenticate(mw, m)
+	case m.Command.is(RplSASLSuccess), m.Command.is(RplErrSASLAlready):
+		s.auth.Done(nil)
+	case m.Command.is(RplErrSASLFail),
+		m.Command.is(RplErrSASLTooLong),
+		m.Command.is(RplErrSASLAborted),
+		m.Command.is(RplErrNickLocked):
+		s.auth.Done(fmt.Errorf("sasl: %s", m.Params.Get(len(m.Params))))
+	case m.Command.is(RplWelcome):
+		// registration completed before the server offered sasl
+		s.auth.Done(errors.New("sasl: not supported by the server"))
+	case m.Command.is(RplErrUnknownCommand):
+		// "<client> <command> :Unknown command"; only the commands of SASL mean that the server doesn't support it
+		if cmd := Command(m.Params.Get(2)); cmd.is(CmdCap) || cmd.is(CmdAuthenticate) {
+			s.auth.Done(errors.New("sasl: not supported by the server"))
+		}
+	}
+}
+
+func (s *saslHandler) handleCap(mw MessageWriter, m *Message) {
+	list := m.Params.Get(len(m.Params))
+	switch strings.ToUpper(m.Params.Get(2)) {
+	case "LS":
+		// the hold must be placed before the capability middleware sees the final LS line,
+		// otherwise it would send CAP END before we could authenticate.
+		if s.holding {
+			return
+		}
+		for _, c := range strings.Fields(list) {
+			name, mechs, _ := strings.Cut(c, "=")
+			if !strings.EqualFold(name, "sasl") {
+				continue
+			}
+			if s.active = s.choose(mechs); s.active == nil {
+				s.auth.Done(fmt.Errorf("sasl: the server supports none of our mechanisms, only %s", mechs))
+				return
+			}
+			s.holding = true
+			s.auth.HoldCapEnd()
+			return
+		}
+		if m.Params.Get(3) != "*" {
+			s.auth.Done(errors.New("sasl: not supported by the server"))
+		}
+	case "ACK":
+		if s.holding && containsFold(capNames(list), "sasl") {
+			mw.WriteMessage(Authenticate(s.active.Name()))
+		}
+	case "NAK":
+		// a refused request for several capabilities is requested again one at a time,
+		// so sasl is only refused when it was requested alone
+		if names := capNames(list); len(names) == 1 && strings.EqualFold(names[0], "sasl") {
+			s.auth.Done(errors.New("sasl: the server refused the capability"))
+		}
+	}
+}
+
+func (s *saslHandler) handleAuthenticate(mw MessageWriter, m *Message) {
+	if !s.holding {
+		return
+	}
+	chunk := m.Params.Get(1)
+	if chunk != "+" {
+		s.challenge.WriteString(chunk)
+	}
+	// a chunk of exactly the maximum size means there is more to come
+	if len(chunk) == saslChunkSize {
+		return
+	}
+	challenge, err := base64.StdEncoding.DecodeString(s.challenge.String())
+	s.challenge.Reset()
+	if err == nil {
+		var response []byte
+		if response, err = s.active.Next(challenge); err == nil {
+			for _, payload := range saslPayloads(response) {
+				mw.WriteMessage(Authenticate(payload))
+			}
+			return
+		}
+	}
+	// an asterisk aborts the authentication; the server replies with 906 which ends it
+	mw.WriteMessage(Authenticate("*"))
+}
+
+// choose returns the mechanism to authenticate with, given the comma-separated list of mechanisms
+// advertised by the server (which may be empty), or nil if the server supports none of ours.
+func (s *saslHandler) choose(advertised string) SASLMechanism {
+	candidates := []SASLMechanism{s.mech}
+	if f, ok := s.mech.(saslFirst); ok {
+		candidates = f
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	if advertised == "" {
+		return candidates[0]
+	}
+	supported := strings.Split(advertised, ",")
+	for _, mech := range candidates {
+		if containsFold(supported, mech.Name()) {
+			return mech
+		}
+	}
+	return nil
+}
+
+// saslPayloads encodes response as a sequence of AUTHENTICATE parameters.
+func saslPayloads(response []byte) []string {
+	if len(response) == 0 {
+		return []string{"+"}
+	}
+	encoded := base64.StdEncoding.EncodeToString(response)
+	var payloads []string
+	for len(encoded) >= saslChunkSize {
+		payloads = append(payloads, encoded[:saslChunkSize])
+		encoded = encoded[saslChunkSize:]
+	}
+	// when the last chunk was exactly 400 bytes, "+" indicates the end of the response
+	if encoded == "" {
+		encoded = "+"
+	}
+	return append(payloads, encoded)
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
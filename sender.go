@@ -0,0 +1,136 @@
+package irc
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// MessageSender is a MessageWriter which can also report whether a message was delivered.
+// Client implements MessageSender.
+type MessageSender interface {
+	MessageWriter
+
+	// SendMessage writes m and waits until the server accepted or rejected it.
+	SendMessage(ctx context.Context, m *Message) error
+}
+
+// SendMessage writes m and waits for the outcome, for callers which need more than WriteMessage's fire-and-forget.
+// It returns the errors of WriteMessageE, or an error wrapping ErrNotDelivered when the server rejected m,
+// e.g. with ERR_CANNOTSENDTOCHAN.
+//
+// The outcome is confirmed in the best way the server supports:
+//
+//   - with labeled-response, by the server's labeled reply to m;
+//   - with echo-message, by the server echoing m back;
+//   - otherwise, by the server answering a PING sent after m without reporting an error about m.
+//
+// Messages held until a JOIN completes (see JoinTimeout) can only be confirmed with labeled-response.
+//
+// Like the other Client methods which wait for a reply, SendMessage must not be called from a handler.
+func (c *Client) SendMessage(ctx context.Context, m *Message) error {
+	c.connMu.Lock()
+	caps, p := c.caps, c.replies
+	c.connMu.Unlock()
+	if caps == nil || p == nil {
+		return ErrNotConnected
+	}
+
+	if caps.isEnabled("labeled-response") {
+		p.mu.Lock()
+		label := p.token("SEND")
+		p.mu.Unlock()
+		msg := *m
+		msg.Tags = make(Tags, len(m.Tags)+1)
+		for k, v := range m.Tags {
+			msg.Tags[k] = v
+		}
+		msg.Tags.Set("label", label)
+		return c.request(ctx, &msg, false, labeledReply(m, label))
+	}
+
+	isMessage := m.Command.is(CmdPrivmsg) || m.Command.is(CmdNotice) || m.Command.is(CmdTagMsg)
+	if caps.isEnabled("echo-message") && isMessage {
+		var echoed bool
+		nick := c.Nick()
+		err := c.request(ctx, m, true, func(reply *Message) (bool, error) {
+			if err := deliveryError(m, reply); err != nil {
+				return true, err
+			}
+			if reply.Source.Nick.Is(nick.String()) && reply.Command == m.Command &&
+				reply.Params.Get(1) == m.Params.Get(1) && reply.Params.Get(2) == m.Params.Get(2) {
+				echoed = true
+				return true, nil
+			}
+			return false, nil
+		})
+		if err == nil && !echoed {
+			return fmt.Errorf("%s %s: %w: the server did not echo the message", m.Command, m.Params.Get(1), ErrNotDelivered)
+		}
+		return err
+	}
+
+	return c.request(ctx, m, true, func(reply *Message) (bool, error) {
+		if err := deliveryError(m, reply); err != nil {
+			return true, err
+		}
+		return false, nil
+	})
+}
+
+// labeledReply returns an accept function for request which completes with the server's reply to m sent with label:
+// an ACK, an echo, or a numeric, either on its own or as the first message of a labeled-response batch.
+func labeledReply(m *Message, label string) func(*Message) (bool, error) {
+	var batch string
+	return func(reply *Message) (bool, error) {
+		if batch != "" {
+			switch {
+			case reply.Command.is("BATCH") && reply.Params.Get(1) == "-"+batch:
+				return true, nil
+			case reply.Tags.Get("batch") == batch && isErrorReply(reply):
+				return true, rejected(m, reply)
+			}
+			return false, nil
+		}
+		if reply.Tags.Get("label") != label {
+			return false, nil
+		}
+		if reply.Command.is("BATCH") {
+			batch = strings.TrimPrefix(reply.Params.Get(1), "+")
+			return false, nil
+		}
+		if isErrorReply(reply) {
+			return true, rejected(m, reply)
+		}
+		return true, nil
+	}
+}
+
+// deliveryError returns an error if reply is an error about m:
+// an error numeric or FAIL whose subject is m's target or command.
+func deliveryError(m, reply *Message) error {
+	if !isErrorReply(reply) {
+		return nil
+	}
+	subject := reply.Params.Get(2)
+	if reply.Command.is("FAIL") {
+		subject = reply.Params.Get(1)
+	}
+	if strings.EqualFold(subject, m.Params.Get(1)) || strings.EqualFold(subject, m.Command.String()) {
+		return rejected(m, reply)
+	}
+	return nil
+}
+
+// isErrorReply reports whether reply is an error numeric (400-599) or a FAIL standard reply.
+func isErrorReply(reply *Message) bool {
+	cmd := reply.Command.String()
+	if cmd == "FAIL" {
+		return true
+	}
+	return len(cmd) == 3 && (cmd[0] == '4' || cmd[0] == '5') && isDigit(cmd[1]) && isDigit(cmd[2])
+}
+
+func rejected(m, reply *Message) error {
+	return fmt.Errorf("%s %s: %w: %s %s", m.Command, m.Params.Get(1), ErrNotDelivered, reply.Command, reply.Params.Get(len(reply.Params)))
+}
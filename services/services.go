@@ -0,0 +1,309 @@
+/*
+Package services talks to the channel services of IRC networks, such as ChanServ or QuakeNet's Q,
+so that moderation features can ask for ops, read access lists, and check whether a channel is registered
+without knowing which services package the network runs.
+
+Each network's commands and replies are described by a Dialect.
+The dialects of the common services packages are predefined,
+and a custom Dialect can be written for any other network:
+
+	s := &services.Services{Dialect: services.Atheme}
+	r.Use(s.Middleware)
+	// later, outside of a handler:
+	entries, err := s.AccessList(ctx, client, "#channel")
+*/
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/Travis-Britz/irc"
+)
+
+// Errors returned by the queries of Services.
+var (
+	ErrNotRegistered = errors.New("channel is not registered")
+	ErrAccessDenied  = errors.New("access denied")
+)
+
+// A Dialect describes the commands and replies of a network's channel services.
+//
+// Commands are text/template templates executed with the fields .Channel and .Nick,
+// and are sent to Target as a PRIVMSG.
+// Replies are NOTICEs from Nick, matched line by line with the regular expressions.
+type Dialect struct {
+	Name string
+
+	// Target is where commands are sent, e.g. "ChanServ" or "Q@CServe.quakenet.org".
+	Target string
+
+	// Nick is the nickname the replies come from.
+	Nick string
+
+	Op, Deop, Voice, Devoice string
+
+	// Access lists the users with access to a channel.
+	// Each line matching AccessEntry is an entry of the list, with the named groups "account" and "level".
+	// The list ends with a line matching AccessEnd.
+	Access      string
+	AccessEntry *regexp.Regexp
+	AccessEnd   *regexp.Regexp
+
+	// Info queries the registration of a channel, answered by a line matching Registered or NotRegistered.
+	Info          string
+	Registered    *regexp.Regexp
+	NotRegistered *regexp.Regexp
+
+	// Denied matches the replies which refuse a command, such as for lack of access.
+	Denied *regexp.Regexp
+}
+
+// Dialects of the common services packages.
+var (
+	// Atheme is used by Libera.Chat, OFTC (as a fork), and many smaller networks.
+	Atheme = &Dialect{
+		Name:          "Atheme",
+		Target:        "ChanServ",
+		Nick:          "ChanServ",
+		Op:            "OP {{.Channel}} {{.Nick}}",
+		Deop:          "DEOP {{.Channel}} {{.Nick}}",
+		Voice:         "VOICE {{.Channel}} {{.Nick}}",
+		Devoice:       "DEVOICE {{.Channel}} {{.Nick}}",
+		Access:        "FLAGS {{.Channel}}",
+		AccessEntry:   regexp.MustCompile(`^\s*\d+\s+(?P<account>\S+)\s+(?P<level>\+\S+)`),
+		AccessEnd:     regexp.MustCompile(`^End of \S+ FLAGS listing`),
+		Info:          "INFO {{.Channel}}",
+		Registered:    regexp.MustCompile(`^Information on \S+:`),
+		NotRegistered: regexp.MustCompile(`is not registered`),
+		Denied:        regexp.MustCompile(`(?i)you are not authorized|access denied`),
+	}
+
+	// Anope is used by networks such as Rizon and many smaller networks.
+	Anope = &Dialect{
+		Name:          "Anope",
+		Target:        "ChanServ",
+		Nick:          "ChanServ",
+		Op:            "OP {{.Channel}} {{.Nick}}",
+		Deop:          "DEOP {{.Channel}} {{.Nick}}",
+		Voice:         "VOICE {{.Channel}} {{.Nick}}",
+		Devoice:       "DEVOICE {{.Channel}} {{.Nick}}",
+		Access:        "ACCESS {{.Channel}} LIST",
+		AccessEntry:   regexp.MustCompile(`^\s*\d+\s+(?P<level>-?\d+|[A-Z]+)\s+(?P<account>\S+)`),
+		AccessEnd:     regexp.MustCompile(`^End of access list|access list is empty`),
+		Info:          "INFO {{.Channel}}",
+		Registered:    regexp.MustCompile(`^Information for channel \S+:`),
+		NotRegistered: regexp.MustCompile(`is not registered`),
+		Denied:        regexp.MustCompile(`(?i)access denied`),
+	}
+
+	// GameSurge is srvx, the services of GameSurge.
+	GameSurge = &Dialect{
+		Name:          "GameSurge",
+		Target:        "ChanServ",
+		Nick:          "ChanServ",
+		Op:            "OP {{.Channel}} {{.Nick}}",
+		Deop:          "DEOP {{.Channel}} {{.Nick}}",
+		Voice:         "VOICE {{.Channel}} {{.Nick}}",
+		Devoice:       "DEVOICE {{.Channel}} {{.Nick}}",
+		Access:        "USERS {{.Channel}}",
+		AccessEntry:   regexp.MustCompile(`^\s*(?P<level>\d+)\s+(?P<account>\S+)`),
+		AccessEnd:     regexp.MustCompile(`^There (are|is) \d+ users? in`),
+		Info:          "INFO {{.Channel}}",
+		Registered:    regexp.MustCompile(`^\S+ Information:`),
+		NotRegistered: regexp.MustCompile(`has not been registered`),
+		Denied:        regexp.MustCompile(`(?i)you lack access|access denied`),
+	}
+
+	// QuakeNet is Q, the channel service of QuakeNet.
+	// Q has no INFO command, so the registration is read from the reply to CHANLEV.
+	QuakeNet = &Dialect{
+		Name:          "QuakeNet",
+		Target:        "Q@CServe.quakenet.org",
+		Nick:          "Q",
+		Op:            "OP {{.Channel}} {{.Nick}}",
+		Deop:          "DEOP {{.Channel}} {{.Nick}}",
+		Voice:         "VOICE {{.Channel}} {{.Nick}}",
+		Devoice:       "DEVOICE {{.Channel}} {{.Nick}}",
+		Access:        "CHANLEV {{.Channel}}",
+		AccessEntry:   regexp.MustCompile(`^\s*(?P<account>\S+)\s+(?P<level>\+[a-zA-Z]+)`),
+		AccessEnd:     regexp.MustCompile(`^End of list`),
+		Info:          "CHANLEV {{.Channel}}",
+		Registered:    regexp.MustCompile(`^Known users on \S+:`),
+		NotRegistered: regexp.MustCompile(`is unknown or suspended`),
+		Denied:        regexp.MustCompile(`(?i)you do not have sufficient access|access denied`),
+	}
+)
+
+// AccessEntry is an entry of a channel's access list.
+type AccessEntry struct {
+
+	// Account is the account or mask which has access.
+	Account string
+
+	// Level is the access as the services show it, such as "300" on Anope or "+amnotv" on Q.
+	Level string
+}
+
+// Services sends commands to the channel services described by Dialect, which must be set, and parses their replies.
+// Middleware must be installed on the client's handler so that Services sees the replies.
+//
+// The queries wait for replies which are read by the client's handlers,
+// so they must be called from another goroutine, not from a handler.
+// Queries are sent one at a time, since services don't mark which command a reply belongs to.
+type Services struct {
+	Dialect *Dialect
+
+	// sem allows one query at a time; once creates it
+	once sync.Once
+	sem  chan struct{}
+
+	mu      sync.Mutex
+	waiting bool          // set while a query waits for replies
+	lines   []string      // the lines of the reply which the query hasn't read yet
+	ready   chan struct{} // signaled when lines are added
+}
+
+// Middleware passes the replies of the services to the waiting query.
+func (s *Services) Middleware(next irc.Handler) irc.Handler {
+	return irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+		if strings.EqualFold(m.Command.String(), irc.CmdNotice) && s.Dialect != nil && m.Source.Nick.Is(s.Dialect.Nick) {
+			s.mu.Lock()
+			if s.waiting {
+				// long replies, such as access lists, are collected without blocking the client's handlers
+				s.lines = append(s.lines, m.Params.Get(2))
+				select {
+				case s.ready <- struct{}{}:
+				default:
+				}
+			}
+			s.mu.Unlock()
+		}
+		next.SpeakIRC(w, m)
+	})
+}
+
+// Op asks the services to give channel operator status to nick.
+func (s *Services) Op(w irc.MessageWriter, channel, nick string) error {
+	return s.send(w, s.Dialect.Op, channel, nick)
+}
+
+// Deop asks the services to remove channel operator status from nick.
+func (s *Services) Deop(w irc.MessageWriter, channel, nick string) error {
+	return s.send(w, s.Dialect.Deop, channel, nick)
+}
+
+// Voice asks the services to give voice to nick.
+func (s *Services) Voice(w irc.MessageWriter, channel, nick string) error {
+	return s.send(w, s.Dialect.Voice, channel, nick)
+}
+
+// Devoice asks the services to remove voice from nick.
+func (s *Services) Devoice(w irc.MessageWriter, channel, nick string) error {
+	return s.send(w, s.Dialect.Devoice, channel, nick)
+}
+
+// AccessList returns the access list of channel.
+func (s *Services) AccessList(ctx context.Context, w irc.MessageWriter, channel string) ([]AccessEntry, error) {
+	d := s.Dialect
+	var entries []AccessEntry
+	err := s.query(ctx, w, d.Access, channel, func(line string) (bool, error) {
+		switch {
+		case d.NotRegistered != nil && d.NotRegistered.MatchString(line):
+			return true, fmt.Errorf("%s: %w", channel, ErrNotRegistered)
+		case d.AccessEnd.MatchString(line):
+			return true, nil
+		}
+		if match := d.AccessEntry.FindStringSubmatch(line); match != nil {
+			entries = append(entries, AccessEntry{
+				Account: match[d.AccessEntry.SubexpIndex("account")],
+				Level:   match[d.AccessEntry.SubexpIndex("level")],
+			})
+		}
+		return false, nil
+	})
+	return entries, err
+}
+
+// Registered reports whether channel is registered with the services.
+func (s *Services) Registered(ctx context.Context, w irc.MessageWriter, channel string) (bool, error) {
+	d := s.Dialect
+	var registered bool
+	err := s.query(ctx, w, d.Info, channel, func(line string) (bool, error) {
+		switch {
+		case d.NotRegistered != nil && d.NotRegistered.MatchString(line):
+			return true, nil
+		case d.Registered != nil && d.Registered.MatchString(line):
+			registered = true
+			return true, nil
+		}
+		return false, nil
+	})
+	return registered, err
+}
+
+// query sends the command tmpl about channel, and passes each line of the reply to accept until it's done.
+func (s *Services) query(ctx context.Context, w irc.MessageWriter, tmpl, channel string, accept func(line string) (bool, error)) error {
+	s.once.Do(func() { s.sem = make(chan struct{}, 1) })
+	select {
+	case s.sem <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-s.sem }()
+
+	ready := make(chan struct{}, 1)
+	s.mu.Lock()
+	s.waiting, s.lines, s.ready = true, nil, ready
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.waiting, s.lines, s.ready = false, nil, nil
+		s.mu.Unlock()
+	}()
+
+	if err := s.send(w, tmpl, channel, ""); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		s.mu.Lock()
+		lines := s.lines
+		s.lines = nil
+		s.mu.Unlock()
+		for _, line := range lines {
+			if d := s.Dialect.Denied; d != nil && d.MatchString(line) {
+				return fmt.Errorf("%s: %w: %s", s.Dialect.Target, ErrAccessDenied, line)
+			}
+			if done, err := accept(line); done {
+				return err
+			}
+		}
+	}
+}
+
+// send writes the command tmpl to the services.
+func (s *Services) send(w irc.MessageWriter, tmpl, channel, nick string) error {
+	if tmpl == "" {
+		return fmt.Errorf("services: %s does not support the command", s.Dialect.Name)
+	}
+	t, err := template.New("").Parse(tmpl)
+	if err != nil {
+		return fmt.Errorf("services: %w", err)
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, struct{ Channel, Nick string }{channel, nick}); err != nil {
+		return fmt.Errorf("services: %w", err)
+	}
+	w.WriteMessage(irc.Msg(s.Dialect.Target, b.String()))
+	return nil
+}
@@ -0,0 +1,92 @@
+package services_test
+
+import (
+	"context"
+	"encoding"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Travis-Britz/irc"
+	"github.com/Travis-Britz/irc/services"
+)
+
+// fakeServices answers the commands written to it with the NOTICEs in replies, through h.
+// The replies are passed to h before WriteMessage returns, as quickly as the client could read them.
+type fakeServices struct {
+	nick    string
+	replies map[string][]string
+	h       irc.Handler
+	sent    []string
+}
+
+func (f *fakeServices) WriteMessage(m encoding.TextMarshaler) {
+	msg := m.(*irc.Message)
+	text := msg.Params.Get(2)
+	f.sent = append(f.sent, msg.Params.Get(1)+" "+text)
+	for _, line := range f.replies[text] {
+		n := irc.NewMessage(irc.CmdNotice, "bot", line)
+		n.Source = irc.Prefix{Nick: irc.Nickname(f.nick), User: "services", Host: "services.example.com"}
+		f.h.SpeakIRC(f, n)
+	}
+}
+
+func TestServices(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	s := &services.Services{Dialect: services.Atheme}
+	f := &fakeServices{
+		nick: "ChanServ",
+		replies: map[string][]string{
+			"FLAGS #chan": {
+				"Entry Nickname/Host          Flags",
+				"----- ---------------------- -----",
+				"1     alice                  +AFRefiorstv (FOUNDER) [modified 1 year ago]",
+				"2     bob                    +Vv [modified 3 days ago]",
+				"----- ---------------------- -----",
+				"End of #chan FLAGS listing.",
+			},
+			"FLAGS #big":   bigListing(100),
+			"FLAGS #other": {"You are not authorized to execute this command."},
+			"INFO #chan":   {"Information on #chan:", "Founder    : alice"},
+			"INFO #new":    {"\x02#new\x02 is not registered."},
+		},
+	}
+	f.h = s.Middleware(irc.HandlerFunc(func(irc.MessageWriter, *irc.Message) {}))
+
+	if err := s.Op(f, "#chan", "bot"); err != nil || f.sent[0] != "ChanServ OP #chan bot" {
+		t.Errorf("expected OP to be sent to ChanServ; got %q, %v", f.sent, err)
+	}
+
+	entries, err := s.AccessList(ctx, f, "#chan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0] != (services.AccessEntry{Account: "alice", Level: "+AFRefiorstv"}) || entries[1].Account != "bob" {
+		t.Errorf("unexpected access list: %+v", entries)
+	}
+	if entries, err := s.AccessList(ctx, f, "#big"); err != nil || len(entries) != 100 {
+		t.Errorf("expected every entry of a long access list; got %d, %v", len(entries), err)
+	}
+	if _, err := s.AccessList(ctx, f, "#other"); !errors.Is(err, services.ErrAccessDenied) {
+		t.Errorf("expected ErrAccessDenied; got %v", err)
+	}
+
+	for channel, want := range map[string]bool{"#chan": true, "#new": false} {
+		registered, err := s.Registered(ctx, f, channel)
+		if err != nil || registered != want {
+			t.Errorf("Registered(%s): expected %v; got %v, %v", channel, want, registered, err)
+		}
+	}
+}
+
+// bigListing returns a FLAGS listing of #big with n entries.
+func bigListing(n int) []string {
+	lines := []string{"Entry Nickname/Host          Flags", "----- ---------------------- -----"}
+	for i := 1; i <= n; i++ {
+		lines = append(lines, fmt.Sprintf("%-5d user%-18d +v [modified 1 day ago]", i, i))
+	}
+	return append(lines, "----- ---------------------- -----", "End of #big FLAGS listing.")
+}
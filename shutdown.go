@@ -0,0 +1,90 @@
+package irc
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DefaultQuitMessage is the reason sent with QUIT during a graceful shutdown when Client.QuitMessage is empty.
+const DefaultQuitMessage = "closing link"
+
+// DefaultShutdownTimeout is how long a graceful shutdown waits for the server to close the connection after QUIT,
+// when Client.ShutdownTimeout is 0.
+const DefaultShutdownTimeout = 3 * time.Second
+
+// shutdown is the graceful shutdown of a connection, which happens at most once.
+type shutdown struct {
+
+	// ctx is done when the connection is closed.
+	ctx context.Context
+
+	once sync.Once
+}
+
+// Shutdown gracefully closes the client's connection, like the cancellation of the context passed to ConnectAndRun:
+//
+//  1. messages held for channels which the client is still joining are dropped and reported to ErrorLog (see JoinTimeout),
+//  2. OnShutdown is called to write any final messages,
+//  3. the messages delayed by FloodControl are written,
+//  4. QUIT is sent with QuitMessage, and the server is given ShutdownTimeout to close the connection before the client closes it.
+//
+// Shutdown returns when the connection is closed, after which ConnectAndRun returns nil.
+// If ctx is done first, the connection is closed immediately and Shutdown returns ctx.Err().
+// Shutdown returns ErrNotConnected if the client has no connection.
+//
+// Like the other Client methods which wait for the server, Shutdown must not be called from a handler.
+func (c *Client) Shutdown(ctx context.Context) error {
+	c.connMu.Lock()
+	s := c.closing
+	c.connMu.Unlock()
+	if s == nil || s.ctx.Err() != nil {
+		return ErrNotConnected
+	}
+	go c.quit(ctx, s)
+	select {
+	case <-s.ctx.Done():
+		return nil
+	case <-ctx.Done():
+		c.exit(nil)
+		return ctx.Err()
+	}
+}
+
+// quit runs the steps of a graceful shutdown, unless they already ran,
+// and waits until the connection is closed.
+// The steps stop waiting when ctx is done.
+func (c *Client) quit(ctx context.Context, s *shutdown) {
+	s.once.Do(func() {
+		c.connMu.Lock()
+		outbox, flood := c.outbox, c.flood
+		c.connMu.Unlock()
+		if outbox != nil {
+			outbox.discard()
+		}
+		if c.OnShutdown != nil {
+			c.OnShutdown(c)
+		}
+		if flood != nil {
+			flood.drain(ctx)
+		}
+		reason := c.QuitMessage
+		if reason == "" {
+			reason = DefaultQuitMessage
+		}
+		c.WriteMessage(Quit(reason))
+
+		timeout := c.ShutdownTimeout
+		if timeout <= 0 {
+			timeout = DefaultShutdownTimeout
+		}
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		select {
+		// after sending QUIT we wait for the server to close the connection
+		case <-s.ctx.Done():
+		case <-t.C:
+			c.exit(nil)
+		}
+	})
+}
@@ -0,0 +1,144 @@
+package irc
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNoState is returned by the Load method of a StateStore for a key which was never saved.
+var ErrNoState = errors.New("no saved state")
+
+// A StateStore keeps state which should survive a restart of the bot,
+// such as the timers of a FloodControl or the cooldowns of a Router,
+// so that restarting doesn't reset abuse counters.
+//
+// Keys are short names such as "flood" or "router". Data is opaque to the store.
+// A StateStore must be safe for concurrent use.
+type StateStore interface {
+
+	// Load returns the data last saved for key, or ErrNoState if nothing was saved.
+	Load(key string) ([]byte, error)
+
+	// Save replaces the data of key.
+	Save(key string, data []byte) error
+}
+
+// A Snapshotter is state which can be saved to a StateStore and restored from it.
+// PenaltyFlood, TwitchFlood, and Router are Snapshotters.
+type Snapshotter interface {
+
+	// Snapshot returns the current state.
+	Snapshot() ([]byte, error)
+
+	// Restore replaces the current state with data returned by an earlier Snapshot.
+	Restore(data []byte) error
+}
+
+// SaveState saves a snapshot of s to store as key.
+func SaveState(store StateStore, key string, s Snapshotter) error {
+	data, err := s.Snapshot()
+	if err != nil {
+		return fmt.Errorf("state %q: %w", key, err)
+	}
+	if err := store.Save(key, data); err != nil {
+		return fmt.Errorf("state %q: %w", key, err)
+	}
+	return nil
+}
+
+// RestoreState restores s from the snapshot saved to store as key.
+// s is left unchanged if nothing was saved.
+func RestoreState(store StateStore, key string, s Snapshotter) error {
+	data, err := store.Load(key)
+	if errors.Is(err, ErrNoState) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("state %q: %w", key, err)
+	}
+	if err := s.Restore(data); err != nil {
+		return fmt.Errorf("state %q: %w", key, err)
+	}
+	return nil
+}
+
+// DirStore is a StateStore which saves each key to a file of the same name in a directory.
+// The directory is created when the first key is saved.
+type DirStore string
+
+// Load implements StateStore.
+func (d DirStore) Load(key string) ([]byte, error) {
+	path, err := d.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNoState
+	}
+	return data, err
+}
+
+// Save implements StateStore. The file is replaced atomically,
+// so a crash while saving leaves the previous data in place.
+func (d DirStore) Save(key string, data []byte) error {
+	path, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(string(d), 0700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(string(d), key+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (d DirStore) path(key string) (string, error) {
+	if key == "" || key == "." || key == ".." || strings.ContainsAny(key, `/\`) {
+		return "", fmt.Errorf("invalid state key %q", key)
+	}
+	return filepath.Join(string(d), key), nil
+}
+
+// stateKeyFlood is the key of the client's FloodControl in Client.Store.
+const stateKeyFlood = "flood"
+
+// restoreFlood restores f from the client's Store, if it has one and f is a Snapshotter.
+// c.connMu must not be held, since the store may be slow.
+func (c *Client) restoreFlood(f FloodControl) {
+	s, ok := f.(Snapshotter)
+	if c.Store == nil || !ok {
+		return
+	}
+	if err := RestoreState(c.Store, stateKeyFlood, s); err != nil {
+		c.log(err)
+	}
+}
+
+// saveFlood saves the FloodControl of g to the client's Store, if it has one and the FloodControl is a Snapshotter.
+func (c *Client) saveFlood(g *floodGate) {
+	c.connMu.Lock()
+	s, ok := g.control.(Snapshotter)
+	c.connMu.Unlock()
+	if c.Store == nil || !ok {
+		return
+	}
+	if err := SaveState(c.Store, stateKeyFlood, s); err != nil {
+		c.log(err)
+	}
+}
@@ -0,0 +1,232 @@
+package irc
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StatsReply is the server's reply to a STATS query, collected by Client.Stats.
+//
+// The replies to the common queries are parsed into fields;
+// the others are only available in Replies, since their format differs between servers.
+type StatsReply struct {
+	Query string
+
+	// Links is the reply to STATS l (RPL_STATSLINKINFO).
+	Links []StatsLink
+
+	// Commands is the reply to STATS m (RPL_STATSCOMMANDS).
+	Commands []StatsCommand
+
+	// Uptime is the reply to STATS u (RPL_STATSUPTIME).
+	Uptime time.Duration
+
+	// Replies holds every reply to the query except RPL_ENDOFSTATS, including those parsed into fields.
+	Replies []*Message
+}
+
+// StatsLink is the state of a connection of the server, as reported by STATS l.
+type StatsLink struct {
+	Name             string
+	SendQ            int
+	SentMessages     int
+	SentKBytes       int
+	ReceivedMessages int
+	ReceivedKBytes   int
+	Open             time.Duration
+}
+
+// StatsCommand is the usage of a command, as reported by STATS m.
+type StatsCommand struct {
+	Command     string
+	Count       int
+	Bytes       int
+	RemoteCount int
+}
+
+// add records a reply to the query.
+func (s *StatsReply) add(m *Message) {
+	s.Replies = append(s.Replies, m)
+	switch m.Command {
+	// "<client> <linkname> <sendq> <sent messages> <sent Kbytes> <received messages> <received Kbytes> <time open>"
+	case RplStatsLinkInfo:
+		n := atois(m.Params[1:]...)
+		s.Links = append(s.Links, StatsLink{
+			Name:             m.Params.Get(2),
+			SendQ:            n[1],
+			SentMessages:     n[2],
+			SentKBytes:       n[3],
+			ReceivedMessages: n[4],
+			ReceivedKBytes:   n[5],
+			Open:             time.Duration(n[6]) * time.Second,
+		})
+
+	// "<client> <command> <count> [<byte count> <remote count>]"
+	case RplStatsCommands:
+		n := atois(m.Params[1:]...)
+		s.Commands = append(s.Commands, StatsCommand{Command: m.Params.Get(2), Count: n[1], Bytes: n[2], RemoteCount: n[3]})
+
+	// "<client> :Server Up <days> days <hours>:<minutes>:<seconds>"
+	case RplStatsUptime:
+		var days, h, min, sec int
+		if _, err := fmt.Sscanf(m.Params.Get(2), "Server Up %d days %d:%d:%d", &days, &h, &min, &sec); err == nil {
+			s.Uptime = time.Duration(days)*24*time.Hour + time.Duration(h)*time.Hour + time.Duration(min)*time.Minute + time.Duration(sec)*time.Second
+		}
+	}
+}
+
+// isStatsReply reports whether m is one of the numerics sent in reply to STATS.
+func isStatsReply(m *Message) bool {
+	n, err := strconv.Atoi(m.Command.String())
+	if err != nil || len(m.Command) != 3 {
+		return false
+	}
+	return (n >= 211 && n <= 218) || (n >= 240 && n <= 250)
+}
+
+// Stats queries the statistics of type query, e.g. "u" for the server's uptime,
+// and collects the replies until RPL_ENDOFSTATS.
+// If server is empty, the statistics of the server the client is on are returned.
+//
+// Many queries are only available to IRC operators; when they're refused, the error wraps ErrNoPrivileges.
+// Like the other Client methods which wait for a reply, Stats must not be called from a handler.
+func (c *Client) Stats(ctx context.Context, query, server string) (*StatsReply, error) {
+	reply := &StatsReply{Query: query}
+	refused := commandReply(CmdStats, "")
+	err := c.request(ctx, Stats(query, server), false, func(m *Message) (bool, error) {
+		if done, err := refused(m); done {
+			return true, err
+		}
+		if m.Command.is(RplEndOfStats) {
+			return true, nil
+		}
+		if isStatsReply(m) {
+			reply.add(m)
+		}
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// LUsersReply is the server's reply to LUSERS, collected by Client.LUsers.
+// Counts which the server didn't report are 0.
+type LUsersReply struct {
+
+	// Users, Invisible, Services, and Servers are the totals of the network (RPL_LUSERCLIENT).
+	// Users may or may not include the invisible users, depending on the server.
+	Users     int
+	Invisible int
+	Services  int
+	Servers   int
+
+	// Operators is the number of IRC operators online (RPL_LUSEROP).
+	Operators int
+
+	// Unknown is the number of connections which haven't registered yet (RPL_LUSERUNKNOWN).
+	Unknown int
+
+	// Channels is the number of channels (RPL_LUSERCHANNELS).
+	Channels int
+
+	// LocalClients and LocalServers are connected to the server the client is on (RPL_LUSERME).
+	LocalClients int
+	LocalServers int
+
+	// LocalUsers and GlobalUsers are the current user counts, and MaxLocalUsers and MaxGlobalUsers
+	// their highest values (RPL_LOCALUSERS and RPL_GLOBALUSERS).
+	LocalUsers     int
+	MaxLocalUsers  int
+	GlobalUsers    int
+	MaxGlobalUsers int
+}
+
+// add records a reply to LUSERS.
+func (l *LUsersReply) add(m *Message) {
+	text := m.Params.Get(len(m.Params))
+	switch m.Command {
+	// "<client> :There are <u> users and <i> invisible on <s> servers"
+	case RplLUserClient:
+		counts := countWords(text)
+		l.Users, l.Invisible, l.Services, l.Servers = counts["users"], counts["invisible"], counts["services"], counts["servers"]
+	case RplLUserOp:
+		l.Operators = atois(m.Params.Get(2))[0]
+	case RplLUserUknownL:
+		l.Unknown = atois(m.Params.Get(2))[0]
+	case RplLUserChannels:
+		l.Channels = atois(m.Params.Get(2))[0]
+	// "<client> :I have <c> clients and <s> servers"
+	case RplLUserMe:
+		counts := countWords(text)
+		l.LocalClients, l.LocalServers = counts["clients"], counts["servers"]
+	// "<client> [<u> <m>] :Current local users <u>, max <m>"
+	case RplLocalUsers:
+		l.LocalUsers, l.MaxLocalUsers = userCounts(m)
+	case RplGlobalUsers:
+		l.GlobalUsers, l.MaxGlobalUsers = userCounts(m)
+	}
+}
+
+// LUsers queries the size of the network.
+// Like the other Client methods which wait for a reply, LUsers must not be called from a handler.
+func (c *Client) LUsers(ctx context.Context) (*LUsersReply, error) {
+	reply := &LUsersReply{}
+	refused := commandReply(CmdLUsers, "")
+	// servers send a varying set of numerics with no end marker, so the reply is complete at the barrier
+	err := c.request(ctx, LUsers(), true, func(m *Message) (bool, error) {
+		if done, err := refused(m); done {
+			return true, err
+		}
+		reply.add(m)
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// atois converts each of params to an int, with 0 for anything which isn't a number.
+// The result has room for at least 8 values, so that missing optional parameters read as 0.
+func atois(params ...string) []int {
+	n := make([]int, len(params), len(params)+8)
+	for i, p := range params {
+		n[i], _ = strconv.Atoi(p)
+	}
+	return n[:cap(n)]
+}
+
+// countWords returns the numbers in text keyed by the lowercase word following each,
+// e.g. {"users": 5, "servers": 2} for "There are 5 users on 2 servers".
+func countWords(text string) map[string]int {
+	counts := make(map[string]int)
+	fields := strings.Fields(text)
+	for i := 0; i+1 < len(fields); i++ {
+		if n, err := strconv.Atoi(fields[i]); err == nil {
+			counts[strings.ToLower(strings.Trim(fields[i+1], ",.:"))] = n
+		}
+	}
+	return counts
+}
+
+// userCounts returns the current and maximum counts of RPL_LOCALUSERS or RPL_GLOBALUSERS,
+// from the optional parameters or else from the text.
+func userCounts(m *Message) (current, max int) {
+	if len(m.Params) >= 4 {
+		n := atois(m.Params.Get(2), m.Params.Get(3))
+		return n[0], n[1]
+	}
+	var numbers []int
+	for _, f := range strings.Fields(m.Params.Get(len(m.Params))) {
+		if n, err := strconv.Atoi(strings.Trim(f, ",.:")); err == nil {
+			numbers = append(numbers, n)
+		}
+	}
+	numbers = append(numbers, 0, 0)
+	return numbers[0], numbers[1]
+}
@@ -0,0 +1,141 @@
+package irc
+
+import "fmt"
+
+// TokenType identifies the kind of a Token.
+type TokenType int
+
+const (
+	// TokenError is returned when the line can't be tokenized. Tokenizer.Err returns the *ParseError.
+	TokenError TokenType = iota
+
+	// TokenTagKey is the name of a message tag, including any client prefix and vendor, e.g. "+example.com/foo".
+	// A TokenTagValue always follows it.
+	TokenTagKey
+
+	// TokenTagValue is the value of the preceding tag key, still escaped as it was written.
+	// It's empty when the tag had no value.
+	TokenTagValue
+
+	// TokenNickname is the nickname of a prefix in the nick!user@host form, or a nickname prefix by itself.
+	TokenNickname
+
+	// TokenUser is the user of a prefix in the nick!user@host form.
+	TokenUser
+
+	// TokenHost is the host of a prefix, or a server name prefix by itself.
+	TokenHost
+
+	// TokenCommand is the verb or numeric.
+	TokenCommand
+
+	// TokenParam is a middle parameter, or a last parameter which was written without the ':' sentinel.
+	TokenParam
+
+	// TokenTrailing is a last parameter which was written with the ':' sentinel.
+	TokenTrailing
+
+	// TokenEOF marks the end of the line.
+	TokenEOF
+)
+
+func (t TokenType) String() string {
+	switch t {
+	case TokenError:
+		return "Error"
+	case TokenTagKey:
+		return "TagKey"
+	case TokenTagValue:
+		return "TagValue"
+	case TokenNickname:
+		return "Nickname"
+	case TokenUser:
+		return "User"
+	case TokenHost:
+		return "Host"
+	case TokenCommand:
+		return "Command"
+	case TokenParam:
+		return "Param"
+	case TokenTrailing:
+		return "Trailing"
+	case TokenEOF:
+		return "EOF"
+	default:
+		return ""
+	}
+}
+
+// Token is a piece of an IRC line returned by a Tokenizer.
+type Token struct {
+	Type TokenType
+
+	// Value is the text of the token, without delimiters.
+	// For TokenError it's the error message.
+	Value string
+
+	// Offset is the byte offset of Value in the line.
+	Offset int
+}
+
+func (t Token) String() string {
+	switch t.Type {
+	case TokenEOF:
+		return "EOF"
+	case TokenError:
+		return t.Value
+	}
+	return fmt.Sprintf("%s: %q", t.Type, t.Value)
+}
+
+// Tokenizer splits a single IRC line into tokens,
+// using the same rules as Message.UnmarshalText but without building a Message.
+// It's meant for tools which need to see how a line was written,
+// such as protocol analyzers, fuzzers, or parsers for lines which UnmarshalText would reject part way through.
+//
+// A Tokenizer does no work until Next is called, and uses no goroutines.
+type Tokenizer struct {
+	l   *lexer
+	end bool
+}
+
+// NewTokenizer returns a Tokenizer for line, which should not include the trailing CR-LF.
+func NewTokenizer(line string) *Tokenizer {
+	return &Tokenizer{l: lex(line)}
+}
+
+// Next returns the next token of the line.
+// The last token is either TokenEOF or TokenError,
+// after which Next keeps returning TokenEOF.
+func (t *Tokenizer) Next() Token {
+	if t.end {
+		return Token{Type: TokenEOF, Offset: len(t.l.input)}
+	}
+	i := t.l.nextItem()
+	if i.typ == itemEOF || i.typ == itemError {
+		t.end = true
+	}
+	return Token{Type: itemTokens[i.typ], Value: i.val, Offset: i.pos}
+}
+
+// Err returns the *ParseError which ended the line, if Next returned TokenError.
+func (t *Tokenizer) Err() error {
+	if t.l.err == nil {
+		return nil
+	}
+	return t.l.err
+}
+
+// itemTokens maps the lexer's item types to the exported token types.
+var itemTokens = map[itemType]TokenType{
+	itemError:    TokenError,
+	itemTagKey:   TokenTagKey,
+	itemTagValue: TokenTagValue,
+	itemNickname: TokenNickname,
+	itemUser:     TokenUser,
+	itemHost:     TokenHost,
+	itemCommand:  TokenCommand,
+	itemParam:    TokenParam,
+	itemTrailing: TokenTrailing,
+	itemEOF:      TokenEOF,
+}
@@ -0,0 +1,234 @@
+package irc
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Topology is the tree of servers of a network, as reported by LINKS or MAP.
+// Networks which hide their topology from users report every server as linked to the server the client is on.
+type Topology struct {
+
+	// Root is the server which answered the query.
+	Root *ServerNode
+
+	// servers is keyed by the lowercase server name.
+	servers map[string]*ServerNode
+}
+
+// ServerNode is a server in a Topology.
+type ServerNode struct {
+	Name string
+
+	// Info is the server's description, or the rest of the server's line in MAP, such as its user count.
+	Info string
+
+	// Hops is the distance to the root, if the server reported it.
+	Hops int
+
+	// Parent is the hub the server is linked to, or nil for the root.
+	Parent   *ServerNode
+	Children []*ServerNode
+}
+
+// TopologyDiff is the difference between two snapshots of a network's Topology.
+type TopologyDiff struct {
+
+	// Linked are the servers which were added.
+	Linked []string
+
+	// Delinked are the servers which were removed, including those which split along with their hub.
+	Delinked []string
+
+	// Moved are the servers which are now linked to a different hub.
+	Moved []string
+}
+
+// Changed reports whether the topology changed at all.
+func (d TopologyDiff) Changed() bool {
+	return len(d.Linked)+len(d.Delinked)+len(d.Moved) > 0
+}
+
+// Server returns the server named name, or nil if it's not part of t.
+func (t *Topology) Server(name string) *ServerNode {
+	return t.servers[strings.ToLower(name)]
+}
+
+// Servers returns the names of the servers in t, from the root down in depth-first order.
+func (t *Topology) Servers() []string {
+	var names []string
+	var walk func(n *ServerNode)
+	walk = func(n *ServerNode) {
+		names = append(names, n.Name)
+		for _, child := range n.Children {
+			walk(child)
+		}
+	}
+	if t.Root != nil {
+		walk(t.Root)
+	}
+	return names
+}
+
+// Diff returns the changes from t to newer, e.g. between two polls of a network monitor.
+// The result lists server names in the order of Servers.
+func (t *Topology) Diff(newer *Topology) TopologyDiff {
+	var d TopologyDiff
+	for _, name := range newer.Servers() {
+		old := t.Server(name)
+		switch {
+		case old == nil:
+			d.Linked = append(d.Linked, name)
+		case parentName(old) != parentName(newer.Server(name)):
+			d.Moved = append(d.Moved, name)
+		}
+	}
+	for _, name := range t.Servers() {
+		if newer.Server(name) == nil {
+			d.Delinked = append(d.Delinked, name)
+		}
+	}
+	return d
+}
+
+func parentName(n *ServerNode) string {
+	if n.Parent == nil {
+		return ""
+	}
+	return strings.ToLower(n.Parent.Name)
+}
+
+// add creates the node for a server, or returns the existing one.
+func (t *Topology) add(name string) *ServerNode {
+	key := strings.ToLower(name)
+	if n := t.servers[key]; n != nil {
+		return n
+	}
+	if t.servers == nil {
+		t.servers = make(map[string]*ServerNode)
+	}
+	n := &ServerNode{Name: name}
+	t.servers[key] = n
+	return n
+}
+
+// link makes parent the hub of n.
+func (n *ServerNode) link(parent *ServerNode) {
+	n.Parent = parent
+	parent.Children = append(parent.Children, n)
+}
+
+// Links lists the servers of the network with LINKS, and arranges them into a Topology.
+// If mask is not empty, only the servers matching mask are listed.
+//
+// Like the other Client methods which wait for a reply, Links must not be called from a handler.
+func (c *Client) Links(ctx context.Context, mask string) (*Topology, error) {
+	type link struct{ server, hub string }
+	var links []link
+	t := &Topology{}
+	refused := commandReply(CmdLinks, "")
+	err := c.request(ctx, Links(mask), false, func(m *Message) (bool, error) {
+		if done, err := refused(m); done {
+			return true, err
+		}
+		switch m.Command {
+		// "<client> <server> <hub> :<hopcount> <server info>"
+		case RplLinks:
+			n := t.add(m.Params.Get(2))
+			hops, info, _ := strings.Cut(m.Params.Get(4), " ")
+			n.Hops, _ = strconv.Atoi(hops)
+			n.Info = info
+			links = append(links, link{server: n.Name, hub: m.Params.Get(3)})
+		case RplEndOfLinks:
+			return true, nil
+		}
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// servers are listed in no particular order, so the tree is built once every server is known
+	for _, l := range links {
+		n := t.Server(l.server)
+		if strings.EqualFold(l.server, l.hub) || n.Hops == 0 {
+			t.Root = n
+		}
+	}
+	if t.Root == nil && len(links) > 0 {
+		t.Root = t.Server(links[0].server)
+	}
+	for _, l := range links {
+		n := t.Server(l.server)
+		if n == t.Root {
+			continue
+		}
+		hub := t.Server(l.hub)
+		if hub == nil || hub == n {
+			// the hub is hidden or outside of mask
+			hub = t.Root
+		}
+		n.link(hub)
+	}
+	return t, nil
+}
+
+// Map fetches the network's server tree with MAP, which isn't supported by every server.
+// When it's not supported, the error wraps ErrUnknownCommand, and Links may be used instead.
+//
+// MAP draws the tree as indented text, and the depth of each server is taken from its indentation.
+//
+// Like the other Client methods which wait for a reply, Map must not be called from a handler.
+func (c *Client) Map(ctx context.Context) (*Topology, error) {
+	type level struct {
+		indent int
+		node   *ServerNode
+	}
+	var stack []level
+	t := &Topology{}
+	refused := commandReply(CmdMap, "")
+	err := c.request(ctx, Map(), false, func(m *Message) (bool, error) {
+		if done, err := refused(m); done {
+			return true, err
+		}
+		switch m.Command {
+		case RplMap:
+			line := m.Params.Get(len(m.Params))
+			indent := strings.IndexFunc(line, func(r rune) bool {
+				return unicode.IsLetter(r) || unicode.IsDigit(r)
+			})
+			if indent < 0 {
+				return false, nil
+			}
+			name, info, _ := strings.Cut(line[indent:], " ")
+			n := t.add(name)
+			n.Info = strings.TrimSpace(info)
+
+			for len(stack) > 0 && stack[len(stack)-1].indent >= indent {
+				stack = stack[:len(stack)-1]
+			}
+			if len(stack) == 0 {
+				if t.Root == nil {
+					t.Root = n
+				} else if n != t.Root {
+					n.link(t.Root)
+				}
+			} else {
+				n.link(stack[len(stack)-1].node)
+			}
+			if n.Parent != nil {
+				n.Hops = n.Parent.Hops + 1
+			}
+			stack = append(stack, level{indent: indent, node: n})
+		case RplMapEnd:
+			return true, nil
+		}
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
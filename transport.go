@@ -0,0 +1,95 @@
+package irc
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// ErrStalled is returned by ConnectAndRun when the connection stopped carrying data,
+// usually because the network path to the server was lost without either end closing the connection (a half-open connection).
+// Reconnecting right away is reasonable, since the server may not have noticed anything wrong.
+var ErrStalled = errors.New("transport stalled")
+
+// DefaultKeepAlive is the period of TCP keepalive probes used when Client.KeepAlive is 0.
+const DefaultKeepAlive = 15 * time.Second
+
+// configureTransport applies the client's transport settings to a newly dialed connection.
+// Connections which aren't TCP, e.g. pipes and mocks, are left alone.
+func (c *Client) configureTransport(conn io.ReadWriteCloser) {
+	if c.KeepAlive < 0 {
+		return
+	}
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	period := c.KeepAlive
+	if period == 0 {
+		period = DefaultKeepAlive
+	}
+	if err := tcp.SetKeepAlive(true); err != nil {
+		c.log(fmt.Errorf("enable TCP keepalive: %w", err))
+		return
+	}
+	if err := tcp.SetKeepAlivePeriod(period); err != nil {
+		c.log(fmt.Errorf("set TCP keepalive period: %w", err))
+	}
+}
+
+// reader returns the reader for incoming lines on conn,
+// which detects stalls when StallTimeout is set and conn supports deadlines.
+func (c *Client) reader(conn io.ReadWriteCloser) io.Reader {
+	nc, ok := conn.(net.Conn)
+	if !ok || c.StallTimeout <= 0 {
+		return conn
+	}
+	return &stallReader{conn: nc, timeout: c.StallTimeout, probe: func() {
+		// written by another goroutine because the reader must not block on writes
+		go c.WriteMessage(Ping("STALLCHECK"))
+	}}
+}
+
+// writeDeadline sets the deadline for the next write to conn, when StallTimeout is set.
+func (c *Client) writeDeadline(conn io.ReadWriteCloser) {
+	if nc, ok := conn.(net.Conn); ok && c.StallTimeout > 0 {
+		_ = nc.SetWriteDeadline(time.Now().Add(c.StallTimeout))
+	}
+}
+
+// stallReader reads from a connection with deadlines.
+// When nothing was read for timeout, it calls probe to make the server send something,
+// and when nothing was read for another timeout, Read returns ErrStalled.
+type stallReader struct {
+	conn    net.Conn
+	timeout time.Duration
+	probe   func()
+}
+
+func (r *stallReader) Read(b []byte) (int, error) {
+	probed := false
+	for {
+		_ = r.conn.SetReadDeadline(time.Now().Add(r.timeout))
+		n, err := r.conn.Read(b)
+		if n > 0 || !isTimeout(err) {
+			return n, err
+		}
+		if probed {
+			return 0, fmt.Errorf("%w: nothing received for %s", ErrStalled, 2*r.timeout)
+		}
+		probed = true
+		r.probe()
+	}
+}
+
+// isTimeout reports whether err is a network timeout.
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
@@ -0,0 +1,237 @@
+package twitch
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Travis-Britz/irc"
+)
+
+// Twitch-specific commands, sent when the twitch.tv/commands capability is enabled.
+const (
+	CmdUserNotice = "USERNOTICE" // A subscription, raid, or other channel event.
+	CmdRoomState  = "ROOMSTATE"  // The chat settings of a channel, such as slow mode.
+	CmdUserState  = "USERSTATE"  // The client's own badges in a channel, after joining or sending a message.
+)
+
+// Tier is the tier of a subscription.
+type Tier string
+
+// Subscription tiers, as sent in the msg-param-sub-plan tag.
+const (
+	TierPrime Tier = "Prime"
+	Tier1     Tier = "1000"
+	Tier2     Tier = "2000"
+	Tier3     Tier = "3000"
+)
+
+// UserNoticeEvent is a USERNOTICE: an event in a channel which Twitch announces in chat,
+// such as a subscription or a raid.
+// The variations with their own event type embed a UserNoticeEvent;
+// others, such as announcements, can be handled as a UserNoticeEvent with irc.On.
+type UserNoticeEvent struct {
+	Message *irc.Message
+	Channel string
+
+	// ID is the kind of event, from the msg-id tag, e.g. "resub" or "raid".
+	ID string
+
+	// Login, DisplayName, and UserID identify the user who caused the event.
+	Login       string
+	DisplayName string
+	UserID      string
+
+	// SystemMsg is Twitch's description of the event, e.g. "alice subscribed for 3 months!".
+	SystemMsg string
+
+	// Text is the message the user added, if any.
+	Text string
+}
+
+// Command implements irc.Event.
+func (e *UserNoticeEvent) Command() irc.Command { return CmdUserNotice }
+
+// Decode implements irc.Event. m must be a USERNOTICE.
+func (e *UserNoticeEvent) Decode(m *irc.Message) error {
+	return e.decode(m)
+}
+
+// decode decodes m, which must be a USERNOTICE with one of ids, or any msg-id if ids is empty.
+func (e *UserNoticeEvent) decode(m *irc.Message, ids ...string) error {
+	if !strings.EqualFold(string(m.Command), CmdUserNotice) || len(m.Params) < 1 {
+		return fmt.Errorf("decode %s: message is a %s", CmdUserNotice, m.Command)
+	}
+	id := m.Tags.Get("msg-id")
+	if len(ids) > 0 && !contains(ids, id) {
+		return fmt.Errorf("decode %s: msg-id is %q", CmdUserNotice, id)
+	}
+	*e = UserNoticeEvent{
+		Message:     m,
+		Channel:     m.Params.Get(1),
+		ID:          id,
+		Login:       m.Tags.Get("login"),
+		DisplayName: m.Tags.Get("display-name"),
+		UserID:      m.Tags.Get("user-id"),
+		SystemMsg:   m.Tags.Get("system-msg"),
+		Text:        m.Params.Get(2),
+	}
+	return nil
+}
+
+// SubEvent is a user subscribing to a channel, or announcing that they renewed their subscription.
+type SubEvent struct {
+	UserNoticeEvent
+
+	// Resub is set when the user announced a renewed subscription.
+	Resub bool
+
+	// CumulativeMonths is the total number of months the user has subscribed.
+	CumulativeMonths int
+
+	// StreakMonths is the number of consecutive months, or 0 when the user chose not to share it.
+	StreakMonths int
+
+	Tier     Tier
+	PlanName string
+}
+
+// Command implements irc.Event.
+func (e *SubEvent) Command() irc.Command { return CmdUserNotice }
+
+// Decode implements irc.Event. m must be a USERNOTICE with a msg-id of sub or resub.
+func (e *SubEvent) Decode(m *irc.Message) error {
+	*e = SubEvent{}
+	if err := e.UserNoticeEvent.decode(m, "sub", "resub"); err != nil {
+		return err
+	}
+	e.Resub = e.ID == "resub"
+	e.CumulativeMonths = intTag(m, "msg-param-cumulative-months")
+	if m.Tags.Get("msg-param-should-share-streak") == "1" {
+		e.StreakMonths = intTag(m, "msg-param-streak-months")
+	}
+	e.Tier = Tier(m.Tags.Get("msg-param-sub-plan"))
+	e.PlanName = m.Tags.Get("msg-param-sub-plan-name")
+	return nil
+}
+
+// SubGiftEvent is a user gifting a subscription to another user.
+// When a user gifts many subscriptions at once, Twitch sends a SubGiftEvent for each recipient.
+type SubGiftEvent struct {
+	UserNoticeEvent
+
+	// Anonymous is set when the gifter chose to stay anonymous.
+	// Login and DisplayName are then those of an account such as AnAnonymousGifter.
+	Anonymous bool
+
+	// Recipient and RecipientDisplayName identify the user who received the subscription.
+	Recipient            string
+	RecipientDisplayName string
+
+	Tier Tier
+
+	// Months is the number of months gifted at once (1 if the tag is missing).
+	Months int
+}
+
+// Command implements irc.Event.
+func (e *SubGiftEvent) Command() irc.Command { return CmdUserNotice }
+
+// Decode implements irc.Event. m must be a USERNOTICE with a msg-id of subgift or anonsubgift.
+func (e *SubGiftEvent) Decode(m *irc.Message) error {
+	*e = SubGiftEvent{}
+	if err := e.UserNoticeEvent.decode(m, "subgift", "anonsubgift"); err != nil {
+		return err
+	}
+	e.Anonymous = e.ID == "anonsubgift" || e.UserID == anonymousGifterID
+	e.Recipient = m.Tags.Get("msg-param-recipient-user-name")
+	e.RecipientDisplayName = m.Tags.Get("msg-param-recipient-display-name")
+	e.Tier = Tier(m.Tags.Get("msg-param-sub-plan"))
+	e.Months = intTag(m, "msg-param-gift-months")
+	if e.Months == 0 {
+		e.Months = 1
+	}
+	return nil
+}
+
+// anonymousGifterID is the user ID of the AnAnonymousGifter account, which sends anonymous gifts.
+const anonymousGifterID = "274598607"
+
+// RaidEvent is a broadcaster sending their viewers to the channel at the end of their stream.
+// The raiding broadcaster is identified by Login and DisplayName.
+type RaidEvent struct {
+	UserNoticeEvent
+
+	// Viewers is the number of viewers who came along.
+	Viewers int
+}
+
+// Command implements irc.Event.
+func (e *RaidEvent) Command() irc.Command { return CmdUserNotice }
+
+// Decode implements irc.Event. m must be a USERNOTICE with a msg-id of raid.
+func (e *RaidEvent) Decode(m *irc.Message) error {
+	*e = RaidEvent{}
+	if err := e.UserNoticeEvent.decode(m, "raid"); err != nil {
+		return err
+	}
+	e.Viewers = intTag(m, "msg-param-viewerCount")
+	return nil
+}
+
+// RitualEvent is a ritual, such as a new viewer's first message in the channel ("new_chatter").
+type RitualEvent struct {
+	UserNoticeEvent
+
+	// Ritual is the name of the ritual, e.g. "new_chatter".
+	Ritual string
+}
+
+// Command implements irc.Event.
+func (e *RitualEvent) Command() irc.Command { return CmdUserNotice }
+
+// Decode implements irc.Event. m must be a USERNOTICE with a msg-id of ritual.
+func (e *RitualEvent) Decode(m *irc.Message) error {
+	*e = RitualEvent{}
+	if err := e.UserNoticeEvent.decode(m, "ritual"); err != nil {
+		return err
+	}
+	e.Ritual = m.Tags.Get("msg-param-ritual-name")
+	return nil
+}
+
+// OnSub attaches a handler to r for new and renewed subscriptions.
+// It's a shortcut for irc.On, and returns the route for further matchers.
+func OnSub(r *irc.Router, h func(irc.MessageWriter, *SubEvent)) *irc.Route {
+	return irc.On(r, h)
+}
+
+// OnSubGift attaches a handler to r for gifted subscriptions.
+func OnSubGift(r *irc.Router, h func(irc.MessageWriter, *SubGiftEvent)) *irc.Route {
+	return irc.On(r, h)
+}
+
+// OnRaid attaches a handler to r for raids.
+func OnRaid(r *irc.Router, h func(irc.MessageWriter, *RaidEvent)) *irc.Route {
+	return irc.On(r, h)
+}
+
+// OnRitual attaches a handler to r for rituals.
+func OnRitual(r *irc.Router, h func(irc.MessageWriter, *RitualEvent)) *irc.Route {
+	return irc.On(r, h)
+}
+
+// intTag returns the value of the tag key as an int, or 0 if it's missing or not a number.
+func intTag(m *irc.Message, key string) int {
+	n, _ := strconv.Atoi(m.Tags.Get(key))
+	return n
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,104 @@
+/*
+Package twitch contains helpers for bots connected to Twitch chat, which is built on IRC
+but describes users with IRCv3 message tags instead of channel modes.
+
+The roles of users are in the "badges" tag of each message, and the predicates in this package
+can be used as route matchers so that handlers don't need to parse the tag:
+
+	r.OnText("!so &", shoutout).MatchFunc(twitch.IsMod)
+
+The tags are only sent when the twitch.tv/tags capability is enabled; see Caps.
+
+Twitch limits how many messages a bot may send per 30 seconds rather than their rate.
+irc.Client paces its messages with irc.TwitchFlood when it's connected to Twitch,
+which needs the tags and commands capabilities to learn the bot's roles and each channel's slow mode.
+*/
+package twitch
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/Travis-Britz/irc"
+)
+
+// Caps are the Twitch capabilities a bot usually wants, for irc.Client.Caps:
+// tags for user roles and message IDs, commands for USERNOTICE, ROOMSTATE, etc.,
+// and membership for JOIN and PART of other users.
+var Caps = []string{"twitch.tv/tags", "twitch.tv/commands", "twitch.tv/membership"}
+
+// OAuth returns an irc.Authenticator which logs in to Twitch chat with an OAuth token, for irc.Client.Auth.
+// The token is sent as the connection password, with the "oauth:" prefix Twitch requires added if it's missing.
+//
+// A failed login is reported to the client's ErrorLog; Twitch closes the connection after it.
+func OAuth(token string) irc.Authenticator {
+	if !strings.HasPrefix(token, "oauth:") {
+		token = "oauth:" + token
+	}
+	return irc.AuthFunc(func(w irc.MessageWriter, a *irc.Auth) irc.Handler {
+		w.WriteMessage(irc.Pass(token))
+		return irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+			switch cmd := m.Command.String(); {
+			case cmd == irc.RplWelcome:
+				a.Done(nil)
+			case strings.EqualFold(cmd, irc.CmdNotice):
+				// Twitch only sends a NOTICE before RPL_WELCOME when the login failed,
+				// e.g. "Login authentication failed" or "Improperly formatted auth"
+				a.Done(errors.New("twitch: " + m.Params.Get(2)))
+			}
+		})
+	})
+}
+
+// A Badge is a badge shown next to a user's name in chat, such as "subscriber" or "moderator".
+// Version distinguishes variations of a badge, e.g. the subscription tier or length.
+type Badge struct {
+	Name    string
+	Version string
+}
+
+// Badges returns the badges of the sender of m, in the order shown in chat.
+func Badges(m *irc.Message) []Badge {
+	tag := m.Tags.Get("badges")
+	if tag == "" {
+		return nil
+	}
+	var badges []Badge
+	for _, b := range strings.Split(tag, ",") {
+		name, version, _ := strings.Cut(b, "/")
+		badges = append(badges, Badge{Name: name, Version: version})
+	}
+	return badges
+}
+
+// HasBadge reports whether the sender of m has the badge name.
+func HasBadge(m *irc.Message, name string) bool {
+	for _, b := range Badges(m) {
+		if b.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// IsBroadcaster reports whether m was sent by the owner of the channel.
+func IsBroadcaster(m *irc.Message) bool {
+	return HasBadge(m, "broadcaster")
+}
+
+// IsMod reports whether m was sent by a moderator of the channel.
+// The broadcaster has every moderator permission, so IsMod is also true for the broadcaster.
+func IsMod(m *irc.Message) bool {
+	return m.Tags.Get("mod") == "1" || HasBadge(m, "moderator") || IsBroadcaster(m)
+}
+
+// IsVIP reports whether m was sent by a VIP of the channel.
+func IsVIP(m *irc.Message) bool {
+	return m.Tags.Has("vip") || HasBadge(m, "vip")
+}
+
+// IsSubscriber reports whether m was sent by a subscriber of the channel.
+// Founders, the first subscribers of a channel, have a founder badge in place of the subscriber badge.
+func IsSubscriber(m *irc.Message) bool {
+	return m.Tags.Get("subscriber") == "1" || HasBadge(m, "subscriber") || HasBadge(m, "founder")
+}
@@ -0,0 +1,184 @@
+package twitch_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Travis-Britz/irc"
+	"github.com/Travis-Britz/irc/twitch"
+)
+
+type discard struct{}
+
+func (discard) WriteMessage(m encoding.TextMarshaler) {}
+
+func TestRoles(t *testing.T) {
+	var got []string
+	r := &irc.Router{}
+	r.OnText("!ban *", func(w irc.MessageWriter, m *irc.Message) {
+		got = append(got, "ban by "+m.Source.Nick.String())
+	}).MatchFunc(twitch.IsMod)
+	r.OnText("!perk", func(w irc.MessageWriter, m *irc.Message) {
+		got = append(got, "perk for "+m.Source.Nick.String())
+	}).MatchFunc(twitch.IsSubscriber)
+	r.OnText("*", func(w irc.MessageWriter, m *irc.Message) {
+		got = append(got, "ignored "+m.Source.Nick.String())
+	})
+
+	for _, line := range []string{
+		"@badges=broadcaster/1,subscriber/0;mod=0 :owner!owner@owner.tmi.twitch.tv PRIVMSG #owner :!ban troll",
+		"@badges=moderator/1;mod=1 :helper!helper@helper.tmi.twitch.tv PRIVMSG #owner :!ban troll",
+		"@badges=founder/0;mod=0;subscriber=0 :fan!fan@fan.tmi.twitch.tv PRIVMSG #owner :!perk",
+		"@badges=;mod=0 :viewer!viewer@viewer.tmi.twitch.tv PRIVMSG #owner :!ban owner",
+		"@badges=;mod=0 :viewer!viewer@viewer.tmi.twitch.tv PRIVMSG #owner :!perk",
+	} {
+		m := new(irc.Message)
+		if err := m.UnmarshalText([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+		r.SpeakIRC(discard{}, m)
+	}
+
+	want := []string{"ban by owner", "ban by helper", "perk for fan", "ignored viewer", "ignored viewer"}
+	if len(got) != len(want) {
+		t.Fatalf("expected %q; got %q", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("expected %q; got %q", want[i], got[i])
+		}
+	}
+
+	m := new(irc.Message)
+	_ = m.UnmarshalText([]byte("@badges=subscriber/3012,premium/1 :fan!fan@fan.tmi.twitch.tv PRIVMSG #owner :hi"))
+	badges := twitch.Badges(m)
+	if len(badges) != 2 || badges[0] != (twitch.Badge{Name: "subscriber", Version: "3012"}) {
+		t.Errorf("unexpected badges: %v", badges)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	var got []string
+	r := &irc.Router{}
+	twitch.OnSub(r, func(w irc.MessageWriter, e *twitch.SubEvent) {
+		got = append(got, fmt.Sprintf("%s sub resub=%t months=%d streak=%d tier=%s text=%q", e.DisplayName, e.Resub, e.CumulativeMonths, e.StreakMonths, e.Tier, e.Text))
+	})
+	twitch.OnSubGift(r, func(w irc.MessageWriter, e *twitch.SubGiftEvent) {
+		got = append(got, fmt.Sprintf("%s gift to %s anonymous=%t months=%d", e.DisplayName, e.Recipient, e.Anonymous, e.Months))
+	})
+	twitch.OnRaid(r, func(w irc.MessageWriter, e *twitch.RaidEvent) {
+		got = append(got, fmt.Sprintf("%s raid viewers=%d", e.Login, e.Viewers))
+	}).MatchFunc(func(m *irc.Message) bool { return m.Params.Get(1) == "#owner" })
+	twitch.OnRitual(r, func(w irc.MessageWriter, e *twitch.RitualEvent) {
+		got = append(got, e.Login+" ritual "+e.Ritual)
+	})
+	irc.On(r, func(w irc.MessageWriter, e *twitch.UserNoticeEvent) {
+		got = append(got, "other "+e.ID+": "+e.SystemMsg)
+	})
+
+	for _, line := range []string{
+		`@badges=subscriber/0;display-name=Alice;login=alice;msg-id=sub;msg-param-cumulative-months=1;msg-param-should-share-streak=0;msg-param-sub-plan=Prime;system-msg=Alice\ssubscribed\swith\sPrime. :tmi.twitch.tv USERNOTICE #owner`,
+		`@display-name=Bob;login=bob;msg-id=resub;msg-param-cumulative-months=14;msg-param-should-share-streak=1;msg-param-streak-months=3;msg-param-sub-plan=2000 :tmi.twitch.tv USERNOTICE #owner :still here`,
+		`@display-name=AnAnonymousGifter;login=ananonymousgifter;user-id=274598607;msg-id=subgift;msg-param-recipient-user-name=carol;msg-param-sub-plan=1000 :tmi.twitch.tv USERNOTICE #owner`,
+		`@display-name=Streamer;login=streamer;msg-id=raid;msg-param-viewerCount=1234 :tmi.twitch.tv USERNOTICE #owner`,
+		`@display-name=Streamer;login=streamer;msg-id=raid;msg-param-viewerCount=5;system-msg=Raid\selsewhere :tmi.twitch.tv USERNOTICE #other`,
+		`@login=newbie;msg-id=ritual;msg-param-ritual-name=new_chatter :tmi.twitch.tv USERNOTICE #owner :HeyGuys`,
+		`@login=owner;msg-id=announcement;system-msg=Announcement :tmi.twitch.tv USERNOTICE #owner :hello chat`,
+	} {
+		m := new(irc.Message)
+		if err := m.UnmarshalText([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+		r.SpeakIRC(discard{}, m)
+	}
+
+	want := []string{
+		`Alice sub resub=false months=1 streak=0 tier=Prime text=""`,
+		`Bob sub resub=true months=14 streak=3 tier=2000 text="still here"`,
+		`AnAnonymousGifter gift to carol anonymous=true months=1`,
+		`streamer raid viewers=1234`,
+		`other raid: Raid elsewhere`,
+		`newbie ritual new_chatter`,
+		`other announcement: Announcement`,
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %q; got %q", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("expected %q; got %q", want[i], got[i])
+		}
+	}
+}
+
+func TestUserNoticeEvent_Decode(t *testing.T) {
+	m := &irc.Message{Command: "usernotice", Params: irc.Params{"#owner"}, Tags: irc.Tags{"msg-id": "raid"}}
+	var e twitch.RaidEvent
+	if err := e.Decode(m); err != nil {
+		t.Errorf("expected a lowercase command to decode; got %v", err)
+	}
+	if err := e.Decode(&irc.Message{Command: irc.CmdPrivmsg, Params: irc.Params{"#owner", "hi"}}); err == nil {
+		t.Errorf("expected a PRIVMSG not to decode")
+	}
+}
+
+func TestOAuth(t *testing.T) {
+	for _, tt := range []struct {
+		token    string
+		welcomed bool
+		logged   string
+	}{
+		{"good", true, ""},
+		{"oauth:good", true, ""},
+		{"bad", false, "twitch: Login authentication failed"},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		clientConn, serverConn := irc.Pipe()
+		go func() {
+			defer serverConn.Close()
+			var pass string
+			scanner := bufio.NewScanner(serverConn)
+			for scanner.Scan() {
+				switch line := scanner.Text(); {
+				case strings.HasPrefix(line, "PASS"):
+					pass = line
+				case strings.HasPrefix(line, "USER"):
+					if pass != "PASS :oauth:good" {
+						// Twitch closes the connection after a failed login
+						fmt.Fprintf(serverConn, ":tmi.twitch.tv NOTICE * :Login authentication failed\r\n")
+						return
+					}
+					fmt.Fprintf(serverConn, ":tmi.twitch.tv 001 bot :Welcome, GLHF!\r\n")
+				case strings.HasPrefix(line, "QUIT"):
+					return
+				}
+			}
+		}()
+
+		var errorLog bytes.Buffer
+		welcomed := false
+		client := &irc.Client{Nickname: "bot", Auth: []irc.Authenticator{twitch.OAuth(tt.token)}, ErrorLog: log.New(&errorLog, "", 0)}
+		client.DialFn = func() (io.ReadWriteCloser, error) { return clientConn, nil }
+		_ = client.ConnectAndRun(ctx, irc.HandlerFunc(func(w irc.MessageWriter, m *irc.Message) {
+			if m.Command == irc.RplWelcome {
+				welcomed = true
+				w.WriteMessage(irc.Quit("bye"))
+			}
+		}))
+		cancel()
+		if welcomed != tt.welcomed {
+			t.Errorf("%s: expected welcomed=%t", tt.token, tt.welcomed)
+		}
+		if tt.logged != "" && !strings.Contains(errorLog.String(), tt.logged) {
+			t.Errorf("%s: expected %q to be reported; got %q", tt.token, tt.logged, errorLog.String())
+		}
+	}
+}
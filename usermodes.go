@@ -0,0 +1,68 @@
+package irc
+
+import (
+	"sort"
+	"strings"
+)
+
+// UserModes returns the client's own user modes as tracked from MODE and RPL_UMODEIS (221), e.g. "iwx".
+// The modes are sorted, without a leading '+'. Servers don't always tell clients about the modes set while connecting;
+// send "MODE <nick>" to ask for them.
+func (c *Client) UserModes() string {
+	c.state.mu.RLock()
+	defer c.state.mu.RUnlock()
+	return c.state.umodes
+}
+
+// OnUserMode attaches a handler which is called when the client's own user modes change,
+// such as +x for a host cloak, +o for IRC operators, or +i.
+// change is the mode string of the MODE message, e.g. "+x" or "-i+w".
+// Client.UserModes already includes the change when h is called.
+// The router must know the client's nickname; see BindClient.
+func (r *Router) OnUserMode(h func(w MessageWriter, change string)) *route {
+	adapter := func(w MessageWriter, m *Message) {
+		h(w, m.Params.Get(2))
+	}
+	rt := r.HandleFunc(CmdMode, adapter).MatchFunc(func(m *Message) bool {
+		nick, ok := r.nick()
+		return ok && nick.Is(m.Params.Get(1))
+	})
+	rt.handler = funcName(h)
+	return rt
+}
+
+// applyModes returns the set of mode letters in modes after applying the mode string change, e.g. "+i-w".
+func applyModes(modes, change string) string {
+	set := make(map[rune]bool)
+	for _, r := range modes {
+		set[r] = true
+	}
+	add := true
+	for _, r := range change {
+		switch r {
+		case '+':
+			add = true
+		case '-':
+			add = false
+		case ' ':
+			// the parameters of modes such as +s (server notice masks) aren't modes
+			return sortedModes(set)
+		default:
+			if add {
+				set[r] = true
+			} else {
+				delete(set, r)
+			}
+		}
+	}
+	return sortedModes(set)
+}
+
+func sortedModes(set map[rune]bool) string {
+	modes := make([]string, 0, len(set))
+	for r := range set {
+		modes = append(modes, string(r))
+	}
+	sort.Strings(modes)
+	return strings.Join(modes, "")
+}